@@ -0,0 +1,159 @@
+package torus
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+var auditLogger = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "audit")
+
+// Operations recorded in the audit log.
+const (
+	AuditInit              = "init"
+	AuditPeerAdd           = "peer-add"
+	AuditPeerRemove        = "peer-remove"
+	AuditPeerEvict         = "peer-evict"
+	AuditPeerAutoEvict     = "peer-auto-evict"
+	AuditPeerDrain         = "peer-drain"
+	AuditPeerUndrain       = "peer-undrain"
+	AuditPeerCordon        = "peer-cordon"
+	AuditPeerUncordon      = "peer-uncordon"
+	AuditPeerResize        = "peer-resize"
+	AuditRingChange        = "ring-change"
+	AuditReplicationChange = "replication-change"
+	AuditRingRollback      = "ring-rollback"
+	AuditRebalanceStart    = "rebalance-start"
+	AuditRebalanceFinish   = "rebalance-finish"
+	AuditRebalancePause    = "rebalance-pause"
+	AuditRebalanceResume   = "rebalance-resume"
+	AuditRebalanceLimit    = "rebalance-limit"
+	AuditGCSettings        = "gc-settings"
+	AuditGCRun             = "gc-run"
+	AuditGCPass            = "gc-pass"
+	AuditVolumeCreate      = "volume-create"
+	AuditVolumeDelete      = "volume-delete"
+	AuditFsckRepair        = "fsck-repair"
+	AuditBlockUnlock       = "block-unlock"
+)
+
+// AuditEvent is one entry of the audit log.
+type AuditEvent struct {
+	// Seq numbers the entries of a log file, without gaps.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	// Source is who asked for the change: a node UUID, the remote address
+	// of an admin request, or by default the local user and host.
+	Source string `json:"source"`
+	// Node is the UUID of the node that recorded the event in the cluster
+	// event log.
+	Node string `json:"node,omitempty"`
+	// RingVersion is the version of the ring the operation resulted in.
+	RingVersion int               `json:"ring_version,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	Err         string            `json:"error,omitempty"`
+}
+
+// AuditLog records state-changing operations on the cluster. Every event is
+// logged through the "audit" package logger, and appended as a line of JSON
+// to the log file if there is one.
+type AuditLog struct {
+	mut sync.Mutex
+	f   *os.File
+	seq uint64
+}
+
+// OpenAuditLog opens the audit log file at path for appending, creating it if
+// needed, and carries on the sequence from its last entry. An empty path
+// returns an AuditLog that only logs.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEvent
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Seq > a.seq {
+			a.seq = e.Seq
+		}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.f = f
+	return a, nil
+}
+
+// Record stamps e with the time and the next sequence number and writes it
+// out, filling in the source if it's empty. Failing to write the file is
+// logged, but doesn't fail the operation being recorded.
+func (a *AuditLog) Record(e AuditEvent) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.seq++
+	e.Seq = a.seq
+	e.Time = time.Now().UTC()
+	if e.Source == "" {
+		e.Source = localAuditSource()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		auditLogger.Errorf("couldn't encode audit event: %v", err)
+		return
+	}
+	auditLogger.Info(string(b))
+	if a.f == nil {
+		return
+	}
+	b = append(b, '\n')
+	if _, err := a.f.Write(b); err != nil {
+		auditLogger.Errorf("couldn't write audit log %s: %v", a.f.Name(), err)
+		return
+	}
+	if err := a.f.Sync(); err != nil {
+		auditLogger.Errorf("couldn't sync audit log %s: %v", a.f.Name(), err)
+	}
+}
+
+// Close closes the log file.
+func (a *AuditLog) Close() error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// localAuditSource names the user running this process and the host it runs
+// on.
+func localAuditSource() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// AuditErr returns the text of err for AuditEvent.Err.
+func AuditErr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,76 @@
+package torus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(AuditEvent{Op: AuditPeerAdd, Source: "peer-a", RingVersion: 2})
+	a.Record(AuditEvent{Op: AuditPeerRemove, RingVersion: 3, Err: AuditErr(errors.New("boom"))})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening carries on the sequence.
+	a, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(AuditEvent{Op: AuditRingChange, Source: "peer-a", RingVersion: 4})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []AuditEvent
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("bad audit line %q: %v", sc.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	ops := []string{AuditPeerAdd, AuditPeerRemove, AuditRingChange}
+	for i, e := range events {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("event %d: expected seq %d, got %d", i, i+1, e.Seq)
+		}
+		if e.Op != ops[i] {
+			t.Errorf("event %d: expected op %s, got %s", i, ops[i], e.Op)
+		}
+		if e.Time.IsZero() || e.Source == "" {
+			t.Errorf("event %d: missing time or source: %+v", i, e)
+		}
+		if i > 0 && e.Time.Before(events[i-1].Time) {
+			t.Errorf("event %d is older than the one before it", i)
+		}
+	}
+	if events[1].Err != "boom" {
+		t.Errorf("expected the error to be recorded, got %q", events[1].Err)
+	}
+}
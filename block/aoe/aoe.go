@@ -13,6 +13,7 @@ import (
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/mdlayher/aoe"
+	"github.com/mdlayher/ethernet"
 	"github.com/mdlayher/raw"
 	"golang.org/x/net/bpf"
 	"golang.org/x/net/context"
@@ -23,6 +24,25 @@ var (
 	broadcastAddr = net.HardwareAddr([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 )
 
+const (
+	// standardMTU is the MTU of Ethernet without jumbo frames.
+	standardMTU = 1500
+	// ethernetHeaderLen is the length of the Ethernet header, which the
+	// MTU doesn't count.
+	ethernetHeaderLen = 14
+	// aoeHeaderLen and ataArgLen are the lengths of the headers ahead of
+	// the data in the frame of an ATA request or reply.
+	aoeHeaderLen = 10
+	ataArgLen    = 12
+
+	// probeTimeout bounds sending the jumbo frame probing the interface.
+	probeTimeout = time.Second
+	// jumboResends is how many requests in a row answered with jumbo
+	// frames clients may send again before we take it that the network
+	// drops jumbo frames, and fall back to standard ones.
+	jumboResends = 3
+)
+
 type Server struct {
 	dfs *block.BlockVolume
 
@@ -36,6 +56,22 @@ type Server struct {
 	minor uint8
 
 	usingBPF bool
+
+	// mtu is the size of the frames served: the interface's MTU, or
+	// mtuOption, unless jumbo frames turned out not to work.
+	mtu       int
+	mtuOption int
+	// clients holds the last ATA request of each client, by its hardware
+	// address, to tell requests sent again.
+	clients map[string]*lastRequest
+	// resends counts the requests in a row sent again after a jumbo reply.
+	resends int
+}
+
+type lastRequest struct {
+	tag [4]byte
+	// jumbo is set if the reply didn't fit a standard frame.
+	jumbo bool
 }
 
 // ServerOptions specifies options for a Server.
@@ -48,12 +84,28 @@ type ServerOptions struct {
 	// network must have different major and minor addresses.
 	Major uint16
 	Minor uint8
+
+	// ReadOnly serves the volume with a shared lock, alongside other
+	// read-only servers, refusing writes.
+	ReadOnly bool
+
+	// MTU overrides the MTU of the interface served on, which sets how
+	// many sectors each frame carries. Zero uses the interface's.
+	MTU int
 }
 
 // NewServer creates a new Server which utilizes the specified block volume.
 // If options is nil, DefaultServerOptions will be used.
 func NewServer(b *block.BlockVolume, options *ServerOptions) (*Server, error) {
-	f, err := b.OpenBlockFile()
+	var (
+		f   *block.BlockFile
+		err error
+	)
+	if options.ReadOnly {
+		f, err = b.OpenBlockFileShared()
+	} else {
+		f, err = b.OpenBlockFile()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -75,6 +127,9 @@ func NewServer(b *block.BlockVolume, options *ServerOptions) (*Server, error) {
 		wg:     wg,
 		major:  options.Major,
 		minor:  options.Minor,
+
+		mtuOption: options.MTU,
+		clients:   make(map[string]*lastRequest),
 	}
 
 	return as, nil
@@ -113,11 +168,113 @@ type bpfPacketConn interface {
 // raw.Conn is a bpfPacketConn.
 var _ bpfPacketConn = &raw.Conn{}
 
+// negotiateMTU returns the MTU to serve on iface with. Jumbo frames are
+// given up on for standard ones if iface won't send one.
+func (s *Server) negotiateMTU(iface *Interface) int {
+	mtu := iface.MTU
+	if s.mtuOption != 0 {
+		mtu = s.mtuOption
+	}
+	if mtu <= standardMTU {
+		return mtu
+	}
+	if err := s.probe(iface, mtu); err != nil {
+		clog.Warningf("%s can't send %d byte frames, falling back to %d: %v", iface.Name, mtu, standardMTU, err)
+		promJumboFallbacks.Inc()
+		return standardMTU
+	}
+	return mtu
+}
+
+// probe broadcasts the configuration of the server, padded to fill a frame of
+// mtu bytes.
+func (s *Server) probe(iface *Interface, mtu int) error {
+	hdr := &aoe.Header{
+		Version:      aoe.Version,
+		FlagResponse: true,
+		Major:        s.major,
+		Minor:        s.minor,
+		Command:      aoe.CommandQueryConfigInformation,
+		Arg:          defaultConfig(mtu),
+	}
+	hbuf, err := hdr.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, mtu)
+	copy(payload, hbuf)
+	frame := &ethernet.Frame{
+		Destination: broadcastAddr,
+		Source:      iface.HardwareAddr,
+		EtherType:   aoe.EtherType,
+		Payload:     payload,
+	}
+	ebuf, err := frame.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	// A send that doesn't go through mustn't hold up serving.
+	if err := iface.SetWriteDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return err
+	}
+	defer iface.SetWriteDeadline(time.Time{})
+	if _, err := iface.WriteTo(ebuf, &raw.Addr{HardwareAddr: broadcastAddr}); err != nil {
+		return err
+	}
+	promFramesSent.Inc()
+	return nil
+}
+
+// noteRequest records an ATA request from a client, returning whether it
+// repeats the client's last one.
+func (s *Server) noteRequest(client net.HardwareAddr, hdr *aoe.Header) bool {
+	last, ok := s.clients[client.String()]
+	if !ok {
+		last = &lastRequest{}
+		s.clients[client.String()] = last
+	}
+	if ok && last.tag == hdr.Tag {
+		promFramesRetransmitted.Inc()
+		if last.jumbo {
+			s.resends++
+		}
+		return true
+	}
+	if last.jumbo {
+		// The last jumbo reply got through.
+		s.resends = 0
+	}
+	last.tag = hdr.Tag
+	return false
+}
+
+// fallBack has the server use standard frames rather than jumbo ones, and
+// advertises its configuration with the fewer sectors a frame carries, which
+// has clients follow.
+func (s *Server) fallBack(iface *Interface) {
+	clog.Warningf("clients keep sending requests answered with %d byte frames again; the network seems to drop jumbo frames, falling back to %d", s.mtu, standardMTU)
+	promJumboFallbacks.Inc()
+	s.mtu = standardMTU
+	s.resends = 0
+	if err := s.advertise(iface); err != nil {
+		clog.Errorf("advertisement failed: %v", err)
+	}
+}
+
 func (s *Server) Serve(iface *Interface) error {
+	s.mtu = s.negotiateMTU(iface)
+	// Read frames as large as the interface can take, even once we serve
+	// smaller ones.
+	frameLen := iface.MTU
+	if s.mtu > frameLen {
+		frameLen = s.mtu
+	}
+	frameLen += ethernetHeaderLen
+
 	// If available, attach a BPF filter to net.PacketConn.
 	if bp, ok := iface.PacketConn.(bpfPacketConn); ok {
 		clog.Debugf("attaching BPF program to %T", bp)
-		if err := bp.SetBPF(s.mustAssembleBPF(iface.MTU)); err != nil {
+		if err := bp.SetBPF(s.mustAssembleBPF(frameLen)); err != nil {
 			// If user does not have permission to attach a BPF filter to an
 			// interface, continue without one
 			if !os.IsPermission(err) {
@@ -131,7 +288,7 @@ func (s *Server) Serve(iface *Interface) error {
 		}
 	}
 
-	fmt.Printf("Attached to AoE device (%s, Major: %d, Minor: %d). Server loop begins ... \n", iface.Name, s.major, s.minor)
+	fmt.Printf("Attached to AoE device (%s, Major: %d, Minor: %d, MTU: %d). Server loop begins ... \n", iface.Name, s.major, s.minor, s.mtu)
 
 	// Start goroutine to sync device at regular intervals, and halt when
 	// the Server's Close method is called.
@@ -159,7 +316,7 @@ func (s *Server) Serve(iface *Interface) error {
 	}
 
 	for {
-		payload := make([]byte, iface.MTU)
+		payload := make([]byte, frameLen)
 		n, addr, err := iface.ReadFrom(payload)
 		if err != nil {
 			clog.Errorf("ReadFrom failed: %v", err)
@@ -172,6 +329,7 @@ func (s *Server) Serve(iface *Interface) error {
 
 		// resize payload
 		payload = payload[:n]
+		promFramesReceived.Inc()
 
 		var f Frame
 		if err := f.UnmarshalBinary(payload); err != nil {
@@ -220,7 +378,14 @@ func (s *Server) handleFrame(from net.Addr, iface *Interface, f *Frame) (int, er
 
 	switch hdr.Command {
 	case aoe.CommandIssueATACommand:
+		resent := s.noteRequest(sender.dst, hdr)
+		if resent && s.resends >= jumboResends && s.mtu > standardMTU {
+			s.fallBack(iface)
+		}
 		n, err := aoe.ServeATA(sender, hdr, s.dev)
+		if last, ok := s.clients[sender.dst.String()]; ok {
+			last.jumbo = sender.sent > standardMTU+ethernetHeaderLen
+		}
 		if err != nil {
 			clog.Errorf("ServeATA failed: %v", err)
 			switch err {
@@ -238,7 +403,7 @@ func (s *Server) handleFrame(from net.Addr, iface *Interface, f *Frame) (int, er
 
 		switch cfgarg.Command {
 		case aoe.ConfigCommandRead:
-			hdr.Arg = defaultConfig(iface.MTU)
+			hdr.Arg = defaultConfig(s.mtu)
 
 			return sender.Send(hdr)
 		}
@@ -261,24 +426,36 @@ func (s *Server) Close() error {
 	return s.dev.Close()
 }
 
+// frameSectors returns how many sectors fit in the frame of an ATA request
+// or reply on a network with the given MTU.
+func frameSectors(mtu int) uint8 {
+	n := (mtu - aoeHeaderLen - ataArgLen) / 512
+	switch {
+	case n < 1:
+		return 1
+	case n > 255:
+		return 255
+	}
+	return uint8(n)
+}
+
 // defaultConfig is the default AoE server configuration.
 func defaultConfig(mtu int) *aoe.ConfigArg {
 	return &aoe.ConfigArg{
 		// if < 2, linux aoe handles it poorly
 		BufferCount:     2,
 		FirmwareVersion: 0,
-		// naive, but works.
-		SectorCount:  uint8(mtu / 512),
-		Version:      aoe.Version,
-		Command:      aoe.ConfigCommandRead,
-		StringLength: 0,
-		String:       []byte{},
+		SectorCount:     frameSectors(mtu),
+		Version:         aoe.Version,
+		Command:         aoe.ConfigCommandRead,
+		StringLength:    0,
+		String:          []byte{},
 	}
 }
 
 // mustAssembleBPF assembles a BPF program to filter out packets not bound
-// for this server.
-func (s *Server) mustAssembleBPF(mtu int) []bpf.RawInstruction {
+// for this server, accepting frames up to frameLen bytes.
+func (s *Server) mustAssembleBPF(frameLen int) []bpf.RawInstruction {
 	// This BPF program filters out packets that are not bound for this server
 	// by checking against both the AoE broadcast addresses and this server's
 	// major/minor address combination.  The structure of the incoming ethernet
@@ -353,9 +530,9 @@ func (s *Server) mustAssembleBPF(mtu int) []bpf.RawInstruction {
 		bpf.RetConstant{
 			Val: 0,
 		},
-		// Accept the packet bytes up to the interface's MTU
+		// Accept the packet bytes up to the frame length
 		bpf.RetConstant{
-			Val: uint32(mtu),
+			Val: uint32(frameLen),
 		},
 	})
 	if err != nil {
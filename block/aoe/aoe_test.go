@@ -425,3 +425,90 @@ func (noopPacketConn) LocalAddr() net.Addr                          { return nil
 func (noopPacketConn) SetDeadline(t time.Time) error                { return nil }
 func (noopPacketConn) SetReadDeadline(t time.Time) error            { return nil }
 func (noopPacketConn) SetWriteDeadline(t time.Time) error           { return nil }
+
+func TestFrameSectors(t *testing.T) {
+	for _, tt := range []struct {
+		mtu  int
+		want uint8
+	}{
+		{1500, 2},
+		{9000, 17},
+		{100, 1},
+		{1 << 20, 255},
+	} {
+		if got := frameSectors(tt.mtu); got != tt.want {
+			t.Errorf("frameSectors(%d): want %d, got %d", tt.mtu, tt.want, got)
+		}
+	}
+}
+
+// A failPacketConn is a net.PacketConn which can't send.
+type failPacketConn struct {
+	noopPacketConn
+}
+
+func (failPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, syscall.EMSGSIZE
+}
+
+func TestNegotiateMTU(t *testing.T) {
+	iface := &Interface{
+		Interface: &net.Interface{
+			Name: "lo",
+			MTU:  testMTU,
+		},
+		PacketConn: &noopPacketConn{},
+	}
+	s := &Server{}
+	if got := s.negotiateMTU(iface); got != testMTU {
+		t.Fatalf("expected MTU %d, got %d", testMTU, got)
+	}
+	s.mtuOption = 4000
+	if got := s.negotiateMTU(iface); got != 4000 {
+		t.Fatalf("expected the MTU option to be used, got %d", got)
+	}
+	iface.PacketConn = &failPacketConn{}
+	if got := s.negotiateMTU(iface); got != standardMTU {
+		t.Fatalf("expected to fall back to %d when jumbo frames can't be sent, got %d", standardMTU, got)
+	}
+}
+
+func TestJumboFallback(t *testing.T) {
+	iface := &Interface{
+		Interface: &net.Interface{
+			Name: "lo",
+			MTU:  testMTU,
+		},
+		PacketConn: &noopPacketConn{},
+	}
+	s := &Server{
+		mtu:     testMTU,
+		clients: make(map[string]*lastRequest),
+	}
+	client := rawAddr.HardwareAddr
+	req := func(tag byte, jumbo bool) bool {
+		hdr := &aoe.Header{Tag: [4]byte{tag}}
+		resent := s.noteRequest(client, hdr)
+		s.clients[client.String()].jumbo = jumbo
+		return resent
+	}
+	// A jumbo reply that got through resets the count.
+	req(1, true)
+	req(1, true)
+	req(2, true)
+	if s.resends != 0 {
+		t.Fatalf("expected no resends pending, got %d", s.resends)
+	}
+	for i := 0; i < jumboResends; i++ {
+		if !req(2, true) {
+			t.Fatal("expected the request to be taken as sent again")
+		}
+	}
+	if s.resends != jumboResends {
+		t.Fatalf("expected %d resends, got %d", jumboResends, s.resends)
+	}
+	s.fallBack(iface)
+	if s.mtu != standardMTU {
+		t.Fatalf("expected to fall back to %d, got %d", standardMTU, s.mtu)
+	}
+}
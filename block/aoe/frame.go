@@ -39,6 +39,9 @@ type FrameSender struct {
 
 	major uint16
 	minor uint8
+
+	// sent is the length of the last frame sent.
+	sent int
 }
 
 func (fs *FrameSender) Send(hdr *aoe.Header) (int, error) {
@@ -68,7 +71,12 @@ func (fs *FrameSender) Send(hdr *aoe.Header) (int, error) {
 	clog.Tracef("send: %d %s %+v", len(ebuf), fs.dst, hdr)
 	clog.Tracef("send arg: %+v", hdr.Arg)
 
-	return fs.conn.WriteTo(ebuf, &raw.Addr{HardwareAddr: fs.dst})
+	n, err := fs.conn.WriteTo(ebuf, &raw.Addr{HardwareAddr: fs.dst})
+	if err == nil {
+		fs.sent = len(ebuf)
+		promFramesSent.Inc()
+	}
+	return n, err
 }
 
 func (fs *FrameSender) SendError(aerr aoe.Error) (int, error) {
@@ -0,0 +1,29 @@
+package aoe
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	promFramesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_aoe_frames_sent_total",
+		Help: "Number of AoE frames sent",
+	})
+	promFramesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_aoe_frames_received_total",
+		Help: "Number of AoE frames received",
+	})
+	promFramesRetransmitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_aoe_frames_retransmitted_total",
+		Help: "Number of AoE requests received again, because the client didn't get the reply",
+	})
+	promJumboFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_aoe_jumbo_fallbacks_total",
+		Help: "Number of times jumbo frames were given up on for standard ones",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promFramesSent)
+	prometheus.MustRegister(promFramesReceived)
+	prometheus.MustRegister(promFramesRetransmitted)
+	prometheus.MustRegister(promJumboFallbacks)
+}
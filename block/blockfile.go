@@ -1,6 +1,8 @@
 package block
 
 import (
+	"time"
+
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/blockset"
 	"golang.org/x/net/context"
@@ -9,13 +11,28 @@ import (
 type BlockFile struct {
 	*torus.File
 	vol *BlockVolume
+	// locked is set if the file holds the volume's write lock, and shared
+	// if it holds a shared one.
+	locked bool
+	shared bool
+	// unsynced is the INode written by a Sync that couldn't make it
+	// durable, and is still to be made the volume's current one.
+	unsynced torus.INodeRef
+	// buf coalesces the writes to the file, if enabled.
+	buf *writeBuffer
+	// qos holds back reads and writes to the volume's QoS limits.
+	qos *qosLimiter
 }
 
 func (s *BlockVolume) OpenBlockFile() (file *BlockFile, err error) {
 	if s.volume.Type != VolumeType {
 		panic("Wrong type")
 	}
-	if err = s.mds.Lock(s.srv.Lease()); err != nil {
+	gen, err := s.mds.Lock(s.srv.Lease())
+	if err == torus.ErrLocked {
+		return nil, s.lockedError()
+	}
+	if err != nil {
 		return nil, err
 	}
 	defer func() {
@@ -37,33 +54,121 @@ func (s *BlockVolume) OpenBlockFile() (file *BlockFile, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = s.unlock(bs); err != nil {
+		return nil, err
+	}
 	f, err := s.srv.CreateFile(s.volume, inode, bs)
 	if err != nil {
 		return nil, err
 	}
+	f.SetLockGeneration(gen)
+	cfg := s.srv.Cfg
 	return &BlockFile{
-		File: f,
-		vol:  s,
+		File:   f,
+		vol:    s,
+		locked: true,
+		buf:    newWriteBuffer(f, s.volume.Name, int64(s.srv.Blocks.BlockSize()), cfg.WriteCoalesceWindow, cfg.WriteBufferBytes),
+		qos:    newQoSLimiter(s.srv.MDS, s.volume),
 	}, nil
 }
 
-func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
+// ForceOpenBlockFile is OpenBlockFile, taking the volume's write lock over
+// from a holder that hasn't heartbeat for staleAfter, such as one on a host
+// that crashed. The lease the holder took the lock under is revoked, and
+// peers refuse the writes it still makes once they have seen ours. A holder
+// that heartbeat more recently keeps the lock, and a *LockedError is
+// returned.
+func (s *BlockVolume) ForceOpenBlockFile(staleAfter time.Duration) (*BlockFile, error) {
+	f, err := s.OpenBlockFile()
+	lerr, ok := err.(*LockedError)
+	if !ok {
+		return f, err
+	}
+	if err := breakStaleLock(s.srv.MDS, s.mds, s.volume.Name, &lerr.Holder, staleAfter); err != nil {
+		return nil, err
+	}
+	return s.OpenBlockFile()
+}
+
+// lockedError describes the holder of the volume's write lock, which locking
+// the volume found taken.
+func (s *BlockVolume) lockedError() error {
+	h, err := s.mds.LockHolder()
+	if err != nil || h == nil {
+		return torus.ErrLocked
+	}
+	// The holder is worth reporting even if we can't tell when it last
+	// heartbeat.
+	seen, _ := lastSeen(s.srv.MDS, h.UUID)
+	return &LockedError{Holder: *h, LastSeen: seen}
+}
+
+// OpenBlockFileReadOnly opens the current state of the volume for reading.
+// It doesn't take the volume's write lock, so any number of readers can open
+// the volume alongside its writer. Readers keep seeing the volume as it was
+// when they opened it; writes to the file fail with torus.ErrReadOnly.
+//
+// Blocks the writer replaces are garbage collected eventually, so long-lived
+// readers, such as backups, should open a snapshot instead.
+func (s *BlockVolume) OpenBlockFileReadOnly() (*BlockFile, error) {
 	if s.volume.Type != VolumeType {
 		panic("wrong type")
 	}
-	snaps, err := s.mds.GetSnapshots()
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return nil, err
+	}
+	inode, err := s.getOrCreateBlockINode(ref)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), s.srv.Blocks)
 	if err != nil {
 		return nil, err
 	}
-	var found Snapshot
-	for _, x := range snaps {
-		if x.Name == name {
-			found = x
-			break
+	if err = s.unlock(bs); err != nil {
+		return nil, err
+	}
+	f, err := s.srv.CreateFile(s.volume, inode, bs)
+	if err != nil {
+		return nil, err
+	}
+	f.ReadOnly = true
+	return &BlockFile{
+		File: f,
+		vol:  s,
+		qos:  newQoSLimiter(s.srv.MDS, s.volume),
+	}, nil
+}
+
+// OpenBlockFileShared opens the volume read-only, holding a shared lock on it
+// until the file is closed. Any number of shared readers can open the volume
+// at once, but not while it is open for writing, so it doesn't change under
+// them; OpenBlockFile fails with a *ReadersError while any are open.
+func (s *BlockVolume) OpenBlockFileShared() (file *BlockFile, err error) {
+	if err = s.mds.LockShared(s.srv.Lease()); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.mds.UnlockShared()
 		}
+	}()
+	file, err = s.OpenBlockFileReadOnly()
+	if err != nil {
+		return nil, err
 	}
-	if found.Name != name {
-		return nil, torus.ErrNotExist
+	file.shared = true
+	return file, nil
+}
+
+func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	found, err := s.findSnapshot(name)
+	if err != nil {
+		return nil, err
 	}
 	ref := torus.INodeRefFromBytes(found.INodeRef)
 	inode, err := s.getOrCreateBlockINode(ref)
@@ -74,6 +179,9 @@ func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = s.unlock(bs); err != nil {
+		return nil, err
+	}
 	f, err := s.srv.CreateFile(s.volume, inode, bs)
 	if err != nil {
 		return nil, err
@@ -82,6 +190,7 @@ func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
 	return &BlockFile{
 		File: f,
 		vol:  s,
+		qos:  newQoSLimiter(s.srv.MDS, s.volume),
 	}, nil
 }
 
@@ -89,32 +198,33 @@ func (s *BlockVolume) RestoreSnapshot(name string) (err error) {
 	if s.volume.Type != VolumeType {
 		panic("Wrong type")
 	}
-	if err = s.mds.Lock(s.srv.Lease()); err != nil {
+	if _, err = s.mds.Lock(s.srv.Lease()); err != nil {
+		if err == torus.ErrLocked {
+			return s.lockedError()
+		}
 		return err
 	}
 	defer s.mds.Unlock()
-	snaps, err := s.mds.GetSnapshots()
+	found, err := s.findSnapshot(name)
 	if err != nil {
 		return err
 	}
-	var found Snapshot
-	for _, x := range snaps {
-		if x.Name == name {
-			found = x
-			break
-		}
-	}
-	if found.Name != name {
-		return torus.ErrNotExist
-	}
 	ref := torus.INodeRefFromBytes(found.INodeRef)
 	return s.mds.SyncINode(ref)
 }
 
 func (f *BlockFile) Close() (err error) {
 	defer func() {
-		// No matter what attempt to release the lock.
-		unlockErr := f.vol.mds.Unlock()
+		var unlockErr error
+		switch {
+		case f.locked:
+			// No matter what attempt to release the lock.
+			unlockErr = f.vol.mds.Unlock()
+		case f.shared:
+			unlockErr = f.vol.mds.UnlockShared()
+		default:
+			return
+		}
 		if err == nil {
 			// TODO: Log unlock errors if err is not nil?
 			err = unlockErr
@@ -124,26 +234,132 @@ func (f *BlockFile) Close() (err error) {
 	if err = f.Sync(); err != nil {
 		return err
 	}
+	if err = f.buf.close(context.TODO()); err != nil {
+		return err
+	}
 	return f.File.Close()
 }
 
-func (f *BlockFile) inodeContext() context.Context {
-	return context.WithValue(context.TODO(), torus.CtxWriteLevel, torus.WriteAll)
+// WriteAt writes to the file at off. With write coalescing enabled, the write
+// is buffered, and applied to the file along with the others to the same
+// block by the next Sync, or once the coalescing window is up.
+func (f *BlockFile) WriteAt(b []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.TODO(), b, off)
+}
+
+// WriteAtContext is WriteAt as part of the operation in ctx.
+func (f *BlockFile) WriteAtContext(ctx context.Context, b []byte, off int64) (int, error) {
+	if err := f.qos.wait(ctx, len(b)); err != nil {
+		return 0, err
+	}
+	if f.buf == nil {
+		return f.File.WriteAtContext(ctx, b, off)
+	}
+	return f.buf.writeAt(ctx, b, off)
+}
+
+// ReadAt reads from the file at off, seeing the writes still buffered.
+func (f *BlockFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.TODO(), b, off)
+}
+
+// ReadAtContext is ReadAt as part of the operation in ctx.
+func (f *BlockFile) ReadAtContext(ctx context.Context, b []byte, off int64) (int, error) {
+	if err := f.qos.wait(ctx, len(b)); err != nil {
+		return 0, err
+	}
+	if f.buf == nil {
+		return f.File.ReadAtContext(ctx, b, off)
+	}
+	return f.buf.readAt(ctx, b, off)
+}
+
+func (f *BlockFile) Write(b []byte) (n int, err error) {
+	if err = f.qos.wait(context.TODO(), len(b)); err != nil {
+		return 0, err
+	}
+	err = f.buf.after(context.TODO(), func() error {
+		n, err = f.File.Write(b)
+		return err
+	})
+	return n, err
+}
+
+func (f *BlockFile) Read(b []byte) (n int, err error) {
+	if err = f.qos.wait(context.TODO(), len(b)); err != nil {
+		return 0, err
+	}
+	err = f.buf.after(context.TODO(), func() error {
+		n, err = f.File.Read(b)
+		return err
+	})
+	return n, err
+}
+
+func (f *BlockFile) Truncate(size int64) error {
+	return f.buf.after(context.TODO(), func() error {
+		return f.File.Truncate(size)
+	})
+}
+
+func (f *BlockFile) Trim(offset, length int64) error {
+	return f.buf.after(context.TODO(), func() error {
+		return f.File.Trim(offset, length)
+	})
+}
+
+// IsReadOnly reports whether the file refuses writes.
+func (f *BlockFile) IsReadOnly() bool {
+	return f.ReadOnly
+}
+
+func (f *BlockFile) inodeContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, torus.CtxWriteLevel, torus.WriteAll)
 }
 
+// Sync makes the writes to the file durable on every peer that took them
+// before making them the volume's current state, buffered ones included. If
+// it fails, the writes since the last successful Sync may be lost, and the
+// next Sync tries again.
 func (f *BlockFile) Sync() error {
-	if !f.WriteOpen() {
+	return f.SyncContext(context.TODO())
+}
+
+// SyncContext is Sync as part of the operation in ctx, such as a traced
+// flush.
+func (f *BlockFile) SyncContext(ctx context.Context) error {
+	return f.buf.after(ctx, func() error {
+		return f.syncContext(ctx)
+	})
+}
+
+func (f *BlockFile) syncContext(ctx context.Context) error {
+	if f.WriteOpen() {
+		clog.Debugf("Syncing block volume: %v", f.vol.volume.Name)
+		err := f.File.SyncBlocksContext(ctx)
+		if err != nil {
+			return err
+		}
+		f.unsynced, err = f.File.SyncINode(f.inodeContext(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	if f.unsynced.Equals(torus.ZeroINode()) {
 		clog.Debugf("not syncing")
 		return nil
 	}
-	clog.Debugf("Syncing block volume: %v", f.vol.volume.Name)
-	err := f.File.SyncBlocks()
+	err := torus.SyncBlockStore(ctx, f.vol.srv.Blocks)
 	if err != nil {
 		return err
 	}
-	ref, err := f.File.SyncINode(f.inodeContext())
+	span, _ := torus.StartChildSpan(ctx, "Commit INode")
+	span.SetTag("inode", f.unsynced.String())
+	err = f.vol.mds.SyncINode(f.unsynced)
+	span.Finish()
 	if err != nil {
 		return err
 	}
-	return f.vol.mds.SyncINode(ref)
+	f.unsynced = torus.ZeroINode()
+	return nil
 }
@@ -0,0 +1,600 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/consul"
+	"github.com/alternative-storage/torus/models"
+)
+
+// blockConsul keeps block volumes under the same keys as blockEtcd. Where
+// etcd compares revisions, it checks the ModifyIndex of keys, zero standing
+// for a key that doesn't exist.
+type blockConsul struct {
+	*consul.Consul
+	name string
+	vid  torus.VolumeID
+	// held is the value of the write lock while we hold it.
+	held []byte
+	// ctx is the context of the metadata service the volume was opened
+	// through, if it was given one.
+	ctx context.Context
+}
+
+func (b *blockConsul) getContext() context.Context {
+	if b.ctx != nil {
+		return b.ctx
+	}
+	return context.TODO()
+}
+
+func (b *blockConsul) volKey(s ...string) string {
+	return consul.MkKey(append([]string{"volumemeta", consul.Uint64ToHex(uint64(b.vid))}, s...)...)
+}
+
+func (b *blockConsul) CreateBlockVolume(volume *models.Volume) error {
+	vbytes, err := volume.Marshal()
+	if err != nil {
+		return err
+	}
+	inodeBytes := torus.NewINodeRef(torus.VolumeID(volume.Id), 1).ToBytes()
+	ok, err := b.Client.Txn(b.getContext(),
+		consul.OpCheckNotExists(consul.MkKey("volumes", volume.Name)),
+		consul.OpSet(consul.MkKey("volumes", volume.Name), consul.Uint64ToBytes(volume.Id)),
+		consul.OpSet(consul.MkKey("volumeid", consul.Uint64ToHex(volume.Id)), vbytes),
+		consul.OpSet(consul.MkKey("volumemeta", consul.Uint64ToHex(volume.Id), "inode"), consul.Uint64ToBytes(1)),
+		consul.OpSet(consul.MkKey("volumemeta", consul.Uint64ToHex(volume.Id), "blockinode"), inodeBytes),
+	)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return torus.ErrExists
+	}
+	return nil
+}
+
+func (b *blockConsul) UpdateVolume(volume *models.Volume) error {
+	vbytes, err := volume.Marshal()
+	if err != nil {
+		return err
+	}
+	k := consul.MkKey("volumeid", consul.Uint64ToHex(volume.Id))
+	for {
+		kv, err := b.Client.Get(b.getContext(), k)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return torus.ErrNotExist
+		}
+		ok, err := b.Client.CAS(b.getContext(), k, vbytes, kv.ModifyIndex)
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+func (b *blockConsul) DeleteVolume(opts DeleteOptions) error {
+	vid := uint64(b.vid)
+	lockKey := b.volKey("blocklock")
+	vol, err := b.GetVolume(b.name)
+	if err != nil {
+		return err
+	}
+	tomb, err := marshalTombstone(vol, opts)
+	if err != nil {
+		return err
+	}
+	for {
+		gen, err := b.cloneGen()
+		if err != nil {
+			return err
+		}
+		snaps, err := b.GetSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, x := range snaps {
+			if len(x.Clones) != 0 {
+				return &ClonesError{Snapshot: x.Name, Clones: x.Clones}
+			}
+		}
+		ops := []consul.TxnOp{
+			consul.OpCheckIndex(consulCloneGenKey(b.vid), gen),
+		}
+		if !opts.Force {
+			readGen, err := b.modifyIndex(b.readGenKey())
+			if err != nil {
+				return err
+			}
+			readers, err := b.readers()
+			if err != nil {
+				return err
+			}
+			if len(readers) != 0 {
+				return &ReadersError{Holders: readers}
+			}
+			ops = append(ops,
+				consul.OpCheckNotExists(lockKey),
+				consul.OpCheckIndex(b.readGenKey(), readGen),
+			)
+		}
+		ops = append(ops,
+			consul.OpDelete(consul.MkKey("volumes", b.name)),
+			consul.OpDelete(consul.MkKey("volumeid", consul.Uint64ToHex(vid))),
+			consul.OpDeleteTree(b.volKey()+"/"),
+			consul.OpSet(consul.MkKey("tombstones", consul.Uint64ToHex(vid)), tomb),
+		)
+		// A clone releases its hold on the snapshot it was made from.
+		origin, err := b.origin()
+		if err != nil {
+			return err
+		}
+		if origin != nil {
+			parent := torus.VolumeID(origin.Volume)
+			k := consulSnapshotKey(parent, origin.Snapshot)
+			kv, err := b.Client.Get(b.getContext(), k)
+			if err != nil {
+				return err
+			}
+			if kv != nil {
+				var snap Snapshot
+				if err := json.Unmarshal(kv.Value, &snap); err != nil {
+					return err
+				}
+				snap.Clones = removeClone(snap.Clones, b.name)
+				bytes, err := json.Marshal(snap)
+				if err != nil {
+					return err
+				}
+				ops = append(ops,
+					consul.OpCheckIndex(k, kv.ModifyIndex),
+					consul.OpSet(k, bytes),
+					consul.OpSet(consulCloneGenKey(parent), nil),
+				)
+			}
+		}
+		ok, err := b.Client.Txn(b.getContext(), ops...)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if opts.Force {
+			continue
+		}
+		kv, err := b.Client.Get(b.getContext(), lockKey)
+		if err != nil {
+			return err
+		}
+		if kv != nil {
+			return torus.ErrLocked
+		}
+		// A clone or reader was made or went since we looked; look again.
+	}
+}
+
+// CreateClone creates the clone and adds it to the snapshot's Clones in one
+// transaction, as blockEtcd does.
+func (b *blockConsul) CreateClone(volume *models.Volume, inode torus.INodeRef, parent torus.VolumeID, snapshot string) error {
+	vbytes, err := volume.Marshal()
+	if err != nil {
+		return err
+	}
+	obytes, err := json.Marshal(cloneOrigin{Volume: uint64(parent), Snapshot: snapshot})
+	if err != nil {
+		return err
+	}
+	volKey := consul.MkKey("volumes", volume.Name)
+	k := consulSnapshotKey(parent, snapshot)
+	for {
+		kv, err := b.Client.Get(b.getContext(), k)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return torus.ErrNotExist
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(kv.Value, &snap); err != nil {
+			return err
+		}
+		snap.Clones = append(snap.Clones, volume.Name)
+		sbytes, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		ok, err := b.Client.Txn(b.getContext(),
+			consul.OpCheckNotExists(volKey),
+			consul.OpCheckIndex(k, kv.ModifyIndex),
+			consul.OpSet(volKey, consul.Uint64ToBytes(volume.Id)),
+			consul.OpSet(consul.MkKey("volumeid", consul.Uint64ToHex(volume.Id)), vbytes),
+			consul.OpSet(consul.MkKey("volumemeta", consul.Uint64ToHex(volume.Id), "inode"), consul.Uint64ToBytes(uint64(inode.INode))),
+			consul.OpSet(consul.MkKey("volumemeta", consul.Uint64ToHex(volume.Id), "blockinode"), inode.ToBytes()),
+			consul.OpSet(consulOriginKey(torus.VolumeID(volume.Id)), obytes),
+			consul.OpSet(k, sbytes),
+			consul.OpSet(consulCloneGenKey(parent), nil),
+		)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		vkv, err := b.Client.Get(b.getContext(), volKey)
+		if err != nil {
+			return err
+		}
+		if vkv != nil {
+			return torus.ErrExists
+		}
+		// The snapshot changed since we read it; read it again.
+	}
+}
+
+func consulSnapshotKey(vid torus.VolumeID, name string) string {
+	return consul.MkKey("volumemeta", consul.Uint64ToHex(uint64(vid)), "snapshots", name)
+}
+
+func consulCloneGenKey(vid torus.VolumeID) string {
+	return consul.MkKey("volumemeta", consul.Uint64ToHex(uint64(vid)), "clonegen")
+}
+
+func consulOriginKey(vid torus.VolumeID) string {
+	return consul.MkKey("volumemeta", consul.Uint64ToHex(uint64(vid)), "origin")
+}
+
+// modifyIndex returns the index key was last modified at, or zero if it
+// doesn't exist.
+func (b *blockConsul) modifyIndex(key string) (uint64, error) {
+	kv, err := b.Client.Get(b.getContext(), key)
+	if err != nil || kv == nil {
+		return 0, err
+	}
+	return kv.ModifyIndex, nil
+}
+
+// cloneGen returns the index at which a clone of the volume was last made
+// or deleted.
+func (b *blockConsul) cloneGen() (uint64, error) {
+	return b.modifyIndex(consulCloneGenKey(b.vid))
+}
+
+// origin returns the snapshot the volume was cloned from, or nil if it isn't
+// a clone.
+func (b *blockConsul) origin() (*cloneOrigin, error) {
+	kv, err := b.Client.Get(b.getContext(), consulOriginKey(b.vid))
+	if err != nil || kv == nil {
+		return nil, err
+	}
+	o := &cloneOrigin{}
+	if err := json.Unmarshal(kv.Value, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Lock takes the lock key with the session of lease, so that it goes away
+// with the holder.
+func (b *blockConsul) Lock(lease int64) (uint64, error) {
+	if lease == 0 {
+		return 0, torus.ErrInvalid
+	}
+	session, err := b.Consul.Session(lease)
+	if err != nil {
+		return 0, err
+	}
+	k := b.volKey("blocklock")
+	value, err := json.Marshal(newLockHolder(b.Consul.UUID()))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		gen, err := b.modifyIndex(b.readGenKey())
+		if err != nil {
+			return 0, err
+		}
+		readers, err := b.readers()
+		if err != nil {
+			return 0, err
+		}
+		if len(readers) != 0 {
+			return 0, &ReadersError{Holders: readers}
+		}
+		ok, err := b.Client.Txn(b.getContext(),
+			consul.OpCheckNotExists(k),
+			consul.OpCheckIndex(b.readGenKey(), gen),
+			consul.OpLock(k, value, session),
+		)
+		if err != nil {
+			return 0, err
+		}
+		kv, err := b.Client.Get(b.getContext(), k)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if kv == nil || !bytes.Equal(kv.Value, value) {
+				// Our session ended as soon as we took the lock.
+				return 0, torus.ErrLocked
+			}
+			b.held = value
+			return kv.CreateIndex, nil
+		}
+		if kv != nil {
+			return 0, torus.ErrLocked
+		}
+		// A reader attached since we looked; look again.
+	}
+}
+
+// The write lock is kept as blockEtcd keeps it, held by the holder's session.
+// Its generation is the index it was created at.
+func (b *blockConsul) LockHolder() (*LockHolder, error) {
+	kv, err := b.Client.Get(b.getContext(), b.volKey("blocklock"))
+	if err != nil || kv == nil {
+		return nil, err
+	}
+	h := parseLockHolder(kv.Value)
+	h.Generation = kv.CreateIndex
+	return h, nil
+}
+
+func (b *blockConsul) BreakLock(holder *LockHolder) error {
+	kv, err := b.Client.Get(b.getContext(), b.volKey("blocklock"))
+	if err != nil || kv == nil {
+		return err
+	}
+	if kv.CreateIndex != holder.Generation {
+		return torus.ErrLocked
+	}
+	if kv.Session == "" {
+		_, err = b.Client.DeleteCAS(b.getContext(), kv.Key, kv.ModifyIndex)
+		return err
+	}
+	return b.Client.DestroySession(b.getContext(), kv.Session)
+}
+
+// Read-only holders are kept as blockEtcd keeps them, each key held by the
+// reader's session.
+func (b *blockConsul) readersPrefix() string {
+	return b.volKey("blockreaders") + "/"
+}
+
+func (b *blockConsul) readGenKey() string {
+	return b.volKey("blockreadgen")
+}
+
+// readers lists the read-only holders of the volume.
+func (b *blockConsul) readers() ([]string, error) {
+	kvs, err := b.Client.List(b.getContext(), b.readersPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, kv := range kvs {
+		out = append(out, holderName(strings.TrimPrefix(kv.Key, b.readersPrefix()), string(kv.Value)))
+	}
+	return out, nil
+}
+
+func (b *blockConsul) LockShared(lease int64) error {
+	if lease == 0 {
+		return torus.ErrInvalid
+	}
+	session, err := b.Consul.Session(lease)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	ok, err := b.Client.Txn(b.getContext(),
+		consul.OpCheckNotExists(b.volKey("blocklock")),
+		consul.OpLock(b.readersPrefix()+b.Consul.UUID(), []byte(host), session),
+		consul.OpSet(b.readGenKey(), nil),
+	)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return torus.ErrLocked
+	}
+	return nil
+}
+
+func (b *blockConsul) UnlockShared() error {
+	return b.Client.Delete(b.getContext(), b.readersPrefix()+b.Consul.UUID())
+}
+
+func (b *blockConsul) Publish(node string) error {
+	k := b.volKey("blockpublish")
+	for {
+		ok, err := b.Client.CAS(b.getContext(), k, []byte(node), 0)
+		if err != nil || ok {
+			return err
+		}
+		kv, err := b.Client.Get(b.getContext(), k)
+		if err != nil {
+			return err
+		}
+		if kv != nil {
+			if string(kv.Value) == node {
+				return nil
+			}
+			return torus.ErrLocked
+		}
+		// Unpublished since we looked; try again.
+	}
+}
+
+func (b *blockConsul) Unpublish(node string) error {
+	k := b.volKey("blockpublish")
+	kv, err := b.Client.Get(b.getContext(), k)
+	if err != nil || kv == nil || string(kv.Value) != node {
+		return err
+	}
+	_, err = b.Client.DeleteCAS(b.getContext(), k, kv.ModifyIndex)
+	return err
+}
+
+func (b *blockConsul) GetINode() (torus.INodeRef, error) {
+	kv, err := b.Client.Get(b.getContext(), b.volKey("blockinode"))
+	if err != nil {
+		return torus.NewINodeRef(0, 0), err
+	}
+	if kv == nil {
+		return torus.NewINodeRef(0, 0), errors.New("unexpected metadata for volume")
+	}
+	return torus.INodeRefFromBytes(kv.Value), nil
+}
+
+// heldLock returns the lock key of volume vid and the index it was taken at,
+// if this node holds it, and ErrLocked otherwise.
+func (b *blockConsul) heldLock(vid torus.VolumeID) (string, uint64, error) {
+	k := consul.MkKey("volumemeta", consul.Uint64ToHex(uint64(vid)), "blocklock")
+	kv, err := b.Client.Get(b.getContext(), k)
+	if err != nil {
+		return "", 0, err
+	}
+	if kv == nil || b.held == nil || !bytes.Equal(kv.Value, b.held) {
+		return "", 0, torus.ErrLocked
+	}
+	return k, kv.ModifyIndex, nil
+}
+
+func (b *blockConsul) SyncINode(inode torus.INodeRef) error {
+	k, index, err := b.heldLock(inode.Volume())
+	if err != nil {
+		return err
+	}
+	ok, err := b.Client.Txn(b.getContext(),
+		consul.OpCheckIndex(k, index),
+		consul.OpSet(consul.MkKey("volumemeta", consul.Uint64ToHex(uint64(inode.Volume())), "blockinode"), inode.ToBytes()),
+	)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return torus.ErrLocked
+	}
+	return nil
+}
+
+func (b *blockConsul) Unlock() error {
+	k, index, err := b.heldLock(b.vid)
+	if err != nil {
+		return err
+	}
+	ok, err := b.Client.DeleteCAS(b.getContext(), k, index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return torus.ErrLocked
+	}
+	return nil
+}
+
+func (b *blockConsul) SaveSnapshot(name string) error {
+	sshotKey := b.volKey("snapshots", name)
+	inoKey := b.volKey("blockinode")
+	for {
+		kv, err := b.Client.Get(b.getContext(), sshotKey)
+		if err != nil {
+			return err
+		}
+		if kv != nil {
+			return torus.ErrExists
+		}
+		ino, err := b.Client.Get(b.getContext(), inoKey)
+		if err != nil {
+			return err
+		}
+		if ino == nil {
+			return errors.New("unexpected metadata for volume")
+		}
+		inode := Snapshot{
+			Name:     name,
+			When:     time.Now(),
+			INodeRef: ino.Value,
+		}
+		bytes, err := json.Marshal(inode)
+		if err != nil {
+			return err
+		}
+		ok, err := b.Client.Txn(b.getContext(),
+			consul.OpCheckNotExists(sshotKey),
+			consul.OpCheckIndex(inoKey, ino.ModifyIndex),
+			consul.OpSet(sshotKey, bytes),
+		)
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+func (b *blockConsul) GetSnapshots() ([]Snapshot, error) {
+	kvs, err := b.Client.List(b.getContext(), b.volKey("snapshots")+"/")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Snapshot, len(kvs))
+	for i, kv := range kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (b *blockConsul) DeleteSnapshot(name string) error {
+	k := consulSnapshotKey(b.vid, name)
+	for {
+		kv, err := b.Client.Get(b.getContext(), k)
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			return torus.ErrLocked
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(kv.Value, &snap); err != nil {
+			return err
+		}
+		if len(snap.Clones) != 0 {
+			return &ClonesError{Snapshot: name, Clones: snap.Clones}
+		}
+		ok, err := b.Client.DeleteCAS(b.getContext(), k, kv.ModifyIndex)
+		if err != nil || ok {
+			return err
+		}
+		// The snapshot was cloned since we read it; read it again.
+	}
+}
+
+func createBlockConsulMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
+	// Both the Consul and what its WithContext returns unwrap to the
+	// Consul.
+	if c, ok := mds.(interface {
+		Unwrap() *consul.Consul
+		Context() context.Context
+	}); ok {
+		return &blockConsul{
+			Consul: c.Unwrap(),
+			name:   name,
+			vid:    vid,
+			ctx:    c.Context(),
+		}, nil
+	}
+	panic("how are we creating a consul metadata that doesn't implement it but reports as being consul")
+}
@@ -3,9 +3,12 @@ package block
 import (
 	"encoding/json"
 	"errors"
+	"os"
+	"strings"
 	"time"
 
 	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"golang.org/x/net/context"
 
 	"github.com/alternative-storage/torus"
@@ -17,6 +20,11 @@ type blockEtcd struct {
 	*etcd.Etcd
 	name string
 	vid  torus.VolumeID
+	// held is the value of the write lock while we hold it.
+	held string
+	// ctx is the context of the metadata service the volume was opened
+	// through, if it was given one.
+	ctx context.Context
 }
 
 func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
@@ -25,14 +33,15 @@ func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
 		return err
 	}
 	inodeBytes := torus.NewINodeRef(torus.VolumeID(volume.Id), 1).ToBytes()
+	defer b.invalidate(volume.Name, volume.Id)
 
 	do := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", volume.Name)), "=", 0),
+		etcdv3.Compare(etcdv3.Version(b.Etcd.MkKey("volumes", volume.Name)), "=", 0),
 	).Then(
-		etcdv3.OpPut(etcd.MkKey("volumes", volume.Name), string(etcd.Uint64ToBytes(volume.Id))),
-		etcdv3.OpPut(etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
-		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "inode"), string(etcd.Uint64ToBytes(1))),
-		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "blockinode"), string(inodeBytes)),
+		etcdv3.OpPut(b.Etcd.MkKey("volumes", volume.Name), string(etcd.Uint64ToBytes(volume.Id))),
+		etcdv3.OpPut(b.Etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
+		etcdv3.OpPut(b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "inode"), string(etcd.Uint64ToBytes(1))),
+		etcdv3.OpPut(b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "blockinode"), string(inodeBytes)),
 	)
 	resp, err := do.Commit()
 	if err != nil {
@@ -44,39 +53,383 @@ func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
 	return nil
 }
 
-func (b *blockEtcd) DeleteVolume() error {
-	vid := uint64(b.vid)
-	tx := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")), "=", 0),
+func (b *blockEtcd) UpdateVolume(volume *models.Volume) error {
+	vbytes, err := volume.Marshal()
+	if err != nil {
+		return err
+	}
+	defer b.invalidate(volume.Name, volume.Id)
+	do := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(b.Etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id))), ">", 0),
 	).Then(
-		etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
-		etcdv3.OpDelete(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
-		etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
+		etcdv3.OpPut(b.Etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
 	)
-	resp, err := tx.Commit()
+	resp, err := do.Commit()
 	if err != nil {
 		return err
 	}
 	if !resp.Succeeded {
-		return torus.ErrLocked
+		return torus.ErrNotExist
 	}
 	return nil
+}
 
+func (b *blockEtcd) DeleteVolume(opts DeleteOptions) error {
+	vid := uint64(b.vid)
+	lockKey := b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	vol, err := b.GetVolume(b.name)
+	if err != nil {
+		return err
+	}
+	tomb, err := marshalTombstone(vol, opts)
+	if err != nil {
+		return err
+	}
+	defer b.invalidate(b.name, vid)
+	for {
+		gen, err := b.cloneGen()
+		if err != nil {
+			return err
+		}
+		snaps, err := b.GetSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, x := range snaps {
+			if len(x.Clones) != 0 {
+				return &ClonesError{Snapshot: x.Name, Clones: x.Clones}
+			}
+		}
+		cmps := []etcdv3.Cmp{
+			etcdv3.Compare(etcdv3.ModRevision(b.cloneGenKey(b.vid)), "=", gen),
+		}
+		if !opts.Force {
+			readGen, err := b.readGen()
+			if err != nil {
+				return err
+			}
+			readers, err := b.readers()
+			if err != nil {
+				return err
+			}
+			if len(readers) != 0 {
+				return &ReadersError{Holders: readers}
+			}
+			cmps = append(cmps,
+				etcdv3.Compare(etcdv3.Version(lockKey), "=", 0),
+				etcdv3.Compare(etcdv3.ModRevision(b.readGenKey()), "=", readGen),
+			)
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpDelete(b.Etcd.MkKey("volumes", b.name)),
+			etcdv3.OpDelete(b.Etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
+			etcdv3.OpDelete(b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
+			etcdv3.OpPut(b.Etcd.MkKey("tombstones", etcd.Uint64ToHex(vid)), string(tomb)),
+		}
+		// A clone releases its hold on the snapshot it was made from.
+		origin, err := b.origin()
+		if err != nil {
+			return err
+		}
+		if origin != nil {
+			parent := torus.VolumeID(origin.Volume)
+			k := b.snapshotKey(parent, origin.Snapshot)
+			resp, err := b.Etcd.Client.Get(b.getContext(), k)
+			if err != nil {
+				return err
+			}
+			if len(resp.Kvs) != 0 {
+				var snap Snapshot
+				if err := json.Unmarshal(resp.Kvs[0].Value, &snap); err != nil {
+					return err
+				}
+				snap.Clones = removeClone(snap.Clones, b.name)
+				bytes, err := json.Marshal(snap)
+				if err != nil {
+					return err
+				}
+				cmps = append(cmps, etcdv3.Compare(etcdv3.ModRevision(k), "=", resp.Kvs[0].ModRevision))
+				ops = append(ops,
+					etcdv3.OpPut(k, string(bytes)),
+					etcdv3.OpPut(b.cloneGenKey(parent), ""),
+				)
+			}
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Else(
+			etcdv3.OpGet(lockKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if !opts.Force && len(resp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrLocked
+		}
+		// A clone or reader was made or went since we looked; look again.
+	}
+}
+
+// CreateClone creates the clone and adds it to the snapshot's Clones in one
+// transaction, so that the snapshot can't be deleted in between. Creating a
+// clone also touches the parent's clonegen key, which lets DeleteVolume tell
+// whether the parent gained a clone after it checked.
+func (b *blockEtcd) CreateClone(volume *models.Volume, inode torus.INodeRef, parent torus.VolumeID, snapshot string) error {
+	vbytes, err := volume.Marshal()
+	if err != nil {
+		return err
+	}
+	obytes, err := json.Marshal(cloneOrigin{Volume: uint64(parent), Snapshot: snapshot})
+	if err != nil {
+		return err
+	}
+	volKey := b.Etcd.MkKey("volumes", volume.Name)
+	k := b.snapshotKey(parent, snapshot)
+	defer b.invalidate(volume.Name, volume.Id)
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), k)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return torus.ErrNotExist
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(resp.Kvs[0].Value, &snap); err != nil {
+			return err
+		}
+		snap.Clones = append(snap.Clones, volume.Name)
+		sbytes, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		txresp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(volKey), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", resp.Kvs[0].ModRevision),
+		).Then(
+			etcdv3.OpPut(volKey, string(etcd.Uint64ToBytes(volume.Id))),
+			etcdv3.OpPut(b.Etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
+			etcdv3.OpPut(b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "inode"), string(etcd.Uint64ToBytes(uint64(inode.INode)))),
+			etcdv3.OpPut(b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "blockinode"), string(inode.ToBytes())),
+			etcdv3.OpPut(b.originKey(torus.VolumeID(volume.Id)), string(obytes)),
+			etcdv3.OpPut(k, string(sbytes)),
+			etcdv3.OpPut(b.cloneGenKey(parent), ""),
+		).Else(
+			etcdv3.OpGet(volKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if txresp.Succeeded {
+			return nil
+		}
+		if len(txresp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrExists
+		}
+		// The snapshot changed since we read it; read it again.
+	}
+}
+
+func (b *blockEtcd) inodeKey(vid torus.VolumeID) string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(vid)), "blockinode")
+}
+
+// invalidate drops the cached lookups of a volume this node changed.
+func (b *blockEtcd) invalidate(name string, vid uint64) {
+	b.Etcd.Invalidate(
+		b.Etcd.MkKey("volumes", name),
+		b.Etcd.MkKey("volumeid", etcd.Uint64ToHex(vid)),
+		b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "inode"),
+		b.inodeKey(torus.VolumeID(vid)),
+	)
+}
+
+func (b *blockEtcd) snapshotKey(vid torus.VolumeID, name string) string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(vid)), "snapshots", name)
+}
+
+func (b *blockEtcd) cloneGenKey(vid torus.VolumeID) string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(vid)), "clonegen")
+}
+
+func (b *blockEtcd) originKey(vid torus.VolumeID) string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(vid)), "origin")
+}
+
+// cloneGen returns the revision at which a clone of the volume was last made
+// or deleted.
+func (b *blockEtcd) cloneGen() (int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.cloneGenKey(b.vid))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return resp.Kvs[0].ModRevision, nil
+}
+
+// origin returns the snapshot the volume was cloned from, or nil if it isn't
+// a clone.
+func (b *blockEtcd) origin() (*cloneOrigin, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.originKey(b.vid))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	o := &cloneOrigin{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, o); err != nil {
+		return nil, err
+	}
+	return o, nil
 }
 
 func (b *blockEtcd) getContext() context.Context {
+	if b.ctx != nil {
+		return b.ctx
+	}
 	return context.TODO()
 }
 
-func (b *blockEtcd) Lock(lease int64) error {
+// The write lock records its holder, and is tied to the holder's lease so
+// that it goes away with the holder. Its generation is the revision it was
+// created at.
+func (b *blockEtcd) lockKey() string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blocklock")
+}
+
+func (b *blockEtcd) Lock(lease int64) (uint64, error) {
+	if lease == 0 {
+		return 0, torus.ErrInvalid
+	}
+	k := b.lockKey()
+	value, err := json.Marshal(newLockHolder(b.Etcd.UUID()))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		gen, err := b.readGen()
+		if err != nil {
+			return 0, err
+		}
+		readers, err := b.readers()
+		if err != nil {
+			return 0, err
+		}
+		if len(readers) != 0 {
+			return 0, &ReadersError{Holders: readers}
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(k), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(b.readGenKey()), "=", gen),
+		).Then(
+			etcdv3.OpPut(k, string(value), etcdv3.WithLease(etcdv3.LeaseID(lease))),
+		).Else(
+			etcdv3.OpGet(k),
+		)
+		txresp, err := tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txresp.Succeeded {
+			b.held = string(value)
+			// Now that only we write the INode, make sure we start from
+			// the last one written rather than a cached one.
+			b.Etcd.Invalidate(b.inodeKey(b.vid))
+			return uint64(txresp.Header.Revision), nil
+		}
+		if len(txresp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return 0, torus.ErrLocked
+		}
+		// A reader attached since we looked; look again.
+	}
+}
+
+func (b *blockEtcd) LockHolder() (*LockHolder, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.lockKey())
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	h := parseLockHolder(resp.Kvs[0].Value)
+	h.Generation = uint64(resp.Kvs[0].CreateRevision)
+	return h, nil
+}
+
+func (b *blockEtcd) BreakLock(holder *LockHolder) error {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.lockKey())
+	if err != nil || len(resp.Kvs) == 0 {
+		return err
+	}
+	kv := resp.Kvs[0]
+	if uint64(kv.CreateRevision) != holder.Generation {
+		return torus.ErrLocked
+	}
+	if kv.Lease == 0 {
+		// Locks are always taken under a lease, but don't leave one
+		// without for good.
+		_, err = b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.CreateRevision(b.lockKey()), "=", kv.CreateRevision),
+		).Then(
+			etcdv3.OpDelete(b.lockKey()),
+		).Commit()
+		return err
+	}
+	_, err = b.Etcd.Client.Revoke(b.getContext(), etcdv3.LeaseID(kv.Lease))
+	if rpctypes.Error(err) == rpctypes.ErrLeaseNotFound {
+		// It expired on its own.
+		return nil
+	}
+	return err
+}
+
+// Each read-only holder of a volume keeps a key under blockreaders, tied to
+// its lease so that it goes away with the holder. Taking one also touches
+// blockreadgen, which lets a writer tell whether a reader arrived after it
+// checked for them.
+func (b *blockEtcd) readersPrefix() string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blockreaders") + "/"
+}
+
+func (b *blockEtcd) readGenKey() string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blockreadgen")
+}
+
+// readGen returns the revision at which a reader last attached.
+func (b *blockEtcd) readGen() (int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.readGenKey())
+	if err != nil || len(resp.Kvs) == 0 {
+		return 0, err
+	}
+	return resp.Kvs[0].ModRevision, nil
+}
+
+// readers lists the read-only holders of the volume.
+func (b *blockEtcd) readers() ([]string, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.readersPrefix(), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, kv := range resp.Kvs {
+		out = append(out, holderName(strings.TrimPrefix(string(kv.Key), b.readersPrefix()), string(kv.Value)))
+	}
+	return out, nil
+}
+
+func (b *blockEtcd) LockShared(lease int64) error {
 	if lease == 0 {
 		return torus.ErrInvalid
 	}
-	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blocklock")
+	host, _ := os.Hostname()
+	k := b.lockKey()
 	tx := b.Etcd.Client.Txn(b.getContext()).If(
 		etcdv3.Compare(etcdv3.Version(k), "=", 0),
 	).Then(
-		etcdv3.OpPut(k, b.Etcd.UUID(), etcdv3.WithLease(etcdv3.LeaseID(lease))),
+		etcdv3.OpPut(b.readersPrefix()+b.Etcd.UUID(), host, etcdv3.WithLease(etcdv3.LeaseID(lease))),
+		etcdv3.OpPut(b.readGenKey(), ""),
 	)
 	resp, err := tx.Commit()
 	if err != nil {
@@ -88,26 +441,76 @@ func (b *blockEtcd) Lock(lease int64) error {
 	return nil
 }
 
+func (b *blockEtcd) UnlockShared() error {
+	_, err := b.Etcd.Client.Delete(b.getContext(), b.readersPrefix()+b.Etcd.UUID())
+	return err
+}
+
+// The node a volume is published to is kept under blockpublish, without a
+// lease.
+func (b *blockEtcd) publishKey() string {
+	return b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blockpublish")
+}
+
+func (b *blockEtcd) Publish(node string) error {
+	k := b.publishKey()
+	for {
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(k), "=", 0),
+		).Then(
+			etcdv3.OpPut(k, node),
+		).Else(
+			etcdv3.OpGet(k),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) != 0 {
+			if string(kvs[0].Value) == node {
+				return nil
+			}
+			return torus.ErrLocked
+		}
+		// Unpublished since we looked; try again.
+	}
+}
+
+func (b *blockEtcd) Unpublish(node string) error {
+	k := b.publishKey()
+	_, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", node),
+	).Then(
+		etcdv3.OpDelete(k),
+	).Commit()
+	return err
+}
+
 func (b *blockEtcd) GetINode() (torus.INodeRef, error) {
-	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blockinode"))
+	v, found, err := b.Etcd.CachedGet(b.getContext(), "inode", b.inodeKey(b.vid))
 	if err != nil {
 		return torus.NewINodeRef(0, 0), err
 	}
-	if len(resp.Kvs) != 1 {
+	if !found {
 		return torus.NewINodeRef(0, 0), errors.New("unexpected metadata for volume")
 	}
-	return torus.INodeRefFromBytes(resp.Kvs[0].Value), nil
+	return torus.INodeRefFromBytes(v), nil
 }
 
 func (b *blockEtcd) SyncINode(inode torus.INodeRef) error {
 	vid := uint64(inode.Volume())
 	inodeBytes := string(inode.ToBytes())
-	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	k := b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	defer b.Etcd.Invalidate(b.inodeKey(inode.Volume()))
 	tx := b.Etcd.Client.Txn(b.getContext()).If(
 		etcdv3.Compare(etcdv3.Version(k), ">", 0),
-		etcdv3.Compare(etcdv3.Value(k), "=", b.Etcd.UUID()),
+		etcdv3.Compare(etcdv3.Value(k), "=", b.held),
 	).Then(
-		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blockinode"), inodeBytes),
+		etcdv3.OpPut(b.inodeKey(inode.Volume()), inodeBytes),
 	)
 	resp, err := tx.Commit()
 	if err != nil {
@@ -120,13 +523,12 @@ func (b *blockEtcd) SyncINode(inode torus.INodeRef) error {
 }
 
 func (b *blockEtcd) Unlock() error {
-	vid := uint64(b.vid)
-	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	k := b.lockKey()
 	tx := b.Etcd.Client.Txn(b.getContext()).If(
 		etcdv3.Compare(etcdv3.Version(k), ">", 0),
-		etcdv3.Compare(etcdv3.Value(k), "=", b.Etcd.UUID()),
+		etcdv3.Compare(etcdv3.Value(k), "=", b.held),
 	).Then(
-		etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")),
+		etcdv3.OpDelete(k),
 	)
 	resp, err := tx.Commit()
 	if err != nil {
@@ -141,8 +543,8 @@ func (b *blockEtcd) Unlock() error {
 func (b *blockEtcd) SaveSnapshot(name string) error {
 	vid := uint64(b.vid)
 	for {
-		sshotKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "snapshots", name)
-		inoKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blockinode")
+		sshotKey := b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "snapshots", name)
+		inoKey := b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blockinode")
 		tx := b.Etcd.Client.Txn(b.getContext()).If(
 			etcdv3.Compare(etcdv3.Version(sshotKey), "=", 0),
 		).Then(
@@ -184,7 +586,7 @@ func (b *blockEtcd) SaveSnapshot(name string) error {
 
 func (b *blockEtcd) GetSnapshots() ([]Snapshot, error) {
 	resp, err := b.Etcd.Client.Get(b.getContext(),
-		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "snapshots"),
+		b.Etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "snapshots"),
 		etcdv3.WithPrefix())
 	if err != nil {
 		return nil, err
@@ -200,29 +602,49 @@ func (b *blockEtcd) GetSnapshots() ([]Snapshot, error) {
 }
 
 func (b *blockEtcd) DeleteSnapshot(name string) error {
-	vid := uint64(b.vid)
-	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "snapshots", name)
-	tx := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(k), ">", 0),
-	).Then(
-		etcdv3.OpDelete(k),
-	)
-	resp, err := tx.Commit()
-	if err != nil {
-		return err
-	}
-	if !resp.Succeeded {
-		return torus.ErrLocked
+	k := b.snapshotKey(b.vid, name)
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), k)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return torus.ErrLocked
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(resp.Kvs[0].Value, &snap); err != nil {
+			return err
+		}
+		if len(snap.Clones) != 0 {
+			return &ClonesError{Snapshot: name, Clones: snap.Clones}
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", resp.Kvs[0].ModRevision),
+		).Then(
+			etcdv3.OpDelete(k),
+		)
+		txresp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if txresp.Succeeded {
+			return nil
+		}
+		// The snapshot was cloned since we read it; read it again.
 	}
-	return nil
 }
 
 func createBlockEtcdMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
-	if e, ok := mds.(*etcd.Etcd); ok {
+	// Both the Etcd and what its WithContext returns unwrap to the Etcd.
+	if e, ok := mds.(interface {
+		Unwrap() *etcd.Etcd
+		Context() context.Context
+	}); ok {
 		return &blockEtcd{
-			Etcd: e,
+			Etcd: e.Unwrap(),
 			name: name,
 			vid:  vid,
+			ctx:  e.Context(),
 		}, nil
 	}
 	panic("how are we creating an etcd metadata that doesn't implement it but reports as being etcd")
@@ -0,0 +1,66 @@
+package block
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/alternative-storage/torus/metadata"
+	"github.com/alternative-storage/torus/metadata/etcd"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func TestEtcdPrefixCreateVolume(t *testing.T) {
+	endpoints := os.Getenv("TORUS_ETCD_TEST_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("set TORUS_ETCD_TEST_ENDPOINTS to run tests against etcd")
+	}
+	cfg := torus.Config{
+		MetadataAddress: endpoints,
+		MetadataPrefix:  "/torus-test/" + metadata.MakeUUID(),
+	}
+	gmd := torus.GlobalMetadata{
+		BlockSize:        4096,
+		DefaultBlockSpec: blockset.MustParseBlockLayerSpec("crc,base"),
+	}
+	if err := torus.InitMDS("etcd", cfg, gmd, ring.Ketama); err != nil {
+		t.Fatal(err)
+	}
+	defer torus.WipeMDS("etcd", cfg)
+	mds, err := torus.CreateMetadataService("etcd", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mds.Close()
+
+	if err := CreateBlockVolume(mds, volName, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateBlockVolume(mds, volName, 1024*1024); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists creating the volume twice, got %v", err)
+	}
+	vol, err := mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mds.(*etcd.Etcd)
+	for _, k := range []string{
+		cfg.MetadataPrefix + "/volumes/" + volName,
+		cfg.MetadataPrefix + "/volumeid/" + etcd.Uint64ToHex(vol.Id),
+		cfg.MetadataPrefix + "/volumemeta/" + etcd.Uint64ToHex(vol.Id) + "/blockinode",
+	} {
+		resp, err := e.Client.Get(context.Background(), k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 {
+			t.Fatalf("expected %s to exist", k)
+		}
+	}
+	if err := DeleteBlockVolume(mds, volName); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,309 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/alternative-storage/torus"
+)
+
+// The export format is a header followed by one record per changed block and
+// an end record:
+//
+//	magic "TBEX", version byte
+//	header: size, block size (uint64 each); volume, base, target (uint16
+//	        length followed by the bytes each)
+//	record: kind byte, block index (uint64), and for data records the
+//	        block's data, block size bytes
+//	end:    kind byte 0, number of records (uint64)
+//
+// Integers are big-endian. Readers refuse versions they don't know.
+const exportVersion = 1
+
+var exportMagic = [4]byte{'T', 'B', 'E', 'X'}
+
+const (
+	exportEnd byte = iota
+	// exportData records a block's new data.
+	exportData
+	// exportZero records a block that reads back as zeroes, such as one
+	// discarded since the base snapshot.
+	exportZero
+)
+
+// ExportHeader describes an export stream.
+type ExportHeader struct {
+	// Volume is the volume exported, and Size its size in bytes.
+	Volume    string
+	Size      uint64
+	BlockSize uint64
+	// Base is the snapshot the stream holds the changes since, or empty
+	// if it holds the whole of Target.
+	Base   string
+	Target string
+}
+
+// ErrBadExport is returned when reading a stream that isn't a valid export.
+var ErrBadExport = errors.New("block: not a valid export stream")
+
+// ExportSnapshot writes the blocks of the snapshot target changed since the
+// snapshot base to w, or all of target's written blocks if base is empty,
+// returning the number of blocks it wrote. Snapshots don't change, so the
+// export is consistent however long it takes and whatever is written to the
+// volume meanwhile. Blocks of encrypted volumes are written decrypted.
+func (s *BlockVolume) ExportSnapshot(w io.Writer, base, target string) (uint64, error) {
+	refs, err := s.snapshotBlockRefs(target)
+	if err != nil {
+		return 0, err
+	}
+	changed, err := s.ChangedBlocks(base, target)
+	if err != nil {
+		return 0, err
+	}
+	f, err := s.OpenSnapshot(target)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := &ExportHeader{
+		Volume:    s.volume.Name,
+		Size:      f.Size(),
+		BlockSize: s.mds.GlobalMetadata().BlockSize,
+		Base:      base,
+		Target:    target,
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeExportHeader(bw, h); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, h.BlockSize)
+	var n uint64
+	for _, i := range changed {
+		if i >= uint64(len(refs)) || refs[i].IsZero() {
+			if err := writeExportRecord(bw, exportZero, i, nil); err != nil {
+				return n, err
+			}
+			n++
+			continue
+		}
+		off := i * h.BlockSize
+		for j := range buf {
+			buf[j] = 0
+		}
+		want := h.BlockSize
+		if off+want > h.Size {
+			want = h.Size - off
+		}
+		if _, err := f.ReadAt(buf[:want], int64(off)); err != nil && err != io.EOF {
+			return n, fmt.Errorf("couldn't read block %d: %v", i, err)
+		}
+		if err := writeExportRecord(bw, exportData, i, buf); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := bw.WriteByte(exportEnd); err != nil {
+		return n, err
+	}
+	if err := binary.Write(bw, binary.BigEndian, n); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// ImportBlockVolume applies an export stream read from r to volume, then
+// snapshots the volume as the stream's target snapshot, returning the
+// stream's header. A stream holding a whole snapshot creates the volume. One
+// holding the changes since a base snapshot is applied to an existing volume
+// which must still be as of its own snapshot of that name, such as one made
+// by importing the stream exported before. If the import fails partway, the
+// volume can be restored to the base snapshot and the import tried again.
+func ImportBlockVolume(srv *torus.Server, volume string, r io.Reader) (*ExportHeader, error) {
+	br := bufio.NewReader(r)
+	h, err := readExportHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if bs := srv.MDS.GlobalMetadata().BlockSize; h.BlockSize != bs {
+		return nil, fmt.Errorf("stream has blocks of %d bytes, but the cluster's are %d", h.BlockSize, bs)
+	}
+	if h.Base == "" {
+		if err := CreateBlockVolume(srv.MDS, volume, h.Size); err != nil {
+			return nil, err
+		}
+	}
+	vol, err := OpenBlockVolume(srv, volume)
+	if err != nil {
+		return nil, err
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		return nil, err
+	}
+	if h.Base != "" {
+		if err := vol.checkImportBase(h); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := applyExport(br, h, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return h, vol.SaveSnapshot(h.Target)
+}
+
+// checkImportBase checks that the volume, which the caller holds the lock
+// of, is still as of its snapshot of the stream's base.
+func (s *BlockVolume) checkImportBase(h *ExportHeader) error {
+	if s.volume.MaxBytes != h.Size {
+		return fmt.Errorf("stream is of a volume of %d bytes, but %s has %d", h.Size, s.volume.Name, s.volume.MaxBytes)
+	}
+	snap, err := s.findSnapshot(h.Base)
+	if err == torus.ErrNotExist {
+		return fmt.Errorf("volume %s has no snapshot %s to apply the changes since it to", s.volume.Name, h.Base)
+	}
+	if err != nil {
+		return err
+	}
+	cur, err := s.mds.GetINode()
+	if err != nil {
+		return err
+	}
+	if !cur.Equals(torus.INodeRefFromBytes(snap.INodeRef)) {
+		return fmt.Errorf("volume %s was written since snapshot %s; restore it first", s.volume.Name, h.Base)
+	}
+	return nil
+}
+
+func applyExport(r *bufio.Reader, h *ExportHeader, f *BlockFile) error {
+	buf := make([]byte, h.BlockSize)
+	var n uint64
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if kind == exportEnd {
+			var want uint64
+			if err := binary.Read(r, binary.BigEndian, &want); err != nil {
+				return unexpectedEOF(err)
+			}
+			if want != n {
+				return fmt.Errorf("%v: stream ends after %d blocks of %d", ErrBadExport, n, want)
+			}
+			return nil
+		}
+		var i uint64
+		if err := binary.Read(r, binary.BigEndian, &i); err != nil {
+			return unexpectedEOF(err)
+		}
+		off := i * h.BlockSize
+		if off >= h.Size {
+			return fmt.Errorf("%v: block %d is past the end of the volume", ErrBadExport, i)
+		}
+		switch kind {
+		case exportData:
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return unexpectedEOF(err)
+			}
+			want := h.BlockSize
+			if off+want > h.Size {
+				want = h.Size - off
+			}
+			if _, err := f.WriteAt(buf[:want], int64(off)); err != nil {
+				return err
+			}
+		case exportZero:
+			if err := f.Trim(int64(off), int64(h.BlockSize)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%v: unknown record kind %d", ErrBadExport, kind)
+		}
+		n++
+	}
+}
+
+func readExportHeader(r *bufio.Reader) (*ExportHeader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || magic != exportMagic {
+		return nil, ErrBadExport
+	}
+	v, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if v != exportVersion {
+		return nil, fmt.Errorf("block: export stream is version %d, only version %d is supported", v, exportVersion)
+	}
+	h := &ExportHeader{}
+	for _, x := range []*uint64{&h.Size, &h.BlockSize} {
+		if err := binary.Read(r, binary.BigEndian, x); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	for _, x := range []*string{&h.Volume, &h.Base, &h.Target} {
+		var l uint16
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		*x = string(b)
+	}
+	if h.BlockSize == 0 || h.Target == "" {
+		return nil, ErrBadExport
+	}
+	return h, nil
+}
+
+func writeExportHeader(w io.Writer, h *ExportHeader) error {
+	if _, err := w.Write(exportMagic[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{exportVersion}); err != nil {
+		return err
+	}
+	for _, x := range []uint64{h.Size, h.BlockSize} {
+		if err := binary.Write(w, binary.BigEndian, x); err != nil {
+			return err
+		}
+	}
+	for _, x := range []string{h.Volume, h.Base, h.Target} {
+		if err := binary.Write(w, binary.BigEndian, uint16(len(x))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportRecord(w io.Writer, kind byte, i uint64, data []byte) error {
+	if _, err := w.Write([]byte{kind}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, i); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// unexpectedEOF reports a stream cut short as such.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
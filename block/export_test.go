@@ -0,0 +1,115 @@
+package block
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/alternative-storage/torus/metadata/temp"
+)
+
+func TestExportImportSnapshot(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	// 8 blocks of 256 bytes.
+	if err := CreateBlockVolume(srv.MDS, volName, 2048); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(vol *BlockVolume, f func(*BlockFile) error) {
+		bf, err := vol.OpenBlockFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f(bf); err != nil {
+			t.Fatal(err)
+		}
+		if err := bf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fill := func(b byte, n int) []byte {
+		return bytes.Repeat([]byte{b}, n)
+	}
+	write(vol, func(f *BlockFile) error {
+		_, err := f.WriteAt(fill(1, 768), 0)
+		return err
+	})
+	if err := vol.SaveSnapshot("a"); err != nil {
+		t.Fatal(err)
+	}
+	write(vol, func(f *BlockFile) error {
+		if _, err := f.WriteAt(fill(2, 256), 1536); err != nil {
+			return err
+		}
+		return f.Trim(256, 256)
+	})
+	if err := vol.SaveSnapshot("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := vol.ChangedBlocks("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 || changed[0] != 1 || changed[1] != 6 {
+		t.Fatalf("expected blocks 1 and 6 to have changed, got %v", changed)
+	}
+
+	var full, incr bytes.Buffer
+	if n, err := vol.ExportSnapshot(&full, "", "a"); err != nil || n != 3 {
+		t.Fatalf("expected to export 3 blocks, got %d, %v", n, err)
+	}
+	if n, err := vol.ExportSnapshot(&incr, "a", "b"); err != nil || n != 2 {
+		t.Fatalf("expected to export 2 blocks, got %d, %v", n, err)
+	}
+
+	h, err := ImportBlockVolume(srv, newVolName, bytes.NewReader(full.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Volume != volName || h.Base != "" || h.Target != "a" || h.Size != 2048 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	if _, err := ImportBlockVolume(srv, newVolName, bytes.NewReader(incr.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	copyVol, err := OpenBlockVolume(srv, newVolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(vol *BlockVolume, snap string) []byte {
+		f, err := vol.OpenSnapshot(snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		b := make([]byte, 2048)
+		if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !bytes.Equal(read(vol, "b"), read(copyVol, "b")) {
+		t.Fatal("imported volume doesn't match the exported one")
+	}
+
+	// The copy was written since its snapshot a, so the changes since a
+	// can't be applied to it again.
+	if _, err := ImportBlockVolume(srv, newVolName, bytes.NewReader(incr.Bytes())); err == nil {
+		t.Fatal("expected applying changes to a volume written since the base to fail")
+	}
+
+	bad := append([]byte(nil), full.Bytes()...)
+	bad[4] = exportVersion + 1
+	if _, err := ImportBlockVolume(srv, "other", bytes.NewReader(bad)); err == nil {
+		t.Fatal("expected a stream of an unknown version to be refused")
+	}
+	short := full.Bytes()[:full.Len()-9]
+	if _, err := ImportBlockVolume(srv, "short", bytes.NewReader(short)); err == nil {
+		t.Fatal("expected a truncated stream to be refused")
+	}
+}
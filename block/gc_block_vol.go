@@ -22,12 +22,24 @@ type blockvolGC struct {
 	set        map[torus.BlockRef]bool
 	highwaters map[torus.VolumeID]torus.INodeID
 	curINodes  []torus.INodeRef
+
+	// unreachable holds when each allocated INode that no volume or
+	// snapshot reaches was first seen so, across passes. Those unreachable
+	// for longer than the window are orphans, along with their blocks.
+	unreachable map[torus.INodeRef]time.Time
+	seen        map[torus.INodeRef]bool
+	orphans     map[torus.INodeRef]bool
+	// collected are the orphans found dead this pass, and blocks the
+	// number of their blocks.
+	collected map[torus.INodeRef]bool
+	blocks    int
 }
 
 func NewBlockVolGC(srv *torus.Server, inodes gc.INodeFetcher) (gc.GC, error) {
 	b := &blockvolGC{
-		srv:    srv,
-		inodes: inodes,
+		srv:         srv,
+		inodes:      inodes,
+		unreachable: make(map[torus.INodeRef]time.Time),
 	}
 	b.Clear()
 	return b, nil
@@ -52,7 +64,7 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 	}
 	b.highwaters[curRef.Volume()] = 0
 	if curRef.INode <= 1 {
-		return nil
+		return b.findOrphans(curRef, nil)
 	}
 
 	snaps, err := mds.GetSnapshots()
@@ -87,6 +99,44 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 		}
 	}
 	b.curINodes = append(b.curINodes, curINodes...)
+	return b.findOrphans(curRef, curINodes)
+}
+
+// findOrphans marks as orphans the INodes of the volume of cur that have been
+// allocated but are neither cur nor reached, and have stayed so for longer
+// than the window. Those below the highwater mark are dead already.
+func (b *blockvolGC) findOrphans(cur torus.INodeRef, reached []torus.INodeRef) error {
+	window := b.srv.Cfg.INodeGCWindow
+	if window <= 0 {
+		return nil
+	}
+	vid := cur.Volume()
+	last, err := b.srv.MDS.GetINodeIndex(vid)
+	if err != nil {
+		return err
+	}
+	live := map[torus.INodeID]bool{cur.INode: true}
+	for _, x := range reached {
+		if x.Volume() == vid {
+			live[x.INode] = true
+		}
+	}
+	now := time.Now()
+	for i := b.highwaters[vid]; i <= last; i++ {
+		if i <= 1 || live[i] {
+			continue
+		}
+		ref := torus.NewINodeRef(vid, i)
+		b.seen[ref] = true
+		first, ok := b.unreachable[ref]
+		if !ok {
+			b.unreachable[ref] = now
+			continue
+		}
+		if now.Sub(first) > window {
+			b.orphans[ref] = true
+		}
+	}
 	return nil
 }
 
@@ -99,6 +149,16 @@ func (b *blockvolGC) IsDead(ref torus.BlockRef) bool {
 		// Volume doesn't exist anymore
 		return true
 	}
+	// Blocks written under an INode stay referenced by the INodes after it
+	// until they're overwritten, so only the unreferenced ones go with it.
+	if inode := torus.NewINodeRef(ref.Volume(), ref.INode); b.orphans[inode] && !b.set[ref] {
+		if clog.LevelAt(capnslog.TRACE) {
+			clog.Tracef("%s is in orphaned %s", ref, inode)
+		}
+		b.collected[inode] = true
+		b.blocks++
+		return true
+	}
 	// If it's a new block or INode, let it be.
 	if ref.INode >= v {
 		if clog.LevelAt(capnslog.TRACE) {
@@ -131,8 +191,26 @@ func (b *blockvolGC) IsDead(ref torus.BlockRef) bool {
 	return true
 }
 
+func (b *blockvolGC) Stats() gc.Stats {
+	return gc.Stats{
+		OrphanedINodes: len(b.collected),
+		OrphanedBlocks: b.blocks,
+	}
+}
+
 func (b *blockvolGC) Clear() {
 	b.highwaters = make(map[torus.VolumeID]torus.INodeID)
 	b.curINodes = make([]torus.INodeRef, 0, len(b.curINodes))
 	b.set = make(map[torus.BlockRef]bool)
+	// Forget the INodes that became reachable, or went with their volume,
+	// during the pass.
+	for ref := range b.unreachable {
+		if b.seen != nil && !b.seen[ref] {
+			delete(b.unreachable, ref)
+		}
+	}
+	b.seen = make(map[torus.INodeRef]bool)
+	b.orphans = make(map[torus.INodeRef]bool)
+	b.collected = make(map[torus.INodeRef]bool)
+	b.blocks = 0
 }
@@ -0,0 +1,195 @@
+package block
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/gc"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"golang.org/x/net/context"
+)
+
+func TestBlockVolGCKeepsSnapshots(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	err := CreateBlockVolume(srv.MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func() {
+		f, err := vol.OpenBlockFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(make([]byte, 256), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	firstBlock := func(snap string) torus.BlockRef {
+		refs, err := vol.snapshotBlockRefs(snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refs[0]
+	}
+
+	// Each write replaces the first block, so each snapshot holds the
+	// only reference to its version of it.
+	write()
+	if err = vol.SaveSnapshot(snapName); err != nil {
+		t.Fatal(err)
+	}
+	write()
+	if err = vol.SaveSnapshot("mid"); err != nil {
+		t.Fatal(err)
+	}
+	write()
+	kept, dropped := firstBlock(snapName), firstBlock("mid")
+	cur, err := vol.ReferencedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gc, err := NewBlockVolGC(srv, srv.INodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gc.PrepVolume(vol.volume); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range cur {
+		if gc.IsDead(ref) {
+			t.Fatalf("referenced block %s is dead", ref)
+		}
+	}
+
+	if err = vol.DeleteSnapshot("mid"); err != nil {
+		t.Fatal(err)
+	}
+	gc.Clear()
+	if err = gc.PrepVolume(vol.volume); err != nil {
+		t.Fatal(err)
+	}
+	if gc.IsDead(kept) {
+		t.Fatalf("block %s of snapshot %s is dead", kept, snapName)
+	}
+	if !gc.IsDead(dropped) {
+		t.Fatalf("block %s of a deleted snapshot isn't dead", dropped)
+	}
+}
+
+func TestBlockVolGCOrphanedINodes(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	srv.Cfg.INodeGCWindow = time.Hour
+	if err := CreateBlockVolume(srv.MDS, volName, 4096); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(make([]byte, 2048), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := vol.ReferencedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer that crashes after writing its blocks and INode, but before
+	// making the INode the volume's current one.
+	f, err = vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("lost"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.File.SyncBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := f.File.SyncINode(f.inodeContext(context.TODO()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphaned []torus.BlockRef
+	it := srv.Blocks.BlockIterator()
+	for it.Next() {
+		if ref := it.BlockRef(); ref.INode == orphan.INode {
+			orphaned = append(orphaned, ref)
+		}
+	}
+	it.Close()
+	if len(orphaned) < 2 {
+		t.Fatalf("expected a data block and an INode block of the crashed writer, got %v", orphaned)
+	}
+
+	g, err := NewBlockVolGC(srv, srv.INodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass := func() {
+		g.Clear()
+		if err := g.PrepVolume(vol.volume); err != nil {
+			t.Fatal(err)
+		}
+		for _, ref := range committed {
+			if g.IsDead(ref) {
+				t.Fatalf("committed block %s is dead", ref)
+			}
+		}
+	}
+	// Within the window, the INode may still be committed.
+	pass()
+	pass()
+	for _, ref := range orphaned {
+		if g.IsDead(ref) {
+			t.Fatalf("block %s of an INode within the window is dead", ref)
+		}
+	}
+	if s := g.(gc.StatsGC).Stats(); s.OrphanedINodes != 0 {
+		t.Fatalf("expected no orphans within the window, got %+v", s)
+	}
+
+	g.(*blockvolGC).unreachable[orphan] = time.Now().Add(-2 * time.Hour)
+	pass()
+	for _, ref := range orphaned {
+		if !g.IsDead(ref) {
+			t.Fatalf("block %s of an orphaned INode isn't dead", ref)
+		}
+	}
+	if s := g.(gc.StatsGC).Stats(); s.OrphanedINodes != 1 || s.OrphanedBlocks != len(orphaned) {
+		t.Fatalf("expected 1 orphaned INode of %d blocks, got %+v", len(orphaned), s)
+	}
+
+	// Once committed, the INode is no orphan, however long it waited.
+	if err = vol.mds.SyncINode(orphan); err != nil {
+		t.Fatal(err)
+	}
+	g.Clear()
+	if err = g.PrepVolume(vol.volume); err != nil {
+		t.Fatal(err)
+	}
+	g.Clear()
+	if _, ok := g.(*blockvolGC).unreachable[orphan]; ok {
+		t.Fatal("expected the committed INode to be forgotten")
+	}
+}
@@ -1,7 +1,11 @@
 package block
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/alternative-storage/torus"
@@ -15,23 +19,182 @@ type Snapshot struct {
 	Name     string
 	When     time.Time
 	INodeRef []byte
+	// Clones names the volumes cloned from the snapshot, which share its
+	// blocks. The snapshot can't be deleted while it has any.
+	Clones []string
+}
+
+// cloneOrigin records the snapshot a clone was made from, so that deleting
+// the clone can release its hold on the snapshot.
+type cloneOrigin struct {
+	Volume   uint64
+	Snapshot string
 }
 
 type blockMetadata interface {
 	torus.MetadataService
 
-	Lock(lease int64) error
+	// Lock takes the volume for writing under lease, recording the holder
+	// in the lock, and returns the lock's new generation. It fails with
+	// ErrLocked if another holds the lock.
+	Lock(lease int64) (uint64, error)
 	Unlock() error
+	// LockHolder returns the holder of the volume's write lock, or nil if
+	// it is free.
+	LockHolder() (*LockHolder, error)
+	// BreakLock revokes the lease the write lock is held under, if it is
+	// still the generation of the lock holder describes, releasing the
+	// lock along with everything else the holder keeps under the lease.
+	// It fails with ErrLocked if the lock has been taken since.
+	BreakLock(holder *LockHolder) error
+	// LockShared takes the volume for reading alongside other readers.
+	// While any hold it, Lock fails with a *ReadersError.
+	LockShared(lease int64) error
+	UnlockShared() error
+	// Publish claims the volume for node until Unpublish. Unlike the lock,
+	// the claim outlives the process that took it. It fails with ErrLocked
+	// if another node has claimed the volume.
+	Publish(node string) error
+	Unpublish(node string) error
 
 	GetINode() (torus.INodeRef, error)
 	SyncINode(torus.INodeRef) error
 
 	CreateBlockVolume(vol *models.Volume) error
-	DeleteVolume() error
+	UpdateVolume(vol *models.Volume) error
+	// DeleteVolume deletes the volume, leaving a tombstone for it until
+	// its blocks are reclaimed. Unless opts.Force is set, it fails with
+	// ErrLocked or a *ReadersError while the volume is attached.
+	DeleteVolume(opts DeleteOptions) error
 
 	SaveSnapshot(name string) error
 	GetSnapshots() ([]Snapshot, error)
 	DeleteSnapshot(name string) error
+
+	// CreateClone creates the volume as a clone of snapshot of the parent
+	// volume, starting out at inode, which must already hold the
+	// snapshot's block map. The clone is added to the snapshot's Clones.
+	CreateClone(vol *models.Volume, inode torus.INodeRef, parent torus.VolumeID, snapshot string) error
+}
+
+// ReadersError is returned when a volume can't be locked for writing because
+// it is attached read-only elsewhere.
+type ReadersError struct {
+	// Holders names each reader, by its UUID and host.
+	Holders []string
+}
+
+func (e *ReadersError) Error() string {
+	return "block: volume is attached read-only by " + strings.Join(e.Holders, ", ")
+}
+
+func holderName(uuid, host string) string {
+	if host == "" {
+		return uuid
+	}
+	return fmt.Sprintf("%s (%s)", uuid, host)
+}
+
+// DefaultStaleLockAge is how long the holder of a volume's write lock must
+// have gone without a heartbeat for the lock to be taken over by default:
+// long enough that a live holder would have missed two heartbeats.
+const DefaultStaleLockAge = 3 * torus.DefaultHeartbeatInterval
+
+// LockHolder describes the holder of a volume's write lock, as recorded in
+// the lock.
+type LockHolder struct {
+	UUID     string
+	Host     string    `json:",omitempty"`
+	PID      int       `json:",omitempty"`
+	Attached time.Time `json:",omitempty"`
+	// Generation goes up each time the volume is locked. The holder's
+	// writes carry it, for peers to refuse those of earlier holders. It
+	// isn't recorded in the lock, but read from the metadata service
+	// along with it.
+	Generation uint64 `json:"-"`
+}
+
+func newLockHolder(uuid string) *LockHolder {
+	host, _ := os.Hostname()
+	return &LockHolder{
+		UUID:     uuid,
+		Host:     host,
+		PID:      os.Getpid(),
+		Attached: time.Now().UTC(),
+	}
+}
+
+// parseLockHolder reads the holder recorded in a lock. Locks taken before
+// holders were recorded hold just the UUID of the holder.
+func parseLockHolder(b []byte) *LockHolder {
+	var h LockHolder
+	if err := json.Unmarshal(b, &h); err != nil || h.UUID == "" {
+		return &LockHolder{UUID: string(b)}
+	}
+	return &h
+}
+
+func (h *LockHolder) String() string {
+	out := holderName(h.UUID, h.Host)
+	if h.PID != 0 {
+		out += fmt.Sprintf(" pid %d", h.PID)
+	}
+	if !h.Attached.IsZero() {
+		out += " since " + h.Attached.Local().Format(time.RFC3339)
+	}
+	return out
+}
+
+// LockedError is returned when a volume can't be opened for writing because
+// another holds its write lock.
+type LockedError struct {
+	Holder LockHolder
+	// LastSeen is when the holder last heartbeat, or zero if it isn't
+	// registered as a peer.
+	LastSeen time.Time
+}
+
+func (e *LockedError) Error() string {
+	out := "block: volume is attached by " + e.Holder.String()
+	if !e.LastSeen.IsZero() {
+		out += fmt.Sprintf(", last heartbeat %s ago", time.Since(e.LastSeen)/time.Second*time.Second)
+	}
+	return out
+}
+
+// ClonesError is returned when a snapshot, or the volume holding it, can't be
+// deleted because volumes were cloned from the snapshot.
+type ClonesError struct {
+	Snapshot string
+	Clones   []string
+}
+
+func (e *ClonesError) Error() string {
+	return fmt.Sprintf("block: snapshot %s has clones %s", e.Snapshot, strings.Join(e.Clones, ", "))
+}
+
+// removeClone returns clones without name.
+func removeClone(clones []string, name string) []string {
+	var out []string
+	for _, c := range clones {
+		if c != name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// marshalTombstone returns the tombstone vol leaves once deleted, as it is
+// stored.
+func marshalTombstone(vol *models.Volume, opts DeleteOptions) ([]byte, error) {
+	return json.Marshal(torus.VolumeTombstone{
+		Name:    vol.Name,
+		ID:      vol.Id,
+		Type:    vol.Type,
+		Size:    vol.MaxBytes,
+		Deleted: time.Now().UTC(),
+		Secure:  opts.Secure,
+	})
 }
 
 func createBlockMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
@@ -40,6 +203,8 @@ func createBlockMetadata(mds torus.MetadataService, name string, vid torus.Volum
 		return createBlockEtcdMetadata(mds, name, vid)
 	case torus.TempMetadata:
 		return createBlockTempMetadata(mds, name, vid)
+	case torus.ConsulMetadata:
+		return createBlockConsulMetadata(mds, name, vid)
 	default:
 		return nil, errors.New("unimplemented for this kind of metadata")
 	}
@@ -0,0 +1,199 @@
+package block
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+var (
+	promQoSThrottledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_block_qos_throttled_seconds_total",
+		Help: "Time reads and writes to a block volume were held back by its QoS limits",
+	}, []string{"volume"})
+	promQoSThrottledOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_block_qos_throttled_ops_total",
+		Help: "Number of reads and writes to a block volume held back by its QoS limits",
+	}, []string{"volume"})
+)
+
+func init() {
+	prometheus.MustRegister(promQoSThrottledSeconds)
+	prometheus.MustRegister(promQoSThrottledOps)
+}
+
+// qosRefresh is how often an open volume looks up its QoS limits again, to
+// pick up changes made while it's attached.
+const qosRefresh = 5 * time.Second
+
+// QoS is the limits on the reads and writes to a block volume, enforced on
+// the node it's attached to. Zero limits are unlimited.
+type QoS struct {
+	// MaxIOPS is the number of reads and writes allowed a second.
+	MaxIOPS uint64 `json:"max_iops,omitempty"`
+	// MaxBytesPerSec is the number of bytes allowed to be read and
+	// written a second.
+	MaxBytesPerSec uint64 `json:"max_bytes_per_sec,omitempty"`
+	// Burst is how long an idle volume can save up its allowance for, to
+	// spend at once. Zero is a second.
+	Burst time.Duration `json:"burst,omitempty"`
+}
+
+// VolumeQoS returns the QoS limits of vol.
+func VolumeQoS(vol *models.Volume) QoS {
+	return QoS{
+		MaxIOPS:        vol.MaxIops,
+		MaxBytesPerSec: vol.MaxBytesPerSec,
+		Burst:          time.Duration(vol.QosBurst),
+	}
+}
+
+// Limited reports whether q limits the volume at all.
+func (q QoS) Limited() bool {
+	return q.MaxIOPS != 0 || q.MaxBytesPerSec != 0
+}
+
+func (q QoS) burst() time.Duration {
+	if q.Burst <= 0 {
+		return time.Second
+	}
+	return q.Burst
+}
+
+// MaxDelay returns the longest the last of ops reads and writes, of bytes in
+// all, could be held back, were they all issued at once to a volume that had
+// used up its allowance.
+func (q QoS) MaxDelay(ops int, bytes int64) time.Duration {
+	var d float64
+	if q.MaxIOPS != 0 {
+		d = float64(ops) / float64(q.MaxIOPS)
+	}
+	if q.MaxBytesPerSec != 0 {
+		d = math.Max(d, float64(bytes)/float64(q.MaxBytesPerSec))
+	}
+	return time.Duration(d * float64(time.Second))
+}
+
+// SetBlockVolumeQoS sets the QoS limits of a block volume. Nodes with the
+// volume attached pick them up within a few seconds.
+func SetBlockVolumeQoS(mds torus.MetadataService, volume string, q QoS) error {
+	if q.Burst < 0 {
+		return errors.New("QoS burst can't be negative")
+	}
+	return updateBlockVolume(mds, volume, func(v *models.Volume) {
+		setVolumeQoS(v, q)
+	})
+}
+
+func setVolumeQoS(v *models.Volume, q QoS) {
+	v.MaxIops = q.MaxIOPS
+	v.MaxBytesPerSec = q.MaxBytesPerSec
+	v.QosBurst = int64(q.Burst)
+}
+
+// qosBucket holds the allowance of a volume for one of its limits. It holds
+// at most a burst's worth, and goes into debt for a request larger than
+// that, which the requests after it wait off.
+type qosBucket struct {
+	rate   uint64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n from the allowance of the bucket at rate, saving up for
+// at most burst, and returns how long the caller must wait before going
+// ahead. A rate of zero is unlimited.
+func (b *qosBucket) reserve(n float64, rate uint64, burst time.Duration, now time.Time) time.Duration {
+	if rate == 0 {
+		b.rate = 0
+		return 0
+	}
+	max := burst.Seconds() * float64(rate)
+	if rate != b.rate || b.last.IsZero() {
+		b.rate = rate
+		b.tokens = max
+		b.last = now
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+elapsed.Seconds()*float64(rate), max)
+		b.last = now
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// qosLimiter holds back the reads and writes to an open block volume to its
+// QoS limits, which it looks up again every qosRefresh.
+type qosLimiter struct {
+	mds    torus.MetadataService
+	volume string
+
+	mut       sync.Mutex
+	limits    QoS
+	lastFetch time.Time
+	ops       qosBucket
+	bytes     qosBucket
+}
+
+func newQoSLimiter(mds torus.MetadataService, vol *models.Volume) *qosLimiter {
+	return &qosLimiter{
+		mds:       mds,
+		volume:    vol.Name,
+		limits:    VolumeQoS(vol),
+		lastFetch: time.Now(),
+	}
+}
+
+// reserve takes a request of n bytes from the allowance of the volume, and
+// returns how long it must wait before going ahead.
+func (l *qosLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if now.Sub(l.lastFetch) >= qosRefresh {
+		l.lastFetch = now
+		vol, err := l.mds.GetVolume(l.volume)
+		if err != nil {
+			clog.Debugf("couldn't look up QoS limits of volume %s, keeping the last ones: %v", l.volume, err)
+		} else {
+			l.limits = VolumeQoS(vol)
+		}
+	}
+	burst := l.limits.burst()
+	wait := l.ops.reserve(1, l.limits.MaxIOPS, burst, now)
+	if w := l.bytes.reserve(float64(n), l.limits.MaxBytesPerSec, burst, now); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+// wait holds back a request of n bytes to the limits of the volume, or until
+// ctx is done.
+func (l *qosLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	d := l.reserve(n, time.Now())
+	if d <= 0 {
+		return nil
+	}
+	promQoSThrottledOps.WithLabelValues(l.volume).Inc()
+	promQoSThrottledSeconds.WithLabelValues(l.volume).Add(d.Seconds())
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
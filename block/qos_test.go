@@ -0,0 +1,87 @@
+package block
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+)
+
+func TestQoSBucket(t *testing.T) {
+	var b qosBucket
+	now := time.Unix(1000, 0)
+	// A full bucket at 100/s with a 2s burst lets 200 through at once.
+	for i := 0; i < 200; i++ {
+		if d := b.reserve(1, 100, 2*time.Second, now); d != 0 {
+			t.Fatalf("expected request %d to go ahead within the burst, waited %v", i, d)
+		}
+	}
+	if d := b.reserve(1, 100, 2*time.Second, now); d != 10*time.Millisecond {
+		t.Fatalf("expected to wait 10ms once the burst is spent, got %v", d)
+	}
+	// Idle for longer than the burst, it saves up no more than the burst.
+	now = now.Add(time.Minute)
+	if d := b.reserve(250, 100, 2*time.Second, now); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait off the 50 over the burst, got %v", d)
+	}
+	if d := b.reserve(1e9, 0, time.Second, now); d != 0 {
+		t.Fatalf("expected no limit at a rate of zero, got %v", d)
+	}
+}
+
+func TestQoSMaxDelay(t *testing.T) {
+	q := QoS{MaxIOPS: 100, MaxBytesPerSec: 1 << 20}
+	if d := q.MaxDelay(50, 4<<20); d != 4*time.Second {
+		t.Fatalf("expected the bandwidth limit to bound the delay at 4s, got %v", d)
+	}
+	if d := q.MaxDelay(500, 1<<20); d != 5*time.Second {
+		t.Fatalf("expected the IOPS limit to bound the delay at 5s, got %v", d)
+	}
+	if d := (QoS{}).MaxDelay(500, 1<<30); d != 0 {
+		t.Fatalf("expected no delay without limits, got %v", d)
+	}
+}
+
+func TestSetBlockVolumeQoS(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	if err := CreateBlockVolume(mds, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newQoSLimiter(mds, vol)
+	now := time.Now()
+	if d := l.reserve(1<<30, now); d != 0 {
+		t.Fatalf("expected no limit on a new volume, waited %v", d)
+	}
+
+	if err := SetBlockVolumeQoS(mds, volName, QoS{Burst: -time.Second}); err == nil {
+		t.Fatal("expected a negative burst to be rejected")
+	}
+	q := QoS{MaxIOPS: 10, MaxBytesPerSec: 1000, Burst: 3 * time.Second}
+	if err := SetBlockVolumeQoS(mds, volName, q); err != nil {
+		t.Fatal(err)
+	}
+	vol, err = mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := VolumeQoS(vol); got != q {
+		t.Fatalf("expected QoS %+v, got %+v", q, got)
+	}
+
+	// The open volume picks up the limits once it looks them up again.
+	if d := l.reserve(1, now.Add(time.Second)); d != 0 {
+		t.Fatalf("expected the old limits until the next refresh, waited %v", d)
+	}
+	now = now.Add(qosRefresh)
+	if d := l.reserve(3000, now); d != 0 {
+		t.Fatalf("expected a full burst to go ahead, waited %v", d)
+	}
+	if d := l.reserve(500, now); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms once the burst is spent, got %v", d)
+	}
+}
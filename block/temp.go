@@ -1,7 +1,11 @@
 package block
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"os"
+	"sort"
 	"time"
 
 	"github.com/alternative-storage/torus"
@@ -13,12 +17,64 @@ type blockTempMetadata struct {
 	*temp.Client
 	name string
 	vid  torus.VolumeID
+	// held is the write lock while we hold it.
+	held *LockHolder
 }
 
 type blockTempVolumeData struct {
-	locked string
-	id     torus.INodeRef
-	snaps  []Snapshot
+	lock *LockHolder
+	// lockGen is the generation of the last write lock taken.
+	lockGen uint64
+	// readers maps the UUID of each read-only holder to its host.
+	readers map[string]string
+	id      torus.INodeRef
+	snaps   []Snapshot
+	origin  *cloneOrigin
+	// published is the node the volume is published to, if any.
+	published string
+}
+
+func init() {
+	// The temp metadata service may persist the data we store in it.
+	gob.Register(&blockTempVolumeData{})
+}
+
+// blockTempVolumeGob is the persisted form of blockTempVolumeData. The lock
+// and read-only holders are deliberately dropped, as they were held by clients
+// of a previous process, but not the lock's generation, which must keep going
+// up.
+type blockTempVolumeGob struct {
+	INode     []byte
+	Snaps     []Snapshot
+	Origin    *cloneOrigin
+	Published string
+	LockGen   uint64
+}
+
+func (d *blockTempVolumeData) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&blockTempVolumeGob{
+		INode:     d.id.ToBytes(),
+		Snaps:     d.snaps,
+		Origin:    d.origin,
+		Published: d.published,
+		LockGen:   d.lockGen,
+	})
+	return buf.Bytes(), err
+}
+
+func (d *blockTempVolumeData) GobDecode(b []byte) error {
+	var g blockTempVolumeGob
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&g)
+	if err != nil {
+		return err
+	}
+	d.id = torus.INodeRefFromBytes(g.INode)
+	d.snaps = g.Snaps
+	d.origin = g.Origin
+	d.published = g.Published
+	d.lockGen = g.LockGen
+	return nil
 }
 
 func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume) error {
@@ -30,13 +86,103 @@ func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume) error {
 	}
 	b.CreateVolume(volume)
 	b.SetData(fmt.Sprint(volume.Id), &blockTempVolumeData{
-		locked: "",
-		id:     torus.NewINodeRef(torus.VolumeID(volume.Id), 1),
+		id: torus.NewINodeRef(torus.VolumeID(volume.Id), 1),
 	})
 	return nil
 }
 
-func (b *blockTempMetadata) Lock(lease int64) error {
+func (b *blockTempMetadata) Lock(lease int64) (uint64, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return 0, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.lock != nil {
+		return 0, torus.ErrLocked
+	}
+	if len(d.readers) != 0 {
+		var holders []string
+		for uuid, host := range d.readers {
+			holders = append(holders, holderName(uuid, host))
+		}
+		sort.Strings(holders)
+		return 0, &ReadersError{Holders: holders}
+	}
+	d.lockGen++
+	d.lock = newLockHolder(b.UUID())
+	d.lock.Generation = d.lockGen
+	b.held = d.lock
+	return d.lockGen, nil
+}
+
+func (b *blockTempMetadata) LockHolder() (*LockHolder, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.lock == nil {
+		return nil, nil
+	}
+	h := *d.lock
+	return &h, nil
+}
+
+// BreakLock drops the lock; the temp metadata service has no leases to
+// revoke.
+func (b *blockTempMetadata) BreakLock(holder *LockHolder) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.lock == nil {
+		return nil
+	}
+	if d.lock.Generation != holder.Generation {
+		return torus.ErrLocked
+	}
+	d.lock = nil
+	return nil
+}
+
+func (b *blockTempMetadata) LockShared(lease int64) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.lock != nil {
+		return torus.ErrLocked
+	}
+	if d.readers == nil {
+		d.readers = make(map[string]string)
+	}
+	host, _ := os.Hostname()
+	d.readers[b.UUID()] = host
+	return nil
+}
+
+func (b *blockTempMetadata) UnlockShared() error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	delete(v.(*blockTempVolumeData).readers, b.UUID())
+	return nil
+}
+
+func (b *blockTempMetadata) Publish(node string) error {
 	b.LockData()
 	defer b.UnlockData()
 	v, ok := b.GetData(fmt.Sprint(b.vid))
@@ -44,10 +190,24 @@ func (b *blockTempMetadata) Lock(lease int64) error {
 		return torus.ErrNotExist
 	}
 	d := v.(*blockTempVolumeData)
-	if d.locked != "" {
+	if d.published != "" && d.published != node {
 		return torus.ErrLocked
 	}
-	d.locked = b.UUID()
+	d.published = node
+	return nil
+}
+
+func (b *blockTempMetadata) Unpublish(node string) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if d.published == node {
+		d.published = ""
+	}
 	return nil
 }
 
@@ -70,7 +230,7 @@ func (b *blockTempMetadata) SyncINode(inode torus.INodeRef) error {
 		return torus.ErrNotExist
 	}
 	d := v.(*blockTempVolumeData)
-	if d.locked != b.UUID() {
+	if d.lock == nil || d.lock != b.held {
 		return torus.ErrLocked
 	}
 	d.id = inode
@@ -85,27 +245,98 @@ func (b *blockTempMetadata) Unlock() error {
 		return torus.ErrNotExist
 	}
 	d := v.(*blockTempVolumeData)
-	if d.locked != b.UUID() {
+	if d.lock == nil || d.lock != b.held {
 		return torus.ErrLocked
 	}
-	d.locked = ""
+	d.lock = nil
 	return nil
 }
 
-func (b *blockTempMetadata) DeleteVolume() error {
+func (b *blockTempMetadata) DeleteVolume(opts DeleteOptions) error {
 	b.LockData()
-	defer b.UnlockData()
 	v, ok := b.GetData(fmt.Sprint(b.vid))
 	if !ok {
+		b.UnlockData()
 		return torus.ErrNotExist
 	}
 	d := v.(*blockTempVolumeData)
-	if d.locked != b.UUID() {
+	if !opts.Force && d.lock != nil && d.lock.UUID != b.UUID() {
+		b.UnlockData()
 		return torus.ErrLocked
 	}
+	if !opts.Force && len(d.readers) != 0 {
+		var holders []string
+		for uuid, host := range d.readers {
+			holders = append(holders, holderName(uuid, host))
+		}
+		sort.Strings(holders)
+		b.UnlockData()
+		return &ReadersError{Holders: holders}
+	}
+	for _, x := range d.snaps {
+		if len(x.Clones) != 0 {
+			b.UnlockData()
+			return &ClonesError{Snapshot: x.Name, Clones: x.Clones}
+		}
+	}
+	if d.origin != nil {
+		if pv, ok := b.GetData(fmt.Sprint(d.origin.Volume)); ok {
+			p := pv.(*blockTempVolumeData)
+			for i, x := range p.snaps {
+				if x.Name == d.origin.Snapshot {
+					p.snaps[i].Clones = removeClone(x.Clones, b.name)
+				}
+			}
+		}
+	}
+	b.UnlockData()
+	if opts.Secure {
+		return b.Client.SecureDeleteVolume(b.name)
+	}
 	return b.Client.DeleteVolume(b.name)
 }
 
+func (b *blockTempMetadata) CreateClone(volume *models.Volume, inode torus.INodeRef, parent torus.VolumeID, snapshot string) error {
+	err := b.createClone(volume, inode, parent, snapshot)
+	if err != nil {
+		return err
+	}
+	// CreateVolume starts the volume's INode count over; move it past the
+	// clone's INode.
+	for {
+		id, err := b.CommitINodeIndex(torus.VolumeID(volume.Id))
+		if err != nil || id >= inode.INode {
+			return err
+		}
+	}
+}
+
+func (b *blockTempMetadata) createClone(volume *models.Volume, inode torus.INodeRef, parent torus.VolumeID, snapshot string) error {
+	b.LockData()
+	defer b.UnlockData()
+	if _, ok := b.GetData(fmt.Sprint(volume.Id)); ok {
+		return torus.ErrExists
+	}
+	pv, ok := b.GetData(fmt.Sprint(parent))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	p := pv.(*blockTempVolumeData)
+	for i, x := range p.snaps {
+		if x.Name != snapshot {
+			continue
+		}
+		p.snaps[i].Clones = append(x.Clones, volume.Name)
+		b.CreateVolume(volume)
+		b.SetData(fmt.Sprint(volume.Id), &blockTempVolumeData{
+			id:     inode,
+			origin: &cloneOrigin{Volume: uint64(parent), Snapshot: snapshot},
+		})
+		return nil
+	}
+	return torus.ErrNotExist
+}
+
 func (b *blockTempMetadata) SaveSnapshot(name string) error {
 	b.LockData()
 	defer b.UnlockData()
@@ -150,6 +381,9 @@ func (b *blockTempMetadata) DeleteSnapshot(name string) error {
 	d := v.(*blockTempVolumeData)
 	for i, x := range d.snaps {
 		if x.Name == name {
+			if len(x.Clones) != 0 {
+				return &ClonesError{Snapshot: name, Clones: x.Clones}
+			}
 			d.snaps = append(d.snaps[:i], d.snaps[i+1:]...)
 			return nil
 		}
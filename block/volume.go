@@ -1,9 +1,11 @@
 package block
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/coreos/pkg/progressutil"
@@ -16,6 +18,10 @@ import (
 
 const VolumeType = "block"
 
+func init() {
+	torus.RegisterBlockChecksums(VolumeType, blockVolumeChecksums)
+}
+
 type BlockVolume struct {
 	srv    *torus.Server
 	mds    blockMetadata
@@ -24,19 +30,111 @@ type BlockVolume struct {
 
 // CreateBlockVolume creates volume in metadata service.
 func CreateBlockVolume(mds torus.MetadataService, volume string, size uint64) error {
+	return createBlockVolume(mds, &models.Volume{
+		Name:     volume,
+		Type:     VolumeType,
+		MaxBytes: size,
+	})
+}
+
+// CreateBlockVolumeWithSpec creates volume in metadata service, with its
+// blocks laid out by spec rather than the cluster's default block spec.
+func CreateBlockVolumeWithSpec(mds torus.MetadataService, volume string, size uint64, spec torus.BlockLayerSpec) error {
+	if err := validateVolumeSpec(spec); err != nil {
+		return err
+	}
+	return createBlockVolume(mds, &models.Volume{
+		Name:      volume,
+		Type:      VolumeType,
+		MaxBytes:  size,
+		BlockSpec: blockset.FormatBlockLayerSpec(spec),
+	})
+}
+
+func validateVolumeSpec(spec torus.BlockLayerSpec) error {
+	for _, l := range spec {
+		if l.Kind == blockset.Encryption {
+			return errors.New("block spec can't have an aes layer; create an encrypted volume instead")
+		}
+	}
+	_, err := blockset.CreateBlocksetFromSpec(spec, nil)
+	return err
+}
+
+// VolumeBlockSpec returns the block layer spec the blocks of vol are laid
+// out by.
+func VolumeBlockSpec(mds torus.MetadataService, vol *models.Volume) (torus.BlockLayerSpec, error) {
+	spec := mds.GlobalMetadata().DefaultBlockSpec
+	if vol.BlockSpec != "" {
+		var err error
+		spec, err = blockset.ParseBlockLayerSpec(vol.BlockSpec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(vol.WrappedKey) != 0 {
+		spec = blockset.EncryptedSpec(spec)
+	}
+	return spec, nil
+}
+
+// CreateEncryptedBlockVolume creates volume in metadata service, with its
+// blocks encrypted under a new data key wrapped by master. Opening it takes
+// the same master key.
+func CreateEncryptedBlockVolume(mds torus.MetadataService, volume string, size uint64, master []byte) error {
+	return CreateEncryptedBlockVolumeWithSpec(mds, volume, size, nil, master)
+}
+
+// CreateEncryptedBlockVolumeWithSpec is CreateEncryptedBlockVolume, with the
+// blocks laid out by spec before they're encrypted. A nil spec follows the
+// cluster's default block spec.
+func CreateEncryptedBlockVolumeWithSpec(mds torus.MetadataService, volume string, size uint64, spec torus.BlockLayerSpec, master []byte) error {
+	if spec != nil {
+		if err := validateVolumeSpec(spec); err != nil {
+			return err
+		}
+	}
+	wrapped, err := blockset.NewDataKey(master)
+	if err != nil {
+		return err
+	}
+	return createBlockVolume(mds, &models.Volume{
+		Name:       volume,
+		Type:       VolumeType,
+		MaxBytes:   size,
+		WrappedKey: wrapped,
+		BlockSpec:  blockset.FormatBlockLayerSpec(spec),
+	})
+}
+
+func createBlockVolume(mds torus.MetadataService, vol *models.Volume) error {
 	id, err := mds.NewVolumeID()
 	if err != nil {
 		return err
 	}
-	blkmd, err := createBlockMetadata(mds, volume, id)
+	blkmd, err := createBlockMetadata(mds, vol.Name, id)
 	if err != nil {
 		return err
 	}
-	return blkmd.CreateBlockVolume(&models.Volume{
-		Name:     volume,
-		Id:       uint64(id),
-		Type:     VolumeType,
-		MaxBytes: size,
+	vol.Id = uint64(id)
+	if err := blkmd.CreateBlockVolume(vol); err != nil {
+		return err
+	}
+	recordVolumeEvent(mds, torus.AuditVolumeCreate, vol, nil)
+	return nil
+}
+
+// recordVolumeEvent records op on vol in the cluster event log.
+func recordVolumeEvent(mds torus.MetadataService, op string, vol *models.Volume, details map[string]string) {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details["volume"] = vol.Name
+	details["id"] = strconv.FormatUint(vol.Id, 10)
+	details["size"] = strconv.FormatUint(vol.MaxBytes, 10)
+	torus.RecordClusterEvent(mds, torus.AuditEvent{
+		Op:      op,
+		Details: details,
 	})
 }
 
@@ -52,8 +150,26 @@ func CreateBlockFromSnapshot(srv *torus.Server, origvol, origsnap, newvol string
 	}
 	size := bfsrc.Size()
 
-	// create new volume
-	err = CreateBlockVolume(srv.MDS, newvol, size)
+	// create new volume with the original's block spec, encrypted under a
+	// key of its own if the original is
+	var spec torus.BlockLayerSpec
+	if srcVol.volume.BlockSpec != "" {
+		spec, err = blockset.ParseBlockLayerSpec(srcVol.volume.BlockSpec)
+		if err != nil {
+			return fmt.Errorf("volume %s has an invalid block spec: %v", origvol, err)
+		}
+	}
+	if len(srcVol.volume.WrappedKey) != 0 {
+		var master []byte
+		master, err = blockset.LoadMasterKey(srv.Cfg)
+		if err == nil {
+			err = CreateEncryptedBlockVolumeWithSpec(srv.MDS, newvol, size, spec, master)
+		}
+	} else if spec != nil {
+		err = CreateBlockVolumeWithSpec(srv.MDS, newvol, size, spec)
+	} else {
+		err = CreateBlockVolume(srv.MDS, newvol, size)
+	}
 	if err != nil {
 		return fmt.Errorf("error creating volume %s: %v", newvol, err)
 	}
@@ -90,6 +206,54 @@ func CreateBlockFromSnapshot(srv *torus.Server, origvol, origsnap, newvol string
 	return nil
 }
 
+// CloneBlockVolume creates newvol as a writable clone of the snapshot
+// origsnap of origvol. Rather than copying the snapshot, the clone starts out
+// with its block map, sharing its blocks; writes to the clone go to new
+// blocks of its own. The snapshot can't be deleted while it has clones.
+func CloneBlockVolume(srv *torus.Server, origvol, origsnap, newvol string) error {
+	src, err := OpenBlockVolume(srv, origvol)
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", origvol, err)
+	}
+	snap, err := src.findSnapshot(origsnap)
+	if err != nil {
+		return fmt.Errorf("couldn't find snapshot %s: %v", origsnap, err)
+	}
+	inode, err := src.getOrCreateBlockINode(torus.INodeRefFromBytes(snap.INodeRef))
+	if err != nil {
+		return err
+	}
+	id, err := srv.MDS.NewVolumeID()
+	if err != nil {
+		return err
+	}
+	// The clone keeps the settings of the original, and its data key, which
+	// the shared blocks are encrypted under. The nonces of the blocks it
+	// writes have its own volume ID, so they don't repeat those of the
+	// original, though it numbers its INodes the same.
+	vol := *src.volume
+	vol.Name = newvol
+	vol.Id = uint64(id)
+	// INode 1 is the empty volume, so the clone's first INode is 2.
+	ref := torus.NewINodeRef(id, 2)
+	clone := *inode
+	clone.Volume = vol.Id
+	clone.INode = uint64(ref.INode)
+	ctx := context.WithValue(context.TODO(), torus.CtxWriteLevel, torus.WriteAll)
+	if err = srv.INodes.WriteINode(ctx, ref, &clone); err != nil {
+		return err
+	}
+	blkmd, err := createBlockMetadata(srv.MDS, newvol, id)
+	if err != nil {
+		return err
+	}
+	if err = blkmd.CreateClone(&vol, ref, torus.VolumeID(src.volume.Id), origsnap); err != nil {
+		return fmt.Errorf("error creating volume %s: %v", newvol, err)
+	}
+	recordVolumeEvent(srv.MDS, torus.AuditVolumeCreate, &vol, map[string]string{"clone-of": origvol + "@" + origsnap})
+	return nil
+}
+
 func OpenBlockVolume(s *torus.Server, volume string) (*BlockVolume, error) {
 	vol, err := s.MDS.GetVolume(volume)
 	if err != nil {
@@ -106,7 +270,225 @@ func OpenBlockVolume(s *torus.Server, volume string) (*BlockVolume, error) {
 	}, nil
 }
 
+// unlock gives bs, a blockset of the volume, its data key if the volume is
+// encrypted. It fails if the server has no master key, or the wrong one.
+func (s *BlockVolume) unlock(bs torus.Blockset) error {
+	if len(s.volume.WrappedKey) == 0 {
+		return nil
+	}
+	master, err := blockset.LoadMasterKey(s.srv.Cfg)
+	if err != nil {
+		return fmt.Errorf("volume %s is encrypted: %v", s.volume.Name, err)
+	}
+	key, err := blockset.UnwrapDataKey(master, s.volume.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("volume %s is encrypted: %v", s.volume.Name, err)
+	}
+	return blockset.SetDataKey(bs, key)
+}
+
+// DeleteBlockVolume deletes a block volume that isn't attached. It leaves a
+// tombstone, which garbage collection removes once every node has reclaimed
+// the volume's blocks.
 func DeleteBlockVolume(mds torus.MetadataService, volume string) error {
+	return DeleteBlockVolumeWithOptions(mds, volume, DeleteOptions{})
+}
+
+// ForceDeleteBlockVolume deletes a block volume even if it is attached. The
+// nodes it is attached to can no longer commit writes to it.
+func ForceDeleteBlockVolume(mds torus.MetadataService, volume string) error {
+	return DeleteBlockVolumeWithOptions(mds, volume, DeleteOptions{Force: true})
+}
+
+// DeleteOptions change how a block volume is deleted.
+type DeleteOptions struct {
+	// Force deletes the volume even if it is attached.
+	Force bool
+	// Secure has every node overwrite the volume's blocks with zeros where
+	// they are stored before reclaiming them. The volume's tombstone stays
+	// until every node in the ring has, including those down at the time.
+	Secure bool
+}
+
+// DeleteBlockVolumeWithOptions deletes a block volume as opts say.
+func DeleteBlockVolumeWithOptions(mds torus.MetadataService, volume string, opts DeleteOptions) error {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return err
+	}
+	bmds, err := createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return err
+	}
+	if err := bmds.DeleteVolume(opts); err != nil {
+		return err
+	}
+	recordVolumeEvent(mds, torus.AuditVolumeDelete, vol, map[string]string{
+		"force":  strconv.FormatBool(opts.Force),
+		"secure": strconv.FormatBool(opts.Secure),
+	})
+	return nil
+}
+
+// PublishBlockVolume claims a block volume for node, such as when a container
+// orchestrator places a workload using it there, until UnpublishBlockVolume.
+// Publishing a volume to the node that has it succeeds again; publishing it
+// to another fails with ErrLocked.
+func PublishBlockVolume(mds torus.MetadataService, volume, node string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.Publish(node)
+}
+
+// UnpublishBlockVolume releases the claim of node on a block volume. It
+// succeeds if node has no claim on it.
+func UnpublishBlockVolume(mds torus.MetadataService, volume, node string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.Unpublish(node)
+}
+
+// GetBlockVolumeLock returns the holder of the write lock of a block volume,
+// and when it last heartbeat, or a nil holder if the volume isn't attached
+// for writing.
+func GetBlockVolumeLock(mds torus.MetadataService, volume string) (*LockHolder, time.Time, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	h, err := bmds.LockHolder()
+	if err != nil || h == nil {
+		return nil, time.Time{}, err
+	}
+	seen, err := lastSeen(mds, h.UUID)
+	return h, seen, err
+}
+
+// BreakBlockVolumeLock takes the write lock of a block volume from a holder
+// that hasn't heartbeat for staleAfter, as ForceOpenBlockFile does, leaving
+// the volume free. It returns the holder, or nil if the volume wasn't
+// attached for writing.
+func BreakBlockVolumeLock(mds torus.MetadataService, volume string, staleAfter time.Duration) (*LockHolder, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	h, err := bmds.LockHolder()
+	if err != nil || h == nil {
+		return nil, err
+	}
+	return h, breakStaleLock(mds, bmds, volume, h, staleAfter)
+}
+
+// breakStaleLock breaks the write lock h holds on volume, unless h heartbeat
+// within staleAfter, in which case it returns a *LockedError. A holder that
+// is registered heartbeats at least once per peer timeout, though it may
+// only renew its lease in between, so it is live for at least that long.
+func breakStaleLock(mds torus.MetadataService, bmds blockMetadata, volume string, h *LockHolder, staleAfter time.Duration) error {
+	seen, err := lastSeen(mds, h.UUID)
+	if err != nil {
+		return err
+	}
+	if timeout := mds.GlobalMetadata().PeerTimeoutOrDefault(); staleAfter < timeout {
+		staleAfter = timeout
+	}
+	if !seen.IsZero() && time.Since(seen) < staleAfter {
+		return &LockedError{Holder: *h, LastSeen: seen}
+	}
+	clog.Warningf("breaking the lock of volume %s held by %s", volume, h)
+	return bmds.BreakLock(h)
+}
+
+// lastSeen returns when the peer uuid last heartbeat, or the zero time if it
+// isn't registered, as a holder whose lease is gone isn't.
+func lastSeen(mds torus.MetadataService, uuid string) (time.Time, error) {
+	peers, err := mds.GetPeers()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, p := range peers {
+		if p.UUID == uuid && p.LastSeen != 0 {
+			return time.Unix(0, p.LastSeen), nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+func openBlockMetadata(mds torus.MetadataService, volume string) (blockMetadata, error) {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return nil, err
+	}
+	return createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+}
+
+// SetBlockVolumeConsistency sets the write consistency of a block volume,
+// after checking it against the replication factor of the current ring. An
+// empty consistency returns the volume to the server's write level.
+func SetBlockVolumeConsistency(mds torus.MetadataService, volume, consistency string) error {
+	r, err := mds.GetRing()
+	if err != nil {
+		return err
+	}
+	perm, err := r.GetPeers(torus.ZeroBlock())
+	if err != nil {
+		return err
+	}
+	if err := torus.ValidateConsistency(consistency, perm.Replication); err != nil {
+		return err
+	}
+	return updateBlockVolume(mds, volume, func(v *models.Volume) {
+		v.Consistency = consistency
+	})
+}
+
+// SetBlockVolumeCachePolicy sets how the blocks of a block volume are
+// admitted to the block cache.
+func SetBlockVolumeCachePolicy(mds torus.MetadataService, volume, policy string) error {
+	if err := torus.ValidateCachePolicy(policy); err != nil {
+		return err
+	}
+	if policy == torus.CachePolicyDefault {
+		policy = ""
+	}
+	return updateBlockVolume(mds, volume, func(v *models.Volume) {
+		v.CachePolicy = policy
+	})
+}
+
+// SetBlockVolumeLabels adds the labels in set to a block volume, replacing
+// those of the same keys, and takes off those with keys in remove.
+func SetBlockVolumeLabels(mds torus.MetadataService, volume string, set map[string]string, remove []string) error {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string)
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	for k, v := range set {
+		labels[k] = v
+	}
+	for _, k := range remove {
+		delete(labels, k)
+	}
+	if err := torus.ValidateLabels(labels); err != nil {
+		return err
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	return updateBlockVolume(mds, volume, func(v *models.Volume) {
+		v.Labels = labels
+	})
+}
+
+func updateBlockVolume(mds torus.MetadataService, volume string, f func(v *models.Volume)) error {
 	vol, err := mds.GetVolume(volume)
 	if err != nil {
 		return err
@@ -115,13 +497,199 @@ func DeleteBlockVolume(mds torus.MetadataService, volume string) error {
 	if err != nil {
 		return err
 	}
-	return bmds.DeleteVolume()
+	// The metadata service may hand out a shared copy of the volume.
+	update := *vol
+	f(&update)
+	return bmds.UpdateVolume(&update)
+}
+
+// GetBlockVolumeSnapshots lists the snapshots of a block volume without
+// needing a running server.
+func GetBlockVolumeSnapshots(mds torus.MetadataService, volume string) ([]Snapshot, error) {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return nil, err
+	}
+	bmds, err := createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetSnapshots()
+}
+
+// SaveBlockVolumeSnapshot snapshots the current state of a block volume as
+// name, without needing a running server.
+func SaveBlockVolumeSnapshot(mds torus.MetadataService, volume, name string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.SaveSnapshot(name)
+}
+
+// DeleteBlockVolumeSnapshot deletes the snapshot name of a block volume,
+// without needing a running server.
+func DeleteBlockVolumeSnapshot(mds torus.MetadataService, volume, name string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.DeleteSnapshot(name)
+}
+
+// VolumeUsage summarizes the block map of a block volume.
+type VolumeUsage struct {
+	// TotalBlocks is the number of blocks addressable by the volume.
+	TotalBlocks uint64
+	// AllocatedBlocks is the number of blocks that have been written.
+	AllocatedBlocks uint64
+	// SparseBlocks is the number of blocks that have never been written
+	// and read back as zeroes.
+	SparseBlocks uint64
+	// UsedBytes is the space taken by allocated blocks, before replication.
+	UsedBytes uint64
+}
+
+// Usage walks the block map of the current INode of the volume.
+func (s *BlockVolume) Usage() (*VolumeUsage, error) {
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return nil, err
+	}
+	return s.usage(ref)
+}
+
+// SnapshotUsage walks the block map of a snapshot. Its UsedBytes is the
+// space the snapshot references, much of which it may share with the volume
+// and other snapshots.
+func (s *BlockVolume) SnapshotUsage(name string) (*VolumeUsage, error) {
+	snap, err := s.findSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.usage(torus.INodeRefFromBytes(snap.INodeRef))
+}
+
+func (s *BlockVolume) usage(ref torus.INodeRef) (*VolumeUsage, error) {
+	inode, err := s.getOrCreateBlockINode(ref)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+	if err != nil {
+		return nil, err
+	}
+	u := &VolumeUsage{}
+	for _, b := range bs.GetAllBlockRefs() {
+		u.TotalBlocks++
+		if b.IsZero() {
+			u.SparseBlocks++
+			continue
+		}
+		u.AllocatedBlocks++
+	}
+	u.UsedBytes = u.AllocatedBlocks * s.mds.GlobalMetadata().BlockSize
+	return u, nil
+}
+
+// ReferencedBlocks returns the data blocks referenced by the current INode
+// of the volume and by its snapshots, without duplicates. Sparse blocks are
+// left out.
+func (s *BlockVolume) ReferencedBlocks() ([]torus.BlockRef, error) {
+	sets, err := s.blocksets()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[torus.BlockRef]bool)
+	var out []torus.BlockRef
+	for _, bs := range sets {
+		for _, b := range bs.GetAllBlockRefs() {
+			if b.IsZero() || seen[b] {
+				continue
+			}
+			seen[b] = true
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+// BlockChecksums returns the checksums the crc layers of the current INode
+// and the snapshots of the volume recorded for the blocks they reference.
+func (s *BlockVolume) BlockChecksums() (map[torus.BlockRef]uint32, error) {
+	sets, err := s.blocksets()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[torus.BlockRef]uint32)
+	for _, bs := range sets {
+		for ref, sum := range blockset.BlockChecksums(bs) {
+			out[ref] = sum
+		}
+	}
+	return out, nil
+}
+
+func blockVolumeChecksums(srv *torus.Server, vol *models.Volume) (map[torus.BlockRef]uint32, error) {
+	bv, err := OpenBlockVolume(srv, vol.Name)
+	if err != nil {
+		return nil, err
+	}
+	return bv.BlockChecksums()
+}
+
+// blocksets returns the blocksets of the current INode of the volume and of
+// its snapshots.
+func (s *BlockVolume) blocksets() ([]torus.Blockset, error) {
+	cur, err := s.mds.GetINode()
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	inodes := []torus.INodeRef{cur}
+	for _, x := range snaps {
+		inodes = append(inodes, torus.INodeRefFromBytes(x.INodeRef))
+	}
+	var out []torus.Blockset
+	for _, ref := range inodes {
+		// INode 1 is the empty volume; it is never written.
+		if ref.INode <= 1 {
+			continue
+		}
+		inode, err := s.srv.INodes.GetINode(s.getContext(), ref)
+		if err != nil {
+			return nil, err
+		}
+		bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bs)
+	}
+	return out, nil
 }
 
 func (s *BlockVolume) SaveSnapshot(name string) error    { return s.mds.SaveSnapshot(name) }
 func (s *BlockVolume) GetSnapshots() ([]Snapshot, error) { return s.mds.GetSnapshots() }
 func (s *BlockVolume) DeleteSnapshot(name string) error  { return s.mds.DeleteSnapshot(name) }
 
+// findSnapshot returns the snapshot called name, or torus.ErrNotExist.
+func (s *BlockVolume) findSnapshot(name string) (Snapshot, error) {
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, x := range snaps {
+		if x.Name == name {
+			return x, nil
+		}
+	}
+	return Snapshot{}, torus.ErrNotExist
+}
+
 func (s *BlockVolume) getContext() context.Context {
 	return context.TODO()
 }
@@ -134,7 +702,11 @@ func (s *BlockVolume) getOrCreateBlockINode(ref torus.INodeRef) (*models.INode,
 		return s.srv.INodes.GetINode(s.getContext(), ref)
 	}
 	globals := s.mds.GlobalMetadata()
-	bs, err := blockset.CreateBlocksetFromSpec(globals.DefaultBlockSpec, nil)
+	spec, err := VolumeBlockSpec(s.mds, s.volume)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := blockset.CreateBlocksetFromSpec(spec, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1,10 +1,22 @@
 package block
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/blockset"
 	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
 
 	// CreateBlockStore
 	_ "github.com/alternative-storage/torus/storage"
@@ -49,20 +61,74 @@ func TestCreateOpenDeleteBlockVolume(t *testing.T) {
 		t.Fatalf("Got wrong volume name %s, expected %s", openvol.volume.Name, volName)
 	}
 
-	// TODO: bug in code (?)
-	// DeleteVolume() in block/temp.go
-	// d.locked != b.UUID() should also allow d.locked == ""
-	/*
-		err = DeleteBlockVolume(mds, volName)
-		if err != nil {
-			t.Fatal(err)
-		}
-		openvol, err = OpenBlockVolume(srv, volName)
-		if err == nil {
-			t.Fatal("Failed to delete volume")
-		}
-	*/
+	err = DeleteBlockVolume(mds, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openvol, err = OpenBlockVolume(srv, volName)
+	if err == nil {
+		t.Fatal("Failed to delete volume")
+	}
+}
+
+func TestDeleteAttachedBlockVolume(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	if err := CreateBlockVolume(srv.MDS, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	id := vol.volume.Id
+
+	// Another node can't delete the volume while it's attached...
+	mds := temp.NewClient(torus.Config{}, md)
+	if err := DeleteBlockVolume(mds, volName); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked deleting an attached volume, got %v", err)
+	}
+	var gc torus.GCController = mds
+	tombs, err := gc.GetTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombs) != 0 {
+		t.Fatalf("expected no tombstone for a volume that wasn't deleted, got %v", tombs)
+	}
 
+	// ...unless forced, which leaves a tombstone.
+	if err := ForceDeleteBlockVolume(mds, volName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mds.GetVolume(volName); err != torus.ErrNotExist {
+		t.Fatalf("expected the volume to be gone, got %v", err)
+	}
+	vols, _, err := mds.GetVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 0 {
+		t.Fatalf("expected no volumes listed, got %v", vols)
+	}
+	tombs, err = gc.GetTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombs) != 1 || tombs[0].ID != id || tombs[0].Name != volName || tombs[0].Size != 1024 {
+		t.Fatalf("expected a tombstone for volume %d, got %v", id, tombs)
+	}
+	if err := gc.RemoveTombstone(torus.VolumeID(id)); err != nil {
+		t.Fatal(err)
+	}
+	if tombs, _ = gc.GetTombstones(); len(tombs) != 0 {
+		t.Fatalf("expected the tombstone to be removed, got %v", tombs)
+	}
 }
 
 func TestSnapshotCreateOpenDeleteBlockVolume(t *testing.T) {
@@ -117,3 +183,893 @@ func TestSnapshotCreateOpenDeleteBlockVolume(t *testing.T) {
 		t.Fatalf("Got wrong volume name %s, expected %s", newvol.volume.Name, newVolName)
 	}
 }
+
+func TestBlockVolumeUsage(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	err := CreateBlockVolume(srv.MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := vol.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.TotalBlocks != 4 || u.AllocatedBlocks != 0 || u.SparseBlocks != 4 {
+		t.Fatalf("unexpected usage of empty volume: %+v", u)
+	}
+
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = f.WriteAt(data, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = vol.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.AllocatedBlocks != 1 || u.SparseBlocks != 3 || u.UsedBytes != 256 {
+		t.Fatalf("unexpected usage after write: %+v", u)
+	}
+
+	err = vol.SaveSnapshot(snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := GetBlockVolumeSnapshots(srv.MDS, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 {
+		t.Fatalf("expected 1 snapshot, got %d", len(snaps))
+	}
+	u, err = vol.SnapshotUsage(snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.AllocatedBlocks != 1 || u.UsedBytes != 256 {
+		t.Fatalf("unexpected usage of snapshot: %+v", u)
+	}
+	if _, err = vol.SnapshotUsage("missing"); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist for a missing snapshot, got %v", err)
+	}
+}
+
+func TestOpenBlockFileReadOnly(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	err := CreateBlockVolume(srv.MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt([]byte{1, 2, 3, 4}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers don't need the lock the writer holds.
+	r1, err := vol.OpenBlockFileReadOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := vol.OpenBlockFileReadOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r1.IsReadOnly() || w.IsReadOnly() {
+		t.Fatal("expected only the readers to be read-only")
+	}
+	if _, err = r1.WriteAt([]byte{5}, 0); err != torus.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly writing to a read-only file, got %v", err)
+	}
+
+	// The writer carries on; readers keep the view they opened.
+	if _, err = w.WriteAt([]byte{9, 9, 9, 9}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = r2.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 1 || buf[3] != 4 {
+		t.Fatalf("expected the data as of opening, got %v", buf)
+	}
+	if err = r1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the readers must not have released the writer's lock.
+	if _, err = vol.OpenBlockFile(); err == nil {
+		t.Fatal("expected the volume to still be locked")
+	} else if _, ok := err.(*LockedError); !ok {
+		t.Fatalf("expected a LockedError, got %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForceOpenBlockFile(t *testing.T) {
+	md := temp.NewServer()
+	srvs := []*torus.Server{newServer(md), newServer(md)}
+	err := CreateBlockVolume(srvs[0].MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vols []*BlockVolume
+	for _, s := range srvs {
+		vol, err := OpenBlockVolume(s, volName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vols = append(vols, vol)
+	}
+	old, err := vols[0].OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srvs[0].MDS.RegisterPeer(1, &models.PeerInfo{
+		UUID:     srvs[0].MDS.UUID(),
+		LastSeen: time.Now().UnixNano(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vols[1].OpenBlockFile()
+	lerr, ok := err.(*LockedError)
+	if !ok {
+		t.Fatalf("expected a LockedError, got %v", err)
+	}
+	if lerr.Holder.UUID != srvs[0].MDS.UUID() || lerr.Holder.PID != os.Getpid() || lerr.Holder.Attached.IsZero() {
+		t.Fatalf("expected the lock to record its holder, got %+v", lerr.Holder)
+	}
+	if lerr.LastSeen.IsZero() {
+		t.Fatal("expected the holder's last heartbeat")
+	}
+
+	// The holder heartbeat too recently to take the lock over.
+	if _, err = vols[1].ForceOpenBlockFile(time.Hour); err == nil {
+		t.Fatal("expected to be refused the lock of a live holder")
+	} else if _, ok := err.(*LockedError); !ok {
+		t.Fatalf("expected a LockedError, got %v", err)
+	}
+
+	// A registered holder may go a peer timeout between writing its
+	// heartbeats, so a shorter stale-after doesn't take its lock either.
+	if _, err = vols[1].ForceOpenBlockFile(time.Nanosecond); err == nil {
+		t.Fatal("expected to be refused the lock of a holder seen within the peer timeout")
+	}
+	err = srvs[0].MDS.RegisterPeer(1, &models.PeerInfo{
+		UUID:     srvs[0].MDS.UUID(),
+		LastSeen: time.Now().Add(-2 * torus.DefaultPeerTimeout).UnixNano(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := vols[1].ForceOpenBlockFile(time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := GetBlockVolumeLock(srvs[0].MDS, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h == nil || h.UUID != srvs[1].MDS.UUID() || h.Generation <= lerr.Holder.Generation {
+		t.Fatalf("expected the lock to have a new holder and generation, got %+v", h)
+	}
+
+	// The old holder can no longer commit its writes.
+	if _, err = old.WriteAt([]byte{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Sync(); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked syncing after the lock was taken over, got %v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenBlockFileShared(t *testing.T) {
+	md := temp.NewServer()
+	srvs := []*torus.Server{newServer(md), newServer(md), newServer(md)}
+	err := CreateBlockVolume(srvs[0].MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vols []*BlockVolume
+	for _, s := range srvs {
+		vol, err := OpenBlockVolume(s, volName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vols = append(vols, vol)
+	}
+
+	// Readers on several hosts share the volume.
+	r1, err := vols[0].OpenBlockFileShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := vols[1].OpenBlockFileShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r1.WriteAt([]byte{5}, 0); err != torus.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly writing to a shared file, got %v", err)
+	}
+
+	// A writer is refused, and told who the readers are.
+	_, err = vols[2].OpenBlockFile()
+	rerr, ok := err.(*ReadersError)
+	if !ok {
+		t.Fatalf("expected a ReadersError, got %v", err)
+	}
+	if len(rerr.Holders) != 2 {
+		t.Fatalf("expected two holders, got %v", rerr.Holders)
+	}
+	for _, s := range srvs[:2] {
+		if !strings.Contains(err.Error(), s.MDS.UUID()) {
+			t.Fatalf("expected %q to name reader %s", err, s.MDS.UUID())
+		}
+	}
+
+	if err = r1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := vols[2].OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers in turn wait for the writer.
+	if _, err = vols[0].OpenBlockFileShared(); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked while the volume is open for writing, got %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloneBlockVolume(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	err := CreateBlockVolume(srv.MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(v *BlockVolume, data []byte, off int64) {
+		f, err := v.OpenBlockFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(data, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(f *BlockFile, off int64) []byte {
+		data := make([]byte, 256)
+		_, err := f.ReadAt(data, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	golden := bytes.Repeat([]byte{1}, 256)
+	write(vol, golden, 0)
+	write(vol, golden, 512)
+	err = vol.SaveSnapshot(snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CloneBlockVolume(srv, volName, snapName, newVolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := OpenBlockVolume(srv, newVolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := clone.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(f, 0), golden) {
+		t.Fatal("clone doesn't start out with the snapshot's contents")
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing to the clone leaves the snapshot alone, and only replaces
+	// the block written.
+	changed := bytes.Repeat([]byte{2}, 256)
+	write(clone, changed, 0)
+	snap, err := vol.OpenSnapshot(snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(snap, 0), golden) {
+		t.Fatal("writing to the clone changed the snapshot")
+	}
+	snapRefs, err := vol.snapshotBlockRefs(snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneRefs, err := clone.ReferencedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cloneRefs) != 2 {
+		t.Fatalf("expected 2 blocks in the clone, got %v", cloneRefs)
+	}
+	if cloneRefs[0] == snapRefs[0] || cloneRefs[0].Volume() != torus.VolumeID(clone.volume.Id) {
+		t.Fatalf("block written to the clone is %s, expected a new block of the clone", cloneRefs[0])
+	}
+	if cloneRefs[1] != snapRefs[2] {
+		t.Fatalf("expected the clone to share %s, got %s", snapRefs[2], cloneRefs[1])
+	}
+
+	// The snapshot, and the volume holding it, outlive their clones.
+	if err = vol.DeleteSnapshot(snapName); err == nil {
+		t.Fatal("deleted a snapshot with clones")
+	} else if _, ok := err.(*ClonesError); !ok {
+		t.Fatalf("expected a ClonesError, got %v", err)
+	}
+	if err = DeleteBlockVolume(srv.MDS, volName); err == nil {
+		t.Fatal("deleted a volume whose snapshot has clones")
+	}
+	if err = DeleteBlockVolume(srv.MDS, newVolName); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.DeleteSnapshot(snapName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloneEncryptedBlockVolume(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	os.Setenv("TORUS_TEST_MASTER_KEY", strings.Repeat("ab", 32))
+	defer os.Unsetenv("TORUS_TEST_MASTER_KEY")
+	srv.Cfg.MasterKeyEnv = "TORUS_TEST_MASTER_KEY"
+	master, _ := hex.DecodeString(strings.Repeat("ab", 32))
+	if err := CreateEncryptedBlockVolume(srv.MDS, volName, 1024, master); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(v *BlockVolume, data []byte) {
+		f, err := v.OpenBlockFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// nonce returns the nonce block 0 of v was last encrypted with, the
+	// start of the seal the encryption layer keeps for it.
+	nonce := func(v *BlockVolume) []byte {
+		ref, err := v.mds.GetINode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		inode, err := srv.INodes.GetINode(context.TODO(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range inode.Blocks {
+			if l.Type == uint32(blockset.Encryption) {
+				return l.Content[:12]
+			}
+		}
+		t.Fatal("volume has no encryption layer")
+		return nil
+	}
+	write(vol, bytes.Repeat([]byte{1}, 256))
+	if err = vol.SaveSnapshot(snapName); err != nil {
+		t.Fatal(err)
+	}
+	if err = CloneBlockVolume(srv, volName, snapName, newVolName); err != nil {
+		t.Fatal(err)
+	}
+	clone, err := OpenBlockVolume(srv, newVolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clone shares the data key of the original, and numbers its
+	// INodes the same; the same block written to both must still be
+	// encrypted under different nonces.
+	data := bytes.Repeat([]byte{2}, 256)
+	write(vol, data)
+	write(clone, data)
+	if bytes.Equal(nonce(vol), nonce(clone)) {
+		t.Fatalf("the clone reused nonce %x of the original", nonce(vol))
+	}
+}
+
+func TestReferencedBlocks(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	err := CreateBlockVolume(srv.MDS, volName, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := vol.ReferencedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Fatalf("expected no blocks in an empty volume, got %v", refs)
+	}
+
+	write := func(off int64) {
+		f, err := vol.OpenBlockFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(make([]byte, 256), off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+	err = vol.SaveSnapshot(snapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rewriting the block after the snapshot gives it a new ref, while the
+	// snapshot keeps the old one.
+	write(0)
+	write(512)
+	refs, err = vol.ReferencedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 3 {
+		t.Fatalf("expected 3 referenced blocks, got %v", refs)
+	}
+	sums, err := vol.BlockChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 3 {
+		t.Fatalf("expected checksums of 3 blocks, got %v", sums)
+	}
+	for _, ref := range refs {
+		data, err := srv.Blocks.GetBlock(context.TODO(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum, ok := sums[ref]; !ok || sum != crc32.ChecksumIEEE(data) {
+			t.Fatalf("checksum of block %s doesn't match what's stored", ref)
+		}
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	// 8 blocks of 256 bytes.
+	err := CreateBlockVolume(srv.MDS, volName, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(off int64, n int) {
+		f, err := vol.OpenBlockFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt(make([]byte, n), off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := func(name string) {
+		if err := vol.SaveSnapshot(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap("empty")
+	write(0, 256)
+	snap("a")
+	write(256, 512)
+	write(1536, 256)
+	snap("b")
+
+	for _, tt := range []struct {
+		from, to string
+		want     []ChangedRange
+	}{
+		{"a", "a", nil},
+		{"a", "b", []ChangedRange{{256, 512}, {1536, 256}}},
+		{"b", "a", []ChangedRange{{256, 512}, {1536, 256}}},
+		{"empty", "b", []ChangedRange{{0, 768}, {1536, 256}}},
+	} {
+		got, err := vol.DiffSnapshots(tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("diff %s..%s: expected %v, got %v", tt.from, tt.to, tt.want, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("diff %s..%s: expected %v, got %v", tt.from, tt.to, tt.want, got)
+			}
+		}
+	}
+	if _, err := vol.DiffSnapshots("a", "missing"); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist for a missing snapshot, got %v", err)
+	}
+}
+
+func TestSetBlockVolumeConsistency(t *testing.T) {
+	md := temp.NewServer()
+	mds := temp.NewClient(torus.Config{}, md)
+	var peers torus.PeerInfoList
+	for _, uuid := range []string{"a", "b", "c"} {
+		peers = append(peers, &models.PeerInfo{UUID: uuid, TotalBlocks: 100})
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateBlockVolume(mds, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetBlockVolumeConsistency(mds, volName, torus.ConsistencyQuorum); err == nil {
+		t.Fatal("expected quorum to be rejected with a replication factor of 2")
+	}
+	if err := SetBlockVolumeConsistency(mds, volName, torus.ConsistencyAsync); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Consistency != torus.ConsistencyAsync {
+		t.Fatalf("expected consistency %q, got %q", torus.ConsistencyAsync, vol.Consistency)
+	}
+	if vol.MaxBytes != 1024 {
+		t.Fatalf("expected the rest of the volume to be kept, got size %d", vol.MaxBytes)
+	}
+	if err := SetBlockVolumeConsistency(mds, "missing", torus.ConsistencySync); err == nil {
+		t.Fatal("expected an error for a missing volume")
+	}
+}
+
+func TestSetBlockVolumeCachePolicy(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	if err := CreateBlockVolume(mds, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBlockVolumeCachePolicy(mds, volName, "sometimes"); err == nil {
+		t.Fatal("expected an invalid policy to be rejected")
+	}
+	if err := SetBlockVolumeCachePolicy(mds, volName, torus.CachePolicyNoCache); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.CachePolicy != torus.CachePolicyNoCache {
+		t.Fatalf("expected cache policy %q, got %q", torus.CachePolicyNoCache, vol.CachePolicy)
+	}
+	if err := SetBlockVolumeCachePolicy(mds, volName, torus.CachePolicyDefault); err != nil {
+		t.Fatal(err)
+	}
+	vol, err = mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.CachePolicy != "" {
+		t.Fatalf("expected the default policy to be stored as empty, got %q", vol.CachePolicy)
+	}
+}
+
+func TestSetBlockVolumeLabels(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	if err := CreateBlockVolume(mds, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBlockVolumeLabels(mds, volName, map[string]string{"team": "storage", "env": "prod"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBlockVolumeLabels(mds, volName, map[string]string{"env": "dev"}, []string{"team"}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := torus.FormatLabels(vol.Labels); got != "env=dev" {
+		t.Fatalf("expected labels env=dev, got %q", got)
+	}
+	if err := SetBlockVolumeLabels(mds, volName, map[string]string{"bad key": "x"}, nil); err == nil {
+		t.Fatal("expected an invalid label to be rejected")
+	}
+	many := make(map[string]string)
+	for i := 0; i < torus.MaxVolumeLabels; i++ {
+		many[fmt.Sprintf("k%d", i)] = "v"
+	}
+	if err := SetBlockVolumeLabels(mds, volName, many, nil); err == nil {
+		t.Fatalf("expected more than %d labels to be rejected", torus.MaxVolumeLabels)
+	}
+	if err := SetBlockVolumeLabels(mds, volName, nil, []string{"env"}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err = mds.GetVolume(volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vol.Labels) != 0 {
+		t.Fatalf("expected no labels left, got %v", vol.Labels)
+	}
+}
+
+func TestEncryptedBlockVolume(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	master, _ := hex.DecodeString(strings.Repeat("ab", 32))
+	err := CreateEncryptedBlockVolume(srv.MDS, volName, 1024, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the master key, or with the wrong one, the volume won't open.
+	if _, err = vol.OpenBlockFile(); err == nil {
+		t.Fatal("expected opening without a master key to fail")
+	}
+	os.Setenv("TORUS_TEST_MASTER_KEY", strings.Repeat("cd", 32))
+	defer os.Unsetenv("TORUS_TEST_MASTER_KEY")
+	srv.Cfg.MasterKeyEnv = "TORUS_TEST_MASTER_KEY"
+	if _, err = vol.OpenBlockFileReadOnly(); err == nil {
+		t.Fatal("expected opening with the wrong master key to fail")
+	}
+
+	os.Setenv("TORUS_TEST_MASTER_KEY", strings.Repeat("ab", 32))
+	w, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("secret block data")
+	if _, err = w.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := vol.OpenBlockFileReadOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("expected %q back, got %q", data, buf)
+	}
+	r.Close()
+	w.Close()
+}
+
+func TestCreateBlockVolumeWithSpec(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	if err := CreateBlockVolumeWithSpec(srv.MDS, volName, 1024, blockset.MustParseBlockLayerSpec("crc,aes,base")); err == nil {
+		t.Fatal("expected a spec with an aes layer to be rejected")
+	}
+	if err := CreateBlockVolumeWithSpec(srv.MDS, volName, 1024, blockset.MustParseBlockLayerSpec("lz4,base")); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := VolumeBlockSpec(srv.MDS, vol.volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := blockset.FormatBlockLayerSpec(spec); s != "lz4,base" {
+		t.Fatalf("expected block spec lz4,base, got %s", s)
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := []byte("compressible compressible compressible")
+	if _, err = f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	inode, err := vol.getOrCreateBlockINode(torus.NewINodeRef(torus.VolumeID(vol.volume.Id), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inode.Blocks) != 2 || torus.BlockLayerKind(inode.Blocks[0].Type) != blockset.Compression {
+		t.Fatalf("expected the volume's blocks laid out by its spec, got %v", inode.Blocks)
+	}
+}
+
+func TestCreateBlockFromSnapshotKeepsSpec(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	if err := CreateBlockVolumeWithSpec(srv.MDS, volName, 1024, blockset.MustParseBlockLayerSpec("crc,rep=3,base")); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("replicated"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.SaveSnapshot(snapName); err != nil {
+		t.Fatal(err)
+	}
+	if err = CreateBlockFromSnapshot(srv, volName, snapName, newVolName, false); err != nil {
+		t.Fatal(err)
+	}
+	newvol, err := OpenBlockVolume(srv, newVolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newvol.volume.BlockSpec != "crc,rep=3,base" {
+		t.Fatalf("expected the restored volume to keep block spec crc,rep=3,base, got %q", newvol.volume.BlockSpec)
+	}
+	// Every block of the restored volume is held three times over, which
+	// is what GC and fsck go by.
+	sets, err := newvol.blocksets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bs := range sets {
+		if n, refs := bs.Length(), len(bs.GetAllBlockRefs()); refs != 3*n {
+			t.Fatalf("expected %d block refs for %d blocks, got %d", 3*n, n, refs)
+		}
+	}
+}
+
+func TestCreateEncryptedBlockVolumeWithSpec(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	master, _ := hex.DecodeString(strings.Repeat("ab", 32))
+	if err := CreateEncryptedBlockVolumeWithSpec(srv.MDS, volName, 1024, blockset.MustParseBlockLayerSpec("lz4,base"), master); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := VolumeBlockSpec(srv.MDS, vol.volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := blockset.FormatBlockLayerSpec(blockset.EncryptedSpec(blockset.MustParseBlockLayerSpec("lz4,base"))); blockset.FormatBlockLayerSpec(spec) != want {
+		t.Fatalf("expected block spec %s, got %s", want, blockset.FormatBlockLayerSpec(spec))
+	}
+}
+
+func TestPublishBlockVolume(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	if err := CreateBlockVolume(mds, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishBlockVolume(mds, volName, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishBlockVolume(mds, volName, "node1"); err != nil {
+		t.Fatalf("publishing again to the same node failed: %v", err)
+	}
+	if err := PublishBlockVolume(mds, volName, "node2"); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked publishing to another node, got %v", err)
+	}
+	// Only the node holding the volume releases it.
+	if err := UnpublishBlockVolume(mds, volName, "node2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishBlockVolume(mds, volName, "node2"); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked publishing to another node, got %v", err)
+	}
+	if err := UnpublishBlockVolume(mds, volName, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishBlockVolume(mds, volName, "node2"); err != nil {
+		t.Fatal(err)
+	}
+}
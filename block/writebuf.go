@@ -0,0 +1,307 @@
+package block
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+var (
+	promWriteBufferBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_block_write_buffer_bytes",
+		Help: "Number of bytes written to a block volume and buffered, yet to be applied to its blocks",
+	}, []string{"volume"})
+	promBufferedWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_block_buffered_writes_total",
+		Help: "Number of writes to a block volume taken into its write buffer",
+	}, []string{"volume"})
+	promBufferFlushedBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_block_buffer_flushed_blocks_total",
+		Help: "Number of blocks of a block volume written out of its write buffer, each with a single read-modify-write",
+	}, []string{"volume"})
+	promWriteCoalescing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_block_write_coalescing_ratio",
+		Help: "Writes buffered per block written out, since the volume was opened",
+	}, []string{"volume"})
+)
+
+func init() {
+	prometheus.MustRegister(promWriteBufferBytes)
+	prometheus.MustRegister(promBufferedWrites)
+	prometheus.MustRegister(promBufferFlushedBlocks)
+	prometheus.MustRegister(promWriteCoalescing)
+}
+
+// writeBuffer holds the writes to a file for up to a window, so that the
+// small writes landing in the same block are applied to it together, with one
+// read-modify-write of the block rather than one each. Reads through it see
+// the writes it holds. It holds at most maxBlocks blocks; a write that needs
+// another waits for the ones held to be written out.
+type writeBuffer struct {
+	f         *torus.File
+	volume    string
+	blkSize   int64
+	window    time.Duration
+	maxBlocks int
+
+	// mut is held while the buffer is written out as well, so that reads
+	// don't see a block between the buffer and the file.
+	mut    sync.Mutex
+	blocks map[int64]*bufferedBlock
+	bytes  int64
+	closed bool
+	// timer writes out the buffer once the window of its oldest write is
+	// up. gen tells it from the timers stopped before it.
+	timer *time.Timer
+	gen   uint64
+	// writes and flushed count the writes taken and the blocks written
+	// out, for the coalescing ratio.
+	writes  uint64
+	flushed uint64
+}
+
+// bufferedBlock is what was written to a block and is yet to be applied.
+type bufferedBlock struct {
+	data []byte
+	// extents are the ranges of data written, sorted and apart.
+	extents []extent
+}
+
+type extent struct {
+	from, to int64
+}
+
+// newWriteBuffer returns a buffer for the writes to f, a file of blocks of
+// blkSize, holding them for up to window in up to maxBytes of memory, or nil
+// if window is zero.
+func newWriteBuffer(f *torus.File, volume string, blkSize int64, window time.Duration, maxBytes uint64) *writeBuffer {
+	if window <= 0 {
+		return nil
+	}
+	maxBlocks := int(int64(maxBytes) / blkSize)
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+	return &writeBuffer{
+		f:         f,
+		volume:    volume,
+		blkSize:   blkSize,
+		window:    window,
+		maxBlocks: maxBlocks,
+		blocks:    make(map[int64]*bufferedBlock),
+	}
+}
+
+// writeAt buffers p for writing at off. Writes that reach past the end of the
+// file go straight to it, after the ones buffered, so that it can fail them.
+func (b *writeBuffer) writeAt(ctx context.Context, p []byte, off int64) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed || off < 0 || uint64(off)+uint64(len(p)) > b.f.Size() {
+		if err := b.flush(ctx); err != nil {
+			return 0, err
+		}
+		return b.f.WriteAtContext(ctx, p, off)
+	}
+	n := 0
+	for n < len(p) {
+		i, bo := off/b.blkSize, off%b.blkSize
+		l := int64(len(p) - n)
+		if l > b.blkSize-bo {
+			l = b.blkSize - bo
+		}
+		bb, ok := b.blocks[i]
+		if !ok {
+			if len(b.blocks) >= b.maxBlocks {
+				// Full; the writer waits for the buffer to be
+				// written out.
+				if err := b.flush(ctx); err != nil {
+					return n, err
+				}
+			}
+			bb = &bufferedBlock{data: make([]byte, b.blkSize)}
+			b.blocks[i] = bb
+		}
+		copy(bb.data[bo:bo+l], p[n:])
+		b.bytes += bb.add(bo, bo+l)
+		n += int(l)
+		off += l
+	}
+	b.writes++
+	promBufferedWrites.WithLabelValues(b.volume).Inc()
+	promWriteBufferBytes.WithLabelValues(b.volume).Set(float64(b.bytes))
+	if b.timer == nil {
+		b.arm()
+	}
+	return n, nil
+}
+
+// readAt reads from the file at off into p, with the writes buffered over
+// what it read.
+func (b *writeBuffer) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	n, err := b.f.ReadAtContext(ctx, p, off)
+	end := off + int64(n)
+	for i := off / b.blkSize; i*b.blkSize < end; i++ {
+		bb, ok := b.blocks[i]
+		if !ok {
+			continue
+		}
+		base := i * b.blkSize
+		for _, e := range bb.extents {
+			from, to := base+e.from, base+e.to
+			if from < off {
+				from = off
+			}
+			if to > end {
+				to = end
+			}
+			if from < to {
+				copy(p[from-off:to-off], bb.data[from-base:to-base])
+			}
+		}
+	}
+	return n, err
+}
+
+// arm starts the timer. b.mut must be held.
+func (b *writeBuffer) arm() {
+	b.gen++
+	gen := b.gen
+	b.timer = time.AfterFunc(b.window, func() { b.expire(gen) })
+}
+
+// expire writes out the buffer for the timer of generation gen. If that
+// fails, the writes stay buffered and it tries again a window later.
+func (b *writeBuffer) expire(gen uint64) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed || b.timer == nil || gen != b.gen {
+		// Written out since.
+		return
+	}
+	b.timer = nil
+	if err := b.flush(context.TODO()); err != nil {
+		clog.Warningf("couldn't write out the buffered writes to block volume %s: %v", b.volume, err)
+		b.arm()
+	}
+}
+
+// after writes out the buffer, then runs fn, holding off writes to the file
+// until it returns.
+func (b *writeBuffer) after(ctx context.Context, fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// flush writes out the blocks buffered, in order, so that each is read and
+// written back once by the file. A block that fails is kept, along with the
+// ones after it. b.mut must be held.
+func (b *writeBuffer) flush(ctx context.Context) error {
+	if len(b.blocks) == 0 {
+		return nil
+	}
+	idx := make([]int64, 0, len(b.blocks))
+	for i := range b.blocks {
+		idx = append(idx, i)
+	}
+	sort.Sort(int64s(idx))
+	defer func() {
+		promWriteBufferBytes.WithLabelValues(b.volume).Set(float64(b.bytes))
+		if b.flushed != 0 {
+			promWriteCoalescing.WithLabelValues(b.volume).Set(float64(b.writes) / float64(b.flushed))
+		}
+	}()
+	for _, i := range idx {
+		bb := b.blocks[i]
+		for _, e := range bb.extents {
+			if _, err := b.f.WriteAtContext(ctx, bb.data[e.from:e.to], i*b.blkSize+e.from); err != nil {
+				return err
+			}
+		}
+		delete(b.blocks, i)
+		b.bytes -= bb.size()
+		b.flushed++
+		promBufferFlushedBlocks.WithLabelValues(b.volume).Inc()
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return nil
+}
+
+// close writes out the buffer and stops it; writes after it go straight to
+// the file.
+func (b *writeBuffer) close(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+	b.closed = true
+	promWriteBufferBytes.DeleteLabelValues(b.volume)
+	return nil
+}
+
+// add marks [from, to) as written, merging it with the extents it touches,
+// and returns how many bytes weren't already.
+func (bb *bufferedBlock) add(from, to int64) int64 {
+	before := bb.size()
+	out := make([]extent, 0, len(bb.extents)+1)
+	placed := false
+	for _, e := range bb.extents {
+		switch {
+		case e.to < from:
+			out = append(out, e)
+		case to < e.from:
+			if !placed {
+				out = append(out, extent{from, to})
+				placed = true
+			}
+			out = append(out, e)
+		default:
+			if e.from < from {
+				from = e.from
+			}
+			if e.to > to {
+				to = e.to
+			}
+		}
+	}
+	if !placed {
+		out = append(out, extent{from, to})
+	}
+	bb.extents = out
+	return bb.size() - before
+}
+
+func (bb *bufferedBlock) size() int64 {
+	var n int64
+	for _, e := range bb.extents {
+		n += e.to - e.from
+	}
+	return n
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,168 @@
+package block
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+)
+
+func newCoalescingServer(md *temp.Server, window time.Duration, bufSize uint64) *torus.Server {
+	cfg := torus.Config{
+		StorageSize:         100 * 1024 * 1024,
+		WriteCoalesceWindow: window,
+		WriteBufferBytes:    bufSize,
+	}
+	mds := temp.NewClient(cfg, md)
+	gmd := mds.GlobalMetadata()
+	blocks, _ := torus.CreateBlockStore("temp", "current", cfg, gmd)
+	s, _ := torus.NewServerByImpl(cfg, mds, blocks)
+	return s
+}
+
+func openCoalescing(t *testing.T, window time.Duration, bufSize uint64) (*BlockVolume, *BlockFile) {
+	md := temp.NewServer()
+	srv := newCoalescingServer(md, window, bufSize)
+	if err := CreateBlockVolume(srv.MDS, volName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := OpenBlockVolume(srv, volName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.buf == nil {
+		t.Fatal("expected a write buffer")
+	}
+	return vol, f
+}
+
+func (b *writeBuffer) stats() (blocks int, flushed uint64) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return len(b.blocks), b.flushed
+}
+
+func TestWriteBufferCoalesces(t *testing.T) {
+	// The window is long enough that only a Sync writes out the buffer.
+	vol, f := openCoalescing(t, time.Hour, 1024)
+	want := make([]byte, 512)
+	for _, off := range []int{0, 32, 16, 300, 256} {
+		chunk := bytes.Repeat([]byte{byte(off + 1)}, 16)
+		copy(want[off:], chunk)
+		if _, err := f.WriteAt(chunk, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reads see the writes buffered, though the file doesn't have them.
+	got := make([]byte, 512)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected buffered writes to be read back, got %v", got)
+	}
+	if _, err := f.File.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, make([]byte, 512)) {
+		t.Fatal("expected the file not to have the buffered writes yet")
+	}
+	if n, flushed := f.buf.stats(); n != 2 || flushed != 0 {
+		t.Fatalf("expected 2 blocks buffered and none written out, got %d and %d", n, flushed)
+	}
+
+	// Sync writes out each block once.
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n, flushed := f.buf.stats(); n != 0 || flushed != 2 {
+		t.Fatalf("expected 2 blocks written out by Sync, got %d buffered and %d written out", n, flushed)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := vol.OpenBlockFileReadOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected the synced writes to be read back, got %v", got)
+	}
+}
+
+func TestWriteBufferFull(t *testing.T) {
+	// Two blocks of 256 bytes fit.
+	_, f := openCoalescing(t, time.Hour, 512)
+	defer f.Close()
+	data := []byte("coalesce")
+	for _, off := range []int64{0, 256, 8, 512} {
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third block waited for the first two to be written out.
+	if n, flushed := f.buf.stats(); n != 1 || flushed != 2 {
+		t.Fatalf("expected 1 block buffered and 2 written out, got %d and %d", n, flushed)
+	}
+	got := make([]byte, len(data))
+	if _, err := f.File.ReadAt(got, 256); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected the written out block in the file, got %q", got)
+	}
+}
+
+func TestWriteBufferWindow(t *testing.T) {
+	_, f := openCoalescing(t, 10*time.Millisecond, 1024)
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("coalesce"), 100); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, flushed := f.buf.stats()
+		if n == 0 && flushed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the buffer to be written out once the window was up, got %d buffered", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBufferedBlockExtents(t *testing.T) {
+	var bb bufferedBlock
+	for _, tt := range []struct {
+		from, to int64
+		added    int64
+		want     []extent
+	}{
+		{10, 20, 10, []extent{{10, 20}}},
+		{30, 40, 10, []extent{{10, 20}, {30, 40}}},
+		{0, 5, 5, []extent{{0, 5}, {10, 20}, {30, 40}}},
+		{15, 35, 10, []extent{{0, 5}, {10, 40}}},
+		{5, 10, 5, []extent{{0, 40}}},
+		{20, 30, 0, []extent{{0, 40}}},
+	} {
+		if added := bb.add(tt.from, tt.to); added != tt.added {
+			t.Errorf("adding [%d, %d): expected %d bytes added, got %d", tt.from, tt.to, tt.added, added)
+		}
+		if !reflect.DeepEqual(bb.extents, tt.want) {
+			t.Fatalf("adding [%d, %d): expected extents %v, got %v", tt.from, tt.to, tt.want, bb.extents)
+		}
+	}
+}
@@ -44,6 +44,20 @@ type Blockset interface {
 	String() string
 }
 
+// BlocksetRangeReader is implemented by Blocksets that can return part of a
+// block without fetching all of it. Layers that need the whole block, such as
+// checksums, don't implement it.
+type BlocksetRangeReader interface {
+	GetBlockRange(ctx context.Context, i int, offset, length uint64) ([]byte, error)
+}
+
+// BlocksetBatchReader is implemented by Blocksets that can fetch the blocks
+// in range [from, to) together, more cheaply than one at a time. errs[i] is
+// the error reading block from+i.
+type BlocksetBatchReader interface {
+	GetBlocks(ctx context.Context, from, to int) (data [][]byte, errs []error)
+}
+
 type BlockLayerKind int
 
 type BlockLayer struct {
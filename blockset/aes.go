@@ -0,0 +1,411 @@
+package blockset
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alternative-storage/torus"
+)
+
+const (
+	aesKeySize   = 32
+	aesNonceSize = 12
+	aesTagSize   = 16
+	// aesSealSize is the size of a marshaled aesSeal.
+	aesSealSize = aesNonceSize + aesTagSize + 4
+
+	// A nonce is the volume ID, the low aesNonceINodeBits bits of the INode
+	// being written and a count of the blocks written to that INode, of
+	// aesNonceWritesBits bits.
+	aesNonceINodeBits  = 32
+	aesNonceWritesBits = 24
+)
+
+var (
+	// ErrNoMasterKey is returned when an encrypted volume is created or
+	// opened without a master key configured.
+	ErrNoMasterKey = errors.New("blockset: no master key configured")
+
+	errNoDataKey = errors.New("blockset: encrypted blockset has no data key")
+)
+
+// aesSeal is what it takes to decrypt a block besides the data key: the
+// nonce it was encrypted with, its GCM tag, and its length, as stores may
+// pad it.
+type aesSeal struct {
+	nonce  [aesNonceSize]byte
+	tag    [aesTagSize]byte
+	length uint32
+}
+
+// written reports whether the block was encrypted at all; blocks never
+// written, or trimmed, are zeros.
+func (s aesSeal) written() bool {
+	return s.nonce != [aesNonceSize]byte{}
+}
+
+// aesBlockset encrypts blocks with AES-256-GCM under the data key of their
+// volume. Ciphertexts are as long as the blocks, so the GCM tag of each is
+// kept in the blockset, with its nonce.
+//
+// A nonce is the ID of the volume and of the INode being written, followed
+// by a count of the blocks this blockset wrote to that INode. Volumes sharing
+// a data key, such as clones, have IDs of their own, and INode IDs are never
+// reused within a volume, so neither are nonces, however often a block is
+// rewritten.
+type aesBlockset struct {
+	sub   blockset
+	mut   sync.RWMutex
+	aead  cipher.AEAD
+	seals []aesSeal
+	// writes counts the blocks written to the INode writing.
+	writing torus.INodeRef
+	writes  uint32
+}
+
+var _ storedBlockset = &aesBlockset{}
+
+func init() {
+	RegisterBlockset(Encryption, func(_ string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		return &aesBlockset{sub: sub}, nil
+	})
+}
+
+func (b *aesBlockset) setKey(key []byte) error {
+	if len(key) != aesKeySize {
+		return fmt.Errorf("blockset: data key must be %d bytes, got %d", aesKeySize, len(key))
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.aead = aead
+	return nil
+}
+
+func (b *aesBlockset) Length() int {
+	return b.sub.Length()
+}
+
+func (b *aesBlockset) Kind() uint32 {
+	return uint32(Encryption)
+}
+
+func (b *aesBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	span, ctx := startSpan(ctx, "aes: GetBlock", i)
+	defer span.Finish()
+	stored, err := b.getStored(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	return b.decode(i, stored)
+}
+
+func (b *aesBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	span, ctx := startSpan(ctx, "aes: PutBlock", i)
+	defer span.Finish()
+	_, err := b.putStored(ctx, inode, i, data)
+	return err
+}
+
+// blockAD returns the additional data a block is sealed with, its index, so
+// that blocks can't be swapped around.
+func blockAD(i int) []byte {
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ad, uint64(i))
+	return ad
+}
+
+func (b *aesBlockset) putStored(ctx context.Context, inode torus.INodeRef, i int, data []byte) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.aead == nil {
+		return nil, errNoDataKey
+	}
+	if i > len(b.seals) {
+		return nil, torus.ErrBlockNotExist
+	}
+	nonce, err := b.nextNonce(inode)
+	if err != nil {
+		return nil, err
+	}
+	seal := aesSeal{nonce: nonce}
+	out := b.aead.Seal(nil, seal.nonce[:], data, blockAD(i))
+	copy(seal.tag[:], out[len(data):])
+	seal.length = uint32(len(data))
+	stored, err := putStoredBlock(ctx, b.sub, inode, i, out[:len(data)])
+	if err != nil {
+		return nil, err
+	}
+	if i == len(b.seals) {
+		b.seals = append(b.seals, seal)
+	} else {
+		b.seals[i] = seal
+	}
+	return stored, nil
+}
+
+// nextNonce returns the nonce of the next block written to inode. The caller
+// holds b.mut.
+func (b *aesBlockset) nextNonce(inode torus.INodeRef) ([aesNonceSize]byte, error) {
+	var nonce [aesNonceSize]byte
+	if uint64(inode.INode)>>aesNonceINodeBits != 0 {
+		return nonce, errors.New("blockset: out of nonces for this volume")
+	}
+	if !inode.Equals(b.writing) {
+		b.writing, b.writes = inode, 0
+	}
+	if b.writes+1 == 1<<aesNonceWritesBits {
+		return nonce, errors.New("blockset: out of nonces for this INode")
+	}
+	b.writes++
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(inode.Volume()))
+	copy(nonce[:5], buf[3:])
+	binary.BigEndian.PutUint32(nonce[5:9], uint32(inode.INode))
+	binary.BigEndian.PutUint32(buf[:4], b.writes)
+	copy(nonce[9:], buf[1:4])
+	return nonce, nil
+}
+
+func (b *aesBlockset) seal(i int) aesSeal {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= len(b.seals) {
+		return aesSeal{}
+	}
+	return b.seals[i]
+}
+
+func (b *aesBlockset) getStored(ctx context.Context, i int) ([]byte, error) {
+	stored, transformed, err := getStoredBlock(ctx, b.sub, i)
+	seal := b.seal(i)
+	if err != nil || transformed || !seal.written() {
+		return stored, err
+	}
+	// Stores may hand back the block padded out to the block size.
+	if int(seal.length) > len(stored) {
+		clog.Warningf("aes: block %d is short: %d bytes of %d", i, len(stored), seal.length)
+		return nil, torus.ErrBlockUnavailable
+	}
+	return stored[:seal.length], nil
+}
+
+func (b *aesBlockset) decode(i int, stored []byte) ([]byte, error) {
+	stored, err := decodeStoredBlock(b.sub, i, stored)
+	seal := b.seal(i)
+	if err != nil || !seal.written() {
+		return stored, err
+	}
+	b.mut.RLock()
+	aead := b.aead
+	b.mut.RUnlock()
+	if aead == nil {
+		return nil, errNoDataKey
+	}
+	if int(seal.length) > len(stored) {
+		return nil, torus.ErrBlockUnavailable
+	}
+	ct := make([]byte, seal.length, int(seal.length)+aesTagSize)
+	copy(ct, stored)
+	data, err := aead.Open(ct[:0], seal.nonce[:], append(ct, seal.tag[:]...), blockAD(i))
+	if err != nil {
+		clog.Warningf("aes: block %d: %v", i, err)
+		return nil, torus.ErrBlockUnavailable
+	}
+	return data, nil
+}
+
+func (b *aesBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *aesBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *aesBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *aesBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := make([]byte, len(b.seals)*aesSealSize)
+	for i, s := range b.seals {
+		out := buf[i*aesSealSize:]
+		copy(out, s.nonce[:])
+		copy(out[aesNonceSize:], s.tag[:])
+		binary.LittleEndian.PutUint32(out[aesNonceSize+aesTagSize:], s.length)
+	}
+	return buf, nil
+}
+
+func (b *aesBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(data)%aesSealSize != 0 {
+		return errors.New("blockset: aes blockset has a partial block")
+	}
+	b.seals = make([]aesSeal, len(data)/aesSealSize)
+	for i := range b.seals {
+		in := data[i*aesSealSize:]
+		copy(b.seals[i].nonce[:], in)
+		copy(b.seals[i].tag[:], in[aesNonceSize:])
+		b.seals[i].length = binary.LittleEndian.Uint32(in[aesNonceSize+aesTagSize:])
+	}
+	return nil
+}
+
+func (b *aesBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *aesBlockset) GetLiveINodes() *roaring.Bitmap {
+	return b.sub.GetLiveINodes()
+}
+
+func (b *aesBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.sub.Truncate(lastIndex, blocksize); err != nil {
+		return err
+	}
+	if lastIndex <= len(b.seals) {
+		b.seals = b.seals[:lastIndex]
+		return nil
+	}
+	// New blocks are zeros, left unencrypted.
+	b.seals = append(b.seals, make([]aesSeal, lastIndex-len(b.seals))...)
+	return nil
+}
+
+func (b *aesBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.sub.Trim(from, to); err != nil {
+		return err
+	}
+	for i := from; i < to && i < len(b.seals); i++ {
+		b.seals[i] = aesSeal{}
+	}
+	return nil
+}
+
+func (b *aesBlockset) GetAllBlockRefs() []torus.BlockRef {
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *aesBlockset) String() string {
+	return "aes\n" + b.sub.String()
+}
+
+// LoadMasterKey reads the master key named by cfg, from its file if it has
+// one and its environment variable otherwise.
+func LoadMasterKey(cfg torus.Config) ([]byte, error) {
+	var s string
+	if cfg.MasterKeyFile != "" {
+		data, err := ioutil.ReadFile(cfg.MasterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("blockset: couldn't read master key: %v", err)
+		}
+		s = string(data)
+	} else if cfg.MasterKeyEnv != "" {
+		s = os.Getenv(cfg.MasterKeyEnv)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, ErrNoMasterKey
+	}
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != aesKeySize {
+		return nil, fmt.Errorf("blockset: master key must be %d hex-encoded bytes", aesKeySize)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewDataKey returns a new random data key for a volume, wrapped by master.
+// A volume copied from a snapshot gets a new key, as its blocks are written
+// afresh; only a clone that shares the blocks of a snapshot keeps the
+// original's key.
+//
+// Every block encrypted under a data key must have a nonce of its own. The
+// encryption layer makes them from the volume ID, the INode ID and a count
+// of the writes to that INode, so a data key may be shared by several
+// volumes, as long as no two of them write blocks under the same volume ID,
+// and no volume writes an INode ID twice.
+func NewDataKey(master []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, aesNonceSize+aesKeySize)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	nonce, key := buf[:aesNonceSize], buf[aesNonceSize:]
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapDataKey returns the data key wrapped by NewDataKey, which fails if
+// master isn't the key it was wrapped with.
+func UnwrapDataKey(master, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aesNonceSize {
+		return nil, errors.New("blockset: wrapped data key is too short")
+	}
+	key, err := aead.Open(nil, wrapped[:aesNonceSize], wrapped[aesNonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("blockset: couldn't unwrap data key; is it the right master key?")
+	}
+	return key, nil
+}
+
+// SetDataKey gives the encryption layer of b, if any, the data key to
+// encrypt and decrypt blocks with.
+func SetDataKey(b torus.Blockset, key []byte) error {
+	for l := b; l != nil; l = l.GetSubBlockset() {
+		if a, ok := l.(*aesBlockset); ok {
+			return a.setKey(key)
+		}
+	}
+	return nil
+}
+
+// EncryptedSpec returns spec with an encryption layer added, below the crc
+// and compression layers it starts with, so that they see the blocks as
+// they're stored and compress them before encryption, and above those that
+// write blocks of their own, like replication.
+func EncryptedSpec(spec torus.BlockLayerSpec) torus.BlockLayerSpec {
+	i := 0
+	for i < len(spec) && (spec[i].Kind == CRC || spec[i].Kind == Compression) {
+		i++
+	}
+	out := append(torus.BlockLayerSpec(nil), spec[:i]...)
+	out = append(out, torus.BlockLayer{Kind: Encryption})
+	return append(out, spec[i:]...)
+}
@@ -0,0 +1,217 @@
+package blockset
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func newAESBlockset(t *testing.T, spec string) (torus.BlockStore, torus.Blockset) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec(spec), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDataKey(b, bytes.Repeat([]byte{7}, aesKeySize)); err != nil {
+		t.Fatal(err)
+	}
+	return s, b
+}
+
+func TestAESReadWrite(t *testing.T) {
+	_, b := newAESBlockset(t, "aes,base")
+	readWriteTest(t, b.(blockset))
+}
+
+func TestAESNonces(t *testing.T) {
+	s, b := newAESBlockset(t, "aes,base")
+	a := b.(*aesBlockset)
+	base := a.sub.(*baseBlockset)
+	inode := torus.NewINodeRef(1, 2)
+	data := bytes.Repeat([]byte("plaintext"), 100)
+	seen := make(map[[aesNonceSize]byte]bool)
+	var stored [][]byte
+	for n := 0; n < 3; n++ {
+		if err := b.PutBlock(context.TODO(), inode, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		if seen[a.seals[0].nonce] {
+			t.Fatal("rewriting a block reused its nonce")
+		}
+		seen[a.seals[0].nonce] = true
+		ct, _ := s.GetBlock(context.TODO(), base.blocks[0])
+		if bytes.Contains(ct, []byte("plaintext")) {
+			t.Fatal("block was stored in the clear")
+		}
+		stored = append(stored, ct)
+	}
+	if bytes.Equal(stored[0], stored[1]) {
+		t.Fatal("rewriting a block with the same data stored the same ciphertext")
+	}
+
+	// A new blockset counts writes afresh, but for a new INode.
+	_, nb := newAESBlockset(t, "aes,base")
+	nb.PutBlock(context.TODO(), torus.NewINodeRef(1, 3), 0, data)
+	if seen[nb.(*aesBlockset).seals[0].nonce] {
+		t.Fatal("a new INode reused a nonce")
+	}
+
+	// Another volume sharing the data key writing the same INode doesn't
+	// reuse them either.
+	if err := b.PutBlock(context.TODO(), torus.NewINodeRef(2, 2), 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if seen[a.seals[0].nonce] {
+		t.Fatal("another volume reused a nonce")
+	}
+
+	// Running out of nonces is an error, not a wrap around.
+	a.writes = 1<<aesNonceWritesBits - 2
+	if err := b.PutBlock(context.TODO(), torus.NewINodeRef(2, 2), 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutBlock(context.TODO(), torus.NewINodeRef(2, 2), 0, data); err == nil {
+		t.Fatal("expected running out of nonces for an INode to fail")
+	}
+	if err := b.PutBlock(context.TODO(), torus.NewINodeRef(2, 1<<aesNonceINodeBits), 0, data); err == nil {
+		t.Fatal("expected an INode ID too large for a nonce to fail")
+	}
+}
+
+func TestAESMarshal(t *testing.T) {
+	s, b := newAESBlockset(t, "crc,aes,base")
+	inode := torus.NewINodeRef(1, 1)
+	data := []byte("Some data")
+	if err := b.PutBlock(context.TODO(), inode, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Truncate(3, 1024); err != nil {
+		t.Fatal(err)
+	}
+	marshal, err := torus.MarshalBlocksetToProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, err := UnmarshalFromProto(marshal, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The crc layer outside checks the ciphertext, without the key.
+	if _, err := nb.GetBlock(context.TODO(), 0); err != errNoDataKey {
+		t.Fatalf("expected errNoDataKey reading without the key, got %v", err)
+	}
+	base := nb.GetSubBlockset().GetSubBlockset().(*baseBlockset)
+	ct, _ := s.GetBlock(context.TODO(), base.blocks[0])
+	ct[0] ^= 0xff
+	s.WriteBlock(context.TODO(), base.blocks[0], ct)
+	if _, err := nb.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected the crc layer to catch corruption without the key, got %v", err)
+	}
+	ct[0] ^= 0xff
+	s.WriteBlock(context.TODO(), base.blocks[0], ct)
+
+	SetDataKey(nb, bytes.Repeat([]byte{7}, aesKeySize))
+	got, err := nb.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+	// Blocks never written are zeros, and need no decrypting.
+	got, err = nb.GetBlock(context.TODO(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, make([]byte, 1024)) {
+		t.Fatal("expected a zero block")
+	}
+
+	// The wrong key doesn't decrypt.
+	SetDataKey(nb, bytes.Repeat([]byte{8}, aesKeySize))
+	if _, err := nb.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected ErrBlockUnavailable with the wrong key, got %v", err)
+	}
+}
+
+func TestAESCompressed(t *testing.T) {
+	s, b := newAESBlockset(t, "crc,lz4,aes,base")
+	inode := torus.NewINodeRef(1, 1)
+	data := bytes.Repeat([]byte("Some data"), 100)
+	if err := b.PutBlock(context.TODO(), inode, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	// Stores may pad blocks out to the block size.
+	base := b.GetSubBlockset().GetSubBlockset().GetSubBlockset().(*baseBlockset)
+	ct, _ := s.GetBlock(context.TODO(), base.blocks[0])
+	if len(ct) >= 1024 {
+		t.Fatalf("expected the block to be compressed before encryption, got %d bytes", len(ct))
+	}
+	padded := make([]byte, 1024)
+	copy(padded, ct)
+	s.WriteBlock(context.TODO(), base.blocks[0], padded)
+	got, err := b.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data not retrieved")
+	}
+}
+
+func TestDataKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := LoadMasterKey(torus.Config{}); err != ErrNoMasterKey {
+		t.Fatalf("expected ErrNoMasterKey, got %v", err)
+	}
+	path := filepath.Join(dir, "master.key")
+	ioutil.WriteFile(path, []byte(strings.Repeat("0f", 32)+"\n"), 0600)
+	master, err := LoadMasterKey(torus.Config{MasterKeyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, []byte("0f0f"), 0600)
+	if _, err := LoadMasterKey(torus.Config{MasterKeyFile: path}); err == nil {
+		t.Fatal("expected a short master key to be refused")
+	}
+
+	wrapped, err := NewDataKey(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := UnwrapDataKey(master, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != aesKeySize {
+		t.Fatalf("expected a %d byte data key, got %d", aesKeySize, len(key))
+	}
+	if _, err := UnwrapDataKey(bytes.Repeat([]byte{1}, aesKeySize), wrapped); err == nil {
+		t.Fatal("expected unwrapping with the wrong master key to fail")
+	}
+}
+
+func TestEncryptedSpec(t *testing.T) {
+	for in, want := range map[string]string{
+		"base":               "aes,base",
+		"crc,base":           "crc,aes,base",
+		"crc,lz4,rep=2,base": "crc,lz4,aes,rep=2,base",
+		"crc,ec=4.2,base":    "crc,aes,ec=4.2,base",
+	} {
+		if got := FormatBlockLayerSpec(EncryptedSpec(MustParseBlockLayerSpec(in))); got != want {
+			t.Errorf("%s: expected %s, got %s", in, want, got)
+		}
+	}
+}
@@ -45,6 +45,8 @@ func (b *baseBlockset) Kind() uint32 {
 }
 
 func (b *baseBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	span, ctx := startSpan(ctx, "base: GetBlock", i)
+	defer span.Finish()
 	if i >= len(b.blocks) {
 		return nil, torus.ErrBlockNotExist
 	}
@@ -62,7 +64,65 @@ func (b *baseBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
 	return bytes, err
 }
 
+func (b *baseBlockset) GetBlockRange(ctx context.Context, i int, offset, length uint64) ([]byte, error) {
+	span, ctx := startSpan(ctx, "base: GetBlockRange", i)
+	defer span.Finish()
+	if i >= len(b.blocks) {
+		return nil, torus.ErrBlockNotExist
+	}
+	if b.blocks[i].IsZero() {
+		return make([]byte, length), nil
+	}
+	if torus.BlockLog.LevelAt(capnslog.TRACE) {
+		torus.BlockLog.Tracef("base: getting range [%d:+%d] of block %d at BlockID %s", offset, length, i, b.blocks[i])
+	}
+	bytes, err := torus.GetBlockRange(ctx, b.store, b.blocks[i], offset, length)
+	if err != nil {
+		promBaseFail.Inc()
+		return nil, err
+	}
+	return bytes, nil
+}
+
+func (b *baseBlockset) GetBlocks(ctx context.Context, from, to int) ([][]byte, []error) {
+	span, ctx := startSpan(ctx, "base: GetBlocks", from)
+	defer span.Finish()
+	data := make([][]byte, to-from)
+	errs := make([]error, to-from)
+	var (
+		refs []torus.BlockRef
+		idx  []int
+	)
+	for i := from; i < to; i++ {
+		switch {
+		case i >= len(b.blocks):
+			errs[i-from] = torus.ErrBlockNotExist
+		case b.blocks[i].IsZero():
+			data[i-from] = make([]byte, b.store.BlockSize())
+		default:
+			refs = append(refs, b.blocks[i])
+			idx = append(idx, i-from)
+		}
+	}
+	if len(refs) == 0 {
+		return data, errs
+	}
+	if torus.BlockLog.LevelAt(capnslog.TRACE) {
+		torus.BlockLog.Tracef("base: getting blocks %d to %d starting at BlockID %s", from, to, refs[0])
+	}
+	got, goterrs := torus.GetBlocks(ctx, b.store, refs)
+	for j, i := range idx {
+		data[i], errs[i] = got[j], goterrs[j]
+		if errs[i] != nil {
+			promBaseFail.Inc()
+		}
+	}
+	return data, errs
+}
+
 func (b *baseBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	span, ctx := startSpan(ctx, "base: PutBlock", i)
+	defer span.Finish()
 	if i > len(b.blocks) {
 		return torus.ErrBlockNotExist
 	}
@@ -75,7 +135,7 @@ func (b *baseBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int
 	// 	}
 	// 	return nil
 	// }
-	newBlockID := b.makeID(inode)
+	newBlockID := newID(ctx, b, inode)
 	if torus.BlockLog.LevelAt(capnslog.TRACE) {
 		torus.BlockLog.Tracef("base: writing block %d at BlockID %s", i, newBlockID)
 	}
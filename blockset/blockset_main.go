@@ -12,7 +12,9 @@ import (
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/models"
 	"github.com/coreos/pkg/capnslog"
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
 )
 
 var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "blockset")
@@ -26,11 +28,39 @@ var (
 		Name: "torus_blockset_base_failed_blocks",
 		Help: "Number of blocks that failed",
 	})
+	promECReconstructed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_ec_reconstructed_blocks",
+		Help: "Number of blocks rebuilt from erasure coding parity",
+	})
+	promCompressIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_compress_in_bytes_total",
+		Help: "Number of bytes written to compressing block layers",
+	})
+	promCompressOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_compress_out_bytes_total",
+		Help: "Number of bytes compressing block layers stored for what was written to them",
+	})
+	promCompressSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_compress_skipped_blocks",
+		Help: "Number of blocks stored uncompressed because they wouldn't shrink",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(promCRCFail)
 	prometheus.MustRegister(promBaseFail)
+	prometheus.MustRegister(promECReconstructed)
+	prometheus.MustRegister(promCompressIn)
+	prometheus.MustRegister(promCompressOut)
+	prometheus.MustRegister(promCompressSkipped)
+}
+
+// startSpan starts a span for op on the ith block of a layer, if ctx is part
+// of a trace.
+func startSpan(ctx context.Context, op string, i int) (opentracing.Span, context.Context) {
+	span, ctx := torus.StartChildSpan(ctx, op)
+	span.SetTag("index", i)
+	return span, ctx
 }
 
 type blockset interface {
@@ -45,6 +75,9 @@ const (
 	Base torus.BlockLayerKind = iota
 	CRC
 	Replication
+	ErasureCoding
+	Compression
+	Encryption
 )
 
 // CreateBlocksetFunc is the signature of a constructor used to create
@@ -125,6 +158,12 @@ func ParseBlockLayerKind(s string) (torus.BlockLayerKind, error) {
 		return CRC, nil
 	case "rep", "r":
 		return Replication, nil
+	case "ec":
+		return ErasureCoding, nil
+	case "lz4":
+		return Compression, nil
+	case "aes":
+		return Encryption, nil
 	default:
 		return torus.BlockLayerKind(-1), fmt.Errorf("no such block layer type: %s", s)
 	}
@@ -143,6 +182,11 @@ func ParseBlockLayerSpec(s string) (torus.BlockLayerSpec, error) {
 		if len(opts) > 1 {
 			opt = opts[1]
 		}
+		if k == ErasureCoding {
+			if _, _, err := parseECOptions(opt); err != nil {
+				return nil, err
+			}
+		}
 		out = append(out, torus.BlockLayer{
 			Kind:    k,
 			Options: opt,
@@ -151,6 +195,36 @@ func ParseBlockLayerSpec(s string) (torus.BlockLayerSpec, error) {
 	return out, nil
 }
 
+// FormatBlockLayerSpec returns the string form of spec, as accepted by
+// ParseBlockLayerSpec.
+func FormatBlockLayerSpec(spec torus.BlockLayerSpec) string {
+	var out []string
+	for _, x := range spec {
+		var name string
+		switch x.Kind {
+		case Base:
+			name = "base"
+		case CRC:
+			name = "crc"
+		case Replication:
+			name = "rep"
+		case ErasureCoding:
+			name = "ec"
+		case Compression:
+			name = "lz4"
+		case Encryption:
+			name = "aes"
+		default:
+			name = fmt.Sprintf("unknown(%d)", x.Kind)
+		}
+		if x.Options != "" {
+			name += "=" + x.Options
+		}
+		out = append(out, name)
+	}
+	return strings.Join(out, ",")
+}
+
 func MustParseBlockLayerSpec(s string) torus.BlockLayerSpec {
 	out, err := ParseBlockLayerSpec(s)
 	if err != nil {
@@ -0,0 +1,248 @@
+package blockset
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alternative-storage/torus"
+)
+
+// Formats blocks are stored in by a compressing blockset.
+const (
+	formatRaw byte = iota
+	formatLZ4
+)
+
+// storedBlockset is implemented by blocksets that change blocks on their way
+// to storage. Blocksets above them that check blocks, like crc, go through
+// it to check the bytes actually stored. When several are stacked, the stored
+// bytes are those of the lowest.
+type storedBlockset interface {
+	blockset
+	// putStored puts data as block i, and returns the bytes stored for it.
+	putStored(ctx context.Context, inode torus.INodeRef, i int, data []byte) ([]byte, error)
+	// getStored returns the bytes stored for block i, as putStored did.
+	getStored(ctx context.Context, i int) ([]byte, error)
+	// decode turns the bytes stored for block i back into the block.
+	decode(i int, stored []byte) ([]byte, error)
+}
+
+// putStoredBlock puts data as block i of b, and returns the bytes stored for
+// it.
+func putStoredBlock(ctx context.Context, b blockset, inode torus.INodeRef, i int, data []byte) ([]byte, error) {
+	if sb, ok := b.(storedBlockset); ok {
+		return sb.putStored(ctx, inode, i, data)
+	}
+	return data, b.PutBlock(ctx, inode, i, data)
+}
+
+// getStoredBlock returns the bytes stored for block i of b, along with
+// whether b transforms blocks at all.
+func getStoredBlock(ctx context.Context, b blockset, i int) ([]byte, bool, error) {
+	if sb, ok := b.(storedBlockset); ok {
+		data, err := sb.getStored(ctx, i)
+		return data, true, err
+	}
+	data, err := b.GetBlock(ctx, i)
+	return data, false, err
+}
+
+// decodeStoredBlock turns the bytes stored for block i of b back into the
+// block.
+func decodeStoredBlock(b blockset, i int, stored []byte) ([]byte, error) {
+	if sb, ok := b.(storedBlockset); ok {
+		return sb.decode(i, stored)
+	}
+	return stored, nil
+}
+
+// compressBlockset compresses blocks with LZ4 before they reach its
+// sub-blockset. A compressed block is stored as its 4-byte little-endian
+// compressed length followed by the LZ4 block; blocks that wouldn't come out
+// shorter are stored raw. Which way each block went is kept as a byte of the
+// blockset's own, so nothing is ever stored larger than it came in.
+type compressBlockset struct {
+	sub     blockset
+	mut     sync.RWMutex
+	formats []byte
+}
+
+var _ storedBlockset = &compressBlockset{}
+
+func init() {
+	RegisterBlockset(Compression, func(_ string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		return &compressBlockset{sub: sub}, nil
+	})
+}
+
+func (b *compressBlockset) Length() int {
+	return b.sub.Length()
+}
+
+func (b *compressBlockset) Kind() uint32 {
+	return uint32(Compression)
+}
+
+func (b *compressBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	span, ctx := startSpan(ctx, "compress: GetBlock", i)
+	defer span.Finish()
+	stored, err := b.getStored(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	return b.decode(i, stored)
+}
+
+func (b *compressBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	span, ctx := startSpan(ctx, "compress: PutBlock", i)
+	defer span.Finish()
+	_, err := b.putStored(ctx, inode, i, data)
+	return err
+}
+
+func (b *compressBlockset) putStored(ctx context.Context, inode torus.INodeRef, i int, data []byte) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > len(b.formats) {
+		return nil, torus.ErrBlockNotExist
+	}
+	format, out := formatRaw, data
+	if c := lz4Compress(data); 4+len(c) < len(data) {
+		format = formatLZ4
+		out = make([]byte, 4+len(c))
+		binary.LittleEndian.PutUint32(out, uint32(len(c)))
+		copy(out[4:], c)
+	} else {
+		promCompressSkipped.Inc()
+	}
+	promCompressIn.Add(float64(len(data)))
+	promCompressOut.Add(float64(len(out)))
+	stored, err := putStoredBlock(ctx, b.sub, inode, i, out)
+	if err != nil {
+		return nil, err
+	}
+	if i == len(b.formats) {
+		b.formats = append(b.formats, format)
+	} else {
+		b.formats[i] = format
+	}
+	return stored, nil
+}
+
+func (b *compressBlockset) getStored(ctx context.Context, i int) ([]byte, error) {
+	stored, transformed, err := getStoredBlock(ctx, b.sub, i)
+	if err != nil || transformed || b.format(i) != formatLZ4 {
+		return stored, err
+	}
+	// Stores may hand back the block padded out to the block size.
+	n, err := lz4Length(stored)
+	if err != nil {
+		return nil, err
+	}
+	return stored[:4+n], nil
+}
+
+func (b *compressBlockset) format(i int) byte {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= len(b.formats) {
+		return formatRaw
+	}
+	return b.formats[i]
+}
+
+func lz4Length(stored []byte) (int, error) {
+	if len(stored) < 4 {
+		return 0, errLZ4Corrupt
+	}
+	n := int(binary.LittleEndian.Uint32(stored))
+	if n > len(stored)-4 {
+		return 0, errLZ4Corrupt
+	}
+	return n, nil
+}
+
+func (b *compressBlockset) decode(i int, stored []byte) ([]byte, error) {
+	stored, err := decodeStoredBlock(b.sub, i, stored)
+	if err != nil || b.format(i) != formatLZ4 {
+		return stored, err
+	}
+	n, err := lz4Length(stored)
+	if err == nil {
+		stored, err = lz4Decompress(stored[4:4+n], int(b.getStore().BlockSize()))
+	}
+	if err != nil {
+		clog.Warningf("compress: block %d: %v", i, err)
+		return nil, torus.ErrBlockUnavailable
+	}
+	return stored, nil
+}
+
+func (b *compressBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *compressBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *compressBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *compressBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return append([]byte(nil), b.formats...), nil
+}
+
+func (b *compressBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.formats = append([]byte(nil), data...)
+	return nil
+}
+
+func (b *compressBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *compressBlockset) GetLiveINodes() *roaring.Bitmap {
+	return b.sub.GetLiveINodes()
+}
+
+func (b *compressBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.sub.Truncate(lastIndex, blocksize); err != nil {
+		return err
+	}
+	if lastIndex <= len(b.formats) {
+		b.formats = b.formats[:lastIndex]
+		return nil
+	}
+	// New blocks are zeros, stored raw.
+	b.formats = append(b.formats, make([]byte, lastIndex-len(b.formats))...)
+	return nil
+}
+
+func (b *compressBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.sub.Trim(from, to); err != nil {
+		return err
+	}
+	for i := from; i < to && i < len(b.formats); i++ {
+		b.formats[i] = formatRaw
+	}
+	return nil
+}
+
+func (b *compressBlockset) GetAllBlockRefs() []torus.BlockRef {
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *compressBlockset) String() string {
+	return "lz4\n" + b.sub.String()
+}
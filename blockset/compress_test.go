@@ -0,0 +1,113 @@
+package blockset
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestLZ4(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 100)
+	for _, in := range [][]byte{
+		nil,
+		[]byte("short"),
+		make([]byte, 4096),
+		random,
+		text,
+		append(append([]byte(nil), text...), random[:300]...),
+	} {
+		c := lz4Compress(in)
+		out, err := lz4Decompress(c, len(in))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(in), err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("%d bytes didn't survive compression", len(in))
+		}
+	}
+	if c := lz4Compress(text); len(c) > len(text)/10 {
+		t.Errorf("expected repeated text to compress well, got %d bytes from %d", len(c), len(text))
+	}
+	if _, err := lz4Decompress(lz4Compress(text), len(text)-1); err != errLZ4Corrupt {
+		t.Errorf("expected a block decompressing past its limit to be corrupt, got %v", err)
+	}
+}
+
+func TestCompressReadWrite(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	readWriteTest(t, &compressBlockset{sub: b})
+
+	zeros := make([]byte, 1024)
+	random := make([]byte, 1024)
+	rand.Read(random)
+	c := &compressBlockset{sub: b}
+	inode := torus.NewINodeRef(1, 1)
+	for i, data := range [][]byte{zeros, random} {
+		if err := c.PutBlock(context.TODO(), inode, i, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.GetBlock(context.TODO(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("block %d has the wrong data", i)
+		}
+	}
+	stored, _ := s.GetBlock(context.TODO(), b.blocks[0])
+	if c.formats[0] != formatLZ4 || len(stored) >= 1024 {
+		t.Errorf("expected zeros to be stored compressed, got %d bytes", len(stored))
+	}
+	// Random data doesn't compress, and mustn't grow either.
+	stored, _ = s.GetBlock(context.TODO(), b.blocks[1])
+	if c.formats[1] != formatRaw || !bytes.Equal(stored, random) {
+		t.Errorf("expected random data to be stored raw, got %d bytes", len(stored))
+	}
+}
+
+func TestCompressMarshal(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	marshalTest(t, s, MustParseBlockLayerSpec("crc,lz4,base"))
+	if spec := FormatBlockLayerSpec(MustParseBlockLayerSpec("crc,lz4,base")); spec != "crc,lz4,base" {
+		t.Errorf("expected the spec to format back the same, got %s", spec)
+	}
+}
+
+func TestCompressCRC(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	crc := newCRCBlockset(&compressBlockset{sub: b})
+	crc.setStore(s)
+	inode := torus.NewINodeRef(1, 1)
+	data := bytes.Repeat([]byte("Some data"), 100)
+	if err := crc.PutBlock(context.TODO(), inode, 0, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stores may pad blocks out to the block size.
+	stored, _ := s.GetBlock(context.TODO(), b.blocks[0])
+	padded := make([]byte, 1024)
+	copy(padded, stored)
+	s.WriteBlock(context.TODO(), b.blocks[0], padded)
+	got, err := crc.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data not retrieved")
+	}
+
+	// The CRC covers the compressed bytes.
+	padded[6] ^= 0xff
+	s.WriteBlock(context.TODO(), b.blocks[0], padded)
+	if _, err := crc.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected corruption of the compressed block to be caught, got %v", err)
+	}
+}
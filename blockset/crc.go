@@ -49,28 +49,126 @@ func (b *crcBlockset) Kind() uint32 {
 }
 
 func (b *crcBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	span, ctx := startSpan(ctx, "crc: GetBlock", i)
+	defer span.Finish()
 	b.mut.RLock()
 	defer b.mut.RUnlock()
 	if i >= len(b.crcs) {
 		clog.Trace("crc: requesting block off the edge of known blocks")
 		return nil, torus.ErrBlockNotExist
 	}
-	data, err := b.sub.GetBlock(ctx, i)
-	if err != nil {
-		clog.Trace("crc: error requesting subblock")
-		return nil, err
+	rr := &torus.ReplicaRead{}
+	ctx = torus.WithReplicaRead(ctx, rr)
+	var bad error
+	for {
+		// Check what was stored, which isn't the block itself when the
+		// layers below transform it.
+		stored, _, err := getStoredBlock(ctx, b.sub, i)
+		if err != nil {
+			if bad != nil {
+				// Every copy that could be read was bad.
+				return nil, bad
+			}
+			clog.Trace("crc: error requesting subblock")
+			return nil, err
+		}
+		bad = b.check(i, stored)
+		if bad == nil {
+			b.repair(rr)
+			return decodeStoredBlock(b.sub, i, stored)
+		}
+		if !b.retryOther(rr) {
+			return nil, bad
+		}
+	}
+}
+
+// GetBlocks fetches the blocks in range [from, to) together if the layer
+// below can. Blocks that fail their checksum there are read again one at a
+// time, which tries the other copies.
+func (b *crcBlockset) GetBlocks(ctx context.Context, from, to int) ([][]byte, []error) {
+	span, ctx := startSpan(ctx, "crc: GetBlocks", from)
+	defer span.Finish()
+	data := make([][]byte, to-from)
+	errs := make([]error, to-from)
+	r, ok := b.sub.(torus.BlocksetBatchReader)
+	if _, stored := b.sub.(storedBlockset); ok && !stored {
+		b.mut.RLock()
+		end := to
+		if end > len(b.crcs) {
+			end = len(b.crcs)
+		}
+		if from < end {
+			got, _ := r.GetBlocks(ctx, from, end)
+			for j, blk := range got {
+				if blk != nil && crc32.ChecksumIEEE(blk) == b.crcs[from+j] {
+					data[j] = blk
+				}
+			}
+		}
+		b.mut.RUnlock()
+	}
+	for i := range data {
+		if data[i] == nil {
+			data[i], errs[i] = b.GetBlock(ctx, from+i)
+		}
+	}
+	return data, errs
+}
+
+// retryOther marks the copy rr last read as bad, and reports whether another
+// copy may be read in its place.
+func (b *crcBlockset) retryOther(rr *torus.ReplicaRead) bool {
+	if rr.Ref.IsZero() {
+		// The store doesn't keep replicas.
+		return false
+	}
+	if rr.Bad.Has(rr.Peer) {
+		return false
+	}
+	if rr.Peer != "" {
+		fields := torus.BlockLogFields(rr.Ref)
+		fields["peer"] = rr.Peer
+		torus.WithFields(clog, fields).Warningf("crc: block from peer is corrupt")
+	}
+	rr.Bad = append(rr.Bad, rr.Peer)
+	return true
+}
+
+// repair writes the good copy rr last read over the bad ones it passed.
+func (b *crcBlockset) repair(rr *torus.ReplicaRead) {
+	var peers []string
+	for _, p := range rr.Bad {
+		if p != "" {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	if r, ok := b.getStore().(torus.ReplicaRepairer); ok {
+		r.RepairBlock(rr.Ref, rr.Data, peers)
 	}
+}
+
+func (b *crcBlockset) check(i int, data []byte) error {
 	crc := crc32.ChecksumIEEE(data)
 	if crc != b.crcs[i] {
 		clog.Warningf("crc: block %d did not pass crc", i)
-		clog.Debugf("crc: %x should be %x\ndata : %v\n\n", crc, b.crcs[i], data[:10])
+		head := data
+		if len(head) > 10 {
+			head = head[:10]
+		}
+		clog.Debugf("crc: %x should be %x\ndata : %v\n\n", crc, b.crcs[i], head)
 		promCRCFail.Inc()
-		return nil, torus.ErrBlockUnavailable
+		return torus.ErrBlockUnavailable
 	}
-	return data, nil
+	return nil
 }
 
 func (b *crcBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	span, ctx := startSpan(ctx, "crc: PutBlock", i)
+	defer span.Finish()
 	b.mut.Lock()
 	defer b.mut.Unlock()
 	if i > len(b.crcs) {
@@ -80,10 +178,13 @@ func (b *crcBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int,
 	if crc == b.emptyCrc {
 		ctx = context.WithValue(ctx, "isEmpty", true)
 	}
-	err := b.sub.PutBlock(ctx, inode, i, data)
+	stored, err := putStoredBlock(ctx, b.sub, inode, i, data)
 	if err != nil {
 		return err
 	}
+	if _, ok := b.sub.(storedBlockset); ok {
+		crc = crc32.ChecksumIEEE(stored)
+	}
 	if i == len(b.crcs) {
 		b.crcs = append(b.crcs, crc)
 	} else {
@@ -189,3 +290,46 @@ func (b *crcBlockset) GetAllBlockRefs() []torus.BlockRef {
 func (b *crcBlockset) String() string {
 	return "crc\n" + b.sub.String()
 }
+
+// BlockChecksums returns the CRC-32 the crc layer of b recorded for each
+// block it put in storage, keyed by the block's ref. A replication layer
+// below the crc layer stores copies of the same bytes, which have the same
+// checksum. It returns nil if b has no crc layer, or one above layers, like
+// erasure coding, that don't store each of its blocks as blocks of their own.
+func BlockChecksums(b torus.Blockset) map[torus.BlockRef]uint32 {
+	var c *crcBlockset
+	for l := b; l != nil && c == nil; l = l.GetSubBlockset() {
+		c, _ = l.(*crcBlockset)
+	}
+	if c == nil {
+		return nil
+	}
+	sub := c.sub
+	for {
+		if _, ok := sub.(storedBlockset); !ok {
+			break
+		}
+		sub = sub.GetSubBlockset().(blockset)
+	}
+	var copies [][]torus.BlockRef
+	if rep, ok := sub.(*replicationBlockset); ok {
+		copies = rep.repBlocks
+		sub = rep.sub
+	}
+	base, ok := sub.(*baseBlockset)
+	if !ok {
+		return nil
+	}
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	out := make(map[torus.BlockRef]uint32)
+	for _, refs := range append([][]torus.BlockRef{base.GetAllBlockRefs()}, copies...) {
+		for i, ref := range refs {
+			if i >= len(c.crcs) || ref.IsZero() {
+				continue
+			}
+			out[ref] = c.crcs[i]
+		}
+	}
+	return out
+}
@@ -1,6 +1,8 @@
 package blockset
 
 import (
+	"bytes"
+	"hash/crc32"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -35,3 +37,68 @@ func TestCRCCorruption(t *testing.T) {
 		t.Fatal("No corruption detection")
 	}
 }
+
+func TestCRCBlockChecksums(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	for _, spec := range []string{"crc,base", "crc,lz4,base", "crc,rep=2,base"} {
+		b, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec(spec), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inode := torus.NewINodeRef(1, 1)
+		for i := 0; i < 3; i++ {
+			if err := b.PutBlock(context.TODO(), inode, i, bytes.Repeat([]byte{byte(i)}, 1024)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sums := BlockChecksums(b)
+		if want := len(b.GetAllBlockRefs()); len(sums) != want {
+			t.Fatalf("%s: expected %d checksums, got %d", spec, want, len(sums))
+		}
+		for ref, sum := range sums {
+			data, err := s.GetBlock(context.TODO(), ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if crc32.ChecksumIEEE(data) != sum {
+				t.Fatalf("%s: checksum of stored block %s doesn't match", spec, ref)
+			}
+		}
+	}
+	b, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec("base"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums := BlockChecksums(b); sums != nil {
+		t.Fatalf("expected no checksums without a crc layer, got %v", sums)
+	}
+}
+
+func TestCRCGetBlocks(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	crc := newCRCBlockset(b)
+	inode := torus.NewINodeRef(1, 1)
+	for i := 0; i < 4; i++ {
+		crc.PutBlock(context.TODO(), inode, i, bytes.Repeat([]byte{byte(i)}, 1024))
+	}
+	s.WriteBlock(context.TODO(), b.blocks[2], []byte("Evil Corruption!!"))
+	data, errs := crc.GetBlocks(context.TODO(), 1, 5)
+	for i := 1; i < 5; i++ {
+		d, err := data[i-1], errs[i-1]
+		switch i {
+		case 2:
+			if err != torus.ErrBlockUnavailable {
+				t.Fatalf("expected corruption of block %d to be caught, got %v", i, err)
+			}
+		case 4:
+			if err != torus.ErrBlockNotExist {
+				t.Fatalf("expected block %d not to exist, got %v", i, err)
+			}
+		default:
+			if err != nil || !bytes.Equal(d, bytes.Repeat([]byte{byte(i)}, 1024)) {
+				t.Fatalf("unexpected block %d: %v", i, err)
+			}
+		}
+	}
+}
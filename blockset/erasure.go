@@ -0,0 +1,438 @@
+package blockset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/alternative-storage/torus"
+)
+
+// erasureBlockset protects each block with Reed-Solomon parity. A block is
+// split into k data shards, which m parity shards are computed from, and
+// each of the k+m shards is stored as a block of its own, so that any m of
+// them can be lost. The first data shard is stored by the sub-blockset as
+// the block itself; the other shards are kept here, each with the CRC-32 it
+// was written with, so that a corrupt shard is read as a missing one rather
+// than used to reconstruct the block.
+//
+// When the store places blocks on a ring, every shard of a block is given a
+// BlockRef whose primary peer holds no other shard of the block, as far as
+// ecPlacementTries allow, so that losing a peer loses at most one shard of
+// each block.
+//
+// Writing a block writes all of its shards under fresh BlockRefs, which only
+// replace the old ones once every write succeeded; like all blockset
+// changes, they take effect when the INode is synced.
+type erasureBlockset struct {
+	k, m int
+	rs   *reedSolomon
+	sub  blockset
+	bs   torus.BlockStore
+	mut  sync.RWMutex
+	// shards holds the shards of each block. A block of the sub-blockset
+	// that was never written here, such as one grown by a Truncate or
+	// zeroed by a Trim, has none.
+	shards []*ecShards
+}
+
+// ecShards describes the shards of a block.
+type ecShards struct {
+	// size is the length of the block; its shards are size/k bytes,
+	// rounded up.
+	size int
+	// refs holds the shards but the first, which the sub-blockset stores:
+	// the k-1 other data shards, then the m parity shards.
+	refs []torus.BlockRef
+	// sums holds the CRC-32 of each of the k+m shards.
+	sums []uint32
+}
+
+var _ blockset = &erasureBlockset{}
+
+const (
+	defaultECData   = 4
+	defaultECParity = 2
+	// ecPlacementTries bounds the BlockRefs tried for each shard to find
+	// one whose primary peer holds no other shard of the block.
+	ecPlacementTries = 64
+)
+
+func init() {
+	RegisterBlockset(ErasureCoding, func(opt string, bs torus.BlockStore, sub blockset) (blockset, error) {
+		k, m, err := parseECOptions(opt)
+		if err != nil {
+			clog.Errorf("%v", err)
+			return nil, err
+		}
+		return newErasureBlockset(sub, bs, k, m), nil
+	})
+}
+
+// parseECOptions parses the options of an ec layer, "K.M" for K data and M
+// parity shards per block.
+func parseECOptions(opt string) (int, int, error) {
+	if opt == "" {
+		return defaultECData, defaultECParity, nil
+	}
+	parts := strings.Split(opt, ".")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid erasure coding %q; expected DATA.PARITY, e.g. 4.2", opt)
+	}
+	k, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid erasure coding %q: %v", opt, err)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid erasure coding %q: %v", opt, err)
+	}
+	if k < 1 || m < 1 || k+m > 256 {
+		return 0, 0, fmt.Errorf("invalid erasure coding %q; needs at least one data and one parity shard, and at most 256 in all", opt)
+	}
+	return k, m, nil
+}
+
+func newErasureBlockset(sub blockset, bs torus.BlockStore, k, m int) *erasureBlockset {
+	return &erasureBlockset{
+		k:   k,
+		m:   m,
+		rs:  newReedSolomon(k, m),
+		sub: sub,
+		bs:  bs,
+	}
+}
+
+func (b *erasureBlockset) Length() int {
+	return b.sub.Length()
+}
+
+func (b *erasureBlockset) Kind() uint32 {
+	return uint32(ErasureCoding)
+}
+
+func (b *erasureBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	span, ctx := startSpan(ctx, "erasure: GetBlock", i)
+	defer span.Finish()
+	b.mut.RLock()
+	var e *ecShards
+	if i < len(b.shards) {
+		e = b.shards[i]
+	}
+	b.mut.RUnlock()
+	if e == nil {
+		return b.sub.GetBlock(ctx, i)
+	}
+	size := shardSize(e.size, b.k)
+	shards := make([][]byte, b.k+b.m)
+	have := 0
+	for c := range shards {
+		if have == b.k {
+			break
+		}
+		var (
+			data []byte
+			err  error
+		)
+		if c == 0 {
+			data, err = b.sub.GetBlock(ctx, i)
+		} else {
+			data, err = b.bs.GetBlock(ctx, e.refs[c-1])
+		}
+		if err != nil {
+			continue
+		}
+		// Stores may hand back the shard padded out to the block size.
+		if len(data) < size {
+			continue
+		}
+		data = data[:size]
+		if crc32.ChecksumIEEE(data) != e.sums[c] {
+			clog.Warningf("ec: shard %d of block %d did not pass crc", c, i)
+			promCRCFail.Inc()
+			continue
+		}
+		shards[c] = data
+		have++
+	}
+	missing := false
+	for _, s := range shards[:b.k] {
+		missing = missing || s == nil
+	}
+	if missing {
+		clog.Debugf("ec: reconstructing block %d", i)
+		if err := b.rs.reconstruct(shards); err != nil {
+			clog.Warningf("ec: couldn't reconstruct block %d: %v", i, err)
+			return nil, torus.ErrBlockUnavailable
+		}
+		promECReconstructed.Inc()
+	}
+	out := make([]byte, 0, b.k*size)
+	for _, s := range shards[:b.k] {
+		out = append(out, s...)
+	}
+	return out[:e.size], nil
+}
+
+// shardSize returns the length of each of the k shards of a block of size
+// bytes.
+func shardSize(size, k int) int {
+	if size == 0 {
+		return 1
+	}
+	return (size + k - 1) / k
+}
+
+func (b *erasureBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	span, ctx := startSpan(ctx, "erasure: PutBlock", i)
+	defer span.Finish()
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > b.sub.Length() {
+		return torus.ErrBlockNotExist
+	}
+	size := shardSize(len(data), b.k)
+	padded := make([]byte, b.k*size)
+	copy(padded, data)
+	shards := make([][]byte, b.k)
+	for c := range shards {
+		shards[c] = padded[c*size : (c+1)*size]
+	}
+	shards = append(shards, b.rs.encode(shards)...)
+	e := &ecShards{size: len(data)}
+	for _, s := range shards {
+		e.sums = append(e.sums, crc32.ChecksumIEEE(s))
+	}
+	// Every shard goes on a peer none of the others are on. The first one
+	// goes last, through the sub-blockset, as writing it replaces the block.
+	sp := newSpread(b.bs)
+	ctx = withAvoid(ctx, sp.has)
+	for c, s := range shards[1:] {
+		ref := newID(ctx, b, inode)
+		if err := b.bs.WriteBlock(ctx, ref, s); err != nil {
+			clog.Errorf("ec: couldn't write shard %d of block %d: %v", c+1, i, err)
+			return err
+		}
+		sp.add(ref)
+		e.refs = append(e.refs, ref)
+	}
+	if err := b.sub.PutBlock(ctx, inode, i, shards[0]); err != nil {
+		return err
+	}
+	for len(b.shards) <= i {
+		b.shards = append(b.shards, nil)
+	}
+	b.shards[i] = e
+	return nil
+}
+
+// ringStore is implemented by BlockStores that place blocks on a ring.
+type ringStore interface {
+	Ring() torus.Ring
+}
+
+// spread holds the primary peers of the shards of a block. Without a ring,
+// it holds none.
+type spread struct {
+	ring  torus.Ring
+	peers map[string]bool
+}
+
+// newSpread returns an empty spread of the blocks of bs.
+func newSpread(bs torus.BlockStore) *spread {
+	sp := &spread{peers: make(map[string]bool)}
+	if rs, ok := bs.(ringStore); ok {
+		sp.ring = rs.Ring()
+	}
+	return sp
+}
+
+func (sp *spread) primary(ref torus.BlockRef) string {
+	if sp.ring == nil {
+		return ""
+	}
+	p, err := sp.ring.GetPeers(ref)
+	if err != nil || len(p.Peers) == 0 {
+		return ""
+	}
+	return p.Peers[0]
+}
+
+func (sp *spread) add(ref torus.BlockRef) {
+	if p := sp.primary(ref); p != "" {
+		sp.peers[p] = true
+	}
+}
+
+// has reports whether the primary peer of ref already holds a shard of the
+// block.
+func (sp *spread) has(ref torus.BlockRef) bool {
+	return sp.peers[sp.primary(ref)]
+}
+
+// avoidKey is the context key of a function reporting the BlockRefs a block
+// about to be written had better not get.
+type avoidKey struct{}
+
+// withAvoid returns a context under which newID steers clear of the
+// BlockRefs avoid reports.
+func withAvoid(ctx context.Context, avoid func(torus.BlockRef) bool) context.Context {
+	return context.WithValue(ctx, avoidKey{}, avoid)
+}
+
+// newID returns a BlockRef from b for a new block of inode, trying up to
+// ecPlacementTries of them for one the context doesn't avoid.
+func newID(ctx context.Context, b blockset, inode torus.INodeRef) torus.BlockRef {
+	id := b.makeID(inode)
+	avoid, ok := ctx.Value(avoidKey{}).(func(torus.BlockRef) bool)
+	if !ok {
+		return id
+	}
+	for try := 1; try < ecPlacementTries && avoid(id); try++ {
+		id = b.makeID(inode)
+	}
+	return id
+}
+
+func (b *erasureBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *erasureBlockset) setStore(s torus.BlockStore) {
+	b.bs = s
+	b.sub.setStore(s)
+}
+
+func (b *erasureBlockset) getStore() torus.BlockStore {
+	return b.bs
+}
+
+func (b *erasureBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := new(bytes.Buffer)
+	for _, x := range []int32{int32(b.k), int32(b.m), int32(len(b.shards))} {
+		if err := binary.Write(buf, binary.LittleEndian, x); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range b.shards {
+		if e == nil {
+			if err := binary.Write(buf, binary.LittleEndian, int32(-1)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := binary.Write(buf, binary.LittleEndian, int32(e.size)); err != nil {
+			return nil, err
+		}
+		for _, x := range e.refs {
+			if _, err := buf.Write(x.ToBytes()); err != nil {
+				return nil, err
+			}
+		}
+		if err := binary.Write(buf, binary.LittleEndian, e.sums); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *erasureBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	r := bytes.NewReader(data)
+	var k, m, blocks int32
+	for _, x := range []*int32{&k, &m, &blocks} {
+		if err := binary.Read(r, binary.LittleEndian, x); err != nil {
+			return err
+		}
+	}
+	if k < 1 || m < 1 || k+m > 256 || blocks < 0 {
+		return errors.New("blockset: invalid erasure coding")
+	}
+	b.k, b.m = int(k), int(m)
+	b.rs = newReedSolomon(b.k, b.m)
+	b.shards = make([]*ecShards, blocks)
+	for i := range b.shards {
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size < 0 {
+			continue
+		}
+		e := &ecShards{
+			size: int(size),
+			refs: make([]torus.BlockRef, b.k+b.m-1),
+			sums: make([]uint32, b.k+b.m),
+		}
+		for j := range e.refs {
+			buf := make([]byte, torus.BlockRefByteSize)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			e.refs[j] = torus.BlockRefFromBytes(buf)
+		}
+		if err := binary.Read(r, binary.LittleEndian, e.sums); err != nil {
+			return err
+		}
+		b.shards[i] = e
+	}
+	return nil
+}
+
+func (b *erasureBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *erasureBlockset) GetLiveINodes() *roaring.Bitmap {
+	return b.sub.GetLiveINodes()
+}
+
+func (b *erasureBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.sub.Truncate(lastIndex, blocksize); err != nil {
+		return err
+	}
+	if lastIndex <= len(b.shards) {
+		b.shards = b.shards[:lastIndex]
+	}
+	return nil
+}
+
+func (b *erasureBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err := b.sub.Trim(from, to); err != nil {
+		return err
+	}
+	for i := from; i < to && i < len(b.shards); i++ {
+		b.shards[i] = nil
+	}
+	return nil
+}
+
+func (b *erasureBlockset) GetAllBlockRefs() []torus.BlockRef {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	out := b.sub.GetAllBlockRefs()
+	for _, e := range b.shards {
+		if e != nil {
+			out = append(out, e.refs...)
+		}
+	}
+	return out
+}
+
+func (b *erasureBlockset) String() string {
+	return fmt.Sprintf("ec=%d.%d\n", b.k, b.m) + b.sub.String()
+}
@@ -0,0 +1,271 @@
+package blockset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs := newReedSolomon(4, 2)
+	data := make([][]byte, 4)
+	for i := range data {
+		data[i] = make([]byte, 64)
+		rand.Read(data[i])
+	}
+	parity := rs.encode(data)
+	// Any two shards can go.
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			shards := append(append([][]byte{}, data...), parity...)
+			shards[a], shards[b] = nil, nil
+			if err := rs.reconstruct(shards); err != nil {
+				t.Fatalf("without shards %d and %d: %v", a, b, err)
+			}
+			for i := range data {
+				if !bytes.Equal(shards[i], data[i]) {
+					t.Fatalf("without shards %d and %d: data shard %d is wrong", a, b, i)
+				}
+			}
+		}
+	}
+	shards := append(append([][]byte{}, data...), parity...)
+	shards[0], shards[1], shards[5] = nil, nil, nil
+	if err := rs.reconstruct(shards); err != errTooFewShards {
+		t.Fatalf("expected errTooFewShards, got %v", err)
+	}
+}
+
+// downStore fails reads of the blocks whose primary peer on its ring is down,
+// and flips the bits of the corrupt ones.
+type downStore struct {
+	torus.BlockStore
+	ring    torus.Ring
+	down    map[string]bool
+	corrupt map[torus.BlockRef]bool
+}
+
+func (s *downStore) Ring() torus.Ring { return s.ring }
+
+func (s *downStore) GetBlock(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	p, err := s.ring.GetPeers(ref)
+	if err != nil {
+		return nil, err
+	}
+	if s.down[p.Peers[0]] {
+		return nil, torus.ErrBlockUnavailable
+	}
+	data, err := s.BlockStore.GetBlock(ctx, ref)
+	if err != nil || !s.corrupt[ref] {
+		return data, err
+	}
+	out := make([]byte, len(data))
+	for i, x := range data {
+		out[i] = ^x
+	}
+	return out, nil
+}
+
+func newDownStore(t *testing.T, peers int) *downStore {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	var pl torus.PeerInfoList
+	for i := 0; i < peers; i++ {
+		pl = append(pl, &models.PeerInfo{UUID: fmt.Sprintf("peer-%d", i), TotalBlocks: 300})
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             pl,
+		ReplicationFactor: 1,
+		Version:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &downStore{BlockStore: s, ring: r, down: make(map[string]bool), corrupt: make(map[torus.BlockRef]bool)}
+}
+
+// shardRefs returns the refs of the k+m shards of block i of b.
+func shardRefs(b *erasureBlockset, i int) []torus.BlockRef {
+	return append([]torus.BlockRef{b.sub.GetAllBlockRefs()[i]}, b.shards[i].refs...)
+}
+
+func TestErasureDegradedRead(t *testing.T) {
+	s := newDownStore(t, 8)
+	b := newErasureBlockset(newBaseBlockset(s), s, 4, 2)
+	inode := torus.NewINodeRef(1, 1)
+	blocks := make([][]byte, 3)
+	for i := range blocks {
+		blocks[i] = make([]byte, 1024)
+		rand.Read(blocks[i])
+		if err := b.PutBlock(context.TODO(), inode, i, blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwriting a block replaces all of its shards.
+	blocks[1] = bytes.Repeat([]byte{42}, 1024)
+	if err := b.PutBlock(context.TODO(), inode, 1, blocks[1]); err != nil {
+		t.Fatal(err)
+	}
+	// A short block comes back as short as it went in.
+	blocks = append(blocks, []byte("short"))
+	if err := b.PutBlock(context.TODO(), inode, 3, blocks[3]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b.GetAllBlockRefs()); n != 4*(4+2) {
+		t.Fatalf("expected 4 blocks of 6 shards, got %d refs", n)
+	}
+
+	// The shards of a block never share a peer, so any two peers can be
+	// down.
+	peers := s.ring.Members()
+	for x := range peers {
+		for y := x + 1; y < len(peers); y++ {
+			s.down = map[string]bool{peers[x]: true, peers[y]: true}
+			for i, want := range blocks {
+				got, err := b.GetBlock(context.TODO(), i)
+				if err != nil {
+					t.Fatalf("peers %s and %s down: block %d: %v", peers[x], peers[y], i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("peers %s and %s down: block %d has the wrong data", peers[x], peers[y], i)
+				}
+			}
+		}
+	}
+
+	// More shards of a block lost than it has parity for.
+	s.down = make(map[string]bool)
+	for _, ref := range shardRefs(b, 0)[:3] {
+		p, _ := s.ring.GetPeers(ref)
+		s.down[p.Peers[0]] = true
+	}
+	if _, err := b.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected ErrBlockUnavailable with three shards of the block down, got %v", err)
+	}
+}
+
+func TestErasureCorruptShards(t *testing.T) {
+	s := newDownStore(t, 8)
+	b := newErasureBlockset(newBaseBlockset(s), s, 4, 2)
+	inode := torus.NewINodeRef(1, 1)
+	want := make([]byte, 1024)
+	rand.Read(want)
+	if err := b.PutBlock(context.TODO(), inode, 0, want); err != nil {
+		t.Fatal(err)
+	}
+	refs := shardRefs(b, 0)
+	// A corrupt data shard has to be rebuilt, and a corrupt parity shard
+	// must not be used to rebuild it.
+	s.corrupt[refs[1]] = true
+	s.corrupt[refs[4]] = true
+	got, err := b.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("block rebuilt with a corrupt shard")
+	}
+	s.corrupt[refs[0]] = true
+	if _, err := b.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected ErrBlockUnavailable with three corrupt shards, got %v", err)
+	}
+}
+
+func TestErasureShardPlacement(t *testing.T) {
+	s := newDownStore(t, 8)
+	b := newErasureBlockset(newBaseBlockset(s), s, 4, 2)
+	inode := torus.NewINodeRef(1, 1)
+	for i := 0; i < 4; i++ {
+		if err := b.PutBlock(context.TODO(), inode, i, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary := func(ref torus.BlockRef) string {
+		p, _ := s.ring.GetPeers(ref)
+		return p.Peers[0]
+	}
+	// Every shard of a block, data and parity, has a peer of its own.
+	for i := 0; i < 4; i++ {
+		used := make(map[string]string)
+		for _, ref := range shardRefs(b, i) {
+			p := primary(ref)
+			if other, ok := used[p]; ok {
+				t.Fatalf("expected the shards of block %d on distinct peers, got %s and %s on %s", i, other, ref, p)
+			}
+			used[p] = ref.String()
+		}
+	}
+}
+
+func TestErasureMarshal(t *testing.T) {
+	s := newDownStore(t, 4)
+	b := newErasureBlockset(newBaseBlockset(s), s, 3, 1)
+	inode := torus.NewINodeRef(1, 1)
+	for i := 0; i < 5; i++ {
+		if err := b.PutBlock(context.TODO(), inode, i, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A trimmed block has no shards.
+	if err := b.Trim(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	data, err := b.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb := newErasureBlockset(newBaseBlockset(s), s, defaultECData, defaultECParity)
+	if err := nb.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if nb.k != 3 || nb.m != 1 || len(nb.shards) != 5 || nb.shards[1] != nil {
+		t.Fatalf("unexpected blockset after unmarshaling: k=%d m=%d shards=%v", nb.k, nb.m, nb.shards)
+	}
+	for _, i := range []int{0, 4} {
+		if !reflect.DeepEqual(nb.shards[i], b.shards[i]) {
+			t.Fatalf("shards of block %d didn't survive marshaling: %+v, want %+v", i, nb.shards[i], b.shards[i])
+		}
+	}
+	// A shard ref cut short is an error, not a ref padded with zeros.
+	if err := nb.Unmarshal(data[:len(data)-8]); err == nil {
+		t.Fatal("expected truncated data to fail to unmarshal")
+	}
+}
+
+func TestErasureSpec(t *testing.T) {
+	spec, err := ParseBlockLayerSpec("crc,ec=4.2,base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec[1].Kind != ErasureCoding || spec[1].Options != "4.2" {
+		t.Fatalf("unexpected ec layer %+v", spec[1])
+	}
+	if s := FormatBlockLayerSpec(spec); s != "crc,ec=4.2,base" {
+		t.Fatalf("expected the spec to format back the same, got %s", s)
+	}
+	gmd, err := json.Marshal(torus.GlobalMetadata{BlockSize: 1024, DefaultBlockSpec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out torus.GlobalMetadata
+	if err := json.Unmarshal(gmd, &out); err != nil {
+		t.Fatal(err)
+	}
+	if FormatBlockLayerSpec(out.DefaultBlockSpec) != "crc,ec=4.2,base" {
+		t.Fatalf("spec didn't survive the global metadata: %v", out.DefaultBlockSpec)
+	}
+	for _, bad := range []string{"ec=4", "ec=0.2", "ec=4.x", "ec=200.100"} {
+		if _, err := ParseBlockLayerSpec(bad + ",base"); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
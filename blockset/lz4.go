@@ -0,0 +1,144 @@
+package blockset
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// An implementation of the LZ4 block format: a series of sequences, each a
+// token holding the number of literals and the match length less 4, more
+// length bytes for either if they don't fit its 4 bits, the literals, and a
+// 2-byte offset back to the match. The last sequence only has literals.
+
+const (
+	lz4MinMatch = 4
+	// The last 5 bytes are always literals, and the last match starts at
+	// least 12 bytes before the end.
+	lz4LastLiterals = 5
+	lz4MatchLimit   = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 12
+)
+
+var errLZ4Corrupt = errors.New("blockset: corrupt lz4 block")
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4Compress compresses src into an LZ4 block.
+func lz4Compress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2)
+	var table [1 << lz4HashLog]int
+	anchor := 0
+	for i := 0; i < len(src)-lz4MatchLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := table[h] - 1
+		table[h] = i + 1
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends a sequence of literals followed by a match of n
+// bytes at offset, or by nothing if n is zero.
+func lz4AppendSequence(dst, literals []byte, offset, n int) []byte {
+	token := byte(min15(len(literals)) << 4)
+	if n != 0 {
+		token |= byte(min15(n - lz4MinMatch))
+	}
+	dst = append(dst, token)
+	dst = lz4AppendLength(dst, len(literals))
+	dst = append(dst, literals...)
+	if n == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	return lz4AppendLength(dst, n-lz4MinMatch)
+}
+
+// lz4AppendLength appends what's left of l after the 15 its token holds.
+func lz4AppendLength(dst []byte, l int) []byte {
+	if l < 15 {
+		return dst
+	}
+	for l -= 15; l >= 255; l -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(l))
+}
+
+func min15(n int) int {
+	if n > 15 {
+		return 15
+	}
+	return n
+}
+
+// lz4Decompress decompresses the LZ4 block src, which must come to at most
+// max bytes.
+func lz4Decompress(src []byte, max int) ([]byte, error) {
+	dst := make([]byte, 0, max)
+	i := 0
+	readLength := func(l int) (int, error) {
+		if l != 15 {
+			return l, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, errLZ4Corrupt
+			}
+			b := src[i]
+			i++
+			l += int(b)
+			if b != 255 {
+				return l, nil
+			}
+		}
+	}
+	for i < len(src) {
+		token := src[i]
+		i++
+		lit, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if i+lit > len(src) || len(dst)+lit > max {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+lit]...)
+		i += lit
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		n, err := readLength(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+		n += lz4MinMatch
+		if offset == 0 || offset > len(dst) || len(dst)+n > max {
+			return nil, errLZ4Corrupt
+		}
+		// Matches may overlap what they copy, so go byte by byte.
+		for j := 0; j < n; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	return dst, nil
+}
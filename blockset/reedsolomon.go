@@ -0,0 +1,168 @@
+package blockset
+
+import "errors"
+
+// Arithmetic in GF(2^8), over the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd adds c times in to out.
+func mulAdd(out, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for i, x := range in {
+		if x != 0 {
+			out[i] ^= gfExp[lc+int(gfLog[x])]
+		}
+	}
+}
+
+var errTooFewShards = errors.New("blockset: too few shards to reconstruct")
+
+// reedSolomon is a systematic Reed-Solomon code of k data and m parity
+// shards. Its encoding matrix is the identity stacked on a Cauchy matrix,
+// so that any k of its rows are invertible, and any k shards are enough to
+// recover the data.
+type reedSolomon struct {
+	k, m   int
+	matrix [][]byte
+}
+
+func newReedSolomon(k, m int) *reedSolomon {
+	rs := &reedSolomon{k: k, m: m, matrix: make([][]byte, k+m)}
+	for r := range rs.matrix {
+		rs.matrix[r] = make([]byte, k)
+		if r < k {
+			rs.matrix[r][r] = 1
+			continue
+		}
+		for c := 0; c < k; c++ {
+			rs.matrix[r][c] = gfInv(byte(r) ^ byte(c))
+		}
+	}
+	return rs
+}
+
+// encode returns the m parity shards of the k data shards, which must all be
+// the same length.
+func (rs *reedSolomon) encode(data [][]byte) [][]byte {
+	parity := make([][]byte, rs.m)
+	for j := range parity {
+		parity[j] = make([]byte, len(data[0]))
+		for c, d := range data {
+			mulAdd(parity[j], d, rs.matrix[rs.k+j][c])
+		}
+	}
+	return parity
+}
+
+// reconstruct fills in the missing (nil) data shards of shards, which holds
+// the k data shards followed by the m parity ones. Parity shards are left
+// alone.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	var rows []int
+	for i, s := range shards {
+		if s != nil {
+			rows = append(rows, i)
+		}
+		if len(rows) == rs.k {
+			break
+		}
+	}
+	if len(rows) < rs.k {
+		return errTooFewShards
+	}
+	sub := make([][]byte, rs.k)
+	for i, r := range rows {
+		sub[i] = append([]byte(nil), rs.matrix[r]...)
+	}
+	inv, err := gfInvert(sub)
+	if err != nil {
+		return err
+	}
+	size := len(shards[rows[0]])
+	for c := 0; c < rs.k; c++ {
+		if shards[c] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for i, r := range rows {
+			mulAdd(out, shards[r], inv[c][i])
+		}
+		shards[c] = out
+	}
+	return nil
+}
+
+// gfInvert inverts the square matrix m in place by Gauss-Jordan elimination,
+// and returns the inverse.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("blockset: singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if c := m[col][col]; c != 1 {
+			ic := gfInv(c)
+			for i := 0; i < n; i++ {
+				m[col][i] = gfMul(m[col][i], ic)
+				inv[col][i] = gfMul(inv[col][i], ic)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			c := m[r][col]
+			for i := 0; i < n; i++ {
+				m[r][i] ^= gfMul(c, m[col][i])
+				inv[r][i] ^= gfMul(c, inv[col][i])
+			}
+		}
+	}
+	return inv, nil
+}
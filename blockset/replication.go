@@ -29,7 +29,7 @@ func init() {
 			return newReplicationBlockset(sub, bs, defaultReplication), nil
 		}
 		r, err := strconv.Atoi(opt)
-		if err != nil {
+		if err != nil || r < 1 {
 			clog.Errorf("unknown replication amount %s: %v", opt, err)
 			return nil, errors.New("unknown replication amount: " + opt)
 		}
@@ -55,6 +55,8 @@ func (b *replicationBlockset) Kind() uint32 {
 }
 
 func (b *replicationBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	span, ctx := startSpan(ctx, "replication: GetBlock", i)
+	defer span.Finish()
 	if b.rep == 0 {
 		return nil, torus.ErrBlockUnavailable
 	}
@@ -73,6 +75,8 @@ func (b *replicationBlockset) GetBlock(ctx context.Context, i int) ([]byte, erro
 }
 
 func (b *replicationBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	span, ctx := startSpan(ctx, "replication: PutBlock", i)
+	defer span.Finish()
 	if b.rep == 0 {
 		return torus.ErrBlockUnavailable
 	}
@@ -136,8 +140,11 @@ func (b *replicationBlockset) Unmarshal(data []byte) error {
 	if err != nil {
 		return err
 	}
+	if rep < 1 {
+		return errors.New("blockset: invalid replication amount")
+	}
 	b.rep = int(rep)
-	b.repBlocks = make([][]torus.BlockRef, rep)
+	b.repBlocks = make([][]torus.BlockRef, rep-1)
 	for rep := 0; rep < (b.rep - 1); rep++ {
 		var l int32
 		err := binary.Read(r, binary.LittleEndian, &l)
@@ -169,17 +176,13 @@ func (b *replicationBlockset) Truncate(lastIndex int, blocksize uint64) error {
 	if err != nil {
 		return err
 	}
-	if lastIndex <= len(b.repBlocks[0]) {
-		for i := range b.repBlocks {
-			b.repBlocks[i] = b.repBlocks[i][:lastIndex]
+	for i, list := range b.repBlocks {
+		if lastIndex <= len(list) {
+			b.repBlocks[i] = list[:lastIndex]
+			continue
 		}
-		return nil
-	}
-	for i := range b.repBlocks {
-		toadd := lastIndex - len(b.repBlocks[0])
-		for toadd != 0 {
+		for len(b.repBlocks[i]) < lastIndex {
 			b.repBlocks[i] = append(b.repBlocks[i], torus.ZeroBlock())
-			toadd--
 		}
 	}
 	return nil
@@ -190,17 +193,12 @@ func (b *replicationBlockset) Trim(from, to int) error {
 	if err != nil {
 		return err
 	}
-	if from >= len(b.repBlocks[0]) {
-		return nil
-	}
-	if to > len(b.repBlocks[0]) {
-		to = len(b.repBlocks[0])
-	}
-	for i := from; i < to; i++ {
-		for _, blist := range b.repBlocks {
-			if len(blist) == 0 {
-				continue
-			}
+	for _, blist := range b.repBlocks {
+		end := to
+		if end > len(blist) {
+			end = len(blist)
+		}
+		for i := from; i < end; i++ {
 			blist[i] = torus.ZeroBlock()
 		}
 	}
@@ -208,13 +206,11 @@ func (b *replicationBlockset) Trim(from, to int) error {
 }
 
 func (b *replicationBlockset) GetAllBlockRefs() []torus.BlockRef {
-	sub := b.sub.GetAllBlockRefs()
-	out := make([]torus.BlockRef, len(b.repBlocks[0])*len(b.repBlocks))
-	nblocks := len(b.repBlocks[0])
-	for i, list := range b.repBlocks {
-		copy(out[i*nblocks:], list)
+	out := b.sub.GetAllBlockRefs()
+	for _, list := range b.repBlocks {
+		out = append(out, list...)
 	}
-	return append(sub, out...)
+	return out
 }
 
 func (b *replicationBlockset) String() string {
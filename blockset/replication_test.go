@@ -0,0 +1,68 @@
+package blockset
+
+import (
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestReplicationMarshal(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	marshalTest(t, s, MustParseBlockLayerSpec("rep=3,base"))
+}
+
+func TestReplicationBlockRefs(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	for _, rep := range []int{1, 2, 3} {
+		spec := torus.BlockLayerSpec{{Kind: Replication, Options: strconv.Itoa(rep)}, {Kind: Base}}
+		b, err := CreateBlocksetFromSpec(spec, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inode := torus.NewINodeRef(1, 1)
+		for i := 0; i < 2; i++ {
+			if err := b.PutBlock(context.TODO(), inode, i, []byte("Some data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Growing the blockset pads every copy, so that blocks can be put
+		// past the old end.
+		if err := b.Truncate(4, 1024); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutBlock(context.TODO(), inode, 3, []byte("More data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Trim(0, 1); err != nil {
+			t.Fatal(err)
+		}
+		marshal, err := torus.MarshalBlocksetToProto(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newb, err := UnmarshalFromProto(marshal, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live := 0
+		for _, ref := range newb.GetAllBlockRefs() {
+			if !ref.IsZero() {
+				live++
+			}
+		}
+		if n := len(newb.GetAllBlockRefs()); n != 4*rep || live != 2*rep {
+			t.Fatalf("rep=%d: expected %d refs, %d of them live, got %d and %d", rep, 4*rep, 2*rep, n, live)
+		}
+	}
+}
+
+func TestReplicationBadAmount(t *testing.T) {
+	for _, spec := range []string{"rep=0,base", "rep=x,base"} {
+		if _, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec(spec), nil); err == nil {
+			t.Errorf("expected %s to be refused", spec)
+		}
+	}
+}
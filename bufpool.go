@@ -0,0 +1,81 @@
+package torus
+
+import "sync"
+
+// BlockBufPool recycles buffers of a single block size, so that hot I/O paths
+// don't allocate a fresh block for every request. A buffer must only be put
+// back once nothing else, including work still running in the background,
+// refers to it.
+//
+// Block payloads follow a few ownership rules, so that their buffers can be
+// pooled:
+//
+//   - A block returned by a BlockStore's GetBlock belongs to the caller. If
+//     the store is a BlockReleaser, the caller may give it back with
+//     ReleaseBlock once nothing refers to it. Otherwise it is left to the
+//     garbage collector.
+//   - A block handed to a BlockStore's WriteBlock, or sent to a peer, still
+//     belongs to the caller once the call returns. Anything that keeps it
+//     for longer, such as a write finishing in the background or the read
+//     cache, keeps a copy of its own.
+//   - Blocks held by the read cache are shared by every reader, and never go
+//     back to a pool.
+type BlockBufPool struct {
+	size uint64
+	pool sync.Pool
+}
+
+// NewBlockBufPool returns a pool of buffers of size bytes, normally the
+// BlockSize of the GlobalMetadata.
+func NewBlockBufPool(size uint64) *BlockBufPool {
+	p := &BlockBufPool{size: size}
+	p.pool.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+var (
+	blockBufsMut sync.Mutex
+	blockBufs    = make(map[uint64]*BlockBufPool)
+)
+
+// BlockBufs returns the process-wide pool of buffers of size bytes, shared by
+// the block stores and the distributor so that a block read by one can be
+// given back by another.
+func BlockBufs(size uint64) *BlockBufPool {
+	blockBufsMut.Lock()
+	defer blockBufsMut.Unlock()
+	p, ok := blockBufs[size]
+	if !ok {
+		p = NewBlockBufPool(size)
+		blockBufs[size] = p
+	}
+	return p
+}
+
+// Get returns a buffer of the pool's size. Its contents are undefined.
+func (p *BlockBufPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Copy returns a copy of data, in a buffer of the pool if data is of the
+// pool's size.
+func (p *BlockBufPool) Copy(data []byte) []byte {
+	if uint64(len(data)) != p.size {
+		return append([]byte(nil), data...)
+	}
+	b := p.Get()
+	copy(b, data)
+	return b
+}
+
+// Put returns b to the pool. Buffers of any other size are dropped.
+func (p *BlockBufPool) Put(b []byte) {
+	if uint64(cap(b)) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
@@ -0,0 +1,23 @@
+package torus
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlockBufPoolCopy(t *testing.T) {
+	p := BlockBufs(16)
+	if BlockBufs(16) != p {
+		t.Fatal("expected the pool of a size to be shared")
+	}
+	data := bytes.Repeat([]byte{1}, 16)
+	b := p.Copy(data)
+	if !bytes.Equal(b, data) || &b[0] == &data[0] {
+		t.Fatal("expected a copy of the block")
+	}
+	p.Put(b)
+	short := p.Copy(data[:4])
+	if !bytes.Equal(short, data[:4]) || cap(short) == 16 {
+		t.Fatalf("expected a copy of its own of a short block, got cap %d", cap(short))
+	}
+}
@@ -0,0 +1,71 @@
+// Package client manages a torus cluster from Go programs: its volumes and
+// their snapshots, its ring and its peers. It works through the metadata
+// service of the cluster, as torusctl does, without running a node.
+//
+// Every method takes a context, which bounds the calls it makes to the
+// metadata service:
+//
+//	c, err := client.New(torus.Config{MetadataAddress: "127.0.0.1:2379"})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	ctx := context.Background()
+//	if err := c.CreateBlockVolume(ctx, "data", 10<<30, nil, nil); err != nil {
+//		return err
+//	}
+//	return c.DeleteVolume(ctx, "data", block.DeleteOptions{})
+package client
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+
+	// Register the metadata services New can connect to.
+	_ "github.com/alternative-storage/torus/metadata/consul"
+	_ "github.com/alternative-storage/torus/metadata/etcd"
+)
+
+// Client is a connection to the metadata service of a cluster. It is safe
+// for concurrent use.
+type Client struct {
+	mds torus.MetadataService
+}
+
+// New connects to the metadata service cfg names, as torusd and torusctl
+// would given the same configuration.
+func New(cfg torus.Config) (*Client, error) {
+	mds, err := torus.CreateMetadataService(torus.MetadataServiceFor(cfg), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{mds: mds}, nil
+}
+
+// NewFromMetadataService returns a Client using mds, which it closes on
+// Close.
+func NewFromMetadataService(mds torus.MetadataService) *Client {
+	return &Client{mds: mds}
+}
+
+// MetadataService returns the metadata service the Client uses, for what
+// the Client doesn't cover.
+func (c *Client) MetadataService() torus.MetadataService {
+	return c.mds
+}
+
+// GlobalMetadata returns the cluster-wide settings, such as its block size.
+func (c *Client) GlobalMetadata() torus.GlobalMetadata {
+	return c.mds.GlobalMetadata()
+}
+
+// Close closes the connection to the metadata service.
+func (c *Client) Close() error {
+	return c.mds.Close()
+}
+
+// with returns the metadata service making its calls under ctx.
+func (c *Client) with(ctx context.Context) torus.MetadataService {
+	return c.mds.WithContext(ctx)
+}
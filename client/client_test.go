@@ -0,0 +1,134 @@
+package client
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func newClient(t *testing.T) *Client {
+	mds, err := temp.NewTemp(torus.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFromMetadataService(mds)
+}
+
+func TestVolumes(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.CreateBlockVolume(ctx, "vol", 1024*1024, nil, map[string]string{"app": "db"}); err != nil {
+		t.Fatal(err)
+	}
+	vols, err := c.ListVolumes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].Name != "vol" || vols[0].MaxBytes != 1024*1024 || vols[0].Labels["app"] != "db" {
+		t.Fatalf("expected the labeled volume, got %v", vols)
+	}
+	if err := c.CreateBlockVolume(ctx, "bad", 1024, nil, map[string]string{"-": "x"}); err == nil {
+		t.Fatal("expected an invalid label to be refused")
+	}
+
+	if err := c.CreateSnapshot(ctx, "vol", "snap"); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := c.ListSnapshots(ctx, "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].Name != "snap" {
+		t.Fatalf("expected the snapshot, got %v", snaps)
+	}
+	if err := c.DeleteSnapshot(ctx, "vol", "snap"); err != nil {
+		t.Fatal(err)
+	}
+	if snaps, err = c.ListSnapshots(ctx, "vol"); err != nil || len(snaps) != 0 {
+		t.Fatalf("expected no snapshots, got %v (%v)", snaps, err)
+	}
+
+	if err := c.DeleteVolume(ctx, "vol", block.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetVolume(ctx, "vol"); err == nil {
+		t.Fatal("expected the volume to be gone")
+	}
+	if err := c.RequestReclaim(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRingAndPeers(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	peers := torus.PeerInfoList{
+		&models.PeerInfo{UUID: "a", Address: "http://a", TotalBlocks: 100},
+		&models.PeerInfo{UUID: "b", Address: "http://b", TotalBlocks: 100},
+	}
+	for _, p := range peers {
+		if err := c.MetadataService().RegisterPeer(1, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := c.ListPeers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 peers, got %v", list)
+	}
+
+	cur, err := c.GetRing(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           uint32(cur.Version() + 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetRing(ctx, r, "add a and b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetRing(ctx, r, "again"); err == nil {
+		t.Fatal("expected a ring of the same version to be refused")
+	}
+
+	if _, err := c.DrainPeer(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DrainPeer(ctx, "a"); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists draining again, got %v", err)
+	}
+	if _, err := c.DrainPeer(ctx, "c"); err != torus.ErrNoPeer {
+		t.Fatalf("expected ErrNoPeer for a peer out of the ring, got %v", err)
+	}
+	if _, err := c.UndrainPeer(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EvictPeer(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = c.GetRing(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Members().Has("b") {
+		t.Fatalf("expected b out of the ring, got %v", r.Members())
+	}
+}
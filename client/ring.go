@@ -0,0 +1,49 @@
+package client
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// GetRing returns the current ring of the cluster.
+func (c *Client) GetRing(ctx context.Context) (torus.Ring, error) {
+	return c.with(ctx).GetRing()
+}
+
+// SetRing makes r the ring of the cluster, keeping message with it in the
+// ring history. r must be the version after the current ring; otherwise
+// SetRing fails with torus.ErrNonSequentialRing, and r should be made again
+// from the ring that replaced it.
+func (c *Client) SetRing(ctx context.Context, r torus.Ring, message string) error {
+	return torus.SetRingWithMessage(c.with(ctx), r, message)
+}
+
+// ListPeers returns the peers registered with the metadata service, in the
+// ring or not.
+func (c *Client) ListPeers(ctx context.Context) (torus.PeerInfoList, error) {
+	return c.with(ctx).GetPeers()
+}
+
+// DrainPeer marks the peer uuid as draining, so that rebalancing moves
+// every block off it, and returns the ring it replaced. It fails with
+// torus.ErrNoPeer if the peer isn't in the ring, torus.ErrNotSupported if the
+// ring can't drain peers, and torus.ErrExists if the peer is draining
+// already.
+func (c *Client) DrainPeer(ctx context.Context, uuid string) (torus.Ring, error) {
+	return torus.DrainPeer(c.with(ctx), uuid, true)
+}
+
+// UndrainPeer stops draining the peer uuid, which takes blocks again, and
+// returns the ring it replaced. It fails as DrainPeer does, with
+// torus.ErrExists if the peer isn't draining.
+func (c *Client) UndrainPeer(ctx context.Context, uuid string) (torus.Ring, error) {
+	return torus.DrainPeer(c.with(ctx), uuid, false)
+}
+
+// EvictPeer takes the peer uuid out of the ring at once, and returns the
+// ring it replaced. Blocks it held are under-replicated until rebalancing
+// copies them elsewhere; drain it first to keep them from being.
+func (c *Client) EvictPeer(ctx context.Context, uuid string) (torus.Ring, error) {
+	return torus.EvictPeer(c.with(ctx), uuid)
+}
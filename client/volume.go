@@ -0,0 +1,115 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/models"
+)
+
+// ListVolumes returns the volumes of the cluster, not counting those
+// deleted.
+func (c *Client) ListVolumes(ctx context.Context) ([]*models.Volume, error) {
+	vols, _, err := c.with(ctx).GetVolumes()
+	return vols, err
+}
+
+// GetVolume returns the volume name.
+func (c *Client) GetVolume(ctx context.Context, name string) (*models.Volume, error) {
+	return c.with(ctx).GetVolume(name)
+}
+
+// CreateBlockVolume creates a block volume of size bytes, with its blocks
+// laid out by spec, or the cluster's default block spec if spec is nil, and
+// labeled with labels, if any.
+func (c *Client) CreateBlockVolume(ctx context.Context, name string, size uint64, spec torus.BlockLayerSpec, labels map[string]string) error {
+	return c.createBlockVolume(ctx, name, size, spec, labels, nil)
+}
+
+// CreateEncryptedBlockVolume is CreateBlockVolume, with the blocks of the
+// volume encrypted under a new data key wrapped by master. Opening it takes
+// the same master key.
+func (c *Client) CreateEncryptedBlockVolume(ctx context.Context, name string, size uint64, spec torus.BlockLayerSpec, labels map[string]string, master []byte) error {
+	if len(master) == 0 {
+		return fmt.Errorf("can't create encrypted volume %s without a master key", name)
+	}
+	return c.createBlockVolume(ctx, name, size, spec, labels, master)
+}
+
+func (c *Client) createBlockVolume(ctx context.Context, name string, size uint64, spec torus.BlockLayerSpec, labels map[string]string, master []byte) error {
+	if err := torus.ValidateLabels(labels); err != nil {
+		return err
+	}
+	mds := c.with(ctx)
+	var err error
+	switch {
+	case master != nil:
+		err = block.CreateEncryptedBlockVolumeWithSpec(mds, name, size, spec, master)
+	case spec != nil:
+		err = block.CreateBlockVolumeWithSpec(mds, name, size, spec)
+	default:
+		err = block.CreateBlockVolume(mds, name, size)
+	}
+	if err != nil {
+		return err
+	}
+	if len(labels) != 0 {
+		if err := block.SetBlockVolumeLabels(mds, name, labels, nil); err != nil {
+			return fmt.Errorf("volume %s created, but couldn't label it: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// DeleteVolume deletes the volume name as opts say. It fails with
+// torus.ErrLocked if the volume is attached, unless opts.Force is set. The
+// blocks of the volume are reclaimed by the next garbage collection pass of
+// each node; RequestReclaim has them start one at once.
+func (c *Client) DeleteVolume(ctx context.Context, name string, opts block.DeleteOptions) error {
+	mds := c.with(ctx)
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		return err
+	}
+	if vol.Type != block.VolumeType {
+		return fmt.Errorf("unknown volume type %s", vol.Type)
+	}
+	return block.DeleteBlockVolumeWithOptions(mds, name, opts)
+}
+
+// RequestReclaim has every node start a garbage collection pass, reclaiming
+// the blocks of deleted volumes, rather than wait for its next one. It
+// returns torus.ErrNotSupported if the metadata service doesn't coordinate
+// garbage collection.
+func (c *Client) RequestReclaim(ctx context.Context) error {
+	gc, ok := c.with(ctx).(torus.GCController)
+	if !ok {
+		return torus.ErrNotSupported
+	}
+	gs, err := gc.GetGCSettings()
+	if err != nil {
+		return err
+	}
+	gs.RunRequested = time.Now().UTC()
+	return gc.SetGCSettings(gs)
+}
+
+// ListSnapshots returns the snapshots of the block volume volume.
+func (c *Client) ListSnapshots(ctx context.Context, volume string) ([]block.Snapshot, error) {
+	return block.GetBlockVolumeSnapshots(c.with(ctx), volume)
+}
+
+// CreateSnapshot snapshots the current state of the block volume volume as
+// name.
+func (c *Client) CreateSnapshot(ctx context.Context, volume, name string) error {
+	return block.SaveBlockVolumeSnapshot(c.with(ctx), volume, name)
+}
+
+// DeleteSnapshot deletes the snapshot name of the block volume volume.
+func (c *Client) DeleteSnapshot(ctx context.Context, volume, name string) error {
+	return block.DeleteBlockVolumeSnapshot(c.with(ctx), volume, name)
+}
@@ -0,0 +1,34 @@
+package torus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// clusterIDFile marks the metadata directory of a data directory with the
+// cluster it holds blocks for.
+const clusterIDFile = "cluster-id"
+
+// checkClusterID checks that the data directory dir belongs to the cluster
+// of gmd, marking it as such the first time. Clusters initialized before
+// they had an ID are not checked.
+func checkClusterID(dir string, gmd GlobalMetadata) error {
+	if dir == "" || gmd.ClusterID == "" {
+		return nil
+	}
+	path := filepath.Join(dir, "metadata", clusterIDFile)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(path, []byte(gmd.ClusterID+"\n"), 0600)
+	}
+	if err != nil {
+		return err
+	}
+	if have := strings.TrimSpace(string(b)); have != gmd.ClusterID {
+		return fmt.Errorf("%v: data directory %s holds blocks of cluster %s, and the metadata service is of cluster %s; start torusd with --force-reclaim to wipe it", ErrWrongCluster, dir, have, gmd.ClusterID)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package torus
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckClusterID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := MkdirsFor(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkClusterID(dir, GlobalMetadata{}); err != nil {
+		t.Fatalf("expected a cluster without an ID to be let through, got %v", err)
+	}
+	a := GlobalMetadata{ClusterID: "cluster-a"}
+	if err := checkClusterID(dir, a); err != nil {
+		t.Fatalf("expected a new data directory to be marked, got %v", err)
+	}
+	if err := checkClusterID(dir, a); err != nil {
+		t.Fatalf("expected the data directory to belong to its cluster, got %v", err)
+	}
+	if err := checkClusterID(dir, GlobalMetadata{ClusterID: "cluster-b"}); err == nil {
+		t.Fatal("expected the data directory of another cluster to be refused")
+	}
+}
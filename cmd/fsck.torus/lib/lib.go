@@ -47,6 +47,7 @@ func Fsck(verbose bool, deviceName string, torusBlockSize uint64) error {
 		return fmt.Errorf("device has a torus block size of %d, whereas we're checking for %d", metadata.TorusBlockSize, torusBlockSize)
 	}
 	debug(verbose, "torus was formatted on %s", metadata.FormattedTimestamp.String())
+	debug(verbose, "superblock format version %d, cluster %q", metadata.FormatVersion, metadata.ClusterID)
 	stderr("there should be %d blocks in use", metadata.UsedBlocks)
 
 	jumpSize := blockDevice.BlockSize + torusBlockSize
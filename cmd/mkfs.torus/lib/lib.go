@@ -1,7 +1,9 @@
 package lib
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"syscall"
@@ -20,12 +22,23 @@ func debug(verbose bool, msg string, args ...interface{}) {
 	}
 }
 
-func Mkfs(torusBlockSize uint64, verbose bool, deviceName string) error {
+// Mkfs formats deviceName for torus with a cluster block size of
+// torusBlockSize. If clusterID is set, the device is marked as holding
+// blocks for that cluster; otherwise it takes on the cluster of the first
+// node to use it.
+func Mkfs(torusBlockSize uint64, clusterID string, verbose bool, deviceName string) error {
 	debug(verbose, "formatting device %s for torus with a cluster block size of %d bytes", deviceName, torusBlockSize)
+	if torusBlockSize == 0 {
+		return fmt.Errorf("block size must be greater than zero")
+	}
+	if len(clusterID) > blockDevice.ClusterIDLen {
+		return fmt.Errorf("cluster ID %s is longer than %d bytes", clusterID, blockDevice.ClusterIDLen)
+	}
 	deviceFile, err := os.OpenFile(deviceName, os.O_RDWR, 0777|os.ModeDevice)
 	if err != nil {
 		return err
 	}
+	defer deviceFile.Close()
 
 	deviceSize, err := blockDevice.GetDeviceSize(deviceFile)
 	if err != nil {
@@ -33,6 +46,9 @@ func Mkfs(torusBlockSize uint64, verbose bool, deviceName string) error {
 	}
 
 	debug(verbose, "this device has a size of %d", deviceSize)
+	if deviceSize < blockDevice.MetadataSize+blockDevice.BlockSize+torusBlockSize {
+		return fmt.Errorf("device %s of %d bytes is too small to hold a block of %d bytes", deviceName, deviceSize, torusBlockSize)
+	}
 
 	zeros := make([]byte, blockDevice.BlockSize)
 
@@ -79,6 +95,9 @@ func Mkfs(torusBlockSize uint64, verbose bool, deviceName string) error {
 		TorusBlockSize:     torusBlockSize,
 		FormattedTimestamp: time.Now(),
 		UsedBlocks:         0,
+		ClusterID:          clusterID,
+		FormatVersion:      blockDevice.FormatVersion,
+		Capacity:           deviceSize,
 	}
 
 	metadataBytes := metadata.Marshal()
@@ -98,9 +117,66 @@ func Mkfs(torusBlockSize uint64, verbose bool, deviceName string) error {
 
 	debug(verbose, "metadata written, syncing changes to disk...")
 
-	deviceFile.Close()
 	syscall.Sync()
 	debug(verbose, "device %s formatted successfully", deviceName)
 
 	return nil
 }
+
+// ReadSuperblock reads the superblock of deviceName.
+func ReadSuperblock(deviceName string) (*blockDevice.Metadata, error) {
+	buf, err := readSuperblock(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &blockDevice.Metadata{}
+	if err := metadata.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func readSuperblock(deviceName string) ([]byte, error) {
+	deviceFile, err := os.Open(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer deviceFile.Close()
+	buf := make([]byte, blockDevice.MetadataSize)
+	if _, err := io.ReadFull(deviceFile, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// CheckDevice makes sure formatting deviceName can't destroy data it
+// shouldn't: the device must be blank, or formatted for torus already, in
+// which case wipe must be set to format it again.
+func CheckDevice(deviceName string, wipe bool) error {
+	buf, err := readSuperblock(deviceName)
+	if err != nil {
+		return err
+	}
+	switch {
+	case blockDevice.IsBlank(buf):
+		return nil
+	case bytes.HasPrefix(buf, blockDevice.MagicSentence):
+		if !wipe {
+			return fmt.Errorf("%s is already formatted for torus; give --wipe to format it again, destroying the blocks it holds", deviceName)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s is neither blank nor formatted for torus, and may hold other data; if it is meant for torus, zero its first %d bytes first", deviceName, blockDevice.MetadataSize)
+	}
+}
+
+// Reformat formats the torus device deviceName again with the block size it
+// was formatted with, dropping the blocks it holds and the cluster it holds
+// them for.
+func Reformat(verbose bool, deviceName string) error {
+	metadata, err := ReadSuperblock(deviceName)
+	if err != nil {
+		return fmt.Errorf("%s: %v; format it with torusctl mkfs-device", deviceName, err)
+	}
+	return Mkfs(metadata.TorusBlockSize, "", verbose, deviceName)
+}
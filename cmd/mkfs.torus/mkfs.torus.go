@@ -14,6 +14,7 @@ import (
 var (
 	verbose      bool
 	assumeYes    bool
+	wipe         bool
 	blockSizeStr string
 )
 
@@ -49,6 +50,7 @@ func init() {
 	rootCommand.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable debug logging")
 	rootCommand.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "assume yes on all prompts")
 	rootCommand.PersistentFlags().StringVarP(&blockSizeStr, "block-size", "b", "512K", "torus cluster block size")
+	rootCommand.PersistentFlags().BoolVarP(&wipe, "wipe", "", false, "format a device already formatted for torus again, destroying its blocks")
 }
 
 func runFunc(cmd *cobra.Command, args []string) {
@@ -61,6 +63,9 @@ func runFunc(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("error parsing block size: %v", err)
 	}
+	if err := lib.CheckDevice(args[0], wipe); err != nil {
+		die("%v", err)
+	}
 
 	stderr("This is going to format %s for torus.", args[0])
 	stderr("This will destroy any data on the device.")
@@ -85,7 +90,7 @@ func runFunc(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	err = lib.Mkfs(torusBlockSize, verbose, args[0])
+	err = lib.Mkfs(torusBlockSize, "", verbose, args[0])
 	if err != nil {
 		die("%v", err)
 	}
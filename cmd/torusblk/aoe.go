@@ -34,6 +34,12 @@ eth0 network interface:
 
 	torusblk aoe vol01 eth0 1 1
 	torusblk aoe vol02 eth0 1 2
+
+Each frame carries as many sectors as the interface's MTU allows, so on a
+network with jumbo frames each carries about 8KiB. If the interface can't send
+a jumbo frame, or clients keep sending requests answered with jumbo frames
+again, as happens when a switch drops them, the server falls back to standard
+1500 byte frames and logs a warning.
 `),
 	Run: func(cmd *cobra.Command, args []string) {
 		err := aoeAction(cmd, args)
@@ -48,10 +54,12 @@ eth0 network interface:
 
 var (
 	aoeFlush string
+	aoeMTU   int
 )
 
 func init() {
 	aoeCommand.Flags().StringVarP(&aoeFlush, "flush", "", "", "flush AOE device (e.g. torsublk aoe --flush e1.1)")
+	aoeCommand.Flags().IntVarP(&aoeMTU, "mtu", "", 0, "size frames for this MTU rather than the interface's (e.g. 9000 for jumbo frames)")
 }
 
 func aoeAction(cmd *cobra.Command, args []string) error {
@@ -95,8 +103,10 @@ func aoeAction(cmd *cobra.Command, args []string) error {
 	}
 
 	as, err := aoe.NewServer(blockvol, &aoe.ServerOptions{
-		Major: uint16(major),
-		Minor: uint8(minor),
+		Major:    uint16(major),
+		Minor:    uint8(minor),
+		ReadOnly: readOnly,
+		MTU:      aoeMTU,
 	})
 	if err != nil {
 		return fmt.Errorf("Failed to crate AoE server: %v", err)
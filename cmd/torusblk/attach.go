@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/internal/nbd"
+)
+
+// nbdAttachTimeout bounds how long an NBD device takes to come up once
+// connected, or to go down once disconnected.
+const nbdAttachTimeout = 10 * time.Second
+
+// nbdAttachMut is held from picking a free NBD device until it's connected,
+// so that two volumes attached at once never pick the same one.
+var nbdAttachMut sync.Mutex
+
+// attachment is a volume served to an NBD device by this process, for as
+// long as it runs.
+type attachment struct {
+	name   string
+	device string
+	dev    *reconnectDevice
+	handle *nbd.NBD
+	served chan error
+}
+
+// attachVolume opens a volume, read-only if ro is set, and serves it to a
+// free NBD device. The volume's lock is taken before any device is picked, so
+// that a volume attached elsewhere fails with a *block.LockedError without
+// tying one up.
+func attachVolume(srv *torus.Server, name string, ro bool) (*attachment, error) {
+	open := func() (*block.BlockFile, error) {
+		return openBlockFileAs(srv, name, ro)
+	}
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	a := &attachment{
+		name:   name,
+		served: make(chan error, 1),
+	}
+	a.dev = newReconnectDevice(name, f, open, reconnectTimeout, func() {
+		a.handle.Disconnect()
+	})
+	a.handle = nbd.Create(a.dev, int64(a.dev.Size()), int64(srv.MDS.GlobalMetadata().BlockSize))
+	a.handle.SetTimeout(nbdTimeout(srv, name))
+	if err := a.connect(); err != nil {
+		a.dev.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// connect connects the volume to a free NBD device, and waits for the device
+// to come up.
+func (a *attachment) connect() error {
+	nbdAttachMut.Lock()
+	defer nbdAttachMut.Unlock()
+	device, err := nbd.FindDevice()
+	if err != nil {
+		return err
+	}
+	if _, err := a.handle.OpenDevice(device); err != nil {
+		return err
+	}
+	go func() {
+		a.served <- a.handle.Serve()
+	}()
+	// FindDevice only takes a device for busy once it's connected.
+	pid := filepath.Join("/sys/block", filepath.Base(device), "pid")
+	deadline := time.After(nbdAttachTimeout)
+	for {
+		if _, err := os.Stat(pid); err == nil {
+			a.device = device
+			return nil
+		}
+		select {
+		case err := <-a.served:
+			a.served <- err
+			if err == nil {
+				err = errors.New("disconnected")
+			}
+			return fmt.Errorf("%s: %v", device, err)
+		case <-deadline:
+			a.handle.Disconnect()
+			return fmt.Errorf("%s didn't come up in %v", device, nbdAttachTimeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// detach disconnects the device and closes the volume, releasing its lock.
+// Whatever is mounted from the device should be unmounted first.
+func (a *attachment) detach() error {
+	a.handle.Disconnect()
+	select {
+	case <-a.served:
+	case <-time.After(nbdAttachTimeout):
+		clog.Warningf("%s is slow to disconnect from volume %s", a.device, a.name)
+	}
+	if err := a.dev.Close(); err != nil {
+		return fmt.Errorf("error closing volume %s: %v", a.name, err)
+	}
+	return nil
+}
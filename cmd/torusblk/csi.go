@@ -0,0 +1,226 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+)
+
+var (
+	csiCommand = &cobra.Command{
+		Use:   "csi",
+		Short: "serve block volumes to container orchestrators over CSI",
+		Long: strings.TrimSpace(`
+Serve block volumes to container orchestrators, such as Kubernetes, as a
+Container Storage Interface plugin.
+
+The controller service creates and deletes volumes, and publishes each to
+one node at a time. The node service attaches volumes to NBD devices that it
+serves itself, so it must keep running for as long as they're in use, and
+formats and mounts them for workloads that want a filesystem.
+`),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := csiAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+)
+
+var (
+	csiEndpoint    string
+	csiDriverName  string
+	csiNodeID      string
+	csiServices    string
+	csiDefaultSize string
+)
+
+func init() {
+	rootCommand.AddCommand(csiCommand)
+
+	csiCommand.Flags().StringVarP(&csiEndpoint, "endpoint", "", "unix:///var/lib/kubelet/plugins/torus.alternative-storage.github.com/csi.sock", "CSI endpoint to listen on")
+	csiCommand.Flags().StringVarP(&csiDriverName, "driver-name", "", "torus.alternative-storage.github.com", "name the plugin is registered under")
+	csiCommand.Flags().StringVarP(&csiNodeID, "node-id", "", "", "ID of this node (default is the hostname)")
+	csiCommand.Flags().StringVarP(&csiServices, "services", "", "controller,node", "services to serve: controller, node, or both")
+	csiCommand.Flags().StringVarP(&csiDefaultSize, "default-size", "", "10GiB", "size of volumes created without a required capacity")
+	csiCommand.Flags().DurationVarP(&reconnectTimeout, "reconnect-timeout", "", defaultReconnectTimeout, "keep retrying I/O to a volume for this long after a failure, holding requests until it's back, before failing its device (0 fails requests right away)")
+}
+
+func csiAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return torus.ErrUsage
+	}
+	var controller, node bool
+	for _, s := range strings.Split(csiServices, ",") {
+		switch strings.TrimSpace(s) {
+		case "controller":
+			controller = true
+		case "node":
+			node = true
+		default:
+			return fmt.Errorf("unknown CSI service %q", s)
+		}
+	}
+	size, err := humanize.ParseBytes(csiDefaultSize)
+	if err != nil {
+		return fmt.Errorf("error parsing default size %s: %v", csiDefaultSize, err)
+	}
+	if csiNodeID == "" {
+		if csiNodeID, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	l, err := listenCSI(csiEndpoint)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %v", csiEndpoint, err)
+	}
+	g := grpc.NewServer(grpc.UnaryInterceptor(logCSIErrors))
+	csi.RegisterIdentityServer(g, &csiIdentity{controller: controller})
+	if controller {
+		csi.RegisterControllerServer(g, newCSIController(srv, size))
+	}
+	var n *csiNode
+	if node {
+		n = newCSINode(srv, csiNodeID)
+		csi.RegisterNodeServer(g, n)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived a signal, stopping...")
+		g.GracefulStop()
+	}()
+
+	err = g.Serve(l)
+	if n != nil {
+		// The volumes' devices are served by this process; don't leave
+		// them, or their locks, behind.
+		n.detachAll()
+	}
+	return err
+}
+
+// listenCSI listens on a CSI endpoint, unix://PATH or tcp://HOST:PORT,
+// replacing the socket a previous run left behind.
+func listenCSI(endpoint string) (net.Listener, error) {
+	i := strings.Index(endpoint, "://")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	proto, addr := endpoint[:i], endpoint[i+3:]
+	if proto == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return net.Listen(proto, addr)
+}
+
+func logCSIErrors(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	clog.Debugf("%s: %+v", info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		clog.Errorf("%s: %v", info.FullMethod, err)
+	}
+	return resp, err
+}
+
+// csiError maps an error from torus onto the status code CSI expects for
+// it.
+func csiError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch err.(type) {
+	case *block.ClonesError, *block.ReadersError, *block.LockedError:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	switch err {
+	case torus.ErrNotExist:
+		return status.Error(codes.NotFound, err.Error())
+	case torus.ErrLocked:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case torus.ErrExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+type csiIdentity struct {
+	controller bool
+}
+
+func (i *csiIdentity) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          csiDriverName,
+		VendorVersion: torus.Version,
+	}, nil
+}
+
+func (i *csiIdentity) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	resp := &csi.GetPluginCapabilitiesResponse{}
+	if i.controller {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+	return resp, nil
+}
+
+func (i *csiIdentity) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+// csiAccessModes are the access modes volumes may be used in: a volume is
+// published to one node at a time.
+var csiAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: true,
+}
+
+// checkCapabilities checks that volumes can be used with each of caps, as
+// block devices or as filesystems.
+func checkCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "volume capabilities missing")
+	}
+	for _, c := range caps {
+		if c.GetBlock() == nil && c.GetMount() == nil {
+			return status.Error(codes.InvalidArgument, "volume capability has no access type")
+		}
+		if mode := c.GetAccessMode().GetMode(); !csiAccessModes[mode] {
+			return status.Errorf(codes.InvalidArgument, "unsupported access mode %v", mode)
+		}
+	}
+	return nil
+}
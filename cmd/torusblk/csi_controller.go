@@ -0,0 +1,256 @@
+// +build linux
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/alternative-storage/torus/models"
+)
+
+// csiParameterPrefix marks the parameters the CSI sidecars pass along for
+// themselves.
+const csiParameterPrefix = "csi.storage.k8s.io/"
+
+// csiController creates block volumes for CSI, naming them by the name the
+// orchestrator gives them, which doubles as their ID.
+type csiController struct {
+	*csi.UnimplementedControllerServer
+
+	srv         *torus.Server
+	defaultSize uint64
+	// mut serializes creating volumes, so that the retries the sidecars
+	// send while one is being created find it rather than race it.
+	mut sync.Mutex
+}
+
+func newCSIController(srv *torus.Server, defaultSize uint64) *csiController {
+	return &csiController{
+		UnimplementedControllerServer: &csi.UnimplementedControllerServer{},
+		srv:                           srv,
+		defaultSize:                   defaultSize,
+	}
+}
+
+func (c *csiController) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	resp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, t := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	} {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: t},
+			},
+		})
+	}
+	return resp, nil
+}
+
+// CreateVolume creates a block volume, or returns the one already created
+// under the name if it fits the request, as the sidecars retry requests that
+// take a while.
+func (c *csiController) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume name missing")
+	}
+	if err := checkCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, err
+	}
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "volumes can't be created from a content source")
+	}
+	required := req.GetCapacityRange().GetRequiredBytes()
+	limit := req.GetCapacityRange().GetLimitBytes()
+	if required < 0 || limit < 0 || (limit != 0 && required > limit) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid capacity range %d-%d", required, limit)
+	}
+	size := uint64(required)
+	if size == 0 {
+		size = c.defaultSize
+		if limit != 0 && size > uint64(limit) {
+			size = uint64(limit)
+		}
+	}
+	var spec torus.BlockLayerSpec
+	for k, v := range req.GetParameters() {
+		switch {
+		case k == "blockspec":
+			if !strings.HasSuffix(v, ",base") && !strings.HasPrefix(v, "base") {
+				v += ",base"
+			}
+			var err error
+			if spec, err = blockset.ParseBlockLayerSpec(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid blockspec %q: %v", v, err)
+			}
+		case strings.HasPrefix(k, csiParameterPrefix):
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown parameter %q", k)
+		}
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	vol, err := c.srv.MDS.GetVolume(name)
+	if err == torus.ErrNotExist {
+		if spec != nil {
+			err = block.CreateBlockVolumeWithSpec(c.srv.MDS, name, size, spec)
+		} else {
+			err = block.CreateBlockVolume(c.srv.MDS, name, size)
+		}
+		// Another controller may have just created it; if so, check it
+		// fits like any other.
+		if err != nil && err != torus.ErrExists {
+			return nil, csiError(err)
+		}
+		vol, err = c.srv.MDS.GetVolume(name)
+	}
+	if err != nil {
+		return nil, csiError(err)
+	}
+	if vol.Type != block.VolumeType {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s exists, but isn't a block volume", name)
+	}
+	if vol.MaxBytes < uint64(required) || (limit != 0 && vol.MaxBytes > uint64(limit)) {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s exists with a size of %d bytes", name, vol.MaxBytes)
+	}
+	if spec != nil {
+		have, err := block.VolumeBlockSpec(c.srv.MDS, vol)
+		if err != nil {
+			return nil, csiError(err)
+		}
+		if blockset.FormatBlockLayerSpec(have) != blockset.FormatBlockLayerSpec(spec) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s exists with block spec %s", name, blockset.FormatBlockLayerSpec(have))
+		}
+	}
+	return &csi.CreateVolumeResponse{Volume: csiVolume(vol)}, nil
+}
+
+func csiVolume(vol *models.Volume) *csi.Volume {
+	return &csi.Volume{
+		VolumeId:      vol.Name,
+		CapacityBytes: int64(vol.MaxBytes),
+	}
+}
+
+// DeleteVolume deletes a block volume, succeeding if there's none.
+func (c *csiController) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing")
+	}
+	err := block.DeleteBlockVolume(c.srv.MDS, req.GetVolumeId())
+	if err != nil && err != torus.ErrNotExist {
+		return nil, csiError(err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume claims a volume for a node. It fails while another
+// node has it, until that node's claim is released by
+// ControllerUnpublishVolume.
+func (c *csiController) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" || req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume or node ID missing")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+	err := block.PublishBlockVolume(c.srv.MDS, req.GetVolumeId(), req.GetNodeId())
+	if err == torus.ErrLocked {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published to another node", req.GetVolumeId())
+	} else if err != nil {
+		return nil, csiError(err)
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// ControllerUnpublishVolume releases the claim of a node on a volume. It
+// succeeds if the node has none, or the volume is gone.
+func (c *csiController) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing")
+	}
+	err := block.UnpublishBlockVolume(c.srv.MDS, req.GetVolumeId(), req.GetNodeId())
+	if err != nil && err != torus.ErrNotExist {
+		return nil, csiError(err)
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (c *csiController) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing")
+	}
+	vol, err := c.srv.MDS.GetVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, csiError(err)
+	}
+	if vol.Type != block.VolumeType {
+		return nil, status.Errorf(codes.NotFound, "volume %s isn't a block volume", vol.Name)
+	}
+	if err := checkCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// ListVolumes lists the block volumes by name. The token of the next page is
+// the index of its first volume.
+func (c *csiController) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	vols, _, err := c.srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, csiError(err)
+	}
+	var blockVols []*models.Volume
+	for _, v := range vols {
+		if v.Type == block.VolumeType {
+			blockVols = append(blockVols, v)
+		}
+	}
+	sort.Slice(blockVols, func(i, j int) bool { return blockVols[i].Name < blockVols[j].Name })
+
+	start := 0
+	if tok := req.GetStartingToken(); tok != "" {
+		start, err = strconv.Atoi(tok)
+		if err != nil || start < 0 || start > len(blockVols) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", tok)
+		}
+	}
+	end := len(blockVols)
+	if max := int(req.GetMaxEntries()); max > 0 && start+max < end {
+		end = start + max
+	}
+	resp := &csi.ListVolumesResponse{}
+	for _, v := range blockVols[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{Volume: csiVolume(v)})
+	}
+	if end < len(blockVols) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
@@ -0,0 +1,248 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+)
+
+// csiNode stages volumes on this node by attaching them to NBD devices, and
+// publishes them to workloads by bind mounting them.
+type csiNode struct {
+	*csi.UnimplementedNodeServer
+
+	srv    *torus.Server
+	nodeID string
+
+	mut    sync.Mutex
+	staged map[string]*stagedVolume
+}
+
+// stagedVolume is a volume attached on this node, mounted at its staging path
+// unless it's used as a raw block device.
+type stagedVolume struct {
+	*attachment
+	stagingPath string
+	mounted     bool
+}
+
+func newCSINode(srv *torus.Server, nodeID string) *csiNode {
+	return &csiNode{
+		UnimplementedNodeServer: &csi.UnimplementedNodeServer{},
+		srv:                     srv,
+		nodeID:                  nodeID,
+		staged:                  make(map[string]*stagedVolume),
+	}
+}
+
+func (n *csiNode) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (n *csiNode) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: n.nodeID}, nil
+}
+
+// NodeStageVolume attaches a volume and, unless it's to be used as a block
+// device, formats it if it's blank and mounts it at the staging path.
+func (n *csiNode) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	name, path, vcap := req.GetVolumeId(), req.GetStagingTargetPath(), req.GetVolumeCapability()
+	if name == "" || path == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID or staging path missing")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{vcap}); err != nil {
+		return nil, err
+	}
+
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if sv, ok := n.staged[name]; ok {
+		if sv.stagingPath != path || sv.mounted != (vcap.GetMount() != nil) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is staged at %s differently", name, sv.stagingPath)
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	ro := vcap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	a, err := attachVolume(n.srv, name, ro)
+	if lerr, ok := err.(*block.LockedError); ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is attached by %s", name, &lerr.Holder)
+	} else if err == torus.ErrLocked {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is attached on another node", name)
+	} else if err != nil {
+		return nil, csiError(err)
+	}
+	sv := &stagedVolume{attachment: a, stagingPath: path}
+	if m := vcap.GetMount(); m != nil {
+		if err := stageFilesystem(a.device, path, m, ro); err != nil {
+			a.detach()
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		sv.mounted = true
+	}
+	clog.Infof("staged volume %s on %s", name, a.device)
+	n.staged[name] = sv
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func stageFilesystem(dev, path string, m *csi.VolumeCapability_MountVolume, ro bool) error {
+	fstype := m.GetFsType()
+	if fstype == "" {
+		fstype = "ext4"
+	}
+	options := append([]string{"noatime"}, m.GetMountFlags()...)
+	if ro {
+		// A read-only device can't be formatted, nor would its
+		// filesystem take discards.
+		found, err := filesystemType(dev)
+		if err != nil {
+			return err
+		}
+		if found == "" {
+			return status.Errorf(codes.FailedPrecondition, "%s has no filesystem to mount read-only", dev)
+		}
+		return mountDevice(dev, path, found, append(options, "ro"))
+	}
+	found, err := formatDevice(dev, fstype)
+	if err != nil {
+		return err
+	}
+	return mountDevice(dev, path, found, append(options, "discard"))
+}
+
+// NodeUnstageVolume unmounts a volume from its staging path and detaches it.
+// It succeeds if the volume isn't staged.
+func (n *csiNode) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	name, path := req.GetVolumeId(), req.GetStagingTargetPath()
+	if name == "" || path == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID or staging path missing")
+	}
+
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	sv, ok := n.staged[name]
+	if !ok {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	if err := sv.unstage(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	delete(n.staged, name)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (sv *stagedVolume) unstage() error {
+	if sv.mounted {
+		mounted, err := isMountpoint(sv.stagingPath)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			if err := forceUnmountDir(sv.stagingPath); err != nil {
+				return err
+			}
+		}
+	}
+	clog.Infof("unstaging volume %s from %s", sv.name, sv.device)
+	return sv.detach()
+}
+
+// NodePublishVolume bind mounts a staged volume at the target path: its
+// filesystem onto a directory, or its device onto a file.
+func (n *csiNode) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	name, target := req.GetVolumeId(), req.GetTargetPath()
+	if name == "" || target == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID or target path missing")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	sv, ok := n.staged[name]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s isn't staged", name)
+	}
+	mounted, err := isMountpoint(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	src := sv.stagingPath
+	if req.GetVolumeCapability().GetBlock() != nil {
+		src = sv.device
+		f, err := os.OpenFile(target, os.O_CREATE, 0644)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		f.Close()
+	} else {
+		if !sv.mounted {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is staged as a block device", name)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := bindMount(src, target, req.GetReadonly()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts a volume from the target path and removes it.
+// It succeeds if nothing is mounted there.
+func (n *csiNode) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	name, target := req.GetVolumeId(), req.GetTargetPath()
+	if name == "" || target == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID or target path missing")
+	}
+	mounted, err := isMountpoint(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		if err := forceUnmountDir(target); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// detachAll unstages every volume, for shutting down.
+func (n *csiNode) detachAll() {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	for name, sv := range n.staged {
+		if err := sv.unstage(); err != nil {
+			clog.Errorf("error unstaging volume %s: %v", name, err)
+		}
+		delete(n.staged, name)
+	}
+}
@@ -0,0 +1,486 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/alternative-storage/torus/internal/dockerplugin"
+	"github.com/alternative-storage/torus/internal/nbd"
+	"github.com/alternative-storage/torus/models"
+)
+
+var (
+	dockerPluginCommand = &cobra.Command{
+		Use:   "docker-plugin",
+		Short: "serve block volumes to Docker as a volume plugin",
+		Long: strings.TrimSpace(`
+Serve block volumes to Docker as a volume plugin, listening on the plugin
+socket. Containers using a volume get it attached to an NBD device and
+mounted under the --root directory, formatted first if it has no filesystem.
+
+Volumes are created with docker volume create -d torus, and take these
+options:
+
+	size=SIZE        size of the volume, such as 10GiB
+	blockspec=SPEC   block layer spec, such as crc,lz4 (default is the
+	                 cluster's)
+	fstype=TYPE      filesystem to make on first mount (default ext4)
+	mkfs=false       don't make a filesystem; mounting fails until there's
+	                 one
+
+The containers on one host using a volume share its mount. A volume mounted
+on one host can't be mounted on another until it's unmounted there.
+`),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := dockerPluginAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+)
+
+var (
+	dockerSocket      string
+	dockerRoot        string
+	dockerDefaultSize string
+)
+
+const defaultDockerFSType = "ext4"
+
+func init() {
+	rootCommand.AddCommand(dockerPluginCommand)
+
+	dockerPluginCommand.Flags().StringVarP(&dockerSocket, "socket", "", "/run/docker/plugins/torus.sock", "plugin socket to listen on; Docker names the driver after it")
+	dockerPluginCommand.Flags().StringVarP(&dockerRoot, "root", "", "/var/lib/torus/docker", "directory to mount volumes and keep their options under")
+	dockerPluginCommand.Flags().StringVarP(&dockerDefaultSize, "default-size", "", "10GiB", "size of volumes created without a size option")
+	dockerPluginCommand.Flags().DurationVarP(&reconnectTimeout, "reconnect-timeout", "", defaultReconnectTimeout, "keep retrying I/O to a volume for this long after a failure, holding requests until it's back, before failing its device (0 fails requests right away)")
+}
+
+func dockerPluginAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return torus.ErrUsage
+	}
+	size, err := humanize.ParseBytes(dockerDefaultSize)
+	if err != nil {
+		return fmt.Errorf("error parsing default size %s: %v", dockerDefaultSize, err)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	d := newDockerDriver(srv, dockerRoot, size)
+	if err := d.cleanup(); err != nil {
+		return fmt.Errorf("couldn't clean up after the last run: %v", err)
+	}
+	l, err := dockerplugin.ListenUnix(dockerSocket)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %v", dockerSocket, err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived a signal, detaching volumes...")
+		l.Close()
+	}()
+
+	err = http.Serve(l, dockerplugin.NewHandler(d, dockerplugin.ScopeGlobal))
+	// The volumes' devices are served by this process; don't leave them,
+	// or their locks, behind.
+	d.detachAll()
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		return fmt.Errorf("plugin server exited: %v", err)
+	}
+	return nil
+}
+
+// dockerVolumeOptions are the options a volume was created with that apply
+// when it's mounted. They're kept on the host it was created on; volumes
+// created elsewhere are mounted with the defaults.
+type dockerVolumeOptions struct {
+	FSType string `json:"fstype,omitempty"`
+	NoMkfs bool   `json:"no_mkfs,omitempty"`
+}
+
+// dockerDriver attaches volumes to NBD devices for Docker, serving the
+// devices itself.
+type dockerDriver struct {
+	srv         *torus.Server
+	root        string
+	defaultSize uint64
+
+	// mut guards volumes, mounts and the options file.
+	mut     sync.Mutex
+	volumes map[string]*dockerVolume
+	mounts  map[string]string
+}
+
+// dockerVolume is a volume as attached on this host. Its mutex is held
+// across mounting and unmounting it, so that containers mounting it at once
+// wait for the first to attach it, then share it.
+type dockerVolume struct {
+	mut sync.Mutex
+	// ids are the mounts of the containers using the volume.
+	ids        map[string]bool
+	mountpoint string
+	*attachment
+}
+
+func newDockerDriver(srv *torus.Server, root string, defaultSize uint64) *dockerDriver {
+	return &dockerDriver{
+		srv:         srv,
+		root:        root,
+		defaultSize: defaultSize,
+		volumes:     make(map[string]*dockerVolume),
+		mounts:      make(map[string]string),
+	}
+}
+
+func (d *dockerDriver) volume(name string) *dockerVolume {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	v, ok := d.volumes[name]
+	if !ok {
+		v = &dockerVolume{ids: make(map[string]bool)}
+		d.volumes[name] = v
+	}
+	return v
+}
+
+func (d *dockerDriver) mountDir() string {
+	return filepath.Join(d.root, "mounts")
+}
+
+func (d *dockerDriver) optionsFile() string {
+	return filepath.Join(d.root, "volumes.json")
+}
+
+// loadOptions reads the options of every volume created on this host. d.mut
+// must be held.
+func (d *dockerDriver) loadOptions() (map[string]dockerVolumeOptions, error) {
+	opts := make(map[string]dockerVolumeOptions)
+	b, err := ioutil.ReadFile(d.optionsFile())
+	if os.IsNotExist(err) {
+		return opts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return opts, json.Unmarshal(b, &opts)
+}
+
+// setOptions records the options of a volume, or forgets them if opts is
+// nil. d.mut must be held.
+func (d *dockerDriver) setOptions(name string, opts *dockerVolumeOptions) error {
+	all, err := d.loadOptions()
+	if err != nil {
+		return err
+	}
+	if opts == nil {
+		if _, ok := all[name]; !ok {
+			return nil
+		}
+		delete(all, name)
+	} else {
+		all[name] = *opts
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.root, 0755); err != nil {
+		return err
+	}
+	tmp := d.optionsFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.optionsFile())
+}
+
+func (d *dockerDriver) options(name string) (dockerVolumeOptions, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	all, err := d.loadOptions()
+	if err != nil {
+		return dockerVolumeOptions{}, err
+	}
+	opts := all[name]
+	if opts.FSType == "" {
+		opts.FSType = defaultDockerFSType
+	}
+	return opts, nil
+}
+
+func (d *dockerDriver) Create(name string, opts map[string]string) error {
+	if vol, err := d.srv.MDS.GetVolume(name); err == nil {
+		if vol.Type != block.VolumeType {
+			return fmt.Errorf("volume %s exists, but isn't a block volume", name)
+		}
+		if len(opts) != 0 {
+			return fmt.Errorf("volume %s already exists", name)
+		}
+		return nil
+	}
+
+	size := d.defaultSize
+	var spec torus.BlockLayerSpec
+	var vopts dockerVolumeOptions
+	for k, v := range opts {
+		var err error
+		switch k {
+		case "size":
+			size, err = humanize.ParseBytes(v)
+		case "blockspec":
+			if !strings.HasSuffix(v, ",base") && !strings.HasPrefix(v, "base") {
+				v += ",base"
+			}
+			spec, err = blockset.ParseBlockLayerSpec(v)
+		case "fstype":
+			vopts.FSType = v
+		case "mkfs":
+			var mkfs bool
+			mkfs, err = strconv.ParseBool(v)
+			vopts.NoMkfs = !mkfs
+		default:
+			return fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s option %q: %v", k, v, err)
+		}
+	}
+
+	var err error
+	if spec != nil {
+		err = block.CreateBlockVolumeWithSpec(d.srv.MDS, name, size, spec)
+	} else {
+		err = block.CreateBlockVolume(d.srv.MDS, name, size)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating volume %s: %v", name, err)
+	}
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if vopts == (dockerVolumeOptions{}) {
+		return d.setOptions(name, nil)
+	}
+	return d.setOptions(name, &vopts)
+}
+
+func (d *dockerDriver) Remove(name string) error {
+	vol := d.volume(name)
+	vol.mut.Lock()
+	defer vol.mut.Unlock()
+	if len(vol.ids) != 0 {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+	if err := block.DeleteBlockVolume(d.srv.MDS, name); err != nil {
+		return fmt.Errorf("error deleting volume %s: %v", name, err)
+	}
+	os.Remove(filepath.Join(d.mountDir(), name))
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.setOptions(name, nil)
+}
+
+func (d *dockerDriver) Mount(name, id string) (string, error) {
+	vol := d.volume(name)
+	vol.mut.Lock()
+	defer vol.mut.Unlock()
+	if len(vol.ids) == 0 {
+		if err := d.attach(name, vol); err != nil {
+			return "", err
+		}
+	}
+	vol.ids[id] = true
+	return vol.mountpoint, nil
+}
+
+func (d *dockerDriver) Unmount(name, id string) error {
+	vol := d.volume(name)
+	vol.mut.Lock()
+	defer vol.mut.Unlock()
+	delete(vol.ids, id)
+	if len(vol.ids) != 0 || vol.attachment == nil {
+		return nil
+	}
+	return d.detach(name, vol)
+}
+
+func (d *dockerDriver) Path(name string) (string, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.mounts[name], nil
+}
+
+func (d *dockerDriver) Get(name string) (*dockerplugin.Volume, error) {
+	vol, err := d.srv.MDS.GetVolume(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting volume %s: %v", name, err)
+	}
+	if vol.Type != block.VolumeType {
+		return nil, fmt.Errorf("volume %s isn't a block volume", name)
+	}
+	v := d.describe(vol)
+	v.Status = map[string]interface{}{
+		"size": humanize.IBytes(vol.MaxBytes),
+		"lock": d.srv.MDS.GetLockStatus(vol.Id),
+	}
+	return v, nil
+}
+
+func (d *dockerDriver) List() ([]*dockerplugin.Volume, error) {
+	vols, _, err := d.srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("error listing volumes: %v", err)
+	}
+	var out []*dockerplugin.Volume
+	for _, vol := range vols {
+		if vol.Type == block.VolumeType {
+			out = append(out, d.describe(vol))
+		}
+	}
+	return out, nil
+}
+
+func (d *dockerDriver) describe(vol *models.Volume) *dockerplugin.Volume {
+	mp, _ := d.Path(vol.Name)
+	return &dockerplugin.Volume{
+		Name:       vol.Name,
+		Mountpoint: mp,
+	}
+}
+
+// attach attaches the volume to a free NBD device and mounts it. vol.mut
+// must be held.
+func (d *dockerDriver) attach(name string, vol *dockerVolume) error {
+	a, err := attachVolume(d.srv, name, readOnly)
+	if lerr, ok := err.(*block.LockedError); ok {
+		return fmt.Errorf("volume %s is mounted by %s", name, &lerr.Holder)
+	} else if err == torus.ErrLocked {
+		return fmt.Errorf("volume %s is mounted on another host", name)
+	} else if err != nil {
+		return fmt.Errorf("can't attach volume %s: %v", name, err)
+	}
+	vol.attachment = a
+	if err := d.mount(name, vol); err != nil {
+		d.detach(name, vol)
+		return err
+	}
+	return nil
+}
+
+// mount makes a filesystem on vol's device if it has none and the volume's
+// options allow it, and mounts it. vol.mut must be held.
+func (d *dockerDriver) mount(name string, vol *dockerVolume) error {
+	opts, err := d.options(name)
+	if err != nil {
+		return err
+	}
+	var fstype string
+	if opts.NoMkfs {
+		fstype, err = filesystemType(vol.device)
+		if err == nil && fstype == "" {
+			err = fmt.Errorf("volume %s has no filesystem", name)
+		}
+	} else {
+		fstype, err = formatDevice(vol.device, opts.FSType)
+	}
+	if err != nil {
+		return err
+	}
+	flags := []string{"noatime", "discard"}
+	if vol.dev.IsReadOnly() {
+		flags = append(flags, "ro")
+	}
+	mp := filepath.Join(d.mountDir(), name)
+	if err := mountDevice(vol.device, mp, fstype, flags); err != nil {
+		return err
+	}
+	vol.mountpoint = mp
+	d.mut.Lock()
+	d.mounts[name] = mp
+	d.mut.Unlock()
+	return nil
+}
+
+// detach unmounts vol and detaches it, releasing its lock. It carries on
+// past errors, so that a volume isn't left locked by a container that didn't
+// clean up. vol.mut must be held.
+func (d *dockerDriver) detach(name string, vol *dockerVolume) error {
+	var err error
+	if vol.mountpoint != "" {
+		err = forceUnmountDir(vol.mountpoint)
+		d.mut.Lock()
+		delete(d.mounts, name)
+		d.mut.Unlock()
+	}
+	if derr := vol.attachment.detach(); err == nil {
+		err = derr
+	}
+	vol.ids = make(map[string]bool)
+	vol.mountpoint, vol.attachment = "", nil
+	return err
+}
+
+// detachAll detaches every volume attached on this host.
+func (d *dockerDriver) detachAll() {
+	d.mut.Lock()
+	vols := make(map[string]*dockerVolume, len(d.volumes))
+	for name, vol := range d.volumes {
+		vols[name] = vol
+	}
+	d.mut.Unlock()
+	for name, vol := range vols {
+		vol.mut.Lock()
+		if vol.attachment != nil {
+			if err := d.detach(name, vol); err != nil {
+				clog.Error(err)
+			}
+		}
+		vol.mut.Unlock()
+	}
+}
+
+// cleanup unmounts and detaches the volumes a previous run of the plugin left
+// mounted, such as after it was killed. Their locks expire with that run's
+// lease.
+func (d *dockerDriver) cleanup() error {
+	mounts, err := mountsUnder(d.mountDir())
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		clog.Infof("cleaning up %s left mounted at %s", m.device, m.dir)
+		if err := forceUnmountDir(m.dir); err != nil {
+			clog.Error(err)
+		}
+		if strings.HasPrefix(m.device, "/dev/nbd") {
+			if err := nbd.Detach(m.device); err != nil {
+				clog.Errorf("couldn't detach %s: %v", m.device, err)
+			}
+		}
+	}
+	return nil
+}
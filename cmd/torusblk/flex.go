@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
-	"strings"
 	"time"
 
 	"github.com/alternative-storage/torus"
@@ -183,6 +181,9 @@ func attachAction(cmd *cobra.Command, args []string) {
 	if vol.WriteCacheSize != "" {
 		cmdList = append(cmdList, []string{"--write-cache-size", vol.WriteCacheSize}...)
 	}
+	if vol.ReadWrite == "ro" {
+		cmdList = append(cmdList, "--read-only")
+	}
 
 	ch := make(chan string)
 
@@ -225,9 +226,12 @@ func mountAction(cmd *cobra.Command, args []string) {
 		onErr(err)
 	}
 
-	flags := "noatime"
+	flags := []string{"noatime"}
 	if vol.Trim {
-		flags = "noatime,discard"
+		flags = append(flags, "discard")
+	}
+	if vol.ReadWrite == "ro" {
+		flags = append(flags, "ro")
 	}
 
 	ch := make(chan string)
@@ -289,9 +293,7 @@ func mountAction(cmd *cobra.Command, args []string) {
 		onErr(err)
 	}
 
-	ex := exec.Command("mount", "-t", vol.FSType, "-o", flags, mountdev, mountdir)
-	_, err = ex.CombinedOutput()
-	if err != nil {
+	if err := mountDevice(mountdev, mountdir, vol.FSType, flags); err != nil {
 		onErr(err)
 	}
 	writeResponse(Response{
@@ -312,8 +314,7 @@ func unmountAction(cmd *cobra.Command, args []string) {
 	// sysd.StopUnit(svc, "fail", ch)
 	// <-ch
 
-	_, err := exec.Command("umount", mountdir).Output()
-	if err != nil {
+	if err := unmountDir(mountdir); err != nil {
 		onErr(err)
 	}
 	writeResponse(Response{
@@ -344,20 +345,15 @@ func flexprepvolAction(cmd *cobra.Command, args []string) {
 	}
 	dev := args[0]
 	fstype := args[1]
-	out, err := exec.Command("blkid", "-p", dev).Output()
+	found, err := formatDevice(dev, fstype)
 	if err != nil {
-		// Not formatted
-		out, err := exec.Command("mkfs", "-t", fstype, dev).CombinedOutput()
-		if err != nil {
-			fmt.Println(string(out))
-			os.Exit(1)
-		}
-	} else {
-		if !strings.Contains(string(out), fstype) {
-			// wrong FS type, this is bad
-			fmt.Println("unexpected FS Type")
-			os.Exit(1)
-		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if found != fstype {
+		// wrong FS type, this is bad
+		fmt.Println("unexpected FS Type")
+		os.Exit(1)
 	}
 	os.Exit(0)
 }
@@ -0,0 +1,108 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/internal/tcmu"
+)
+
+var (
+	iscsiCommand = &cobra.Command{
+		Use:   "iscsi VOLUME[@SNAPSHOT]",
+		Short: "serve a block volume as an iSCSI target",
+		Long: strings.TrimSpace(`
+Serve a block volume as an iSCSI target, through the kernel's LIO target
+and the target_core_user and iscsi_target_mod modules.
+
+The target is named after the volume unless --iqn is given. It takes the
+volume's write lock like any other attachment, and is torn down when
+torusblk exits; initiators log in again once it is back.
+
+An example of serving a volume to a single initiator, with CHAP:
+
+	torusblk iscsi vol01 --initiator iqn.1994-05.com.redhat:client01 \
+		--chap-user vol01 --chap-password secretsecret
+`),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := iscsiAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+)
+
+var (
+	iscsiTarget torustcmu.ISCSITarget
+)
+
+func init() {
+	rootCommand.AddCommand(iscsiCommand)
+
+	iscsiCommand.Flags().StringVarP(&iscsiTarget.IQN, "iqn", "", "", "name of the target (default is made up from the volume name)")
+	iscsiCommand.Flags().StringSliceVarP(&iscsiTarget.Portals, "portal", "", []string{"0.0.0.0:3260"}, "IP:PORT to listen for initiators on; may be given more than once")
+	iscsiCommand.Flags().StringSliceVarP(&iscsiTarget.Initiators, "initiator", "", nil, "IQN of an initiator allowed to log in; may be given more than once (default allows any)")
+	iscsiCommand.Flags().StringVarP(&iscsiTarget.CHAPUser, "chap-user", "", "", "CHAP user initiators must log in with")
+	iscsiCommand.Flags().StringVarP(&iscsiTarget.CHAPPassword, "chap-password", "", "", "CHAP password initiators must log in with")
+	iscsiCommand.Flags().StringVarP(&iscsiTarget.MutualUser, "chap-mutual-user", "", "", "CHAP user the target answers initiators with, for mutual CHAP")
+	iscsiCommand.Flags().StringVarP(&iscsiTarget.MutualPassword, "chap-mutual-password", "", "", "CHAP password the target answers initiators with, for mutual CHAP")
+	iscsiCommand.Flags().DurationVarP(&reconnectTimeout, "reconnect-timeout", "", defaultReconnectTimeout, "keep retrying I/O to the volume for this long after a failure, holding requests until it's back, before failing them (0 fails requests right away)")
+}
+
+func iscsiAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	if iscsiTarget.IQN == "" {
+		iscsiTarget.IQN = torustcmu.DefaultIQN(args[0])
+	}
+	if err := iscsiTarget.Validate(); err != nil {
+		return err
+	}
+
+	srv := createServer()
+
+	// Service managers restart torusblk with SIGTERM; take the target down
+	// cleanly then too.
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	closer := make(chan bool)
+	var once sync.Once
+	stop := func() { once.Do(func() { close(closer) }) }
+	go func() {
+		for range signalChan {
+			fmt.Println("\nReceived a signal, stopping the target...")
+			stop()
+		}
+	}()
+	defer srv.Close()
+	f, err := openBlockFile(srv, args[0])
+	if err != nil {
+		return openError(args[0], err)
+	}
+	reopen := func() (*block.BlockFile, error) {
+		return openBlockFile(srv, args[0])
+	}
+	dev := newReconnectDevice(args[0], f, reopen, reconnectTimeout, stop)
+	defer dev.Close()
+	err = torustcmu.ServeISCSI(dev, args[0], &iscsiTarget, closer)
+	if err != nil {
+		return fmt.Errorf("failed to serve volume over iSCSI: %s", err)
+	}
+	return nil
+}
@@ -4,30 +4,41 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
 	"github.com/alternative-storage/torus/distributor"
 	"github.com/alternative-storage/torus/internal/flagconfig"
 	"github.com/alternative-storage/torus/tracing"
 
 	// Register all the drivers.
+	_ "github.com/alternative-storage/torus/metadata/consul"
 	_ "github.com/alternative-storage/torus/metadata/etcd"
 	_ "github.com/alternative-storage/torus/storage"
 	_ "net/http/pprof"
 )
 
 var (
-	logpkg      string
-	httpAddress string
-	cfg         torus.Config
+	logpkg          string
+	logFormat       string
+	httpAddress     string
+	readOnly        bool
+	forceAttach     bool
+	staleAfter      time.Duration
+	traceSampleRate float64
+	cfg             torus.Config
 
 	debug bool
 )
 
+var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "torusblk")
+
 var rootCommand = &cobra.Command{
 	Use:              "torusblk",
 	Short:            "torus block volume tool",
@@ -62,12 +73,23 @@ func init() {
 	rootCommand.AddCommand(flexprepvolCommand)
 
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
+	rootCommand.PersistentFlags().StringVarP(&logFormat, "log-format", "", "text", "Format of log output: text, or json for one JSON object per line")
 	rootCommand.PersistentFlags().StringVarP(&httpAddress, "http", "", "", "HTTP endpoint for debug and stats")
 	rootCommand.PersistentFlags().BoolVarP(&debug, "debug", "", false, "Turn on debug output")
+	rootCommand.PersistentFlags().BoolVarP(&readOnly, "read-only", "", false, "Attach volumes read-only, alongside other read-only attachments but not a read-write one")
+	rootCommand.PersistentFlags().BoolVarP(&forceAttach, "force", "", false, "Take volumes over from a holder that stopped heartbeating, such as a crashed host, rather than fail to attach them")
+	rootCommand.PersistentFlags().DurationVarP(&staleAfter, "stale-after", "", block.DefaultStaleLockAge, "How long a holder must have gone without heartbeating for --force to take its volume over")
+	rootCommand.PersistentFlags().Float64VarP(&traceSampleRate, "trace-sample-rate", "", jaeger.DefaultSampleRate, "Fraction of NBD requests to trace with Jaeger (0 to 1)")
 	flagconfig.AddConfigFlags(rootCommand.PersistentFlags())
 }
 
 func configureServer(cmd *cobra.Command, args []string) {
+	if err := flagconfig.ApplyConfigFile(cmd.Flags(), "torusblk"); err != nil {
+		die("%v", err)
+	}
+	if err := torus.SetLogFormat(logFormat); err != nil {
+		die("%v", err)
+	}
 	switch {
 	case debug:
 		capnslog.SetGlobalLogLevel(capnslog.DEBUG)
@@ -85,11 +107,16 @@ func configureServer(cmd *cobra.Command, args []string) {
 		rl.SetLogLevel(llc)
 	}
 
+	hostname, _ := os.Hostname()
+	if err := jaeger.Init("torusblk:"+hostname, traceSampleRate); err != nil {
+		die("%v", err)
+	}
+
 	cfg = flagconfig.BuildConfigFromFlags()
 }
 
 func createServer() *torus.Server {
-	srv, err := torus.NewServer(cfg, "etcd", "temp")
+	srv, err := torus.NewServer(cfg, torus.MetadataServiceFor(cfg), "temp")
 	if err != nil {
 		fmt.Printf("couldn't start: %s\n", err)
 		os.Exit(1)
@@ -109,14 +136,52 @@ func createServer() *torus.Server {
 	return srv
 }
 
-func main() {
-	capnslog.SetGlobalLogLevel(capnslog.WARNING)
-	hostname, _ := os.Hostname()
+// openBlockFile opens a block volume for serving, read-only if --read-only is
+// set. A name of the form VOLUME@SNAPSHOT opens a snapshot of the volume,
+// which is always read-only.
+func openBlockFile(srv *torus.Server, name string) (*block.BlockFile, error) {
+	return openBlockFileAs(srv, name, readOnly)
+}
 
-	if err := jaeger.Init("torusblk:" + hostname); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// openBlockFileAs is openBlockFile, opening the volume read-only if ro is set
+// rather than by --read-only.
+func openBlockFileAs(srv *torus.Server, name string, ro bool) (*block.BlockFile, error) {
+	volName, snapName := name, ""
+	if i := strings.Index(name, "@"); i >= 0 {
+		volName, snapName = name[:i], name[i+1:]
+	}
+	vol, err := block.OpenBlockVolume(srv, volName)
+	if err != nil {
+		return nil, err
+	}
+	if snapName != "" {
+		return vol.OpenSnapshot(snapName)
+	}
+	if ro {
+		return vol.OpenBlockFileShared()
+	}
+	if forceAttach {
+		return vol.ForceOpenBlockFile(staleAfter)
 	}
+	return vol.OpenBlockFile()
+}
+
+// openError describes why the volume name couldn't be opened for serving.
+func openError(name string, err error) error {
+	if lerr, ok := err.(*block.LockedError); ok {
+		if forceAttach {
+			return fmt.Errorf("volume %s is attached by %s, which is still heartbeating", name, &lerr.Holder)
+		}
+		return fmt.Errorf("%v; if that host is gone, attach with --force to take the volume over", lerr)
+	}
+	if err == torus.ErrLocked {
+		return fmt.Errorf("volume %s is already mounted on another host", name)
+	}
+	return fmt.Errorf("can't open block volume: %s", err)
+}
+
+func main() {
+	capnslog.SetGlobalLogLevel(capnslog.WARNING)
 
 	if err := rootCommand.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// filesystemType returns the type of the filesystem on dev, or the empty
+// string if it has none.
+func filesystemType(dev string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "value", "-s", "TYPE", dev).Output()
+	if err != nil {
+		// blkid exits with 2 when it finds nothing on the device.
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.ExitStatus() == 2 {
+				return "", nil
+			}
+		}
+		return "", fmt.Errorf("couldn't probe %s: %v", dev, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// formatDevice makes a filesystem of type fstype on dev if it has none, and
+// returns the type of the filesystem dev has.
+func formatDevice(dev, fstype string) (string, error) {
+	found, err := filesystemType(dev)
+	if err != nil || found != "" {
+		return found, err
+	}
+	clog.Infof("making a %s filesystem on %s", fstype, dev)
+	if out, err := exec.Command("mkfs", "-t", fstype, dev).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("couldn't make a %s filesystem on %s: %v: %s", fstype, dev, err, out)
+	}
+	return fstype, nil
+}
+
+// mountDevice mounts the filesystem of type fstype on dev at dir, making dir
+// if need be.
+func mountDevice(dev, dir, fstype string, options []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	args := []string{"-t", fstype}
+	if len(options) != 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, dev, dir)
+	if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't mount %s at %s: %v: %s", dev, dir, err, out)
+	}
+	return nil
+}
+
+// bindMount mounts src, a directory or a device, at dst as well, read-only
+// if ro is set.
+func bindMount(src, dst string, ro bool) error {
+	if out, err := exec.Command("mount", "--bind", src, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't mount %s at %s: %v: %s", src, dst, err, out)
+	}
+	if !ro {
+		return nil
+	}
+	// Bind mounts only become read-only on remounting.
+	if out, err := exec.Command("mount", "-o", "remount,bind,ro", dst).CombinedOutput(); err != nil {
+		unmountDir(dst)
+		return fmt.Errorf("couldn't make %s read-only: %v: %s", dst, err, out)
+	}
+	return nil
+}
+
+func unmountDir(dir string) error {
+	if out, err := exec.Command("umount", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't unmount %s: %v: %s", dir, err, out)
+	}
+	return nil
+}
+
+// forceUnmountDir unmounts dir, lazily if it's busy, such as when processes
+// of a container that died are still around.
+func forceUnmountDir(dir string) error {
+	err := unmountDir(dir)
+	if err == nil {
+		return nil
+	}
+	clog.Warningf("%v; unmounting lazily", err)
+	if out, err := exec.Command("umount", "-l", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't unmount %s: %v: %s", dir, err, out)
+	}
+	return nil
+}
+
+// mountEntry is a line of /proc/mounts.
+type mountEntry struct {
+	device string
+	dir    string
+}
+
+// mountsUnder lists what's mounted at dir or below it.
+func mountsUnder(dir string) ([]mountEntry, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []mountEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[1] == dir || strings.HasPrefix(fields[1], strings.TrimSuffix(dir, "/")+"/") {
+			out = append(out, mountEntry{device: fields[0], dir: fields[1]})
+		}
+	}
+	return out, s.Err()
+}
+
+// isMountpoint reports whether something is mounted at dir.
+func isMountpoint(dir string) (bool, error) {
+	mounts, err := mountsUnder(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		if m.dir == dir {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/block"
@@ -14,7 +18,7 @@ import (
 
 var (
 	nbdCommand = &cobra.Command{
-		Use:   "nbd VOLUME [NBD-DEV]",
+		Use:   "nbd VOLUME[@SNAPSHOT] [NBD-DEV]",
 		Short: "attach a block volume to an NBD device",
 		Run: func(cmd *cobra.Command, args []string) {
 			err := nbdAction(cmd, args)
@@ -28,8 +32,18 @@ var (
 	}
 
 	nbdServeCommand = &cobra.Command{
-		Use:   "nbdserve",
-		Short: "serve a block volume over the NBD protocol",
+		Use:     "nbd-serve [VOLUME[@SNAPSHOT]...]",
+		Aliases: []string{"nbdserve"},
+		Short:   "serve block volumes over the NBD protocol",
+		Long: `nbd-serve serves block volumes to NBD clients, such as qemu, over TCP or a
+Unix socket, without the kernel's NBD module. Clients name the volume they
+want as the export name.
+
+With volumes named, only those are served: each is opened, taking its lock,
+when the server starts, and stays open for any number of connections until it
+stops. Snapshots, and volumes with --read-only, are served read-only. With no
+volumes named, any volume can be asked for, and is opened for the connection
+asking.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := nbdServeAction(cmd, args)
 			if err == torus.ErrUsage {
@@ -45,6 +59,7 @@ var (
 var (
 	serveListenAddress string
 	detachDevice       string
+	reconnectTimeout   time.Duration
 )
 
 func init() {
@@ -52,7 +67,8 @@ func init() {
 	rootCommand.AddCommand(nbdServeCommand)
 
 	nbdCommand.Flags().StringVarP(&detachDevice, "detach", "d", "", "detach an NBD device from a block volume. (e.g. torsublk nbd -d /dev/nbd0)")
-	nbdServeCommand.Flags().StringVarP(&serveListenAddress, "listen", "l", "0.0.0.0:10809", "nbd server listen address")
+	nbdCommand.Flags().DurationVarP(&reconnectTimeout, "reconnect-timeout", "", defaultReconnectTimeout, "keep retrying I/O to the volume for this long after a failure, holding requests until it's back, before failing the device (0 fails requests right away)")
+	nbdServeCommand.Flags().StringVarP(&serveListenAddress, "listen", "l", "0.0.0.0:10809", "nbd server listen address: a TCP address, or unix:PATH for a Unix socket")
 }
 
 func nbdAction(cmd *cobra.Command, args []string) error {
@@ -78,40 +94,62 @@ func nbdAction(cmd *cobra.Command, args []string) error {
 	signal.Notify(signalChan, os.Interrupt)
 
 	closer := make(chan bool)
+	var once sync.Once
+	stop := func() { once.Do(func() { close(closer) }) }
 	go func() {
 		for _ = range signalChan {
 			fmt.Println("\nReceived an interrupt, disconnecting...")
-			close(closer)
+			stop()
 		}
 	}()
 	defer srv.Close()
-	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	f, err := openBlockFile(srv, args[0])
 	if err != nil {
-		return fmt.Errorf("server doesn't support block volumes: %s", err)
+		return openError(args[0], err)
 	}
+	reopen := func() (*block.BlockFile, error) {
+		return openBlockFile(srv, args[0])
+	}
+	dev := newReconnectDevice(args[0], f, reopen, reconnectTimeout, stop)
+	return connectNBD(srv, dev, knownDev, closer)
+}
 
-	f, err := blockvol.OpenBlockFile()
-	if err != nil {
-		if err == torus.ErrLocked {
-			return fmt.Errorf("volume %s is already mounted on another host", args[0])
-		}
-		return fmt.Errorf("can't open block volume: %s", err)
+const (
+	// nbdBaseTimeout is how long the kernel waits for a request to a
+	// volume to be answered, before holding requests back to the volume's
+	// QoS limits or while reconnecting it is allowed for.
+	nbdBaseTimeout = 30 * time.Second
+	// nbdQueueDepth and nbdMaxRequest bound the requests the kernel can
+	// have queued on a device at once, which are answered one at a time.
+	nbdQueueDepth = 128
+	nbdMaxRequest = 1 << 20
+)
+
+// nbdTimeout returns how long the kernel should wait for a request to volume
+// name, or a snapshot of it, to be answered, allowing for the requests
+// queued ahead of it to be held back to the volume's QoS limits, and for
+// reconnecting to the volume.
+func nbdTimeout(srv *torus.Server, name string) time.Duration {
+	d := nbdBaseTimeout + reconnectTimeout
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
 	}
-	defer f.Close()
-	err = connectNBD(srv, f, knownDev, closer)
+	vol, err := srv.MDS.GetVolume(name)
 	if err != nil {
-		return err
+		clog.Warningf("couldn't look up QoS limits of volume %s: %v", name, err)
+		return d
 	}
-	return nil
+	return d + block.VolumeQoS(vol).MaxDelay(nbdQueueDepth, nbdQueueDepth*nbdMaxRequest)
 }
 
-func connectNBD(srv *torus.Server, f *block.BlockFile, target string, closer chan bool) error {
-	defer f.Close()
-	size := f.Size()
+func connectNBD(srv *torus.Server, dev *reconnectDevice, target string, closer chan bool) error {
+	defer dev.Close()
+	size := dev.Size()
 
 	gmd := srv.MDS.GlobalMetadata()
 
-	handle := nbd.Create(f, int64(size), int64(gmd.BlockSize))
+	handle := nbd.Create(dev, int64(size), int64(gmd.BlockSize))
+	handle.SetTimeout(nbdTimeout(srv, dev.name))
 
 	if target == "" {
 		t, err := nbd.FindDevice()
@@ -143,12 +181,7 @@ type finder struct {
 }
 
 func (f *finder) FindDevice(name string) (nbd.Device, error) {
-	blockvol, err := block.OpenBlockVolume(f.srv, name)
-	if err != nil {
-		return nil, err
-	}
-
-	return blockvol.OpenBlockFile()
+	return openBlockFile(f.srv, name)
 }
 
 func (f *finder) ListDevices() ([]string, error) {
@@ -166,18 +199,76 @@ func (f *finder) ListDevices() ([]string, error) {
 	return volnames, nil
 }
 
-func nbdServeAction(cmd *cobra.Command, args []string) error {
-	if len(args) != 0 {
-		return torus.ErrUsage
+// exportFinder serves a fixed set of volumes, opened up front.
+type exportFinder struct {
+	exports map[string]*block.BlockFile
+	names   []string
+}
+
+func openExports(srv *torus.Server, names []string) (*exportFinder, error) {
+	f := &exportFinder{exports: make(map[string]*block.BlockFile)}
+	for _, name := range names {
+		if _, ok := f.exports[name]; ok {
+			continue
+		}
+		bf, err := openBlockFile(srv, name)
+		if err != nil {
+			f.Close()
+			return nil, openError(name, err)
+		}
+		f.exports[name] = bf
+		f.names = append(f.names, name)
 	}
+	return f, nil
+}
 
+func (f *exportFinder) FindDevice(name string) (nbd.Device, error) {
+	bf, ok := f.exports[name]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't exported", name)
+	}
+	return sharedExport{bf}, nil
+}
+
+func (f *exportFinder) ListDevices() ([]string, error) {
+	return f.names, nil
+}
+
+// Close closes the exports, releasing their locks.
+func (f *exportFinder) Close() {
+	for name, bf := range f.exports {
+		if err := bf.Close(); err != nil {
+			clog.Errorf("couldn't close export %s: %v", name, err)
+		}
+	}
+}
+
+// sharedExport is an export as served to one connection, which leaves it open
+// for the others when it ends.
+type sharedExport struct {
+	*block.BlockFile
+}
+
+func (e sharedExport) Close() error {
+	return e.Sync()
+}
+
+func nbdServeAction(cmd *cobra.Command, args []string) error {
 	srv := createServer()
 	defer srv.Close()
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
-	devfinder := &finder{srv}
+	var devfinder nbd.DeviceFinder = &finder{srv}
+	if len(args) != 0 {
+		exports, err := openExports(srv, args)
+		if err != nil {
+			return err
+		}
+		defer exports.Close()
+		devfinder = exports
+	}
 	server, err := nbd.NewNBDServer(serveListenAddress, devfinder)
 	if err != nil {
 		return fmt.Errorf("can't start server: %v", err)
@@ -190,8 +281,14 @@ func nbdServeAction(cmd *cobra.Command, args []string) error {
 		return
 	}()
 
-	if err := server.Serve(); err != nil {
+	if err := server.Serve(); err != nil && !isClosedError(err) {
 		return fmt.Errorf("server exited: %v", err)
 	}
 	return nil
 }
+
+// isClosedError reports whether err is from accepting on a listener after it
+// was closed.
+func isClosedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus/block"
+	"golang.org/x/net/context"
+)
+
+const (
+	reconnectMinBackoff = 250 * time.Millisecond
+	reconnectMaxBackoff = 10 * time.Second
+	// defaultReconnectTimeout is how long I/O to a volume is retried by
+	// default before the device fails.
+	defaultReconnectTimeout = 2 * time.Minute
+)
+
+var errDeviceFailed = errors.New("torusblk: gave up reconnecting to the volume")
+
+// journalEntry is a write or trim made since the last successful Sync.
+type journalEntry struct {
+	off    int64
+	data   []byte
+	trim   bool
+	length int64
+}
+
+// reconnectDevice serves a block volume to NBD, reopening the volume when
+// I/O to it fails rather than passing the error on to the kernel. Writes and
+// trims are kept until a Sync makes them durable, and replayed onto the
+// reopened volume, so that none that were acknowledged are lost with the old
+// one. The request that failed is retried once the volume is back, and only
+// answered after that.
+type reconnectDevice struct {
+	mu      sync.Mutex
+	name    string
+	open    func() (*block.BlockFile, error)
+	f       *block.BlockFile
+	timeout time.Duration
+	journal []journalEntry
+	failed  bool
+	// giveUp is called once reconnecting has taken longer than timeout.
+	giveUp func()
+}
+
+func newReconnectDevice(name string, f *block.BlockFile, open func() (*block.BlockFile, error), timeout time.Duration, giveUp func()) *reconnectDevice {
+	return &reconnectDevice{
+		name:    name,
+		open:    open,
+		f:       f,
+		timeout: timeout,
+		giveUp:  giveUp,
+	}
+}
+
+func (d *reconnectDevice) ReadAt(b []byte, off int64) (n int, err error) {
+	return d.ReadAtContext(context.TODO(), b, off)
+}
+
+// ReadAtContext is ReadAt as part of the NBD request in ctx.
+func (d *reconnectDevice) ReadAtContext(ctx context.Context, b []byte, off int64) (n int, err error) {
+	err = d.do(func(f *block.BlockFile) error {
+		n, err = f.ReadAtContext(ctx, b, off)
+		return err
+	})
+	return n, err
+}
+
+func (d *reconnectDevice) WriteAt(b []byte, off int64) (n int, err error) {
+	return d.WriteAtContext(context.TODO(), b, off)
+}
+
+// WriteAtContext is WriteAt as part of the NBD request in ctx.
+func (d *reconnectDevice) WriteAtContext(ctx context.Context, b []byte, off int64) (n int, err error) {
+	err = d.do(func(f *block.BlockFile) error {
+		n, err = f.WriteAtContext(ctx, b, off)
+		return err
+	})
+	if err == nil {
+		d.record(journalEntry{off: off, data: append([]byte(nil), b...)})
+	}
+	return n, err
+}
+
+func (d *reconnectDevice) Trim(off, length int64) error {
+	err := d.do(func(f *block.BlockFile) error {
+		return f.Trim(off, length)
+	})
+	if err == nil {
+		d.record(journalEntry{off: off, trim: true, length: length})
+	}
+	return err
+}
+
+func (d *reconnectDevice) Sync() error {
+	return d.SyncContext(context.TODO())
+}
+
+// SyncContext is Sync as part of the NBD request in ctx.
+func (d *reconnectDevice) SyncContext(ctx context.Context) error {
+	err := d.do(func(f *block.BlockFile) error {
+		return f.SyncContext(ctx)
+	})
+	if err == nil {
+		d.mu.Lock()
+		d.journal = nil
+		d.mu.Unlock()
+	}
+	return err
+}
+
+func (d *reconnectDevice) Size() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Size()
+}
+
+func (d *reconnectDevice) IsReadOnly() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.IsReadOnly()
+}
+
+func (d *reconnectDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+func (d *reconnectDevice) record(e journalEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.journal = append(d.journal, e)
+}
+
+// do runs op against the volume, reconnecting and running it again for as
+// long as it fails, up to the timeout.
+func (d *reconnectDevice) do(op func(*block.BlockFile) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failed {
+		return errDeviceFailed
+	}
+	err := op(d.f)
+	if err == nil || d.timeout == 0 {
+		return err
+	}
+	start := time.Now()
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		if time.Since(start) >= d.timeout {
+			clog.Errorf("giving up reconnecting to %s after %v: %v", d.name, d.timeout, err)
+			d.failed = true
+			go d.giveUp()
+			return errDeviceFailed
+		}
+		clog.Warningf("I/O to %s failed, reconnecting (attempt %d): %v", d.name, attempt, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+		if err = d.reconnect(); err != nil {
+			continue
+		}
+		// Don't answer until what was acknowledged before, and the
+		// request itself, are durable on the reopened volume.
+		if err = op(d.f); err != nil {
+			continue
+		}
+		if err = d.f.Sync(); err != nil {
+			continue
+		}
+		d.journal = nil
+		clog.Infof("reconnected to %s after %v", d.name, time.Since(start))
+		return nil
+	}
+}
+
+// reconnect reopens the volume and replays the journal onto it.
+func (d *reconnectDevice) reconnect() error {
+	// Release the lock on the volume, if it can still be reached.
+	if d.f != nil {
+		if err := d.f.Close(); err != nil {
+			clog.Debugf("closing %s: %v", d.name, err)
+		}
+		d.f = nil
+	}
+	f, err := d.open()
+	if err != nil {
+		return err
+	}
+	d.f = f
+	for _, e := range d.journal {
+		if e.trim {
+			err = f.Trim(e.off, e.length)
+		} else {
+			_, err = f.WriteAt(e.data, e.off)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
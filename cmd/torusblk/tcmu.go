@@ -8,7 +8,6 @@ import (
 	"os/signal"
 
 	"github.com/alternative-storage/torus"
-	"github.com/alternative-storage/torus/block"
 	"github.com/spf13/cobra"
 
 	"github.com/alternative-storage/torus/internal/tcmu"
@@ -16,7 +15,7 @@ import (
 
 var (
 	tcmuCommand = &cobra.Command{
-		Use:   "tcmu VOLUME",
+		Use:   "tcmu VOLUME[@SNAPSHOT]",
 		Short: "attach a torus block volume via SCSI",
 		Run: func(cmd *cobra.Command, args []string) {
 			err := tcmuAction(cmd, args)
@@ -52,17 +51,9 @@ func tcmuAction(cmd *cobra.Command, args []string) error {
 		}
 	}()
 	defer srv.Close()
-	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	f, err := openBlockFile(srv, args[0])
 	if err != nil {
-		return fmt.Errorf("server doesn't support block volumes: %s", err)
-	}
-
-	f, err := blockvol.OpenBlockFile()
-	if err != nil {
-		if err == torus.ErrLocked {
-			return fmt.Errorf("volume %s is already mounted on another host", args[0])
-		}
-		return fmt.Errorf("can't open block volume: %s", err)
+		return openError(args[0], err)
 	}
 	defer f.Close()
 	err = torustcmu.ConnectAndServe(f, args[0], closer)
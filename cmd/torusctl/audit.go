@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/distributor"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var auditSample float64
+
+var auditCommand = &cobra.Command{
+	Use:   "audit [VOLUME...]",
+	Short: "check that every block of the cluster has the right number of copies",
+	Long: `audit reads the block maps of the given block volumes (all of them by default),
+asks every peer in the ring which of the referenced blocks it holds, and reports
+blocks with fewer or more copies than the ring's replication factor.`,
+	Run: auditAction,
+}
+
+func init() {
+	auditCommand.Flags().Float64VarP(&auditSample, "sample", "", 1, "fraction of each volume's blocks to check, between 0 and 1 (1 checks every block)")
+	auditCommand.Flags().BoolVarP(&outputAsJSON, "json", "", false, "output as json instead")
+}
+
+type auditVolume struct {
+	Name    string `json:"name"`
+	Checked int    `json:"checked"`
+	Under   int    `json:"under_replicated"`
+	Over    int    `json:"over_replicated"`
+}
+
+type auditProblem struct {
+	Volume  string   `json:"volume"`
+	Block   string   `json:"block"`
+	Want    int      `json:"want"`
+	Have    int      `json:"have"`
+	Holders []string `json:"holders"`
+}
+
+type auditReport struct {
+	Volumes          []auditVolume     `json:"volumes"`
+	Problems         []auditProblem    `json:"problems"`
+	UnreachablePeers map[string]string `json:"unreachable_peers,omitempty"`
+}
+
+func auditAction(cmd *cobra.Command, args []string) {
+	if auditSample <= 0 || auditSample > 1 {
+		die("sample must be in (0, 1]: %v", auditSample)
+	}
+	report := runAudit(args)
+	if wantJSON() {
+		printJSON(report)
+	} else {
+		printAuditReport(report)
+	}
+	if len(report.Problems) != 0 {
+		os.Exit(1)
+	}
+}
+
+func runAudit(args []string) auditReport {
+	srv := createServer()
+	defer srv.Close()
+
+	names := args
+	if len(names) == 0 {
+		vols, _, err := srv.MDS.GetVolumes()
+		if err != nil {
+			die("error listing volumes: %v", err)
+		}
+		for _, v := range vols {
+			if v.Type == block.VolumeType {
+				names = append(names, v.Name)
+			}
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	report := auditReport{
+		UnreachablePeers: make(map[string]string),
+	}
+	for _, name := range names {
+		vol, err := block.OpenBlockVolume(srv, name)
+		if err != nil {
+			die("couldn't open block volume %s: %v", name, err)
+		}
+		refs, err := vol.ReferencedBlocks()
+		if err != nil {
+			die("couldn't read block map of volume %s: %v", name, err)
+		}
+		if auditSample < 1 {
+			sampled := refs[:0]
+			for _, ref := range refs {
+				if rnd.Float64() < auditSample {
+					sampled = append(sampled, ref)
+				}
+			}
+			refs = sampled
+		}
+		reps, peerErrs, err := distributor.AuditReplicas(context.Background(), srv, refs)
+		if err != nil {
+			die("couldn't audit volume %s: %v", name, err)
+		}
+		for p, err := range peerErrs {
+			report.UnreachablePeers[p] = err.Error()
+		}
+		v := auditVolume{
+			Name:    name,
+			Checked: len(reps),
+		}
+		for _, r := range reps {
+			switch {
+			case r.UnderReplicated():
+				v.Under++
+			case r.OverReplicated():
+				v.Over++
+			default:
+				continue
+			}
+			report.Problems = append(report.Problems, auditProblem{
+				Volume:  name,
+				Block:   r.Ref.String(),
+				Want:    r.Want,
+				Have:    len(r.Holders),
+				Holders: r.Holders,
+			})
+		}
+		report.Volumes = append(report.Volumes, v)
+	}
+	return report
+}
+
+func printAuditReport(report auditReport) {
+	for p, err := range report.UnreachablePeers {
+		fmt.Fprintf(os.Stderr, "couldn't ask peer %s, counting it as holding nothing: %s\n", p, err)
+	}
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Volume", "Checked", "Under-replicated", "Over-replicated"})
+	for _, v := range report.Volumes {
+		table.Append([]string{
+			v.Name,
+			strconv.Itoa(v.Checked),
+			strconv.Itoa(v.Under),
+			strconv.Itoa(v.Over),
+		})
+	}
+	table.Render()
+	if len(report.Problems) == 0 {
+		return
+	}
+	fmt.Println()
+	table = NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Volume", "Block", "Want", "Have", "Holders"})
+	for _, p := range report.Problems {
+		table.Append([]string{
+			p.Volume,
+			p.Block,
+			strconv.Itoa(p.Want),
+			strconv.Itoa(p.Have),
+			strings.Join(p.Holders, ","),
+		})
+	}
+	table.Render()
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
 	"github.com/alternative-storage/torus/internal/flagconfig"
 	"github.com/spf13/cobra"
 )
@@ -36,9 +38,27 @@ var blockCreateFromSnapshotCommand = &cobra.Command{
 	},
 }
 
+var blockCloneCommand = &cobra.Command{
+	Use:   "clone VOLUME@SNAPSHOT_NAME NEW_NAME",
+	Short: "create a block volume that shares the blocks of a snapshot",
+	Long:  "creates a writable block volume named NEW_NAME from a snapshot without copying it; the clone shares the snapshot's blocks until it overwrites them, and the snapshot can't be deleted while it has clones",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := blockCloneAction(cmd, args)
+		if err == torus.ErrUsage {
+			cmd.Usage()
+			os.Exit(1)
+		} else if err != nil {
+			die("%v", err)
+		}
+	},
+}
+
 func init() {
 	blockCommand.AddCommand(blockCreateCommand)
+	blockCommand.AddCommand(blockCloneCommand)
 	blockCreateCommand.AddCommand(blockCreateFromSnapshotCommand)
+	blockCreateCommand.Flags().BoolVarP(&encrypted, "encrypted", "", false, "encrypt the volume's blocks under a key wrapped by the master key")
+	blockCreateCommand.Flags().StringVarP(&volumeBlockSpec, "blockspec", "", "", "block layer spec for the volume's blocks, such as crc,rep=3,base (default is the cluster's block spec)")
 	flagconfig.AddConfigFlags(blockCommand.PersistentFlags())
 }
 
@@ -46,3 +66,16 @@ func blockAction(cmd *cobra.Command, args []string) {
 	cmd.Usage()
 	os.Exit(1)
 }
+
+func blockCloneAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	vol := ParseSnapName(args[0])
+	if vol.Snapshot == "" {
+		return fmt.Errorf("can't clone a snapshot without a name, please use the form VOLUME@SNAPSHOT_NAME")
+	}
+	srv := createServer()
+	defer srv.Close()
+	return block.CloneBlockVolume(srv, vol.Volume, vol.Snapshot, args[1])
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var (
+	blockExportCommand = &cobra.Command{
+		Use:   "export VOLUME@SNAPSHOT_NAME",
+		Short: "export the blocks of a snapshot, or those changed since an earlier one",
+		Long: `export writes the blocks of a snapshot of a block volume to --out, or to
+standard output, in a stream 'torusctl block import' reads. With --since, only
+the blocks changed between that snapshot and this one are written, which for a
+volume backed up regularly is usually a small part of it. Only the block maps
+of the two snapshots are compared to find them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockExportAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	blockImportCommand = &cobra.Command{
+		Use:   "import INPUT_FILE VOLUME",
+		Short: "apply a stream written by export to a block volume",
+		Long: `import applies a stream written by 'torusctl block export' to VOLUME, then
+snapshots VOLUME with the name of the snapshot exported. A stream of a whole
+snapshot creates VOLUME. One of the changes since an earlier snapshot is
+applied to an existing VOLUME, which must still be as of its own snapshot of
+that name, as importing the previous stream leaves it. INPUT_FILE may be - for
+standard input.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockImportAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	exportSince string
+	exportOut   string
+)
+
+func init() {
+	blockExportCommand.Flags().StringVarP(&exportSince, "since", "", "", "only export the blocks changed since this snapshot of the volume")
+	blockExportCommand.Flags().StringVarP(&exportOut, "out", "o", "-", "file to write the stream to")
+	blockCommand.AddCommand(blockExportCommand)
+	blockCommand.AddCommand(blockImportCommand)
+}
+
+func blockExportAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return torus.ErrUsage
+	}
+	vol := ParseSnapName(args[0])
+	if vol.Snapshot == "" {
+		return fmt.Errorf("can't export without a snapshot, please use the form VOLUME@SNAPSHOT_NAME")
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, vol.Volume)
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", vol.Volume, err)
+	}
+	var out io.Writer = os.Stdout
+	if exportOut != "-" {
+		f, err := os.Create(exportOut)
+		if err != nil {
+			return fmt.Errorf("couldn't open output: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	n, err := blockvol.ExportSnapshot(out, exportSince, vol.Snapshot)
+	if err != nil {
+		return fmt.Errorf("couldn't export: %v", err)
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("couldn't write output: %v", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "exported %d blocks\n", n)
+	return nil
+}
+
+func blockImportAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	in := os.Stdin
+	if args[0] != "-" {
+		f, err := getReaderFromArg(args[0])
+		if err != nil {
+			return fmt.Errorf("couldn't open input: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	srv := createServer()
+	defer srv.Close()
+	h, err := block.ImportBlockVolume(srv, args[1], in)
+	if err != nil {
+		return fmt.Errorf("couldn't import into %s: %v", args[1], err)
+	}
+	if h.Base != "" {
+		fmt.Printf("applied the changes to %s@%s since %s to %s\n", h.Volume, h.Target, h.Base, args[1])
+	} else {
+		fmt.Printf("imported %s@%s as %s\n", h.Volume, h.Target, args[1])
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/internal/qcow2"
+
+	"github.com/coreos/pkg/progressutil"
+	"github.com/spf13/cobra"
+)
+
+var (
+	blockImportFileCommand = &cobra.Command{
+		Use:   "import-file IMAGE VOLUME",
+		Short: "copy a raw or qcow2 disk image into a block volume",
+		Long: `import-file copies a disk image, such as a VM's, into VOLUME, creating it
+with the size of the image if it doesn't exist. An existing VOLUME must be the
+size of the image. Blocks of the image that are all zeroes aren't written, so
+they take no space in the volume. qcow2 images are read as the guest sees
+them, if they have no backing file and aren't compressed or encrypted.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockImportFileAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	blockExportFileCommand = &cobra.Command{
+		Use:   "export-file VOLUME IMAGE",
+		Short: "copy a block volume, or a snapshot of it, into a raw disk image",
+		Long: `export-file copies VOLUME into the raw image IMAGE, leaving the blocks that
+are all zeroes as holes in it. The volume is held read-only while it is
+copied, so it can't be exported while it is attached for writing; export a
+snapshot of it with --from-snapshot instead.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := blockExportFileAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
+	imageFormat  string
+	fromSnapshot string
+)
+
+func init() {
+	blockImportFileCommand.Flags().StringVarP(&imageFormat, "format", "f", "auto", "format of the image: raw, qcow2, or auto to tell from its header")
+	blockImportFileCommand.Flags().BoolVarP(&progress, "progress", "p", false, "show progress")
+	blockExportFileCommand.Flags().StringVarP(&fromSnapshot, "from-snapshot", "", "", "export this snapshot of the volume rather than the volume")
+	blockExportFileCommand.Flags().BoolVarP(&progress, "progress", "p", false, "show progress")
+	blockCommand.AddCommand(blockImportFileCommand)
+	blockCommand.AddCommand(blockExportFileCommand)
+}
+
+func openImage(name string) (io.Reader, uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	format := imageFormat
+	if format == "auto" {
+		format = "raw"
+		if qcow2.IsQcow2(f) {
+			format = "qcow2"
+		}
+	}
+	switch format {
+	case "raw":
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, uint64(fi.Size()), nil
+	case "qcow2":
+		img, err := qcow2.Open(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NewSectionReader(img, 0, int64(img.Size())), img.Size(), nil
+	default:
+		return nil, 0, fmt.Errorf("unknown image format %q", format)
+	}
+}
+
+func blockImportFileAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	input, size, err := openImage(args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open image: %v", err)
+	}
+	srv := createServer()
+	defer srv.Close()
+	fresh := false
+	vol, err := srv.MDS.GetVolume(args[1])
+	switch {
+	case err == torus.ErrNotExist:
+		if err := block.CreateBlockVolume(srv.MDS, args[1], size); err != nil {
+			return fmt.Errorf("couldn't create block volume %s: %v", args[1], err)
+		}
+		fresh = true
+	case err != nil:
+		return fmt.Errorf("couldn't get volume %s: %v", args[1], err)
+	case vol.MaxBytes != size:
+		return fmt.Errorf("volume %s has %d bytes, but the image has %d", args[1], vol.MaxBytes, size)
+	}
+	blockvol, err := block.OpenBlockVolume(srv, args[1])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[1], err)
+	}
+	f, err := blockvol.OpenBlockFile()
+	if err != nil {
+		return fmt.Errorf("couldn't open blockfile %s: %v", args[1], err)
+	}
+	defer f.Close()
+
+	w := &sparseBlockWriter{
+		f:     f,
+		buf:   make([]byte, 0, srv.MDS.GlobalMetadata().BlockSize),
+		fresh: fresh,
+	}
+	if err := copyWithProgress(w, input, path.Base(args[0]), int64(size)); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return fmt.Errorf("couldn't copy: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("couldn't sync: %v", err)
+	}
+	if uint64(w.off) != size || f.Size() != size {
+		return fmt.Errorf("copied %d bytes into a volume of %d, but the image has %d", w.off, f.Size(), size)
+	}
+	fmt.Printf("copied %d bytes, %d blocks of them all zeroes\n", size, w.zero)
+	return nil
+}
+
+func blockExportFileAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return torus.ErrUsage
+	}
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	var bf *block.BlockFile
+	if fromSnapshot != "" {
+		bf, err = blockvol.OpenSnapshot(fromSnapshot)
+	} else {
+		// The shared lock keeps the volume from being attached for
+		// writing while it is copied.
+		bf, err = blockvol.OpenBlockFileShared()
+		if err == torus.ErrLocked {
+			return fmt.Errorf("volume %s is attached for writing; export a snapshot of it with --from-snapshot", args[0])
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", args[0], err)
+	}
+	defer bf.Close()
+	output, err := os.Create(args[1])
+	if err != nil {
+		return fmt.Errorf("couldn't open output: %v", err)
+	}
+	defer output.Close()
+
+	size := int64(bf.Size())
+	w := &sparseFileWriter{f: output}
+	if err := copyWithProgress(w, bf, path.Base(args[0]), size); err != nil {
+		return err
+	}
+	// Holes at the end of the image only count once it is truncated to
+	// its size.
+	if err := output.Truncate(size); err != nil {
+		return fmt.Errorf("couldn't size output: %v", err)
+	}
+	if err := output.Sync(); err != nil {
+		return fmt.Errorf("couldn't sync output: %v", err)
+	}
+	fmt.Printf("copied %d bytes\n", size)
+	return nil
+}
+
+func copyWithProgress(dst io.Writer, src io.Reader, name string, size int64) error {
+	if progress {
+		pb := progressutil.NewCopyProgressPrinter()
+		pb.AddCopy(src, name, size, dst)
+		if err := pb.PrintAndWait(os.Stderr, 500*time.Millisecond, nil); err != nil {
+			return fmt.Errorf("couldn't copy: %v", err)
+		}
+		return nil
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("couldn't copy: %v", err)
+	}
+	if n != size {
+		return fmt.Errorf("copied %d bytes of %d", n, size)
+	}
+	return nil
+}
+
+// sparseBlockWriter writes to a block file a block at a time, leaving out
+// the blocks that are all zeroes: in a fresh volume they already read as
+// zeroes, and otherwise they are discarded.
+type sparseBlockWriter struct {
+	f     *block.BlockFile
+	buf   []byte
+	off   int64
+	fresh bool
+	zero  int
+}
+
+func (w *sparseBlockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *sparseBlockWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	switch {
+	case !allZero(w.buf):
+		_, err = w.f.WriteAt(w.buf, w.off)
+	case w.fresh:
+		w.zero++
+	case len(w.buf) == cap(w.buf):
+		w.zero++
+		err = w.f.Trim(w.off, int64(len(w.buf)))
+	default:
+		// A partial block at the end can't be discarded.
+		_, err = w.f.WriteAt(w.buf, w.off)
+	}
+	w.off += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return err
+}
+
+// sparseFileWriter writes to a new file, seeking past runs of zeroes to
+// leave holes.
+type sparseFileWriter struct {
+	f *os.File
+}
+
+func (w *sparseFileWriter) Write(p []byte) (int, error) {
+	if allZero(p) {
+		if _, err := w.f.Seek(int64(len(p)), os.SEEK_CUR); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.f.Write(p)
+}
+
+func allZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var blockStaleAfter time.Duration
+
+var blockLocksCommand = &cobra.Command{
+	Use:   "locks",
+	Short: "list the holders of the block volumes attached for writing",
+	Run:   blockLocksAction,
+}
+
+var blockUnlockCommand = &cobra.Command{
+	Use:   "unlock VOLUME",
+	Short: "take the write lock of a block volume from a holder that stopped heartbeating",
+	Long: `unlock frees a block volume attached for writing by a holder that has gone
+without a heartbeat for --stale-after, such as one on a crashed host, so that it
+can be attached elsewhere. The lease the holder took the lock under is revoked,
+and peers refuse the writes it still makes once the volume's new holder has
+written to them.`,
+	Run: blockUnlockAction,
+}
+
+func init() {
+	blockCommand.AddCommand(blockLocksCommand, blockUnlockCommand)
+	blockUnlockCommand.Flags().DurationVarP(&blockStaleAfter, "stale-after", "", block.DefaultStaleLockAge, "how long the holder must have gone without heartbeating")
+}
+
+type blockLock struct {
+	Volume        string `json:"volume"`
+	UUID          string `json:"uuid"`
+	Host          string `json:"host,omitempty"`
+	PID           int    `json:"pid,omitempty"`
+	Attached      string `json:"attached,omitempty"`
+	LastHeartbeat string `json:"last_heartbeat,omitempty"`
+	Generation    uint64 `json:"generation"`
+
+	attached, lastSeen time.Time
+}
+
+func blockLocksAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	vols, _, err := mds.GetVolumes()
+	if err != nil {
+		die("couldn't get volumes: %v", err)
+	}
+	locks := []blockLock{}
+	for _, vol := range vols {
+		if vol.Type != block.VolumeType {
+			continue
+		}
+		h, seen, err := block.GetBlockVolumeLock(mds, vol.Name)
+		if err == torus.ErrNotExist {
+			// Deleted since we listed it.
+			continue
+		}
+		if err != nil {
+			die("couldn't get the lock of volume %s: %v", vol.Name, err)
+		}
+		if h == nil {
+			continue
+		}
+		locks = append(locks, blockLock{
+			Volume:        vol.Name,
+			UUID:          h.UUID,
+			Host:          h.Host,
+			PID:           h.PID,
+			Attached:      jsonTime(h.Attached),
+			LastHeartbeat: jsonTime(seen),
+			Generation:    h.Generation,
+			attached:      h.Attached,
+			lastSeen:      seen,
+		})
+	}
+	printOutput(locks, func() { printBlockLocks(locks) })
+}
+
+func printBlockLocks(locks []blockLock) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Volume", "Holder", "Host", "PID", "Attached", "Last Heartbeat", "Generation"})
+	for _, l := range locks {
+		pid, attached, seen := "", "", "unknown"
+		if l.PID != 0 {
+			pid = strconv.Itoa(l.PID)
+		}
+		if !l.attached.IsZero() {
+			attached = humanize.Time(l.attached)
+		}
+		if !l.lastSeen.IsZero() {
+			seen = humanize.Time(l.lastSeen)
+		}
+		table.Append([]string{
+			l.Volume,
+			l.UUID,
+			l.Host,
+			pid,
+			attached,
+			seen,
+			strconv.FormatUint(l.Generation, 10),
+		})
+	}
+	table.Render()
+}
+
+func blockUnlockAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	h, err := block.BreakBlockVolumeLock(mds, args[0], blockStaleAfter)
+	if h == nil && err == nil {
+		fmt.Printf("volume %s isn't attached for writing\n", args[0])
+		return
+	}
+	if _, ok := err.(*block.LockedError); ok {
+		die("%v; it is still heartbeating", err)
+	}
+	recordAudit(mds, torus.AuditEvent{
+		Op: torus.AuditBlockUnlock,
+		Details: map[string]string{
+			"volume": args[0],
+			"holder": h.String(),
+		},
+		Err: torus.AuditErr(err),
+	})
+	if err != nil {
+		die("couldn't unlock volume %s: %v", args[0], err)
+	}
+	fmt.Printf("took the lock of volume %s from %s\n", args[0], h)
+}
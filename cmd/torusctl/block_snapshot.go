@@ -3,12 +3,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/block"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -60,6 +62,20 @@ var (
 		},
 	}
 
+	bsnapDiffCommand = &cobra.Command{
+		Use:   "diff VOLUME FROM_SNAPSHOT TO_SNAPSHOT",
+		Short: "list the byte ranges of VOLUME that differ between two snapshots",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := bsnapDiffAction(cmd, args)
+			if err == torus.ErrUsage {
+				cmd.Usage()
+				os.Exit(1)
+			} else if err != nil {
+				die("%v", err)
+			}
+		},
+	}
+
 	bsnapRestoreCommand = &cobra.Command{
 		Use:   "restore VOLUME@SNAPSHOT_NAME",
 		Short: "restore VOLUME to the state it had as of SNAPSHOT_NAME",
@@ -94,7 +110,11 @@ func init() {
 	blockSnapshotCommand.AddCommand(bsnapCreateCommand)
 	blockSnapshotCommand.AddCommand(bsnapDeleteCommand)
 	blockSnapshotCommand.AddCommand(bsnapRestoreCommand)
+	blockSnapshotCommand.AddCommand(bsnapDiffCommand)
 	bsnapListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+	bsnapListCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	bsnapDiffCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+	bsnapDiffCommand.Flags().BoolVarP(&outputAsJSON, "json", "", false, "output as json instead")
 }
 
 func bsnapListAction(cmd *cobra.Command, args []string) error {
@@ -112,21 +132,64 @@ func bsnapListAction(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("couldn't get snapshots for block volume %s: %v", vol, err)
 	}
-	table := NewTableWriter(os.Stdout)
-	table.SetHeader([]string{"Snapshot Name", "Timestamp"})
+	list := snapshotList{
+		Volume:    vol,
+		Snapshots: []snapshotSummary{},
+	}
 	for _, x := range snaps {
+		u, err := blockvol.SnapshotUsage(x.Name)
+		if err != nil {
+			return fmt.Errorf("couldn't get usage of snapshot %s: %v", x.Name, err)
+		}
+		clones := x.Clones
+		if clones == nil {
+			clones = []string{}
+		}
+		list.Snapshots = append(list.Snapshots, snapshotSummary{
+			Name:            x.Name,
+			Timestamp:       jsonTime(x.When),
+			ReferencedBytes: u.UsedBytes,
+			Clones:          clones,
+			when:            x.When,
+		})
+	}
+	printOutput(list, func() { printSnapshotList(list) })
+	return nil
+}
+
+type snapshotSummary struct {
+	Name      string `json:"name"`
+	Timestamp string `json:"timestamp"`
+	// ReferencedBytes is the space taken by the blocks the snapshot
+	// refers to, whether or not the volume still shares them.
+	ReferencedBytes uint64   `json:"referenced_bytes"`
+	Clones          []string `json:"clones"`
+
+	when time.Time
+}
+
+type snapshotList struct {
+	Volume    string            `json:"volume"`
+	Snapshots []snapshotSummary `json:"snapshots"`
+}
+
+func printSnapshotList(list snapshotList) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Snapshot Name", "Timestamp", "Referenced", "Clones"})
+	for _, x := range list.Snapshots {
 		table.Append([]string{
 			x.Name,
-			x.When.Format(time.RFC3339),
+			x.when.Format(time.RFC3339),
+			bytesOrIbytes(x.ReferencedBytes, outputAsSI),
+			strings.Join(x.Clones, ","),
 		})
 	}
 	if !outputAsCSV {
-		fmt.Printf("Volume: %s\n", vol)
+		fmt.Printf("Volume: %s\n", list.Volume)
 		table.Render()
 	} else {
 		table.RenderCSV()
 	}
-	return nil
 }
 
 func bsnapCreateAction(cmd *cobra.Command, args []string) error {
@@ -137,14 +200,9 @@ func bsnapCreateAction(cmd *cobra.Command, args []string) error {
 	if vol.Snapshot == "" {
 		return fmt.Errorf("can't create snapshot without a name, please use the form VOLUME@SNAPSHOT_NAME")
 	}
-	srv := createServer()
-	defer srv.Close()
-	blockvol, err := block.OpenBlockVolume(srv, vol.Volume)
-	if err != nil {
-		return fmt.Errorf("couldn't open block volume %s: %v", vol.Volume, err)
-	}
-	err = blockvol.SaveSnapshot(vol.Snapshot)
-	if err != nil {
+	c := mustConnect()
+	defer c.Close()
+	if err := c.CreateSnapshot(context.Background(), vol.Volume, vol.Snapshot); err != nil {
 		return fmt.Errorf("couldn't snapshot: %v", err)
 	}
 	return nil
@@ -158,14 +216,9 @@ func bsnapDeleteAction(cmd *cobra.Command, args []string) error {
 	if vol.Snapshot == "" {
 		return fmt.Errorf("can't delete a snapshot without a name, please use the form VOLUME@SNAPSHOT_NAME")
 	}
-	srv := createServer()
-	defer srv.Close()
-	blockvol, err := block.OpenBlockVolume(srv, vol.Volume)
-	if err != nil {
-		return fmt.Errorf("couldn't open block volume %s: %v", vol.Volume, err)
-	}
-	err = blockvol.DeleteSnapshot(vol.Snapshot)
-	if err != nil {
+	c := mustConnect()
+	defer c.Close()
+	if err := c.DeleteSnapshot(context.Background(), vol.Volume, vol.Snapshot); err != nil {
 		return fmt.Errorf("couldn't delete snapshot: %v", err)
 	}
 	return nil
@@ -191,3 +244,42 @@ func bsnapRestoreAction(cmd *cobra.Command, args []string) error {
 	}
 	return nil
 }
+
+func bsnapDiffAction(cmd *cobra.Command, args []string) error {
+	if len(args) != 3 {
+		return torus.ErrUsage
+	}
+	vol, from, to := args[0], args[1], args[2]
+	srv := createServer()
+	defer srv.Close()
+	blockvol, err := block.OpenBlockVolume(srv, vol)
+	if err != nil {
+		return fmt.Errorf("couldn't open block volume %s: %v", vol, err)
+	}
+	changed, err := blockvol.DiffSnapshots(from, to)
+	if err != nil {
+		return fmt.Errorf("couldn't diff snapshots %s and %s: %v", from, to, err)
+	}
+	if wantJSON() {
+		if changed == nil {
+			changed = []block.ChangedRange{}
+		}
+		printJSON(changed)
+		return nil
+	}
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Offset", "Length"})
+	for _, x := range changed {
+		table.Append([]string{
+			strconv.FormatUint(x.Offset, 10),
+			strconv.FormatUint(x.Length, 10),
+		})
+	}
+	if outputAsCSV {
+		table.RenderCSV()
+		return nil
+	}
+	fmt.Printf("Volume: %s\n", vol)
+	table.Render()
+	return nil
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/client"
 	"github.com/alternative-storage/torus/distributor"
 	"github.com/alternative-storage/torus/internal/flagconfig"
 
 	// Register all the drivers.
+	_ "github.com/alternative-storage/torus/metadata/consul"
 	_ "github.com/alternative-storage/torus/metadata/etcd"
 	_ "github.com/alternative-storage/torus/storage"
 
@@ -16,22 +19,29 @@ import (
 )
 
 func die(why string, args ...interface{}) {
+	torus.FlushClusterEvents(clusterEventsFlushTimeout)
 	fmt.Fprintf(os.Stderr, why+"\n", args...)
 	os.Exit(1)
 }
 
-func mustConnectToMDS() torus.MetadataService {
-	cfg := flagconfig.BuildConfigFromFlags()
-	mds, err := torus.CreateMetadataService("etcd", cfg)
+// mustConnect connects to the metadata service the flags name. Commands go
+// through the client package for what it covers, so that torusctl and Go
+// programs managing the cluster behave the same.
+func mustConnect() *client.Client {
+	c, err := client.New(flagconfig.BuildConfigFromFlags())
 	if err != nil {
 		die("couldn't connect to etcd: %v", err)
 	}
-	return mds
+	return c
+}
+
+func mustConnectToMDS() torus.MetadataService {
+	return mustConnect().MetadataService()
 }
 
 func createServer() *torus.Server {
 	cfg := flagconfig.BuildConfigFromFlags()
-	srv, err := torus.NewServer(cfg, "etcd", "temp")
+	srv, err := torus.NewServer(cfg, torus.MetadataServiceFor(cfg), "temp")
 	if err != nil {
 		die("couldn't start: %s", err)
 	}
@@ -42,6 +52,25 @@ func createServer() *torus.Server {
 	return srv
 }
 
+// clusterEventsFlushTimeout is how long torusctl waits on exit for the
+// cluster events it recorded to reach the metadata service.
+const clusterEventsFlushTimeout = 2 * time.Second
+
+// recordAudit appends e to the audit log named by --audit-log, if any, and
+// records it in the cluster event log of mds if it succeeded.
+func recordAudit(mds torus.MetadataService, e torus.AuditEvent) {
+	if e.Err == "" {
+		torus.RecordClusterEvent(mds, e)
+	}
+	audit, err := torus.OpenAuditLog(flagconfig.BuildConfigFromFlags().AuditLog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open audit log: %v\n", err)
+		return
+	}
+	defer audit.Close()
+	audit.Record(e)
+}
+
 func bytesOrIbytes(s uint64, si bool) string {
 	if si {
 		return humanize.Bytes(s)
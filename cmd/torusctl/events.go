@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+// eventsPollInterval is how often events --follow reads the log again from
+// a metadata service that can't watch it.
+const eventsPollInterval = 2 * time.Second
+
+var (
+	eventsTypes  []string
+	eventsSince  string
+	eventsUntil  string
+	eventsFollow bool
+)
+
+var eventsCommand = &cobra.Command{
+	Use:   "events",
+	Short: "show the events recorded for the whole cluster",
+	Long: `events lists the events nodes recorded in the metadata service for the whole
+cluster to see, oldest first: peers joining, leaving, being drained, cordoned,
+evicted or resized, ring changes and rollbacks, rebalances starting and finishing,
+garbage collection passes that reclaimed blocks, and volumes being created or
+deleted. Only the most recent 1000 events are kept, for up to a week.
+
+--since and --until take either a time, such as 2017-06-01T12:00:00Z, or a
+duration before now, such as 1h. With --follow, events keeps printing new
+events as they are recorded, until interrupted.`,
+	Run: eventsAction,
+}
+
+func init() {
+	eventsCommand.Flags().StringSliceVarP(&eventsTypes, "type", "t", nil, "only show events of these types, e.g. "+torus.AuditPeerAutoEvict+" (repeatable)")
+	eventsCommand.Flags().StringSliceVarP(&eventsTypes, "op", "", nil, "same as --type")
+	eventsCommand.Flags().MarkHidden("op")
+	eventsCommand.Flags().StringVarP(&eventsSince, "since", "", "", "only show events recorded at or after this time or duration ago")
+	eventsCommand.Flags().StringVarP(&eventsUntil, "until", "", "", "only show events recorded before this time or duration ago")
+	eventsCommand.Flags().BoolVarP(&eventsFollow, "follow", "f", false, "keep printing events as they are recorded")
+}
+
+type eventList struct {
+	Events []torus.AuditEvent `json:"events"`
+}
+
+// eventFilter picks the events events shows.
+type eventFilter struct {
+	types        map[string]bool
+	since, until time.Time
+}
+
+func (f eventFilter) match(e torus.AuditEvent) bool {
+	if len(f.types) != 0 && !f.types[e.Op] {
+		return false
+	}
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !e.Time.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// parseEventTime parses the --since and --until flags, as an RFC 3339 time
+// or a duration before now.
+func parseEventTime(flag, s string, now time.Time) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		die("--%s takes a time such as 2017-06-01T12:00:00Z or a duration such as 1h, not %q", flag, s)
+	}
+	return now.Add(-d)
+}
+
+func eventsAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	now := time.Now()
+	f := eventFilter{
+		since: parseEventTime("since", eventsSince, now),
+		until: parseEventTime("until", eventsUntil, now),
+	}
+	if len(eventsTypes) != 0 {
+		f.types = make(map[string]bool)
+		for _, t := range eventsTypes {
+			f.types[t] = true
+		}
+	}
+	mds := mustConnectToMDS()
+	el, ok := mds.(torus.ClusterEventLog)
+	if !ok {
+		die("metadata service doesn't keep cluster events")
+	}
+	if eventsFollow {
+		followEvents(mds, el, f)
+		return
+	}
+	events, err := el.GetClusterEvents()
+	if err != nil {
+		die("couldn't get cluster events: %v", err)
+	}
+	list := eventList{Events: []torus.AuditEvent{}}
+	for _, e := range events {
+		if f.match(e) {
+			list.Events = append(list.Events, e)
+		}
+	}
+	printOutput(list, func() { printEventList(list) })
+}
+
+// followEvents prints the events of el matching f, then those recorded after
+// them as they are, one per line, until interrupted or past f.until.
+func followEvents(mds torus.MetadataService, el torus.ClusterEventLog, f eventFilter) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Watch before reading the log, so that nothing recorded in between is
+	// missed; what is both read and watched is skipped by its Seq.
+	var watch <-chan torus.AuditEvent
+	if w, ok := mds.(torus.ClusterEventWatcher); ok {
+		watch = w.WatchClusterEvents(ctx)
+	}
+	var last uint64
+	show := func(e torus.AuditEvent) bool {
+		if e.Seq <= last {
+			return true
+		}
+		last = e.Seq
+		if !f.until.IsZero() && !e.Time.Before(f.until) {
+			return false
+		}
+		if f.match(e) {
+			printEventLine(e)
+		}
+		return true
+	}
+	poll := func() bool {
+		events, err := el.GetClusterEvents()
+		if err != nil {
+			die("couldn't get cluster events: %v", err)
+		}
+		sort.Sort(eventsBySeq(events))
+		for _, e := range events {
+			if !show(e) {
+				return false
+			}
+		}
+		return true
+	}
+	if !poll() {
+		return
+	}
+	for {
+		select {
+		case e, ok := <-watch:
+			if !ok {
+				return
+			}
+			if !show(e) {
+				return
+			}
+		case <-pollTick(watch):
+			if !poll() {
+				return
+			}
+		}
+	}
+}
+
+// pollTick times the next read of the log when there is no watch to follow
+// it with.
+func pollTick(watch <-chan torus.AuditEvent) <-chan time.Time {
+	if watch != nil {
+		return nil
+	}
+	return time.After(eventsPollInterval)
+}
+
+type eventsBySeq []torus.AuditEvent
+
+func (s eventsBySeq) Len() int           { return len(s) }
+func (s eventsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s eventsBySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+
+// printEventLine prints e as it is followed: as a line of JSON, or a line
+// of text.
+func printEventLine(e torus.AuditEvent) {
+	if wantJSON() {
+		b, err := json.Marshal(e)
+		if err != nil {
+			die("error encoding json: %v", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	line := []string{e.Time.Local().Format(time.RFC3339), e.Op}
+	if e.Node != "" {
+		line = append(line, "node="+e.Node)
+	}
+	if e.Source != "" && e.Source != e.Node {
+		line = append(line, "source="+e.Source)
+	}
+	if details := eventDetails(e); details != "" {
+		line = append(line, details)
+	}
+	fmt.Println(strings.Join(line, " "))
+}
+
+func eventDetails(e torus.AuditEvent) string {
+	var details []string
+	for k, v := range e.Details {
+		details = append(details, k+"="+v)
+	}
+	sort.Strings(details)
+	return strings.Join(details, " ")
+}
+
+func printEventList(list eventList) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Seq", "Time", "Op", "Node", "Source", "Details", "Error"})
+	for _, e := range list.Events {
+		table.Append([]string{
+			strconv.FormatUint(e.Seq, 10),
+			humanize.Time(e.Time),
+			e.Op,
+			e.Node,
+			e.Source,
+			eventDetails(e),
+			e.Err,
+		})
+	}
+	table.Render()
+}
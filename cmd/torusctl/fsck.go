@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/distributor"
+	"github.com/alternative-storage/torus/internal/flagconfig"
+	"github.com/alternative-storage/torus/metadata"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var (
+	fsckDataDirs    []string
+	fsckBlockDevice string
+	fsckRepair      bool
+)
+
+var fsckCommand = &cobra.Command{
+	Use:   "fsck",
+	Short: "check the local storage of a stopped node against the metadata",
+	Long: `fsck opens the storage of a node, which must not be running, and compares the
+blocks in it with those the ring places on the node. It reports blocks that are
+missing from the storage, blocks that no volume references any more, and blocks
+that can't be read or don't match their checksums.
+
+Nothing is changed unless --repair is given, in which case missing and corrupt
+blocks are fetched again from other replicas and unreferenced blocks are
+deleted.`,
+	Run: fsckAction,
+}
+
+func init() {
+	fsckCommand.Flags().StringSliceVarP(&fsckDataDirs, "data-dir", "", []string{"torus-data"}, "data directory of the node to check, as given to torusd (repeatable)")
+	fsckCommand.Flags().StringVarP(&fsckBlockDevice, "block-device", "", "", "block device of the node to check, if it stores its blocks on one")
+	fsckCommand.Flags().BoolVarP(&fsckRepair, "repair", "", false, "refetch missing and corrupt blocks and delete unreferenced ones")
+}
+
+type fsckResult struct {
+	UUID      string            `json:"uuid"`
+	Repaired  bool              `json:"repaired"`
+	Expected  int               `json:"expected"`
+	Stored    int               `json:"stored"`
+	Missing   []string          `json:"missing"`
+	Orphaned  []string          `json:"orphaned"`
+	Corrupt   []string          `json:"corrupt"`
+	Refetched int               `json:"refetched"`
+	Deleted   int               `json:"deleted"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+func fsckAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	if len(fsckDataDirs) == 0 {
+		die("at least one data-dir is needed")
+	}
+	metaDir := fsckDataDirs[0]
+	if _, err := os.Stat(filepath.Join(metaDir, "metadata", "uuid")); err != nil {
+		die("%s is not the data directory of a node: %v", metaDir, err)
+	}
+	uuid, err := metadata.GetUUID(metaDir)
+	if err != nil {
+		die("couldn't read the UUID of the node: %v", err)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+	local, err := openLocalStorage(srv.MDS.GlobalMetadata())
+	if err != nil {
+		die("couldn't open the storage of the node: %v", err)
+	}
+	defer local.Close()
+
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		die("error listing volumes: %v", err)
+	}
+	var refs []torus.BlockRef
+	sums := make(map[torus.BlockRef]uint32)
+	for _, v := range vols {
+		if v.Type != block.VolumeType {
+			continue
+		}
+		vol, err := block.OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			die("couldn't open block volume %s: %v", v.Name, err)
+		}
+		vrefs, err := vol.ReferencedBlocks()
+		if err != nil {
+			die("couldn't read block map of volume %s: %v", v.Name, err)
+		}
+		refs = append(refs, vrefs...)
+		vsums, err := vol.BlockChecksums()
+		if err != nil {
+			die("couldn't read checksums of volume %s: %v", v.Name, err)
+		}
+		for ref, sum := range vsums {
+			sums[ref] = sum
+		}
+	}
+
+	report, err := distributor.Fsck(context.Background(), srv, local, uuid, refs, sums, fsckRepair)
+	if err != nil {
+		die("couldn't check the storage of the node: %v", err)
+	}
+	res := fsckResult{
+		UUID:      uuid,
+		Repaired:  fsckRepair,
+		Expected:  report.Expected,
+		Stored:    report.Stored,
+		Missing:   refStrings(report.Missing),
+		Orphaned:  refStrings(report.Orphaned),
+		Corrupt:   refStrings(report.Corrupt),
+		Refetched: report.Refetched,
+		Deleted:   report.Deleted,
+	}
+	if len(report.Failed) != 0 {
+		res.Failed = make(map[string]string)
+		for ref, err := range report.Failed {
+			res.Failed[ref.String()] = err.Error()
+		}
+	}
+	if fsckRepair {
+		recordAudit(srv.MDS, torus.AuditEvent{
+			Op: torus.AuditFsckRepair,
+			Details: map[string]string{
+				"peer":      uuid,
+				"refetched": strconv.Itoa(report.Refetched),
+				"deleted":   strconv.Itoa(report.Deleted),
+				"failed":    strconv.Itoa(len(report.Failed)),
+			},
+		})
+	}
+	printOutput(res, func() { printFsckResult(res) })
+	if len(res.Failed) != 0 || (!fsckRepair && len(res.Missing)+len(res.Orphaned)+len(res.Corrupt) != 0) {
+		os.Exit(1)
+	}
+}
+
+// openLocalStorage opens the block store of the node being checked as it
+// is, without creating or resizing it. Data directories whose storage can't
+// be found are left out, so that their blocks are reported missing.
+func openLocalStorage(gmd torus.GlobalMetadata) (torus.BlockStore, error) {
+	cfg := flagconfig.BuildConfigFromFlags()
+	if fsckBlockDevice != "" {
+		cfg.DataDir = fsckDataDirs[:1]
+		cfg.BlockDevice = fsckBlockDevice
+		return torus.CreateBlockStore("block_device", "current", cfg, gmd)
+	}
+	for _, dir := range fsckDataDirs {
+		fi, err := os.Stat(filepath.Join(dir, "block", "data-current.blk"))
+		if err != nil {
+			if len(fsckDataDirs) == 1 {
+				return nil, err
+			}
+			fmt.Fprintf(os.Stderr, "leaving out %s: %v\n", dir, err)
+			continue
+		}
+		cfg.DataDir = append(cfg.DataDir, dir)
+		cfg.DataDirSizes = append(cfg.DataDirSizes, uint64(fi.Size()))
+		cfg.StorageSize += uint64(fi.Size())
+	}
+	if len(cfg.DataDir) == 0 {
+		return nil, errors.New("none of the data directories hold any storage")
+	}
+	return torus.CreateBlockStore("mfile", "current", cfg, gmd)
+}
+
+func refStrings(refs []torus.BlockRef) []string {
+	out := make([]string, len(refs))
+	for i, ref := range refs {
+		out[i] = ref.String()
+	}
+	sort.Strings(out)
+	return out
+}
+
+func printFsckResult(res fsckResult) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Expected", "Stored", "Missing", "Orphaned", "Corrupt"})
+	table.Append([]string{
+		strconv.Itoa(res.Expected),
+		strconv.Itoa(res.Stored),
+		strconv.Itoa(len(res.Missing)),
+		strconv.Itoa(len(res.Orphaned)),
+		strconv.Itoa(len(res.Corrupt)),
+	})
+	table.Render()
+	for _, c := range []struct {
+		name string
+		refs []string
+	}{
+		{"missing", res.Missing},
+		{"orphaned", res.Orphaned},
+		{"corrupt", res.Corrupt},
+	} {
+		for _, ref := range c.refs {
+			fmt.Printf("%s\t%s\n", c.name, ref)
+		}
+	}
+	if !res.Repaired {
+		if len(res.Missing)+len(res.Orphaned)+len(res.Corrupt) != 0 {
+			fmt.Println("\nNothing was changed; run with --repair to fix these.")
+		}
+		return
+	}
+	fmt.Printf("\nRefetched %d blocks and deleted %d.\n", res.Refetched, res.Deleted)
+	for ref, err := range res.Failed {
+		fmt.Fprintf(os.Stderr, "couldn't repair %s: %s\n", ref, err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/client"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var gcCommand = &cobra.Command{
+	Use:   "gc",
+	Short: "inspect and control garbage collection of dead blocks",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+		os.Exit(1)
+	},
+}
+
+var gcStatusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "show the GC settings and what each node's last GC pass did",
+	Long: `status prints the cluster's GC settings, then lists, for each node that has
+finished a GC pass, when it finished, the local blocks it examined, and the
+dead blocks it reclaimed or, outside the GC window, left for later.`,
+	Run: gcStatusAction,
+}
+
+var gcRunCommand = &cobra.Command{
+	Use:   "run",
+	Short: "have every node start a GC pass now, inside the window or not",
+	Long: `run asks every node to start a GC pass at once. The pass deletes the dead
+blocks it finds even outside the GC window, though still no faster than the
+rate limit. A node with rebalancing paused starts the pass once resumed.`,
+	Run: gcRunAction,
+}
+
+var gcWindowCommand = &cobra.Command{
+	Use:   "window HH:MM-HH:MM|always",
+	Short: "delete dead blocks only between these times, local to each node",
+	Long: `window sets the time of day during which nodes delete the dead blocks they
+find, such as 01:00-05:00, in each node's local time. A window ending before it
+starts wraps past midnight. Dead blocks found outside the window are left until
+a later pass. "always" removes the window.`,
+	Run: gcWindowAction,
+}
+
+var gcLimitCommand = &cobra.Command{
+	Use:   "limit RATE",
+	Short: "limit the bytes per second of dead blocks each peer deletes (0 for unlimited)",
+	Run:   gcLimitAction,
+}
+
+func init() {
+	gcCommand.AddCommand(gcStatusCommand, gcRunCommand, gcWindowCommand, gcLimitCommand)
+	gcStatusCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+}
+
+type gcNode struct {
+	UUID            string `json:"uuid"`
+	Address         string `json:"address,omitempty"`
+	LastPass        string `json:"last_pass"`
+	BlocksExamined  uint64 `json:"blocks_examined"`
+	BlocksReclaimed uint64 `json:"blocks_reclaimed"`
+	BytesFreed      uint64 `json:"bytes_freed"`
+	BlocksDeferred  uint64 `json:"blocks_deferred"`
+	OrphanedINodes  uint64 `json:"orphaned_inodes"`
+	Forced          bool   `json:"forced"`
+
+	lastPass time.Time
+}
+
+type gcList struct {
+	Window       string   `json:"window"`
+	RateLimit    uint64   `json:"rate_limit"`
+	RunRequested string   `json:"run_requested,omitempty"`
+	Nodes        []gcNode `json:"nodes"`
+
+	runRequested time.Time
+}
+
+func mustGCController(mds torus.MetadataService) torus.GCController {
+	gc, ok := mds.(torus.GCController)
+	if !ok {
+		die("metadata service doesn't support gc settings")
+	}
+	return gc
+}
+
+func gcStatusAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	gc := mustGCController(mds)
+	gs, err := gc.GetGCSettings()
+	if err != nil {
+		die("couldn't get gc settings: %v", err)
+	}
+	statuses, err := gc.GetGCStatuses()
+	if err != nil {
+		die("couldn't get gc status: %v", err)
+	}
+	peers, err := mds.GetPeers()
+	if err != nil {
+		die("couldn't get peers: %v", err)
+	}
+	addrs := make(map[string]string)
+	for _, p := range peers {
+		addrs[p.UUID] = p.Address
+	}
+	list := gcList{
+		Window:       gs.Window(),
+		RateLimit:    gs.RateLimit,
+		RunRequested: jsonTime(gs.RunRequested),
+		Nodes:        []gcNode{},
+		runRequested: gs.RunRequested,
+	}
+	for _, s := range statuses {
+		list.Nodes = append(list.Nodes, gcNode{
+			UUID:            s.UUID,
+			Address:         addrs[s.UUID],
+			LastPass:        jsonTime(s.LastPass),
+			BlocksExamined:  s.BlocksExamined,
+			BlocksReclaimed: s.BlocksReclaimed,
+			BytesFreed:      s.BytesFreed,
+			BlocksDeferred:  s.BlocksDeferred,
+			OrphanedINodes:  s.OrphanedINodes,
+			Forced:          s.Forced,
+			lastPass:        s.LastPass,
+		})
+	}
+	sort.Sort(gcNodesByUUID(list.Nodes))
+	printOutput(list, func() { printGCList(list) })
+}
+
+type gcNodesByUUID []gcNode
+
+func (s gcNodesByUUID) Len() int           { return len(s) }
+func (s gcNodesByUUID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s gcNodesByUUID) Less(i, j int) bool { return s[i].UUID < s[j].UUID }
+
+func printGCList(list gcList) {
+	limit := "unlimited"
+	if list.RateLimit != 0 {
+		limit = bytesOrIbytes(list.RateLimit, outputAsSI) + "/sec"
+	}
+	fmt.Printf("Window: %s\nRate limit: %s\n", list.Window, limit)
+	if !list.runRequested.IsZero() {
+		fmt.Printf("Last run requested: %s\n", humanize.Time(list.runRequested))
+	}
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"UUID", "Address", "Last Pass", "Examined", "Reclaimed", "Freed", "Deferred", "Orphaned INodes"})
+	for _, n := range list.Nodes {
+		last := "never"
+		if !n.lastPass.IsZero() {
+			last = humanize.Time(n.lastPass)
+			if n.Forced {
+				last += " (requested)"
+			}
+		}
+		table.Append([]string{
+			n.UUID,
+			n.Address,
+			last,
+			strconv.FormatUint(n.BlocksExamined, 10),
+			strconv.FormatUint(n.BlocksReclaimed, 10),
+			bytesOrIbytes(n.BytesFreed, outputAsSI),
+			strconv.FormatUint(n.BlocksDeferred, 10),
+			strconv.FormatUint(n.OrphanedINodes, 10),
+		})
+	}
+	table.Render()
+}
+
+// changeGCSettings applies change to the current settings, and records it as
+// op in the audit log.
+func changeGCSettings(op string, details map[string]string, change func(*torus.GCSettings)) {
+	mds := mustConnectToMDS()
+	gc := mustGCController(mds)
+	gs, err := gc.GetGCSettings()
+	if err != nil {
+		die("couldn't get gc settings: %v", err)
+	}
+	change(&gs)
+	err = gc.SetGCSettings(gs)
+	recordAudit(mds, torus.AuditEvent{
+		Op:      op,
+		Details: details,
+		Err:     torus.AuditErr(err),
+	})
+	if err != nil {
+		die("couldn't set gc settings: %v", err)
+	}
+}
+
+func gcRunAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	changeGCSettings(torus.AuditGCRun, nil, func(gs *torus.GCSettings) {
+		gs.RunRequested = time.Now().UTC()
+	})
+}
+
+// requestReclaim has every node start a GC pass at once, to reclaim the
+// blocks of deleted volume name. If it can't, they go in a later pass.
+func requestReclaim(c *client.Client, name string) {
+	err := c.RequestReclaim(context.Background())
+	if err == torus.ErrNotSupported {
+		return
+	}
+	recordAudit(c.MetadataService(), torus.AuditEvent{
+		Op:      torus.AuditGCRun,
+		Details: map[string]string{"volume": name},
+		Err:     torus.AuditErr(err),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't start a gc run, the blocks of %s will be reclaimed by the next pass: %v\n", name, err)
+	}
+}
+
+func gcWindowAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	var start, end string
+	if args[0] != "always" {
+		var err error
+		start, end, err = torus.ParseGCWindow(args[0])
+		if err != nil {
+			die("%v", err)
+		}
+	}
+	details := map[string]string{"window": args[0]}
+	changeGCSettings(torus.AuditGCSettings, details, func(gs *torus.GCSettings) {
+		gs.WindowStart = start
+		gs.WindowEnd = end
+	})
+}
+
+func gcLimitAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	rate, err := humanize.ParseBytes(args[0])
+	if err != nil {
+		die("invalid rate %q: %v", args[0], err)
+	}
+	details := map[string]string{"rate_limit": strconv.FormatUint(rate, 10)}
+	changeGCSettings(torus.AuditGCSettings, details, func(gs *torus.GCSettings) {
+		gs.RateLimit = rate
+	})
+}
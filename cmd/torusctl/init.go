@@ -19,6 +19,9 @@ var (
 	blockSize    uint64
 	blockSizeStr string
 	blockSpec    string
+	ketamaVNodes int
+	initRingName string
+	initRingType torus.RingType
 	noMakeRing   bool
 	metaView     bool
 )
@@ -33,6 +36,8 @@ var initCommand = &cobra.Command{
 func init() {
 	initCommand.Flags().StringVarP(&blockSizeStr, "block-size", "", "512KiB", "size of all data blocks in this storage cluster")
 	initCommand.Flags().StringVarP(&blockSpec, "block-spec", "", "crc", "default replication/error correction applied to blocks in this storage cluster")
+	initCommand.Flags().IntVar(&ketamaVNodes, "ketama-vnodes", 0, "virtual nodes per peer on ketama rings (0 uses the default)")
+	initCommand.Flags().StringVar(&initRingName, "ring-type", "ketama", "type of ring the cluster uses ("+strings.Join(ring.InitTypes(), ", ")+")")
 	initCommand.Flags().BoolVar(&noMakeRing, "no-ring", false, "do not create the default ring as part of init")
 	initCommand.Flags().BoolVar(&metaView, "view", false, "view metadata configured in this storage cluster")
 }
@@ -51,23 +56,33 @@ func initPreRun(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("error parsing block-size: %v", err)
 	}
+	if err = ring.ValidateVNodes(ketamaVNodes); err != nil {
+		die("error parsing ketama-vnodes: %v", err)
+	}
+	initRingType, err = ring.InitTypeFromString(initRingName)
+	if err != nil {
+		die("error parsing ring-type: %v", err)
+	}
 }
 
 func initAction(cmd *cobra.Command, args []string) {
 	var err error
 	md := torus.GlobalMetadata{}
 	md.BlockSize = blockSize
+	md.KetamaVNodes = ketamaVNodes
+	md.RingType = initRingName
 	md.DefaultBlockSpec, err = blockset.ParseBlockLayerSpec(blockSpec)
 	if err != nil {
 		die("error parsing block-spec: %v", err)
 	}
 
 	cfg := flagconfig.BuildConfigFromFlags()
-	ringType := ring.Ketama
+	md.PeerTimeout = cfg.PeerTimeout
+	ringType := initRingType
 	if noMakeRing {
 		ringType = ring.Empty
 	}
-	err = torus.InitMDS("etcd", cfg, md, ringType)
+	err = torus.InitMDS(torus.MetadataServiceFor(cfg), cfg, md, ringType)
 	if err != nil {
 		die("error writing metadata: %v", err)
 	}
@@ -77,15 +92,13 @@ func viewMetadata() {
 	mds := mustConnectToMDS()
 	md := mds.GlobalMetadata()
 
-	var blockSpecToStrings = []string{
-		blockset.Base:        "base",
-		blockset.CRC:         "crc",
-		blockset.Replication: "rep",
+	fmt.Printf("Block size: %d byte\n", md.BlockSize)
+	fmt.Printf("Block spec: %s\n", blockset.FormatBlockLayerSpec(md.DefaultBlockSpec))
+	if md.RingType != "" {
+		fmt.Printf("Ring type: %s\n", md.RingType)
 	}
-	blockSpec := ""
-	for _, x := range md.DefaultBlockSpec {
-		blockSpec += blockSpecToStrings[x.Kind] + " "
+	if md.KetamaVNodes != 0 {
+		fmt.Printf("Ketama vnodes: %d\n", md.KetamaVNodes)
 	}
-	fmt.Printf("Block size: %d byte\n", md.BlockSize)
-	fmt.Printf("Block spec: %s\n", blockSpec)
+	fmt.Printf("Peer timeout: %s\n", md.PeerTimeoutOrDefault())
 }
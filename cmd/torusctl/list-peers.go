@@ -5,13 +5,16 @@ import (
 	"os"
 	"time"
 
+	"github.com/alternative-storage/torus"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var (
-	outputAsCSV bool
-	outputAsSI  bool
+	outputAsCSV  bool
+	outputAsSI   bool
+	outputAsJSON bool
 )
 
 var listPeersCommand = &cobra.Command{
@@ -25,50 +28,152 @@ func init() {
 	listPeersCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
 }
 
-func listPeersAction(cmd *cobra.Command, args []string) {
-	var totalStorage uint64
-	var usedStorage uint64
+type peerSummary struct {
+	UUID    string `json:"uuid"`
+	Address string `json:"address"`
+	// Member is OK for peers in the ring, Witness for those in it that
+	// store nothing, Cordoned for those cordoned for maintenance, Draining
+	// for those being drained, Read-only for those too full to take new
+	// blocks, Avail for those out of it, Late for
+	// those in it that haven't heartbeated within the cluster's peer
+	// timeout but are still registered, and DOWN for those in it that
+	// haven't been seen.
+	Member string `json:"member"`
+	// ReadOnly is set for peers too full to take new blocks, in the ring
+	// or not.
+	ReadOnly    bool              `json:"read_only"`
+	TotalBytes  uint64            `json:"total_bytes"`
+	UsedBytes   uint64            `json:"used_bytes"`
+	FreeBytes   uint64            `json:"free_bytes"`
+	LastSeen    string            `json:"last_seen,omitempty"`
+	Zone        string            `json:"zone,omitempty"`
+	Rack        string            `json:"rack,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Rebalancing bool              `json:"rebalancing"`
+	// RebalanceRate is the rate, in bytes per second, the peer moved
+	// blocks at during its last rebalance.
+	RebalanceRate uint64 `json:"rebalance_rate"`
+	// ProtocolVersion is the version of the peer protocol the peer
+	// advertises, which differs between peers during a rolling upgrade.
+	ProtocolVersion uint64 `json:"protocol_version,omitempty"`
+	// Version is the torus release the peer runs. Peers from before it was
+	// advertised, and builds without one, leave it empty.
+	Version string `json:"version,omitempty"`
+	// LastSeenUnixNano is the time of the peer's last heartbeat, in Unix
+	// nanoseconds.
+	LastSeenUnixNano int64 `json:"last_seen_unix_nano,omitempty"`
+	// Stale is set for peers that haven't heartbeated within the cluster's
+	// peer timeout, in the ring or not.
+	Stale bool `json:"stale"`
+	// CircuitOpenOn lists the peers that have stopped sending requests to
+	// this one because too many of them failed.
+	CircuitOpenOn []string `json:"circuit_open_on,omitempty"`
+	// CordonedSince is set for peers cordoned for maintenance, up or
+	// down.
+	CordonedSince string `json:"cordoned_since,omitempty"`
+	CordonReason  string `json:"cordon_reason,omitempty"`
+
+	lastSeen    time.Time
+	cordonSince time.Time
+}
+
+type peerList struct {
+	Peers      []peerSummary `json:"peers"`
+	Balanced   bool          `json:"balanced"`
+	TotalBytes uint64        `json:"total_bytes"`
+	UsedBytes  uint64        `json:"used_bytes"`
+	// MixedVersions is set when peers advertise different versions of the
+	// peer protocol.
+	MixedVersions bool `json:"mixed_versions"`
+}
 
-	mds := mustConnectToMDS()
-	gmd := mds.GlobalMetadata()
-	peers, err := mds.GetPeers()
+func listPeersAction(cmd *cobra.Command, args []string) {
+	c := mustConnect()
+	mds := c.MetadataService()
+	gmd := c.GlobalMetadata()
+	peers, err := c.ListPeers(context.Background())
 	if err != nil {
 		die("couldn't get peers: %v", err)
 	}
-	ring, err := mds.GetRing()
+	ring, err := c.GetRing(context.Background())
 	if err != nil {
 		die("couldn't get ring: %v", err)
 	}
 	members := ring.Members()
-	table := NewTableWriter(os.Stdout)
-	table.SetHeader([]string{"Address", "UUID", "Size", "Used", "Member", "Updated", "Reb/Rep Data"})
-	rebalancing := false
+	timeout := gmd.PeerTimeoutOrDefault()
+	var draining torus.PeerList
+	if rd, ok := ring.(torus.RingDrainer); ok {
+		draining = rd.Draining()
+	}
+	cordons, err := torus.GetCordons(mds)
+	if err != nil {
+		die("couldn't get cordons: %v", err)
+	}
+	cordoned := make(map[string]torus.Cordon)
+	for _, c := range cordons {
+		cordoned[c.UUID] = c
+	}
+	list := peerList{
+		Peers:    []peerSummary{},
+		Balanced: true,
+	}
 	for _, x := range peers {
 		ringStatus := "Avail"
 		if x.Address == "" {
 			continue
 		}
+		stale := time.Since(time.Unix(0, x.LastSeen)) > timeout
 		if members.Has(x.UUID) {
 			ringStatus = "OK"
+			if stale {
+				ringStatus = "Late"
+			} else if x.TotalBlocks == 0 {
+				ringStatus = "Witness"
+			} else if _, ok := cordoned[x.UUID]; ok {
+				ringStatus = "Cordoned"
+			} else if draining.Has(x.UUID) {
+				ringStatus = "Draining"
+			} else if x.ReadOnly {
+				ringStatus = "Read-only"
+			}
 		}
-		table.Append([]string{
-			x.Address,
-			x.UUID,
-			bytesOrIbytes(x.TotalBlocks*gmd.BlockSize, outputAsSI),
-			bytesOrIbytes(x.UsedBlocks*gmd.BlockSize, outputAsSI),
-			ringStatus,
-			humanize.Time(time.Unix(0, x.LastSeen)),
-			bytesOrIbytes(x.RebalanceInfo.LastRebalanceBlocks*gmd.BlockSize*uint64(time.Second)/uint64(x.LastSeen+1-x.RebalanceInfo.LastRebalanceFinish), outputAsSI) + "/sec",
-		})
-		if x.RebalanceInfo.Rebalancing {
-			rebalancing = true
+		p := peerSummary{
+			UUID:       x.UUID,
+			Address:    x.Address,
+			Member:     ringStatus,
+			ReadOnly:   x.ReadOnly,
+			TotalBytes: x.TotalBlocks * gmd.BlockSize,
+			UsedBytes:  x.UsedBlocks * gmd.BlockSize,
+			LastSeen:   jsonTime(time.Unix(0, x.LastSeen)),
+			lastSeen:   time.Unix(0, x.LastSeen),
+			Stale:      stale,
+			Zone:       x.Zone,
+			Rack:       x.Rack,
+			Labels:     x.Labels,
+
+			LastSeenUnixNano: x.LastSeen,
+			ProtocolVersion:  x.ProtocolVersion,
+			Version:          x.Version,
+		}
+		if x.TotalBlocks > x.UsedBlocks {
+			p.FreeBytes = (x.TotalBlocks - x.UsedBlocks) * gmd.BlockSize
+		}
+		if x.RebalanceInfo != nil {
+			p.Rebalancing = x.RebalanceInfo.Rebalancing
+			p.RebalanceRate = x.RebalanceInfo.LastRebalanceBlocks * gmd.BlockSize * uint64(time.Second) / uint64(x.LastSeen+1-x.RebalanceInfo.LastRebalanceFinish)
+		}
+		if p.Rebalancing {
+			list.Balanced = false
+		}
+		if len(list.Peers) != 0 && p.ProtocolVersion != list.Peers[0].ProtocolVersion {
+			list.MixedVersions = true
 		}
-		totalStorage += x.TotalBlocks * gmd.BlockSize
-		usedStorage += x.UsedBlocks * gmd.BlockSize
+		list.TotalBytes += p.TotalBytes
+		list.UsedBytes += p.UsedBytes
+		list.Peers = append(list.Peers, p)
 	}
 
 	for _, x := range members {
-		ringStatus := "DOWN"
 		ok := false
 		for _, p := range peers {
 			if p.UUID == x {
@@ -79,20 +184,92 @@ func listPeersAction(cmd *cobra.Command, args []string) {
 		if ok {
 			continue
 		}
+		list.Peers = append(list.Peers, peerSummary{
+			UUID:   x,
+			Member: "DOWN",
+		})
+	}
+
+	openOn := make(map[string][]string)
+	for _, x := range peers {
+		for _, p := range x.OpenCircuits {
+			openOn[p] = append(openOn[p], x.UUID)
+		}
+	}
+	for i := range list.Peers {
+		p := &list.Peers[i]
+		p.CircuitOpenOn = openOn[p.UUID]
+		if c, ok := cordoned[p.UUID]; ok {
+			p.CordonedSince = jsonTime(c.Since)
+			p.CordonReason = c.Reason
+			p.cordonSince = c.Since
+		}
+	}
+	printOutput(list, func() { printPeerList(list) })
+}
+
+func printPeerList(list peerList) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Address", "UUID", "Size", "Used", "Free", "Member", "Updated", "Reb/Rep Data", "Version", "Proto"})
+	for _, p := range list.Peers {
+		if p.Member == "DOWN" {
+			table.Append([]string{
+				"",
+				p.UUID,
+				"???",
+				"???",
+				"???",
+				p.Member,
+				"Missing",
+				"",
+				"",
+				"",
+			})
+			continue
+		}
+		updated := humanize.Time(p.lastSeen)
+		if p.Stale {
+			updated += " (stale)"
+		}
+		version := p.Version
+		if version == "" {
+			version = "-"
+		}
 		table.Append([]string{
-			"",
-			x,
-			"???",
-			"???",
-			ringStatus,
-			"Missing",
-			"",
+			p.Address,
+			p.UUID,
+			bytesOrIbytes(p.TotalBytes, outputAsSI),
+			bytesOrIbytes(p.UsedBytes, outputAsSI),
+			bytesOrIbytes(p.FreeBytes, outputAsSI),
+			p.Member,
+			updated,
+			bytesOrIbytes(p.RebalanceRate, outputAsSI) + "/sec",
+			version,
+			fmt.Sprintf("v%d", p.ProtocolVersion),
 		})
 	}
 	if outputAsCSV {
 		table.RenderCSV()
 	} else {
 		table.Render()
-		fmt.Printf("Balanced: %v Usage: %5.2f%%\n", !rebalancing, (float64(usedStorage) / float64(totalStorage) * 100.0))
+		fmt.Printf("Balanced: %v Usage: %5.2f%%\n", list.Balanced, (float64(list.UsedBytes) / float64(list.TotalBytes) * 100.0))
+		if list.MixedVersions {
+			fmt.Println("NOTE: peers speak different protocol versions; finish the rolling upgrade to use the newest")
+		}
+		for _, p := range list.Peers {
+			if p.ReadOnly {
+				fmt.Printf("WARNING: %s (%s) is out of space and takes no new blocks\n", p.UUID, p.Address)
+			}
+			if p.CordonedSince != "" {
+				reason := ""
+				if p.CordonReason != "" {
+					reason = ": " + p.CordonReason
+				}
+				fmt.Printf("NOTE: %s was cordoned %s and takes no new blocks%s\n", p.UUID, humanize.Time(p.cordonSince), reason)
+			}
+			if len(p.CircuitOpenOn) != 0 {
+				fmt.Printf("WARNING: %s (%s) is failing requests; %d peers have stopped sending it any\n", p.UUID, p.Address, len(p.CircuitOpenOn))
+			}
+		}
 	}
 }
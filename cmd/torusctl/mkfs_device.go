@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/alternative-storage/torus/cmd/mkfs.torus/lib"
+	blockDevice "github.com/alternative-storage/torus/storage/block_device"
+)
+
+var (
+	mkfsBlockSizeStr string
+	mkfsWipe         bool
+)
+
+var mkfsDeviceCommand = &cobra.Command{
+	Use:   "mkfs-device DEVICE",
+	Short: "format a block device for torusd --block-device",
+	Long: `mkfs-device writes a torus superblock to DEVICE and clears the block headers
+after it, so torusd can store blocks on it with --block-device. The superblock
+records its format version, the cluster block size, the size of the device,
+when it was formatted and, unless --block-size is given, the ID of the
+cluster of the metadata service, whose block size is used.
+
+The device must be blank, as a new disk is. A device formatted for torus
+already is only formatted again with --wipe, which destroys the blocks it
+holds. Devices holding anything else are refused.`,
+	Run: mkfsDeviceAction,
+}
+
+func init() {
+	mkfsDeviceCommand.Flags().StringVarP(&mkfsBlockSizeStr, "block-size", "", "", "cluster block size to format for, such as 512KiB, instead of asking the metadata service")
+	mkfsDeviceCommand.Flags().BoolVarP(&mkfsWipe, "wipe", "", false, "format a device already formatted for torus again, destroying its blocks")
+}
+
+type mkfsDeviceResult struct {
+	Device        string    `json:"device"`
+	FormatVersion uint32    `json:"format_version"`
+	BlockSize     uint64    `json:"block_size"`
+	Capacity      uint64    `json:"capacity"`
+	Blocks        uint64    `json:"blocks"`
+	ClusterID     string    `json:"cluster_id,omitempty"`
+	Formatted     time.Time `json:"formatted"`
+}
+
+func mkfsDeviceAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	device := args[0]
+	var (
+		blockSize uint64
+		clusterID string
+		err       error
+	)
+	if mkfsBlockSizeStr != "" {
+		blockSize, err = humanize.ParseBytes(mkfsBlockSizeStr)
+		if err != nil {
+			die("error parsing block-size: %v", err)
+		}
+	} else {
+		mds := mustConnectToMDS()
+		gmd := mds.GlobalMetadata()
+		mds.Close()
+		blockSize, clusterID = gmd.BlockSize, gmd.ClusterID
+	}
+	if err := lib.CheckDevice(device, mkfsWipe); err != nil {
+		die("%v", err)
+	}
+	if err := lib.Mkfs(blockSize, clusterID, false, device); err != nil {
+		die("couldn't format %s: %v", device, err)
+	}
+	m, err := lib.ReadSuperblock(device)
+	if err != nil {
+		die("couldn't read back the superblock of %s: %v", device, err)
+	}
+	res := mkfsDeviceResult{
+		Device:        device,
+		FormatVersion: m.FormatVersion,
+		BlockSize:     m.TorusBlockSize,
+		Capacity:      m.Capacity,
+		Blocks:        (m.Capacity - blockDevice.MetadataSize) / (blockDevice.BlockSize + m.TorusBlockSize),
+		ClusterID:     m.ClusterID,
+		Formatted:     m.FormattedTimestamp,
+	}
+	printOutput(res, func() {
+		fmt.Printf("formatted %s for torus: %d blocks of %s, superblock format %d\n",
+			device, res.Blocks, humanize.IBytes(res.BlockSize), res.FormatVersion)
+		if res.ClusterID != "" {
+			fmt.Printf("marked for cluster %s\n", res.ClusterID)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Output formats taken by --output.
+const (
+	outputFormatTable = "table"
+	outputFormatJSON  = "json"
+)
+
+var outputFormat string
+
+func checkOutputFormat() error {
+	switch outputFormat {
+	case outputFormatTable, outputFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q (try table or json)", outputFormat)
+}
+
+// wantJSON reports whether to print JSON, as asked for by --output json or
+// the --json flag some commands take.
+func wantJSON() bool {
+	return outputAsJSON || outputFormat == outputFormatJSON
+}
+
+// printOutput prints v as JSON if asked to, and otherwise calls printTable to
+// print it for people. v should hold raw values, such as sizes in bytes and
+// times from jsonTime, leaving humanizing them to printTable.
+func printOutput(v interface{}, printTable func()) {
+	if wantJSON() {
+		printJSON(v)
+		return
+	}
+	printTable()
+}
+
+func printJSON(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		die("error encoding json: %v", err)
+	}
+	fmt.Println(string(out))
+}
+
+// jsonTime formats t for JSON output, leaving unknown times empty.
+func jsonTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/models"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -41,9 +43,9 @@ var peerRemoveCommand = &cobra.Command{
 }
 
 func init() {
-	peerCommand.AddCommand(peerAddCommand, peerRemoveCommand, peerListCommand)
+	peerCommand.AddCommand(peerAddCommand, peerRemoveCommand, peerEvictCommand, peerListCommand)
 	peerAddCommand.Flags().BoolVar(&allPeers, "all-peers", false, "add all peers")
-	peerRemoveCommand.PersistentFlags().BoolVar(&force, "force", false, "force-remove a UUID")
+	peerRemoveCommand.PersistentFlags().BoolVar(&force, "force", false, "remove peers that are down or still draining, or while the last ring change is still rebalancing")
 }
 
 func peerAction(cmd *cobra.Command, args []string) {
@@ -55,8 +57,8 @@ func peerChangePreRun(cmd *cobra.Command, args []string) {
 	if allPeers && len(args) > 0 {
 		die("can't have both --all-peers and a list of peers")
 	}
-	mds = mustConnectToMDS()
-	peers, err := mds.GetPeers()
+	connect()
+	peers, err := cl.ListPeers(context.Background())
 	if err != nil {
 		die("couldn't get peer list: %v", err)
 	}
@@ -97,10 +99,8 @@ func peerAddAction(cmd *cobra.Command, args []string) {
 	if !allPeers && len(args) == 0 {
 		die("need to specify one of peer's address, uuid or --all-peers")
 	}
-	if mds == nil {
-		mds = mustConnectToMDS()
-	}
-	currentRing, err := mds.GetRing()
+	connect()
+	currentRing, err := cl.GetRing(context.Background())
 	if err != nil {
 		die("couldn't get ring: %v", err)
 	}
@@ -113,20 +113,28 @@ func peerAddAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("couldn't add peer to ring: %v", err)
 	}
-	err = mds.SetRing(newRing)
+	checkRingTransition(mds, force)
+	err = cl.SetRing(context.Background(), newRing, "add peers "+strings.Join(newPeers.PeerList(), ","))
+	recordAudit(mds, torus.AuditEvent{
+		Op:          torus.AuditPeerAdd,
+		RingVersion: newRing.Version(),
+		Details:     map[string]string{"peers": strings.Join(newPeers.PeerList(), ",")},
+		Err:         torus.AuditErr(err),
+	})
 	if err != nil {
 		die("couldn't set new ring: %v", err)
 	}
 }
 
 func peerRemoveAction(cmd *cobra.Command, args []string) {
-	if mds == nil {
-		mds = mustConnectToMDS()
-	}
-	currentRing, err := mds.GetRing()
+	connect()
+	currentRing, err := cl.GetRing(context.Background())
 	if err != nil {
 		die("couldn't get ring: %v", err)
 	}
+	if rd, ok := currentRing.(torus.RingDrainer); ok && !force {
+		checkDrained(rd.Draining().Intersect(newPeers.PeerList()))
+	}
 	var newRing torus.Ring
 	if r, ok := currentRing.(torus.RingRemover); ok {
 		newRing, err = r.RemovePeers(newPeers.PeerList())
@@ -136,8 +144,26 @@ func peerRemoveAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("couldn't remove peer from ring: %v", err)
 	}
-	err = mds.SetRing(newRing)
+	checkRingTransition(mds, force)
+	err = cl.SetRing(context.Background(), newRing, "remove peers "+strings.Join(newPeers.PeerList(), ","))
+	recordAudit(mds, torus.AuditEvent{
+		Op:          torus.AuditPeerRemove,
+		RingVersion: newRing.Version(),
+		Details:     map[string]string{"peers": strings.Join(newPeers.PeerList(), ",")},
+		Err:         torus.AuditErr(err),
+	})
 	if err != nil {
 		die("couldn't set new ring: %v", err)
 	}
 }
+
+// checkDrained refuses to remove draining peers that still hold blocks, as
+// removing them would leave those blocks short of replicas.
+func checkDrained(draining torus.PeerList) {
+	for _, uuid := range draining {
+		st := getDrainStatus(mds, uuid)
+		if st.Up && st.BlocksRemaining != 0 {
+			die("peer %s is still draining, with %d blocks left. Wait for it, or use `--force`", uuid, st.BlocksRemaining)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/spf13/cobra"
+)
+
+var cordonReason string
+
+var peerCordonCommand = &cobra.Command{
+	Use:   "cordon UUID",
+	Short: "stop a peer taking new blocks while it's down for maintenance",
+	Long: `cordon marks a peer of the ring as under maintenance. A cordoned peer stays
+in the ring and keeps serving the blocks it holds, but takes no new ones:
+writes go to the next peers of the ring in its place, and rebalancing sends
+it nothing. If it stops reporting, it isn't evicted until it has been
+cordoned for longer than the --cordon-timeout of torusd.
+
+The cordon stays until it is lifted with peer uncordon, including across
+restarts of the peer.`,
+	Run: peerCordonAction,
+}
+
+var peerUncordonCommand = &cobra.Command{
+	Use:   "uncordon UUID",
+	Short: "let a cordoned peer take new blocks again",
+	Run:   peerUncordonAction,
+}
+
+func init() {
+	peerCommand.AddCommand(peerCordonCommand, peerUncordonCommand)
+	peerCordonCommand.Flags().StringVarP(&cordonReason, "reason", "", "", "why the peer is cordoned, shown in the peer list")
+}
+
+func peerCordonAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	uuid := args[0]
+	mds := mustConnectToMDS()
+	c, err := torus.CordonPeer(mds, uuid, cordonReason)
+	recordAudit(mds, torus.AuditEvent{
+		Op:      torus.AuditPeerCordon,
+		Details: map[string]string{"peer": uuid, "reason": cordonReason},
+		Err:     torus.AuditErr(err),
+	})
+	switch err {
+	case nil:
+	case torus.ErrNoPeer:
+		die("peer %s is not in the ring", uuid)
+	case torus.ErrNotSupported:
+		die("the metadata service doesn't support cordons")
+	default:
+		die("couldn't cordon peer %s: %v", uuid, err)
+	}
+	fmt.Fprintf(os.Stderr, "peer %s is cordoned since %s\n", uuid, c.Since.Local().Format(time.Stamp))
+}
+
+func peerUncordonAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	uuid := args[0]
+	mds := mustConnectToMDS()
+	err := torus.UncordonPeer(mds, uuid)
+	if err != torus.ErrNotExist {
+		recordAudit(mds, torus.AuditEvent{
+			Op:      torus.AuditPeerUncordon,
+			Details: map[string]string{"peer": uuid},
+			Err:     torus.AuditErr(err),
+		})
+	}
+	switch err {
+	case nil:
+	case torus.ErrNotExist:
+		die("peer %s is not cordoned", uuid)
+	case torus.ErrNotSupported:
+		die("the metadata service doesn't support cordons")
+	default:
+		die("couldn't uncordon peer %s: %v", uuid, err)
+	}
+	fmt.Fprintf(os.Stderr, "peer %s takes new blocks again\n", uuid)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var (
+	drainNoWait bool
+	drainRemove bool
+	drainCancel bool
+	drainPoll   time.Duration
+)
+
+var peerDrainCommand = &cobra.Command{
+	Use:   "drain UUID",
+	Short: "move every block off a peer before removing it",
+	Long: `drain marks a peer as draining. A draining peer stays in the ring and keeps
+serving reads of the blocks it holds, but takes no new ones, while
+rebalancing copies its blocks to where the ring places them without it and
+drops them from the peer.
+
+drain then reports how many blocks the peer has left until it has none, at
+which point the peer can be taken out of the ring with peer remove, or right
+away with --remove, without any block losing a replica.`,
+	Run: peerDrainAction,
+}
+
+func init() {
+	peerCommand.AddCommand(peerDrainCommand)
+	peerDrainCommand.Flags().BoolVarP(&drainNoWait, "no-wait", "", false, "mark the peer as draining and return")
+	peerDrainCommand.Flags().BoolVarP(&drainRemove, "remove", "", false, "remove the peer from the ring once it's drained")
+	peerDrainCommand.Flags().BoolVarP(&drainCancel, "cancel", "", false, "stop draining the peer, which takes blocks again")
+	peerDrainCommand.Flags().DurationVarP(&drainPoll, "interval", "", 5*time.Second, "how often to report progress")
+}
+
+// drainStatus is the progress of a draining peer, as of its last heartbeat.
+type drainStatus struct {
+	UUID string `json:"uuid"`
+	// Up is false if the peer isn't reporting; its blocks can't move until
+	// it's back.
+	Up              bool    `json:"up"`
+	BlocksRemaining uint64  `json:"blocks_remaining"`
+	BytesRemaining  uint64  `json:"bytes_remaining"`
+	Throughput      float64 `json:"throughput"`
+	LastSeen        string  `json:"last_seen,omitempty"`
+}
+
+func peerDrainAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	uuid := args[0]
+	c := mustConnect()
+	mds := c.MetadataService()
+
+	op, drain := torus.AuditPeerDrain, c.DrainPeer
+	if drainCancel {
+		op, drain = torus.AuditPeerUndrain, c.UndrainPeer
+	}
+	old, err := drain(context.Background(), uuid)
+	e := torus.AuditEvent{
+		Op:      op,
+		Details: map[string]string{"peer": uuid},
+		Err:     torus.AuditErr(err),
+	}
+	if err == nil {
+		e.RingVersion = old.Version() + 1
+	}
+	if err != torus.ErrExists {
+		recordAudit(mds, e)
+	}
+	switch err {
+	case nil:
+	case torus.ErrNoPeer:
+		die("peer %s is not in the ring", uuid)
+	case torus.ErrNotSupported:
+		die("current ring type cannot drain peers")
+	case torus.ErrExists:
+		if drainCancel {
+			die("peer %s isn't draining", uuid)
+		}
+		// Already draining; carry on watching it.
+	default:
+		die("couldn't drain peer %s: %v", uuid, err)
+	}
+	if drainCancel {
+		fmt.Fprintf(os.Stderr, "stopped draining peer %s\n", uuid)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "draining peer %s\n", uuid)
+	if drainNoWait {
+		return
+	}
+
+	for {
+		st := getDrainStatus(mds, uuid)
+		printOutput(st, func() { printDrainStatus(st) })
+		if st.Up && st.BlocksRemaining == 0 {
+			break
+		}
+		time.Sleep(drainPoll)
+	}
+	fmt.Fprintf(os.Stderr, "peer %s is drained\n", uuid)
+	if !drainRemove {
+		fmt.Fprintf(os.Stderr, "run `torusctl peer remove %s` to take it out of the ring\n", uuid)
+		return
+	}
+	old, err = c.EvictPeer(context.Background(), uuid)
+	e = torus.AuditEvent{
+		Op:      torus.AuditPeerRemove,
+		Details: map[string]string{"peers": uuid},
+		Err:     torus.AuditErr(err),
+	}
+	if err == nil {
+		e.RingVersion = old.Version() + 1
+	}
+	recordAudit(mds, e)
+	if err != nil {
+		die("couldn't remove peer %s: %v", uuid, err)
+	}
+	fmt.Fprintf(os.Stderr, "removed peer %s from the ring\n", uuid)
+}
+
+func getDrainStatus(mds torus.MetadataService, uuid string) drainStatus {
+	peers, err := mds.GetPeers()
+	if err != nil {
+		die("couldn't get peers: %v", err)
+	}
+	st := drainStatus{UUID: uuid}
+	var p *models.PeerInfo
+	for _, x := range peers {
+		if x.UUID == uuid && x.Address != "" {
+			p = x
+		}
+	}
+	if p == nil {
+		return st
+	}
+	st.Up = true
+	st.BlocksRemaining = p.UsedBlocks
+	st.BytesRemaining = p.UsedBlocks * mds.GlobalMetadata().BlockSize
+	st.Throughput = torus.NewRebalanceProgress(uuid, p.RebalanceInfo, time.Unix(0, p.LastSeen)).Throughput
+	st.LastSeen = jsonTime(time.Unix(0, p.LastSeen))
+	return st
+}
+
+func printDrainStatus(st drainStatus) {
+	if !st.Up {
+		fmt.Printf("%s: down; its blocks can't move until it's back\n", st.UUID)
+		return
+	}
+	fmt.Printf("%s: %d blocks (%s) remaining, %s/sec\n", st.UUID, st.BlocksRemaining,
+		bytesOrIbytes(st.BytesRemaining, outputAsSI), bytesOrIbytes(uint64(st.Throughput), outputAsSI))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/distributor"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var yesIAmSurePleaseEvict bool
+
+var peerEvictCommand = &cobra.Command{
+	Use:   "evict UUID",
+	Short: "remove a dead peer from the ring immediately",
+	Long: `evict removes a peer from the ring right away, without waiting for it to time
+out or draining it first. It is meant for nodes that are never coming back.
+
+Blocks held by the evicted peer are under-replicated until a rebalance copies
+them again, and blocks it held the only copy of are lost. Once the peer is out
+of the ring, evict lists the blocks of every block volume that are at risk.`,
+	Run: peerEvictAction,
+}
+
+func init() {
+	peerEvictCommand.Flags().BoolVarP(&yesIAmSurePleaseEvict, "yes-i-am-sure", "", false, "evict without asking for confirmation")
+	peerEvictCommand.Flags().BoolVarP(&outputAsJSON, "json", "", false, "output as json instead")
+}
+
+type evictReport struct {
+	Evicted          string            `json:"evicted"`
+	AtRisk           []auditProblem    `json:"at_risk"`
+	UnreachablePeers map[string]string `json:"unreachable_peers,omitempty"`
+}
+
+func peerEvictAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	uuid := args[0]
+	if !yesIAmSurePleaseEvict {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Printf("This will remove peer %s from the ring without moving its data first.\nPlease type `YES`, all caps to confirm: ", uuid)
+		text, _ := reader.ReadString('\n')
+		if strings.TrimSpace(text) != "YES" {
+			fmt.Println("`YES` not entered, exiting")
+			os.Exit(1)
+		}
+	}
+	report := evictPeer(uuid)
+	if wantJSON() {
+		printJSON(report)
+		return
+	}
+	printEvictReport(report)
+}
+
+func evictPeer(uuid string) evictReport {
+	srv := createServer()
+	defer srv.Close()
+
+	old, err := torus.EvictPeer(srv.MDS, uuid)
+	e := torus.AuditEvent{
+		Op:      torus.AuditPeerEvict,
+		Details: map[string]string{"peer": uuid},
+		Err:     torus.AuditErr(err),
+	}
+	if err == nil {
+		e.RingVersion = old.Version() + 1
+	}
+	srv.Audit.Record(e)
+	if err == torus.ErrNoPeer {
+		die("peer %s is not in the ring", uuid)
+	}
+	if err != nil {
+		die("couldn't evict peer %s: %v", uuid, err)
+	}
+	torus.RecordClusterEvent(srv.MDS, e)
+	fmt.Fprintf(os.Stderr, "WARNING: evicted peer %s from the ring. Blocks it held are under-replicated until a rebalance restores them.\n", uuid)
+
+	report := evictReport{
+		Evicted:          uuid,
+		AtRisk:           []auditProblem{},
+		UnreachablePeers: make(map[string]string),
+	}
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		die("couldn't list volumes to find blocks at risk: %v", err)
+	}
+	for _, v := range vols {
+		if v.Type != block.VolumeType {
+			continue
+		}
+		vol, err := block.OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			die("couldn't open block volume %s: %v", v.Name, err)
+		}
+		refs, err := vol.ReferencedBlocks()
+		if err != nil {
+			die("couldn't read block map of volume %s: %v", v.Name, err)
+		}
+		reps, peerErrs, err := distributor.AtRiskBlocks(context.Background(), srv, old, uuid, refs)
+		if err != nil {
+			die("couldn't check blocks of volume %s: %v", v.Name, err)
+		}
+		for p, err := range peerErrs {
+			report.UnreachablePeers[p] = err.Error()
+		}
+		for _, r := range reps {
+			report.AtRisk = append(report.AtRisk, auditProblem{
+				Volume:  v.Name,
+				Block:   r.Ref.String(),
+				Want:    r.Want,
+				Have:    len(r.Holders),
+				Holders: r.Holders,
+			})
+		}
+	}
+	return report
+}
+
+func printEvictReport(report evictReport) {
+	for p, err := range report.UnreachablePeers {
+		fmt.Fprintf(os.Stderr, "couldn't ask peer %s, counting it as holding nothing: %s\n", p, err)
+	}
+	if len(report.AtRisk) == 0 {
+		fmt.Println("No blocks are at risk.")
+		return
+	}
+	fmt.Printf("%d blocks are at risk:\n", len(report.AtRisk))
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Volume", "Block", "Want", "Have", "Holders"})
+	for _, p := range report.AtRisk {
+		table.Append([]string{
+			p.Volume,
+			p.Block,
+			strconv.Itoa(p.Want),
+			strconv.Itoa(p.Have),
+			strings.Join(p.Holders, ","),
+		})
+	}
+	table.Render()
+}
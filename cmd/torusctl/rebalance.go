@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var rebalanceCommand = &cobra.Command{
+	Use:   "rebalance",
+	Short: "show rebalance progress of the peers in the cluster",
+	Run:   rebalanceAction,
+}
+
+var rebalancePauseCommand = &cobra.Command{
+	Use:   "pause",
+	Short: "pause rebalancing on every peer until it is resumed",
+	Run:   rebalancePauseAction,
+}
+
+var rebalanceResumeCommand = &cobra.Command{
+	Use:   "resume",
+	Short: "resume paused rebalancing",
+	Run:   rebalanceResumeAction,
+}
+
+var rebalanceLimitCommand = &cobra.Command{
+	Use:   "limit RATE",
+	Short: "limit the bytes per second each peer sends while rebalancing (0 for unlimited)",
+	Run:   rebalanceLimitAction,
+}
+
+func init() {
+	rebalanceCommand.AddCommand(rebalancePauseCommand, rebalanceResumeCommand, rebalanceLimitCommand)
+	rebalanceCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+	rebalanceCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	rebalanceCommand.Flags().BoolVarP(&outputAsJSON, "json", "", false, "output as json instead")
+}
+
+func rebalanceAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	peers, err := mds.GetPeers()
+	if err != nil {
+		die("couldn't get peers: %v", err)
+	}
+	var progress []torus.RebalanceProgress
+	for _, x := range peers {
+		if x.Address == "" {
+			continue
+		}
+		// The info is as fresh as the peer's last heartbeat.
+		progress = append(progress, torus.NewRebalanceProgress(x.UUID, x.RebalanceInfo, time.Unix(0, x.LastSeen)))
+	}
+	if wantJSON() {
+		printJSON(progress)
+		return
+	}
+	table := NewTableWriter(os.Stdout)
+	if !outputAsCSV {
+		printRebalanceSettings(mds)
+	}
+	table.SetHeader([]string{"UUID", "Rebalancing", "Blocks Left", "Moved", "Throughput", "ETA"})
+	for _, p := range progress {
+		eta := "-"
+		if p.Rebalancing && p.ETA != 0 {
+			eta = (p.ETA / time.Second * time.Second).String()
+		}
+		table.Append([]string{
+			p.UUID,
+			strconv.FormatBool(p.Rebalancing),
+			strconv.FormatUint(p.BlocksRemaining, 10),
+			bytesOrIbytes(p.BytesMoved, outputAsSI),
+			bytesOrIbytes(uint64(p.Throughput), outputAsSI) + "/sec",
+			eta,
+		})
+	}
+	if outputAsCSV {
+		table.RenderCSV()
+		return
+	}
+	table.Render()
+}
+
+func printRebalanceSettings(mds torus.MetadataService) {
+	rc, ok := mds.(torus.RebalanceController)
+	if !ok {
+		return
+	}
+	rs, err := rc.GetRebalanceSettings()
+	if err != nil {
+		die("couldn't get rebalance settings: %v", err)
+	}
+	limit := "unlimited"
+	if rs.RateLimit != 0 {
+		limit = bytesOrIbytes(rs.RateLimit, outputAsSI) + "/sec"
+	}
+	fmt.Printf("Paused: %v\nRate limit: %s\n", rs.Paused, limit)
+}
+
+func mustRebalanceController(mds torus.MetadataService) torus.RebalanceController {
+	rc, ok := mds.(torus.RebalanceController)
+	if !ok {
+		die("metadata service doesn't support rebalance settings")
+	}
+	return rc
+}
+
+// changeRebalanceSettings applies change to the current settings, and
+// records it as op in the audit log.
+func changeRebalanceSettings(op string, details map[string]string, change func(*torus.RebalanceSettings)) {
+	mds := mustConnectToMDS()
+	rc := mustRebalanceController(mds)
+	rs, err := rc.GetRebalanceSettings()
+	if err != nil {
+		die("couldn't get rebalance settings: %v", err)
+	}
+	change(&rs)
+	err = rc.SetRebalanceSettings(rs)
+	recordAudit(mds, torus.AuditEvent{
+		Op:      op,
+		Details: details,
+		Err:     torus.AuditErr(err),
+	})
+	if err != nil {
+		die("couldn't set rebalance settings: %v", err)
+	}
+}
+
+func rebalancePauseAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	changeRebalanceSettings(torus.AuditRebalancePause, nil, func(rs *torus.RebalanceSettings) {
+		rs.Paused = true
+	})
+}
+
+func rebalanceResumeAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	changeRebalanceSettings(torus.AuditRebalanceResume, nil, func(rs *torus.RebalanceSettings) {
+		rs.Paused = false
+	})
+}
+
+func rebalanceLimitAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	rate, err := humanize.ParseBytes(args[0])
+	if err != nil {
+		die("invalid rate %q: %v", args[0], err)
+	}
+	details := map[string]string{"rate_limit": strconv.FormatUint(rate, 10)}
+	changeRebalanceSettings(torus.AuditRebalanceLimit, details, func(rs *torus.RebalanceSettings) {
+		rs.RateLimit = rate
+	})
+}
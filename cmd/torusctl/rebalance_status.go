@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/ring"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rebalanceWait     bool
+	rebalanceInterval time.Duration
+	ringForce         bool
+)
+
+var rebalanceStatusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "show how far the cluster is through moving onto the current ring",
+	Long: `status shows the progress of every peer of the ring onto the current ring
+version. A ring change is complete once every peer that is up has finished
+rebalancing onto it; until then, changing the ring again needs --force.`,
+	Run: rebalanceStatusAction,
+}
+
+func init() {
+	rebalanceCommand.AddCommand(rebalanceStatusCommand)
+	rebalanceStatusCommand.Flags().BoolVar(&rebalanceWait, "wait", false, "wait until the ring change is complete")
+	rebalanceStatusCommand.Flags().DurationVar(&rebalanceInterval, "interval", 5*time.Second, "how often to check progress with --wait")
+	rebalanceStatusCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	for _, c := range []*cobra.Command{ringChangeCommand, ringChangeReplicationCommand, ringRollbackCommand} {
+		c.Flags().BoolVar(&ringForce, "force", false, "change the ring even if the last change is still rebalancing")
+	}
+	peerAddCommand.Flags().BoolVar(&force, "force", false, "add peers even if the last ring change is still rebalancing")
+}
+
+type transitionStatus struct {
+	*ring.Transition
+	Started string `json:"started,omitempty"`
+}
+
+func rebalanceStatusAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	for {
+		t, err := ring.CurrentTransition(mds)
+		if err != nil {
+			die("couldn't get rebalance status: %v", err)
+		}
+		if !rebalanceWait || t.Done {
+			res := transitionStatus{Transition: t, Started: jsonTime(t.Started)}
+			printOutput(res, func() { printTransition(t) })
+			return
+		}
+		if !wantJSON() {
+			fmt.Fprintf(os.Stderr, "ring version %d: %d peers rebalancing, %d blocks left, ETA %s\n",
+				t.RingVersion, len(t.Pending()), t.BlocksRemaining, formatETA(t.ETA))
+		}
+		time.Sleep(rebalanceInterval)
+	}
+}
+
+func printTransition(t *ring.Transition) {
+	state := "complete"
+	switch {
+	case t.Union:
+		state = "on a union ring"
+	case !t.Done:
+		state = "rebalancing"
+	}
+	fmt.Printf("Ring version %d: %s\n", t.RingVersion, state)
+	if !t.Started.IsZero() {
+		fmt.Printf("Started: %s\n", t.Started.Local().Format(time.Stamp))
+	}
+	if !t.Done {
+		fmt.Printf("Blocks left: %d\nMoved: %s\nETA: %s\n", t.BlocksRemaining, bytesOrIbytes(t.BytesMoved, outputAsSI), formatETA(t.ETA))
+	}
+	fmt.Println()
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"UUID", "Status", "Ring Version", "Blocks Left", "Moved", "ETA"})
+	for _, p := range t.Peers {
+		status := "done"
+		switch {
+		case !p.Up:
+			status = "DOWN"
+		case !p.Done:
+			status = "rebalancing"
+		}
+		eta := "-"
+		if p.Up && !p.Done {
+			eta = formatETA(p.ETA)
+		}
+		table.Append([]string{
+			p.UUID,
+			status,
+			strconv.Itoa(p.RingVersion),
+			strconv.FormatUint(p.BlocksRemaining, 10),
+			bytesOrIbytes(p.BytesMoved, outputAsSI),
+			eta,
+		})
+	}
+	table.Render()
+}
+
+func formatETA(eta time.Duration) string {
+	if eta == 0 {
+		return "unknown"
+	}
+	return (eta / time.Second * time.Second).String()
+}
+
+// checkRingTransition refuses to change the ring while the cluster is still
+// moving onto the current one, unless force is set. Stacking ring changes
+// leaves blocks on peers neither ring looks for them on.
+func checkRingTransition(mds torus.MetadataService, force bool) {
+	if force {
+		return
+	}
+	t, err := ring.CurrentTransition(mds)
+	if err != nil {
+		die("couldn't get rebalance status: %v", err)
+	}
+	if t.Done {
+		return
+	}
+	if t.Union {
+		die("the cluster is still on a union ring for version %d. Wait for it with `torusctl rebalance status --wait`, or use `--force`", t.RingVersion)
+	}
+	die("ring version %d is still rebalancing on %d peers. Wait for it with `torusctl rebalance status --wait`, or use `--force`", t.RingVersion, len(t.Pending()))
+}
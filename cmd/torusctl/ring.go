@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/alternative-storage/torus"
-	"github.com/alternative-storage/torus/internal/flagconfig"
+	"github.com/alternative-storage/torus/client"
 	"github.com/alternative-storage/torus/models"
 	"github.com/alternative-storage/torus/ring"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -18,9 +20,20 @@ var (
 	uuids     []string
 	allUUIDs  bool
 	repFactor int
+	domain    string
+	cl        *client.Client
 	mds       torus.MetadataService
 )
 
+// connect sets cl, and mds to its metadata service, for the ring and peer
+// change commands, unless their pre-run has already.
+func connect() {
+	if cl == nil {
+		cl = mustConnect()
+		mds = cl.MetadataService()
+	}
+}
+
 var ringCommand = &cobra.Command{
 	Use:   "ring",
 	Short: "modify the ring of the cluster (ADVANCED)",
@@ -34,8 +47,15 @@ var ringChangeReplicationCommand = &cobra.Command{
 }
 
 var ringChangeCommand = &cobra.Command{
-	Use:    "manual-change",
-	Short:  "apply a new ring to the cluster",
+	Use:     "manual-change",
+	Aliases: []string{"change"},
+	Short:   "apply a new ring to the cluster",
+	Long: `manual-change replaces the ring of the cluster with a new one, which the
+cluster then rebalances its blocks onto.
+
+With --dry-run, the ring is left as it is, and the blocks the change would
+move are estimated instead, broken down by the peers they move from and to,
+along with warnings about blocks it would leave short of replicas.`,
 	PreRun: ringChangePreRun,
 	Run:    ringChangeAction,
 }
@@ -52,8 +72,14 @@ func init() {
 	ringCommand.AddCommand(ringGetCommand)
 	ringChangeCommand.Flags().StringSliceVar(&uuids, "uuids", []string{}, "uuids to incorporate in the ring")
 	ringChangeCommand.Flags().BoolVar(&allUUIDs, "all-peers", false, "use all peers in the ring")
-	ringChangeCommand.Flags().StringVar(&ringType, "type", "ketama", "type of ring to create (empty, single, mod or ketama)")
+	ringChangeCommand.Flags().StringVar(&ringType, "type", "", "type of ring to create (empty, single, mod, ketama or ketama-zones; defaults to the type the cluster was initialized with)")
 	ringChangeCommand.Flags().IntVarP(&repFactor, "replication", "r", 2, "number of replicas")
+	ringChangeCommand.Flags().StringVar(&domain, "domain", "", "label key whose values a ketama-zones ring keeps replicas distinct in (e.g. rack)")
+	for _, c := range []*cobra.Command{ringChangeCommand, ringChangeReplicationCommand} {
+		c.Flags().BoolVar(&ringDryRun, "dry-run", false, "estimate the blocks the change would move instead of applying it")
+		c.Flags().IntVar(&ringSample, "sample", 0, "estimate from this many blocks rather than all of them, with --dry-run (0 looks at every block)")
+		c.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	}
 }
 
 func ringAction(cmd *cobra.Command, args []string) {
@@ -62,20 +88,91 @@ func ringAction(cmd *cobra.Command, args []string) {
 	os.Exit(1)
 }
 
+type ringSummary struct {
+	Type              string            `json:"type"`
+	Version           int               `json:"version"`
+	ReplicationFactor int               `json:"replication_factor"`
+	Peers             []ringPeer        `json:"peers"`
+	Attrs             map[string]string `json:"attrs,omitempty"`
+	// Old and New are the rings a union ring, used while the cluster
+	// rebalances onto a new ring, is made of.
+	Old *ringSummary `json:"old,omitempty"`
+	New *ringSummary `json:"new,omitempty"`
+}
+
+type ringPeer struct {
+	UUID       string            `json:"uuid"`
+	Address    string            `json:"address,omitempty"`
+	TotalBytes uint64            `json:"total_bytes"`
+	Zone       string            `json:"zone,omitempty"`
+	Rack       string            `json:"rack,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+func summarizeRing(b []byte, blockSize uint64) (*ringSummary, error) {
+	var r models.Ring
+	if err := r.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	out := &ringSummary{
+		Type:              ring.RingTypeName(torus.RingType(r.Type)),
+		Version:           int(r.Version),
+		ReplicationFactor: int(r.ReplicationFactor),
+		Peers:             []ringPeer{},
+	}
+	for _, p := range r.Peers {
+		out.Peers = append(out.Peers, ringPeer{
+			UUID:       p.UUID,
+			Address:    p.Address,
+			TotalBytes: p.TotalBlocks * blockSize,
+			Zone:       p.Zone,
+			Rack:       p.Rack,
+			Labels:     p.Labels,
+		})
+	}
+	if torus.RingType(r.Type) != ring.Union {
+		for k, v := range r.Attrs {
+			if out.Attrs == nil {
+				out.Attrs = make(map[string]string)
+			}
+			out.Attrs[k] = string(v)
+		}
+		return out, nil
+	}
+	var err error
+	if out.Old, err = summarizeRing(r.Attrs["old"], blockSize); err != nil {
+		return nil, err
+	}
+	if out.New, err = summarizeRing(r.Attrs["new"], blockSize); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func ringGetAction(cmd *cobra.Command, args []string) {
-	mds := mustConnectToMDS()
-	ring, err := mds.GetRing()
+	c := mustConnect()
+	r, err := c.GetRing(context.Background())
 	if err != nil {
 		die("couldn't get ring: %v", err)
 	}
-	fmt.Println(ring.Describe())
+	if !wantJSON() {
+		fmt.Println(r.Describe())
+		return
+	}
+	b, err := r.Marshal()
+	if err != nil {
+		die("couldn't marshal ring: %v", err)
+	}
+	sum, err := summarizeRing(b, c.GlobalMetadata().BlockSize)
+	if err != nil {
+		die("couldn't read ring: %v", err)
+	}
+	printJSON(sum)
 }
 
 func ringChangeAction(cmd *cobra.Command, args []string) {
-	if mds == nil {
-		mds = mustConnectToMDS()
-	}
-	currentRing, err := mds.GetRing()
+	connect()
+	currentRing, err := cl.GetRing(context.Background())
 	if err != nil {
 		die("couldn't get ring: %v", err)
 	}
@@ -100,28 +197,55 @@ func ringChangeAction(cmd *cobra.Command, args []string) {
 			Version:           uint32(currentRing.Version() + 1),
 		})
 	case "ketama":
-		newRing, err = ring.CreateRing(&models.Ring{
+		newRing, err = ring.CreateRing(ring.WithPlacement(ring.WithVNodes(&models.Ring{
 			Type:              uint32(ring.Ketama),
 			Peers:             peers,
 			ReplicationFactor: uint32(repFactor),
 			Version:           uint32(currentRing.Version() + 1),
-		})
+		}, mds.GlobalMetadata().KetamaVNodes), ring.CurrentPlacement))
+	case "ketama-zones":
+		newRing, err = ring.CreateRing(ring.WithDomain(ring.WithPlacement(ring.WithVNodes(&models.Ring{
+			Type:              uint32(ring.KetamaZones),
+			Peers:             peers,
+			ReplicationFactor: uint32(repFactor),
+			Version:           uint32(currentRing.Version() + 1),
+		}, mds.GlobalMetadata().KetamaVNodes), ring.CurrentPlacement), domain))
 	default:
 		panic("still unknown ring type")
 	}
 	if err != nil {
 		die("couldn't create new ring: %v", err)
 	}
-	cfg := flagconfig.BuildConfigFromFlags()
-	err = torus.SetRing("etcd", cfg, newRing)
+	if ringDryRun {
+		previewRingChange(currentRing, newRing)
+		return
+	}
+	checkRingTransition(mds, ringForce)
+	err = cl.SetRing(context.Background(), newRing, ringMessage)
+	recordAudit(mds, torus.AuditEvent{
+		Op:          torus.AuditRingChange,
+		RingVersion: newRing.Version(),
+		Details: map[string]string{
+			"type":   ringType,
+			"peers":  strings.Join(peers.PeerList(), ","),
+			"domain": domain,
+		},
+		Err: torus.AuditErr(err),
+	})
 	if err != nil {
 		die("couldn't set new ring: %v", err)
 	}
 }
 
 func ringChangePreRun(cmd *cobra.Command, args []string) {
-	mds = mustConnectToMDS()
-	currentPeers, err := mds.GetPeers()
+	connect()
+	if ringType == "" {
+		ringType = mds.GlobalMetadata().RingType
+	}
+	if ringType == "" {
+		ringType = "ketama"
+	}
+	currentPeers, err := cl.ListPeers(context.Background())
 	if allUUIDs {
 		if allUUIDs && len(uuids) != 0 {
 			die("use only one of --uuids or --all-peers")
@@ -141,6 +265,9 @@ func ringChangePreRun(cmd *cobra.Command, args []string) {
 			}
 		}
 	}
+	if domain != "" && ringType != "ketama-zones" {
+		die("--domain only applies to ketama-zones rings")
+	}
 	switch ringType {
 	case "empty":
 		uuids = nil
@@ -152,8 +279,24 @@ func ringChangePreRun(cmd *cobra.Command, args []string) {
 		return
 	case "mod":
 	case "ketama":
+	case "ketama-zones":
+		if domain == "" {
+			die("ketama-zones needs the label key to spread replicas by (use --domain)")
+		}
+		domains := make(map[string]bool)
+		for _, p := range peers {
+			if v, ok := p.Labels[domain]; ok {
+				domains[v] = true
+			} else {
+				fmt.Fprintf(os.Stderr, "warning: peer %s has no %s label\n", p.UUID, domain)
+				domains["peer:"+p.UUID] = true
+			}
+		}
+		if len(domains) < repFactor {
+			fmt.Fprintf(os.Stderr, "warning: only %d values of %s for %d replicas; some replicas will share one\n", len(domains), domain, repFactor)
+		}
 	default:
-		die(`invalid ring type %s (try "empty", "mod", "single" or "ketama")`, ringType)
+		die(`invalid ring type %s (try "empty", "mod", "single", "ketama" or "ketama-zones")`, ringType)
 	}
 }
 
@@ -166,10 +309,8 @@ func ringChangeReplicationAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("not an integer number of replicas: %s", args[0])
 	}
-	if mds == nil {
-		mds = mustConnectToMDS()
-	}
-	currentRing, err := mds.GetRing()
+	connect()
+	currentRing, err := cl.GetRing(context.Background())
 	if err != nil {
 		die("couldn't get ring: %v", err)
 	}
@@ -182,7 +323,18 @@ func ringChangeReplicationAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("couldn't change replication amount: %v", err)
 	}
-	err = mds.SetRing(newRing)
+	if ringDryRun {
+		previewRingChange(currentRing, newRing)
+		return
+	}
+	checkRingTransition(mds, ringForce)
+	err = cl.SetRing(context.Background(), newRing, ringMessage)
+	recordAudit(mds, torus.AuditEvent{
+		Op:          torus.AuditReplicationChange,
+		RingVersion: newRing.Version(),
+		Details:     map[string]string{"replication": strconv.Itoa(amount)},
+		Err:         torus.AuditErr(err),
+	})
 	if err != nil {
 		die("couldn't set new ring: %v", err)
 	}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/ring"
+	"github.com/spf13/cobra"
+)
+
+var ringMessage string
+
+var ringHistoryCommand = &cobra.Command{
+	Use:   "history",
+	Short: "list the last rings set on the cluster",
+	Run:   ringHistoryAction,
+}
+
+var ringRollbackCommand = &cobra.Command{
+	Use:   "rollback VERSION",
+	Short: "set a ring from the ring history again",
+	Long: `rollback sets the ring of VERSION, as listed by "torusctl ring history", as
+the cluster's ring again. It becomes the next version of the ring, and the
+cluster rebalances onto it as it would onto any other new ring.`,
+	Run: ringRollbackAction,
+}
+
+func init() {
+	ringCommand.AddCommand(ringHistoryCommand)
+	ringCommand.AddCommand(ringRollbackCommand)
+	for _, c := range []*cobra.Command{ringChangeCommand, ringChangeReplicationCommand, ringRollbackCommand} {
+		c.Flags().StringVarP(&ringMessage, "message", "m", "", "note to keep in the ring history with the new ring")
+	}
+	ringRollbackCommand.Flags().BoolVar(&ringDryRun, "dry-run", false, "estimate the blocks the rollback would move instead of applying it")
+	ringRollbackCommand.Flags().IntVar(&ringSample, "sample", 0, "estimate from this many blocks rather than all of them, with --dry-run (0 looks at every block)")
+	ringRollbackCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+}
+
+type ringHistoryEntry struct {
+	Version int          `json:"version"`
+	Current bool         `json:"current"`
+	Time    string       `json:"time,omitempty"`
+	Client  string       `json:"client,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Ring    *ringSummary `json:"ring"`
+}
+
+func ringHistoryAction(cmd *cobra.Command, args []string) {
+	mds := mustConnectToMDS()
+	h, ok := mds.(torus.RingHistorian)
+	if !ok {
+		die("the metadata service keeps no ring history")
+	}
+	entries, err := h.RingHistory()
+	if err != nil {
+		die("couldn't get ring history: %v", err)
+	}
+	cur, err := mds.GetRing()
+	if err != nil {
+		die("couldn't get ring: %v", err)
+	}
+	blockSize := mds.GlobalMetadata().BlockSize
+	out := []ringHistoryEntry{}
+	for _, e := range entries {
+		sum, err := summarizeRing(e.Ring, blockSize)
+		if err != nil {
+			die("couldn't read ring version %d: %v", e.Version, err)
+		}
+		out = append(out, ringHistoryEntry{
+			Version: e.Version,
+			Current: e.Version == cur.Version(),
+			Time:    jsonTime(e.Time),
+			Client:  e.Client,
+			Message: e.Message,
+			Ring:    sum,
+		})
+	}
+	printOutput(out, func() { printRingHistory(out) })
+}
+
+func printRingHistory(entries []ringHistoryEntry) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"Version", "Set", "Type", "Replication", "Peers", "Client", "Message"})
+	for _, e := range entries {
+		version := strconv.Itoa(e.Version)
+		if e.Current {
+			version += " (current)"
+		}
+		set := "-"
+		if t, err := time.Parse(time.RFC3339, e.Time); err == nil {
+			set = t.Local().Format(time.Stamp)
+		}
+		table.Append([]string{
+			version,
+			set,
+			e.Ring.Type,
+			strconv.Itoa(e.Ring.ReplicationFactor),
+			strconv.Itoa(len(e.Ring.Peers)),
+			e.Client,
+			e.Message,
+		})
+	}
+	table.Render()
+}
+
+func ringRollbackAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		die("not a ring version: %s", args[0])
+	}
+	mds := mustConnectToMDS()
+	if ringDryRun {
+		cur, err := mds.GetRing()
+		if err != nil {
+			die("couldn't get ring: %v", err)
+		}
+		r, err := ring.FromHistory(mds, version, cur.Version()+1)
+		if err != nil {
+			die("couldn't get ring version %d: %v", version, rollbackError(err))
+		}
+		previewRingChange(cur, r)
+		return
+	}
+	checkRingTransition(mds, ringForce)
+	message := ringMessage
+	if message == "" {
+		message = fmt.Sprintf("roll back to version %d", version)
+	}
+	r, err := ring.Rollback(mds, version, message)
+	e := torus.AuditEvent{
+		Op:      torus.AuditRingRollback,
+		Details: map[string]string{"version": args[0]},
+		Err:     torus.AuditErr(err),
+	}
+	if r != nil {
+		e.RingVersion = r.Version()
+	}
+	recordAudit(mds, e)
+	if err != nil {
+		die("couldn't roll back to ring version %d: %v", version, rollbackError(err))
+	}
+	fmt.Printf("ring version %d is now version %d\n", version, r.Version())
+}
+
+func rollbackError(err error) error {
+	switch err {
+	case torus.ErrNotExist:
+		return errors.New("it isn't in the ring history")
+	case torus.ErrExists:
+		return errors.New("it is the current ring")
+	case torus.ErrNotSupported:
+		return errors.New("the metadata service keeps no ring history")
+	}
+	return err
+}
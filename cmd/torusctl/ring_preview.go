@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/ring"
+)
+
+var (
+	ringDryRun bool
+	ringSample int
+)
+
+type ringPreview struct {
+	*ring.ChangePreview
+	FromVersion int    `json:"from_version"`
+	ToVersion   int    `json:"to_version"`
+	BlockSize   uint64 `json:"block_size"`
+	MovingBytes uint64 `json:"moving_bytes"`
+	CopiedBytes uint64 `json:"copied_bytes"`
+}
+
+// previewRingChange prints an estimate of the blocks replacing currentRing
+// with newRing would move, in place of applying it.
+func previewRingChange(currentRing, newRing torus.Ring) {
+	srv := createServer()
+	defer srv.Close()
+	refs, err := clusterBlockRefs(srv)
+	if err != nil {
+		die("couldn't list the blocks of the cluster: %v", err)
+	}
+	up, err := upPeers(srv.MDS)
+	if err != nil {
+		die("couldn't get peer list: %v", err)
+	}
+	p, err := ring.PreviewChange(currentRing, newRing, refs, ringSample, up)
+	if err != nil {
+		die("couldn't preview ring change: %v", err)
+	}
+	blockSize := srv.MDS.GlobalMetadata().BlockSize
+	res := ringPreview{
+		ChangePreview: p,
+		FromVersion:   currentRing.Version(),
+		ToVersion:     newRing.Version(),
+		BlockSize:     blockSize,
+		MovingBytes:   uint64(p.Moving) * blockSize,
+		CopiedBytes:   uint64(p.Copies) * blockSize,
+	}
+	printOutput(res, func() { printRingPreview(res) })
+}
+
+// clusterBlockRefs returns the blocks referenced by every block volume and
+// its snapshots, without duplicates.
+func clusterBlockRefs(srv *torus.Server) ([]torus.BlockRef, error) {
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[torus.BlockRef]bool)
+	var refs []torus.BlockRef
+	for _, v := range vols {
+		if v.Type != block.VolumeType {
+			continue
+		}
+		vol, err := block.OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open block volume %s: %v", v.Name, err)
+		}
+		vrefs, err := vol.ReferencedBlocks()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read block map of volume %s: %v", v.Name, err)
+		}
+		for _, ref := range vrefs {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// upPeers returns the peers that have heartbeat within the peer timeout.
+func upPeers(mds torus.MetadataService) (torus.PeerList, error) {
+	peers, err := mds.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	timeout := mds.GlobalMetadata().PeerTimeoutOrDefault()
+	up := torus.PeerList{}
+	for _, p := range peers {
+		if p.Address != "" && time.Since(time.Unix(0, p.LastSeen)) <= timeout {
+			up = append(up, p.UUID)
+		}
+	}
+	return up, nil
+}
+
+func printRingPreview(res ringPreview) {
+	if res.Examined < res.Total {
+		fmt.Printf("Estimated from %d of %d blocks.\n", res.Examined, res.Total)
+	}
+	fmt.Printf("Ring version %d to %d: %d of %d blocks move (%s), making %d copies (%s).\n",
+		res.FromVersion, res.ToVersion,
+		res.Moving, res.Total, bytesOrIbytes(res.MovingBytes, outputAsSI),
+		res.Copies, bytesOrIbytes(res.CopiedBytes, outputAsSI))
+	if len(res.Moves) != 0 {
+		fmt.Println()
+		table := NewTableWriter(os.Stdout)
+		table.SetHeader([]string{"From", "To", "Blocks", "Bytes"})
+		for _, m := range res.Moves {
+			from := m.From
+			if from == "" {
+				from = "(none)"
+			}
+			table.Append([]string{
+				from,
+				m.To,
+				strconv.Itoa(m.Blocks),
+				bytesOrIbytes(uint64(m.Blocks)*res.BlockSize, outputAsSI),
+			})
+		}
+		table.Render()
+	}
+	if len(res.Peers) != 0 {
+		fmt.Println()
+		table := NewTableWriter(os.Stdout)
+		table.SetHeader([]string{"Peer", "Gains", "Drops"})
+		for _, p := range res.Peers {
+			table.Append([]string{
+				p.UUID,
+				bytesOrIbytes(uint64(p.Gained)*res.BlockSize, outputAsSI),
+				bytesOrIbytes(uint64(p.Dropped)*res.BlockSize, outputAsSI),
+			})
+		}
+		table.Render()
+	}
+	for _, w := range res.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var scrubCommand = &cobra.Command{
+	Use:   "scrub",
+	Short: "inspect the scrubbing of local storage",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+		os.Exit(1)
+	},
+}
+
+var scrubStatusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "show the progress and findings of each node's scrubber",
+	Long: `status lists, for each node that has scrubbed its local storage, when its
+last full pass finished and the bad blocks it found, along with the progress of
+the pass under way. Nodes scrub when torusd runs with --scrub-rate.`,
+	Run: scrubStatusAction,
+}
+
+func init() {
+	scrubCommand.AddCommand(scrubStatusCommand)
+}
+
+type scrubNode struct {
+	UUID           string `json:"uuid"`
+	Address        string `json:"address,omitempty"`
+	LastFullPass   string `json:"last_full_pass"`
+	LastPassErrors uint64 `json:"last_pass_errors"`
+	PassStart      string `json:"pass_start"`
+	Checked        uint64 `json:"checked"`
+	Errors         uint64 `json:"errors"`
+	TotalErrors    uint64 `json:"total_errors"`
+	Updated        string `json:"updated"`
+
+	lastFullPass time.Time
+	passStart    time.Time
+}
+
+type scrubList struct {
+	Nodes []scrubNode `json:"nodes"`
+}
+
+func scrubStatusAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	st, ok := mds.(torus.ScrubTracker)
+	if !ok {
+		die("metadata service doesn't keep scrub status")
+	}
+	statuses, err := st.GetScrubStatuses()
+	if err != nil {
+		die("couldn't get scrub status: %v", err)
+	}
+	peers, err := mds.GetPeers()
+	if err != nil {
+		die("couldn't get peers: %v", err)
+	}
+	addrs := make(map[string]string)
+	for _, p := range peers {
+		addrs[p.UUID] = p.Address
+	}
+	list := scrubList{Nodes: []scrubNode{}}
+	for _, s := range statuses {
+		list.Nodes = append(list.Nodes, scrubNode{
+			UUID:           s.UUID,
+			Address:        addrs[s.UUID],
+			LastFullPass:   jsonTime(s.LastFullPass),
+			LastPassErrors: s.LastPassErrors,
+			PassStart:      jsonTime(s.PassStart),
+			Checked:        s.Checked,
+			Errors:         s.Errors,
+			TotalErrors:    s.TotalErrors,
+			Updated:        jsonTime(s.Updated),
+			lastFullPass:   s.LastFullPass,
+			passStart:      s.PassStart,
+		})
+	}
+	sort.Sort(scrubNodesByUUID(list.Nodes))
+	printOutput(list, func() { printScrubList(list) })
+}
+
+type scrubNodesByUUID []scrubNode
+
+func (s scrubNodesByUUID) Len() int           { return len(s) }
+func (s scrubNodesByUUID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s scrubNodesByUUID) Less(i, j int) bool { return s[i].UUID < s[j].UUID }
+
+func printScrubList(list scrubList) {
+	table := NewTableWriter(os.Stdout)
+	table.SetHeader([]string{"UUID", "Address", "Last Full Pass", "Last Pass Errors", "Current Pass", "Total Errors"})
+	for _, n := range list.Nodes {
+		last := "never"
+		if !n.lastFullPass.IsZero() {
+			last = humanize.Time(n.lastFullPass)
+		}
+		current := "idle"
+		if !n.passStart.IsZero() {
+			current = "started " + humanize.Time(n.passStart) + ", " +
+				strconv.FormatUint(n.Checked, 10) + " checked, " +
+				strconv.FormatUint(n.Errors, 10) + " bad"
+		}
+		table.Append([]string{
+			n.UUID,
+			n.Address,
+			last,
+			strconv.FormatUint(n.LastPassErrors, 10),
+			current,
+			strconv.FormatUint(n.TotalErrors, 10),
+		})
+	}
+	table.Render()
+}
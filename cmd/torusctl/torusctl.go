@@ -11,8 +11,9 @@ import (
 )
 
 var (
-	logpkg string
-	debug  bool
+	logpkg    string
+	logFormat string
+	debug     bool
 )
 
 var rootCommand = &cobra.Command{
@@ -38,14 +39,23 @@ var versionCommand = &cobra.Command{
 func init() {
 	rootCommand.PersistentFlags().BoolVarP(&debug, "debug", "", false, "enable debug logging")
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
+	rootCommand.PersistentFlags().StringVarP(&logFormat, "log-format", "", "text", "Format of log output: text, or json for one JSON object per line")
+	rootCommand.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputFormatTable, "output format of lists and statuses: table or json")
 	rootCommand.AddCommand(initCommand)
 	rootCommand.AddCommand(blockCommand)
 	rootCommand.AddCommand(listPeersCommand)
 	rootCommand.AddCommand(ringCommand)
 	rootCommand.AddCommand(peerCommand)
+	rootCommand.AddCommand(rebalanceCommand)
+	rootCommand.AddCommand(auditCommand)
+	rootCommand.AddCommand(eventsCommand)
+	rootCommand.AddCommand(scrubCommand)
+	rootCommand.AddCommand(gcCommand)
+	rootCommand.AddCommand(fsckCommand)
 	rootCommand.AddCommand(volumeCommand)
 	rootCommand.AddCommand(versionCommand)
 	rootCommand.AddCommand(wipeCommand)
+	rootCommand.AddCommand(mkfsDeviceCommand)
 	rootCommand.AddCommand(configCommand)
 	rootCommand.AddCommand(completionCommand)
 	flagconfig.AddConfigFlags(rootCommand.PersistentFlags())
@@ -55,9 +65,19 @@ func main() {
 	if err := rootCommand.Execute(); err != nil {
 		die("%v", err)
 	}
+	torus.FlushClusterEvents(clusterEventsFlushTimeout)
 }
 
 func configure(cmd *cobra.Command, args []string) {
+	if err := flagconfig.ApplyConfigFile(cmd.Flags(), "torusctl"); err != nil {
+		die("%v", err)
+	}
+	if err := torus.SetLogFormat(logFormat); err != nil {
+		die("%v", err)
+	}
+	if err := checkOutputFormat(); err != nil {
+		die("%v", err)
+	}
 	capnslog.SetGlobalLogLevel(capnslog.WARNING)
 
 	if debug {
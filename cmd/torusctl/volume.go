@@ -3,11 +3,20 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/alternative-storage/torus/client"
+	"github.com/alternative-storage/torus/internal/flagconfig"
+	"github.com/alternative-storage/torus/models"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var volumeCommand = &cobra.Command{
@@ -19,7 +28,21 @@ var volumeCommand = &cobra.Command{
 var volumeDeleteCommand = &cobra.Command{
 	Use:   "delete NAME",
 	Short: "delete a volume in the cluster",
-	Run:   volumeDeleteAction,
+	Long: `delete deletes volume NAME, which is gone from volume list at once, and has
+every node start a GC pass to reclaim its blocks. The volume leaves a tombstone,
+shown by volume list --show-deleted, until every peer in the ring has reclaimed
+them; a node that is down or restarts finishes the job in a later pass.
+
+A volume that is attached can't be deleted without --force. With --wait, delete
+shows the blocks reclaimed so far until none are left.
+
+With --secure, every node overwrites the volume's blocks with zeros where they
+are stored before reclaiming them, and delete waits until every peer in the
+ring has. A peer that is down erases its blocks once it is back, and the
+volume's tombstone stays until it has. Only the blocks the peers hold when
+they reclaim the volume are erased; copies left in freed space by earlier
+rebalancing or defragmentation aren't.`,
+	Run: volumeDeleteAction,
 }
 
 var volumeListCommand = &cobra.Command{
@@ -28,6 +51,58 @@ var volumeListCommand = &cobra.Command{
 	Run:   volumeListAction,
 }
 
+var volumeInfoCommand = &cobra.Command{
+	Use:   "info NAME",
+	Short: "show details and block usage of a volume",
+	Run:   volumeInfoAction,
+}
+
+var volumeSetConsistencyCommand = &cobra.Command{
+	Use:   "set-consistency NAME LEVEL",
+	Short: "set how many replicas acknowledge writes to a volume",
+	Long: `sets the write consistency of volume NAME to LEVEL, one of:
+
+  sync     acknowledge once every replica has the write
+  quorum   acknowledge once a majority of the replicas have it
+  async    acknowledge once one replica has it, copy it to the rest in the background
+  default  follow the write level of each server`,
+	Run: volumeSetConsistencyAction,
+}
+
+var volumeSetCachePolicyCommand = &cobra.Command{
+	Use:   "set-cache-policy NAME POLICY",
+	Short: "set how blocks of a volume are cached",
+	Long: `sets the block cache policy of volume NAME to POLICY, one of:
+
+  aggressive  cache every block read or written, and keep them over other volumes' blocks
+  default     cache blocks written and blocks fetched from other peers
+  no-cache    keep the volume's blocks out of the cache`,
+	Run: volumeSetCachePolicyAction,
+}
+
+var (
+	// deleteForce deletes a volume even while it's attached, and
+	// deleteWait waits for its blocks to be reclaimed, reporting progress
+	// every deletePoll.
+	deleteForce bool
+	deleteWait  bool
+	deletePoll  time.Duration
+	// deleteSecure has the volume's blocks overwritten before they are
+	// reclaimed, and implies deleteWait.
+	deleteSecure bool
+	// showDeleted lists the deleted volumes whose blocks are still being
+	// reclaimed, too.
+	showDeleted bool
+)
+
+var (
+	// encrypted makes create-block encrypt the new volume.
+	encrypted bool
+	// volumeBlockSpec is the block spec create-block lays the new volume's
+	// blocks out by, if not the cluster's default.
+	volumeBlockSpec string
+)
+
 var volumeCreateBlockCommand = &cobra.Command{
 	Use:   "create-block NAME SIZE",
 	Short: "create a block volume in the cluster",
@@ -53,11 +128,101 @@ var volumeCreateBlockFromSnapshotCommand = &cobra.Command{
 func init() {
 	volumeCommand.AddCommand(volumeDeleteCommand)
 	volumeCommand.AddCommand(volumeListCommand)
+	volumeCommand.AddCommand(volumeInfoCommand)
+	volumeCommand.AddCommand(volumeSetConsistencyCommand)
+	volumeCommand.AddCommand(volumeSetCachePolicyCommand)
 	volumeCommand.AddCommand(volumeCreateBlockCommand)
 	volumeCreateBlockCommand.AddCommand(volumeCreateBlockFromSnapshotCommand)
+	volumeCreateBlockCommand.Flags().BoolVarP(&encrypted, "encrypted", "", false, "encrypt the volume's blocks under a key wrapped by the master key")
+	volumeCreateBlockCommand.Flags().StringVarP(&volumeBlockSpec, "blockspec", "", "", "block layer spec for the volume's blocks, such as crc,rep=3,base (default is the cluster's block spec)")
 	volumeCreateBlockFromSnapshotCommand.Flags().BoolVarP(&progress, "progress", "p", false, "show progress")
+	volumeDeleteCommand.Flags().BoolVarP(&deleteForce, "force", "", false, "delete the volume even if it's attached")
+	volumeDeleteCommand.Flags().BoolVarP(&deleteWait, "wait", "", false, "wait until the volume's blocks are reclaimed, showing progress")
+	volumeDeleteCommand.Flags().BoolVarP(&deleteSecure, "secure", "", false, "overwrite the volume's blocks with zeros on every peer before reclaiming them, and wait until all have")
+	volumeDeleteCommand.Flags().DurationVarP(&deletePoll, "interval", "", 2*time.Second, "how often to report progress with --wait")
+	volumeListCommand.Flags().BoolVarP(&showDeleted, "show-deleted", "", false, "also list deleted volumes whose blocks are being reclaimed")
 	volumeListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
 	volumeListCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	volumeListCommand.Flags().BoolVarP(&outputAsJSON, "json", "", false, "output as json instead")
+	volumeInfoCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+	volumeInfoCommand.Flags().BoolVarP(&outputAsJSON, "json", "", false, "output as json instead")
+}
+
+type volumeSummary struct {
+	Name        string `json:"name"`
+	ID          uint64 `json:"id"`
+	Type        string `json:"type"`
+	Size        uint64 `json:"size"`
+	Replication int    `json:"replication"`
+	BlockSpec   string `json:"block_spec"`
+	Snapshots   int    `json:"snapshots"`
+	Consistency string `json:"consistency"`
+	CachePolicy string `json:"cache_policy"`
+	Encrypted   bool   `json:"encrypted"`
+	Status      string `json:"status"`
+	// QoS is the IOPS and bandwidth limits of the volume, if it has any.
+	QoS    *block.QoS        `json:"qos,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// UsedBytes is the space taken by the written blocks of the volume,
+	// before replication. Trimmed blocks don't count.
+	UsedBytes uint64 `json:"used_bytes"`
+}
+
+type volumeDetails struct {
+	volumeSummary
+	BlockSize       uint64 `json:"block_size"`
+	TotalBlocks     uint64 `json:"total_blocks"`
+	AllocatedBlocks uint64 `json:"allocated_blocks"`
+	SparseBlocks    uint64 `json:"sparse_blocks"`
+}
+
+func summarizeVolume(mds torus.MetadataService, vol *models.Volume, rep int) volumeSummary {
+	out := volumeSummary{
+		Name:        vol.Name,
+		ID:          vol.Id,
+		Type:        vol.Type,
+		Size:        vol.MaxBytes,
+		Replication: rep,
+		Status:      mds.GetLockStatus(vol.Id),
+		Consistency: vol.Consistency,
+		CachePolicy: vol.CachePolicy,
+		Encrypted:   len(vol.WrappedKey) != 0,
+		Labels:      vol.Labels,
+	}
+	if spec, err := block.VolumeBlockSpec(mds, vol); err == nil {
+		out.BlockSpec = blockset.FormatBlockLayerSpec(spec)
+	} else {
+		out.BlockSpec = vol.BlockSpec
+	}
+	if out.Consistency == "" {
+		out.Consistency = "default"
+	}
+	if out.CachePolicy == "" {
+		out.CachePolicy = torus.CachePolicyDefault
+	}
+	if vol.Type == block.VolumeType {
+		snaps, err := block.GetBlockVolumeSnapshots(mds, vol.Name)
+		if err != nil {
+			die("error listing snapshots of volume %s: %v", vol.Name, err)
+		}
+		out.Snapshots = len(snaps)
+		if q := block.VolumeQoS(vol); q.Limited() {
+			out.QoS = &q
+		}
+	}
+	return out
+}
+
+func replicationFactor(mds torus.MetadataService) int {
+	ring, err := mds.GetRing()
+	if err != nil {
+		die("error getting ring: %v", err)
+	}
+	perm, err := ring.GetPeers(torus.ZeroBlock())
+	if err != nil {
+		return 0
+	}
+	return perm.Replication
 }
 
 func volumeAction(cmd *cobra.Command, args []string) {
@@ -70,26 +235,117 @@ func volumeListAction(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 		os.Exit(1)
 	}
-	mds := mustConnectToMDS()
-	vols, _, err := mds.GetVolumes()
+	sel := parseSelectors()
+	srv := createServer()
+	defer srv.Close()
+	vols, err := client.NewFromMetadataService(srv.MDS).ListVolumes(context.Background())
 	if err != nil {
 		die("error listing volumes: %v", err)
 	}
-	table := NewTableWriter(os.Stdout)
-	table.SetHeader([]string{"Volume Name", "Size", "Type", "Status"})
+	rep := replicationFactor(srv.MDS)
+	sums := make([]volumeSummary, 0, len(vols))
 	for _, x := range vols {
-		table.Append([]string{
-			x.Name,
-			bytesOrIbytes(x.MaxBytes, outputAsSI),
-			x.Type,
-			mds.GetLockStatus(x.Id),
-		})
+		if !torus.MatchLabels(x.Labels, sel) {
+			continue
+		}
+		sum := summarizeVolume(srv.MDS, x, rep)
+		if x.Type == block.VolumeType {
+			sum.UsedBytes = blockVolumeUsage(srv, x.Name).UsedBytes
+		}
+		sums = append(sums, sum)
 	}
-	if outputAsCSV {
-		table.RenderCSV()
+	// Deleted volumes keep no labels, so no selector matches them.
+	if showDeleted && len(sel) == 0 {
+		sums = append(sums, deletedVolumes(srv.MDS)...)
+	}
+	printOutput(sums, func() {
+		table := NewTableWriter(os.Stdout)
+		table.SetHeader([]string{"Volume Name", "Size", "Used", "Type", "Replication", "Block Spec", "Consistency", "Cache Policy", "Snapshots", "Status", "Labels"})
+		for _, x := range sums {
+			table.Append([]string{
+				x.Name,
+				bytesOrIbytes(x.Size, outputAsSI),
+				bytesOrIbytes(x.UsedBytes, outputAsSI),
+				x.Type,
+				strconv.Itoa(x.Replication),
+				x.BlockSpec,
+				x.Consistency,
+				x.CachePolicy,
+				strconv.Itoa(x.Snapshots),
+				x.Status,
+				torus.FormatLabels(x.Labels),
+			})
+		}
+		if outputAsCSV {
+			table.RenderCSV()
+			return
+		}
+		table.Render()
+	})
+}
+
+func volumeInfoAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	srv := createServer()
+	defer srv.Close()
+	vol, err := srv.MDS.GetVolume(name)
+	if err != nil {
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	if vol.Type != block.VolumeType {
+		die("unknown volume type %s", vol.Type)
+	}
+	usage := blockVolumeUsage(srv, name)
+	info := volumeDetails{
+		volumeSummary:   summarizeVolume(srv.MDS, vol, replicationFactor(srv.MDS)),
+		BlockSize:       srv.MDS.GlobalMetadata().BlockSize,
+		TotalBlocks:     usage.TotalBlocks,
+		AllocatedBlocks: usage.AllocatedBlocks,
+		SparseBlocks:    usage.SparseBlocks,
+	}
+	info.UsedBytes = usage.UsedBytes
+	if wantJSON() {
+		printJSON(info)
 		return
 	}
-	table.Render()
+	fmt.Printf("Volume Name: %s\n", info.Name)
+	fmt.Printf("Volume ID: %d\n", info.ID)
+	fmt.Printf("Type: %s\n", info.Type)
+	fmt.Printf("Size: %s\n", bytesOrIbytes(info.Size, outputAsSI))
+	fmt.Printf("Replication: %d\n", info.Replication)
+	fmt.Printf("Block Spec: %s\n", info.BlockSpec)
+	fmt.Printf("Block Size: %s\n", bytesOrIbytes(info.BlockSize, outputAsSI))
+	fmt.Printf("Consistency: %s\n", info.Consistency)
+	fmt.Printf("Cache Policy: %s\n", info.CachePolicy)
+	fmt.Printf("Encrypted: %t\n", info.Encrypted)
+	if info.QoS != nil {
+		fmt.Printf("QoS: %s\n", formatQoS(*info.QoS))
+	} else {
+		fmt.Printf("QoS: unlimited\n")
+	}
+	fmt.Printf("Snapshots: %d\n", info.Snapshots)
+	if len(info.Labels) != 0 {
+		fmt.Printf("Labels: %s\n", torus.FormatLabels(info.Labels))
+	}
+	fmt.Printf("Status: %s\n", info.Status)
+	fmt.Printf("Blocks: %d total, %d allocated, %d sparse\n", info.TotalBlocks, info.AllocatedBlocks, info.SparseBlocks)
+	fmt.Printf("Used: %s\n", bytesOrIbytes(info.UsedBytes, outputAsSI))
+}
+
+func blockVolumeUsage(srv *torus.Server, name string) *block.VolumeUsage {
+	blockvol, err := block.OpenBlockVolume(srv, name)
+	if err != nil {
+		die("couldn't open block volume %s: %v", name, err)
+	}
+	usage, err := blockvol.Usage()
+	if err != nil {
+		die("couldn't read block map of volume %s: %v", name, err)
+	}
+	return usage
 }
 
 func volumeDeleteAction(cmd *cobra.Command, args []string) {
@@ -98,24 +354,198 @@ func volumeDeleteAction(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	name := args[0]
+	c := mustConnect()
+	mds := c.MetadataService()
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	err = c.DeleteVolume(context.Background(), name, block.DeleteOptions{
+		Force:  deleteForce,
+		Secure: deleteSecure,
+	})
+	if err == torus.ErrLocked {
+		die("cannot delete volume: %s is attached (use --force to delete it anyway)", name)
+	}
+	if _, ok := err.(*block.ReadersError); ok {
+		die("cannot delete volume: %v (use --force to delete it anyway)", err)
+	}
+	if err != nil {
+		die("cannot delete volume: %v", err)
+	}
+	requestReclaim(c, name)
+	if deleteWait || deleteSecure {
+		waitForReclaim(mds, vol, deleteSecure)
+	}
+}
+
+// deletedVolumes summarizes the deleted volumes whose blocks are still being
+// reclaimed.
+func deletedVolumes(mds torus.MetadataService) []volumeSummary {
+	gc, ok := mds.(torus.GCController)
+	if !ok {
+		return nil
+	}
+	tombs, err := gc.GetTombstones()
+	if err != nil {
+		die("error listing deleted volumes: %v", err)
+	}
+	sort.Sort(tombstonesByName(tombs))
+	var out []volumeSummary
+	for _, t := range tombs {
+		status := "deleted"
+		if t.Secure {
+			status = "deleted, erasing"
+		}
+		out = append(out, volumeSummary{
+			Name:   t.Name,
+			ID:     t.ID,
+			Type:   t.Type,
+			Size:   t.Size,
+			Status: status,
+		})
+	}
+	return out
+}
+
+type tombstonesByName []torus.VolumeTombstone
+
+func (s tombstonesByName) Len() int           { return len(s) }
+func (s tombstonesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s tombstonesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// reclaimStatus is how far the peers have got in reclaiming the blocks of a
+// deleted volume.
+type reclaimStatus struct {
+	Name      string `json:"name"`
+	Reclaimed uint64 `json:"reclaimed"`
+	// Total counts the blocks reclaimed and left behind by the peers that
+	// have reported on the volume so far.
+	Total     uint64 `json:"total"`
+	Peers     int    `json:"peers"`
+	PeersDone int    `json:"peers_done"`
+	Done      bool   `json:"done"`
+	// Secure is set if the blocks are overwritten before they are
+	// reclaimed, Erased counting those that have been.
+	Secure bool   `json:"secure,omitempty"`
+	Erased uint64 `json:"erased,omitempty"`
+}
+
+// waitForReclaim reports the progress of reclaiming the blocks of deleted
+// volume vol, and of erasing them if secure, until its tombstone is gone.
+func waitForReclaim(mds torus.MetadataService, vol *models.Volume, secure bool) {
+	gc, ok := mds.(torus.GCController)
+	if !ok {
+		die("metadata service doesn't track the reclaiming of deleted volumes")
+	}
+	st := reclaimStatus{Name: vol.Name, Secure: secure}
+	for {
+		tombs, err := gc.GetTombstones()
+		if err != nil {
+			die("couldn't get deleted volumes: %v", err)
+		}
+		st.Done = true
+		for _, t := range tombs {
+			if t.ID == vol.Id {
+				st.Done = false
+			}
+		}
+		if !st.Done {
+			statuses, err := gc.GetGCStatuses()
+			if err != nil {
+				die("couldn't get gc status: %v", err)
+			}
+			ring, err := mds.GetRing()
+			if err != nil {
+				die("couldn't get ring: %v", err)
+			}
+			peers := ring.Members()
+			p, done := torus.ReclaimProgress(vol.Id, peers, statuses)
+			st.Reclaimed = p.Reclaimed
+			st.Erased = p.Erased
+			st.Total = p.Reclaimed + p.Remaining
+			st.Peers = len(peers)
+			st.PeersDone = done
+		} else {
+			st.PeersDone = st.Peers
+			st.Total = st.Reclaimed
+		}
+		printOutput(st, func() { printReclaimStatus(st) })
+		if st.Done {
+			return
+		}
+		time.Sleep(deletePoll)
+	}
+}
+
+const reclaimBarWidth = 40
+
+func printReclaimStatus(st reclaimStatus) {
+	frac := 0.0
+	if st.Total != 0 {
+		frac = float64(st.Reclaimed) / float64(st.Total)
+	}
+	if st.Done {
+		frac = 1
+	}
+	n := int(frac * reclaimBarWidth)
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", reclaimBarWidth-n)
+	if st.Secure {
+		fmt.Fprintf(os.Stderr, "\r[%s] %d/%d blocks erased and reclaimed, %d/%d peers done", bar, st.Reclaimed, st.Total, st.PeersDone, st.Peers)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r[%s] %d/%d blocks reclaimed, %d/%d peers done", bar, st.Reclaimed, st.Total, st.PeersDone, st.Peers)
+	}
+	if st.Done && st.Secure {
+		fmt.Fprintf(os.Stderr, "\nvolume %s erased and reclaimed on every peer\n", st.Name)
+	} else if st.Done {
+		fmt.Fprintf(os.Stderr, "\nvolume %s reclaimed\n", st.Name)
+	}
+}
+
+func volumeSetConsistencyAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name, level := args[0], args[1]
+	if level == "default" {
+		level = ""
+	}
 	mds := mustConnectToMDS()
 	vol, err := mds.GetVolume(name)
 	if err != nil {
 		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
 	}
-	switch vol.Type {
-	case "block":
-		err = block.DeleteBlockVolume(mds, name)
-	default:
+	if vol.Type != block.VolumeType {
 		die("unknown volume type %s", vol.Type)
 	}
+	if err := block.SetBlockVolumeConsistency(mds, name, level); err != nil {
+		die("error setting consistency of volume %s: %v", name, err)
+	}
+}
+
+func volumeSetCachePolicyAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(name)
 	if err != nil {
-		die("cannot delete volume: %v", err)
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	if vol.Type != block.VolumeType {
+		die("unknown volume type %s", vol.Type)
+	}
+	if err := block.SetBlockVolumeCachePolicy(mds, name, args[1]); err != nil {
+		die("error setting cache policy of volume %s: %v", name, err)
 	}
 }
 
 func volumeCreateBlockAction(cmd *cobra.Command, args []string) {
-	mds := mustConnectToMDS()
+	c := mustConnect()
+	mds := c.MetadataService()
 	if len(args) != 2 {
 		cmd.Usage()
 		os.Exit(1)
@@ -124,10 +554,39 @@ func volumeCreateBlockAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("error parsing size %s: %v", args[1], err)
 	}
-	err = block.CreateBlockVolume(mds, args[0], size)
+	labels, err := torus.ParseLabels(volumeLabels)
+	if err != nil {
+		die("error parsing labels: %v", err)
+	}
+	var spec torus.BlockLayerSpec
+	if volumeBlockSpec != "" {
+		v := volumeBlockSpec
+		if !strings.HasSuffix(v, ",base") && !strings.HasPrefix(v, "base") {
+			v += ",base"
+		}
+		spec, err = blockset.ParseBlockLayerSpec(v)
+		if err != nil {
+			die("error parsing blockspec %s: %v", volumeBlockSpec, err)
+		}
+	}
+	if encrypted {
+		var master []byte
+		master, err = blockset.LoadMasterKey(flagconfig.BuildConfigFromFlags())
+		if err != nil {
+			die("can't create encrypted volume %s: %v", args[0], err)
+		}
+		err = c.CreateEncryptedBlockVolume(context.Background(), args[0], size, spec, labels, master)
+	} else {
+		err = c.CreateBlockVolume(context.Background(), args[0], size, spec, labels)
+	}
 	if err != nil {
 		die("error creating volume %s: %v", args[0], err)
 	}
+	if q := qosFromFlags(cmd, block.QoS{}); q.Limited() {
+		if err := block.SetBlockVolumeQoS(mds, args[0], q); err != nil {
+			die("volume %s created, but couldn't set its QoS limits: %v", args[0], err)
+		}
+	}
 }
 
 func volumeCreateBlockFromSnapshotAction(cmd *cobra.Command, args []string) error {
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var volumeLabelCommand = &cobra.Command{
+	Use:   "label",
+	Short: "manage the labels of a volume",
+}
+
+var volumeLabelAddCommand = &cobra.Command{
+	Use:   "add NAME KEY=VALUE...",
+	Short: "label a volume",
+	Long: `add labels volume NAME with each KEY=VALUE, replacing the value of a label it
+already has. Keys are up to 63 letters, digits and any of "-_./", starting
+with a letter or digit; values are up to 255 letters, digits and any of
+"-_.". A volume has at most 64 labels.`,
+	Run: volumeLabelAddAction,
+}
+
+var volumeLabelRemoveCommand = &cobra.Command{
+	Use:   "remove NAME KEY...",
+	Short: "take labels off a volume",
+	Run:   volumeLabelRemoveAction,
+}
+
+var (
+	// volumeLabels are the labels create-block gives the new volume, and
+	// volumeSelectors those the volumes listed must have.
+	volumeLabels    []string
+	volumeSelectors []string
+)
+
+func init() {
+	volumeCommand.AddCommand(volumeLabelCommand)
+	volumeLabelCommand.AddCommand(volumeLabelAddCommand)
+	volumeLabelCommand.AddCommand(volumeLabelRemoveCommand)
+	for _, c := range []*cobra.Command{volumeCreateBlockCommand, blockCreateCommand} {
+		c.Flags().StringSliceVarP(&volumeLabels, "label", "", nil, "label the volume with key=value (repeatable)")
+	}
+	volumeListCommand.Flags().StringSliceVarP(&volumeSelectors, "selector", "l", nil, "only list the volumes labelled key=value (repeatable; volumes must match all)")
+}
+
+func volumeLabelAddAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	labels, err := torus.ParseLabels(args[1:])
+	if err != nil {
+		die("error parsing labels: %v", err)
+	}
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	if vol.Type != block.VolumeType {
+		die("unknown volume type %s", vol.Type)
+	}
+	if err := block.SetBlockVolumeLabels(mds, name, labels, nil); err != nil {
+		die("error labelling volume %s: %v", name, err)
+	}
+}
+
+func volumeLabelRemoveAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	if vol.Type != block.VolumeType {
+		die("unknown volume type %s", vol.Type)
+	}
+	for _, k := range args[1:] {
+		if _, ok := vol.Labels[k]; !ok {
+			die("volume %s has no label %s", name, k)
+		}
+	}
+	if err := block.SetBlockVolumeLabels(mds, name, nil, args[1:]); err != nil {
+		die("error removing labels of volume %s: %v", name, err)
+	}
+}
+
+// parseSelectors parses the --selector flags of volume list.
+func parseSelectors() map[string]string {
+	sel, err := torus.ParseLabels(volumeSelectors)
+	if err != nil {
+		die("error parsing selector: %v", err)
+	}
+	return sel
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alternative-storage/torus/block"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var volumeQoSCommand = &cobra.Command{
+	Use:   "qos",
+	Short: "manage the IOPS and bandwidth limits of a volume",
+}
+
+var volumeQoSSetCommand = &cobra.Command{
+	Use:   "set NAME",
+	Short: "set the IOPS and bandwidth limits of a volume",
+	Long: `set limits the reads and writes to volume NAME, on the node it's attached
+to, to --max-iops a second and --max-bandwidth bytes a second. A volume that
+has been idle can go over them for a while, spending up to --burst worth of its
+allowance at once. Limits not given are left as they were; a limit of 0 lifts
+it. Attached volumes pick up the new limits within a few seconds.`,
+	Run: volumeQoSSetAction,
+}
+
+var volumeQoSShowCommand = &cobra.Command{
+	Use:   "show NAME",
+	Short: "show the IOPS and bandwidth limits of a volume",
+	Run:   volumeQoSShowAction,
+}
+
+var (
+	qosMaxIOPS      uint64
+	qosMaxBandwidth string
+	qosBurst        time.Duration
+)
+
+func init() {
+	volumeCommand.AddCommand(volumeQoSCommand)
+	volumeQoSCommand.AddCommand(volumeQoSSetCommand)
+	volumeQoSCommand.AddCommand(volumeQoSShowCommand)
+	for _, c := range []*cobra.Command{volumeQoSSetCommand, volumeCreateBlockCommand, blockCreateCommand} {
+		c.Flags().Uint64VarP(&qosMaxIOPS, "max-iops", "", 0, "most reads and writes a second allowed to the volume (0 is unlimited)")
+		c.Flags().StringVarP(&qosMaxBandwidth, "max-bandwidth", "", "0", "most bytes a second allowed to be read and written to the volume, such as 100MiB (0 is unlimited)")
+		c.Flags().DurationVarP(&qosBurst, "burst", "", time.Second, "how much of its allowance an idle volume can save up, to spend at once")
+	}
+	volumeQoSShowCommand.Flags().BoolVarP(&outputAsSI, "si", "", false, "output sizes in powers of 1000")
+}
+
+// qosFromFlags returns q with the limits given on the command line of cmd
+// in place of its own.
+func qosFromFlags(cmd *cobra.Command, q block.QoS) block.QoS {
+	f := cmd.Flags()
+	if f.Changed("max-iops") {
+		q.MaxIOPS = qosMaxIOPS
+	}
+	if f.Changed("max-bandwidth") {
+		bps, err := humanize.ParseBytes(qosMaxBandwidth)
+		if err != nil {
+			die("error parsing bandwidth %s: %v", qosMaxBandwidth, err)
+		}
+		q.MaxBytesPerSec = bps
+	}
+	if f.Changed("burst") {
+		if qosBurst <= 0 {
+			die("--burst must be positive")
+		}
+		q.Burst = qosBurst
+	}
+	return q
+}
+
+func volumeQoSSetAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	if vol.Type != block.VolumeType {
+		die("unknown volume type %s", vol.Type)
+	}
+	q := qosFromFlags(cmd, block.VolumeQoS(vol))
+	if err := block.SetBlockVolumeQoS(mds, name, q); err != nil {
+		die("error setting QoS limits of volume %s: %v", name, err)
+	}
+}
+
+func volumeQoSShowAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+	}
+	q := block.VolumeQoS(vol)
+	printOutput(q, func() { fmt.Println(formatQoS(q)) })
+}
+
+// formatQoS describes the limits of q in a line.
+func formatQoS(q block.QoS) string {
+	if !q.Limited() {
+		return "unlimited"
+	}
+	var limits []string
+	if q.MaxIOPS != 0 {
+		limits = append(limits, fmt.Sprintf("%d IOPS", q.MaxIOPS))
+	}
+	if q.MaxBytesPerSec != 0 {
+		limits = append(limits, bytesOrIbytes(q.MaxBytesPerSec, outputAsSI)+"/s")
+	}
+	burst := q.Burst
+	if burst == 0 {
+		burst = time.Second
+	}
+	return fmt.Sprintf("%s, burst %v", strings.Join(limits, ", "), burst)
+}
@@ -38,7 +38,7 @@ func wipeAction(cmd *cobra.Command, args []string) {
 		}
 	}
 	cfg := flagconfig.BuildConfigFromFlags()
-	err := torus.WipeMDS("etcd", cfg)
+	err := torus.WipeMDS(torus.MetadataServiceFor(cfg), cfg)
 	if err != nil {
 		die("error wiping metadata: %v", err)
 	}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/distributor"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+)
+
+// atRiskBlock is a block left with fewer copies than the ring asks for by an
+// eviction.
+type atRiskBlock struct {
+	Volume  string   `json:"volume"`
+	Block   string   `json:"block"`
+	Want    int      `json:"want"`
+	Have    int      `json:"have"`
+	Holders []string `json:"holders"`
+}
+
+// adminHandler only lets requests through that carry the admin token as a
+// bearer token.
+func adminHandler(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// evictPeerHandler removes the peer named by the uuid parameter from the ring
+// at once, for nodes that are never coming back, and reports the blocks that
+// are left under-replicated.
+func evictPeerHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		uuid := r.FormValue("uuid")
+		if uuid == "" {
+			http.Error(w, "missing uuid", http.StatusBadRequest)
+			return
+		}
+		if uuid == srv.MDS.UUID() {
+			http.Error(w, "refusing to evict this node", http.StatusBadRequest)
+			return
+		}
+		old, err := torus.EvictPeer(srv.MDS, uuid)
+		e := torus.AuditEvent{
+			Op:      torus.AuditPeerEvict,
+			Source:  "admin " + r.RemoteAddr,
+			Details: map[string]string{"peer": uuid},
+			Err:     torus.AuditErr(err),
+		}
+		if err == nil {
+			e.RingVersion = old.Version() + 1
+		}
+		srv.Audit.Record(e)
+		if err == torus.ErrNoPeer {
+			http.Error(w, "peer is not in the ring", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		torus.RecordClusterEvent(srv.MDS, e)
+		fmt.Fprintf(os.Stderr, "WARNING: evicted peer %s from the ring. Blocks it held are under-replicated until a rebalance restores them.\n", uuid)
+		atRisk, unreachable, err := evictedAtRisk(srv, old, uuid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("evicted %s, but couldn't find the blocks at risk: %v", uuid, err), http.StatusInternalServerError)
+			return
+		}
+		if len(atRisk) != 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: %d blocks have fewer copies than the ring asks for after evicting %s\n", len(atRisk), uuid)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Evicted          string            `json:"evicted"`
+			AtRisk           []atRiskBlock     `json:"at_risk"`
+			UnreachablePeers map[string]string `json:"unreachable_peers,omitempty"`
+		}{
+			Evicted:          uuid,
+			AtRisk:           atRisk,
+			UnreachablePeers: unreachable,
+		})
+	})
+}
+
+// cacheHandler resizes the block cache to the size parameter, such as 10GiB,
+// and reports the cache as it is afterwards.
+func cacheHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		size, err := humanize.ParseBytes(r.FormValue("size"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad size: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := distributor.ResizeCache(srv, size); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		c, _ := distributor.GetCacheStats(srv)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	})
+}
+
+// storageHandler resizes the local storage of the node to the size
+// parameter, given as bytes or a percentage of the disk, as with --size: once
+// for every data directory, or once for each of them. The capacity the node
+// is weighted by in the ring is updated to match.
+func storageHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.ParseForm()
+		sizeStrs := r.Form["size"]
+		if len(sizeStrs) == 0 {
+			http.Error(w, "missing size", http.StatusBadRequest)
+			return
+		}
+		_, sizes, err := parseDataDirs(srv.Cfg.DataDir, sizeStrs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad size: %v", err), http.StatusBadRequest)
+			return
+		}
+		uuid := srv.MDS.UUID()
+		before := srv.Blocks.NumBlocks()
+		err = distributor.ResizeStorage(srv, sizes)
+		total := srv.Blocks.NumBlocks()
+		e := torus.AuditEvent{
+			Op:     torus.AuditPeerResize,
+			Source: "admin " + r.RemoteAddr,
+			Details: map[string]string{
+				"peer":   uuid,
+				"blocks": fmt.Sprintf("%d", before),
+				"to":     fmt.Sprintf("%d", total),
+			},
+			Err: torus.AuditErr(err),
+		}
+		if err == nil {
+			old, rerr := torus.ReweighPeer(srv.MDS, uuid, total)
+			switch rerr {
+			case nil:
+				e.RingVersion = old.Version() + 1
+			case torus.ErrNoPeer, torus.ErrNotSupported, torus.ErrExists:
+			default:
+				err = fmt.Errorf("resized storage, but couldn't reweigh the ring: %v", rerr)
+				e.Err = torus.AuditErr(err)
+			}
+		}
+		srv.Audit.Record(e)
+		if _, ok := err.(*torus.ShrinkError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		torus.RecordClusterEvent(srv.MDS, e)
+		blockSize := srv.Blocks.BlockSize()
+		used := srv.Blocks.UsedBlocks()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			TotalBlocks uint64 `json:"total_blocks"`
+			UsedBlocks  uint64 `json:"used_blocks"`
+			TotalBytes  uint64 `json:"total_bytes"`
+			UsedBytes   uint64 `json:"used_bytes"`
+			RingVersion int    `json:"ring_version,omitempty"`
+		}{
+			TotalBlocks: total,
+			UsedBlocks:  used,
+			TotalBytes:  total * blockSize,
+			UsedBytes:   used * blockSize,
+			RingVersion: e.RingVersion,
+		})
+	})
+}
+
+// evictedAtRisk finds the blocks of every block volume that old placed on the
+// evicted peer and that are now under-replicated.
+func evictedAtRisk(srv *torus.Server, old torus.Ring, uuid string) ([]atRiskBlock, map[string]string, error) {
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, nil, err
+	}
+	out := []atRiskBlock{}
+	unreachable := make(map[string]string)
+	for _, v := range vols {
+		if v.Type != block.VolumeType {
+			continue
+		}
+		vol, err := block.OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs, err := vol.ReferencedBlocks()
+		if err != nil {
+			return nil, nil, err
+		}
+		reps, peerErrs, err := distributor.AtRiskBlocks(context.Background(), srv, old, uuid, refs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for p, err := range peerErrs {
+			unreachable[p] = err.Error()
+		}
+		for _, r := range reps {
+			out = append(out, atRiskBlock{
+				Volume:  v.Name,
+				Block:   r.Ref.String(),
+				Want:    r.Want,
+				Have:    len(r.Holders),
+				Holders: r.Holders,
+			})
+		}
+	}
+	return out, unreachable, nil
+}
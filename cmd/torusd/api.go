@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor"
+	"github.com/alternative-storage/torus/ring"
+)
+
+// apiPrefix is the path the admin API is served under, on the --http
+// listener.
+const apiPrefix = "/api/v1/"
+
+// newAPIHandler serves the admin API of srv. Its GET endpoints report on the
+// node and the cluster as the node sees them; its POST endpoints change the
+// node, and need token as a bearer token. They are refused without one.
+// Nodes joining the cluster fetch its join info from join, with joinToken if
+// it is set.
+func newAPIHandler(srv *torus.Server, token, joinToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(apiPrefix+"join", joinHandler(srv, joinToken))
+	mux.Handle(apiPrefix+"status", apiGet(apiStatusHandler(srv)))
+	mux.Handle(apiPrefix+"peers", apiGet(apiPeersHandler(srv)))
+	mux.Handle(apiPrefix+"volumes", apiGet(apiVolumesHandler(srv)))
+	mux.Handle(apiPrefix+"ring", apiGet(apiRingHandler(srv)))
+	mux.Handle(apiPrefix+"rebalance", apiGet(rebalanceHandler(srv)))
+	mux.Handle(apiPrefix+"cache", apiMethods(map[string]http.Handler{
+		"GET":  apiCacheHandler(srv),
+		"POST": apiAdmin(token, cacheHandler(srv)),
+	}))
+	mux.Handle(apiPrefix+"scrub", apiMethods(map[string]http.Handler{
+		"POST": apiAdmin(token, apiScrubHandler(srv)),
+	}))
+	mux.Handle(apiPrefix+"storage", apiMethods(map[string]http.Handler{
+		"POST": apiAdmin(token, storageHandler(srv)),
+	}))
+	mux.Handle(apiPrefix+"evict-peer", apiMethods(map[string]http.Handler{
+		"POST": apiAdmin(token, evictPeerHandler(srv)),
+	}))
+	mux.Handle(apiPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusNotFound, "no such endpoint")
+	}))
+	return mux
+}
+
+// apiError answers a request with msg as a JSON error.
+func apiError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// apiJSON answers a request with v.
+func apiJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// apiMethods passes requests on to the handler for their method.
+func apiMethods(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.Method]
+		if !ok {
+			apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func apiGet(h http.Handler) http.Handler {
+	return apiMethods(map[string]http.Handler{"GET": h})
+}
+
+// apiAdmin lets requests through to h that carry token as a bearer token,
+// and refuses all of them if there is no token.
+func apiAdmin(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiError(w, http.StatusForbidden, "changes through the admin API are disabled; start torusd with --admin-token-file to enable them")
+		})
+	}
+	return adminHandler(token, h)
+}
+
+// apiStatus is what /api/v1/status reports about a node.
+type apiStatus struct {
+	UUID         string                         `json:"uuid"`
+	Version      string                         `json:"version,omitempty"`
+	RingVersion  int                            `json:"ring_version"`
+	Ready        bool                           `json:"ready"`
+	ShuttingDown bool                           `json:"shutting_down"`
+	LeaseError   string                         `json:"lease_error,omitempty"`
+	Rebalance    torus.RebalanceProgress        `json:"rebalance"`
+	Cache        *distributor.CacheStats        `json:"cache,omitempty"`
+	Storage      *torus.BlockStoreStats         `json:"storage,omitempty"`
+	Scrub        *torus.ScrubStatus             `json:"scrub,omitempty"`
+	Reconcile    *distributor.ReconcileProgress `json:"reconcile,omitempty"`
+}
+
+func apiStatusHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rg, err := srv.MDS.GetRing()
+		if err != nil {
+			apiError(w, http.StatusServiceUnavailable, "couldn't get ring: "+err.Error())
+			return
+		}
+		st := apiStatus{
+			UUID:         srv.MDS.UUID(),
+			Version:      torus.Version,
+			RingVersion:  rg.Version(),
+			ShuttingDown: srv.ShuttingDown(),
+			Rebalance:    torus.NewRebalanceProgress(srv.MDS.UUID(), srv.RebalanceInfo(), time.Now()),
+		}
+		if err := srv.LeaseErr(); err != nil {
+			st.LeaseError = err.Error()
+		}
+		if c, ok := distributor.GetCacheStats(srv); ok {
+			st.Cache = &c
+		}
+		if s, ok := distributor.GetStorageStats(srv); ok {
+			st.Storage = &s
+		}
+		if t, ok := srv.MDS.(torus.ScrubTracker); ok && srv.Cfg.ScrubRate > 0 {
+			if s, err := t.GetScrubStatus(srv.MDS.UUID()); err == nil {
+				st.Scrub = &s
+			}
+		}
+		p, ok := distributor.GetReconcileProgress(srv)
+		if ok {
+			st.Reconcile = &p
+		}
+		st.Ready = ok && !p.Running && !distributor.WaitingForPeers(srv) && !st.ShuttingDown
+		apiJSON(w, st)
+	})
+}
+
+// apiPeer is a peer as this node sees it.
+type apiPeer struct {
+	UUID       string            `json:"uuid"`
+	Address    string            `json:"address,omitempty"`
+	InRing     bool              `json:"in_ring"`
+	ReadOnly   bool              `json:"read_only"`
+	TotalBytes uint64            `json:"total_bytes"`
+	UsedBytes  uint64            `json:"used_bytes"`
+	LastSeen   time.Time         `json:"last_seen"`
+	Zone       string            `json:"zone,omitempty"`
+	Rack       string            `json:"rack,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Version    string            `json:"version,omitempty"`
+	Protocol   uint64            `json:"protocol_version,omitempty"`
+}
+
+func apiPeersHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers, err := srv.MDS.GetPeers()
+		if err != nil {
+			apiError(w, http.StatusServiceUnavailable, "couldn't get peers: "+err.Error())
+			return
+		}
+		rg, err := srv.MDS.GetRing()
+		if err != nil {
+			apiError(w, http.StatusServiceUnavailable, "couldn't get ring: "+err.Error())
+			return
+		}
+		members := rg.Members()
+		blockSize := srv.MDS.GlobalMetadata().BlockSize
+		out := []apiPeer{}
+		for _, p := range peers {
+			out = append(out, apiPeer{
+				UUID:       p.UUID,
+				Address:    p.Address,
+				InRing:     members.Has(p.UUID),
+				ReadOnly:   p.ReadOnly,
+				TotalBytes: p.TotalBlocks * blockSize,
+				UsedBytes:  p.UsedBlocks * blockSize,
+				LastSeen:   time.Unix(0, p.LastSeen).UTC(),
+				Zone:       p.Zone,
+				Rack:       p.Rack,
+				Labels:     p.Labels,
+				Version:    p.Version,
+				Protocol:   p.ProtocolVersion,
+			})
+		}
+		apiJSON(w, struct {
+			Peers []apiPeer `json:"peers"`
+		}{out})
+	})
+}
+
+// apiVolume is a volume, without its wrapped data key.
+type apiVolume struct {
+	Name        string            `json:"name"`
+	ID          uint64            `json:"id"`
+	Type        string            `json:"type"`
+	Size        uint64            `json:"size"`
+	Consistency string            `json:"consistency,omitempty"`
+	CachePolicy string            `json:"cache_policy,omitempty"`
+	Encrypted   bool              `json:"encrypted"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+func apiVolumesHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vols, _, err := srv.MDS.GetVolumes()
+		if err != nil {
+			apiError(w, http.StatusServiceUnavailable, "couldn't get volumes: "+err.Error())
+			return
+		}
+		out := []apiVolume{}
+		for _, v := range vols {
+			out = append(out, apiVolume{
+				Name:        v.Name,
+				ID:          v.Id,
+				Type:        v.Type,
+				Size:        v.MaxBytes,
+				Consistency: v.Consistency,
+				CachePolicy: v.CachePolicy,
+				Encrypted:   len(v.WrappedKey) != 0,
+				Labels:      v.Labels,
+			})
+		}
+		apiJSON(w, struct {
+			Volumes []apiVolume `json:"volumes"`
+		}{out})
+	})
+}
+
+func apiRingHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rg, err := srv.MDS.GetRing()
+		if err != nil {
+			apiError(w, http.StatusServiceUnavailable, "couldn't get ring: "+err.Error())
+			return
+		}
+		members := rg.Members()
+		if members == nil {
+			members = torus.PeerList{}
+		}
+		apiJSON(w, struct {
+			Version     int            `json:"version"`
+			Type        string         `json:"type"`
+			Description string         `json:"description"`
+			Members     torus.PeerList `json:"members"`
+		}{
+			Version:     rg.Version(),
+			Type:        ring.RingTypeName(rg.Type()),
+			Description: rg.Describe(),
+			Members:     members,
+		})
+	})
+}
+
+func apiCacheHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := distributor.GetCacheStats(srv)
+		if !ok {
+			apiError(w, http.StatusNotFound, "this node has no block cache")
+			return
+		}
+		apiJSON(w, c)
+	})
+}
+
+// apiScrubHandler starts a scrub pass of this node's storage right away.
+func apiScrubHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := distributor.TriggerScrub(srv); err != nil {
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			Scrubbing bool `json:"scrubbing"`
+		}{true})
+	})
+}
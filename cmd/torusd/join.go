@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// joinInfoFile is where a node bootstrapped by --join keeps what it was
+	// told, under the metadata directory of its first data directory.
+	joinInfoFile = "join.json"
+	// joinTimeout bounds the request for the join info.
+	joinTimeout = 30 * time.Second
+)
+
+// joinInfo is what a node of a cluster tells a node joining it: how to reach
+// the metadata service and what the cluster expects of its peers.
+type joinInfo struct {
+	MetadataAddress string `json:"metadata_address"`
+	MetadataPrefix  string `json:"metadata_prefix,omitempty"`
+	// MetadataTLS is set if the metadata service is reached over TLS, and
+	// PeerTLS if peers replicate over TLS only.
+	MetadataTLS bool                 `json:"metadata_tls"`
+	PeerTLS     bool                 `json:"peer_tls"`
+	Global      torus.GlobalMetadata `json:"global"`
+	// JoinedVia is the node the info was fetched from.
+	JoinedVia string `json:"joined_via,omitempty"`
+}
+
+// joinHandler shares the join info of srv with nodes joining its cluster.
+// If token is set, the request must carry it as a bearer token.
+func joinHandler(srv *torus.Server, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				apiError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		apiJSON(w, joinInfo{
+			MetadataAddress: srv.Cfg.MetadataAddress,
+			MetadataPrefix:  srv.Cfg.MetadataPrefix,
+			MetadataTLS:     srv.Cfg.TLS != nil,
+			PeerTLS:         srv.Cfg.PeerTLS(),
+			Global:          srv.MDS.GlobalMetadata(),
+		})
+	})
+}
+
+// fetchJoinInfo asks the node with the admin address addr for the join info
+// of its cluster. Metadata addresses on the loopback interface, which only
+// mean something on that node, are rewritten to its host.
+func fetchJoinInfo(addr, token string) (joinInfo, error) {
+	var ji joinInfo
+	u, err := addrToUri(addr)
+	if err != nil {
+		return ji, fmt.Errorf("invalid join address %s: %v", addr, err)
+	}
+	u.Path = apiPrefix + "join"
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return ji, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: joinTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ji, fmt.Errorf("couldn't reach %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return ji, fmt.Errorf("%s refused to share its cluster: %s %s", addr, resp.Status, e.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ji); err != nil {
+		return ji, fmt.Errorf("couldn't decode the join info from %s: %v", addr, err)
+	}
+	if ji.MetadataAddress == "" {
+		return ji, fmt.Errorf("%s keeps its metadata in memory, so no other node can join it", addr)
+	}
+	if ji.Global.BlockSize == 0 {
+		return ji, fmt.Errorf("%s sent no cluster metadata", addr)
+	}
+	ji.MetadataAddress = replaceLoopback(ji.MetadataAddress, u.Hostname())
+	ji.JoinedVia = u.String()
+	return ji, nil
+}
+
+// replaceLoopback replaces the loopback hosts among the comma-separated
+// addresses of list with host, keeping their ports.
+func replaceLoopback(list, host string) string {
+	addrs := strings.Split(list, ",")
+	for i, a := range addrs {
+		u, err := addrToUri(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		h := u.Hostname()
+		if ip := net.ParseIP(h); h != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			continue
+		}
+		if p := u.Port(); p != "" {
+			u.Host = net.JoinHostPort(host, p)
+		} else {
+			u.Host = host
+		}
+		addrs[i] = u.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// readJoinInfo reads the join info kept in the metadata directory dir, and
+// reports whether there was any.
+func readJoinInfo(dir string) (joinInfo, bool, error) {
+	var ji joinInfo
+	b, err := ioutil.ReadFile(filepath.Join(dir, "metadata", joinInfoFile))
+	if os.IsNotExist(err) {
+		return ji, false, nil
+	}
+	if err != nil {
+		return ji, false, err
+	}
+	if err := json.Unmarshal(b, &ji); err != nil {
+		return ji, false, fmt.Errorf("couldn't parse %s: %v", joinInfoFile, err)
+	}
+	return ji, true, nil
+}
+
+func writeJoinInfo(dir string, ji joinInfo) error {
+	if err := torus.MkdirsFor(dir); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ji, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "metadata", joinInfoFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// initialized reports whether the metadata directory dir belongs to a node
+// that has run before.
+func initialized(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "metadata", "uuid"))
+	return err == nil
+}
+
+// joinCluster bootstraps this node from the node at addr: it fetches the join
+// info, keeps it in the data directory, and points cfg at the cluster's
+// metadata service unless the flags of cmd already do. A node that joined
+// before uses the join info it kept, and one set up by hand is left as it is.
+// It returns the join info in use, if any.
+func joinCluster(cfg *torus.Config, cmd *cobra.Command, addr, token string) (*joinInfo, error) {
+	dir := cfg.MetadataDir()
+	if dir == "" {
+		return nil, fmt.Errorf("--join needs a data directory")
+	}
+	ji, ok, err := readJoinInfo(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ok:
+		fmt.Fprintf(os.Stderr, "already joined the cluster through %s; using the metadata service at %s\n", ji.JoinedVia, ji.MetadataAddress)
+	case initialized(dir):
+		fmt.Fprintf(os.Stderr, "%s belongs to a node that has run before; ignoring --join\n", dir)
+		return nil, nil
+	default:
+		ji, err = fetchJoinInfo(addr, token)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeJoinInfo(dir, ji); err != nil {
+			return nil, fmt.Errorf("couldn't keep the join info: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "joining the cluster through %s, with its metadata service at %s\n", ji.JoinedVia, ji.MetadataAddress)
+	}
+	if ji.MetadataTLS && cfg.TLS == nil {
+		return nil, fmt.Errorf("the metadata service of the cluster is reached over TLS; give --etcd-cert-file, --etcd-key-file and --etcd-ca-file")
+	}
+	if ji.PeerTLS && !cfg.PeerTLS() {
+		return nil, fmt.Errorf("peers of the cluster replicate over TLS only; give --peer-cert-file, --peer-key-file and --peer-ca-file")
+	}
+	if !cmd.Flags().Changed("etcd") {
+		cfg.MetadataAddress = ji.MetadataAddress
+		if cfg.TLS != nil {
+			u, err := addrToUri(strings.Split(ji.MetadataAddress, ",")[0])
+			if err == nil {
+				cfg.TLS.ServerName = u.Hostname()
+			}
+		}
+	}
+	if !cmd.Flags().Changed("metadata-prefix") {
+		cfg.MetadataPrefix = ji.MetadataPrefix
+	}
+	return &ji, nil
+}
+
+// checkJoined checks that the metadata service srv connected to belongs to
+// the cluster described by ji.
+func checkJoined(srv *torus.Server, ji *joinInfo) error {
+	gmd := srv.MDS.GlobalMetadata()
+	have := blockset.FormatBlockLayerSpec(gmd.DefaultBlockSpec)
+	want := blockset.FormatBlockLayerSpec(ji.Global.DefaultBlockSpec)
+	if gmd.BlockSize != ji.Global.BlockSize || have != want {
+		return fmt.Errorf("the metadata service has block size %d and block spec %s, but the cluster joined through %s has %d and %s; remove %s from the data directory to join again",
+			gmd.BlockSize, have, ji.JoinedVia, ji.Global.BlockSize, want, joinInfoFile)
+	}
+	return nil
+}
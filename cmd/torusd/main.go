@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -9,11 +13,14 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/dustin/go-humanize"
 	"github.com/ricochet2200/go-disk-usage/du"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/blockset"
@@ -21,28 +28,57 @@ import (
 	"github.com/alternative-storage/torus/internal/flagconfig"
 	"github.com/alternative-storage/torus/models"
 	"github.com/alternative-storage/torus/ring"
+	"github.com/alternative-storage/torus/storage"
 	"github.com/alternative-storage/torus/tracing"
 
 	// Register all the possible drivers.
 	_ "github.com/alternative-storage/torus/block"
+	_ "github.com/alternative-storage/torus/metadata/consul"
 	_ "github.com/alternative-storage/torus/metadata/etcd"
 	_ "github.com/alternative-storage/torus/metadata/temp"
-	_ "github.com/alternative-storage/torus/storage"
 	_ "net/http/pprof"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	dataDir     string
-	blockDevice string
-	httpAddress string
-	peerAddress string
-	sizeStr     string
-	debugInit   bool
-	autojoin    bool
-	logpkg      string
-	cfg         torus.Config
+	dataDirs         []string
+	blockDevice      string
+	httpAddress      string
+	peerAddress      string
+	advertiseAddress string
+	sizeStrs         []string
+	debugInit        bool
+	debugInitRing    string
+	initRingType     torus.RingType
+	autojoin         bool
+	witness          bool
+	zone             string
+	rack             string
+	labels           []string
+	minPeers         int
+	reconcileTimeout time.Duration
+	defragInterval   time.Duration
+	autoEvictAfter   time.Duration
+	autoEvictWindow  time.Duration
+	cordonTimeout    time.Duration
+	scrubRate        int
+	highWaterMark    int
+	lowWaterMark     int
+	storageIOMode    string
+	journalDir       string
+	shutdownTimeout  time.Duration
+	adminTokenFile   string
+	adminToken       string
+	joinAddress      string
+	joinTokenFile    string
+	joinToken        string
+	joined           *joinInfo
+	forceReclaim     bool
+	traceSampleRate  float64
+	logpkg           string
+	logFormat        string
+	cfg              torus.Config
 
 	debug      bool
 	version    bool
@@ -64,25 +100,44 @@ var rootCommand = &cobra.Command{
 
 func init() {
 	rootCommand.PersistentFlags().StringVarP(&blockDevice, "block-device", "", "", "Path to a torus formatted block device")
-	rootCommand.PersistentFlags().StringVarP(&dataDir, "data-dir", "", "torus-data", "Path to the data directory")
+	rootCommand.PersistentFlags().StringSliceVarP(&dataDirs, "data-dir", "", []string{"torus-data"}, "Path to a data directory, optionally as path=size (repeatable); blocks are spread across all of them, and the first holds the node's metadata")
 	rootCommand.PersistentFlags().BoolVarP(&debug, "debug", "", false, "Turn on debug output")
 	rootCommand.PersistentFlags().BoolVarP(&debugInit, "debug-init", "", false, "Run a default init for the MDS if one doesn't exist")
+	rootCommand.PersistentFlags().StringVarP(&debugInitRing, "ring-type", "", "ketama", "Type of ring --debug-init creates ("+strings.Join(ring.InitTypes(), ", ")+")")
 	rootCommand.PersistentFlags().StringVarP(&httpAddress, "http", "", "", "HTTP endpoint for debug and stats")
-	rootCommand.PersistentFlags().StringVarP(&peerAddress, "peer-address", "", "", "Address to listen on for intra-cluster data")
-	rootCommand.PersistentFlags().StringVarP(&sizeStr, "size", "", "1GiB", "How much disk space to use for this storage node")
+	rootCommand.PersistentFlags().StringVarP(&peerAddress, "peer-address", "", "", "Comma-separated addresses to listen on for intra-cluster data; the first is advertised to the ring unless --advertise-address is set")
+	rootCommand.PersistentFlags().StringVarP(&advertiseAddress, "advertise-address", "", "", "Address other nodes reach this one at, when it differs from the peer address (e.g. behind NAT)")
+	rootCommand.PersistentFlags().StringSliceVarP(&sizeStrs, "size", "", []string{"1GiB"}, "How much disk space to use in each data directory, as bytes or a percentage of its disk; one value per --data-dir, or one for all of them")
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
+	rootCommand.PersistentFlags().StringVarP(&logFormat, "log-format", "", "text", "Format of log output: text, or json for one JSON object per line")
 	rootCommand.PersistentFlags().BoolVarP(&autojoin, "auto-join", "", false, "Automatically join the storage pool")
+	rootCommand.PersistentFlags().BoolVarP(&witness, "witness", "", false, "Join the ring without storing any data, to make up the number of peers for small clusters")
+	rootCommand.PersistentFlags().StringVarP(&zone, "zone", "", "", "Zone (failure domain) this node runs in, used to spread replicas")
+	rootCommand.PersistentFlags().StringVarP(&rack, "rack", "", "", "Rack this node runs in, used to spread replicas within a zone")
+	rootCommand.PersistentFlags().StringSliceVarP(&labels, "label", "", nil, "Label of this node as key=value, e.g. rack=r1 (repeatable); ketama-zones rings spread replicas by one")
+	rootCommand.PersistentFlags().IntVarP(&minPeers, "min-peers", "", 0, "Minimum number of peers the ring must contain before this node is ready and accepts writes")
+	rootCommand.PersistentFlags().DurationVarP(&reconcileTimeout, "rejoin-reconcile-timeout", "", 10*time.Minute, "How long to spend reconciling local blocks when auto-join finds this node already in the ring")
+	rootCommand.PersistentFlags().DurationVarP(&defragInterval, "defrag-interval", "", 0, "How often to compact the blocks of mfile storage while it's idle (0 disables it)")
+	rootCommand.PersistentFlags().DurationVarP(&autoEvictAfter, "auto-evict-after", "", 0, "Evict a ring member from the ring once it has stopped reporting for this long (0 disables it); set it alike on every node")
+	rootCommand.PersistentFlags().DurationVarP(&autoEvictWindow, "auto-evict-window", "", time.Hour, "Least time between two peers evicted by --auto-evict-after")
+	rootCommand.PersistentFlags().DurationVarP(&cordonTimeout, "cordon-timeout", "", torus.DefaultCordonTimeout, "How long a cordoned peer that stops reporting is spared from --auto-evict-after, counted from when it was cordoned")
+	rootCommand.PersistentFlags().IntVarP(&scrubRate, "scrub-rate", "", 0, "MB/s at which to read back local blocks and check them against their checksums (0 disables it)")
+	rootCommand.PersistentFlags().IntVarP(&highWaterMark, "high-water-mark", "", 95, "Percentage of --size past which this node takes no new blocks (0 only stops it when the disk is full)")
+	rootCommand.PersistentFlags().IntVarP(&lowWaterMark, "low-water-mark", "", 90, "Percentage of --size under which a node stopped by --high-water-mark or a full disk takes new blocks again")
+	rootCommand.PersistentFlags().StringVarP(&storageIOMode, "storage-io-mode", "", storage.IOModeMmap, "How local storage reads and writes blocks ("+strings.Join(storage.IOModes, ", ")+"); direct bypasses the page cache")
+	rootCommand.PersistentFlags().StringVarP(&journalDir, "journal-dir", "", "", "Directory to journal block writes in before applying them, so a crash can't leave blocks torn; best on a fast device")
+	rootCommand.PersistentFlags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", 30*time.Second, "How long to wait for in-flight writes and a clean shutdown on SIGINT or SIGTERM before forcing exit")
+	rootCommand.PersistentFlags().Float64VarP(&traceSampleRate, "trace-sample-rate", "", jaeger.DefaultSampleRate, "Fraction of block operations begun on this node to trace with Jaeger (0 to 1)")
+	rootCommand.PersistentFlags().StringVarP(&adminTokenFile, "admin-token-file", "", "", "File holding the bearer token for the /admin endpoints and the changes made through /api/v1 (they are disabled without one)")
+	rootCommand.PersistentFlags().StringVarP(&joinAddress, "join", "", "", "HTTP address of a node of the cluster to join, such as http://10.0.0.1:4321; its metadata service and settings are kept in the data directory, and the node auto-joins the ring")
+	rootCommand.PersistentFlags().StringVarP(&joinTokenFile, "join-token-file", "", "", "File holding the token nodes must present to join the cluster through this one, or that this one presents with --join")
+	rootCommand.PersistentFlags().BoolVarP(&forceReclaim, "force-reclaim", "", false, "Wipe the local storage before starting, to reuse storage of another cluster; the node starts as a new one")
 	rootCommand.PersistentFlags().BoolVarP(&version, "version", "", false, "Print version info and exit")
 	rootCommand.PersistentFlags().BoolVarP(&completion, "completion", "", false, "Output bash completion code")
 	flagconfig.AddConfigFlags(rootCommand.PersistentFlags())
 }
 
 func main() {
-	hostname, _ := os.Hostname()
-	if err := jaeger.Init("torusd:" + hostname); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
 	if err := rootCommand.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -90,6 +145,12 @@ func main() {
 }
 
 func configureServer(cmd *cobra.Command, args []string) {
+	if err := flagconfig.ApplyConfigFile(cmd.Flags(), "torusd"); err != nil {
+		die("%v", err)
+	}
+	if err := torus.SetLogFormat(logFormat); err != nil {
+		die("%v", err)
+	}
 	if version {
 		fmt.Printf("torusd\nVersion: %s\n", torus.Version)
 		os.Exit(0)
@@ -110,28 +171,231 @@ func configureServer(cmd *cobra.Command, args []string) {
 		rl.SetLogLevel(llc)
 	}
 
-	var (
-		err  error
-		size uint64
-	)
-	if strings.Contains(sizeStr, "%") {
-		percent, err := parsePercentage(sizeStr)
+	hostname, _ := os.Hostname()
+	if err := jaeger.Init("torusd:"+hostname, traceSampleRate); err != nil {
+		die("%v", err)
+	}
+
+	dirs, sizes, err := parseDataDirs(dataDirs, sizeStrs)
+	if err != nil {
+		die("invalid data-dir: %s", err)
+	}
+	if blockDevice != "" && len(dirs) > 1 {
+		die("only one data-dir can be used with --block-device")
+	}
+	if blockDevice != "" && journalDir != "" {
+		die("--journal-dir can't be used with --block-device")
+	}
+	var size uint64
+	for _, s := range sizes {
+		size += s
+	}
+
+	if witness {
+		if blockDevice != "" {
+			die("a witness stores no data; --block-device can't be used with --witness")
+		}
+		// A witness reports no capacity, so rings never place blocks on it.
+		size = 0
+		sizes = nil
+	}
+
+	if debugInit {
+		initRingType, err = ring.InitTypeFromString(debugInitRing)
 		if err != nil {
-			die("error parsing size %s: %s", sizeStr, err)
+			die("error parsing ring-type: %s", err)
 		}
-		directory, _ := filepath.Abs(dataDir)
-		size = du.NewDiskUsage(directory).Size() * percent / 100
-	} else {
-		size, err = humanize.ParseBytes(sizeStr)
+	}
+
+	labelMap, err := parseLabels(labels)
+	if err != nil {
+		die("error parsing label: %s", err)
+	}
+
+	if minPeers < 0 {
+		die("min-peers must not be negative: %d", minPeers)
+	}
+
+	if defragInterval < 0 {
+		die("defrag-interval must not be negative: %s", defragInterval)
+	}
+
+	if autoEvictAfter < 0 {
+		die("auto-evict-after must not be negative: %s", autoEvictAfter)
+	}
+
+	if autoEvictWindow <= 0 {
+		die("auto-evict-window must be positive: %s", autoEvictWindow)
+	}
+
+	if cordonTimeout <= 0 {
+		die("cordon-timeout must be positive: %s", cordonTimeout)
+	}
+
+	if scrubRate < 0 {
+		die("scrub-rate must not be negative: %d", scrubRate)
+	}
+
+	if highWaterMark < 0 || highWaterMark > 100 {
+		die("high-water-mark must be between 0 and 100: %d", highWaterMark)
+	}
+
+	if highWaterMark != 0 && (lowWaterMark < 0 || lowWaterMark > highWaterMark) {
+		die("low-water-mark must be between 0 and high-water-mark: %d", lowWaterMark)
+	}
+
+	if storageIOMode != storage.IOModeMmap && storageIOMode != storage.IOModeDirect {
+		die("storage-io-mode must be one of %s: %s", strings.Join(storage.IOModes, ", "), storageIOMode)
+	}
+
+	var advertise string
+	if advertiseAddress != "" {
+		if peerAddress == "" {
+			die("advertise-address needs a peer-address to listen on")
+		}
+		u, err := addrToUri(advertiseAddress)
+		if err != nil || strings.Contains(advertiseAddress, ",") {
+			die("invalid advertise-address %s", advertiseAddress)
+		}
+		advertise = u.String()
+	}
+
+	if shutdownTimeout <= 0 {
+		die("shutdown-timeout must be positive: %s", shutdownTimeout)
+	}
+
+	if joinTokenFile != "" {
+		b, err := ioutil.ReadFile(joinTokenFile)
 		if err != nil {
-			die("error parsing size %s: %s", sizeStr, err)
+			die("error reading join-token-file: %s", err)
+		}
+		joinToken = strings.TrimSpace(string(b))
+		if joinToken == "" {
+			die("join-token-file %s is empty", joinTokenFile)
+		}
+	}
+
+	if adminTokenFile != "" {
+		b, err := ioutil.ReadFile(adminTokenFile)
+		if err != nil {
+			die("error reading admin-token-file: %s", err)
+		}
+		adminToken = strings.TrimSpace(string(b))
+		if adminToken == "" {
+			die("admin-token-file %s is empty", adminTokenFile)
 		}
 	}
 
 	cfg = flagconfig.BuildConfigFromFlags()
-	cfg.DataDir = dataDir
+	cfg.DataDir = dirs
+	cfg.DataDirSizes = sizes
 	cfg.BlockDevice = blockDevice
 	cfg.StorageSize = size
+	cfg.Zone = zone
+	cfg.Rack = rack
+	cfg.Labels = labelMap
+	cfg.MinPeers = minPeers
+	cfg.DefragInterval = defragInterval
+	cfg.AutoEvictAfter = autoEvictAfter
+	cfg.AutoEvictWindow = autoEvictWindow
+	cfg.CordonTimeout = cordonTimeout
+	cfg.ScrubRate = uint64(scrubRate) * 1000 * 1000
+	cfg.HighWaterMark = highWaterMark
+	cfg.LowWaterMark = lowWaterMark
+	cfg.StorageIOMode = storageIOMode
+	cfg.JournalDir = journalDir
+	cfg.AdvertiseAddress = advertise
+	cfg.AdminToken = adminToken
+
+	if forceReclaim {
+		if err := reclaimLocalStorage(cfg); err != nil {
+			die("couldn't reclaim local storage: %v", err)
+		}
+	}
+
+	if joinAddress != "" {
+		joined, err = joinCluster(&cfg, cmd, joinAddress, joinToken)
+		if err != nil {
+			die("couldn't join: %v", err)
+		}
+		if joined != nil {
+			autojoin = true
+		}
+	}
+}
+
+// parseLabels parses key=value labels, refusing empty keys and keys given
+// twice.
+func parseLabels(in []string) (map[string]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string)
+	for _, l := range in {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%q is not key=value", l)
+		}
+		if _, ok := out[kv[0]]; ok {
+			return nil, fmt.Errorf("label %s given twice", kv[0])
+		}
+		out[kv[0]] = kv[1]
+	}
+	return out, nil
+}
+
+// parseDataDirs parses the data directories of the node, given as path or
+// path=size, and sizes, the sizes of those given as a bare path. A single
+// size applies to each of them; otherwise there must be one per directory.
+func parseDataDirs(in, sizes []string) ([]string, []uint64, error) {
+	if len(in) == 0 {
+		return nil, nil, errors.New("at least one is needed")
+	}
+	if len(sizes) != 1 && len(sizes) != len(in) {
+		return nil, nil, fmt.Errorf("%d sizes given for %d data directories", len(sizes), len(in))
+	}
+	seen := make(map[string]bool)
+	dirs := make([]string, len(in))
+	out := make([]uint64, len(in))
+	for i, d := range in {
+		sizeStr := sizes[0]
+		if len(sizes) > 1 {
+			sizeStr = sizes[i]
+		}
+		if kv := strings.SplitN(d, "=", 2); len(kv) == 2 {
+			d, sizeStr = kv[0], kv[1]
+		}
+		if d == "" {
+			return nil, nil, fmt.Errorf("%q has no path", in[i])
+		}
+		abs, err := filepath.Abs(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[abs] {
+			return nil, nil, fmt.Errorf("%s given twice", d)
+		}
+		seen[abs] = true
+		size, err := parseSize(sizeStr, abs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing size %s: %s", sizeStr, err)
+		}
+		dirs[i] = d
+		out[i] = size
+	}
+	return dirs, out, nil
+}
+
+// parseSize parses a size in bytes, or as a percentage of the disk dir is on.
+func parseSize(sizeStr, dir string) (uint64, error) {
+	if !strings.Contains(sizeStr, "%") {
+		return humanize.ParseBytes(sizeStr)
+	}
+	percent, err := parsePercentage(sizeStr)
+	if err != nil {
+		return 0, err
+	}
+	return du.NewDiskUsage(dir).Size() * percent / 100, nil
 }
 
 func parsePercentage(percentString string) (uint64, error) {
@@ -156,14 +420,19 @@ func runServer(cmd *cobra.Command, args []string) error {
 		srv *torus.Server
 		err error
 	)
+	storage := "mfile"
+	if witness {
+		storage = "temp"
+	}
 	switch {
 	case cfg.MetadataAddress == "":
-		srv, err = torus.NewServer(cfg, "temp", "mfile")
+		srv, err = torus.NewServer(cfg, "temp", storage)
 	case debugInit:
-		err = torus.InitMDS("etcd", cfg, torus.GlobalMetadata{
+		err = torus.InitMDS(torus.MetadataServiceFor(cfg), cfg, torus.GlobalMetadata{
 			BlockSize:        512 * 1024,
 			DefaultBlockSpec: blockset.MustParseBlockLayerSpec("crc,base"),
-		}, ring.Ketama)
+			RingType:         debugInitRing,
+		}, initRingType)
 		if err != nil {
 			if err == torus.ErrExists {
 				fmt.Println("debug-init: Already exists")
@@ -173,41 +442,50 @@ func runServer(cmd *cobra.Command, args []string) error {
 		}
 		fallthrough
 	case blockDevice != "":
-		srv, err = torus.NewServer(cfg, "etcd", "block_device")
+		srv, err = torus.NewServer(cfg, torus.MetadataServiceFor(cfg), "block_device")
 	default:
-		srv, err = torus.NewServer(cfg, "etcd", "mfile")
+		srv, err = torus.NewServer(cfg, torus.MetadataServiceFor(cfg), storage)
 	}
 	if err != nil {
 		return fmt.Errorf("couldn't start: %s", err)
 	}
 
+	if joined != nil {
+		if err := checkJoined(srv, joined); err != nil {
+			srv.Close()
+			return err
+		}
+	}
+
+	rejoined := false
 	if autojoin {
-		err = doAutojoin(srv)
+		rejoined, err = doAutojoin(srv)
 		if err != nil {
 			return fmt.Errorf("couldn't auto-join: %s", err)
 		}
 	}
+	warnIfCordoned(srv)
 
 	mainClose := make(chan bool)
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
 	if peerAddress != "" {
-		var u *url.URL
+		var addrs []*url.URL
 
-		u, err = addrToUri(peerAddress)
+		addrs, err = parsePeerAddresses(peerAddress)
 		if err != nil {
-			return fmt.Errorf("couldn't parse peer address %s: %s", peerAddress, err)
+			return err
 		}
-		err = distributor.ListenReplication(srv, u)
+		err = distributor.ListenReplication(srv, addrs[0], addrs[1:]...)
 	} else {
 		err = distributor.OpenReplication(srv)
 	}
 
 	defer srv.Close()
 	go func() {
-		for _ = range signalChan {
-			fmt.Println("\nReceived an interrupt, stopping services...")
+		for sig := range signalChan {
+			fmt.Printf("\nReceived %s, stopping services...\n", sig)
 			close(mainClose)
 			// return here to call defer srv.Close()
 			return
@@ -217,21 +495,242 @@ func runServer(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("couldn't use server: %s", err)
 	}
+	if rejoined {
+		// We may have missed deletes while we were down.
+		go func() {
+			err := distributor.Reconcile(srv, reconcileTimeout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't reconcile local blocks: %v\n", err)
+			}
+		}()
+	}
+	var httpSrv *http.Server
+	httpErr := make(chan error, 1)
 	if httpAddress != "" {
 		http.Handle("/metrics", prometheus.Handler())
-		http.ListenAndServe(httpAddress, nil)
+		http.Handle("/rebalance", rebalanceHandler(srv))
+		http.Handle("/ready", readyHandler(srv, peerAddress != ""))
+		http.Handle("/status", statusHandler(srv))
+		http.Handle("/healthz", healthzHandler())
+		http.Handle("/readyz", readyzHandler(srv, peerAddress != ""))
+		http.Handle(apiPrefix, newAPIHandler(srv, cfg.AdminToken, joinToken))
+		if cfg.AdminToken != "" {
+			http.Handle("/admin/evict-peer", adminHandler(cfg.AdminToken, evictPeerHandler(srv)))
+			http.Handle("/admin/cache", adminHandler(cfg.AdminToken, cacheHandler(srv)))
+			http.Handle("/admin/storage", adminHandler(cfg.AdminToken, storageHandler(srv)))
+		}
+		// Listening before serving makes a port that can't be bound fatal
+		// here, rather than something only logged once the node is up.
+		l, err := net.Listen("tcp", httpAddress)
+		if err != nil {
+			return fmt.Errorf("couldn't listen for http on %s: %v", httpAddress, err)
+		}
+		httpSrv = &http.Server{}
+		go func() {
+			if err := httpSrv.Serve(l); err != http.ErrServerClosed {
+				httpErr <- err
+			}
+		}()
 	}
 	// Wait
-	<-mainClose
-	return nil
+	var serveErr error
+	select {
+	case <-mainClose:
+	case err := <-httpErr:
+		serveErr = fmt.Errorf("couldn't serve http: %v", err)
+		fmt.Fprintf(os.Stderr, "%v, stopping services...\n", serveErr)
+	}
+	// Closing the server after the shutdown can hang as well, so the
+	// deadline is enforced on the whole way out.
+	time.AfterFunc(shutdownTimeout, func() {
+		die("couldn't stop within %s, forcing exit", shutdownTimeout)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't shut down cleanly: %v\n", err)
+	}
+	// The HTTP endpoints stay up while the node drains, so that readyz
+	// reports it.
+	if httpSrv != nil {
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't stop serving http cleanly: %v\n", err)
+		}
+	}
+	return serveErr
+}
+
+// rebalanceHandler reports the progress of this node's current rebalance pass.
+func rebalanceHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := torus.NewRebalanceProgress(srv.MDS.UUID(), srv.RebalanceInfo(), time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// readyHandler reports whether this node is ready to serve, by the checks
+// of readiness, along with whether it's waiting for the ring to reach
+// --min-peers and the progress of the reconciliation of its local blocks
+// after rejoining.
+func readyHandler(srv *torus.Server, listen bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, _ := readiness(srv, listen)
+		p, _ := distributor.GetReconcileProgress(srv)
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Ready           bool                          `json:"ready"`
+			WaitingForPeers bool                          `json:"waiting_for_peers"`
+			Reconcile       distributor.ReconcileProgress `json:"reconcile"`
+		}{
+			Ready:           ready,
+			WaitingForPeers: distributor.WaitingForPeers(srv),
+			Reconcile:       p,
+		})
+	})
+}
+
+// healthzHandler reports that the process is up and serving HTTP.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Alive bool `json:"alive"`
+		}{true})
+	})
+}
+
+// readyCheck is the outcome of one of the checks of readiness.
+type readyCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// readiness checks whether this node is ready to serve: the metadata service
+// answers with a ring, storage and replication are open, the replication
+// port is bound if listen is set, the ring has reached --min-peers, the local
+// blocks have been reconciled after rejoining, the lease is being renewed and
+// the node isn't shutting down. It returns whether every check passed, and
+// the outcome of each, so a failing one can be told apart.
+func readiness(srv *torus.Server, listen bool) (bool, map[string]readyCheck) {
+	checks := make(map[string]readyCheck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ring, err := srv.MDS.WithContext(ctx).GetRing()
+	cancel()
+	if err != nil {
+		checks["metadata"] = readyCheck{Detail: fmt.Sprintf("couldn't get ring: %v", err)}
+	} else {
+		checks["metadata"] = readyCheck{OK: true, Detail: fmt.Sprintf("ring version %d", ring.Version())}
+	}
+
+	if !srv.ReplicationOpen {
+		checks["storage"] = readyCheck{Detail: "replication isn't open"}
+	} else {
+		checks["storage"] = readyCheck{OK: true, Detail: srv.Blocks.Kind()}
+	}
+
+	switch {
+	case !listen:
+		checks["replication"] = readyCheck{OK: true, Detail: "no peer address"}
+	case distributor.Listening(srv):
+		checks["replication"] = readyCheck{OK: true}
+	default:
+		checks["replication"] = readyCheck{Detail: "not listening"}
+	}
+
+	if distributor.WaitingForPeers(srv) {
+		checks["peers"] = readyCheck{Detail: fmt.Sprintf("waiting for the ring to reach %d peers", srv.Cfg.MinPeers)}
+	} else {
+		checks["peers"] = readyCheck{OK: true}
+	}
+
+	switch p, ok := distributor.GetReconcileProgress(srv); {
+	case !ok:
+		checks["reconcile"] = readyCheck{Detail: "replication isn't open"}
+	case p.Running:
+		checks["reconcile"] = readyCheck{Detail: fmt.Sprintf("checked %d of %d local blocks", p.Checked, p.Total)}
+	default:
+		checks["reconcile"] = readyCheck{OK: true}
+	}
+
+	switch err := srv.LeaseErr(); {
+	case err != nil:
+		checks["lease"] = readyCheck{Detail: fmt.Sprintf("couldn't renew: %v", err)}
+	case srv.Lease() == 0:
+		checks["lease"] = readyCheck{Detail: "no lease"}
+	default:
+		checks["lease"] = readyCheck{OK: true}
+	}
+
+	if srv.ShuttingDown() {
+		checks["shutdown"] = readyCheck{Detail: "shutting down"}
+	} else {
+		checks["shutdown"] = readyCheck{OK: true}
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return ready, checks
+}
+
+// readyzHandler reports whether this node is ready to serve, and the outcome
+// of each of the checks of readiness.
+func readyzHandler(srv *torus.Server, listen bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, checks := readiness(srv, listen)
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Ready  bool                  `json:"ready"`
+			Checks map[string]readyCheck `json:"checks"`
+		}{
+			Ready:  ready,
+			Checks: checks,
+		})
+	})
 }
 
-// doAutojoin automatically adds nodes to the storage pool.
-func doAutojoin(s *torus.Server) error {
+// statusHandler reports on this node's block cache and local storage. The
+// cache is left out if there is none.
+func statusHandler(srv *torus.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := struct {
+			UUID    string                  `json:"uuid"`
+			Cache   *distributor.CacheStats `json:"cache,omitempty"`
+			Storage *torus.BlockStoreStats  `json:"storage,omitempty"`
+		}{
+			UUID: srv.MDS.UUID(),
+		}
+		if c, ok := distributor.GetCacheStats(srv); ok {
+			st.Cache = &c
+		}
+		if s, ok := distributor.GetStorageStats(srv); ok {
+			st.Storage = &s
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// doAutojoin automatically adds nodes to the storage pool. It reports whether
+// the node was already a member of the ring, i.e. is coming back up.
+func doAutojoin(s *torus.Server) (bool, error) {
 	for {
 		ring, err := s.MDS.GetRing()
 		if err != nil {
-			return fmt.Errorf("couldn't get ring: %v", err)
+			return false, fmt.Errorf("couldn't get ring: %v", err)
 		}
 		var newRing torus.Ring
 		if r, ok := ring.(torus.RingAdder); ok {
@@ -239,24 +738,53 @@ func doAutojoin(s *torus.Server) error {
 				&models.PeerInfo{
 					UUID:        s.MDS.UUID(),
 					TotalBlocks: s.Blocks.NumBlocks(),
+					Zone:        s.Cfg.Zone,
+					Rack:        s.Cfg.Rack,
+					Labels:      s.Cfg.Labels,
 				},
 			})
 		} else {
-			return fmt.Errorf("current ring type cannot support auto-adding")
+			return false, fmt.Errorf("current ring type cannot support auto-adding")
 		}
 		if err == torus.ErrExists {
 			// We're already a member; we're coming back up.
-			return nil
+			return true, nil
 		}
 		if err != nil {
-			return fmt.Errorf("couldn't add peer to ring: %v", err)
+			return false, fmt.Errorf("couldn't add peer to ring: %v", err)
 		}
 		err = s.MDS.SetRing(newRing)
 		if err == torus.ErrNonSequentialRing || err == torus.ErrAgain {
 			fmt.Fprintf(os.Stderr, "failed to set ring, try again: %v", err)
 			continue
 		}
-		return err
+		e := torus.AuditEvent{
+			Op:          torus.AuditPeerAdd,
+			Source:      s.MDS.UUID(),
+			RingVersion: newRing.Version(),
+			Details:     map[string]string{"peers": s.MDS.UUID(), "via": "auto-join"},
+			Err:         torus.AuditErr(err),
+		}
+		s.Audit.Record(e)
+		if err == nil {
+			torus.RecordClusterEvent(s.MDS, e)
+		}
+		return false, err
+	}
+}
+
+// warnIfCordoned tells the operator if this node is still cordoned, as it is
+// left to them to lift the cordon once the node is back.
+func warnIfCordoned(s *torus.Server) {
+	cordons, err := torus.GetCordons(s.MDS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't get cordons: %v\n", err)
+		return
+	}
+	for _, c := range cordons {
+		if c.UUID == s.MDS.UUID() {
+			fmt.Fprintf(os.Stderr, "this node has been cordoned since %s and takes no new blocks; lift it with `torusctl peer uncordon %s`\n", c.Since.Local().Format(time.Stamp), c.UUID)
+		}
 	}
 }
 
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/cmd/mkfs.torus/lib"
+)
+
+// reclaimLocalStorage wipes the local storage of cfg: the data directories,
+// the journal, and the blocks of the block device. The node starts as a new
+// one, with a new UUID, and takes on the cluster of its metadata service.
+func reclaimLocalStorage(cfg torus.Config) error {
+	fmt.Fprintf(os.Stderr, "WARNING: --force-reclaim wipes all the blocks and metadata kept by this node\n")
+	if dir := cfg.MetadataDir(); dir != "" {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "metadata", "uuid"))
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "this node was %s; if it is still in the ring of its cluster, remove it with torusctl peer evict\n", strings.TrimSpace(string(b)))
+		}
+	}
+	for _, dir := range cfg.DataDir {
+		fmt.Fprintf(os.Stderr, "wiping data directory %s\n", dir)
+		if err := removeContents(dir); err != nil {
+			return err
+		}
+	}
+	if cfg.JournalDir != "" {
+		fmt.Fprintf(os.Stderr, "wiping journal directory %s\n", cfg.JournalDir)
+		if err := removeContents(cfg.JournalDir); err != nil {
+			return err
+		}
+	}
+	if cfg.BlockDevice != "" {
+		fmt.Fprintf(os.Stderr, "formatting block device %s again\n", cfg.BlockDevice)
+		if err := lib.Reformat(false, cfg.BlockDevice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeContents removes everything in dir, but not dir itself, which may
+// be a mount point.
+func removeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
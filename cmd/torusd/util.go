@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
 	"strings"
 )
@@ -12,3 +13,25 @@ func addrToUri(addr string) (*url.URL, error) {
 	}
 	return url.Parse("http://" + addr)
 }
+
+// parsePeerAddresses parses a comma-separated list of peer addresses.
+func parsePeerAddresses(list string) ([]*url.URL, error) {
+	var out []*url.URL
+	seen := make(map[string]bool)
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			return nil, fmt.Errorf("empty address in peer addresses %q", list)
+		}
+		u, err := addrToUri(addr)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse peer address %s: %s", addr, err)
+		}
+		if seen[u.String()] {
+			return nil, fmt.Errorf("peer address %s given more than once", addr)
+		}
+		seen[u.String()] = true
+		out = append(out, u)
+	}
+	return out, nil
+}
@@ -1,15 +1,243 @@
 package torus
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
 
 type Config struct {
-	DataDir         string
+	// DataDir are the data directories of the node. The first holds its
+	// metadata, such as its UUID; blocks are spread across all of them.
+	DataDir []string
+	// DataDirSizes, if set, is the storage size in bytes of each of DataDir,
+	// StorageSize being their sum. Otherwise StorageSize is split evenly
+	// between them.
+	DataDirSizes    []uint64
 	BlockDevice     string
 	StorageSize     uint64
 	MetadataAddress string
-	ReadCacheSize   uint64
-	ReadLevel       ReadLevel
-	WriteLevel      WriteLevel
+	// MetadataPrefix, if set, is the key prefix the etcd metadata service
+	// keeps every key under, so that torus can share etcd with others.
+	MetadataPrefix string
+	// MetadataUsername and MetadataPassword, if set, are the account the
+	// etcd metadata service logs in as, on clusters with auth enabled.
+	MetadataUsername string
+	MetadataPassword string
+	// MetadataCacheSize is the number of volume and INode lookups the etcd
+	// metadata service caches. Zero uses a default; a negative size turns
+	// the cache off.
+	MetadataCacheSize int
+	// INodeGCWindow is how long an INode a writer allocated may go
+	// uncommitted before its blocks are collected as orphaned, left behind
+	// by a writer that crashed. It must be longer than any writer goes
+	// between syncs. Zero never collects them.
+	INodeGCWindow time.Duration
+	// HeartbeatInterval is how often the node renews its lease and
+	// registration in the metadata service. Zero uses
+	// DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// PeerTimeout is how long a peer may go without a heartbeat before it
+	// is considered missing. It is recorded in the global metadata when
+	// the cluster is initialized, and nodes go by that.
+	PeerTimeout time.Duration
+	// ReadCacheSize is the amount of memory the distributor caches the
+	// blocks it reads and writes in. Zero disables the cache.
+	ReadCacheSize uint64
+	// CachePolicy is how the cache picks the blocks to evict: "lru" for
+	// the least recently used, or "2q" to keep blocks read only once from
+	// pushing out the ones read again and again. Empty means "lru".
+	CachePolicy string
+	// ReadaheadMaxBytes caps how far ahead of a sequential reader of a
+	// file its blocks are fetched into the cache. Zero disables readahead.
+	ReadaheadMaxBytes uint64
+	// WriteCoalesceWindow is how long the writes to an open block volume
+	// are buffered for, so that small writes to the same block are applied
+	// to it together. Zero disables write coalescing.
+	WriteCoalesceWindow time.Duration
+	// WriteBufferBytes caps the memory the writes to each open block
+	// volume are buffered in; writers wait for the buffer to be written
+	// out once it is full.
+	WriteBufferBytes uint64
+	ReadLevel        ReadLevel
+	WriteLevel       WriteLevel
+	// WriteQuorum is the number of replicas that must acknowledge a block
+	// write under WriteAll before it returns. Zero waits for every replica.
+	WriteQuorum int
+	// RingHistory is how many of the last rings set on the cluster the
+	// metadata service keeps, for rolling back. Zero keeps
+	// DefaultRingHistory.
+	RingHistory int
+	// MaxVolumeMetrics caps how many volumes get their own label in the
+	// per-volume metrics; I/O to any further volume is counted as "other".
+	MaxVolumeMetrics int
+	// TempPersistPath, if set, is the file the temp metadata service keeps
+	// its state in across restarts.
+	TempPersistPath string
+	// Zone and Rack label where this node runs. Rings spread the replicas
+	// of a block across distinct zones, then racks, when peers carry them.
+	Zone string
+	Rack string
+	// Labels are free-form labels of this node, such as rack=r1. A
+	// ketama-zones ring keeps the replicas of a block in distinct values of
+	// its domain label.
+	Labels map[string]string
+	// MinPeers is the number of peers the ring must contain before this
+	// node accepts writes. Zero accepts them right away.
+	MinPeers int
+	// TransferChunkSize, if set, splits blocks sent to and fetched from
+	// peers into frames of at most this many bytes, on protocols that
+	// support it. Zero transfers whole blocks.
+	TransferChunkSize uint64
+	// WireChecksum checksums whole blocks sent to and fetched from peers,
+	// on protocols that support it. Chunked transfers are always checked.
+	WireChecksum bool
+	// IOTimeout, if set, bounds how long a block read or write may take
+	// before it fails. Reads fail over to other replicas within it.
+	IOTimeout time.Duration
+	// HedgeAfter, if set, is how long a block read from a peer may go
+	// unanswered before the next replica is asked as well, the first
+	// answer winning. MaxHedges caps how many of these hedged reads may be
+	// in flight at once; zero uses a default.
+	HedgeAfter time.Duration
+	MaxHedges  int
+	// MaxPeerConns, if set, bounds the number of connections open to other
+	// peers at once. Zero leaves it unbounded.
+	MaxPeerConns int
+	// MaxBatchBytes, if set, lets sequential reads fetch runs of blocks
+	// held by the same peer in one request of up to this many bytes, on
+	// protocols that support it. Zero fetches blocks one at a time.
+	MaxBatchBytes uint64
+	// PeerPoolSize is how many connections may be open to each peer, so
+	// that requests to it don't all queue behind one another. Zero means
+	// one.
+	PeerPoolSize int
+	// BreakerThreshold, if set, is the fraction of the requests to a peer
+	// within BreakerWindow that may fail or time out before its circuit
+	// opens and requests to it fail right away. A single probe request is
+	// let through every BreakerProbeInterval, closing the circuit again if
+	// it succeeds. Zero disables circuit breaking; zero durations use
+	// defaults.
+	BreakerThreshold     float64
+	BreakerWindow        time.Duration
+	BreakerProbeInterval time.Duration
+	// AuditLog, if set, is the file ring changes and other administrative
+	// operations are appended to.
+	AuditLog string
+	// AdminToken, if set, is the bearer token requests that change the
+	// node through its admin HTTP API must carry. Without one, the admin
+	// API only reports.
+	AdminToken string
+	// AdvertiseAddress, if set, is the address other nodes are told to
+	// reach this one at, in place of the one replication listens on.
+	AdvertiseAddress string
+	// DefragInterval, if set, is how often storage backends that support
+	// it compact their blocks while idle.
+	DefragInterval time.Duration
+	// AutoEvictAfter, if set, has the node with the lowest UUID among the
+	// live ones evict a ring member that has stopped reporting for this
+	// long. No more than one peer is evicted per AutoEvictWindow.
+	AutoEvictAfter  time.Duration
+	AutoEvictWindow time.Duration
+	// CordonTimeout is how long a cordoned peer is spared from eviction
+	// by AutoEvictAfter, counted from when it was cordoned.
+	CordonTimeout time.Duration
+	// ScrubRate, if set, is the bytes per second at which the blocks in
+	// local storage are read back and checked against their checksums.
+	ScrubRate uint64
+	// HighWaterMark and LowWaterMark are percentages of the blocks of local
+	// storage. Once it fills up past the high-water mark, or the disk runs
+	// out of space, the node serves the blocks it holds but takes no new
+	// ones, until it's back under the low-water mark. A zero HighWaterMark
+	// only stops it when the disk is full.
+	HighWaterMark int
+	LowWaterMark  int
+	// StorageIOMode is how the mfile store reads and writes its blocks:
+	// "mmap", the default, or "direct" to bypass the page cache.
+	StorageIOMode string
+	// JournalDir, if set, is where the mfile store keeps a write-ahead
+	// journal of block writes, so that one cut short by a crash is
+	// replayed rather than left torn.
+	JournalDir string
+	// MasterKeyFile and MasterKeyEnv name a file, and failing that an
+	// environment variable, holding the hex-encoded 256-bit key that the
+	// data keys of encrypted volumes are wrapped with.
+	MasterKeyFile string
+	MasterKeyEnv  string
+	// PeerCertFile, PeerKeyFile and PeerCAFile, if set, secure replication
+	// between peers with TLS: each peer presents the certificate, and
+	// accepts only peers presenting one signed by the CA. They are set
+	// together or not at all.
+	PeerCertFile string
+	PeerKeyFile  string
+	PeerCAFile   string
 
 	TLS *tls.Config
 }
+
+// MetadataDir returns the data directory the metadata of the node is kept
+// in, or "" if it has none.
+func (c Config) MetadataDir() string {
+	if len(c.DataDir) == 0 {
+		return ""
+	}
+	return c.DataDir[0]
+}
+
+// HeartbeatIntervalOrDefault returns c.HeartbeatInterval, or the default if
+// it isn't set.
+func (c Config) HeartbeatIntervalOrDefault() time.Duration {
+	if c.HeartbeatInterval == 0 {
+		return DefaultHeartbeatInterval
+	}
+	return c.HeartbeatInterval
+}
+
+// PeerTLS reports whether replication between peers is secured with TLS.
+func (c Config) PeerTLS() bool {
+	return c.PeerCertFile != "" || c.PeerKeyFile != "" || c.PeerCAFile != ""
+}
+
+// LoadPeerTLS loads the TLS configuration peers serve and dial replication
+// with, authenticating each other against the CA. It returns nil if peer TLS
+// isn't configured.
+func LoadPeerTLS(c Config) (*tls.Config, error) {
+	if !c.PeerTLS() {
+		return nil, nil
+	}
+	var missing []string
+	for _, f := range []struct{ name, path string }{
+		{"certificate", c.PeerCertFile},
+		{"key", c.PeerKeyFile},
+		{"CA", c.PeerCAFile},
+	} {
+		if f.path == "" {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("torus: peer TLS needs a certificate, key and CA; missing the %s", strings.Join(missing, " and "))
+	}
+	cert, err := tls.LoadX509KeyPair(c.PeerCertFile, c.PeerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("torus: couldn't load peer certificate: %v", err)
+	}
+	caPem, err := ioutil.ReadFile(c.PeerCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("torus: couldn't load peer CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("torus: no certificates in peer CA %s", c.PeerCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
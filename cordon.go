@@ -0,0 +1,70 @@
+package torus
+
+import "time"
+
+// DefaultCordonTimeout is how long a cordoned peer may stop reporting before
+// it is treated as any other missing peer.
+const DefaultCordonTimeout = time.Hour
+
+// Cordon marks a peer as under maintenance. A cordoned peer stays in the ring
+// and keeps serving the blocks it holds, but takes no new ones; writes go to
+// the next peers of the ring in its place. It isn't evicted for going away
+// until it has been cordoned for longer than the cordon timeout.
+type Cordon struct {
+	UUID  string    `json:"uuid"`
+	Since time.Time `json:"since"`
+	// Client is the UUID of the client that cordoned the peer.
+	Client string `json:"client,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// GetCordons returns the peers cordoned in mds, or none if mds doesn't
+// store cordons.
+func GetCordons(mds MetadataService) ([]Cordon, error) {
+	pc, ok := mds.(PeerCordoner)
+	if !ok {
+		return nil, nil
+	}
+	return pc.GetCordons()
+}
+
+// CordonPeer cordons the peer uuid, which must be a member of the ring, as
+// of now. Cordoning a peer again keeps the time it was first cordoned.
+func CordonPeer(mds MetadataService, uuid, reason string) (Cordon, error) {
+	pc, ok := mds.(PeerCordoner)
+	if !ok {
+		return Cordon{}, ErrNotSupported
+	}
+	r, err := mds.GetRing()
+	if err != nil {
+		return Cordon{}, err
+	}
+	if !r.Members().Has(uuid) {
+		return Cordon{}, ErrNoPeer
+	}
+	cordons, err := pc.GetCordons()
+	if err != nil {
+		return Cordon{}, err
+	}
+	c := Cordon{
+		UUID:   uuid,
+		Since:  time.Now().UTC(),
+		Client: mds.UUID(),
+		Reason: reason,
+	}
+	for _, x := range cordons {
+		if x.UUID == uuid {
+			c.Since = x.Since
+		}
+	}
+	return c, pc.SetCordon(c)
+}
+
+// UncordonPeer lifts the cordon of the peer uuid.
+func UncordonPeer(mds MetadataService, uuid string) error {
+	pc, ok := mds.(PeerCordoner)
+	if !ok {
+		return ErrNotSupported
+	}
+	return pc.RemoveCordon(uuid)
+}
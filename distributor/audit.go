@@ -0,0 +1,94 @@
+package distributor
+
+import (
+	"errors"
+
+	"github.com/alternative-storage/torus"
+	"golang.org/x/net/context"
+)
+
+// auditBatchSize is the number of blocks asked about in one call to a peer.
+const auditBatchSize = 1000
+
+// BlockReplicas records which peers hold a copy of a block.
+type BlockReplicas struct {
+	Ref torus.BlockRef
+	// Want is the replication factor of the ring for the block.
+	Want int
+	// Holders are the peers that reported having the block.
+	Holders []string
+}
+
+// UnderReplicated reports whether fewer peers hold the block than the ring
+// asks for.
+func (b BlockReplicas) UnderReplicated() bool { return len(b.Holders) < b.Want }
+
+// OverReplicated reports whether more peers hold the block than the ring asks
+// for.
+func (b BlockReplicas) OverReplicated() bool { return len(b.Holders) > b.Want }
+
+// AuditReplicas asks every member of the ring which of refs it holds, and
+// returns the holders of each block in the order of refs. A peer that can't
+// be asked is treated as holding nothing, and its error is returned in the
+// map keyed by its UUID.
+func AuditReplicas(ctx context.Context, s *torus.Server, refs []torus.BlockRef) ([]BlockReplicas, map[string]error, error) {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return nil, nil, errors.New("distributor: replication is not open")
+	}
+	return d.auditReplicas(ctx, refs)
+}
+
+func (d *Distributor) auditReplicas(ctx context.Context, refs []torus.BlockRef) ([]BlockReplicas, map[string]error, error) {
+	r := d.Ring()
+	out := make([]BlockReplicas, len(refs))
+	for i, ref := range refs {
+		perm, err := r.GetPeers(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		out[i] = BlockReplicas{
+			Ref:  ref,
+			Want: perm.Replication,
+		}
+	}
+	peerErrs := make(map[string]error)
+	for _, p := range r.Members() {
+		for start := 0; start < len(refs); start += auditBatchSize {
+			end := start + auditBatchSize
+			if end > len(refs) {
+				end = len(refs)
+			}
+			has, err := d.hasBlocks(ctx, p, refs[start:end])
+			if err != nil {
+				peerErrs[p] = err
+				break
+			}
+			for i, ok := range has {
+				if ok {
+					out[start+i].Holders = append(out[start+i].Holders, p)
+				}
+			}
+		}
+	}
+	return out, peerErrs, nil
+}
+
+// hasBlocks reports which of refs the peer holds, answering locally if the
+// peer is this node.
+func (d *Distributor) hasBlocks(ctx context.Context, peer string, refs []torus.BlockRef) ([]bool, error) {
+	if peer == d.UUID() {
+		out := make([]bool, len(refs))
+		for i, ref := range refs {
+			ok, err := d.blocks.HasBlock(ctx, ref)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ok
+		}
+		return out, nil
+	}
+	checkctx, cancel := context.WithTimeout(ctx, rebalanceClientTimeout)
+	defer cancel()
+	return d.client.Check(checkctx, peer, refs)
+}
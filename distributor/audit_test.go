@@ -0,0 +1,76 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"golang.org/x/net/context"
+)
+
+func TestAuditReplicas(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	d := srvs[0].Blocks.(*Distributor)
+	ctx := context.Background()
+	data := make([]byte, BlockSize)
+	var refs []torus.BlockRef
+	for i := 0; i < 10; i++ {
+		ref := torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, 2),
+			Index:    torus.IndexID(i + 1),
+		}
+		if err := d.WriteBlock(ctx, ref, data); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+
+	reps, peerErrs, err := AuditReplicas(ctx, srvs[0], refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerErrs) != 0 {
+		t.Fatalf("unexpected peer errors: %v", peerErrs)
+	}
+	for _, r := range reps {
+		if r.UnderReplicated() || r.OverReplicated() {
+			t.Fatalf("expected %d copies of %s, got %v", r.Want, r.Ref, r.Holders)
+		}
+	}
+
+	// Drop a copy of the first block, and add one to the second.
+	byUUID := make(map[string]*Distributor)
+	for _, s := range srvs {
+		byUUID[s.MDS.UUID()] = s.Blocks.(*Distributor)
+	}
+	if err := byUUID[reps[0].Holders[0]].blocks.DeleteBlock(ctx, refs[0]); err != nil {
+		t.Fatal(err)
+	}
+	for uuid, x := range byUUID {
+		held := false
+		for _, h := range reps[1].Holders {
+			held = held || h == uuid
+		}
+		if !held {
+			if err := x.blocks.WriteBlock(ctx, refs[1], data); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	reps, _, err = AuditReplicas(ctx, srvs[0], refs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reps[0].UnderReplicated() {
+		t.Fatalf("expected %s to be under-replicated, held by %v", reps[0].Ref, reps[0].Holders)
+	}
+	if !reps[1].OverReplicated() {
+		t.Fatalf("expected %s to be over-replicated, held by %v", reps[1].Ref, reps[1].Holders)
+	}
+}
@@ -0,0 +1,231 @@
+package distributor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+const (
+	defaultAutoEvictWindow = time.Hour
+	autoEvictPollMax       = 10 * time.Second
+	// autoEvictFlushTimeout is how long an eviction waits for its cluster
+	// event to be recorded.
+	autoEvictFlushTimeout = 5 * time.Second
+)
+
+// autoEvictor watches for ring members that have stopped reporting, and
+// evicts them once they've been gone for long enough. Every node running one
+// keeps track of the missing peers, but only the live peer with the lowest
+// UUID evicts them, so that the nodes don't race to change the ring.
+type autoEvictor struct {
+	d      *Distributor
+	after  time.Duration
+	window time.Duration
+	// missing holds when each ring member was first found not reporting.
+	// A peer that reports again is dropped from it, so a flapping peer has
+	// to stay away for the whole of after to be evicted.
+	missing   map[string]time.Time
+	lastEvict time.Time
+	// cordonTimeout is how long a cordoned peer may be missing for before
+	// it's evicted, counted from when it was cordoned.
+	cordonTimeout time.Duration
+}
+
+func newAutoEvictor(d *Distributor) *autoEvictor {
+	window := d.srv.Cfg.AutoEvictWindow
+	if window <= 0 {
+		window = defaultAutoEvictWindow
+	}
+	cordonTimeout := d.srv.Cfg.CordonTimeout
+	if cordonTimeout <= 0 {
+		cordonTimeout = torus.DefaultCordonTimeout
+	}
+	return &autoEvictor{
+		d:             d,
+		after:         d.srv.Cfg.AutoEvictAfter,
+		window:        window,
+		missing:       make(map[string]time.Time),
+		cordonTimeout: cordonTimeout,
+	}
+}
+
+func (d *Distributor) autoEvicter(closer chan struct{}) {
+	a := newAutoEvictor(d)
+	poll := a.after / 4
+	if poll > autoEvictPollMax {
+		poll = autoEvictPollMax
+	}
+	t := time.NewTicker(poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-closer:
+			return
+		case now := <-t.C:
+			a.check(now)
+		}
+	}
+}
+
+// check notes which ring members aren't reporting as of now, and, if this
+// node is the one to do it, evicts the one missing the longest once it's been
+// gone past a.after. The other nodes pick up the new ring and rebalance the
+// evicted peer's blocks onto the rest.
+func (a *autoEvictor) check(now time.Time) {
+	mds := a.d.srv.MDS
+	r, err := mds.GetRing()
+	if err != nil {
+		clog.Errorf("auto-evict: couldn't get ring: %v", err)
+		return
+	}
+	peers, err := mds.GetPeers()
+	if err != nil {
+		clog.Errorf("auto-evict: couldn't get peers: %v", err)
+		return
+	}
+	live := make(map[string]bool)
+	leader := ""
+	for _, p := range peers {
+		if p.Address == "" {
+			continue
+		}
+		live[p.UUID] = true
+		if leader == "" || p.UUID < leader {
+			leader = p.UUID
+		}
+	}
+	cordoned := make(map[string]time.Time)
+	for _, c := range a.d.cordons.get() {
+		cordoned[c.UUID] = c.Since
+	}
+	members := r.Members()
+	for p := range a.missing {
+		if live[p] || !members.Has(p) {
+			delete(a.missing, p)
+		}
+	}
+	candidate := ""
+	for _, p := range members {
+		if live[p] {
+			continue
+		}
+		since, ok := a.missing[p]
+		if !ok {
+			clog.Warningf("auto-evict: ring member %s isn't reporting", p)
+			a.missing[p] = now
+			continue
+		}
+		if now.Sub(since) < a.after {
+			continue
+		}
+		if c, ok := cordoned[p]; ok && now.Sub(c) < a.cordonTimeout {
+			// Taken down for maintenance, and expected back.
+			continue
+		}
+		if candidate == "" || since.Before(a.missing[candidate]) ||
+			(since.Equal(a.missing[candidate]) && p < candidate) {
+			candidate = p
+		}
+	}
+	if candidate == "" || leader != a.d.UUID() {
+		return
+	}
+	if err := a.mayEvict(r, live, now); err != nil {
+		clog.Warningf("auto-evict: not evicting %s, missing for %s: %v", candidate, now.Sub(a.missing[candidate]), err)
+		return
+	}
+	a.evict(candidate, now)
+}
+
+// mayEvict returns an error if evicting a peer of r now would break the limit
+// of one eviction per window, or if the live peers don't hold a majority of
+// the capacity of r, or are too few for its replication factor.
+func (a *autoEvictor) mayEvict(r torus.Ring, live map[string]bool, now time.Time) error {
+	if !a.lastEvict.IsZero() && now.Sub(a.lastEvict) < a.window {
+		return fmt.Errorf("evicted a peer %s ago, within the window of %s", now.Sub(a.lastEvict), a.window)
+	}
+	if el, ok := a.d.srv.MDS.(torus.ClusterEventLog); ok {
+		events, err := el.GetClusterEvents()
+		if err != nil {
+			return fmt.Errorf("couldn't get cluster events: %v", err)
+		}
+		for _, e := range events {
+			if e.Op == torus.AuditPeerAutoEvict && e.Err == "" && now.Sub(e.Time) < a.window {
+				return fmt.Errorf("%s evicted %s at %s, within the window of %s", e.Source, e.Details["peer"], e.Time, a.window)
+			}
+		}
+	}
+	b, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+	var mr models.Ring
+	if err := mr.Unmarshal(b); err != nil {
+		return err
+	}
+	if len(mr.Peers) == 0 {
+		return fmt.Errorf("ring type %d doesn't record the capacity of its peers", mr.Type)
+	}
+	var total, liveTotal uint64
+	storing := 0
+	for _, p := range mr.Peers {
+		total += p.TotalBlocks
+		if !live[p.UUID] {
+			continue
+		}
+		liveTotal += p.TotalBlocks
+		if p.TotalBlocks != 0 {
+			storing++
+		}
+	}
+	if 2*liveTotal <= total {
+		return fmt.Errorf("live peers have %d of the %d blocks of capacity in the ring, no more than half", liveTotal, total)
+	}
+	if storing < int(mr.ReplicationFactor) {
+		return fmt.Errorf("%d live peers store data, fewer than the replication factor of %d", storing, mr.ReplicationFactor)
+	}
+	return nil
+}
+
+func (a *autoEvictor) evict(uuid string, now time.Time) {
+	mds := a.d.srv.MDS
+	missing := now.Sub(a.missing[uuid])
+	old, err := torus.EvictPeer(mds, uuid)
+	if err == torus.ErrNoPeer {
+		// Someone else took it out of the ring first.
+		delete(a.missing, uuid)
+		return
+	}
+	e := torus.AuditEvent{
+		Op:     torus.AuditPeerAutoEvict,
+		Source: a.d.UUID(),
+		Details: map[string]string{
+			"peer":    uuid,
+			"missing": missing.String(),
+		},
+		Err: torus.AuditErr(err),
+	}
+	if err == nil {
+		e.RingVersion = old.Version() + 1
+	}
+	a.d.srv.Audit.Record(e)
+	if err != nil {
+		// Failures are tried again at the next check, so only go to the
+		// local audit log.
+		clog.Errorf("auto-evict: couldn't evict %s: %v", uuid, err)
+		return
+	}
+	torus.RecordClusterEvent(mds, e)
+	// A leader taking over keeps to the window by the cluster's events, so
+	// the eviction's is recorded before carrying on.
+	if !torus.FlushClusterEvents(autoEvictFlushTimeout) {
+		clog.Warningf("auto-evict: timed out recording the eviction of %s in the cluster event log", uuid)
+	}
+	promDistAutoEvictions.Inc()
+	a.lastEvict = now
+	delete(a.missing, uuid)
+	clog.Warningf("auto-evict: evicted peer %s from the ring after it stopped reporting for %s", uuid, missing)
+}
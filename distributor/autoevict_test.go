@@ -0,0 +1,200 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func TestAutoEvict(t *testing.T) {
+	srvs, mds := createN(t, 3)
+	defer closeAll(t, srvs...)
+	var peers torus.PeerInfoList
+	for _, s := range srvs {
+		peers = append(peers, &models.PeerInfo{
+			UUID:        s.MDS.UUID(),
+			TotalBlocks: StorageSize / BlockSize,
+		})
+	}
+	for _, dead := range []string{"dead-a", "dead-b"} {
+		peers = append(peers, &models.PeerInfo{
+			UUID:        dead,
+			TotalBlocks: StorageSize / BlockSize,
+		})
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+
+	leader, other := srvs[0], srvs[1]
+	for _, s := range srvs {
+		if s.MDS.UUID() < leader.MDS.UUID() {
+			leader = s
+		}
+	}
+	if other == leader {
+		other = srvs[2]
+	}
+	newEvictor := func(s *torus.Server) *autoEvictor {
+		a := newAutoEvictor(s.Blocks.(*Distributor))
+		a.after = time.Minute
+		return a
+	}
+	c := leader.MDS
+	members := func() torus.PeerList {
+		r, err := c.GetRing()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Members()
+	}
+
+	a := newEvictor(leader)
+	start := time.Now()
+	a.check(start)
+
+	// Only the lowest live UUID evicts.
+	b := newEvictor(other)
+	b.check(start)
+	b.check(start.Add(2 * time.Minute))
+	if m := members(); !m.Has("dead-a") || !m.Has("dead-b") {
+		t.Fatalf("expected a node other than the leader to leave the ring alone, got %v", m)
+	}
+
+	// dead-a comes back briefly, which restarts its clock.
+	if err := c.RegisterPeer(1, &models.PeerInfo{UUID: "dead-a", Address: "http://127.0.0.1:1"}); err != nil {
+		t.Fatal(err)
+	}
+	a.check(start.Add(30 * time.Second))
+	if err := c.RegisterPeer(1, &models.PeerInfo{UUID: "dead-a"}); err != nil {
+		t.Fatal(err)
+	}
+	a.check(start.Add(40 * time.Second))
+
+	a.check(start.Add(90 * time.Second))
+	if m := members(); !m.Has("dead-a") || m.Has("dead-b") {
+		t.Fatalf("expected only dead-b to be evicted, got %v", m)
+	}
+
+	// One eviction per window.
+	a.check(start.Add(3 * time.Minute))
+	if m := members(); !m.Has("dead-a") {
+		t.Fatalf("expected dead-a to be kept within the window, got %v", m)
+	}
+	if !torus.FlushClusterEvents(time.Second) {
+		t.Fatal("timed out recording cluster events")
+	}
+	events, err := c.(torus.ClusterEventLog).GetClusterEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Op != torus.AuditPeerAutoEvict || events[0].Details["peer"] != "dead-b" || events[0].Source != leader.MDS.UUID() {
+		t.Fatalf("expected the eviction of dead-b as a cluster event, got %+v", events)
+	}
+
+	// A new leader goes by the cluster's events as well as its own.
+	a2 := newEvictor(leader)
+	now := time.Now()
+	a2.check(now)
+	a2.check(now.Add(2 * time.Minute))
+	if m := members(); !m.Has("dead-a") {
+		t.Fatalf("expected dead-a to be kept within the window of the last cluster event, got %v", m)
+	}
+
+	a.check(now.Add(2 * time.Hour))
+	if m := members(); m.Has("dead-a") {
+		t.Fatalf("expected dead-a to be evicted after the window, got %v", m)
+	}
+
+	// The live peers must hold a majority of the capacity.
+	big, err := ring.CreateRing(&models.Ring{
+		Type: uint32(ring.Ketama),
+		Peers: torus.PeerInfoList{
+			{UUID: leader.MDS.UUID(), TotalBlocks: 10},
+			{UUID: "big", TotalBlocks: 10},
+		},
+		ReplicationFactor: 1,
+		Version:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := map[string]bool{leader.MDS.UUID(): true}
+	later := now.Add(4 * time.Hour)
+	if err := a.mayEvict(big, live, later); err == nil {
+		t.Fatal("expected eviction without a majority of the capacity to be refused")
+	}
+}
+
+func TestAutoEvictCordoned(t *testing.T) {
+	srvs, mds := createN(t, 2)
+	defer closeAll(t, srvs...)
+	peers := torus.PeerInfoList{{UUID: "away", TotalBlocks: StorageSize / BlockSize}}
+	leader := srvs[0]
+	for _, s := range srvs {
+		peers = append(peers, &models.PeerInfo{
+			UUID:        s.MDS.UUID(),
+			TotalBlocks: StorageSize / BlockSize,
+		})
+		if s.MDS.UUID() < leader.MDS.UUID() {
+			leader = s
+		}
+	}
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Ketama),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := leader.MDS.(torus.PeerCordoner).SetCordon(torus.Cordon{UUID: "away", Since: start}); err != nil {
+		t.Fatal(err)
+	}
+	d := leader.Blocks.(*Distributor)
+	waitFor(t, func() bool {
+		d.cordons.mut.Lock()
+		if d.cordons.fetching == nil {
+			d.cordons.lastFetch = time.Time{}
+		}
+		d.cordons.mut.Unlock()
+		return len(d.cordons.get()) != 0
+	})
+	a := newAutoEvictor(d)
+	a.after = time.Minute
+	a.cordonTimeout = time.Hour
+	members := func() torus.PeerList {
+		r, err := leader.MDS.GetRing()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Members()
+	}
+
+	a.check(start)
+	a.check(start.Add(2 * time.Minute))
+	if m := members(); !m.Has("away") {
+		t.Fatalf("expected a cordoned peer to be kept, got %v", m)
+	}
+	a.check(start.Add(2 * time.Hour))
+	if m := members(); m.Has("away") {
+		t.Fatalf("expected a peer cordoned past the timeout to be evicted, got %v", m)
+	}
+}
@@ -0,0 +1,141 @@
+package distributor
+
+import (
+	"time"
+
+	"github.com/alternative-storage/torus"
+
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+)
+
+var _ torus.BlockBatchReader = &Distributor{}
+
+// GetBlocks reads the blocks in refs for a sequential read. Runs of blocks
+// whose first replica is the same peer are fetched from it in batches of up
+// to MaxBatchBytes, and each block is cached as it arrives. Blocks that
+// can't be had that way are read one at a time, as GetBlock would, so one
+// block failing leaves the others be.
+func (d *Distributor) GetBlocks(ctx context.Context, refs []torus.BlockRef) ([][]byte, []error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Read Blocks")
+	defer span.Finish()
+	data := make([][]byte, len(refs))
+	errs := make([]error, len(refs))
+	if len(refs) > 1 && torus.ReplicaReadFromContext(ctx) == nil {
+		// Reads that follow the copies of a block need them one at a
+		// time.
+		bctx, cancel := d.withIOTimeout(d.withCacheVersion(ctx))
+		d.getBatched(bctx, refs, data)
+		cancel()
+	}
+	for i, ref := range refs {
+		if data[i] == nil {
+			data[i], errs[i] = d.GetBlock(ctx, ref)
+		}
+	}
+	return data, errs
+}
+
+// getBatched fills in the blocks of refs that are cached, local, or can be
+// fetched in a batch, leaving the rest nil.
+func (d *Distributor) getBatched(ctx context.Context, refs []torus.BlockRef, data [][]byte) {
+	d.mut.RLock()
+	defer d.mut.RUnlock()
+	per := int(d.srv.Cfg.MaxBatchBytes / d.BlockSize())
+	var (
+		peer string
+		run  []int
+	)
+	flush := func() {
+		if len(run) != 0 {
+			d.fetchBatch(ctx, peer, refs, run, data)
+		}
+		run = nil
+	}
+	for i, ref := range refs {
+		if d.scrubMarks.has(ref) {
+			// GetBlock reads another copy.
+			continue
+		}
+		start := time.Now()
+		if bcache, ok := d.readCache.Get(string(ref.ToBytes())); ok {
+			promDistBlockRequests.Inc()
+			promDistBlockCacheHits.Inc()
+			data[i] = bcache.([]byte)
+			d.volumes.observeRead(ref, readSourceCache, start, len(data[i]), nil)
+			continue
+		}
+		p, local := d.batchPeer(ref)
+		if local {
+			b, err := d.blocks.GetBlock(ctx, ref)
+			if err != nil {
+				// GetBlock goes on to the other replicas.
+				continue
+			}
+			promDistBlockRequests.Inc()
+			promDistBlockCacheMisses.Inc()
+			promDistBlockLocalHits.Inc()
+			d.cacheBlock(ctx, ref, b, true)
+			data[i] = b
+			d.volumes.observeRead(ref, readSourceLocal, start, len(b), nil)
+			continue
+		}
+		if p == "" || per < 2 {
+			continue
+		}
+		if p != peer || len(run) == per {
+			flush()
+			peer = p
+		}
+		run = append(run, i)
+	}
+	flush()
+}
+
+// batchPeer returns the peer a block is read from first, or whether it is
+// read from local storage. It returns "" if the block has no peers.
+func (d *Distributor) batchPeer(ref torus.BlockRef) (string, bool) {
+	peers, err := d.ring.GetPeers(ref)
+	if err != nil || len(peers.Peers) == 0 {
+		return "", false
+	}
+	peers = d.client.breakers.preferClosed(peers)
+	for _, p := range peers.Peers[:peers.Replication] {
+		if p == d.UUID() || d.getWriteFromServer() == torus.WriteLocal {
+			return "", true
+		}
+	}
+	for _, p := range peers.Peers {
+		if p != d.UUID() {
+			return p, false
+		}
+	}
+	return "", false
+}
+
+// fetchBatch fetches the blocks of refs at indices run from peer in one
+// request.
+func (d *Distributor) fetchBatch(ctx context.Context, peer string, refs []torus.BlockRef, run []int, data [][]byte) {
+	batch := make([]torus.BlockRef, len(run))
+	for j, i := range run {
+		batch[j] = refs[i]
+	}
+	getctx, cancel := context.WithTimeout(ctx, peerTimeout(ctx, clientTimeout*time.Duration(len(run))))
+	defer cancel()
+	start := time.Now()
+	d.client.GetBlocks(getctx, peer, batch, func(j int, blk []byte, err error) {
+		ref := batch[j]
+		d.volumes.observe(ref, volumeOpFetch, start, len(blk), err)
+		if err != nil {
+			promDistBlockPeerFailures.WithLabelValues(peer).Inc()
+			blockLog(ref, peer).Debugf("batched read from peer failed: %v", err)
+			return
+		}
+		promDistBlockRequests.Inc()
+		promDistBlockCacheMisses.Inc()
+		promDistBlockPeerHits.WithLabelValues(peer).Inc()
+		d.cacheBlock(ctx, ref, blk, false)
+		data[run[j]] = blk
+		d.volumes.observeRead(ref, readSourcePeer, start, len(blk), nil)
+	})
+}
@@ -0,0 +1,103 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"golang.org/x/net/context"
+)
+
+// batchDistributor returns a distributor on the first of three tdp peers
+// holding a single replica of each block, so that most reads go to the
+// other two, and the blocks it wrote.
+func batchDistributor(t testing.TB, n int) (*Distributor, []torus.BlockRef, func()) {
+	srvs, _ := ringNRepScheme(t, 3, 1, "tdp")
+	done := func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}
+	refs := make([]torus.BlockRef, n)
+	for i := range refs {
+		refs[i] = benchRef(i)
+		data := bytes.Repeat([]byte{byte(i)}, BlockSize)
+		if err := srvs[0].Blocks.WriteBlock(context.Background(), refs[i], data); err != nil {
+			done()
+			t.Fatal(err)
+		}
+	}
+	srvs[0].Cfg.MaxBatchBytes = 16 * BlockSize
+	// A distributor of its own, whose cache hasn't seen the writes.
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		done()
+		t.Fatal(err)
+	}
+	return dist, refs, func() {
+		dist.Close()
+		done()
+	}
+}
+
+func TestGetBlocks(t *testing.T) {
+	dist, refs, done := batchDistributor(t, 40)
+	defer done()
+	dist.readCache = newCache(100)
+	// A block nobody has fails alone.
+	missing := benchRef(len(refs))
+	refs = append(refs[:20], append([]torus.BlockRef{missing}, refs[20:]...)...)
+	data, errs := dist.GetBlocks(context.Background(), refs)
+	for i, ref := range refs {
+		if ref == missing {
+			if errs[i] == nil {
+				t.Fatal("expected the missing block to fail")
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("block %d: %v", i, errs[i])
+		}
+		if !bytes.Equal(data[i], bytes.Repeat([]byte{byte(ref.Index - 1)}, BlockSize)) {
+			t.Fatalf("block %d: unexpected data", i)
+		}
+		// Each block is cached as it arrives.
+		if _, ok := dist.readCache.Get(string(ref.ToBytes())); !ok {
+			peers, _ := dist.ring.GetPeers(ref)
+			if peers.Peers[0] != dist.UUID() {
+				t.Fatalf("block %d: expected it to be cached", i)
+			}
+		}
+	}
+}
+
+func BenchmarkReadBlockSequential(b *testing.B) {
+	dist, refs, done := batchDistributor(b, 64)
+	defer done()
+	ctx := context.Background()
+	b.SetBytes(int64(len(refs) * BlockSize))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, ref := range refs {
+			if _, err := dist.GetBlock(ctx, ref); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadBlockBatched(b *testing.B) {
+	dist, refs, done := batchDistributor(b, 64)
+	defer done()
+	ctx := context.Background()
+	b.SetBytes(int64(len(refs) * BlockSize))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, errs := dist.GetBlocks(ctx, refs)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
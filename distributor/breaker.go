@@ -0,0 +1,305 @@
+package distributor
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"golang.org/x/net/context"
+)
+
+const (
+	// breakerBuckets is how many slices the failure window of a peer is
+	// kept in; the oldest slice is dropped as the window moves on.
+	breakerBuckets = 10
+	// breakerMinRequests is how many requests a peer must have been sent
+	// within the window before its failures can open its circuit.
+	breakerMinRequests = 10
+
+	defaultBreakerWindow        = 10 * time.Second
+	defaultBreakerProbeInterval = 5 * time.Second
+)
+
+// errCircuitOpen is returned for requests not sent to a peer because too many
+// of the last ones failed.
+var errCircuitOpen = errors.New("distributor: peer circuit open")
+
+// errDialFailed is recorded against a peer that couldn't be connected to.
+var errDialFailed = errors.New("distributor: couldn't dial peer")
+
+type circuitState int
+
+const (
+	// circuitClosed sends requests to the peer as usual.
+	circuitClosed circuitState = iota
+	// circuitOpen fails requests to the peer right away.
+	circuitOpen
+	// circuitHalfOpen has a single request out to the peer to find out
+	// whether it has recovered.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type breakerBucket struct {
+	// slot is the slice of the window the counts are for.
+	slot                 int64
+	ok, failed, timedOut int
+}
+
+// peerBreaker is the circuit of one peer.
+type peerBreaker struct {
+	state    circuitState
+	buckets  [breakerBuckets]breakerBucket
+	openedAt time.Time
+}
+
+// breakers tracks the rolling failure rate of the requests sent to each peer,
+// and opens a peer's circuit when it gets too high. Once the probe interval
+// has passed, a single request is let through, closing the circuit again if it
+// succeeds.
+type breakers struct {
+	threshold float64
+	window    time.Duration
+	probe     time.Duration
+	// onClose is called when the circuit of a peer closes again.
+	onClose func(peer string)
+
+	mut   sync.Mutex
+	peers map[string]*peerBreaker
+	now   func() time.Time
+}
+
+func newBreakers(cfg torus.Config, onClose func(string)) *breakers {
+	b := &breakers{
+		threshold: cfg.BreakerThreshold,
+		window:    cfg.BreakerWindow,
+		probe:     cfg.BreakerProbeInterval,
+		onClose:   onClose,
+		peers:     make(map[string]*peerBreaker),
+		now:       time.Now,
+	}
+	if b.window <= 0 {
+		b.window = defaultBreakerWindow
+	}
+	if b.probe <= 0 {
+		b.probe = defaultBreakerProbeInterval
+	}
+	return b
+}
+
+// allow reports whether a request may be sent to peer. For an open circuit
+// whose probe interval has passed, it lets a single request through as the
+// probe; its outcome must be recorded.
+func (b *breakers) allow(peer string) bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	pb, ok := b.peers[peer]
+	if !ok {
+		return true
+	}
+	switch pb.state {
+	case circuitOpen:
+		if b.now().Sub(pb.openedAt) < b.probe {
+			return false
+		}
+		b.setState(peer, pb, circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record notes the outcome of a request sent to peer. Requests the caller
+// gave up on, with context.Canceled, say nothing about the peer's health, and
+// a probe that ends that way leaves the circuit open to be probed again.
+func (b *breakers) record(peer string, err error) {
+	if b.threshold == 0 {
+		return
+	}
+	if err == protocols.ErrRefused {
+		// The peer answered, just not with what was asked for.
+		err = nil
+	}
+	b.mut.Lock()
+	pb, ok := b.peers[peer]
+	if !ok {
+		pb = &peerBreaker{}
+		b.peers[peer] = pb
+	}
+	closed := false
+	switch {
+	case err == context.Canceled:
+		if pb.state == circuitHalfOpen {
+			b.setState(peer, pb, circuitOpen)
+		}
+	case pb.state == circuitHalfOpen && err == nil:
+		pb.buckets = [breakerBuckets]breakerBucket{}
+		b.setState(peer, pb, circuitClosed)
+		closed = true
+		torus.WithFields(clog, torus.LogFields{"peer": peer}).Infof("peer is answering again, closing its circuit")
+	case pb.state == circuitHalfOpen:
+		pb.openedAt = b.now()
+		b.setState(peer, pb, circuitOpen)
+	case pb.state == circuitClosed:
+		b.add(peer, pb, err)
+	}
+	b.mut.Unlock()
+	if closed && b.onClose != nil {
+		b.onClose(peer)
+	}
+}
+
+// add counts a request to a peer whose circuit is closed, opening it if too
+// many have failed. b.mut must be held.
+func (b *breakers) add(peer string, pb *peerBreaker, err error) {
+	now := b.now()
+	slot := now.UnixNano() / int64(b.window/breakerBuckets)
+	bk := &pb.buckets[slot%breakerBuckets]
+	if bk.slot != slot {
+		*bk = breakerBucket{slot: slot}
+	}
+	switch {
+	case err == nil:
+		bk.ok++
+	case isTimeout(err):
+		bk.timedOut++
+	default:
+		bk.failed++
+	}
+	var total, failed, timedOut int
+	for _, x := range pb.buckets {
+		if slot-x.slot >= breakerBuckets {
+			continue
+		}
+		total += x.ok + x.failed + x.timedOut
+		failed += x.failed
+		timedOut += x.timedOut
+	}
+	ratio := float64(failed+timedOut) / float64(total)
+	promDistPeerFailureRatio.WithLabelValues(peer).Set(ratio)
+	if total < breakerMinRequests || ratio < b.threshold {
+		return
+	}
+	pb.openedAt = now
+	b.setState(peer, pb, circuitOpen)
+	promDistPeerCircuitTrips.WithLabelValues(peer).Inc()
+	torus.WithFields(clog, torus.LogFields{"peer": peer}).Warningf("opening circuit to peer: %d of the last %d requests failed and %d timed out", failed, total, timedOut)
+}
+
+func (b *breakers) setState(peer string, pb *peerBreaker, s circuitState) {
+	pb.state = s
+	promDistPeerCircuitState.WithLabelValues(peer).Set(float64(s))
+}
+
+// state returns the circuit state of peer.
+func (b *breakers) state(peer string) circuitState {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if pb, ok := b.peers[peer]; ok {
+		return pb.state
+	}
+	return circuitClosed
+}
+
+// open returns the peers whose circuit isn't closed, sorted.
+func (b *breakers) open() []string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	var out []string
+	for peer, pb := range b.peers {
+		if pb.state != circuitClosed {
+			out = append(out, peer)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// probeDue returns the peers whose circuit is open and may be probed.
+func (b *breakers) probeDue() []string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	var out []string
+	for peer, pb := range b.peers {
+		if pb.state == circuitOpen && b.now().Sub(pb.openedAt) >= b.probe {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
+
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// preferClosed moves the replicas among peers whose circuit is open behind
+// the others, so that reads try them last.
+func (b *breakers) preferClosed(peers torus.PeerPermutation) torus.PeerPermutation {
+	if b.threshold == 0 {
+		return peers
+	}
+	rep := peers.Replication
+	if rep > len(peers.Peers) {
+		rep = len(peers.Peers)
+	}
+	var healthy, broken torus.PeerList
+	for _, p := range peers.Peers[:rep] {
+		if b.state(p) == circuitClosed {
+			healthy = append(healthy, p)
+		} else {
+			broken = append(broken, p)
+		}
+	}
+	if len(broken) == 0 {
+		return peers
+	}
+	out := append(append(healthy, broken...), peers.Peers[rep:]...)
+	return torus.PeerPermutation{
+		Replication: peers.Replication,
+		Peers:       out,
+	}
+}
+
+// prober probes the peers whose circuit is open once their probe interval
+// has passed, so that a peer nothing else is sent to can come back.
+func (d *Distributor) prober(closer chan struct{}) {
+	b := d.client.breakers
+	if b.threshold == 0 {
+		return
+	}
+	t := time.NewTicker(b.probe / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-closer:
+			return
+		case <-t.C:
+		}
+		for _, peer := range b.probeDue() {
+			ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+			d.client.probe(ctx, peer)
+			cancel()
+		}
+	}
+}
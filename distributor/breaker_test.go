@@ -0,0 +1,138 @@
+package distributor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+)
+
+func testBreakers(closed *[]string) (*breakers, *time.Time) {
+	now := time.Unix(1000, 0)
+	b := newBreakers(torus.Config{
+		BreakerThreshold:     0.5,
+		BreakerWindow:        10 * time.Second,
+		BreakerProbeInterval: 5 * time.Second,
+	}, func(peer string) { *closed = append(*closed, peer) })
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestBreakerTrips(t *testing.T) {
+	var closed []string
+	b, now := testBreakers(&closed)
+	errDown := errors.New("connection refused")
+
+	// Too few requests to judge the peer by.
+	for i := 0; i < breakerMinRequests-1; i++ {
+		b.record("a", errDown)
+	}
+	if !b.allow("a") {
+		t.Fatal("circuit opened before enough requests were made")
+	}
+	b.record("a", errDown)
+	if b.allow("a") {
+		t.Fatal("expected the circuit to open")
+	}
+	if open := b.open(); len(open) != 1 || open[0] != "a" {
+		t.Fatalf("unexpected open circuits: %v", open)
+	}
+	if !b.allow("b") {
+		t.Fatal("another peer's circuit opened")
+	}
+
+	// A failed probe keeps it open for another interval.
+	*now = now.Add(5 * time.Second)
+	if due := b.probeDue(); len(due) != 1 {
+		t.Fatalf("expected a probe to be due, got %v", due)
+	}
+	if !b.allow("a") {
+		t.Fatal("expected a probe to be let through")
+	}
+	if b.allow("a") {
+		t.Fatal("expected a single probe at a time")
+	}
+	b.record("a", errDown)
+	if b.state("a") != circuitOpen || b.allow("a") {
+		t.Fatal("expected a failed probe to leave the circuit open")
+	}
+
+	// A successful one closes it, and forgets the failures.
+	*now = now.Add(5 * time.Second)
+	if !b.allow("a") {
+		t.Fatal("expected a probe to be let through")
+	}
+	b.record("a", nil)
+	if b.state("a") != circuitClosed || !b.allow("a") {
+		t.Fatal("expected a successful probe to close the circuit")
+	}
+	if len(closed) != 1 || closed[0] != "a" {
+		t.Fatalf("expected to be told the circuit closed, got %v", closed)
+	}
+	b.record("a", errDown)
+	if !b.allow("a") {
+		t.Fatal("expected the failures before the circuit closed to be forgotten")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	var closed []string
+	b, now := testBreakers(&closed)
+	errDown := errors.New("connection refused")
+
+	for i := 0; i < 20; i++ {
+		b.record("a", nil)
+	}
+	for i := 0; i < 19; i++ {
+		b.record("a", errDown)
+	}
+	if !b.allow("a") {
+		t.Fatal("circuit opened below the threshold")
+	}
+	// The successes age out of the window.
+	*now = now.Add(10 * time.Second)
+	for i := 0; i < breakerMinRequests; i++ {
+		b.record("a", errDown)
+	}
+	if b.allow("a") {
+		t.Fatal("expected the circuit to open once the successes aged out")
+	}
+}
+
+func TestBreakerRefused(t *testing.T) {
+	var closed []string
+	b, _ := testBreakers(&closed)
+	for i := 0; i < 2*breakerMinRequests; i++ {
+		b.record("a", protocols.ErrRefused)
+	}
+	if !b.allow("a") {
+		t.Fatal("peer answering with errors of its own opened its circuit")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreakers(torus.Config{}, nil)
+	for i := 0; i < 2*breakerMinRequests; i++ {
+		b.record("a", errors.New("connection refused"))
+	}
+	if !b.allow("a") {
+		t.Fatal("circuit opened with circuit breaking disabled")
+	}
+}
+
+func TestPreferClosed(t *testing.T) {
+	var closed []string
+	b, _ := testBreakers(&closed)
+	for i := 0; i < breakerMinRequests; i++ {
+		b.record("a", errors.New("connection refused"))
+	}
+	peers := b.preferClosed(torus.PeerPermutation{
+		Replication: 2,
+		Peers:       torus.PeerList{"a", "b", "c"},
+	})
+	if peers.Replication != 2 || len(peers.Peers) != 3 || peers.Peers[0] != "b" || peers.Peers[1] != "a" || peers.Peers[2] != "c" {
+		t.Fatalf("unexpected order: %v", peers.Peers)
+	}
+}
@@ -23,12 +23,32 @@ const (
 
 // TODO(barakmich): Clean up errors
 
+// peerConn is an open connection to a peer, shared by the requests to it.
+type peerConn struct {
+	conn protocols.RPC
+	// users is the number of requests currently holding the connection.
+	users    int
+	lastUsed time.Time
+}
+
 // distClient used by client side as a Distributor with connection.
 type distClient struct {
 	dist *Distributor
-	//TODO(barakmich): Better connection pooling
-	openConns map[string]protocols.RPC
-	mut       sync.Mutex
+	// openConns is the pool of connections to each peer, of at most
+	// Cfg.PeerPoolSize connections.
+	openConns map[string][]*peerConn
+	// nconns is the number of open connections, and dialing the number
+	// being set up, which count against the limit like open ones.
+	nconns  int
+	dialing int
+	mut     sync.Mutex
+	// released is signalled whenever a connection goes idle or is closed,
+	// so that requests waiting for a free connection can try again.
+	released *sync.Cond
+	// waiting is the number of requests waiting on released.
+	waiting int
+	// breakers fails requests to peers that keep failing them right away.
+	breakers *breakers
 
 	tracer opentracing.Tracer
 }
@@ -37,8 +57,10 @@ type distClient struct {
 func newDistClient(d *Distributor) *distClient {
 	client := &distClient{
 		dist:      d,
-		openConns: make(map[string]protocols.RPC),
+		openConns: make(map[string][]*peerConn),
 	}
+	client.released = sync.NewCond(&client.mut)
+	client.breakers = newBreakers(d.srv.Cfg, d.flushHandoff)
 	d.srv.AddTimeoutCallback(client.onPeerTimeout)
 	return client
 }
@@ -46,26 +68,228 @@ func newDistClient(d *Distributor) *distClient {
 func (d *distClient) onPeerTimeout(uuid string) {
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	conn, ok := d.openConns[uuid]
-	if !ok {
-		return
+	for _, pc := range d.openConns[uuid] {
+		err := pc.conn.Close()
+		if err != nil {
+			clog.Errorf("peer timeout err on close: %s", err)
+		}
+		d.removeConn(uuid, pc)
 	}
-	err := conn.Close()
-	if err != nil {
-		clog.Errorf("peer timeout err on close: %s", err)
+}
+
+// removeConn forgets a connection to uuid. d.mut must be held.
+func (d *distClient) removeConn(uuid string, pc *peerConn) {
+	pool := d.openConns[uuid]
+	for i, x := range pool {
+		if x != pc {
+			continue
+		}
+		pool = append(pool[:i:i], pool[i+1:]...)
+		d.nconns--
+		break
+	}
+	if len(pool) == 0 {
+		delete(d.openConns, uuid)
+	} else {
+		d.openConns[uuid] = pool
+	}
+	promDistPeerConns.Set(float64(d.nconns))
+	d.released.Broadcast()
+}
+
+// poolSize is the number of connections opened to each peer at most.
+func (d *distClient) poolSize() int {
+	if n := d.dist.srv.Cfg.PeerPoolSize; n > 1 {
+		return n
 	}
-	delete(d.openConns, uuid)
+	return 1
+}
 
+// pickConn returns the connection to uuid a request should use: an idle
+// one, or the least busy one if the pool is full. It returns nil if there is
+// no idle connection and room for another. d.mut must be held.
+func (d *distClient) pickConn(uuid string) *peerConn {
+	var best *peerConn
+	for _, pc := range d.openConns[uuid] {
+		if best == nil || pc.users < best.users {
+			best = pc
+		}
+	}
+	if best == nil || (best.users != 0 && len(d.openConns[uuid]) < d.poolSize()) {
+		return nil
+	}
+	return best
 }
 
-// getConn returns RPC interface after found proper peers.
-func (d *distClient) getConn(uuid string) protocols.RPC {
+// getConn returns a connection to a peer from its pool, dialing another if
+// every one is busy and the pool isn't full. With a limit on peer
+// connections, the least recently used idle connection is closed to make
+// room, and if every connection is busy getConn waits for one to go idle
+// until ctx is done. Every connection returned must be given back with
+// putConn.
+func (d *distClient) getConn(ctx context.Context, uuid string) protocols.RPC {
 	d.mut.Lock()
-	if conn, ok := d.openConns[uuid]; ok {
+	if pc := d.pickConn(uuid); pc != nil {
+		pc.users++
+		d.mut.Unlock()
+		return pc.conn
+	}
+	if !d.reserveConn(ctx, uuid) {
+		d.mut.Unlock()
+		promDistPeerConnsExhausted.Inc()
+		torus.WithFields(clog, torus.LogFields{"peer": uuid}).Warningf("no free connection to peer: all %d are busy", d.dist.srv.Cfg.MaxPeerConns)
+		// Not the peer's doing.
+		d.breakers.record(uuid, context.Canceled)
+		return nil
+	}
+	if pc := d.pickConn(uuid); pc != nil {
+		// Someone else connected while we were waiting.
+		d.dialing--
+		pc.users++
 		d.mut.Unlock()
-		return conn
+		return pc.conn
 	}
 	d.mut.Unlock()
+
+	conn := d.dial(uuid)
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.dialing--
+	if conn == nil {
+		d.released.Broadcast()
+		d.breakers.record(uuid, errDialFailed)
+		return nil
+	}
+	if len(d.openConns[uuid]) >= d.poolSize() {
+		// Lost a race to connect; use the other connections.
+		conn.Close()
+		d.released.Broadcast()
+		pc := d.pickConn(uuid)
+		pc.users++
+		return pc.conn
+	}
+	d.openConns[uuid] = append(d.openConns[uuid], &peerConn{
+		conn:  conn,
+		users: 1,
+	})
+	d.nconns++
+	promDistPeerConns.Set(float64(d.nconns))
+	return conn
+}
+
+// reserveConn makes room for one more connection, closing an idle one or
+// waiting for one to go idle if the limit is reached. It returns false if ctx
+// is done first. Otherwise the caller counts as dialing, even when it stopped
+// waiting because a connection to uuid became usable, which the caller then
+// takes instead of dialing and stops counting itself as dialing. d.mut must
+// be held.
+func (d *distClient) reserveConn(ctx context.Context, uuid string) bool {
+	max := d.dist.srv.Cfg.MaxPeerConns
+	var stop chan struct{}
+	defer func() {
+		if stop != nil {
+			close(stop)
+		}
+	}()
+	for max != 0 && d.nconns+d.dialing >= max {
+		if d.pickConn(uuid) != nil {
+			// Someone else connected while we were waiting.
+			break
+		}
+		if d.closeIdleConn() {
+			continue
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if stop == nil {
+			// Wake up when ctx is done, as well as when a connection
+			// frees up.
+			stop = make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					d.mut.Lock()
+					d.released.Broadcast()
+					d.mut.Unlock()
+				case <-stop:
+				}
+			}()
+		}
+		d.waiting++
+		d.released.Wait()
+		d.waiting--
+	}
+	d.dialing++
+	return true
+}
+
+// closeIdleConn closes the least recently used connection nobody is using,
+// and reports whether there was one. d.mut must be held.
+func (d *distClient) closeIdleConn() bool {
+	var (
+		lru     *peerConn
+		lruPeer string
+	)
+	for uuid, pool := range d.openConns {
+		for _, pc := range pool {
+			if pc.users != 0 {
+				continue
+			}
+			if lru == nil || pc.lastUsed.Before(lru.lastUsed) {
+				lru, lruPeer = pc, uuid
+			}
+		}
+	}
+	if lru == nil {
+		return false
+	}
+	err := lru.conn.Close()
+	if err != nil {
+		clog.Errorf("error closing idle connection to %s: %s", lruPeer, err)
+	}
+	d.removeConn(lruPeer, lru)
+	return true
+}
+
+// acquire returns a connection to a peer for a request, or errCircuitOpen if
+// the peer's circuit is open. The outcome of the request must be recorded
+// with d.breakers.record, and the connection given back with putConn.
+func (d *distClient) acquire(ctx context.Context, uuid string) (protocols.RPC, error) {
+	if !d.breakers.allow(uuid) {
+		return nil, errCircuitOpen
+	}
+	conn := d.getConn(ctx, uuid)
+	if conn == nil {
+		return nil, torus.ErrNoPeer
+	}
+	return conn, nil
+}
+
+// probeRef is the block probes ask peers about. Nobody has it, which any
+// peer that is up can say.
+var probeRef = torus.BlockRef{}
+
+// probe sends a request to a peer whose circuit is open, to close it again if
+// the peer answers.
+func (d *distClient) probe(ctx context.Context, uuid string) {
+	if !d.breakers.allow(uuid) {
+		return
+	}
+	conn := d.getConn(ctx, uuid)
+	if conn == nil {
+		return
+	}
+	defer d.putConn(uuid, conn)
+	_, err := conn.RebalanceCheck(ctx, []torus.BlockRef{probeRef})
+	d.breakers.record(uuid, err)
+	if err != nil {
+		d.resetConn(uuid, conn)
+	}
+}
+
+// dial opens a new connection to a peer.
+func (d *distClient) dial(uuid string) protocols.RPC {
 	pm := d.dist.srv.GetPeerMap()
 	pi := pm[uuid]
 	if pi == nil {
@@ -80,33 +304,82 @@ func (d *distClient) getConn(uuid string) protocols.RPC {
 	if pi.TimedOut {
 		return nil
 	}
+	// Fail fast, rather than on a handshake that never completes.
+	if pi.TLS && d.dist.tls == nil {
+		clog.Errorf("peer %s requires TLS, but this node has no peer certificate (see --peer-cert-file)", uuid)
+		return nil
+	}
+	if !pi.TLS && d.dist.tls != nil {
+		clog.Errorf("peer %s doesn't use TLS, but this node requires it; every peer needs a peer certificate", uuid)
+		return nil
+	}
 	uri, err := url.Parse(pi.Address)
 	if err != nil {
 		clog.Errorf("couldn't parse address %s: %v", pi.Address, err)
 		return nil
 	}
 	gmd := d.dist.srv.MDS.GlobalMetadata()
-	conn, err := protocols.DialRPC(uri, connectTimeout, gmd)
-	d.mut.Lock()
-	defer d.mut.Unlock()
+	conn, err := protocols.DialRPC(uri, connectTimeout, gmd, d.dist.tls)
+	if verr, ok := err.(*protocols.VersionError); ok {
+		clog.Errorf("can't connect to peer %s: it speaks protocol versions %d to %d and this node %d to %d; finish upgrading the cluster", uuid, verr.Remote.MinVersion, verr.Remote.Version, verr.Local.MinVersion, verr.Local.Version)
+		return nil
+	}
 	if err != nil {
 		clog.Errorf("couldn't dial: %v", err)
 		return nil
 	}
-	d.openConns[uuid] = conn
+	if c, ok := conn.(protocols.NegotiatedRPC); ok {
+		if h := c.Negotiated(); h.Version != torus.ProtocolVersion {
+			clog.Infof("speaking protocol version %d to peer %s, which advertises %d (features: %v)", h.Version, uuid, pi.ProtocolVersion, h.Features)
+		}
+	}
+	if c, ok := conn.(protocols.ChunkedRPC); ok && d.dist.srv.Cfg.TransferChunkSize != 0 {
+		c.SetTransferChunkSize(d.dist.srv.Cfg.TransferChunkSize)
+	}
+	if c, ok := conn.(protocols.ChecksummedRPC); ok && d.dist.srv.Cfg.WireChecksum {
+		c.SetWireChecksum(true)
+	}
 	return conn
 }
 
-// resetConn resets connection for the uuid.
-func (d *distClient) resetConn(uuid string) {
+// putConn gives back a connection returned by getConn.
+func (d *distClient) putConn(uuid string, conn protocols.RPC) {
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	conn, ok := d.openConns[uuid]
-	if !ok {
+	pc := d.findConn(uuid, conn)
+	if pc == nil {
+		// It was reset in the meantime.
+		return
+	}
+	pc.users--
+	pc.lastUsed = time.Now()
+	if pc.users == 0 {
+		d.released.Broadcast()
+	}
+}
+
+// findConn returns the pooled connection conn to uuid, or nil if it isn't
+// in the pool. d.mut must be held.
+func (d *distClient) findConn(uuid string, conn protocols.RPC) *peerConn {
+	for _, pc := range d.openConns[uuid] {
+		if pc.conn == conn {
+			return pc
+		}
+	}
+	return nil
+}
+
+// resetConn closes a connection to uuid that failed, so that the next
+// request dials a new one.
+func (d *distClient) resetConn(uuid string, conn protocols.RPC) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	pc := d.findConn(uuid, conn)
+	if pc == nil {
 		return
 	}
-	delete(d.openConns, uuid)
-	err := conn.Close()
+	d.removeConn(uuid, pc)
+	err := pc.conn.Close()
 	if err != nil {
 		clog.Errorf("error resetConn: %s", err)
 	}
@@ -116,10 +389,12 @@ func (d *distClient) resetConn(uuid string) {
 func (d *distClient) Close() error {
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	for _, c := range d.openConns {
-		err := c.Close()
-		if err != nil {
-			return err
+	for _, pool := range d.openConns {
+		for _, pc := range pool {
+			err := pc.conn.Close()
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -127,13 +402,76 @@ func (d *distClient) Close() error {
 
 // GetBlock starts RPC call to get data.
 func (d *distClient) GetBlock(ctx context.Context, uuid string, b torus.BlockRef) ([]byte, error) {
-	conn := d.getConn(uuid)
-	if conn == nil {
-		return nil, torus.ErrNoPeer
+	conn, err := d.acquire(ctx, uuid)
+	if err != nil {
+		return nil, err
 	}
+	defer d.putConn(uuid, conn)
 	data, err := conn.Block(ctx, b)
+	d.breakers.record(uuid, err)
 	if err != nil {
-		d.resetConn(uuid)
+		d.resetConn(uuid, conn)
+		clog.Debug(err)
+		return nil, torus.ErrBlockUnavailable
+	}
+	return data, nil
+}
+
+// GetBlocks fetches several blocks from a peer, in one request if the
+// connection can batch them, calling got with each block or its error as it
+// arrives.
+func (d *distClient) GetBlocks(ctx context.Context, uuid string, refs []torus.BlockRef, got func(i int, data []byte, err error)) {
+	conn, err := d.acquire(ctx, uuid)
+	if err != nil {
+		for i := range refs {
+			got(i, nil, err)
+		}
+		return
+	}
+	bc, ok := conn.(protocols.BatchRPC)
+	if !ok {
+		// Nothing was asked of the peer yet.
+		d.breakers.record(uuid, context.Canceled)
+		d.putConn(uuid, conn)
+		for i, ref := range refs {
+			data, err := d.GetBlock(ctx, uuid, ref)
+			got(i, data, err)
+		}
+		return
+	}
+	defer d.putConn(uuid, conn)
+	arrived := make([]bool, len(refs))
+	err = bc.Blocks(ctx, refs, func(i int, data []byte, err error) {
+		arrived[i] = true
+		if err != nil {
+			clog.Debug(err)
+			err = torus.ErrBlockUnavailable
+		}
+		got(i, data, err)
+	})
+	d.breakers.record(uuid, err)
+	if err != nil {
+		d.resetConn(uuid, conn)
+		clog.Debug(err)
+		for i := range refs {
+			if !arrived[i] {
+				got(i, nil, torus.ErrBlockUnavailable)
+			}
+		}
+	}
+}
+
+// GetBlockRange starts RPC call to get part of a block.
+func (d *distClient) GetBlockRange(ctx context.Context, uuid string, b torus.BlockRef, offset, length uint64) ([]byte, error) {
+	conn, err := d.acquire(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer d.putConn(uuid, conn)
+	data, err := conn.BlockRange(ctx, b, offset, length)
+	d.breakers.record(uuid, err)
+	if err != nil {
+		d.resetConn(uuid, conn)
 		clog.Debug(err)
 		return nil, torus.ErrBlockUnavailable
 	}
@@ -142,13 +480,15 @@ func (d *distClient) GetBlock(ctx context.Context, uuid string, b torus.BlockRef
 
 // PutBlock starts RPC call to put data.
 func (d *distClient) PutBlock(ctx context.Context, uuid string, b torus.BlockRef, data []byte) error {
-	conn := d.getConn(uuid)
-	if conn == nil {
-		return torus.ErrNoPeer
+	conn, err := d.acquire(ctx, uuid)
+	if err != nil {
+		return err
 	}
-	err := conn.PutBlock(ctx, b, data)
+	defer d.putConn(uuid, conn)
+	err = conn.PutBlock(ctx, b, data)
+	d.breakers.record(uuid, err)
 	if err != nil {
-		d.resetConn(uuid)
+		d.resetConn(uuid, conn)
 		if err == context.DeadlineExceeded {
 			return torus.ErrBlockUnavailable
 		}
@@ -157,13 +497,15 @@ func (d *distClient) PutBlock(ctx context.Context, uuid string, b torus.BlockRef
 }
 
 func (d *distClient) Check(ctx context.Context, uuid string, blks []torus.BlockRef) ([]bool, error) {
-	conn := d.getConn(uuid)
-	if conn == nil {
-		return nil, torus.ErrNoPeer
+	conn, err := d.acquire(ctx, uuid)
+	if err != nil {
+		return nil, err
 	}
+	defer d.putConn(uuid, conn)
 	resp, err := conn.RebalanceCheck(ctx, blks)
+	d.breakers.record(uuid, err)
 	if err != nil {
-		d.resetConn(uuid)
+		d.resetConn(uuid, conn)
 		return nil, err
 	}
 	return resp, nil
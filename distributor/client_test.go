@@ -0,0 +1,172 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"golang.org/x/net/context"
+)
+
+func TestMaxPeerConns(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	srvs[0].Cfg.MaxPeerConns = 1
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+
+	for i := 0; i < 10; i++ {
+		ref := torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, 2),
+			Index:    torus.IndexID(i),
+		}
+		data := bytes.Repeat([]byte{byte(i)}, BlockSize)
+		if err := dist.WriteBlock(context.Background(), ref, data); err != nil {
+			t.Fatal(err)
+		}
+		ret, err := dist.GetBlock(context.Background(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ret, data) {
+			t.Fatalf("block %d: read back wrong data", i)
+		}
+		dist.client.mut.Lock()
+		n := dist.client.nconns
+		dist.client.mut.Unlock()
+		if n > 1 {
+			t.Fatalf("expected at most 1 peer connection, got %d", n)
+		}
+	}
+
+	// With the only connection busy, a request to another peer waits for it
+	// and gives up when its context is done.
+	peers := []string{srvs[1].MDS.UUID(), srvs[2].MDS.UUID()}
+	conn := dist.client.getConn(context.Background(), peers[0])
+	if conn == nil {
+		t.Fatal("couldn't connect to peer")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if c := dist.client.getConn(ctx, peers[1]); c != nil {
+		t.Fatal("expected no connection while the pool is exhausted")
+	}
+	dist.client.putConn(peers[0], conn)
+	conn = dist.client.getConn(context.Background(), peers[1])
+	if conn == nil {
+		t.Fatal("expected a connection once the pool had an idle one")
+	}
+	dist.client.putConn(peers[1], conn)
+}
+
+// TestMaxPeerConnsShared has two requests wait for the only connection to a
+// peer, which they end up sharing rather than dialing one of their own.
+func TestMaxPeerConnsShared(t *testing.T) {
+	srvs, _ := ringN(t, 2)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	srvs[0].Cfg.MaxPeerConns = 1
+	srvs[0].Cfg.PeerPoolSize = 2
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+	c := dist.client
+
+	peer := srvs[1].MDS.UUID()
+	conn := c.getConn(context.Background(), peer)
+	if conn == nil {
+		t.Fatal("couldn't connect to peer")
+	}
+	// The connection is busy and the pool has room, so both wait for the
+	// limit to allow another.
+	got := make(chan protocols.RPC, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			got <- c.getConn(context.Background(), peer)
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mut.Lock()
+		waiting := c.waiting
+		c.mut.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 requests waiting for a connection, got %d", waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.putConn(peer, conn)
+	for i := 0; i < 2; i++ {
+		select {
+		case shared := <-got:
+			if shared != conn {
+				t.Fatal("expected the idle connection to be shared")
+			}
+			c.putConn(peer, shared)
+		case <-time.After(time.Second):
+			t.Fatal("request still waiting for a connection")
+		}
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.dialing != 0 || c.nconns != 1 {
+		t.Fatalf("expected 1 connection and none being dialed, got %d and %d", c.nconns, c.dialing)
+	}
+}
+
+func TestPeerPool(t *testing.T) {
+	srvs, _ := ringN(t, 2)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	srvs[0].Cfg.PeerPoolSize = 2
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+
+	// Busy connections are added to until the pool is full, and then
+	// shared.
+	peer := srvs[1].MDS.UUID()
+	var conns []protocols.RPC
+	for i := 0; i < 3; i++ {
+		conn := dist.client.getConn(context.Background(), peer)
+		if conn == nil {
+			t.Fatal("couldn't connect to peer")
+		}
+		defer dist.client.putConn(peer, conn)
+		conns = append(conns, conn)
+	}
+	if conns[0] == conns[1] {
+		t.Fatal("expected a second connection while the first was busy")
+	}
+	if conns[2] != conns[0] && conns[2] != conns[1] {
+		t.Fatal("expected a full pool to be shared")
+	}
+	dist.client.mut.Lock()
+	n := dist.client.nconns
+	dist.client.mut.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 peer connections, got %d", n)
+	}
+}
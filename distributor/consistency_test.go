@@ -0,0 +1,99 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"golang.org/x/net/context"
+)
+
+func TestGetWriteQuorum(t *testing.T) {
+	d := &Distributor{srv: &torus.Server{Cfg: torus.Config{WriteQuorum: 2}}}
+	tests := []struct {
+		consistency string
+		replicas    int
+		want        int
+	}{
+		{"", 3, 2},
+		{"", 1, 1},
+		{torus.ConsistencySync, 3, 3},
+		{torus.ConsistencyQuorum, 3, 2},
+		{torus.ConsistencyQuorum, 5, 3},
+		{torus.ConsistencyAsync, 3, 1},
+	}
+	for _, tt := range tests {
+		if got := d.getWriteQuorum(tt.replicas, tt.consistency); got != tt.want {
+			t.Errorf("%q with %d replicas: expected quorum %d, got %d", tt.consistency, tt.replicas, tt.want, got)
+		}
+	}
+	d.srv.Cfg.WriteQuorum = 0
+	if got := d.getWriteQuorum(3, ""); got != 3 {
+		t.Errorf("expected a quorum of 0 to wait for all 3 replicas, got %d", got)
+	}
+}
+
+func TestValidateConsistency(t *testing.T) {
+	tests := []struct {
+		consistency string
+		replication int
+		ok          bool
+	}{
+		{"", 1, true},
+		{torus.ConsistencySync, 1, true},
+		{torus.ConsistencyQuorum, 2, false},
+		{torus.ConsistencyQuorum, 3, true},
+		{torus.ConsistencyAsync, 1, false},
+		{torus.ConsistencyAsync, 2, true},
+		{"eventual", 3, false},
+	}
+	for _, tt := range tests {
+		err := torus.ValidateConsistency(tt.consistency, tt.replication)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q with replication %d: unexpected result %v", tt.consistency, tt.replication, err)
+		}
+	}
+}
+
+func TestAsyncConsistencyRead(t *testing.T) {
+	srvs, _ := ringNRep(t, 3, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	err := srvs[0].MDS.(*temp.Client).CreateVolume(&models.Volume{
+		Name:        "async",
+		Id:          1,
+		Type:        "block",
+		Consistency: torus.ConsistencyAsync,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, BlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 1),
+		Index:    1,
+	}
+	ref.SetBlockType(torus.TypeBlock)
+	if err := srvs[0].Blocks.WriteBlock(context.Background(), ref, data); err != nil {
+		t.Fatal(err)
+	}
+	// Whichever replica acknowledged the write, every node reads it back.
+	for i, s := range srvs {
+		got, err := s.Blocks.GetBlock(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("server %d: %v", i, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("server %d: read back different data", i)
+		}
+	}
+}
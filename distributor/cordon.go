@@ -0,0 +1,75 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+// cordonRefresh is how long the cordoned peers are cached before they are
+// fetched again, and so how long a cordon takes to reach a running node.
+const cordonRefresh = 5 * time.Second
+
+// cordonCache caches the peers cordoned in the metadata service. They are
+// fetched again in the background once the cache is older than
+// cordonRefresh, by one request at a time, while the last known cordons
+// stay in use. Only the first fetch is waited for.
+type cordonCache struct {
+	mds torus.MetadataService
+
+	mut     sync.Mutex
+	cordons []torus.Cordon
+	// lastFetch is when the last fetch finished, or the zero time before
+	// the first one does.
+	lastFetch time.Time
+	// fetching is closed once the fetch under way, if any, is done.
+	fetching chan struct{}
+}
+
+func newCordonCache(mds torus.MetadataService) *cordonCache {
+	return &cordonCache{mds: mds}
+}
+
+// get returns the current cordons. If they can't be fetched, the last known
+// ones stay in use.
+func (c *cordonCache) get() []torus.Cordon {
+	c.mut.Lock()
+	if c.fetching == nil && time.Since(c.lastFetch) >= cordonRefresh {
+		c.fetching = make(chan struct{})
+		go c.refresh(c.fetching)
+	}
+	if c.lastFetch.IsZero() {
+		wait := c.fetching
+		c.mut.Unlock()
+		<-wait
+		c.mut.Lock()
+	}
+	defer c.mut.Unlock()
+	return c.cordons
+}
+
+// refresh fetches the cordons, and closes done once they are up to date, or
+// couldn't be fetched.
+func (c *cordonCache) refresh(done chan struct{}) {
+	cordons, err := torus.GetCordons(c.mds)
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	defer close(done)
+	c.lastFetch = time.Now()
+	c.fetching = nil
+	if err != nil {
+		clog.Debugf("couldn't get cordons: %v", err)
+		return
+	}
+	c.cordons = cordons
+}
+
+// peers returns the cordoned peers.
+func (c *cordonCache) peers() torus.PeerList {
+	var out torus.PeerList
+	for _, cd := range c.get() {
+		out = append(out, cd.UUID)
+	}
+	return out
+}
@@ -0,0 +1,58 @@
+package distributor
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+)
+
+// slowCordons is a metadata service whose cordons take until release is
+// closed, counting the times they are asked for.
+type slowCordons struct {
+	*temp.Client
+	release chan struct{}
+	calls   int32
+}
+
+func (s *slowCordons) GetCordons() ([]torus.Cordon, error) {
+	atomic.AddInt32(&s.calls, 1)
+	<-s.release
+	return s.Client.GetCordons()
+}
+
+func TestCordonCacheRefresh(t *testing.T) {
+	mds := &slowCordons{
+		Client:  temp.NewClient(torus.Config{}, temp.NewServer()),
+		release: make(chan struct{}),
+	}
+	close(mds.release)
+	c := newCordonCache(mds)
+	if p := c.peers(); len(p) != 0 {
+		t.Fatalf("expected no cordoned peers, got %v", p)
+	}
+	if err := mds.SetCordon(torus.Cordon{UUID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once stale, the cordons are fetched again in the background, once,
+	// and the old ones served in the meantime.
+	mds.release = make(chan struct{})
+	c.mut.Lock()
+	c.lastFetch = time.Now().Add(-cordonRefresh)
+	c.mut.Unlock()
+	for i := 0; i < 10; i++ {
+		if p := c.peers(); len(p) != 0 {
+			t.Fatalf("expected the last known cordons while refreshing, got %v", p)
+		}
+	}
+	close(mds.release)
+	waitFor(t, func() bool {
+		return c.peers().Has("a")
+	})
+	if n := atomic.LoadInt32(&mds.calls); n != 2 {
+		t.Fatalf("expected 2 fetches, got %d", n)
+	}
+}
@@ -0,0 +1,44 @@
+package distributor
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrIOTimeout is returned when a block read or write doesn't complete within
+// the configured I/O timeout.
+var ErrIOTimeout = errors.New("distributor: block i/o timed out")
+
+// withIOTimeout bounds a client read or write by the configured I/O timeout,
+// on top of any deadline ctx already carries.
+func (d *Distributor) withIOTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.srv.Cfg.IOTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.srv.Cfg.IOTimeout)
+}
+
+// ioErr reports a failure that happened because ctx ran out of time as
+// ErrIOTimeout.
+func ioErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrIOTimeout
+	}
+	return err
+}
+
+// peerTimeout is how long to wait on one peer before moving on to the next.
+// When ctx has a deadline, at most half of the time left is spent on a
+// single peer, so there is still time to fail over to another replica.
+func peerTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	if half := deadline.Sub(time.Now()) / 2; half < timeout {
+		return half
+	}
+	return timeout
+}
@@ -4,9 +4,13 @@
 package distributor
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net/url"
 	"sync"
 
+	"golang.org/x/net/context"
+
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/distributor/protocols"
 	"github.com/alternative-storage/torus/distributor/rebalance"
@@ -18,13 +22,37 @@ var (
 	clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "distributor")
 )
 
+// blockLog logs with the block ref and its volume attached, and the peer, if
+// one is given.
+func blockLog(ref torus.BlockRef, peer string) torus.FieldLogger {
+	fields := torus.BlockLogFields(ref)
+	if peer != "" {
+		fields["peer"] = peer
+	}
+	return torus.WithFields(clog, fields)
+}
+
 type Distributor struct {
 	mut       sync.RWMutex
 	blocks    torus.BlockStore
 	srv       *torus.Server
 	client    *distClient
-	rpcSrv    protocols.RPCServer
+	rpcSrvs   []protocols.RPCServer
 	readCache *cache
+	volumes   *volumeMetrics
+	policies  *volumePolicies
+	rebalance *rebalanceControl
+	cordons   *cordonCache
+	gcCtl     *gcControl
+	reaper    *gcReaper
+	// tombReclaimed counts the blocks of each tombstoned volume reclaimed
+	// by the passes since it was deleted. Only the rebalancer uses it.
+	tombReclaimed map[torus.VolumeID]uint64
+	// fences turns away the writes of volume lock holders that have been
+	// taken over from.
+	fences *fences
+	// tls, if set, secures replication in both directions.
+	tls *tls.Config
 
 	ring            torus.Ring
 	closed          bool
@@ -32,27 +60,75 @@ type Distributor struct {
 	ringWatcherChan chan struct{}
 	rebalancer      rebalance.Rebalancer
 	rebalancing     bool
+	rebalancedTo    int
+	repairs         chan blockRepair
+	syncs           *syncTracker
+	hedges          chan struct{}
+	repairerChan    chan struct{}
+	autoEvictChan   chan struct{}
+	scrubChan       chan struct{}
+	scrubNow        chan struct{}
+	scrubMarks      scrubMarks
+	probeChan       chan struct{}
+	// handoffs holds writes for peers whose circuit is open.
+	handoffs handoffs
+	// peersReady is set once the ring has held srv.Cfg.MinPeers peers, and
+	// stays set after that.
+	peersReady bool
+
+	reconcileMut      sync.Mutex
+	reconcileProgress ReconcileProgress
+
+	// drainMut guards draining and rpcSrvs; inflight counts the replication
+	// writes being served.
+	drainMut sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
 }
 
-func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
+// newDistributor serves the distributor on every non-nil address in addrs.
+func newDistributor(srv *torus.Server, addrs ...*url.URL) (*Distributor, error) {
 	var err error
 	d := &Distributor{
-		blocks: srv.Blocks,
-		srv:    srv,
+		blocks:    srv.Blocks,
+		srv:       srv,
+		volumes:   newVolumeMetrics(srv.MDS, srv.Cfg.MaxVolumeMetrics),
+		policies:  newVolumePolicies(srv.MDS),
+		rebalance: newRebalanceControl(srv.MDS),
+		cordons:   newCordonCache(srv.MDS),
+		gcCtl:     newGCControl(srv.MDS),
+		syncs:     newSyncTracker(),
+		fences:    newFences(),
+	}
+	maxHedges := srv.Cfg.MaxHedges
+	if maxHedges <= 0 {
+		maxHedges = defaultMaxHedges
+	}
+	d.hedges = make(chan struct{}, maxHedges)
+	d.tls, err = torus.LoadPeerTLS(srv.Cfg)
+	if err != nil {
+		return nil, err
 	}
 	gmd := d.srv.MDS.GlobalMetadata()
-	if addr != nil {
-		d.rpcSrv, err = protocols.ListenRPC(addr, d, gmd)
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		rpcSrv, err := protocols.ListenRPC(addr, rpcHandler{d}, gmd, d.tls)
 		if err != nil {
-			return nil, err
+			for _, s := range d.rpcSrvs {
+				s.Close()
+			}
+			return nil, fmt.Errorf("distributor: couldn't listen on %s: %v", addr, err)
 		}
+		d.rpcSrvs = append(d.rpcSrvs, rpcSrv)
 	}
 	if srv.Cfg.ReadCacheSize != 0 {
-		size := srv.Cfg.ReadCacheSize / gmd.BlockSize
-		if size < 100 {
-			size = 100
+		d.readCache, err = newPolicyCache(cacheBlocks(srv.Cfg.ReadCacheSize, gmd.BlockSize), srv.Cfg.CachePolicy)
+		if err != nil {
+			d.closeListeners()
+			return nil, err
 		}
-		d.readCache = newCache(int(size))
 	}
 
 	// Set up the rebalancer
@@ -60,13 +136,30 @@ func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.checkMinPeers()
 	d.ringWatcherChan = make(chan struct{})
 	go d.ringWatcher(d.rebalancerChan)
 	d.client = newDistClient(d)
 	g := gc.NewGCController(d.srv, torus.NewINodeStore(d))
-	d.rebalancer = rebalance.NewRebalancer(d, d.blocks, d.client, g)
+	cs := &throttledSender{CheckAndSender: d.client, ctl: d.rebalance}
+	d.reaper = &gcReaper{bs: d.blocks, ctl: d.gcCtl, tombs: d.tombstones}
+	d.rebalancer = rebalance.NewRebalancer(d, d.blocks, cs, g, d.reaper)
 	d.rebalancerChan = make(chan struct{})
 	go d.rebalanceTicker(d.rebalancerChan)
+	d.repairs = make(chan blockRepair, repairQueue)
+	d.repairerChan = make(chan struct{})
+	go d.repairer(d.repairerChan)
+	if srv.Cfg.AutoEvictAfter > 0 {
+		d.autoEvictChan = make(chan struct{})
+		go d.autoEvicter(d.autoEvictChan)
+	}
+	if srv.Cfg.ScrubRate > 0 {
+		d.scrubChan = make(chan struct{})
+		d.scrubNow = make(chan struct{}, 1)
+		go d.scrubLoop(d.scrubChan)
+	}
+	d.probeChan = make(chan struct{})
+	go d.prober(d.probeChan)
 	return d, nil
 }
 
@@ -80,6 +173,49 @@ func (d *Distributor) Ring() torus.Ring {
 	return d.ring
 }
 
+// beginWrite registers a replication write, unless the distributor is
+// draining. Each successful call must be matched by a call to
+// d.inflight.Done.
+func (d *Distributor) beginWrite() bool {
+	d.drainMut.Lock()
+	defer d.drainMut.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflight.Add(1)
+	return true
+}
+
+// closeListeners stops listening for replication requests.
+func (d *Distributor) closeListeners() {
+	d.drainMut.Lock()
+	defer d.drainMut.Unlock()
+	for _, s := range d.rpcSrvs {
+		s.Close()
+	}
+	d.rpcSrvs = nil
+}
+
+// Drain stops serving replication requests, waits for the writes already
+// under way to finish and flushes the local storage.
+func (d *Distributor) Drain(ctx context.Context) error {
+	d.drainMut.Lock()
+	d.draining = true
+	d.drainMut.Unlock()
+	d.closeListeners()
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return d.Flush()
+}
+
 func (d *Distributor) Close() error {
 	d.mut.Lock()
 	defer d.mut.Unlock()
@@ -88,9 +224,16 @@ func (d *Distributor) Close() error {
 	}
 	close(d.rebalancerChan)
 	close(d.ringWatcherChan)
-	if d.rpcSrv != nil {
-		d.rpcSrv.Close()
+	d.gcCtl.close()
+	close(d.repairerChan)
+	if d.autoEvictChan != nil {
+		close(d.autoEvictChan)
+	}
+	if d.scrubChan != nil {
+		close(d.scrubChan)
 	}
+	close(d.probeChan)
+	d.closeListeners()
 	d.client.Close()
 	err := d.blocks.Close()
 	if err != nil {
@@ -2,11 +2,16 @@ package distributor
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
 	"github.com/alternative-storage/torus/metadata/temp"
 
 	_ "github.com/alternative-storage/torus/storage"
@@ -71,3 +76,134 @@ func testOpenClose(t *testing.T) {
 	closeAll(t, srvs...)
 	md.Close()
 }
+
+func freeAddr(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	uri, err := url.Parse("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uri
+}
+
+func TestListenMultipleAddresses(t *testing.T) {
+	md := temp.NewServer()
+	defer md.Close()
+	srv := newServer(md)
+	primary, extra := freeAddr(t), freeAddr(t)
+	if err := ListenReplication(srv, primary, extra); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 1}
+	gmd := srv.MDS.GlobalMetadata()
+	data := make([]byte, gmd.BlockSize)
+	data[0] = 42
+	for _, addr := range []*url.URL{primary, extra} {
+		rpc, err := protocols.DialRPC(addr, time.Second, gmd, nil)
+		if err != nil {
+			t.Fatalf("couldn't dial %s: %v", addr, err)
+		}
+		if err := rpc.PutBlock(context.TODO(), ref, data); err != nil {
+			t.Fatalf("put through %s: %v", addr, err)
+		}
+		b, err := rpc.Block(context.TODO(), ref)
+		if err != nil {
+			t.Fatalf("read through %s: %v", addr, err)
+		}
+		if b[0] != 42 {
+			t.Fatalf("read the wrong block through %s", addr)
+		}
+		rpc.Close()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	peers, err := srv.MDS.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Address != primary.String() {
+		t.Fatalf("expected only %s to be advertised, got %v", primary, peers)
+	}
+
+	// The extra address is taken now, so a second server can't use it.
+	other := newServer(md)
+	err = ListenReplication(other, freeAddr(t), extra)
+	if err == nil {
+		other.Close()
+		t.Fatal("expected listening on a bound address to fail")
+	}
+	if !strings.Contains(err.Error(), extra.String()) {
+		t.Fatalf("expected the error to name %s, got %v", extra, err)
+	}
+}
+
+func TestShutdownDrainsWrites(t *testing.T) {
+	md := temp.NewServer()
+	defer md.Close()
+	srv := newServer(md)
+	addr := freeAddr(t)
+	if err := ListenReplication(srv, addr); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	d := srv.Blocks.(*Distributor)
+
+	// A write still being served holds the shutdown up.
+	if !d.beginWrite() {
+		t.Fatal("expected writes to be accepted before shutting down")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		t.Fatal("expected the shutdown to time out on the write in progress")
+	}
+	d.inflight.Done()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 1}
+	if err := d.PutBlock(context.TODO(), ref, make([]byte, d.BlockSize())); err != torus.ErrClosed {
+		t.Fatalf("expected ErrClosed for a write after shutting down, got %v", err)
+	}
+	if _, err := net.Dial("tcp", addr.Host); err == nil {
+		t.Fatal("expected the replication port to be closed")
+	}
+}
+
+func TestAdvertiseAddress(t *testing.T) {
+	md := temp.NewServer()
+	defer md.Close()
+	srv := newServer(md)
+	srv.Cfg.AdvertiseAddress = "http://10.1.2.3:40000"
+	if err := ListenReplication(srv, freeAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// Heartbeat
+	time.Sleep(10 * time.Millisecond)
+	peers, err := srv.MDS.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Address != srv.Cfg.AdvertiseAddress {
+		t.Fatalf("expected %s to be advertised, got %v", srv.Cfg.AdvertiseAddress, peers)
+	}
+
+	// Nobody else could dial a loopback address.
+	for _, addr := range []string{"http://127.0.0.1:40000", "http://0.0.0.0:40000", "http://localhost:40000"} {
+		other := newServer(md)
+		other.Cfg.AdvertiseAddress = addr
+		err = ListenReplication(other, freeAddr(t))
+		other.Close()
+		if err == nil {
+			t.Fatalf("expected advertising %s to a cluster of two to fail", addr)
+		}
+	}
+}
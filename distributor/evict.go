@@ -0,0 +1,41 @@
+package distributor
+
+import (
+	"github.com/alternative-storage/torus"
+	"golang.org/x/net/context"
+)
+
+// AtRiskBlocks returns the blocks among refs that old, the ring before a peer
+// was evicted, placed on that peer, and that fewer of the remaining peers hold
+// than the ring asks for. Blocks without any holder left are lost unless the
+// evicted peer comes back. Peers that can't be asked are reported as in
+// AuditReplicas.
+func AtRiskBlocks(ctx context.Context, s *torus.Server, old torus.Ring, evicted string, refs []torus.BlockRef) ([]BlockReplicas, map[string]error, error) {
+	var placed []torus.BlockRef
+	for _, ref := range refs {
+		perm, err := old.GetPeers(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		n := perm.Replication
+		if n > len(perm.Peers) {
+			n = len(perm.Peers)
+		}
+		if perm.Peers[:n].Has(evicted) {
+			placed = append(placed, ref)
+		}
+	}
+	reps, peerErrs, err := AuditReplicas(ctx, s, placed)
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(peerErrs, evicted)
+	var out []BlockReplicas
+	for _, r := range reps {
+		r.Holders = torus.PeerList(r.Holders).AndNot(torus.PeerList{evicted})
+		if r.UnderReplicated() {
+			out = append(out, r)
+		}
+	}
+	return out, peerErrs, nil
+}
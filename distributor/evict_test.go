@@ -0,0 +1,99 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"golang.org/x/net/context"
+)
+
+func TestEvictPeer(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	d := srvs[0].Blocks.(*Distributor)
+	ctx := context.Background()
+	data := make([]byte, BlockSize)
+	var refs []torus.BlockRef
+	for i := 0; i < 20; i++ {
+		ref := torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, 2),
+			Index:    torus.IndexID(i + 1),
+		}
+		if err := d.WriteBlock(ctx, ref, data); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+
+	evicted := srvs[2].MDS.UUID()
+	byUUID := make(map[string]*Distributor)
+	for _, s := range srvs {
+		byUUID[s.MDS.UUID()] = s.Blocks.(*Distributor)
+	}
+	// Leave the evicted peer as the only holder of one of its blocks.
+	var lost torus.BlockRef
+	for _, ref := range refs {
+		perm, err := d.Ring().GetPeers(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !perm.Peers[:perm.Replication].Has(evicted) {
+			continue
+		}
+		for _, p := range perm.Peers[:perm.Replication] {
+			if p != evicted {
+				if err := byUUID[p].blocks.DeleteBlock(ctx, ref); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		lost = ref
+		break
+	}
+
+	old, err := torus.EvictPeer(srvs[0].MDS, evicted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := srvs[1].MDS.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Members().Has(evicted) {
+		t.Fatalf("expected %s to be gone from the ring, got %v", evicted, r.Members())
+	}
+	if _, err := torus.EvictPeer(srvs[0].MDS, evicted); err != torus.ErrNoPeer {
+		t.Fatalf("expected ErrNoPeer evicting twice, got %v", err)
+	}
+
+	atRisk, _, err := AtRiskBlocks(ctx, srvs[0], old, evicted, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundLost := false
+	for _, b := range atRisk {
+		perm, err := old.GetPeers(b.Ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !perm.Peers[:perm.Replication].Has(evicted) {
+			t.Fatalf("%s wasn't placed on the evicted peer but is reported at risk", b.Ref)
+		}
+		if torus.PeerList(b.Holders).Has(evicted) {
+			t.Fatalf("evicted peer counted as a holder of %s", b.Ref)
+		}
+		if b.Ref == lost {
+			foundLost = true
+			if len(b.Holders) != 0 {
+				t.Fatalf("expected no holders left for %s, got %v", b.Ref, b.Holders)
+			}
+		}
+	}
+	if !foundLost {
+		t.Fatalf("expected %s to be reported at risk", lost)
+	}
+}
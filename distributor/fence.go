@@ -0,0 +1,41 @@
+package distributor
+
+import (
+	"sync"
+
+	"github.com/alternative-storage/torus"
+)
+
+// fences remembers, for each volume, the latest generation of its write lock
+// that a write has been made under, and turns away writes made under earlier
+// ones: those of a holder the lock has been taken over from. Writes made
+// under no lock, such as those of rebalancing and repair, are let through.
+//
+// A peer only learns of a new generation from the new holder's writes, so
+// the old holder may still write to peers the new one hasn't yet. Those
+// writes are to INodes the old holder can no longer commit, as the metadata
+// service refuses them without the lock, and never over the new holder's.
+type fences struct {
+	mut  sync.Mutex
+	gens map[torus.VolumeID]uint64
+}
+
+func newFences() *fences {
+	return &fences{gens: make(map[torus.VolumeID]uint64)}
+}
+
+// admit reports whether a write to vol made under generation gen of its lock
+// may go ahead, raising the fence to gen if it is the latest yet.
+func (f *fences) admit(vol torus.VolumeID, gen uint64) bool {
+	if gen == 0 {
+		return true
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if gen < f.gens[vol] {
+		promDistFencedWrites.Inc()
+		return false
+	}
+	f.gens[vol] = gen
+	return true
+}
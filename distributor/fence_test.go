@@ -0,0 +1,48 @@
+package distributor
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestFences(t *testing.T) {
+	f := newFences()
+	tests := []struct {
+		vol  torus.VolumeID
+		gen  uint64
+		want bool
+	}{
+		{1, 5, true},
+		{1, 5, true},
+		{1, 0, true},
+		{1, 3, false},
+		{2, 3, true},
+		{1, 8, true},
+		{1, 5, false},
+	}
+	for i, tt := range tests {
+		if got := f.admit(tt.vol, tt.gen); got != tt.want {
+			t.Errorf("%d: volume %d generation %d: expected admitted %v, got %v", i, tt.vol, tt.gen, tt.want, got)
+		}
+	}
+}
+
+func TestWriteBufFenced(t *testing.T) {
+	cfg := torus.Config{StorageSize: 1024 * 1024}
+	bs, err := torus.CreateBlockStore("temp", "current", cfg, torus.GlobalMetadata{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Distributor{blocks: bs, fences: newFences()}
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 2), Index: 1}
+	if _, err := d.WriteBuf(torus.WithLockGeneration(context.Background(), 5), ref); err != nil {
+		t.Fatal(err)
+	}
+	ref.Index = 2
+	if _, err := d.WriteBuf(torus.WithLockGeneration(context.Background(), 4), ref); err != torus.ErrFenced {
+		t.Fatalf("expected ErrFenced writing under an older generation, got %v", err)
+	}
+}
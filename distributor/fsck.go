@@ -0,0 +1,159 @@
+package distributor
+
+import (
+	"errors"
+	"hash/crc32"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/gc"
+	"golang.org/x/net/context"
+)
+
+// FsckReport is what Fsck found in the local storage of a node.
+type FsckReport struct {
+	// Expected is the number of referenced blocks the ring places on the
+	// node, and Stored the number of blocks in its storage.
+	Expected int
+	Stored   int
+	// Missing are blocks the ring places on the node that its storage
+	// doesn't hold.
+	Missing []torus.BlockRef
+	// Orphaned are blocks in its storage that no volume references.
+	Orphaned []torus.BlockRef
+	// Corrupt are blocks in its storage that can't be read, or don't match
+	// the checksum their volume recorded for them.
+	Corrupt []torus.BlockRef
+	// Refetched and Deleted count the blocks a repair fetched again from
+	// other replicas and discarded. Failed maps the blocks it couldn't
+	// repair to the reason.
+	Refetched int
+	Deleted   int
+	Failed    map[torus.BlockRef]error
+}
+
+// Fsck checks local, the storage of the node uuid, against the metadata.
+// refs are the blocks referenced by the volumes of the cluster, and sums the
+// checksums of those that have them. If repair is set, missing and corrupt
+// blocks are fetched again from other replicas and orphaned blocks are
+// deleted; otherwise local is only read.
+//
+// s must have replication open, and is used to read the metadata and to
+// fetch blocks. The node itself should be stopped.
+func Fsck(ctx context.Context, s *torus.Server, local torus.BlockStore, uuid string, refs []torus.BlockRef, sums map[torus.BlockRef]uint32, repair bool) (*FsckReport, error) {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return nil, errors.New("distributor: replication is not open")
+	}
+	r := d.Ring()
+	expected := make(map[torus.BlockRef]bool)
+	for _, ref := range refs {
+		perm, err := r.GetPeers(ref)
+		if err != nil {
+			return nil, err
+		}
+		if perm.Peers[:perm.Replication].Has(uuid) {
+			expected[ref] = true
+		}
+	}
+
+	g := gc.NewGCController(d.srv, torus.NewINodeStore(d))
+	vols, _, err := d.srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		if err := g.PrepVolume(v); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &FsckReport{
+		Expected: len(expected),
+		Failed:   make(map[torus.BlockRef]error),
+	}
+	stored := make(map[torus.BlockRef]bool)
+	it := local.BlockIterator()
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			it.Close()
+			return nil, err
+		}
+		ref := it.BlockRef()
+		stored[ref] = true
+		if g.IsDead(ref) {
+			report.Orphaned = append(report.Orphaned, ref)
+			continue
+		}
+		data, err := local.GetBlock(ctx, ref)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, ref)
+			continue
+		}
+		if sum, ok := sums[ref]; ok && crc32.ChecksumIEEE(data) != sum {
+			report.Corrupt = append(report.Corrupt, ref)
+		}
+		torus.ReleaseBlock(local, data)
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+	report.Stored = len(stored)
+	for _, ref := range refs {
+		if expected[ref] && !stored[ref] {
+			report.Missing = append(report.Missing, ref)
+			delete(expected, ref)
+		}
+	}
+	if !repair {
+		return report, nil
+	}
+
+	for _, ref := range report.Orphaned {
+		if err := local.DeleteBlock(ctx, ref); err != nil {
+			report.Failed[ref] = err
+			continue
+		}
+		report.Deleted++
+	}
+	refetch := append(append([]torus.BlockRef(nil), report.Missing...), report.Corrupt...)
+	for _, ref := range refetch {
+		data, err := d.fetchReplica(ctx, ref, uuid, sums)
+		if err == nil {
+			err = local.WriteBlock(ctx, ref, data)
+		}
+		if err != nil {
+			report.Failed[ref] = err
+			continue
+		}
+		report.Refetched++
+	}
+	return report, local.Flush()
+}
+
+// fetchReplica reads ref from a peer other than skip, passing over copies
+// that don't match its checksum in sums, if it has one.
+func (d *Distributor) fetchReplica(ctx context.Context, ref torus.BlockRef, skip string, sums map[torus.BlockRef]uint32) ([]byte, error) {
+	perm, err := d.Ring().GetPeers(ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range perm.Peers {
+		if p == skip {
+			continue
+		}
+		getctx, cancel := context.WithTimeout(ctx, clientTimeout)
+		data, err := d.client.GetBlock(getctx, p, ref)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if sum, ok := sums[ref]; ok && crc32.ChecksumIEEE(data) != sum {
+			blockLog(ref, p).Warningf("peer holds a corrupt copy of block")
+			continue
+		}
+		return data, nil
+	}
+	return nil, ErrNoPeersBlock
+}
@@ -0,0 +1,125 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/alternative-storage/torus/gc"
+	"github.com/alternative-storage/torus/models"
+)
+
+// fsckDeadVolume is the volume whose blocks fsckGC reports as dead.
+const fsckDeadVolume = 99
+
+type fsckGC struct{}
+
+func (fsckGC) PrepVolume(*models.Volume) error { return nil }
+func (fsckGC) Clear()                          {}
+func (fsckGC) IsDead(ref torus.BlockRef) bool {
+	return ref.Volume() == fsckDeadVolume
+}
+
+func init() {
+	gc.RegisterGC("fsck-test", func(*torus.Server, gc.INodeFetcher) (gc.GC, error) {
+		return fsckGC{}, nil
+	})
+}
+
+func TestFsck(t *testing.T) {
+	srvs, _ := ringNRep(t, 3, 3)
+	defer closeAll(t, srvs...)
+	d := srvs[0].Blocks.(*Distributor)
+	bs, err := blockset.CreateBlocksetFromSpec(blockset.MustParseBlockLayerSpec("crc,base"), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		data := bytes.Repeat([]byte{byte(i + 1)}, BlockSize)
+		if err := bs.PutBlock(ctx, torus.NewINodeRef(1, 1), i, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs := bs.GetAllBlockRefs()
+	sums := blockset.BlockChecksums(bs)
+	waitFor(t, func() bool {
+		for _, s := range srvs {
+			for _, ref := range refs {
+				if ok, _ := s.Blocks.(*Distributor).blocks.HasBlock(ctx, ref); !ok {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	// Check the storage of the first node through the second, as torusctl
+	// would for a stopped node.
+	local := d.blocks
+	uuid := d.UUID()
+	missing, corrupt := refs[1], refs[3]
+	orphan := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(fsckDeadVolume, 1),
+		Index:    1,
+	}
+	if err := local.DeleteBlock(ctx, missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.WriteBlock(ctx, corrupt, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.WriteBlock(ctx, orphan, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(ctx, srvs[1], local, uuid, refs, sums, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Expected != 4 || report.Stored != 4 {
+		t.Fatalf("expected 4 blocks placed and 4 stored, got %+v", report)
+	}
+	for _, c := range []struct {
+		name string
+		got  []torus.BlockRef
+		want torus.BlockRef
+	}{
+		{"missing", report.Missing, missing},
+		{"corrupt", report.Corrupt, corrupt},
+		{"orphaned", report.Orphaned, orphan},
+	} {
+		if len(c.got) != 1 || c.got[0] != c.want {
+			t.Fatalf("expected %s block %s, got %v", c.name, c.want, c.got)
+		}
+	}
+	if ok, _ := local.HasBlock(ctx, orphan); !ok {
+		t.Fatal("a dry run deleted the orphaned block")
+	}
+
+	report, err = Fsck(ctx, srvs[1], local, uuid, refs, sums, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Refetched != 2 || report.Deleted != 1 || len(report.Failed) != 0 {
+		t.Fatalf("expected 2 blocks refetched and 1 deleted, got %+v", report)
+	}
+	got, err := local.GetBlock(ctx, corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte{4}, BlockSize)) {
+		t.Fatal("the corrupt block wasn't replaced with a good copy")
+	}
+
+	report, err = Fsck(ctx, srvs[1], local, uuid, refs, sums, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing)+len(report.Corrupt)+len(report.Orphaned) != 0 {
+		t.Fatalf("expected a clean check after repair, got %+v", report)
+	}
+}
@@ -0,0 +1,293 @@
+package distributor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// gcControl follows the cluster-wide GC settings with a watch, and decides
+// when the rebalancer may delete the dead blocks it finds.
+type gcControl struct {
+	stop context.CancelFunc
+	// kick is signalled when a run is requested, to start the next pass at
+	// once.
+	kick chan struct{}
+
+	mut      sync.Mutex
+	settings torus.GCSettings
+	// runSeen is the latest RunRequested received. pending is set when it
+	// changes, until the next pass starts; that pass is forced.
+	runSeen time.Time
+	pending bool
+	forced  bool
+}
+
+// newGCControl starts following the settings, if mds stores them. Until
+// they arrive, or if it doesn't, dead blocks are deleted at any time, as
+// fast as they are found.
+func newGCControl(mds torus.MetadataService) *gcControl {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &gcControl{
+		stop: cancel,
+		kick: make(chan struct{}, 1),
+	}
+	if gc, ok := mds.(torus.GCController); ok {
+		go g.watch(gc.WatchGCSettings(ctx))
+	}
+	return g
+}
+
+func (g *gcControl) watch(ch <-chan torus.GCSettings) {
+	first := true
+	for gs := range ch {
+		g.update(gs, first)
+		first = false
+	}
+}
+
+// update puts gs in place. A run requested before the first settings
+// arrived, as before a restart, has already been acted on.
+func (g *gcControl) update(gs torus.GCSettings, first bool) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if !first && gs.RunRequested.After(g.runSeen) {
+		clog.Infof("gc: run requested")
+		g.pending = true
+		select {
+		case g.kick <- struct{}{}:
+		default:
+		}
+	}
+	if first || gs.RunRequested.After(g.runSeen) {
+		g.runSeen = gs.RunRequested
+	}
+	g.settings = gs
+	promDistGCRateLimit.Set(float64(gs.RateLimit))
+}
+
+func (g *gcControl) get() torus.GCSettings {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.settings
+}
+
+// startPass is called as a rebalance pass starts, and reports whether it is
+// forced by a run request.
+func (g *gcControl) startPass() bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.forced = g.pending
+	g.pending = false
+	return g.forced
+}
+
+// collecting reports whether dead blocks may be deleted at now: in a forced
+// pass, once a run is requested, or inside the window.
+func (g *gcControl) collecting(now time.Time) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	ok := g.forced || g.pending || g.settings.InWindow(now)
+	collecting := 0.0
+	if ok {
+		collecting = 1
+	}
+	promDistGCCollecting.Set(collecting)
+	return ok
+}
+
+func (g *gcControl) close() {
+	g.stop()
+}
+
+// gcReaper deletes dead blocks from local storage as the GC settings allow.
+// The blocks of volumes deleted securely are overwritten with zeros first.
+type gcReaper struct {
+	bs     torus.BlockStore
+	ctl    *gcControl
+	bucket tokenBucket
+	// tombs returns the tombstones of the deleted volumes.
+	tombs func() []torus.VolumeTombstone
+
+	mut sync.Mutex
+	// secure holds whether each volume dead blocks have been found of in
+	// this pass was deleted securely.
+	secure map[torus.VolumeID]bool
+	// erased counts the blocks of each securely deleted volume overwritten
+	// since it was deleted, or since the node started, if later.
+	erased map[torus.VolumeID]uint64
+}
+
+// startPass sets the tombstones a pass starts with.
+func (r *gcReaper) startPass(tombs []torus.VolumeTombstone) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.secure = make(map[torus.VolumeID]bool)
+	for _, t := range tombs {
+		r.secure[torus.VolumeID(t.ID)] = t.Secure
+	}
+}
+
+// isSecure reports whether the blocks of vid are to be overwritten before
+// they are deleted. A volume the pass didn't start with a tombstone for may
+// have been deleted since, so the tombstones are looked at again, once per
+// volume.
+func (r *gcReaper) isSecure(vid torus.VolumeID) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.secure == nil {
+		r.secure = make(map[torus.VolumeID]bool)
+	}
+	if s, ok := r.secure[vid]; ok {
+		return s
+	}
+	s := false
+	if r.tombs != nil {
+		for _, t := range r.tombs() {
+			if torus.VolumeID(t.ID) == vid {
+				s = t.Secure
+			}
+		}
+	}
+	r.secure[vid] = s
+	return s
+}
+
+// erasedCounts returns the blocks overwritten of each volume of tombs, and
+// forgets those of volumes no longer tombstoned.
+func (r *gcReaper) erasedCounts(tombs []torus.VolumeTombstone) map[torus.VolumeID]uint64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	out := make(map[torus.VolumeID]uint64)
+	for _, t := range tombs {
+		vid := torus.VolumeID(t.ID)
+		if n, ok := r.erased[vid]; ok {
+			out[vid] = n
+		}
+	}
+	r.erased = out
+	return out
+}
+
+func (r *gcReaper) Collecting() bool {
+	return r.ctl.collecting(time.Now())
+}
+
+func (r *gcReaper) DeleteBlock(ctx context.Context, ref torus.BlockRef) error {
+	wait := r.bucket.reserve(int(r.bs.BlockSize()), r.ctl.get().RateLimit, time.Now())
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if r.isSecure(ref.Volume()) {
+		if err := torus.OverwriteBlock(ctx, r.bs, ref); err != nil {
+			promDistGCEraseFailures.Inc()
+			return fmt.Errorf("couldn't erase block: %v", err)
+		}
+		promDistGCErasedBlocks.Inc()
+		r.mut.Lock()
+		if r.erased == nil {
+			r.erased = make(map[torus.VolumeID]uint64)
+		}
+		r.erased[ref.Volume()]++
+		r.mut.Unlock()
+	}
+	err := r.bs.DeleteBlock(ctx, ref)
+	if err == nil {
+		promDistGCReclaimedBlocks.Inc()
+	}
+	return err
+}
+
+// publishGCStatus stores the status of the pass that just finished, if the
+// metadata service keeps them.
+func (d *Distributor) publishGCStatus(st torus.GCStatus) {
+	st.UUID = d.UUID()
+	st.Updated = time.Now().UTC()
+	gc, ok := d.srv.MDS.(torus.GCController)
+	if !ok {
+		return
+	}
+	if err := gc.SetGCStatus(st); err != nil {
+		clog.Errorf("gc: couldn't publish status: %v", err)
+	}
+}
+
+// tombstones returns the tombstones of the deleted volumes, if the metadata
+// service keeps them.
+func (d *Distributor) tombstones() []torus.VolumeTombstone {
+	gc, ok := d.srv.MDS.(torus.GCController)
+	if !ok {
+		return nil
+	}
+	tombs, err := gc.GetTombstones()
+	if err != nil {
+		clog.Errorf("gc: couldn't get tombstones: %v", err)
+		return nil
+	}
+	return tombs
+}
+
+// tombstoneProgress adds the blocks of the deleted volumes of tombs the pass
+// that just finished reclaimed to those reclaimed before, and returns how far
+// this node has got with each.
+func (d *Distributor) tombstoneProgress(tombs []torus.VolumeTombstone) map[uint64]torus.TombstoneProgress {
+	erased := d.reaper.erasedCounts(tombs)
+	if len(tombs) == 0 {
+		d.tombReclaimed = nil
+		return nil
+	}
+	dead := d.rebalancer.DeadByVolume()
+	reclaimed := make(map[torus.VolumeID]uint64)
+	out := make(map[uint64]torus.TombstoneProgress)
+	for _, t := range tombs {
+		vid := torus.VolumeID(t.ID)
+		n := d.tombReclaimed[vid] + uint64(dead[vid].Reclaimed)
+		reclaimed[vid] = n
+		out[t.ID] = torus.TombstoneProgress{
+			Reclaimed: n,
+			Remaining: uint64(dead[vid].Left),
+			Erased:    erased[vid],
+		}
+	}
+	d.tombReclaimed = reclaimed
+	return out
+}
+
+// removeTombstones removes the tombstones of tombs whose volume's blocks no
+// peer of the ring holds any longer, as each has reported in the status of a
+// pass. A peer that is down holds on to the tombstone until it is back, or
+// out of the ring.
+func (d *Distributor) removeTombstones(tombs []torus.VolumeTombstone) {
+	gc, ok := d.srv.MDS.(torus.GCController)
+	if !ok || len(tombs) == 0 {
+		return
+	}
+	statuses, err := gc.GetGCStatuses()
+	if err != nil {
+		clog.Errorf("gc: couldn't get status: %v", err)
+		return
+	}
+	peers := d.Ring().Members()
+	if !peers.Has(d.UUID()) {
+		peers = append(peers, d.UUID())
+	}
+	for _, t := range tombs {
+		p, done := torus.ReclaimProgress(t.ID, peers, statuses)
+		if done < len(peers) {
+			continue
+		}
+		if err := gc.RemoveTombstone(torus.VolumeID(t.ID)); err != nil {
+			clog.Errorf("gc: couldn't remove tombstone of volume %s: %v", t.Name, err)
+			continue
+		}
+		clog.Infof("gc: deleted volume %s reclaimed, %d blocks", t.Name, p.Reclaimed)
+	}
+}
@@ -0,0 +1,148 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+)
+
+func TestGCControlRunRequests(t *testing.T) {
+	g := &gcControl{kick: make(chan struct{}, 1)}
+	noon := time.Date(2017, 3, 1, 12, 0, 0, 0, time.Local)
+	old := time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)
+	// A run requested before the node started was already acted on.
+	g.update(torus.GCSettings{WindowStart: "01:00", WindowEnd: "05:00", RunRequested: old}, true)
+	if g.startPass() {
+		t.Fatal("expected an old run request to be ignored")
+	}
+	if g.collecting(noon) {
+		t.Fatal("expected no collecting outside the window")
+	}
+
+	// A new request collects from then on, and forces the next pass.
+	gs := g.get()
+	gs.RunRequested = old.Add(time.Hour)
+	g.update(gs, false)
+	select {
+	case <-g.kick:
+	default:
+		t.Fatal("expected a run request to kick the rebalancer")
+	}
+	if !g.collecting(noon) {
+		t.Fatal("expected collecting once a run is requested")
+	}
+	if !g.startPass() || !g.collecting(noon) {
+		t.Fatal("expected the next pass to be forced")
+	}
+	if g.startPass() || g.collecting(noon) {
+		t.Fatal("expected the pass after it to follow the window again")
+	}
+
+	// Changing other settings doesn't count as a request.
+	gs.RateLimit = 1 << 20
+	g.update(gs, false)
+	if g.startPass() {
+		t.Fatal("expected no run from a settings change")
+	}
+}
+
+func TestTombstoneRemoved(t *testing.T) {
+	srvs, md := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	mds := temp.NewClient(torus.Config{}, md)
+	vol := &models.Volume{Name: "deleted", Id: 42, Type: "block"}
+	if err := mds.CreateVolume(vol); err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.DeleteVolume(vol.Name); err != nil {
+		t.Fatal(err)
+	}
+	gs, err := mds.GetGCSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs.RunRequested = time.Now().UTC()
+	if err := mds.SetGCSettings(gs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once every peer has passed over its blocks without finding any of
+	// the volume's, the tombstone goes.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		tombs, err := mds.GetTombstones()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tombs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the tombstone to be removed, still have %v", tombs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReaperErasesSecureVolumes(t *testing.T) {
+	cfg := torus.Config{StorageSize: 1024 * 1024}
+	bs, err := torus.CreateBlockStore("temp", "current", cfg, torus.GlobalMetadata{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Volume 3 is deleted securely once the pass has started.
+	tombs := []torus.VolumeTombstone{{ID: 1, Secure: true}, {ID: 2}}
+	r := &gcReaper{
+		bs:    bs,
+		ctl:   &gcControl{},
+		tombs: func() []torus.VolumeTombstone { return append(tombs, torus.VolumeTombstone{ID: 3, Secure: true}) },
+	}
+	r.startPass(tombs)
+	bufs := make(map[torus.VolumeID][]byte)
+	for vid := torus.VolumeID(1); vid <= 3; vid++ {
+		ref := torus.BlockRef{INodeRef: torus.NewINodeRef(vid, 1), Index: 1}
+		data := make([]byte, 1024)
+		data[0] = 0xff
+		if err := bs.WriteBlock(context.TODO(), ref, data); err != nil {
+			t.Fatal(err)
+		}
+		// The temp store hands out the block's own buffer.
+		if bufs[vid], err = bs.GetBlock(context.TODO(), ref); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.DeleteBlock(context.TODO(), ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for vid, want := range map[torus.VolumeID]byte{1: 0, 2: 0xff, 3: 0} {
+		if bufs[vid][0] != want {
+			t.Errorf("volume %d: expected the block to start with %#x, got %#x", vid, want, bufs[vid][0])
+		}
+	}
+	erased := r.erasedCounts(append(tombs, torus.VolumeTombstone{ID: 3}))
+	if erased[1] != 1 || erased[2] != 0 || erased[3] != 1 {
+		t.Fatalf("unexpected erased counts %v", erased)
+	}
+
+	// A store that can't overwrite blocks keeps them.
+	r.bs = struct{ torus.BlockStore }{bs}
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 2}
+	if err := bs.WriteBlock(context.TODO(), ref, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteBlock(context.TODO(), ref); err == nil {
+		t.Fatal("expected a block that can't be erased to be left behind")
+	}
+	if ok, _ := bs.HasBlock(context.TODO(), ref); !ok {
+		t.Fatal("expected the block to still be there")
+	}
+}
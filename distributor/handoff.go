@@ -0,0 +1,86 @@
+package distributor
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// maxHandoffBytes is how much block data may wait for peers whose circuit is
+// open; writes past it are dropped, to be put right by the rebalancer.
+const maxHandoffBytes = 64 << 20
+
+// handoffs holds the copies of blocks that couldn't be written to a peer
+// because its circuit was open, until it closes again.
+type handoffs struct {
+	mut    sync.Mutex
+	queued map[string][]blockRepair
+	bytes  int
+}
+
+// handOff queues writing data as block ref to peer once its circuit closes,
+// and reports whether there was room for it.
+func (d *Distributor) handOff(peer string, ref torus.BlockRef, data []byte) bool {
+	h := &d.handoffs
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.bytes+len(data) > maxHandoffBytes {
+		promDistHandoffDropped.Inc()
+		blockLog(ref, peer).Warningf("handoff queue full, dropping write to peer")
+		return false
+	}
+	if h.queued == nil {
+		h.queued = make(map[string][]blockRepair)
+	}
+	// Local storage may hand out its own memory.
+	data = append([]byte(nil), data...)
+	h.queued[peer] = append(h.queued[peer], blockRepair{ref: ref, data: data, peer: peer})
+	h.bytes += len(data)
+	promDistHandoffBlocks.Inc()
+	blockLog(ref, peer).Debugf("peer circuit open, holding write for it")
+	return true
+}
+
+// flushHandoff writes the blocks held for peer in the background. It is
+// called when the peer's circuit closes; writes that fail again stay queued
+// for the next time.
+func (d *Distributor) flushHandoff(peer string) {
+	h := &d.handoffs
+	h.mut.Lock()
+	queued := h.queued[peer]
+	delete(h.queued, peer)
+	h.mut.Unlock()
+	if len(queued) == 0 {
+		return
+	}
+	go func() {
+		for n, r := range queued {
+			ctx, cancel := context.WithTimeout(context.Background(), writeClientTimeout)
+			err := d.client.PutBlock(ctx, peer, r.ref, r.data)
+			cancel()
+			if err != nil {
+				blockLog(r.ref, peer).Noticef("couldn't write held block to peer: %v", err)
+				d.requeueHandoff(peer, queued[n:])
+				return
+			}
+			h.mut.Lock()
+			h.bytes -= len(r.data)
+			h.mut.Unlock()
+			promDistHandoffBlocks.Dec()
+		}
+		torus.WithFields(clog, torus.LogFields{"peer": peer}).Infof("wrote %d blocks held for peer", len(queued))
+	}()
+}
+
+// requeueHandoff puts back writes held for peer that couldn't be made.
+func (d *Distributor) requeueHandoff(peer string, rs []blockRepair) {
+	h := &d.handoffs
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.queued == nil {
+		h.queued = make(map[string][]blockRepair)
+	}
+	h.queued[peer] = append(rs, h.queued[peer]...)
+}
@@ -0,0 +1,97 @@
+package distributor
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// defaultMaxHedges caps the hedged reads in flight when the configuration
+// leaves it unset.
+const defaultMaxHedges = 16
+
+type hedgeResult struct {
+	peerBlock
+	hedge bool
+	err   error
+}
+
+// readHedged reads a block from the remote replicas in order. If the read in
+// flight hasn't answered within the configured delay, the next replica is
+// asked too, and whichever answers first wins.
+func (d *Distributor) readHedged(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation) ([]byte, string, error) {
+	var remote []string
+	for _, p := range peers.Peers[:peers.Replication] {
+		if p != d.UUID() {
+			remote = append(remote, p)
+		}
+	}
+	return hedgedRead(ctx, remote, d.srv.Cfg.HedgeAfter, d.hedges, func(ctx context.Context, peer string) ([]byte, error) {
+		getctx, cancel := context.WithTimeout(ctx, peerTimeout(ctx, clientTimeout))
+		defer cancel()
+		return d.readFromPeer(getctx, i, peer)
+	})
+}
+
+// hedgedRead reads from peers one at a time, moving on when a read fails.
+// Once, if a read takes longer than after, the next peer is read at the same
+// time, as long as a slot in hedges is free. The reads still in flight when
+// one succeeds are cancelled.
+func hedgedRead(ctx context.Context, peers []string, after time.Duration, hedges chan struct{}, read func(context.Context, string) ([]byte, error)) ([]byte, string, error) {
+	if len(peers) == 0 {
+		return nil, "", ErrNoPeersBlock
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, len(peers))
+	next, pending := 0, 0
+	start := func(hedge bool) {
+		peer := peers[next]
+		next++
+		pending++
+		go func() {
+			if hedge {
+				defer func() { <-hedges }()
+			}
+			blk, err := read(ctx, peer)
+			results <- hedgeResult{peerBlock{blk, peer}, hedge, err}
+		}()
+	}
+	start(false)
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next == len(peers) {
+				continue
+			}
+			select {
+			case hedges <- struct{}{}:
+				promDistHedgedReads.Inc()
+				start(true)
+			default:
+				// Too many reads are hedged already; the cluster is
+				// slow as a whole, and hedging would only add to it.
+				promDistHedgedReadsCapped.Inc()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if r.hedge {
+					promDistHedgedReadWins.Inc()
+				}
+				return r.blk, r.peer, nil
+			}
+			clog.Debugf("hedged read from %s failed: %v", r.peer, r.err)
+			if pending == 0 && next < len(peers) {
+				start(false)
+			}
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+	return nil, "", ErrNoPeersBlock
+}
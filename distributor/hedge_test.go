@@ -0,0 +1,79 @@
+package distributor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// slowReads answers reads from each peer after the given delay, failing
+// those with a negative one.
+func slowReads(delays map[string]time.Duration, cancelled chan string) func(context.Context, string) ([]byte, error) {
+	return func(ctx context.Context, peer string) ([]byte, error) {
+		d := delays[peer]
+		if d < 0 {
+			return nil, errors.New("failed")
+		}
+		select {
+		case <-time.After(d):
+			return []byte(peer), nil
+		case <-ctx.Done():
+			if cancelled != nil {
+				cancelled <- peer
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestHedgedRead(t *testing.T) {
+	peers := []string{"a", "b", "c"}
+	ctx := context.Background()
+
+	// A fast first replica is never hedged.
+	read := slowReads(map[string]time.Duration{"a": 0, "b": 0}, nil)
+	_, peer, err := hedgedRead(ctx, peers, time.Hour, make(chan struct{}, 1), read)
+	if err != nil || peer != "a" {
+		t.Fatalf("expected a read from a, got %q, %v", peer, err)
+	}
+
+	// A slow one is, and the loser is cancelled.
+	cancelled := make(chan string, 1)
+	read = slowReads(map[string]time.Duration{"a": time.Hour, "b": 0}, cancelled)
+	hedges := make(chan struct{}, 1)
+	_, peer, err = hedgedRead(ctx, peers, 10*time.Millisecond, hedges, read)
+	if err != nil || peer != "b" {
+		t.Fatalf("expected the hedge to b to win, got %q, %v", peer, err)
+	}
+	select {
+	case p := <-cancelled:
+		if p != "a" {
+			t.Fatalf("expected the read from a to be cancelled, got %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the read from a wasn't cancelled")
+	}
+
+	// Failures move on without waiting for the hedge.
+	read = slowReads(map[string]time.Duration{"a": -1, "b": -1, "c": 0}, nil)
+	_, peer, err = hedgedRead(ctx, peers, time.Hour, hedges, read)
+	if err != nil || peer != "c" {
+		t.Fatalf("expected a read from c, got %q, %v", peer, err)
+	}
+	read = slowReads(map[string]time.Duration{"a": -1, "b": -1, "c": -1}, nil)
+	if _, _, err = hedgedRead(ctx, peers, time.Hour, hedges, read); err != ErrNoPeersBlock {
+		t.Fatalf("expected ErrNoPeersBlock, got %v", err)
+	}
+}
+
+func TestHedgedReadCapped(t *testing.T) {
+	hedges := make(chan struct{}, 1)
+	hedges <- struct{}{}
+	read := slowReads(map[string]time.Duration{"a": 50 * time.Millisecond, "b": 0}, nil)
+	_, peer, err := hedgedRead(context.Background(), []string{"a", "b"}, time.Millisecond, hedges, read)
+	if err != nil || peer != "a" {
+		t.Fatalf("expected no hedge past the cap, got %q, %v", peer, err)
+	}
+}
@@ -2,55 +2,199 @@ package distributor
 
 import (
 	"container/list"
+	"fmt"
 	"reflect"
 	"sync"
 )
 
-// cache implements an LRU cache.
+const (
+	// cachePolicyLRU evicts the least recently used entry.
+	cachePolicyLRU = "lru"
+	// cachePolicy2Q keeps entries on probation until they are asked for
+	// again, so that a scan through a large volume doesn't push out the
+	// blocks that are read over and over.
+	cachePolicy2Q = "2q"
+
+	// maxInvalidations is how many invalidated keys the cache remembers, to
+	// turn away reads that started before the invalidation.
+	maxInvalidations = 4096
+)
+
+// segment is the list of the cache an entry is kept in.
+type segment int
+
+const (
+	segMain segment = iota
+	segPinned
+	// segRecent holds the entries of a 2Q cache on probation.
+	segRecent
+)
+
+// cache implements an LRU cache. Entries added with PutPinned are ordered
+// apart from the others, and only evicted once there are no others left.
+// Under the 2Q policy, entries are added on probation and only move in with
+// the others if they are added again after being evicted from it. Entries
+// read ahead of time are put on probation under either policy; under LRU they
+// move in with the others once they are asked for.
 type cache struct {
 	cache    map[string]*list.Element
 	priority *list.List
-	maxSize  int
-	mut      sync.Mutex
+	pinned   *list.List
+	recent   *list.List
+	// ghosts remembers the keys recently evicted from probation.
+	ghosts    map[string]*list.Element
+	ghostList *list.List
+	policy    string
+	maxSize   int
+	mut       sync.Mutex
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	bytes     uint64
+
+	// gen counts invalidations. invalidated holds the generation each of
+	// the last maxInvalidations keys was invalidated at, oldest first in
+	// invalidOrder, and floor the newest generation forgotten.
+	gen          uint64
+	invalidated  map[string]uint64
+	invalidOrder *list.List
+	floor        uint64
 }
 
 type kv struct {
 	key   string
 	value interface{}
+	seg   segment
 }
 
 func newCache(size int) *cache {
+	c, _ := newPolicyCache(size, cachePolicyLRU)
+	return c
+}
+
+// newPolicyCache returns a cache of size entries evicting by policy, which is
+// cachePolicyLRU if empty.
+func newPolicyCache(size int, policy string) (*cache, error) {
+	switch policy {
+	case "":
+		policy = cachePolicyLRU
+	case cachePolicyLRU, cachePolicy2Q:
+	default:
+		return nil, fmt.Errorf("distributor: unknown cache policy %q", policy)
+	}
 	var lru cache
 	lru.maxSize = size
+	lru.policy = policy
 	lru.priority = list.New()
+	lru.pinned = list.New()
+	lru.recent = list.New()
+	lru.ghostList = list.New()
 	lru.cache = make(map[string]*list.Element)
-	return &lru
+	lru.ghosts = make(map[string]*list.Element)
+	lru.invalidated = make(map[string]uint64)
+	lru.invalidOrder = list.New()
+	return &lru, nil
 }
 
 func (lru *cache) Put(key string, value interface{}) {
+	lru.put(key, value, false, nil)
+}
+
+// PutPinned adds an entry that is kept over the ones added with Put.
+func (lru *cache) PutPinned(key string, value interface{}) {
+	lru.put(key, value, true, nil)
+}
+
+// putSince adds an entry read at generation gen, as returned by version, and
+// leaves it out if key was invalidated since.
+func (lru *cache) putSince(key string, value interface{}, pinned bool, gen uint64) {
+	lru.put(key, value, pinned, &gen)
+}
+
+// putAhead adds an entry fetched ahead of a reader. Once such entries take up
+// a quarter of the cache, they push out each other rather than the entries
+// already asked for.
+func (lru *cache) putAhead(key string, value interface{}, since *uint64) {
+	lru.insert(key, value, segRecent, since)
+}
+
+func (lru *cache) put(key string, value interface{}, pinned bool, since *uint64) {
+	want := segMain
+	if pinned {
+		want = segPinned
+	}
+	lru.insert(key, value, want, since)
+}
+
+// insert adds an entry to segment want, or to where the policy puts it if
+// want is segMain.
+func (lru *cache) insert(key string, value interface{}, want segment, since *uint64) {
 	if lru == nil {
 		return
 	}
 	lru.mut.Lock()
 	defer lru.mut.Unlock()
-	if v, ok := lru.get(key); ok {
-		if reflect.DeepEqual(v, value) {
+	if lru.maxSize == 0 {
+		return
+	}
+	if since != nil && (*since < lru.floor || lru.invalidated[key] > *since) {
+		// The value may predate a write.
+		return
+	}
+	if element, ok := lru.cache[key]; ok && want == segRecent {
+		if reflect.DeepEqual(element.Value.(kv).value, value) {
+			// Reading ahead isn't a use of the entry.
 			return
 		}
-		// Actually find() is not necessary, but it makes sure to remove
-		// correct element and the find loop would be finished soon, since
-		// the element is in the front now.
-		if old := lru.find(lru.priority.Front(), v); old != nil {
-			lru.priority.Remove(old)
-		} else {
-			clog.Fatalf("read cache is corrupted. Please restart the process.")
+	}
+	seg := lru.segmentFor(key, want)
+	if element, ok := lru.cache[key]; ok {
+		old := element.Value.(kv)
+		if want != segPinned && old.seg != segPinned {
+			seg = old.seg
+		}
+		if reflect.DeepEqual(old.value, value) && old.seg == seg {
+			lru.get(key)
+			return
 		}
+		lru.remove(key)
 	}
-	if len(lru.cache) == lru.maxSize {
+	for len(lru.cache) >= lru.maxSize {
 		lru.removeOldest()
 	}
-	lru.priority.PushFront(kv{key: key, value: value})
-	lru.cache[key] = lru.priority.Front()
+	l := lru.list(seg)
+	l.PushFront(kv{key: key, value: value, seg: seg})
+	lru.cache[key] = l.Front()
+	lru.bytes += valueBytes(value)
+	lru.updateMetrics()
+}
+
+// segmentFor returns the list a new entry for key goes in, asked for in want.
+// lru.mut must be held.
+func (lru *cache) segmentFor(key string, want segment) segment {
+	if want != segMain {
+		return want
+	}
+	if lru.policy != cachePolicy2Q {
+		return segMain
+	}
+	if e, ok := lru.ghosts[key]; ok {
+		// Asked for again since it was evicted from probation.
+		lru.ghostList.Remove(e)
+		delete(lru.ghosts, key)
+		return segMain
+	}
+	return segRecent
+}
+
+func (lru *cache) list(seg segment) *list.List {
+	switch seg {
+	case segPinned:
+		return lru.pinned
+	case segRecent:
+		return lru.recent
+	}
+	return lru.priority
 }
 
 func (lru *cache) Get(key string) (interface{}, bool) {
@@ -59,28 +203,172 @@ func (lru *cache) Get(key string) (interface{}, bool) {
 	}
 	lru.mut.Lock()
 	defer lru.mut.Unlock()
-	return lru.get(key)
+	v, ok := lru.get(key)
+	if ok {
+		lru.hits++
+	} else {
+		lru.misses++
+	}
+	promDistCacheHitRatio.Set(float64(lru.hits) / float64(lru.hits+lru.misses))
+	return v, ok
+}
+
+// Remove drops key from the cache, if it's there.
+func (lru *cache) Remove(key string) {
+	if lru == nil {
+		return
+	}
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	lru.remove(key)
+}
+
+// Invalidate drops key from the cache, and keeps the reads of key already
+// under way from adding what they read back with putSince.
+func (lru *cache) Invalidate(key string) {
+	if lru == nil {
+		return
+	}
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	lru.remove(key)
+	lru.gen++
+	if _, ok := lru.invalidated[key]; !ok {
+		lru.invalidOrder.PushBack(key)
+	}
+	lru.invalidated[key] = lru.gen
+	for lru.invalidOrder.Len() > maxInvalidations {
+		oldest := lru.invalidOrder.Remove(lru.invalidOrder.Front()).(string)
+		lru.floor = lru.invalidated[oldest]
+		delete(lru.invalidated, oldest)
+	}
+}
+
+// version returns the generation of the cache, for putSince.
+func (lru *cache) version() uint64 {
+	if lru == nil {
+		return 0
+	}
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	return lru.gen
+}
+
+func (lru *cache) remove(key string) {
+	element, ok := lru.cache[key]
+	if !ok {
+		return
+	}
+	e := element.Value.(kv)
+	lru.list(e.seg).Remove(element)
+	delete(lru.cache, key)
+	lru.bytes -= valueBytes(e.value)
+	lru.updateMetrics()
+}
+
+// resize changes the number of entries the cache holds at most, evicting
+// entries to fit.
+func (lru *cache) resize(size int) {
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	lru.maxSize = size
+	for len(lru.cache) > size {
+		lru.removeOldest()
+	}
+	for lru.ghostList.Len() > size/2 {
+		lru.dropGhost()
+	}
+	lru.updateMetrics()
+}
+
+// cacheStats is the state of a cache.
+type cacheStats struct {
+	size, entries           int
+	policy                  string
+	hits, misses, evictions uint64
+	bytes                   uint64
+}
+
+// stats returns the size and contents of the cache, and how it has fared.
+func (lru *cache) stats() cacheStats {
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	return cacheStats{
+		size:      lru.maxSize,
+		policy:    lru.policy,
+		entries:   len(lru.cache),
+		hits:      lru.hits,
+		misses:    lru.misses,
+		evictions: lru.evictions,
+		bytes:     lru.bytes,
+	}
 }
 
 func (lru *cache) get(key string) (interface{}, bool) {
 	if element, ok := lru.cache[key]; ok {
-		lru.priority.MoveToFront(element)
-		return element.Value.(kv).value, true
+		e := element.Value.(kv)
+		switch {
+		case e.seg == segRecent && lru.policy != cachePolicy2Q:
+			// Read ahead, and now asked for.
+			lru.recent.Remove(element)
+			e.seg = segMain
+			lru.cache[key] = lru.priority.PushFront(e)
+		case e.seg != segRecent:
+			// Probation is first in, first out.
+			lru.list(e.seg).MoveToFront(element)
+		}
+		return e.value, true
 	}
 	return nil, false
 }
 
 func (lru *cache) removeOldest() {
-	last := lru.priority.Remove(lru.priority.Back())
-	delete(lru.cache, last.(kv).key)
+	l := lru.priority
+	if lru.recent.Len() != 0 && (lru.recent.Len() > lru.maxSize/4 || l.Len() == 0) {
+		l = lru.recent
+	}
+	if l.Len() == 0 {
+		l = lru.pinned
+	}
+	last := l.Remove(l.Back()).(kv)
+	delete(lru.cache, last.key)
+	lru.bytes -= valueBytes(last.value)
+	lru.evictions++
+	promDistCacheEvictions.Inc()
+	if last.seg == segRecent && lru.policy == cachePolicy2Q && lru.maxSize/2 > 0 {
+		lru.ghosts[last.key] = lru.ghostList.PushFront(last.key)
+		for lru.ghostList.Len() > lru.maxSize/2 {
+			lru.dropGhost()
+		}
+	}
+}
+
+func (lru *cache) dropGhost() {
+	key := lru.ghostList.Remove(lru.ghostList.Back()).(string)
+	delete(lru.ghosts, key)
+}
+
+func (lru *cache) updateMetrics() {
+	promDistCacheResidentBytes.Set(float64(lru.bytes))
+}
+
+// valueBytes returns the size of a cached value, for the blocks it holds.
+func valueBytes(v interface{}) uint64 {
+	if b, ok := v.([]byte); ok {
+		return uint64(len(b))
+	}
+	return 0
 }
 
-func (lru *cache) find(e *list.Element, v interface{}) *list.Element {
-	if e == nil {
-		return nil
+// cacheBlocks returns the number of blocks of blockSize a cache of size bytes
+// holds, which is at least 100 unless size is zero.
+func cacheBlocks(size, blockSize uint64) int {
+	if size == 0 {
+		return 0
 	}
-	if reflect.DeepEqual(e.Value.(kv).value, v) {
-		return e
+	n := size / blockSize
+	if n < 100 {
+		n = 100
 	}
-	return lru.find(e.Next(), v)
+	return int(n)
 }
@@ -0,0 +1,134 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCache2QScan(t *testing.T) {
+	c, err := newPolicyCache(8, cachePolicy2Q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks evicted from probation and asked for again are kept over a
+	// scan.
+	c.Put("hot1", 1)
+	c.Put("hot2", 1)
+	for i := 0; i < 8; i++ {
+		c.Put(fmt.Sprintf("first%d", i), 1)
+	}
+	if _, ok := c.Get("hot1"); ok {
+		t.Fatal("expected blocks on probation to be evicted first in, first out")
+	}
+	c.Put("hot1", 1)
+	c.Put("hot2", 1)
+	for i := 0; i < 100; i++ {
+		c.Put(fmt.Sprintf("scan%d", i), 1)
+	}
+	for _, k := range []string{"hot1", "hot2", "scan99"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("expected %s to be cached", k)
+		}
+	}
+
+	lru := newCache(8)
+	lru.Put("hot", 1)
+	for i := 0; i < 100; i++ {
+		lru.Put(fmt.Sprintf("scan%d", i), 1)
+	}
+	if _, ok := lru.Get("hot"); ok {
+		t.Fatal("expected a scan to push everything out of an LRU cache")
+	}
+
+	if _, err := newPolicyCache(8, "arc"); err == nil {
+		t.Fatal("expected an unknown policy to be refused")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := newCache(8)
+	c.Put("a", []byte("old"))
+	gen := c.version()
+	c.Invalidate("a")
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expected the invalidated block to be dropped")
+	}
+	// A read that started before the write doesn't put back what it got.
+	c.putSince("a", []byte("old"), false, gen)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expected a stale read not to be cached")
+	}
+	c.putSince("b", []byte("other"), false, gen)
+	if _, ok := c.Get("b"); !ok {
+		t.Fatal("expected a read of another block to be cached")
+	}
+	c.putSince("a", []byte("new"), false, c.version())
+	if v, ok := c.Get("a"); !ok || string(v.([]byte)) != "new" {
+		t.Fatal("expected a read started after the write to be cached")
+	}
+
+	// Once the invalidation is forgotten, reads from before it are turned
+	// away whatever the block.
+	for i := 0; i < maxInvalidations; i++ {
+		c.Invalidate(fmt.Sprintf("k%d", i))
+	}
+	c.putSince("c", []byte("other"), false, gen)
+	if _, ok := c.Get("c"); ok {
+		t.Fatal("expected a read from before a forgotten invalidation not to be cached")
+	}
+}
+
+func TestCacheResize(t *testing.T) {
+	c := newCache(8)
+	for i := 0; i < 8; i++ {
+		c.Put(fmt.Sprintf("k%d", i), make([]byte, 10))
+	}
+	if st := c.stats(); st.entries != 8 || st.bytes != 80 || st.evictions != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	c.resize(2)
+	if st := c.stats(); st.entries != 2 || st.bytes != 20 || st.evictions != 6 {
+		t.Fatalf("unexpected stats after shrinking %+v", st)
+	}
+	for _, k := range []string{"k6", "k7"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("expected %s to survive shrinking", k)
+		}
+	}
+	c.resize(0)
+	c.Put("k", make([]byte, 10))
+	if st := c.stats(); st.entries != 0 || st.bytes != 0 {
+		t.Fatalf("expected an empty cache at size 0, got %+v", st)
+	}
+}
+
+func TestCacheReadahead(t *testing.T) {
+	c := newCache(8)
+	for i := 0; i < 8; i++ {
+		c.Put(fmt.Sprintf("hot%d", i), 1)
+	}
+	// Blocks read ahead push out a few of the others at most, and then
+	// each other.
+	for i := 0; i < 100; i++ {
+		c.putAhead(fmt.Sprintf("ahead%d", i), 1, nil)
+	}
+	kept := 0
+	for i := 0; i < 8; i++ {
+		if _, ok := c.Get(fmt.Sprintf("hot%d", i)); ok {
+			kept++
+		}
+	}
+	if kept < 5 {
+		t.Fatalf("expected most blocks to be kept over readahead, kept %d of 8", kept)
+	}
+	// A block read ahead and asked for moves in with the others.
+	if _, ok := c.Get("ahead99"); !ok {
+		t.Fatal("expected the last block read ahead to be cached")
+	}
+	for i := 100; i < 110; i++ {
+		c.putAhead(fmt.Sprintf("ahead%d", i), 1, nil)
+	}
+	if _, ok := c.Get("ahead99"); !ok {
+		t.Fatal("expected a block read ahead and asked for to be kept")
+	}
+}
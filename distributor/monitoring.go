@@ -1,6 +1,9 @@
 package distributor
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"github.com/alternative-storage/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	// Blocks
@@ -12,6 +15,22 @@ var (
 		Name: "torus_distributor_block_cached_blocks",
 		Help: "Number of blocks returned from read cache of the distributor layer",
 	})
+	promDistBlockCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_block_cache_misses",
+		Help: "Number of blocks requested of the distributor layer that weren't in its read cache",
+	})
+	promDistCacheHitRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_cache_hit_ratio",
+		Help: "Fraction of the lookups in the read cache of the distributor layer that found the block",
+	})
+	promDistCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_cache_evictions_total",
+		Help: "Number of blocks evicted from the read cache of the distributor layer to make room",
+	})
+	promDistCacheResidentBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_cache_resident_bytes",
+		Help: "Size of the blocks held in the read cache of the distributor layer",
+	})
 	promDistBlockLocalHits = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_block_local_blocks",
 		Help: "Number of blocks returned from local storage",
@@ -32,6 +51,66 @@ var (
 		Name: "torus_distributor_block_request_failures",
 		Help: "Number of failed block requests",
 	})
+	promDistBlockWriteQuorum = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_block_write_quorum_acks",
+		Help: "Number of replicated block writes that reached the write quorum",
+	})
+	promDistBlockWriteQuorumFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_block_write_quorum_failures",
+		Help: "Number of replicated block writes that failed to reach the write quorum",
+	})
+	promDistHedgedReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_hedged_reads_total",
+		Help: "Number of block reads sent to a second replica after the first was slow to answer",
+	})
+	promDistHedgedReadWins = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_hedged_read_wins_total",
+		Help: "Number of hedged block reads answered by the second replica first",
+	})
+	promDistHedgedReadsCapped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_hedged_reads_capped_total",
+		Help: "Number of slow block reads not hedged because too many hedged reads were in flight",
+	})
+	promDistBlockRepairs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_block_repairs_total",
+		Help: "Number of corrupt block copies on peers overwritten with a good copy",
+	})
+	promDistBlockRepairFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_block_repair_failures",
+		Help: "Number of corrupt block copies that couldn't be repaired",
+	})
+	// Volumes
+	promDistVolumeOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_volume_ops_total",
+		Help: "Number of block reads and writes through the distributor, and block fetches from other peers, by volume",
+	}, []string{"volume", "op"})
+	promDistVolumeBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_volume_bytes_total",
+		Help: "Number of bytes read and written through the distributor, and fetched from other peers, by volume",
+	}, []string{"volume", "op"})
+	promDistVolumeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_volume_errors_total",
+		Help: "Number of failed block reads, writes and fetches from other peers, by volume and reason",
+	}, []string{"volume", "op", "reason"})
+	promDistVolumeOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_distributor_volume_op_duration_seconds",
+		Help:    "Time taken by block reads and writes through the distributor, and block fetches from other peers, by volume",
+		Buckets: torus.LatencyBuckets,
+	}, []string{"volume", "op"})
+	promDistVolumeReadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_distributor_volume_read_duration_seconds",
+		Help:    "Time taken by successful block reads through the distributor, by volume and by where the block came from: cache, local or peer",
+		Buckets: torus.LatencyBuckets,
+	}, []string{"volume", "source"})
+	// Syncs
+	promDistSyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_syncs_total",
+		Help: "Number of syncs of the blocks written through this node",
+	})
+	promDistSyncFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_sync_failures_total",
+		Help: "Number of peers that failed to make the blocks written to them durable",
+	})
 	// RPCs
 	promDistPutBlockRPCs = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_put_block_rpcs_total",
@@ -41,6 +120,10 @@ var (
 		Name: "torus_distributor_put_block_rpc_failures",
 		Help: "Number of PutBlock RPCs with errors",
 	})
+	promDistFencedWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_fenced_writes_total",
+		Help: "Number of block writes refused because the writer's volume lock was taken over",
+	})
 	promDistBlockRPCs = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_block_rpcs_total",
 		Help: "Number of PutBlock RPCs made to this node",
@@ -57,22 +140,164 @@ var (
 		Name: "torus_distributor_rebalance_rpc_failures",
 		Help: "Number of Rebalance RPCs with errors",
 	})
+	promDistPeerConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_peer_connections",
+		Help: "Number of connections open to other peers",
+	})
+	promDistPeerConnsExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_peer_connections_exhausted_total",
+		Help: "Number of requests that gave up waiting for a free peer connection",
+	})
+	promDistPeerCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_distributor_peer_circuit_state",
+		Help: "State of the circuit to each peer: 0 closed, 1 open, failing requests right away, 2 half-open, probing the peer",
+	}, []string{"peer"})
+	promDistPeerFailureRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_distributor_peer_failure_ratio",
+		Help: "Fraction of the recent requests to each peer that failed or timed out",
+	}, []string{"peer"})
+	promDistPeerCircuitTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_peer_circuit_trips_total",
+		Help: "Number of times the circuit to each peer opened",
+	}, []string{"peer"})
+	promDistHandoffBlocks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_handoff_blocks",
+		Help: "Number of block replicas waiting for the circuit to their peer to close",
+	})
+	promDistHandoffDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_handoff_dropped_total",
+		Help: "Number of block replicas for peers with an open circuit that couldn't be queued",
+	})
+	// Rebalancing
+	promDistRebalanceThroughput = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_throughput_bytes",
+		Help: "Bytes per second moved to other peers, averaged over the current rebalance pass",
+	})
+	promDistRebalanceBlocksRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_blocks_remaining",
+		Help: "Number of local blocks not yet examined in the current rebalance pass",
+	})
+	promDistRebalanceBytesMoved = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_moved_bytes",
+		Help: "Bytes moved to other peers in the current rebalance pass",
+	})
+	promDistRebalanceStart = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_start_time_seconds",
+		Help: "Unix time the current rebalance pass started",
+	})
+	promDistRebalanceETA = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_eta_seconds",
+		Help: "Estimated seconds until the current rebalance pass finishes, or zero if unknown",
+	})
+	promDistRebalancedRingVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalanced_ring_version",
+		Help: "Ring version this node last finished rebalancing onto",
+	})
+	promDistRebalancePaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_paused",
+		Help: "Whether rebalancing is paused cluster-wide",
+	})
+	promDistRebalanceRateLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_rebalance_rate_limit_bytes",
+		Help: "Bytes per second each node may send while rebalancing, or zero if unlimited",
+	})
+	// Garbage collection
+	promDistGCReclaimedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_gc_reclaimed_blocks_total",
+		Help: "Number of dead local blocks deleted by the garbage collector",
+	})
+	promDistGCErasedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_gc_erased_blocks_total",
+		Help: "Number of dead local blocks of securely deleted volumes overwritten before being deleted",
+	})
+	promDistGCEraseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_gc_erase_failures_total",
+		Help: "Number of dead local blocks of securely deleted volumes that couldn't be overwritten, and were left behind",
+	})
+	promDistGCCollecting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_gc_collecting",
+		Help: "Whether dead blocks may be deleted now, inside the GC window or for a requested run",
+	})
+	promDistGCRateLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_gc_rate_limit_bytes",
+		Help: "Bytes per second of dead blocks each node may delete, or zero if unlimited",
+	})
+	// Scrubbing
+	promDistScrubBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_scrub_blocks_total",
+		Help: "Number of local blocks checked against their checksums by the scrubber",
+	})
+	promDistScrubErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_scrub_errors_total",
+		Help: "Number of local blocks the scrubber found not to match their checksums, or couldn't read",
+	})
+	promDistAutoEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_auto_evictions_total",
+		Help: "Number of peers this node evicted from the ring after they stopped reporting",
+	})
 )
 
 func init() {
 	// Block
 	prometheus.MustRegister(promDistBlockRequests)
 	prometheus.MustRegister(promDistBlockCacheHits)
+	prometheus.MustRegister(promDistBlockCacheMisses)
+	prometheus.MustRegister(promDistCacheHitRatio)
+	prometheus.MustRegister(promDistCacheEvictions)
+	prometheus.MustRegister(promDistCacheResidentBytes)
 	prometheus.MustRegister(promDistBlockLocalHits)
 	prometheus.MustRegister(promDistBlockLocalFailures)
 	prometheus.MustRegister(promDistBlockPeerHits)
 	prometheus.MustRegister(promDistBlockPeerFailures)
 	prometheus.MustRegister(promDistBlockFailures)
+	prometheus.MustRegister(promDistBlockWriteQuorum)
+	prometheus.MustRegister(promDistBlockWriteQuorumFailures)
+	prometheus.MustRegister(promDistHedgedReads)
+	prometheus.MustRegister(promDistHedgedReadWins)
+	prometheus.MustRegister(promDistHedgedReadsCapped)
+	prometheus.MustRegister(promDistBlockRepairs)
+	prometheus.MustRegister(promDistBlockRepairFailures)
+	// Volume
+	prometheus.MustRegister(promDistVolumeOps)
+	prometheus.MustRegister(promDistVolumeBytes)
+	prometheus.MustRegister(promDistVolumeErrors)
+	prometheus.MustRegister(promDistVolumeOpDuration)
+	prometheus.MustRegister(promDistVolumeReadDuration)
+	// Sync
+	prometheus.MustRegister(promDistSyncs)
+	prometheus.MustRegister(promDistSyncFailures)
 	// RPC
 	prometheus.MustRegister(promDistPutBlockRPCs)
 	prometheus.MustRegister(promDistPutBlockRPCFailures)
+	prometheus.MustRegister(promDistFencedWrites)
 	prometheus.MustRegister(promDistBlockRPCs)
 	prometheus.MustRegister(promDistBlockRPCFailures)
 	prometheus.MustRegister(promDistRebalanceRPCs)
 	prometheus.MustRegister(promDistRebalanceRPCFailures)
+	prometheus.MustRegister(promDistPeerConns)
+	prometheus.MustRegister(promDistPeerConnsExhausted)
+	prometheus.MustRegister(promDistPeerCircuitState)
+	prometheus.MustRegister(promDistPeerFailureRatio)
+	prometheus.MustRegister(promDistPeerCircuitTrips)
+	prometheus.MustRegister(promDistHandoffBlocks)
+	prometheus.MustRegister(promDistHandoffDropped)
+	// Rebalancing
+	prometheus.MustRegister(promDistRebalanceThroughput)
+	prometheus.MustRegister(promDistRebalanceBlocksRemaining)
+	prometheus.MustRegister(promDistRebalanceBytesMoved)
+	prometheus.MustRegister(promDistRebalanceStart)
+	prometheus.MustRegister(promDistRebalanceETA)
+	prometheus.MustRegister(promDistRebalancedRingVersion)
+	prometheus.MustRegister(promDistRebalancePaused)
+	prometheus.MustRegister(promDistRebalanceRateLimit)
+	// Garbage collection
+	prometheus.MustRegister(promDistGCReclaimedBlocks)
+	prometheus.MustRegister(promDistGCErasedBlocks)
+	prometheus.MustRegister(promDistGCEraseFailures)
+	prometheus.MustRegister(promDistGCCollecting)
+	prometheus.MustRegister(promDistGCRateLimit)
+	prometheus.MustRegister(promDistAutoEvictions)
+	// Scrub
+	prometheus.MustRegister(promDistScrubBlocks)
+	prometheus.MustRegister(promDistScrubErrors)
 }
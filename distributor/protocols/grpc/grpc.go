@@ -1,6 +1,8 @@
 package grpc
 
 import (
+	"crypto/tls"
+	"errors"
 	"net"
 	"net/url"
 	//	"runtime/debug"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"golang.org/x/net/context"
 
@@ -17,6 +20,7 @@ import (
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/distributor/protocols"
 	"github.com/alternative-storage/torus/models"
+	"github.com/coreos/pkg/capnslog"
 
 	//"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
@@ -24,14 +28,19 @@ import (
 
 const defaultPort = "40000"
 
+var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "grpc")
+
+var errSyncUnsupported = errors.New("grpc: the storage server doesn't support sync")
+
 func init() {
 	protocols.RegisterRPCListener("http", grpcRPCListener)
 	protocols.RegisterRPCDialer("http", grpcRPCDialer)
 }
 
-func grpcRPCListener(url *url.URL, hdl protocols.RPC, gmd torus.GlobalMetadata) (protocols.RPCServer, error) {
+func grpcRPCListener(url *url.URL, hdl protocols.RPC, gmd torus.GlobalMetadata, tlsConfig *tls.Config) (protocols.RPCServer, error) {
 	out := &handler{
 		handle: hdl,
+		hello:  localHello(),
 	}
 	h := url.Host
 	if !strings.Contains(h, ":") {
@@ -42,34 +51,55 @@ func grpcRPCListener(url *url.URL, hdl protocols.RPC, gmd torus.GlobalMetadata)
 		return nil, err
 	}
 
-	uIntOpt := grpc.UnaryInterceptor(grpc_opentracing.UnaryServerInterceptor())
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(grpc_opentracing.UnaryServerInterceptor())}
 	//sIntOpt := grpc_opentracing.StreamServerInterceptor()
-	out.grpc = grpc.NewServer(uIntOpt)
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	out.grpc = grpc.NewServer(opts...)
 
 	models.RegisterTorusStorageServer(out.grpc, out)
 	go out.grpc.Serve(lis)
 	return out, nil
 }
 
-func grpcRPCDialer(url *url.URL, timeout time.Duration, gmd torus.GlobalMetadata) (protocols.RPC, error) {
+func grpcRPCDialer(url *url.URL, timeout time.Duration, gmd torus.GlobalMetadata, tlsConfig *tls.Config) (protocols.RPC, error) {
 	h := url.Host
 	if !strings.Contains(h, ":") {
 		h = net.JoinHostPort(h, defaultPort)
 	}
 	uIntOpt := grpc.WithUnaryInterceptor(grpc_opentracing.UnaryClientInterceptor())
-	conn, err := grpc.Dial(h, grpc.WithInsecure(), grpc.WithTimeout(timeout), uIntOpt)
+	security := grpc.WithInsecure()
+	if tlsConfig != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	conn, err := grpc.Dial(h, security, grpc.WithTimeout(timeout), uIntOpt)
 	if err != nil {
 		return nil, err
 	}
-	return &client{
+	c := &client{
 		conn:    conn,
 		handler: models.NewTorusStorageClient(conn),
-	}, nil
+	}
+	c.hello, err = c.sayHello(localHello(), timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 type client struct {
 	conn    *grpc.ClientConn
 	handler models.TorusStorageClient
+	// hello is what was agreed on with the server when connecting.
+	hello protocols.Hello
+}
+
+// Negotiated returns the version of the protocol and the features agreed on
+// with the server.
+func (c *client) Negotiated() protocols.Hello {
+	return c.hello
 }
 
 func (c *client) Close() error {
@@ -85,10 +115,16 @@ func (c *client) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte)
 		Blocks: [][]byte{
 			data,
 		},
+		LockGeneration: torus.LockGeneration(ctx),
 	})
 	return err
 }
 
+func (c *client) Sync(ctx context.Context) error {
+	_, err := c.handler.PutBlock(ctx, &models.PutBlockRequest{Sync: true})
+	return err
+}
+
 func (c *client) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
 	resp, err := c.handler.Block(ctx, &models.BlockRequest{
 		BlockRef: ref.ToProto(),
@@ -99,6 +135,18 @@ func (c *client) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error)
 	return resp.Data, nil
 }
 
+func (c *client) BlockRange(ctx context.Context, ref torus.BlockRef, offset, length uint64) ([]byte, error) {
+	resp, err := c.handler.Block(ctx, &models.BlockRequest{
+		BlockRef: ref.ToProto(),
+		Offset:   offset,
+		Length:   length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
 func (c *client) RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error) {
 	req := &models.RebalanceCheckRequest{}
 	for _, x := range refs {
@@ -118,10 +166,18 @@ func (c *client) WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, erro
 type handler struct {
 	handle protocols.RPC
 	grpc   *grpc.Server
+	// hello is what the server advertises to clients that say hello.
+	hello protocols.Hello
 }
 
 func (h *handler) Block(ctx context.Context, req *models.BlockRequest) (*models.BlockResponse, error) {
-	data, err := h.handle.Block(ctx, torus.BlockFromProto(req.BlockRef))
+	var data []byte
+	var err error
+	if req.Length != 0 {
+		data, err = h.handle.BlockRange(ctx, torus.BlockFromProto(req.BlockRef), req.Offset, req.Length)
+	} else {
+		data, err = h.handle.Block(ctx, torus.BlockFromProto(req.BlockRef))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -133,16 +189,37 @@ func (h *handler) Block(ctx context.Context, req *models.BlockRequest) (*models.
 
 // This PutBlock is called by server(torusd) side.
 func (h *handler) PutBlock(ctx context.Context, req *models.PutBlockRequest) (*models.PutResponse, error) {
+	if req.LockGeneration != 0 {
+		ctx = torus.WithLockGeneration(ctx, req.LockGeneration)
+	}
 	for i, ref := range req.Refs {
 		err := h.handle.PutBlock(ctx, torus.BlockFromProto(ref), req.Blocks[i])
 		if err != nil {
 			return nil, err
 		}
 	}
+	if req.Sync {
+		s, ok := h.handle.(protocols.SyncRPC)
+		if !ok {
+			return nil, errSyncUnsupported
+		}
+		if err := s.Sync(ctx); err != nil {
+			return nil, err
+		}
+	}
 	return &models.PutResponse{Ok: true}, nil
 }
 
 func (h *handler) RebalanceCheck(ctx context.Context, req *models.RebalanceCheckRequest) (*models.RebalanceCheckResponse, error) {
+	if len(req.BlockRefs) == 0 {
+		hello, err := h.handleHello(ctx)
+		if hello {
+			if err != nil {
+				return nil, err
+			}
+			return &models.RebalanceCheckResponse{}, nil
+		}
+	}
 	check := make([]torus.BlockRef, len(req.BlockRefs))
 	for i, x := range req.BlockRefs {
 		check[i] = torus.BlockFromProto(x)
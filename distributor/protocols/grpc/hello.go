@@ -0,0 +1,120 @@
+package grpc
+
+import (
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"github.com/alternative-storage/torus/models"
+)
+
+// A client says hello with a RebalanceCheck of no blocks, carrying the
+// versions of the protocol it speaks and its features in its metadata. The
+// server sends back its own in the response header, and both use the highest
+// version both speak and the features both have. A server that speaks no
+// version the client does fails the call once it has sent its header.
+//
+// Servers from before the handshake answer without a header, and the client
+// speaks protocols.LegacyHello to them.
+
+// localHello is what this server advertises over gRPC, which has no batched
+// reads.
+func localHello() protocols.Hello {
+	h := protocols.LocalHello()
+	h.Features &^= protocols.FeatureBatchRead
+	return h
+}
+
+// helloTimeout bounds the hello when dialing without a timeout.
+const helloTimeout = 2 * time.Second
+
+const (
+	mdVersion    = "torus-protocol-version"
+	mdMinVersion = "torus-protocol-min-version"
+	mdFeatures   = "torus-protocol-features"
+)
+
+func helloMD(h protocols.Hello) metadata.MD {
+	return metadata.Pairs(
+		mdVersion, strconv.FormatUint(h.Version, 10),
+		mdMinVersion, strconv.FormatUint(h.MinVersion, 10),
+		mdFeatures, strconv.FormatUint(uint64(h.Features), 10),
+	)
+}
+
+// parseHelloMD returns the hello in md, and false if there is none.
+func parseHelloMD(md metadata.MD) (protocols.Hello, bool) {
+	var (
+		vals [3]uint64
+		err  error
+	)
+	for i, k := range []string{mdVersion, mdMinVersion, mdFeatures} {
+		if len(md[k]) != 1 {
+			return protocols.Hello{}, false
+		}
+		vals[i], err = strconv.ParseUint(md[k][0], 10, 64)
+		if err != nil {
+			return protocols.Hello{}, false
+		}
+	}
+	return protocols.Hello{
+		Version:    vals[0],
+		MinVersion: vals[1],
+		Features:   protocols.Features(vals[2]),
+	}, true
+}
+
+// sayHello agrees on the version of the protocol with the server.
+func (c *client) sayHello(hello protocols.Hello, timeout time.Duration) (protocols.Hello, error) {
+	if timeout == 0 {
+		timeout = helloTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, helloMD(hello))
+	var header metadata.MD
+	_, err := c.handler.RebalanceCheck(ctx, &models.RebalanceCheckRequest{}, grpc.Header(&header))
+	remote, ok := parseHelloMD(header)
+	if !ok {
+		if err != nil {
+			return protocols.Hello{}, err
+		}
+		remote = protocols.LegacyHello
+	}
+	return protocols.Negotiate(hello, remote)
+}
+
+// handleHello answers a client's hello, if ctx carries one, with the
+// server's. It reports whether there was one.
+func (h *handler) handleHello(ctx context.Context) (bool, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false, nil
+	}
+	remote, ok := parseHelloMD(md)
+	if !ok {
+		return false, nil
+	}
+	err := grpc.SendHeader(ctx, helloMD(h.hello))
+	if err != nil {
+		return true, err
+	}
+	_, err = protocols.Negotiate(h.hello, remote)
+	if err != nil {
+		from := "unknown address"
+		if p, ok := peer.FromContext(ctx); ok {
+			from = p.Addr.String()
+		}
+		clog.Errorf("refusing peer connection from %s: %v", from, err)
+		return true, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	return true, nil
+}
@@ -3,6 +3,8 @@
 package protocols
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/url"
 	"time"
@@ -12,9 +14,16 @@ import (
 	"github.com/alternative-storage/torus"
 )
 
+// ErrRefused is returned by RPC connections that can tell when the peer
+// answered a request with an error of its own, such as for a block it
+// doesn't have, rather than failing to answer it.
+var ErrRefused = errors.New("server error")
+
 type RPC interface {
 	PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error
 	Block(ctx context.Context, ref torus.BlockRef) ([]byte, error)
+	// BlockRange returns length bytes of the block starting at offset.
+	BlockRange(ctx context.Context, ref torus.BlockRef, offset, length uint64) ([]byte, error)
 	RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error)
 	Close() error
 
@@ -22,12 +31,42 @@ type RPC interface {
 	WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error)
 }
 
+// ChunkedRPC is implemented by RPC connections that can split block payloads
+// into smaller frames, bounding the buffers a transfer needs at a time.
+type ChunkedRPC interface {
+	SetTransferChunkSize(n uint64)
+}
+
+// ChecksummedRPC is implemented by RPC connections that can checksum block
+// payloads on the wire, so that a transfer corrupted on the way fails instead
+// of being accepted.
+type ChecksummedRPC interface {
+	SetWireChecksum(on bool)
+}
+
+// SyncRPC is implemented by RPC connections that can ask the other end to
+// make the blocks it has stored durable. Sync returns once they are.
+type SyncRPC interface {
+	Sync(ctx context.Context) error
+}
+
+// BatchRPC is implemented by RPC connections that can fetch several blocks
+// in one request. Blocks calls got with each block of refs, or the error
+// fetching it, as it arrives; one block failing doesn't fail the others. It
+// returns an error if the request as a whole failed, leaving got uncalled
+// for the blocks that hadn't arrived by then.
+type BatchRPC interface {
+	Blocks(ctx context.Context, refs []torus.BlockRef, got func(i int, data []byte, err error)) error
+}
+
 type RPCServer interface {
 	Close() error
 }
 
-type RPCDialerFunc func(*url.URL, time.Duration, torus.GlobalMetadata) (RPC, error)
-type RPCListenerFunc func(*url.URL, RPC, torus.GlobalMetadata) (RPCServer, error)
+// RPCDialerFunc and RPCListenerFunc dial and serve a protocol, over TLS if
+// given a TLS configuration and in cleartext otherwise.
+type RPCDialerFunc func(*url.URL, time.Duration, torus.GlobalMetadata, *tls.Config) (RPC, error)
+type RPCListenerFunc func(*url.URL, RPC, torus.GlobalMetadata, *tls.Config) (RPCServer, error)
 
 var rpcDialers map[string]RPCDialerFunc
 var rpcListeners map[string]RPCListenerFunc
@@ -44,12 +83,12 @@ func RegisterRPCListener(scheme string, newFunc RPCListenerFunc) {
 	rpcListeners[scheme] = newFunc
 }
 
-func ListenRPC(url *url.URL, handler RPC, gmd torus.GlobalMetadata) (RPCServer, error) {
+func ListenRPC(url *url.URL, handler RPC, gmd torus.GlobalMetadata, tlsConfig *tls.Config) (RPCServer, error) {
 	if rpcListeners[url.Scheme] == nil {
 		return nil, fmt.Errorf("Unknown ListenRPC protocol '%s'", url.Scheme)
 	}
 
-	return rpcListeners[url.Scheme](url, handler, gmd)
+	return rpcListeners[url.Scheme](url, handler, gmd, tlsConfig)
 }
 
 func RegisterRPCDialer(scheme string, newFunc RPCDialerFunc) {
@@ -64,10 +103,10 @@ func RegisterRPCDialer(scheme string, newFunc RPCDialerFunc) {
 	rpcDialers[scheme] = newFunc
 }
 
-func DialRPC(url *url.URL, timeout time.Duration, gmd torus.GlobalMetadata) (RPC, error) {
+func DialRPC(url *url.URL, timeout time.Duration, gmd torus.GlobalMetadata, tlsConfig *tls.Config) (RPC, error) {
 	if rpcDialers[url.Scheme] == nil {
 		return nil, fmt.Errorf("Unknown DialRPC protocol '%s'", url.Scheme)
 	}
 
-	return rpcDialers[url.Scheme](url, timeout, gmd)
+	return rpcDialers[url.Scheme](url, timeout, gmd, tlsConfig)
 }
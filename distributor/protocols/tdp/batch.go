@@ -0,0 +1,144 @@
+package tdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"golang.org/x/net/context"
+)
+
+// A cmdBlocks request is the frame size of chunked transfers as a 4-byte
+// little-endian integer, zero for whole blocks, then the number of blocks as
+// a 2-byte one and their refs. The server answers each block in turn as it
+// reads it: respOk followed by the block, sent as the frame size says, or
+// respErr if it couldn't read it.
+
+// maxBatchBlocks is the most blocks one cmdBlocks request may ask for.
+const maxBatchBlocks = 1<<16 - 1
+
+var _ protocols.BatchRPC = &Conn{}
+
+// Blocks fetches refs in one request if the server speaks batches, and one
+// at a time otherwise.
+func (c *Conn) Blocks(ctx context.Context, refs []torus.BlockRef, got func(i int, data []byte, err error)) error {
+	if !c.hello.Features.Has(protocols.FeatureBatchRead) {
+		for i, ref := range refs {
+			data, err := c.Block(ctx, ref)
+			if err != nil && err != errServer {
+				return err
+			}
+			got(i, data, err)
+		}
+		return nil
+	}
+	span, trace := traceRequest(ctx, "Blocks", nil)
+	err := c.blocks(refs, got, trace)
+	finishSpan(span, err)
+	return err
+}
+
+func (c *Conn) blocks(refs []torus.BlockRef, got func(int, []byte, error), trace []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	if len(refs) > maxBatchBlocks {
+		return errors.New("too many blocks for one request")
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err := c.sendTrace(trace); err != nil {
+		return err
+	}
+	frame := c.frameSize()
+	req := make([]byte, 7+len(refs)*torus.BlockRefByteSize)
+	req[0] = cmdBlocks
+	binary.LittleEndian.PutUint32(req[1:], uint32(frame))
+	binary.LittleEndian.PutUint16(req[5:], uint16(len(refs)))
+	for i, ref := range refs {
+		ref.ToBytesBuf(req[7+i*torus.BlockRefByteSize:])
+	}
+	_, err := c.conn.Write(req)
+	if err != nil {
+		return fmt.Errorf("couldn't write: %v", err)
+	}
+	for i := range refs {
+		// Each block gets the time a request for it alone would.
+		c.conn.SetDeadline(time.Now().Add(clientTimeout))
+		err = readConnIntoBuffer(c.conn, c.buf[:1])
+		if err != nil {
+			return err
+		}
+		if c.buf[0] == respErr {
+			got(i, nil, errServer)
+			continue
+		}
+		data := make([]byte, c.blockSize)
+		if frame != 0 {
+			err = readChunked(c.conn, data)
+			if err == errChecksum {
+				promChecksumErrors.WithLabelValues("get").Inc()
+				got(i, nil, err)
+				continue
+			}
+		} else {
+			err = readConnIntoBuffer(c.conn, data)
+		}
+		if err != nil {
+			return err
+		}
+		got(i, data, nil)
+	}
+	return nil
+}
+
+// handleBlocks sends the blocks of a cmdBlocks request, each as soon as it
+// is read. Blocks that can't be read are answered with respErr, and the rest
+// still sent.
+func (s *Server) handleBlocks(ctx context.Context, conn net.Conn, refbuf []byte) error {
+	hdr := make([]byte, 6)
+	err := readConnIntoBuffer(conn, hdr)
+	if err != nil {
+		return err
+	}
+	frame := int(binary.LittleEndian.Uint32(hdr))
+	refs := make([]torus.BlockRef, binary.LittleEndian.Uint16(hdr[4:]))
+	for i := range refs {
+		err = readConnIntoBuffer(conn, refbuf)
+		if err != nil {
+			return err
+		}
+		refs[i] = torus.BlockRefFromBytes(refbuf)
+	}
+	for _, ref := range refs {
+		data, err := s.handler.Block(ctx, ref)
+		if err != nil {
+			torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to handle block: %v", err)
+			_, err = conn.Write(headerErr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		_, err = conn.Write(headerOk)
+		if err != nil {
+			s.release(data)
+			return err
+		}
+		if frame != 0 {
+			err = writeChunked(conn, data, frame)
+		} else {
+			_, err = conn.Write(data)
+		}
+		s.release(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
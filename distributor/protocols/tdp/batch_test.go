@@ -0,0 +1,82 @@
+package tdp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"golang.org/x/net/context"
+)
+
+// mockMissingRPC fails reads of odd blocks.
+type mockMissingRPC struct {
+	mockBlockRPC
+}
+
+func (m *mockMissingRPC) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	if ref.Index%2 == 1 {
+		return nil, errors.New("no such block")
+	}
+	return m.data, nil
+}
+
+func TestBlocks(t *testing.T) {
+	m := &mockMissingRPC{mockBlockRPC{data: makeTestData(4096)}}
+	for _, tt := range []struct {
+		name  string
+		hello protocols.Hello
+		chunk uint64
+	}{
+		{"batched", protocols.LocalHello(), 0},
+		{"chunked", protocols.LocalHello(), 1000},
+		{"unbatched", protocols.LegacyHello, 0},
+	} {
+		s, err := serveHello("localhost:0", m, m.BlockSize(), nil, tt.hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetTransferChunkSize(tt.chunk)
+		refs := make([]torus.BlockRef, 5)
+		for i := range refs {
+			refs[i] = torus.BlockRef{INodeRef: torus.NewINodeRef(1, 2), Index: torus.IndexID(i)}
+		}
+		data := make([][]byte, len(refs))
+		errs := make([]error, len(refs))
+		calls := 0
+		err = c.Blocks(context.TODO(), refs, func(i int, b []byte, err error) {
+			data[i], errs[i] = b, err
+			calls++
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if calls != len(refs) {
+			t.Fatalf("%s: expected a result for each of %d blocks, got %d", tt.name, len(refs), calls)
+		}
+		for i := range refs {
+			if i%2 == 1 {
+				if errs[i] == nil || data[i] != nil {
+					t.Errorf("%s: expected block %d to fail", tt.name, i)
+				}
+				continue
+			}
+			if errs[i] != nil || !bytes.Equal(m.data, data[i]) {
+				t.Errorf("%s: unexpected block %d: %v", tt.name, i, errs[i])
+			}
+		}
+		// The connection is still good after the failures.
+		b, err := c.Block(context.TODO(), refs[0])
+		if err != nil || !bytes.Equal(m.data, b) {
+			t.Fatalf("%s: unexpected block after batch: %v", tt.name, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
@@ -0,0 +1,82 @@
+package tdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+// A chunked block payload is sent as a series of frames, each a 4-byte
+// little-endian length followed by that many bytes, until the whole block
+// has been sent. The CRC32 (Castagnoli) of the block follows the last frame.
+//
+// With wire checksums on, whole blocks are sent the same way as a single
+// frame, and block ranges are followed by their CRC32.
+
+var errChecksum = errors.New("tdp: block checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func writeChunked(conn net.Conn, data []byte, chunkSize int) error {
+	hdr := make([]byte, 4)
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.LittleEndian.PutUint32(hdr, uint32(end-off))
+		_, err := conn.Write(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(data[off:end])
+		if err != nil {
+			return err
+		}
+	}
+	return writeChecksum(conn, data)
+}
+
+func writeChecksum(conn net.Conn, data []byte) error {
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.Checksum(data, crcTable))
+	_, err := conn.Write(sum)
+	return err
+}
+
+// readChecksum reads a checksum from conn and checks data against it.
+func readChecksum(conn net.Conn, data []byte) error {
+	sum := make([]byte, 4)
+	err := readConnIntoBuffer(conn, sum)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(sum) != crc32.Checksum(data, crcTable) {
+		return errChecksum
+	}
+	return nil
+}
+
+// readChunked fills buf from the frames on conn and checks the result
+// against the trailing checksum. errChecksum leaves the connection usable.
+func readChunked(conn net.Conn, buf []byte) error {
+	hdr := make([]byte, 4)
+	off := 0
+	for off != len(buf) {
+		err := readConnIntoBuffer(conn, hdr)
+		if err != nil {
+			return err
+		}
+		n := int(binary.LittleEndian.Uint32(hdr))
+		if n == 0 || n > len(buf)-off {
+			return errors.New("tdp: bad frame length")
+		}
+		err = readConnIntoBuffer(conn, buf[off:off+n])
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	return readChecksum(conn, buf)
+}
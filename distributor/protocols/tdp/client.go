@@ -1,6 +1,8 @@
 package tdp
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
 	"golang.org/x/net/context"
 )
 
@@ -17,8 +20,11 @@ const (
 	rebalanceClientTimeout = 5 * time.Second
 	clientTimeout          = 500 * time.Millisecond
 	writeClientTimeout     = 2000 * time.Millisecond
+	syncClientTimeout      = 10 * time.Second
 )
 
+var errServer = protocols.ErrRefused
+
 type request interface {
 	Request() [][]byte
 	GotData([]byte) (need int, res *result)
@@ -37,11 +43,48 @@ type Conn struct {
 	conn      net.Conn
 	blockSize int
 	buf       []byte
+	// chunkSize, if non-zero, splits block payloads into frames of at most
+	// this many bytes.
+	chunkSize int
+	// checksum makes unchunked transfers carry a checksum too.
+	checksum bool
+	// hello is what was agreed on with the server when connecting.
+	hello protocols.Hello
 }
 
 func Dial(addr string, timeout time.Duration, blockSize uint64) (*Conn, error) {
-	c, err := net.Dial("tcp", addr)
+	return DialTLS(addr, timeout, blockSize, nil)
+}
+
+// DialTLS is like Dial, but connects over TLS when given a TLS
+// configuration, failing if the handshake doesn't complete within timeout.
+//
+// It agrees on the version of the protocol with the server, and fails with a
+// *protocols.VersionError if they speak no common version.
+func DialTLS(addr string, timeout time.Duration, blockSize uint64, tlsConfig *tls.Config) (*Conn, error) {
+	return dialHello(addr, timeout, blockSize, tlsConfig, protocols.LocalHello())
+}
+
+func dialHello(addr string, timeout time.Duration, blockSize uint64, tlsConfig *tls.Config, hello protocols.Hello) (*Conn, error) {
+	if timeout == 0 {
+		timeout = connectTimeout
+	}
+	c, err := dialConn(addr, timeout, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	negotiated, err := sayHello(c, hello, timeout)
+	if err == errNoHello {
+		// The server predates hellos, and hung up on ours.
+		c.Close()
+		c, err = dialConn(addr, timeout, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		negotiated, err = protocols.Negotiate(hello, protocols.LegacyHello)
+	}
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
 	conn := &Conn{
@@ -49,11 +92,25 @@ func Dial(addr string, timeout time.Duration, blockSize uint64) (*Conn, error) {
 		conn:      c,
 		blockSize: int(blockSize),
 		buf:       make([]byte, torus.BlockRefByteSize+1),
+		hello:     negotiated,
 	}
 	go conn.mainLoop()
 	return conn, nil
 }
 
+func dialConn(addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// Negotiated returns the version of the protocol and the features agreed on
+// with the server.
+func (c *Conn) Negotiated() protocols.Hello {
+	return c.hello
+}
+
 func (c *Conn) mainLoop() {
 	for {
 		select {
@@ -78,13 +135,62 @@ func (c *Conn) mainLoop() {
 	}
 }
 
-func (c *Conn) Block(_ context.Context, ref torus.BlockRef) ([]byte, error) {
+// SetTransferChunkSize makes the connection send and receive blocks in
+// frames of at most n bytes. Zero sends whole blocks. It has no effect if the
+// server doesn't speak chunked transfers.
+func (c *Conn) SetTransferChunkSize(n uint64) {
+	if n != 0 && !c.hello.Features.Has(protocols.FeatureChunked) {
+		clog.Debugf("not chunking transfers to %s: the server doesn't speak them", c.conn.RemoteAddr())
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.chunkSize = int(n)
+}
+
+// SetWireChecksum makes the connection checksum whole blocks and block ranges
+// on the wire, as chunked transfers always are. It has no effect if the
+// server doesn't speak checksums.
+func (c *Conn) SetWireChecksum(on bool) {
+	if on && !c.hello.Features.Has(protocols.FeatureChecksum) {
+		clog.Debugf("not checksumming transfers to %s: the server doesn't speak checksums", c.conn.RemoteAddr())
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.checksum = on
+}
+
+// frameSize returns the frame size of chunked transfers, and zero if blocks
+// are sent unchunked and unchecked. Checked whole blocks are sent as a single
+// frame.
+func (c *Conn) frameSize() int {
+	if c.chunkSize == 0 && c.checksum {
+		return c.blockSize
+	}
+	return c.chunkSize
+}
+
+func (c *Conn) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	span, trace := traceRequest(ctx, "Block", &ref)
+	data, err := c.block(ref, trace)
+	finishSpan(span, err)
+	return data, err
+}
+
+func (c *Conn) block(ref torus.BlockRef, trace []byte) ([]byte, error) {
 	if c.err != nil {
 		return nil, c.err
 	}
 	c.mut.Lock()
 	defer c.mut.Unlock()
+	if c.frameSize() != 0 {
+		return c.blockChunked(ref, trace)
+	}
 	c.conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err := c.sendTrace(trace); err != nil {
+		return nil, err
+	}
 	c.buf[0] = cmdBlock
 	ref.ToBytesBuf(c.buf[1:])
 	_, err := c.conn.Write(c.buf)
@@ -96,7 +202,7 @@ func (c *Conn) Block(_ context.Context, ref torus.BlockRef) ([]byte, error) {
 		return nil, err
 	}
 	if c.buf[0] == respErr {
-		return nil, errors.New("server error")
+		return nil, errServer
 	}
 	data := make([]byte, c.blockSize)
 	err = readConnIntoBuffer(c.conn, data)
@@ -106,20 +212,149 @@ func (c *Conn) Block(_ context.Context, ref torus.BlockRef) ([]byte, error) {
 	return data, nil
 }
 
+func (c *Conn) blockChunked(ref torus.BlockRef, trace []byte) ([]byte, error) {
+	c.conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err := c.sendTrace(trace); err != nil {
+		return nil, err
+	}
+	req := make([]byte, len(c.buf)+4)
+	req[0] = cmdBlockChunked
+	ref.ToBytesBuf(req[1:])
+	binary.LittleEndian.PutUint32(req[len(c.buf):], uint32(c.frameSize()))
+	_, err := c.conn.Write(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't write: %v", err)
+	}
+	err = readConnIntoBuffer(c.conn, c.buf[:1])
+	if err != nil {
+		return nil, err
+	}
+	if c.buf[0] == respErr {
+		return nil, errServer
+	}
+	data := make([]byte, c.blockSize)
+	err = readChunked(c.conn, data)
+	if err == errChecksum {
+		promChecksumErrors.WithLabelValues("get").Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Conn) BlockRange(ctx context.Context, ref torus.BlockRef, offset, length uint64) ([]byte, error) {
+	span, trace := traceRequest(ctx, "BlockRange", &ref)
+	data, err := c.blockRange(ref, offset, length, trace)
+	finishSpan(span, err)
+	return data, err
+}
+
+func (c *Conn) blockRange(ref torus.BlockRef, offset, length uint64, trace []byte) ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err := c.sendTrace(trace); err != nil {
+		return nil, err
+	}
+	req := make([]byte, len(c.buf)+16)
+	req[0] = cmdBlockRange
+	if c.checksum {
+		req[0] = cmdBlockRangeChecked
+	}
+	ref.ToBytesBuf(req[1:])
+	binary.LittleEndian.PutUint64(req[len(c.buf):], offset)
+	binary.LittleEndian.PutUint64(req[len(c.buf)+8:], length)
+	_, err := c.conn.Write(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't write: %v", err)
+	}
+	err = readConnIntoBuffer(c.conn, c.buf[:1])
+	if err != nil {
+		return nil, err
+	}
+	if c.buf[0] == respErr {
+		return nil, errServer
+	}
+	data := make([]byte, length)
+	err = readConnIntoBuffer(c.conn, data)
+	if err != nil {
+		return nil, err
+	}
+	if c.checksum {
+		err = readChecksum(c.conn, data)
+		if err == errChecksum {
+			promChecksumErrors.WithLabelValues("get_range").Inc()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
 func (c *Conn) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
+	span, trace := traceRequest(ctx, "PutBlock", &ref)
+	err := c.put(ref, data, fenceFrame(ctx), trace)
+	finishSpan(span, err)
+	return err
+}
+
+func (c *Conn) put(ref torus.BlockRef, data []byte, fence, trace []byte) error {
 	if c.err != nil {
 		return c.err
 	}
+	if len(data) < c.blockSize {
+		// The server always reads whole blocks; shorter ones, like
+		// compressed blocks, go padded with zeros.
+		bufs := torus.BlockBufs(uint64(c.blockSize))
+		padded := bufs.Get()
+		n := copy(padded, data)
+		for i := n; i < len(padded); i++ {
+			padded[i] = 0
+		}
+		defer bufs.Put(padded)
+		data = padded
+	}
 	c.mut.Lock()
 	defer c.mut.Unlock()
+	err := c.putBlock(ref, data, fence, trace)
+	if err == errServer && c.frameSize() != 0 {
+		// The server refuses blocks that fail their checksum, most likely
+		// because they were corrupted on the way, so send it once more.
+		err = c.putBlock(ref, data, fence, trace)
+	}
+	return err
+}
+
+func (c *Conn) putBlock(ref torus.BlockRef, data []byte, fence, trace []byte) error {
 	c.conn.SetDeadline(time.Now().Add(writeClientTimeout))
+	if len(fence) != 0 && c.hello.Features.Has(protocols.FeatureFence) {
+		if _, err := c.conn.Write(fence); err != nil {
+			return fmt.Errorf("couldn't write fence: %v", err)
+		}
+	}
+	if err := c.sendTrace(trace); err != nil {
+		return err
+	}
 	c.buf[0] = cmdPutBlock
+	frame := c.frameSize()
+	if frame != 0 {
+		c.buf[0] = cmdPutBlockChunked
+	}
 	ref.ToBytesBuf(c.buf[1:])
 	_, err := c.conn.Write(c.buf)
 	if err != nil {
 		return fmt.Errorf("couldn't write: %v", err)
 	}
-	_, err = c.conn.Write(data)
+	if frame != 0 {
+		err = writeChunked(c.conn, data, frame)
+	} else {
+		_, err = c.conn.Write(data)
+	}
 	if err != nil {
 		return fmt.Errorf("couldn't write data: %v", err)
 	}
@@ -128,12 +363,51 @@ func (c *Conn) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) er
 		return err
 	}
 	if c.buf[0] == respErr {
-		return errors.New("server error")
+		return errServer
 	}
 	return nil
 }
 
-func (c *Conn) RebalanceCheck(_ context.Context, refs []torus.BlockRef) ([]bool, error) {
+// Sync returns once the server has made the blocks it stored durable.
+func (c *Conn) Sync(ctx context.Context) error {
+	span, trace := traceRequest(ctx, "Sync", nil)
+	err := c.sync(trace)
+	finishSpan(span, err)
+	return err
+}
+
+func (c *Conn) sync(trace []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.conn.SetDeadline(time.Now().Add(syncClientTimeout))
+	if err := c.sendTrace(trace); err != nil {
+		return err
+	}
+	_, err := c.conn.Write([]byte{cmdSync})
+	if err != nil {
+		return fmt.Errorf("couldn't write: %v", err)
+	}
+	err = readConnIntoBuffer(c.conn, c.buf[:1])
+	if err != nil {
+		return err
+	}
+	if c.buf[0] == respErr {
+		return errServer
+	}
+	return nil
+}
+
+func (c *Conn) RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error) {
+	span, trace := traceRequest(ctx, "RebalanceCheck", nil)
+	out, err := c.rebalanceCheck(refs, trace)
+	finishSpan(span, err)
+	return out, err
+}
+
+func (c *Conn) rebalanceCheck(refs []torus.BlockRef, trace []byte) ([]bool, error) {
 	if c.err != nil {
 		return nil, c.err
 	}
@@ -143,6 +417,9 @@ func (c *Conn) RebalanceCheck(_ context.Context, refs []torus.BlockRef) ([]bool,
 	c.mut.Lock()
 	defer c.mut.Unlock()
 	c.conn.SetDeadline(time.Now().Add(rebalanceClientTimeout))
+	if err := c.sendTrace(trace); err != nil {
+		return nil, err
+	}
 	c.buf[0] = cmdRebalanceCheck
 	c.buf[1] = byte(len(refs))
 	_, err := c.conn.Write(c.buf[:2])
@@ -162,7 +439,7 @@ func (c *Conn) RebalanceCheck(_ context.Context, refs []torus.BlockRef) ([]bool,
 		return nil, err
 	}
 	if c.buf[0] == respErr {
-		return nil, errors.New("server error")
+		return nil, errServer
 	}
 	data := make([]byte, size)
 	err = readConnIntoBuffer(c.conn, data)
@@ -0,0 +1,101 @@
+package tdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/alternative-storage/torus/distributor/protocols"
+)
+
+// A client opens a connection with a cmdHello frame advertising the versions
+// of the protocol it speaks and its features, as three little-endian uint64s:
+// its version, its minimum version and its features. The server answers
+// respOk and its own, and both use the highest version both speak and the
+// features both have. A server that speaks no version the client does hangs
+// up after answering.
+//
+// Servers from before the handshake hang up on the frame without answering.
+// The client dials them again and speaks protocols.LegacyHello to them.
+
+const helloSize = 24
+
+// errNoHello is returned when the server hangs up on a hello.
+var errNoHello = errors.New("tdp: server doesn't answer hellos")
+
+func helloFrame(cmd byte, h protocols.Hello) []byte {
+	frame := make([]byte, 1+helloSize)
+	frame[0] = cmd
+	binary.LittleEndian.PutUint64(frame[1:], h.Version)
+	binary.LittleEndian.PutUint64(frame[9:], h.MinVersion)
+	binary.LittleEndian.PutUint64(frame[17:], uint64(h.Features))
+	return frame
+}
+
+func parseHello(buf []byte) protocols.Hello {
+	return protocols.Hello{
+		Version:    binary.LittleEndian.Uint64(buf),
+		MinVersion: binary.LittleEndian.Uint64(buf[8:]),
+		Features:   protocols.Features(binary.LittleEndian.Uint64(buf[16:])),
+	}
+}
+
+// sayHello sends hello on a new connection and returns what the connection
+// speaks, once the server has answered.
+func sayHello(conn net.Conn, hello protocols.Hello, timeout time.Duration) (protocols.Hello, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	_, err := conn.Write(helloFrame(cmdHello, hello))
+	if err != nil {
+		if isHangup(err) {
+			return protocols.Hello{}, errNoHello
+		}
+		return protocols.Hello{}, err
+	}
+	buf := make([]byte, 1+helloSize)
+	err = readConnIntoBuffer(conn, buf)
+	if err != nil {
+		if isHangup(err) {
+			return protocols.Hello{}, errNoHello
+		}
+		return protocols.Hello{}, err
+	}
+	if buf[0] != respOk {
+		return protocols.Hello{}, errServer
+	}
+	return protocols.Negotiate(hello, parseHello(buf[1:]))
+}
+
+// isHangup reports whether err is the other end closing the connection.
+func isHangup(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNRESET || err == syscall.EPIPE
+}
+
+// handleHello answers a client's hello with the server's, and returns a
+// *protocols.VersionError if they speak no common version.
+func (s *Server) handleHello(conn net.Conn) error {
+	buf := make([]byte, helloSize)
+	err := readConnIntoBuffer(conn, buf)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(helloFrame(respOk, s.hello))
+	if err != nil {
+		return err
+	}
+	_, err = protocols.Negotiate(s.hello, parseHello(buf))
+	return err
+}
@@ -0,0 +1,141 @@
+package tdp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"golang.org/x/net/context"
+)
+
+func TestHelloVersion(t *testing.T) {
+	// Bumping the version is a wire change; make sure it's deliberate.
+	if torus.ProtocolVersion != 2 || torus.MinProtocolVersion != 1 {
+		t.Fatalf("unexpected protocol versions %d to %d", torus.MinProtocolVersion, torus.ProtocolVersion)
+	}
+	m := &mockBlockRPC{data: makeTestData(4096)}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if h := c.Negotiated(); h != protocols.LocalHello() {
+		t.Fatalf("expected to speak %+v, got %+v", protocols.LocalHello(), h)
+	}
+}
+
+func TestHelloDowngrade(t *testing.T) {
+	m := &mockBlockRPC{data: makeTestData(4096)}
+	old := protocols.Hello{Version: 1, MinVersion: 1, Features: protocols.FeatureChunked}
+	s, err := serveHello("localhost:0", m, m.BlockSize(), nil, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := c.Negotiated()
+	if h.Version != 1 || h.Features != protocols.FeatureChunked {
+		t.Fatalf("expected to speak version 1 with chunking only, got %+v", h)
+	}
+	// The server doesn't speak checksums, so none are asked for.
+	c.SetWireChecksum(true)
+	if c.frameSize() != 0 {
+		t.Fatal("expected checksums to stay off")
+	}
+	b, err := c.Block(context.TODO(), torus.BlockRef{INodeRef: torus.NewINodeRef(1, 2), Index: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.data, b) {
+		t.Fatal("unequal response")
+	}
+}
+
+func TestHelloIncompatible(t *testing.T) {
+	m := &mockBlockRPC{data: makeTestData(4096)}
+	future := protocols.Hello{Version: 5, MinVersion: 4}
+	s, err := serveHello("localhost:0", m, m.BlockSize(), nil, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	verr, ok := err.(*protocols.VersionError)
+	if !ok {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+	if verr.Remote.Version != 5 || verr.Local.Version != torus.ProtocolVersion {
+		t.Fatalf("expected the error to name both versions, got %v", verr)
+	}
+}
+
+// legacyServer stands in front of a server, hanging up on hellos as servers
+// from before the handshake do.
+func legacyServer(t *testing.T, addr string) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 1)
+				if readConnIntoBuffer(conn, header) != nil || header[0] == cmdHello {
+					return
+				}
+				up, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				up.Write(header)
+				go io.Copy(conn, up)
+				io.Copy(up, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestHelloLegacyServer(t *testing.T) {
+	m := &mockBlockRPC{data: makeTestData(4096)}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	l := legacyServer(t, s.ListenAddr().String())
+	defer l.Close()
+	c, err := Dial(l.Addr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if h := c.Negotiated(); h.Version != 1 || h.Features != protocols.LegacyFeatures {
+		t.Fatalf("expected to speak version 1 to a legacy server, got %+v", h)
+	}
+	// The server reads the block into m.data, so a copy is sent.
+	data := append([]byte(nil), m.data...)
+	err = c.PutBlock(context.TODO(), torus.BlockRef{INodeRef: torus.NewINodeRef(1, 2), Index: 3}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
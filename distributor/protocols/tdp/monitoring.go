@@ -0,0 +1,14 @@
+package tdp
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	promChecksumErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_tdp_checksum_errors_total",
+		Help: "Number of block transfers between peers that arrived corrupted",
+	}, []string{"op"})
+)
+
+func init() {
+	prometheus.MustRegister(promChecksumErrors)
+}
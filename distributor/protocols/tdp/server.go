@@ -1,6 +1,7 @@
 package tdp
 
 import (
+	"crypto/tls"
 	"net"
 	"net/url"
 	"strings"
@@ -17,16 +18,16 @@ func init() {
 	protocols.RegisterRPCDialer("tdp", tdpRPCDialer)
 }
 
-func tdpRPCListener(url *url.URL, handler protocols.RPC, gmd torus.GlobalMetadata) (protocols.RPCServer, error) {
+func tdpRPCListener(url *url.URL, handler protocols.RPC, gmd torus.GlobalMetadata, tlsConfig *tls.Config) (protocols.RPCServer, error) {
 	if strings.Contains(url.Host, ":") {
-		return Serve(url.Host, handler, gmd.BlockSize)
+		return ServeTLS(url.Host, handler, gmd.BlockSize, tlsConfig)
 	}
-	return Serve(net.JoinHostPort(url.Host, defaultPort), handler, gmd.BlockSize)
+	return ServeTLS(net.JoinHostPort(url.Host, defaultPort), handler, gmd.BlockSize, tlsConfig)
 }
 
-func tdpRPCDialer(url *url.URL, timeout time.Duration, gmd torus.GlobalMetadata) (protocols.RPC, error) {
+func tdpRPCDialer(url *url.URL, timeout time.Duration, gmd torus.GlobalMetadata, tlsConfig *tls.Config) (protocols.RPC, error) {
 	if strings.Contains(url.Host, ":") {
-		return Dial(url.Host, timeout, gmd.BlockSize)
+		return DialTLS(url.Host, timeout, gmd.BlockSize, tlsConfig)
 	}
-	return Dial(net.JoinHostPort(url.Host, defaultPort), timeout, gmd.BlockSize)
+	return DialTLS(net.JoinHostPort(url.Host, defaultPort), timeout, gmd.BlockSize, tlsConfig)
 }
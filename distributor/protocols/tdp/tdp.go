@@ -1,6 +1,8 @@
 package tdp
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
@@ -8,7 +10,9 @@ import (
 	"time"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
 	"github.com/coreos/pkg/capnslog"
+	"github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 )
 
@@ -21,6 +25,22 @@ const (
 	cmdPutBlock
 	cmdBlock
 	cmdRebalanceCheck
+	cmdBlockRange
+	cmdBlockChunked
+	cmdPutBlockChunked
+	cmdBlockRangeChecked
+	cmdSync
+	// cmdTrace carries the span context of the request that follows it on
+	// the connection, for that request to be part of the sender's trace.
+	cmdTrace
+	// cmdFence carries the generation of the volume lock the write that
+	// follows it on the connection is made under.
+	cmdFence
+	// cmdHello opens a connection, agreeing on the version of the
+	// protocol spoken on it.
+	cmdHello
+	// cmdBlocks fetches several blocks at once.
+	cmdBlocks
 )
 
 const (
@@ -37,30 +57,60 @@ type Server struct {
 	handler   Handler
 	lst       net.Listener
 	blocksize uint64
+	// hello is what the server advertises to clients that say hello.
+	hello protocols.Hello
+	// bufs holds the per-connection block buffers of closed connections.
+	bufs *torus.BlockBufPool
 
 	mu     sync.RWMutex // protects fields below
 	closed bool
 	conns  []net.Conn
 }
 
+// Handler serves the requests of a Server. Handlers that also implement
+// torus.BlockReleaser get the blocks returned by Block back once they have
+// been sent.
 type Handler interface {
 	Block(ctx context.Context, ref torus.BlockRef) ([]byte, error)
+	BlockRange(ctx context.Context, ref torus.BlockRef, offset, length uint64) ([]byte, error)
 	PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error
 	RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error)
 	WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error)
 }
 
+// SyncHandler is implemented by Handlers that can make the blocks they have
+// stored durable. Servers whose handler doesn't implement it answer syncs
+// with an error.
+type SyncHandler interface {
+	Sync(ctx context.Context) error
+}
+
 var _ Handler = &Conn{}
 
 func Serve(addr string, handler Handler, blocksize uint64) (*Server, error) {
+	return ServeTLS(addr, handler, blocksize, nil)
+}
+
+// ServeTLS is like Serve, but only accepts connections over TLS when given
+// a TLS configuration.
+func ServeTLS(addr string, handler Handler, blocksize uint64, tlsConfig *tls.Config) (*Server, error) {
+	return serveHello(addr, handler, blocksize, tlsConfig, protocols.LocalHello())
+}
+
+func serveHello(addr string, handler Handler, blocksize uint64, tlsConfig *tls.Config, hello protocols.Hello) (*Server, error) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
 	srv := &Server{
 		lst:       l,
 		handler:   handler,
 		blocksize: blocksize,
+		hello:     hello,
+		bufs:      torus.NewBlockBufPool(blocksize),
 	}
 	go srv.serve()
 	return srv, nil
@@ -91,7 +141,20 @@ func (s *Server) serve() {
 func (s *Server) handle(conn net.Conn) {
 	header := make([]byte, 1)
 	refbuf := make([]byte, torus.BlockRefByteSize)
-	null := make([]byte, s.blocksize)
+	null := s.bufs.Get()
+	defer s.bufs.Put(null)
+	// blockbuf reassembles chunked puts; it is only taken from the pool if
+	// the peer sends any.
+	var blockbuf []byte
+	defer func() {
+		if blockbuf != nil {
+			s.bufs.Put(blockbuf)
+		}
+	}()
+	// trace is the span context sent ahead of the next request, if any,
+	// and fence the lock generation.
+	var trace opentracing.SpanContext
+	var fence uint64
 	//	databuf := make([]byte, s.handler.BlockSize())
 	for {
 		err := readConnIntoBuffer(conn, header)
@@ -106,20 +169,39 @@ func (s *Server) handle(conn net.Conn) {
 			}
 			return
 		}
-		switch header[0] {
-		case cmdKeepAlive:
+		if header[0] == cmdKeepAlive {
 			continue
-		case cmdBlock:
-			err = s.handleBlock(conn, refbuf)
-		case cmdPutBlock:
-			err = s.handlePutBlock(conn, refbuf, null)
-		case cmdRebalanceCheck:
-			err := readConnIntoBuffer(conn, header)
+		}
+		if header[0] == cmdHello {
+			err = s.handleHello(conn)
+			if err == nil {
+				continue
+			}
+			if _, ok := err.(*protocols.VersionError); ok {
+				clog.Errorf("refusing peer connection from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+		} else if header[0] == cmdTrace {
+			trace, err = readTrace(conn)
 			if err == nil {
-				err = s.handleRebalanceCheck(conn, int(header[0]), refbuf)
+				continue
+			}
+		} else if header[0] == cmdFence {
+			fence, err = readFence(conn)
+			if err == nil {
+				continue
+			}
+		} else {
+			ctx, span := requestContext(trace, header[0])
+			if fence != 0 {
+				ctx = torus.WithLockGeneration(ctx, fence)
+			}
+			trace, fence = nil, 0
+			err = s.handleRequest(ctx, conn, header, refbuf, null, &blockbuf)
+			if span != nil {
+				span.Finish()
 			}
-		default:
-			err = errors.New("unknown message on the data port")
 		}
 		if err != nil {
 			if !s.isClosed() {
@@ -131,6 +213,61 @@ func (s *Server) handle(conn net.Conn) {
 	}
 }
 
+// handleRequest serves a single request of the command in header.
+func (s *Server) handleRequest(ctx context.Context, conn net.Conn, header, refbuf, null []byte, blockbuf *[]byte) error {
+	switch header[0] {
+	case cmdBlock:
+		return s.handleBlock(ctx, conn, refbuf)
+	case cmdBlockRange:
+		return s.handleBlockRange(ctx, conn, refbuf, false)
+	case cmdBlockRangeChecked:
+		return s.handleBlockRange(ctx, conn, refbuf, true)
+	case cmdPutBlock:
+		return s.handlePutBlock(ctx, conn, refbuf, null)
+	case cmdBlockChunked:
+		return s.handleBlockChunked(ctx, conn, refbuf)
+	case cmdPutBlockChunked:
+		if *blockbuf == nil {
+			*blockbuf = s.bufs.Get()
+		}
+		return s.handlePutBlockChunked(ctx, conn, refbuf, *blockbuf)
+	case cmdSync:
+		return s.handleSync(ctx, conn)
+	case cmdBlocks:
+		return s.handleBlocks(ctx, conn, refbuf)
+	case cmdRebalanceCheck:
+		err := readConnIntoBuffer(conn, header)
+		if err != nil {
+			return err
+		}
+		return s.handleRebalanceCheck(ctx, conn, int(header[0]), refbuf)
+	}
+	return errors.New("unknown message on the data port")
+}
+
+// fenceFrame returns the cmdFence frame carrying the lock generation of ctx
+// to the server, to be sent ahead of a write. It is nil if ctx has none.
+func fenceFrame(ctx context.Context) []byte {
+	gen := torus.LockGeneration(ctx)
+	if gen == 0 {
+		return nil
+	}
+	frame := make([]byte, 9)
+	frame[0] = cmdFence
+	binary.LittleEndian.PutUint64(frame[1:], gen)
+	return frame
+}
+
+// readFence reads the lock generation of a cmdFence frame.
+func readFence(conn net.Conn) (uint64, error) {
+	buf := make([]byte, 8)
+	err := readConnIntoBuffer(conn, buf)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
 func readConnIntoBuffer(conn net.Conn, buf []byte) error {
 	off := 0
 	for off != len(buf) {
@@ -143,16 +280,17 @@ func readConnIntoBuffer(conn net.Conn, buf []byte) error {
 	return nil
 }
 
-func (s *Server) handleBlock(conn net.Conn, refbuf []byte) error {
+func (s *Server) handleBlock(ctx context.Context, conn net.Conn, refbuf []byte) error {
 	err := readConnIntoBuffer(conn, refbuf)
 	if err != nil {
 		return err
 	}
 	ref := torus.BlockRefFromBytes(refbuf)
-	data, err := s.handler.Block(context.TODO(), ref)
+	data, err := s.handler.Block(ctx, ref)
+	defer s.release(data)
 	respheader := headerOk
 	if err != nil {
-		clog.Warningf("failed to handle block: %v", err)
+		torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to handle block: %v", err)
 		respheader = headerErr
 	}
 	_, err = conn.Write(respheader)
@@ -166,19 +304,78 @@ func (s *Server) handleBlock(conn net.Conn, refbuf []byte) error {
 	return nil
 }
 
-func (s *Server) handlePutBlock(conn net.Conn, refbuf []byte, null []byte) error {
+// handleBlockRange sends part of a block, followed by its checksum if checked
+// is set.
+func (s *Server) handleBlockRange(ctx context.Context, conn net.Conn, refbuf []byte, checked bool) error {
 	err := readConnIntoBuffer(conn, refbuf)
 	if err != nil {
 		return err
 	}
 	ref := torus.BlockRefFromBytes(refbuf)
-	data, err := s.handler.WriteBuf(context.TODO(), ref)
+	rangebuf := make([]byte, 16)
+	err = readConnIntoBuffer(conn, rangebuf)
 	if err != nil {
-		if err == torus.ErrExists {
-			data = null
-		} else {
+		return err
+	}
+	offset := binary.LittleEndian.Uint64(rangebuf[:8])
+	length := binary.LittleEndian.Uint64(rangebuf[8:])
+	data, err := s.handler.BlockRange(ctx, ref, offset, length)
+	respheader := headerOk
+	if err != nil {
+		torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to handle block range: %v", err)
+		respheader = headerErr
+	}
+	_, err = conn.Write(respheader)
+	if err != nil {
+		return err
+	}
+	if respheader[0] == respErr {
+		return nil
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		return err
+	}
+	if checked {
+		return writeChecksum(conn, data)
+	}
+	return nil
+}
+
+func (s *Server) handlePutBlock(ctx context.Context, conn net.Conn, refbuf []byte, null []byte) error {
+	err := readConnIntoBuffer(conn, refbuf)
+	if err != nil {
+		return err
+	}
+	ref := torus.BlockRefFromBytes(refbuf)
+	data, err := s.handler.WriteBuf(ctx, ref)
+	if err == torus.ErrNotSupported {
+		// The storage can't be written in place, so the block is read
+		// into the spare buffer and put, as chunked puts are.
+		err = readConnIntoBuffer(conn, null)
+		if err != nil {
 			return err
 		}
+		err = s.handler.PutBlock(ctx, ref, null)
+		respheader := headerOk
+		if err != nil {
+			torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to put block: %v", err)
+			respheader = headerErr
+		}
+		_, err = conn.Write(respheader)
+		return err
+	}
+	if err == torus.ErrExists {
+		data = null
+	} else if err != nil {
+		// The write was turned away, as fenced writes are; the block is
+		// still read off the connection so the next request can be.
+		if rerr := readConnIntoBuffer(conn, null); rerr != nil {
+			return rerr
+		}
+		torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to put block: %v", err)
+		_, err = conn.Write(headerErr)
+		return err
 	}
 	err = readConnIntoBuffer(conn, data)
 	if err != nil {
@@ -192,7 +389,83 @@ func (s *Server) handlePutBlock(conn net.Conn, refbuf []byte, null []byte) error
 	return err
 }
 
-func (s *Server) handleRebalanceCheck(conn net.Conn, len int, refbuf []byte) error {
+func (s *Server) handleBlockChunked(ctx context.Context, conn net.Conn, refbuf []byte) error {
+	err := readConnIntoBuffer(conn, refbuf)
+	if err != nil {
+		return err
+	}
+	ref := torus.BlockRefFromBytes(refbuf)
+	sizebuf := make([]byte, 4)
+	err = readConnIntoBuffer(conn, sizebuf)
+	if err != nil {
+		return err
+	}
+	chunkSize := int(binary.LittleEndian.Uint32(sizebuf))
+	if chunkSize == 0 {
+		return errors.New("tdp: zero chunk size")
+	}
+	data, err := s.handler.Block(ctx, ref)
+	if err != nil {
+		torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to handle block: %v", err)
+		_, err = conn.Write(headerErr)
+		return err
+	}
+	defer s.release(data)
+	_, err = conn.Write(headerOk)
+	if err != nil {
+		return err
+	}
+	return writeChunked(conn, data, chunkSize)
+}
+
+// release gives a block read by the handler back to it once it has been
+// sent, if the handler pools its blocks.
+func (s *Server) release(data []byte) {
+	if r, ok := s.handler.(torus.BlockReleaser); ok && data != nil {
+		r.ReleaseBlock(data)
+	}
+}
+
+// handlePutBlockChunked reassembles a chunked block into buf, and only hands
+// it to the handler once its checksum matches.
+func (s *Server) handlePutBlockChunked(ctx context.Context, conn net.Conn, refbuf []byte, buf []byte) error {
+	err := readConnIntoBuffer(conn, refbuf)
+	if err != nil {
+		return err
+	}
+	ref := torus.BlockRefFromBytes(refbuf)
+	err = readChunked(conn, buf)
+	if err == nil {
+		err = s.handler.PutBlock(ctx, ref, buf)
+	} else if err == errChecksum {
+		promChecksumErrors.WithLabelValues("put").Inc()
+	} else {
+		return err
+	}
+	respheader := headerOk
+	if err != nil {
+		torus.WithFields(clog, torus.BlockLogFields(ref)).Warningf("failed to put block: %v", err)
+		respheader = headerErr
+	}
+	_, err = conn.Write(respheader)
+	return err
+}
+
+func (s *Server) handleSync(ctx context.Context, conn net.Conn) error {
+	respheader := headerErr
+	if h, ok := s.handler.(SyncHandler); ok {
+		err := h.Sync(ctx)
+		if err == nil {
+			respheader = headerOk
+		} else {
+			clog.Warningf("failed to sync: %v", err)
+		}
+	}
+	_, err := conn.Write(respheader)
+	return err
+}
+
+func (s *Server) handleRebalanceCheck(ctx context.Context, conn net.Conn, len int, refbuf []byte) error {
 	refs := make([]torus.BlockRef, len)
 	for i := 0; i < len; i++ {
 		err := readConnIntoBuffer(conn, refbuf)
@@ -201,7 +474,7 @@ func (s *Server) handleRebalanceCheck(conn net.Conn, len int, refbuf []byte) err
 		}
 		refs[i] = torus.BlockRefFromBytes(refbuf)
 	}
-	bools, err := s.handler.RebalanceCheck(context.TODO(), refs)
+	bools, err := s.handler.RebalanceCheck(ctx, refs)
 	respheader := headerOk
 	if err != nil {
 		clog.Warningf("failed to rebalance check: %v", err)
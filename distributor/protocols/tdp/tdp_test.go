@@ -2,16 +2,21 @@ package tdp
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
 	"github.com/alternative-storage/torus/models"
+	"github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 )
 
@@ -24,6 +29,9 @@ type mockBlockRPC struct {
 func (m *mockBlockRPC) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
 	return m.data, nil
 }
+func (m *mockBlockRPC) BlockRange(ctx context.Context, ref torus.BlockRef, offset, length uint64) ([]byte, error) {
+	return m.data[offset : offset+length], nil
+}
 func (m *mockBlockRPC) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
 	if ref.INode != 2 && ref.Index != 3 {
 		return errors.New("mismatch")
@@ -131,6 +139,77 @@ func TestBlock(t *testing.T) {
 	}
 }
 
+type releasingBlockRPC struct {
+	mockBlockRPC
+	released chan []byte
+}
+
+func (m *releasingBlockRPC) ReleaseBlock(b []byte) {
+	m.released <- b
+}
+
+func TestReleaseBlock(t *testing.T) {
+	m := &releasingBlockRPC{
+		mockBlockRPC: mockBlockRPC{data: makeTestData(512 * 1024)},
+		released:     make(chan []byte, 1),
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	for _, chunk := range []uint64{0, 64 * 1024} {
+		c.SetTransferChunkSize(chunk)
+		if _, err := c.Block(context.TODO(), ref); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case b := <-m.released:
+			if &b[0] != &m.data[0] {
+				t.Fatal("expected the block sent to be released")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("chunk size %d: block wasn't released", chunk)
+		}
+	}
+}
+
+func TestBlockRange(t *testing.T) {
+	test := makeTestData(512 * 1024)
+	m := &mockBlockRPC{
+		data: test,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b, err := c.BlockRange(context.TODO(), torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}, 4096, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(test[4096:8192], b) {
+		t.Fatal("unequal response")
+	}
+}
+
 func TestBlockGRPC(t *testing.T) {
 	test := makeTestData(512 * 1024)
 	m := &mockBlockGRPC{
@@ -190,6 +269,279 @@ func TestPutBlock(t *testing.T) {
 	}
 }
 
+type mockNoWriteBufRPC struct {
+	mockBlockRPC
+}
+
+func (m *mockNoWriteBufRPC) WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	return nil, torus.ErrNotSupported
+}
+
+// Handlers that can't be written in place get blocks through PutBlock.
+func TestPutBlockNoWriteBuf(t *testing.T) {
+	stest := makeTestData(512 * 1024)
+	m := &mockNoWriteBufRPC{mockBlockRPC{data: stest}}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	if err := c.PutBlock(context.TODO(), ref, append([]byte(nil), stest...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutBlock(context.TODO(), ref, makeTestData(512*1024)); err == nil {
+		t.Fatal("expected the handler refusing the block to fail the put")
+	}
+}
+
+func TestPutShortBlock(t *testing.T) {
+	short := makeTestData(1000)
+	m := &mockBlockRPC{
+		data: make([]byte, 512*1024),
+	}
+	copy(m.data, short)
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	for _, chunk := range []uint64{0, 100 * 1024} {
+		c.SetTransferChunkSize(chunk)
+		// The block arrives padded with zeros, and the connection stays usable.
+		if err := c.PutBlock(context.TODO(), ref, short); err != nil {
+			t.Fatalf("chunk size %d: %v", chunk, err)
+		}
+		b, err := c.Block(context.TODO(), ref)
+		if err != nil {
+			t.Fatalf("chunk size %d: %v", chunk, err)
+		}
+		if !bytes.Equal(m.data, b) {
+			t.Fatalf("chunk size %d: unequal response", chunk)
+		}
+	}
+}
+
+func TestChunked(t *testing.T) {
+	test := makeTestData(512 * 1024)
+	m := &mockBlockRPC{
+		data: test,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// A chunk size that doesn't divide the block leaves a short last frame.
+	c.SetTransferChunkSize(100 * 1024)
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	b, err := c.Block(context.TODO(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(test, b) {
+		t.Fatal("unequal response")
+	}
+	err = c.PutBlock(context.TODO(), ref, append([]byte(nil), test...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkedPutBadChecksum(t *testing.T) {
+	test := makeTestData(4096)
+	m := &mockBlockRPC{
+		data: test,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	put := func(corrupt bool) byte {
+		req := make([]byte, torus.BlockRefByteSize+1)
+		req[0] = cmdPutBlockChunked
+		ref.ToBytesBuf(req[1:])
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		data := append([]byte(nil), test...)
+		cw := &corruptingConn{Conn: conn, corrupt: corrupt}
+		if err := writeChunked(cw, data, 1024); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 1)
+		if err := readConnIntoBuffer(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp[0]
+	}
+	if r := put(true); r != respErr {
+		t.Fatalf("expected a corrupted block to be refused, got %d", r)
+	}
+	// The connection stays in sync after a refused block.
+	if r := put(false); r != respOk {
+		t.Fatalf("expected the block to be accepted, got %d", r)
+	}
+}
+
+// corruptingConn flips a bit in the first frame payload written through it.
+type corruptingConn struct {
+	net.Conn
+	corrupt bool
+	writes  int
+}
+
+func (c *corruptingConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.corrupt && c.writes == 2 {
+		b = append([]byte(nil), b...)
+		b[0] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWireChecksum(t *testing.T) {
+	test := makeTestData(512 * 1024)
+	m := &mockBlockRPC{
+		data: test,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetWireChecksum(true)
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	b, err := c.Block(context.TODO(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(test, b) {
+		t.Fatal("unequal response")
+	}
+	b, err = c.BlockRange(context.TODO(), ref, 4096, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(test[4096:8192], b) {
+		t.Fatal("unequal range response")
+	}
+
+	// A put corrupted on the way is refused by the server and sent again.
+	c.mut.Lock()
+	cc := &corruptOnceConn{Conn: c.conn}
+	c.conn = cc
+	c.mut.Unlock()
+	err = c.PutBlock(context.TODO(), ref, append([]byte(nil), test...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cc.corrupted {
+		t.Fatal("expected the first put to be corrupted")
+	}
+}
+
+func TestWireChecksumCorruptRead(t *testing.T) {
+	test := makeTestData(4096)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	// Answer a range request with the right data but a bad checksum, as if
+	// it had been corrupted on the way.
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hello := make([]byte, 1+helloSize)
+		if err := readConnIntoBuffer(conn, hello); err != nil {
+			return
+		}
+		conn.Write(helloFrame(respOk, protocols.LocalHello()))
+		req := make([]byte, torus.BlockRefByteSize+1+16)
+		if err := readConnIntoBuffer(conn, req); err != nil {
+			return
+		}
+		conn.Write(headerOk)
+		conn.Write(test)
+		conn.Write([]byte{0, 0, 0, 0})
+	}()
+	c, err := Dial(lis.Addr().String(), time.Second, uint64(len(test)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetWireChecksum(true)
+	_, err = c.BlockRange(context.TODO(), torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}, 0, uint64(len(test)))
+	if err != errChecksum {
+		t.Fatalf("expected errChecksum, got %v", err)
+	}
+}
+
+// corruptOnceConn flips a bit in the first block-sized write through it.
+type corruptOnceConn struct {
+	net.Conn
+	corrupted bool
+}
+
+func (c *corruptOnceConn) Write(b []byte) (int, error) {
+	if !c.corrupted && len(b) >= 4096 {
+		c.corrupted = true
+		b = append([]byte(nil), b...)
+		b[0] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
 func TestPutBlockGRPC(t *testing.T) {
 	test := makeTestData(512 * 1024)
 	m := &mockBlockGRPC{
@@ -262,6 +614,45 @@ func TestRebalanceCheck(t *testing.T) {
 	}
 }
 
+type mockSyncRPC struct {
+	mockBlockRPC
+	err error
+}
+
+func (m *mockSyncRPC) Sync(ctx context.Context) error {
+	return m.err
+}
+
+func TestSync(t *testing.T) {
+	for _, tt := range []struct {
+		handler Handler
+		ok      bool
+	}{
+		{&mockSyncRPC{}, true},
+		{&mockSyncRPC{err: errors.New("disk gone")}, false},
+		// Servers whose handler can't sync refuse to.
+		{&mockBlockRPC{}, false},
+	} {
+		s, err := Serve("localhost:0", tt.handler, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Dial(s.ListenAddr().String(), time.Second, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Sync(context.TODO())
+		c.Close()
+		s.Close()
+		if tt.ok && err != nil {
+			t.Fatalf("%T: %v", tt.handler, err)
+		}
+		if !tt.ok && err == nil {
+			t.Fatalf("%T: expected sync to fail", tt.handler)
+		}
+	}
+}
+
 // BENCHES
 
 func BenchmarkBlock(b *testing.B) {
@@ -365,6 +756,80 @@ func BenchmarkPutBlock(b *testing.B) {
 	b.SetBytes(int64(total / b.N))
 }
 
+// Transfers of 4MiB blocks, whole and in 256KiB frames. Run with -benchmem
+// to compare allocations.
+func BenchmarkBlock4MiB(b *testing.B)           { benchmarkTransfer(b, 4*1024*1024, 0, false) }
+func BenchmarkBlock4MiBChunked(b *testing.B)    { benchmarkTransfer(b, 4*1024*1024, 256*1024, false) }
+func BenchmarkPutBlock4MiB(b *testing.B)        { benchmarkTransfer(b, 4*1024*1024, 0, true) }
+func BenchmarkPutBlock4MiBChunked(b *testing.B) { benchmarkTransfer(b, 4*1024*1024, 256*1024, true) }
+
+func benchmarkTransfer(b *testing.B, size int, chunkSize uint64, put bool) {
+	test := makeTestData(size)
+	m := &mockBlockRPC{
+		data: test,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTransferChunkSize(chunkSize)
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if put {
+			err = c.PutBlock(context.TODO(), ref, test)
+		} else {
+			_, err = c.Block(context.TODO(), ref)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPutBlockNewConn puts every block over a fresh connection, so the
+// per-connection buffers of the server show up with -benchmem.
+func BenchmarkPutBlockNewConn(b *testing.B) {
+	test := makeTestData(4 * 1024 * 1024)
+	m := &mockBlockRPC{
+		data: test,
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(test)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = c.PutBlock(context.TODO(), ref, test)
+		c.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkGRPCPutBlock(b *testing.B) {
 	test := makeTestData(512 * 1024)
 	m := &mockBlockGRPC{
@@ -498,3 +963,193 @@ func BenchmarkGRPCRebalanceCheck(b *testing.B) {
 	}
 	b.SetBytes(int64(total / b.N))
 }
+
+// fakeTracer numbers its spans, and carries a span's number in its binary
+// format.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpanContext struct {
+	opentracing.SpanContext
+	id int
+}
+
+type fakeSpan struct {
+	opentracing.Span
+	tracer *fakeTracer
+	op     string
+	id     int
+	parent int
+}
+
+func (s *fakeSpan) Context() opentracing.SpanContext                { return fakeSpanContext{id: s.id} }
+func (s *fakeSpan) SetTag(k string, v interface{}) opentracing.Span { return s }
+func (s *fakeSpan) Finish()                                         {}
+func (s *fakeSpan) Tracer() opentracing.Tracer                      { return s.tracer }
+
+func (t *fakeTracer) StartSpan(op string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var o opentracing.StartSpanOptions
+	for _, x := range opts {
+		x.Apply(&o)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &fakeSpan{tracer: t, op: op, id: len(t.spans) + 1}
+	if len(o.References) > 0 {
+		s.parent = o.References[0].ReferencedContext.(fakeSpanContext).id
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func (t *fakeTracer) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	return binary.Write(carrier.(io.Writer), binary.LittleEndian, uint32(sc.(fakeSpanContext).id))
+}
+
+func (t *fakeTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	var id uint32
+	err := binary.Read(carrier.(io.Reader), binary.LittleEndian, &id)
+	return fakeSpanContext{id: int(id)}, err
+}
+
+// tracedBlockRPC records the span each request is served in.
+type tracedBlockRPC struct {
+	*mockBlockRPC
+	served chan opentracing.Span
+}
+
+func (m *tracedBlockRPC) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	m.served <- opentracing.SpanFromContext(ctx)
+	return m.mockBlockRPC.Block(ctx, ref)
+}
+
+func TestTracePropagation(t *testing.T) {
+	tracer := &fakeTracer{}
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	m := &tracedBlockRPC{
+		mockBlockRPC: &mockBlockRPC{data: makeTestData(512 * 1024)},
+		served:       make(chan opentracing.Span, 1),
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+
+	root := tracer.StartSpan("nbd: read")
+	ctx := opentracing.ContextWithSpan(context.TODO(), root)
+	if _, err := c.Block(ctx, ref); err != nil {
+		t.Fatal(err)
+	}
+	served, ok := (<-m.served).(*fakeSpan)
+	if !ok {
+		t.Fatal("traced request was served without a span")
+	}
+	client := tracer.spans[served.parent-1]
+	if client.op != "tdp: Block" || client.parent != root.(*fakeSpan).id {
+		t.Fatalf("server span is a child of %q (parent %d), not of the client span of the request", client.op, client.parent)
+	}
+
+	// The trace doesn't carry over to the next request on the connection.
+	if _, err := c.Block(context.TODO(), ref); err != nil {
+		t.Fatal(err)
+	}
+	if span := <-m.served; span != nil {
+		t.Fatal("untraced request was served with a span")
+	}
+}
+
+// fencedBlockRPC records the lock generation of each write, and turns away
+// those made under a generation older than the latest.
+type fencedBlockRPC struct {
+	*mockBlockRPC
+	gens chan uint64
+	last uint64
+}
+
+func (m *fencedBlockRPC) WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	gen := torus.LockGeneration(ctx)
+	m.gens <- gen
+	if gen != 0 && gen < m.last {
+		return nil, torus.ErrFenced
+	}
+	if gen != 0 {
+		m.last = gen
+	}
+	return m.mockBlockRPC.WriteBuf(ctx, ref)
+}
+
+func (m *fencedBlockRPC) nextGen(t *testing.T) uint64 {
+	select {
+	case gen := <-m.gens:
+		return gen
+	case <-time.After(time.Second):
+		t.Fatal("the write never reached the handler")
+	}
+	return 0
+}
+
+func TestFencePropagation(t *testing.T) {
+	m := &fencedBlockRPC{
+		mockBlockRPC: &mockBlockRPC{data: makeTestData(512 * 1024)},
+		gens:         make(chan uint64, 1),
+	}
+	s, err := Serve("localhost:0", m, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.ListenAddr().String(), time.Second, m.BlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	// The server reads the block into m.data, so a copy is sent.
+	data := append([]byte(nil), m.data...)
+	ctx := torus.WithLockGeneration(context.TODO(), 7)
+	if err := c.PutBlock(ctx, ref, data); err != nil {
+		t.Fatal(err)
+	}
+	if gen := m.nextGen(t); gen != 7 {
+		t.Fatalf("expected the write to be made under generation 7, got %d", gen)
+	}
+
+	// The generation doesn't carry over to the next write on the connection.
+	if err := c.PutBlock(context.TODO(), ref, data); err != nil {
+		t.Fatal(err)
+	}
+	if gen := m.nextGen(t); gen != 0 {
+		t.Fatalf("expected the write to be made under no lock, got generation %d", gen)
+	}
+
+	// A fenced write fails, and the connection is still good afterwards.
+	if err := c.PutBlock(torus.WithLockGeneration(context.TODO(), 6), ref, data); err == nil {
+		t.Fatal("expected a write under an older generation to fail")
+	}
+	if gen := m.nextGen(t); gen != 6 {
+		t.Fatalf("expected the write to be made under generation 6, got %d", gen)
+	}
+	if err := c.PutBlock(ctx, ref, data); err != nil {
+		t.Fatal(err)
+	}
+	if gen := m.nextGen(t); gen != 7 {
+		t.Fatalf("expected the write to be made under generation 7, got %d", gen)
+	}
+}
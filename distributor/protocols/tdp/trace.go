@@ -0,0 +1,117 @@
+package tdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"golang.org/x/net/context"
+)
+
+// maxTraceSize bounds the span context a cmdTrace frame may carry.
+const maxTraceSize = 4096
+
+var cmdNames = map[byte]string{
+	cmdPutBlock:          "PutBlock",
+	cmdBlock:             "Block",
+	cmdRebalanceCheck:    "RebalanceCheck",
+	cmdBlockRange:        "BlockRange",
+	cmdBlockChunked:      "Block",
+	cmdPutBlockChunked:   "PutBlock",
+	cmdBlockRangeChecked: "BlockRange",
+	cmdSync:              "Sync",
+	cmdBlocks:            "Blocks",
+}
+
+// traceRequest starts a client span for op if ctx is part of a trace, tagged
+// with ref unless it is nil. It returns the span, to be finished once the
+// request is answered, and the cmdTrace frame carrying its context to the
+// server, to be sent ahead of the request. Both are nil if ctx isn't traced.
+func traceRequest(ctx context.Context, op string, ref *torus.BlockRef) (opentracing.Span, []byte) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return nil, nil
+	}
+	tracer := parent.Tracer()
+	span := tracer.StartSpan("tdp: "+op, opentracing.ChildOf(parent.Context()), ext.SpanKindRPCClient)
+	if ref != nil {
+		torus.SetBlockRefTags(span, *ref)
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{cmdTrace, 0, 0, 0, 0})
+	err := tracer.Inject(span.Context(), opentracing.Binary, &buf)
+	if err != nil || buf.Len() == 5 || buf.Len()-5 > maxTraceSize {
+		// The tracer can't carry the span to the server, or has nothing
+		// to send; the span still shows the request from this side.
+		return span, nil
+	}
+	frame := buf.Bytes()
+	binary.LittleEndian.PutUint32(frame[1:5], uint32(len(frame)-5))
+	return span, frame
+}
+
+// sendTrace sends a cmdTrace frame, if there is one and the server speaks
+// them. c.mut must be held.
+func (c *Conn) sendTrace(frame []byte) error {
+	if len(frame) == 0 || !c.hello.Features.Has(protocols.FeatureTrace) {
+		return nil
+	}
+	_, err := c.conn.Write(frame)
+	if err != nil {
+		return fmt.Errorf("couldn't write trace: %v", err)
+	}
+	return nil
+}
+
+// finishSpan finishes span, if there is one, tagging it with err.
+func finishSpan(span opentracing.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.SetTag("error.message", err.Error())
+	}
+	span.Finish()
+}
+
+// readTrace reads the span context of a cmdTrace frame. A context the tracer
+// doesn't understand is dropped, and the request that follows is served
+// untraced.
+func readTrace(conn net.Conn) (opentracing.SpanContext, error) {
+	sizebuf := make([]byte, 4)
+	err := readConnIntoBuffer(conn, sizebuf)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(sizebuf)
+	if size > maxTraceSize {
+		return nil, fmt.Errorf("tdp: trace of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	err = readConnIntoBuffer(conn, data)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := opentracing.GlobalTracer().Extract(opentracing.Binary, bytes.NewReader(data))
+	if err != nil {
+		clog.Debugf("dropping trace of request: %v", err)
+		return nil, nil
+	}
+	return sc, nil
+}
+
+// requestContext returns the context to serve a request with, along with the
+// server span that is part of the trace the request was sent with, if any.
+func requestContext(trace opentracing.SpanContext, cmd byte) (context.Context, opentracing.Span) {
+	if trace == nil {
+		return context.TODO(), nil
+	}
+	span := opentracing.GlobalTracer().StartSpan("tdp: "+cmdNames[cmd], ext.RPCServerOption(trace))
+	return opentracing.ContextWithSpan(context.TODO(), span), span
+}
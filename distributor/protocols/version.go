@@ -0,0 +1,126 @@
+package protocols
+
+import (
+	"fmt"
+
+	"github.com/alternative-storage/torus"
+)
+
+// Features are the optional parts of the peer protocol a server speaks.
+// Both ends of a connection advertise theirs, and only those both speak are
+// used on it.
+type Features uint64
+
+const (
+	// FeatureChunked is splitting block payloads into frames.
+	FeatureChunked Features = 1 << iota
+	// FeatureChecksum is checksumming whole blocks and block ranges.
+	FeatureChecksum
+	// FeatureTrace is carrying the trace of a request to the peer.
+	FeatureTrace
+	// FeatureFence is carrying the volume lock generation of a write.
+	FeatureFence
+	// FeatureBatchRead is fetching several blocks in one request.
+	FeatureBatchRead
+)
+
+// LocalFeatures are the features this server speaks.
+const LocalFeatures = FeatureChunked | FeatureChecksum | FeatureTrace | FeatureFence | FeatureBatchRead
+
+// LegacyFeatures are the features spoken by servers from before peers
+// agreed on a version, which didn't advertise any.
+const LegacyFeatures = FeatureChunked | FeatureChecksum | FeatureTrace | FeatureFence
+
+var featureNames = []string{"chunked", "checksum", "trace", "fence", "batch-read"}
+
+// Has reports whether every feature in f2 is in f.
+func (f Features) Has(f2 Features) bool {
+	return f&f2 == f2
+}
+
+func (f Features) String() string {
+	s := ""
+	for i, name := range featureNames {
+		if f&(1<<uint(i)) == 0 {
+			continue
+		}
+		if s != "" {
+			s += ","
+		}
+		s += name
+	}
+	if rest := f &^ (1<<uint(len(featureNames)) - 1); rest != 0 {
+		if s != "" {
+			s += ","
+		}
+		s += fmt.Sprintf("%#x", uint64(rest))
+	}
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// Hello is what a server advertises of the peer protocol when a connection
+// is set up: the range of versions it speaks and its features. Once both
+// ends have advertised theirs, it is what the connection speaks.
+type Hello struct {
+	Version    uint64
+	MinVersion uint64
+	Features   Features
+}
+
+// LocalHello returns what this server advertises.
+func LocalHello() Hello {
+	return Hello{
+		Version:    torus.ProtocolVersion,
+		MinVersion: torus.MinProtocolVersion,
+		Features:   LocalFeatures,
+	}
+}
+
+// LegacyHello is what a server from before peers agreed on a version is
+// taken to speak.
+var LegacyHello = Hello{
+	Version:    1,
+	MinVersion: 1,
+	Features:   LegacyFeatures,
+}
+
+// VersionError is returned when dialing a peer that speaks no version of
+// the protocol this server does.
+type VersionError struct {
+	Local, Remote Hello
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("incompatible peer protocol: this server speaks versions %d to %d, the peer %d to %d", e.Local.MinVersion, e.Local.Version, e.Remote.MinVersion, e.Remote.Version)
+}
+
+// Negotiate returns what a connection between servers advertising local and
+// remote speaks: the highest version both speak, and the features both
+// have. It is the same whichever end computes it.
+func Negotiate(local, remote Hello) (Hello, error) {
+	v := local.Version
+	if remote.Version < v {
+		v = remote.Version
+	}
+	if v < local.MinVersion || v < remote.MinVersion {
+		return Hello{}, &VersionError{Local: local, Remote: remote}
+	}
+	min := local.MinVersion
+	if remote.MinVersion > min {
+		min = remote.MinVersion
+	}
+	return Hello{
+		Version:    v,
+		MinVersion: min,
+		Features:   local.Features & remote.Features,
+	}, nil
+}
+
+// NegotiatedRPC is implemented by RPC connections that agreed on a version
+// of the protocol with the other end when they were set up.
+type NegotiatedRPC interface {
+	Negotiated() Hello
+}
@@ -0,0 +1,38 @@
+package protocols
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	local := Hello{Version: 3, MinVersion: 2, Features: FeatureChunked | FeatureTrace}
+	for _, tt := range []struct {
+		remote Hello
+		want   Hello
+		ok     bool
+	}{
+		// The same version on both ends.
+		{Hello{3, 2, FeatureChunked | FeatureTrace}, Hello{3, 2, FeatureChunked | FeatureTrace}, true},
+		// An older peer: down to its version, and the features both have.
+		{Hello{2, 1, FeatureChunked}, Hello{2, 2, FeatureChunked}, true},
+		// A newer peer that still speaks ours.
+		{Hello{4, 3, FeatureChunked | FeatureFence}, Hello{3, 3, FeatureChunked}, true},
+		// Too old, and too new.
+		{Hello{1, 1, FeatureChunked}, Hello{}, false},
+		{Hello{5, 4, 0}, Hello{}, false},
+	} {
+		got, err := Negotiate(local, tt.remote)
+		if tt.ok != (err == nil) || got != tt.want {
+			t.Errorf("%+v: expected %+v, got %+v, %v", tt.remote, tt.want, got, err)
+		}
+		if err == nil {
+			// Either end comes to the same answer.
+			if back, _ := Negotiate(tt.remote, local); back != got {
+				t.Errorf("%+v: negotiated %+v the other way round", tt.remote, back)
+			}
+		} else if _, ok := err.(*VersionError); !ok {
+			t.Errorf("%+v: expected a version error, got %v", tt.remote, err)
+		}
+	}
+	if s := (FeatureChunked | FeatureBatchRead | 1<<10).String(); s != "chunked,batch-read,0x400" {
+		t.Errorf("unexpected feature names %q", s)
+	}
+}
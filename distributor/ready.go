@@ -0,0 +1,43 @@
+package distributor
+
+import "github.com/alternative-storage/torus"
+
+// checkMinPeers marks the distributor ready for writes once its ring
+// contains at least the configured minimum number of peers. The caller must
+// hold d.mut for writing, or be the only user of d.
+func (d *Distributor) checkMinPeers() {
+	if d.peersReady {
+		return
+	}
+	n := len(d.ring.Members())
+	if n < d.srv.Cfg.MinPeers {
+		clog.Infof("ring has %d of %d peers required to accept writes", n, d.srv.Cfg.MinPeers)
+		return
+	}
+	d.peersReady = true
+}
+
+// Listening reports whether s is serving replication requests from other
+// nodes.
+func Listening(s *torus.Server) bool {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return false
+	}
+	d.drainMut.Lock()
+	defer d.drainMut.Unlock()
+	return len(d.rpcSrvs) > 0
+}
+
+// WaitingForPeers reports whether s is still refusing writes because its ring
+// hasn't yet reached the minimum number of peers, and false if replication
+// isn't open on s.
+func WaitingForPeers(s *torus.Server) bool {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return false
+	}
+	d.mut.RLock()
+	defer d.mut.RUnlock()
+	return !d.peersReady
+}
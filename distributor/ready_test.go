@@ -0,0 +1,97 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+	"golang.org/x/net/context"
+)
+
+// subscribedMDS tells when the distributor's ring watcher subscribes, so a
+// test knows a ring set afterwards will be seen.
+type subscribedMDS struct {
+	torus.MetadataService
+	subscribed chan struct{}
+}
+
+func (m *subscribedMDS) SubscribeNewRings(ch chan torus.Ring) {
+	m.MetadataService.SubscribeNewRings(ch)
+	select {
+	case m.subscribed <- struct{}{}:
+	default:
+	}
+}
+
+func TestMinPeers(t *testing.T) {
+	mds := temp.NewServer()
+	defer mds.Close()
+	srv := newServer(mds)
+	srv.Cfg.MinPeers = 2
+	sub := &subscribedMDS{MetadataService: srv.MDS, subscribed: make(chan struct{}, 1)}
+	srv.MDS = sub
+	if err := OpenReplication(srv); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	select {
+	case <-sub.subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the ring watcher to subscribe")
+	}
+
+	if !WaitingForPeers(srv) {
+		t.Fatal("expected an empty ring to be waiting for peers")
+	}
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    1,
+	}
+	err := srv.Blocks.WriteBlock(context.Background(), ref, make([]byte, BlockSize))
+	if err != ErrNotReady {
+		t.Fatalf("expected ErrNotReady, got %v", err)
+	}
+
+	r, err := ring.CreateRing(&models.Ring{
+		Type: uint32(ring.Ketama),
+		Peers: torus.PeerInfoList{
+			&models.PeerInfo{UUID: srv.MDS.UUID(), TotalBlocks: StorageSize / BlockSize},
+			&models.PeerInfo{UUID: "other", TotalBlocks: StorageSize / BlockSize},
+		},
+		ReplicationFactor: 1,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !WaitingForPeers(srv) })
+}
+
+func TestReadinessDuringShutdown(t *testing.T) {
+	mds := temp.NewServer()
+	defer mds.Close()
+	srv := newServer(mds)
+	if err := ListenReplication(srv, freeAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if !Listening(srv) || srv.ShuttingDown() {
+		t.Fatal("expected a fresh server to be listening and not shutting down")
+	}
+	if srv.Lease() == 0 || srv.LeaseErr() != nil {
+		t.Fatalf("expected a lease, got %d (%v)", srv.Lease(), srv.LeaseErr())
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if Listening(srv) || !srv.ShuttingDown() {
+		t.Fatal("expected the server to stop listening on shutdown")
+	}
+}
@@ -3,6 +3,7 @@ package distributor
 import (
 	"io"
 	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/alternative-storage/torus"
@@ -32,6 +33,7 @@ exit:
 				}
 				d.mut.Lock()
 				d.ring = newring
+				d.checkMinPeers()
 				d.mut.Unlock()
 			} else {
 				break exit
@@ -47,6 +49,13 @@ func (d *Distributor) rebalanceTicker(closer chan struct{}) {
 exit:
 	for {
 		clog.Tracef("starting rebalance/gc cycle")
+		passStart := time.Now().UnixNano()
+		passBlocks := d.blocks.UsedBlocks()
+		forced := d.gcCtl.startPass()
+		// Tombstones are read ahead of the volumes, so that every block
+		// of a volume deleted in between is found dead.
+		tombs := d.tombstones()
+		d.reaper.startPass(tombs)
 		volset, _, err := d.srv.MDS.GetVolumes()
 		if err != nil {
 			clog.Error(err)
@@ -61,30 +70,61 @@ exit:
 	ratelimit:
 		for {
 			timeout := 2 * time.Duration(n+1) * time.Millisecond
+			settings := d.rebalance.get()
+			if settings.Paused {
+				timeout = pausePoll
+			}
+			setRebalanceSettingsGauges(settings)
 			select {
 			case <-closer:
 				break exit
 			case <-time.After(timeout):
+				if settings.Paused {
+					// Checked again before every batch, so a pause
+					// takes effect mid-pass.
+					continue
+				}
 				written, err := d.rebalancer.Tick()
-				if d.ring.Version() != d.rebalancer.VersionStart() {
+				if d.ring.Version() != d.rebalancer.VersionStart() && !d.rebalancing {
 					// Something is changed -- we are now rebalancing
 					d.rebalancing = true
+					d.recordEvent(torus.AuditEvent{
+						Op:          torus.AuditRebalanceStart,
+						Source:      d.UUID(),
+						RingVersion: d.ring.Version(),
+					})
 				}
+				total += written
 				info := &models.RebalanceInfo{
-					Rebalancing: d.rebalancing,
+					Rebalancing:    d.rebalancing,
+					RebalanceStart: passStart,
+					BlocksTotal:    passBlocks,
+					BlocksChecked:  uint64(d.rebalancer.Checked()),
+					BytesMoved:     uint64(total) * d.BlockSize(),
+					RingVersion:    uint32(d.rebalancedTo),
 				}
-				total += written
 				info.LastRebalanceBlocks = uint64(total)
 				if err == io.EOF {
 					// Good job, sleep well, I'll most likely rebalance you in the morning.
 					info.LastRebalanceFinish = time.Now().UnixNano()
 					total = 0
+					d.finishGCPass(forced, tombs)
 					finishver := d.rebalancer.VersionStart()
 					if finishver == d.ring.Version() {
+						if d.rebalancing {
+							d.recordEvent(torus.AuditEvent{
+								Op:          torus.AuditRebalanceFinish,
+								Source:      d.UUID(),
+								RingVersion: finishver,
+								Details:     map[string]string{"blocks_moved": strconv.FormatUint(info.LastRebalanceBlocks, 10)},
+							})
+						}
 						d.rebalancing = false
+						d.rebalancedTo = finishver
 						info.Rebalancing = false
+						info.RingVersion = uint32(finishver)
 					}
-					d.srv.UpdateRebalanceInfo(info)
+					d.updateRebalanceInfo(info)
 					clog.Tracef("finished rebalance/gc cycle. ring version is %v", d.ring.Version())
 					break ratelimit
 				} else if err != nil {
@@ -92,10 +132,82 @@ exit:
 					clog.Error(err)
 				}
 				n = written
-				d.srv.UpdateRebalanceInfo(info)
+				d.updateRebalanceInfo(info)
 			}
 		}
-		time.Sleep(time.Duration(rand.Intn(3)) * time.Second)
+		select {
+		case <-closer:
+			break exit
+		case <-d.gcCtl.kick:
+			// A requested run starts at once.
+		case <-time.After(time.Duration(rand.Intn(3)) * time.Second):
+		}
 		d.rebalancer.Reset()
 	}
 }
+
+// finishGCPass logs and publishes what the garbage collector did in the pass
+// that just finished, which began with tombs, and then removes the
+// tombstones of the volumes every peer has now reclaimed.
+func (d *Distributor) finishGCPass(forced bool, tombs []torus.VolumeTombstone) {
+	stats := d.rebalancer.GCStats()
+	reclaimed := uint64(d.rebalancer.Reclaimed())
+	if stats.OrphanedINodes != 0 {
+		clog.Infof("found %d blocks of %d orphaned INodes", stats.OrphanedBlocks, stats.OrphanedINodes)
+	}
+	if forced {
+		clog.Infof("gc: requested run finished, %d dead blocks reclaimed", reclaimed)
+	}
+	d.publishGCStatus(torus.GCStatus{
+		LastPass:        time.Now().UTC(),
+		BlocksExamined:  uint64(d.rebalancer.Checked()),
+		BlocksReclaimed: reclaimed,
+		BytesFreed:      reclaimed * d.BlockSize(),
+		BlocksDeferred:  uint64(d.rebalancer.Deferred()),
+		OrphanedINodes:  uint64(stats.OrphanedINodes),
+		Forced:          forced,
+		Tombstones:      d.tombstoneProgress(tombs),
+	})
+	d.removeTombstones(tombs)
+	// Most passes find nothing to do; only those that did something, or were
+	// asked for, are worth the room in the cluster event log.
+	if forced || reclaimed != 0 {
+		d.recordEvent(torus.AuditEvent{
+			Op:     torus.AuditGCPass,
+			Source: d.UUID(),
+			Details: map[string]string{
+				"reclaimed": strconv.FormatUint(reclaimed, 10),
+				"forced":    strconv.FormatBool(forced),
+			},
+		})
+	}
+}
+
+// recordEvent records e in the local audit log and, without waiting on it,
+// in the cluster event log.
+func (d *Distributor) recordEvent(e torus.AuditEvent) {
+	d.srv.Audit.Record(e)
+	torus.RecordClusterEvent(d.srv.MDS, e)
+}
+
+// updateRebalanceInfo publishes this node's rebalance progress, both to the
+// cluster and as metrics.
+func (d *Distributor) updateRebalanceInfo(info *models.RebalanceInfo) {
+	d.srv.UpdateRebalanceInfo(info)
+	p := torus.NewRebalanceProgress(d.UUID(), info, time.Now())
+	promDistRebalanceThroughput.Set(p.Throughput)
+	promDistRebalanceBlocksRemaining.Set(float64(p.BlocksRemaining))
+	promDistRebalanceBytesMoved.Set(float64(p.BytesMoved))
+	promDistRebalanceStart.Set(float64(info.RebalanceStart) / float64(time.Second))
+	promDistRebalanceETA.Set(p.ETA.Seconds())
+	promDistRebalancedRingVersion.Set(float64(info.RingVersion))
+}
+
+func setRebalanceSettingsGauges(rs torus.RebalanceSettings) {
+	paused := 0.0
+	if rs.Paused {
+		paused = 1
+	}
+	promDistRebalancePaused.Set(paused)
+	promDistRebalanceRateLimit.Set(float64(rs.RateLimit))
+}
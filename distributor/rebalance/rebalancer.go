@@ -16,26 +16,60 @@ var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "re
 type Ringer interface {
 	Ring() torus.Ring
 	UUID() string
+	// ReadOnlyPeers returns the peers that take no new blocks.
+	ReadOnlyPeers() torus.PeerList
 }
 
 type Rebalancer interface {
 	Tick() (int, error)
+	// Checked returns the number of local blocks examined since the last
+	// Reset.
+	Checked() int
 	VersionStart() int
 	PrepVolume(*models.Volume) error
+	// GCStats returns what the garbage collector found dead since the
+	// last Reset.
+	GCStats() gc.Stats
+	// Reclaimed and Deferred return the number of dead blocks deleted, and
+	// left for a later pass because the Reaper wasn't collecting, since
+	// the last Reset.
+	Reclaimed() int
+	Deferred() int
+	// DeadByVolume returns the dead blocks of each volume found since the
+	// last Reset.
+	DeadByVolume() map[torus.VolumeID]DeadBlocks
 	Reset() error
 }
 
+// DeadBlocks counts the dead blocks of a volume found by the rebalancer, as
+// those deleted and those left behind, for a later pass or because they
+// failed to delete.
+type DeadBlocks struct {
+	Reclaimed int
+	Left      int
+}
+
 type CheckAndSender interface {
 	Check(ctx context.Context, peer string, refs []torus.BlockRef) ([]bool, error)
 	PutBlock(ctx context.Context, peer string, ref torus.BlockRef, data []byte) error
 }
 
-func NewRebalancer(r Ringer, bs torus.BlockStore, cs CheckAndSender, gc gc.GC) Rebalancer {
+// Reaper deletes the blocks the garbage collector finds dead.
+type Reaper interface {
+	// Collecting reports whether dead blocks may be deleted now. Those
+	// found while they may not are left alone, neither deleted nor sent
+	// to other peers.
+	Collecting() bool
+	DeleteBlock(ctx context.Context, ref torus.BlockRef) error
+}
+
+func NewRebalancer(r Ringer, bs torus.BlockStore, cs CheckAndSender, gc gc.GC, rp Reaper) Rebalancer {
 	return &rebalancer{
 		r:  r,
 		bs: bs,
 		cs: cs,
 		gc: gc,
+		rp: rp,
 	}
 }
 
@@ -45,7 +79,43 @@ type rebalancer struct {
 	cs   CheckAndSender
 	it   torus.BlockIterator
 	gc   gc.GC
+	rp   Reaper
 	ring torus.Ring
+
+	checked   int
+	reclaimed int
+	deferred  int
+	dead      map[torus.VolumeID]DeadBlocks
+}
+
+func (r *rebalancer) Checked() int {
+	return r.checked
+}
+
+func (r *rebalancer) Reclaimed() int {
+	return r.reclaimed
+}
+
+func (r *rebalancer) Deferred() int {
+	return r.deferred
+}
+
+func (r *rebalancer) DeadByVolume() map[torus.VolumeID]DeadBlocks {
+	return r.dead
+}
+
+// countDead counts a dead block of vol as reclaimed or left behind.
+func (r *rebalancer) countDead(vol torus.VolumeID, reclaimed bool) {
+	if r.dead == nil {
+		r.dead = make(map[torus.VolumeID]DeadBlocks)
+	}
+	d := r.dead[vol]
+	if reclaimed {
+		d.Reclaimed++
+	} else {
+		d.Left++
+	}
+	r.dead[vol] = d
 }
 
 func (r *rebalancer) VersionStart() int {
@@ -59,11 +129,19 @@ func (r *rebalancer) PrepVolume(vol *models.Volume) error {
 	return r.gc.PrepVolume(vol)
 }
 
+func (r *rebalancer) GCStats() gc.Stats {
+	return gc.GetStats(r.gc)
+}
+
 func (r *rebalancer) Reset() error {
 	if r.it != nil {
 		r.it.Close()
 		r.it = nil
 	}
+	r.checked = 0
+	r.reclaimed = 0
+	r.deferred = 0
+	r.dead = nil
 	r.gc.Clear()
 	return nil
 }
@@ -26,6 +26,7 @@ func (r *rebalancer) Tick() (int, error) {
 	m := make(map[string][]torus.BlockRef)
 	toDelete := make(map[torus.BlockRef]bool)
 	dead := make(map[torus.BlockRef]bool)
+	collecting := r.rp.Collecting()
 	itDone := false
 
 	for i := 0; i < maxIters; i++ {
@@ -40,8 +41,14 @@ func (r *rebalancer) Tick() (int, error) {
 			break
 		}
 		ref = r.it.BlockRef()
+		r.checked++
 		if r.gc.IsDead(ref) {
-			dead[ref] = true
+			if collecting {
+				dead[ref] = true
+			} else {
+				r.deferred++
+				r.countDead(ref.Volume(), false)
+			}
 			continue
 		}
 		perm, err := r.ring.GetPeers(ref)
@@ -61,6 +68,9 @@ func (r *rebalancer) Tick() (int, error) {
 		}
 	}
 
+	// Blocks aren't sent to read-only peers; the copy held here stays until
+	// they take blocks again.
+	readOnly := r.r.ReadOnlyPeers()
 	n := 0
 	for k, v := range m {
 		ctx, cancel := context.WithTimeout(context.TODO(), rebalanceTimeout)
@@ -77,6 +87,10 @@ func (r *rebalancer) Tick() (int, error) {
 			continue
 		}
 		for i, ok := range oks {
+			if !ok && readOnly.Has(k) {
+				toDelete[v[i]] = false
+				continue
+			}
 			if !ok {
 				data, err := r.bs.GetBlock(context.TODO(), v[i])
 				if err != nil {
@@ -91,6 +105,7 @@ func (r *rebalancer) Tick() (int, error) {
 				}
 				err = r.cs.PutBlock(ctx, k, v[i], data)
 				cancel()
+				torus.ReleaseBlock(r.bs, data)
 				if err != nil {
 					// Continue for now
 					toDelete[v[i]] = false
@@ -117,10 +132,13 @@ func (r *rebalancer) Tick() (int, error) {
 			if torus.BlockLog.LevelAt(capnslog.TRACE) {
 				torus.BlockLog.Tracef("rebalance: deleting dead block %s", k)
 			}
-			err := r.bs.DeleteBlock(context.TODO(), k)
+			err := r.rp.DeleteBlock(context.TODO(), k)
+			r.countDead(k.Volume(), err == nil)
 			if err != nil {
 				clog.Errorf("couldn't delete dead local block %s: %v", k, err)
+				continue
 			}
+			r.reclaimed++
 		}
 	}
 	err := r.bs.Flush()
@@ -0,0 +1,146 @@
+package distributor
+
+import (
+	"errors"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/gc"
+	"golang.org/x/net/context"
+)
+
+// ReconcileProgress reports how far a rejoin reconciliation has got.
+type ReconcileProgress struct {
+	Running bool `json:"running"`
+	// Total is the number of local blocks when the pass started.
+	Total     uint64 `json:"total"`
+	Checked   uint64 `json:"checked"`
+	Discarded uint64 `json:"discarded"`
+	Refetched uint64 `json:"refetched"`
+	Err       string `json:"error,omitempty"`
+}
+
+// Reconcile checks the blocks held by a node that is rejoining the cluster
+// against the metadata. Block refs are never rewritten, so a local block can
+// only be stale in two ways: it is no longer referenced by any volume, in
+// which case it is discarded, or the copy on disk is unreadable, in which
+// case it is fetched again from another replica. The pass gives up once
+// timeout has elapsed.
+func Reconcile(s *torus.Server, timeout time.Duration) error {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return errors.New("distributor: replication is not open")
+	}
+	return d.reconcile(timeout)
+}
+
+// GetReconcileProgress returns the progress of the last reconciliation, and
+// false if replication isn't open on s.
+func GetReconcileProgress(s *torus.Server) (ReconcileProgress, bool) {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return ReconcileProgress{}, false
+	}
+	d.reconcileMut.Lock()
+	defer d.reconcileMut.Unlock()
+	return d.reconcileProgress, true
+}
+
+func (d *Distributor) updateReconcile(f func(p *ReconcileProgress)) {
+	d.reconcileMut.Lock()
+	defer d.reconcileMut.Unlock()
+	f(&d.reconcileProgress)
+}
+
+func (d *Distributor) reconcile(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	d.updateReconcile(func(p *ReconcileProgress) {
+		*p = ReconcileProgress{
+			Running: true,
+			Total:   d.blocks.UsedBlocks(),
+		}
+	})
+	err := d.reconcileBlocks(ctx)
+	d.updateReconcile(func(p *ReconcileProgress) {
+		p.Running = false
+		if err != nil {
+			p.Err = err.Error()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	p, _ := GetReconcileProgress(d.srv)
+	clog.Infof("reconciled %d local blocks: %d discarded, %d refetched", p.Checked, p.Discarded, p.Refetched)
+	return nil
+}
+
+func (d *Distributor) reconcileBlocks(ctx context.Context) error {
+	g := gc.NewGCController(d.srv, torus.NewINodeStore(d))
+	vols, _, err := d.srv.MDS.GetVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range vols {
+		if err := g.PrepVolume(v); err != nil {
+			return err
+		}
+	}
+	it := d.blocks.BlockIterator()
+	defer it.Close()
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ref := it.BlockRef()
+		if g.IsDead(ref) {
+			err := d.blocks.DeleteBlock(ctx, ref)
+			if err != nil {
+				clog.Errorf("couldn't discard unreferenced block %s: %v", ref, err)
+			} else {
+				d.updateReconcile(func(p *ReconcileProgress) { p.Discarded++ })
+			}
+		} else {
+			refetched, err := d.reconcileBlock(ctx, ref)
+			if err != nil {
+				clog.Errorf("couldn't reconcile block %s: %v", ref, err)
+			} else if refetched {
+				d.updateReconcile(func(p *ReconcileProgress) { p.Refetched++ })
+			}
+		}
+		d.updateReconcile(func(p *ReconcileProgress) { p.Checked++ })
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return d.blocks.Flush()
+}
+
+// reconcileBlock replaces the local copy of ref from another replica if it
+// can't be read, and reports whether it did so.
+func (d *Distributor) reconcileBlock(ctx context.Context, ref torus.BlockRef) (bool, error) {
+	if data, err := d.blocks.GetBlock(ctx, ref); err == nil {
+		torus.ReleaseBlock(d.blocks, data)
+		return false, nil
+	}
+	d.mut.RLock()
+	peers, err := d.ring.GetPeers(ref)
+	d.mut.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	for _, p := range peers.Peers {
+		if p == d.UUID() {
+			continue
+		}
+		getctx, cancel := context.WithTimeout(ctx, clientTimeout)
+		data, err := d.client.GetBlock(getctx, p, ref)
+		cancel()
+		if err != nil {
+			continue
+		}
+		return true, d.blocks.WriteBlock(ctx, ref, data)
+	}
+	return false, ErrNoPeersBlock
+}
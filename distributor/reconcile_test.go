@@ -0,0 +1,47 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"golang.org/x/net/context"
+)
+
+func TestReconcile(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	d := srvs[0].Blocks.(*Distributor)
+	data := make([]byte, BlockSize)
+	for i := 0; i < 10; i++ {
+		ref := torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, 2),
+			Index:    torus.IndexID(i + 1),
+		}
+		if err := d.WriteBlock(context.Background(), ref, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	local := d.blocks.UsedBlocks()
+
+	if err := Reconcile(srvs[0], time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := GetReconcileProgress(srvs[0])
+	if !ok {
+		t.Fatal("expected reconcile progress for a distributor")
+	}
+	if p.Running || p.Err != "" {
+		t.Fatalf("expected a finished reconciliation, got %+v", p)
+	}
+	if p.Total != local || p.Checked != local {
+		t.Fatalf("expected %d blocks checked, got %+v", local, p)
+	}
+	if p.Refetched != 0 {
+		t.Fatalf("expected nothing to refetch, got %+v", p)
+	}
+}
@@ -0,0 +1,96 @@
+package distributor
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+const (
+	// repairQueue is how many block repairs may wait to be made; more are
+	// dropped, to be found again by a later read.
+	repairQueue = 64
+	// repairInterval spaces out repairs, so that a failing disk can't turn
+	// every read into a write.
+	repairInterval = 100 * time.Millisecond
+)
+
+type blockRepair struct {
+	ref  torus.BlockRef
+	data []byte
+	peer string
+}
+
+var _ torus.ReplicaRepairer = &Distributor{}
+
+// RepairBlock queues writing data as block ref to each of peers, whose copies
+// were found to be bad.
+func (d *Distributor) RepairBlock(ref torus.BlockRef, data []byte, peers []string) {
+	// Local storage may hand out its own memory.
+	data = append([]byte(nil), data...)
+	for _, p := range peers {
+		select {
+		case d.repairs <- blockRepair{ref: ref, data: data, peer: p}:
+		default:
+			blockLog(ref, p).Debugf("repair queue full, dropping repair of block")
+		}
+	}
+}
+
+func (d *Distributor) repairer(closer chan struct{}) {
+	for {
+		select {
+		case <-closer:
+			return
+		case r := <-d.repairs:
+			d.repair(r)
+		}
+		select {
+		case <-closer:
+			return
+		case <-time.After(repairInterval):
+		}
+	}
+}
+
+func (d *Distributor) repair(r blockRepair) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	var err error
+	if r.peer == d.UUID() {
+		err = d.blocks.WriteBlock(ctx, r.ref, r.data)
+		d.invalidateBlock(r.ref)
+	} else {
+		err = d.client.PutBlock(ctx, r.peer, r.ref, r.data)
+	}
+	if err != nil {
+		promDistBlockRepairFailures.Inc()
+		blockLog(r.ref, r.peer).Warningf("couldn't repair block: %v", err)
+		return
+	}
+	if r.peer == d.UUID() {
+		d.scrubMarks.clear(r.ref)
+	}
+	promDistBlockRepairs.Inc()
+	blockLog(r.ref, r.peer).Infof("repaired block")
+}
+
+// withoutPeers returns peers without the ones in bad, keeping the order of
+// the rest.
+func withoutPeers(peers torus.PeerPermutation, bad torus.PeerList) torus.PeerPermutation {
+	if len(bad) == 0 {
+		return peers
+	}
+	rep := peers.Replication
+	for _, p := range peers.Peers[:peers.Replication] {
+		if bad.Has(p) {
+			rep--
+		}
+	}
+	return torus.PeerPermutation{
+		Replication: rep,
+		Peers:       peers.Peers.AndNot(bad),
+	}
+}
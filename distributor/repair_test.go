@@ -0,0 +1,90 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/blockset"
+)
+
+func TestReadRepair(t *testing.T) {
+	srvs, _ := ringNRep(t, 3, 3)
+	defer closeAll(t, srvs...)
+	d := srvs[0].Blocks.(*Distributor)
+	bs, err := blockset.CreateBlocksetFromSpec(blockset.MustParseBlockLayerSpec("crc,base"), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{0xab}, BlockSize)
+	if err := bs.PutBlock(ctx, torus.NewINodeRef(1, 1), 0, data); err != nil {
+		t.Fatal(err)
+	}
+	ref := bs.GetAllBlockRefs()[0]
+	waitFor(t, func() bool {
+		for _, s := range srvs {
+			ok, _ := s.Blocks.(*Distributor).blocks.HasBlock(ctx, ref)
+			if !ok {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Corrupt the local copy, which is read first.
+	if err := d.blocks.WriteBlock(ctx, ref, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bs.GetBlock(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read back the corrupt copy")
+	}
+	waitFor(t, func() bool {
+		local, err := d.blocks.GetBlock(ctx, ref)
+		return err == nil && bytes.Equal(local, data)
+	})
+}
+
+func TestReadRepairAllBad(t *testing.T) {
+	srvs, _ := ringNRep(t, 2, 2)
+	defer closeAll(t, srvs...)
+	d := srvs[0].Blocks.(*Distributor)
+	bs, err := blockset.CreateBlocksetFromSpec(blockset.MustParseBlockLayerSpec("crc,base"), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := bs.PutBlock(ctx, torus.NewINodeRef(1, 1), 0, bytes.Repeat([]byte{1}, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	ref := bs.GetAllBlockRefs()[0]
+	waitFor(t, func() bool {
+		ok, _ := srvs[1].Blocks.(*Distributor).blocks.HasBlock(ctx, ref)
+		return ok
+	})
+	for _, s := range srvs {
+		if err := s.Blocks.(*Distributor).blocks.WriteBlock(ctx, ref, make([]byte, BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bs.GetBlock(ctx, 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("expected ErrBlockUnavailable, got %v", err)
+	}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
@@ -11,27 +11,33 @@ import (
 	_ "github.com/alternative-storage/torus/distributor/protocols/tdp"
 )
 
-// ListenReplication opens the internal networking port and connects to the cluster
-func ListenReplication(s *torus.Server, addr *url.URL) error {
-	return openReplication(s, addr)
+// ListenReplication opens the internal networking port and connects to the cluster.
+// The server also listens on each of extra, for nodes on several networks,
+// but only addr is advertised to the ring.
+func ListenReplication(s *torus.Server, addr *url.URL, extra ...*url.URL) error {
+	return openReplication(s, append([]*url.URL{addr}, extra...)...)
 }
 
 // OpenReplication connects to the cluster without opening the internal networking.
 func OpenReplication(s *torus.Server) error {
-	return openReplication(s, nil)
+	return openReplication(s)
 }
-func openReplication(s *torus.Server, addr *url.URL) error {
+func openReplication(s *torus.Server, addrs ...*url.URL) error {
 	var err error
 	if s.ReplicationOpen {
 		return torus.ErrExists
 	}
-	dist, err := newDistributor(s, addr)
+	dist, err := newDistributor(s, addrs...)
 	if err != nil {
 		return err
 	}
 	s.Blocks = dist
 	s.INodes = torus.NewINodeStore(dist)
-	err = s.BeginHeartbeat(addr)
+	var advertise *url.URL
+	if len(addrs) > 0 {
+		advertise = addrs[0]
+	}
+	err = s.BeginHeartbeat(advertise)
 	if err != nil {
 		return err
 	}
@@ -4,25 +4,34 @@ import (
 	"github.com/alternative-storage/torus"
 
 	"github.com/coreos/pkg/capnslog"
-	"github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 )
 
+// rpcHandler serves the distributor to other peers. Unlike Distributor.Sync,
+// a sync asked for by another peer only covers the blocks stored here.
+type rpcHandler struct {
+	*Distributor
+}
+
+func (h rpcHandler) Sync(ctx context.Context) error {
+	return torus.SyncBlockStore(ctx, h.blocks)
+}
+
+// ReleaseBlock gives a block read by Block back to local storage once it has
+// been sent.
+func (h rpcHandler) ReleaseBlock(b []byte) {
+	torus.ReleaseBlock(h.blocks, b)
+}
+
 func (d *Distributor) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
-	tracer := opentracing.GlobalTracer()
-	if span := opentracing.SpanFromContext(ctx); span != nil {
-		span := tracer.StartSpan("Reading from storage", opentracing.ChildOf(span.Context()))
-		span.SetTag("INode", ref.INodeRef.String())
-		ctx = opentracing.ContextWithSpan(ctx, span)
-		defer span.Finish()
-	} else {
-		clog.Warningf("failed to create span for Block")
-	}
+	span, ctx := torus.StartChildSpan(ctx, "Reading from storage")
+	torus.SetBlockRefTags(span, ref)
+	defer span.Finish()
 	promDistBlockRPCs.Inc()
 	data, err := d.blocks.GetBlock(ctx, ref)
 	if err != nil {
 		promDistBlockRPCFailures.Inc()
-		clog.Warningf("remote asking for non-existent block: %s", ref)
+		blockLog(ref, "").Warningf("remote asking for non-existent block")
 		return nil, torus.ErrBlockUnavailable
 	}
 	if torus.BlockLog.LevelAt(capnslog.TRACE) {
@@ -31,17 +40,37 @@ func (d *Distributor) Block(ctx context.Context, ref torus.BlockRef) ([]byte, er
 	return data, nil
 }
 
+// BlockRange is the server side of a partial block read; only the requested
+// bytes go back over the wire.
+func (d *Distributor) BlockRange(ctx context.Context, ref torus.BlockRef, offset, length uint64) ([]byte, error) {
+	span, ctx := torus.StartChildSpan(ctx, "Reading range from storage")
+	torus.SetBlockRefTags(span, ref)
+	defer span.Finish()
+	promDistBlockRPCs.Inc()
+	data, err := torus.GetBlockRange(ctx, d.blocks, ref, offset, length)
+	if err != nil {
+		promDistBlockRPCFailures.Inc()
+		if err == torus.ErrInvalid {
+			return nil, err
+		}
+		blockLog(ref, "").Warningf("remote asking for non-existent block")
+		return nil, torus.ErrBlockUnavailable
+	}
+	if torus.BlockLog.LevelAt(capnslog.TRACE) {
+		torus.BlockLog.Tracef("rpc: retrieved block %s [%d:+%d]", ref, offset, length)
+	}
+	return data, nil
+}
+
 // PutBlock server side implementation which is called from RPC client.
 func (d *Distributor) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
-	tracer := opentracing.GlobalTracer()
-	if span := opentracing.SpanFromContext(ctx); span != nil {
-		span := tracer.StartSpan("Writing to storage", opentracing.ChildOf(span.Context()))
-		span.SetTag("INode", ref.INodeRef.String())
-		ctx = opentracing.ContextWithSpan(ctx, span)
-		defer span.Finish()
-	} else {
-		clog.Warningf("failed to create span for PutBlock")
+	span, ctx := torus.StartChildSpan(ctx, "Writing to storage")
+	torus.SetBlockRefTags(span, ref)
+	defer span.Finish()
+	if !d.beginWrite() {
+		return torus.ErrClosed
 	}
+	defer d.inflight.Done()
 	d.mut.RLock()
 	defer d.mut.RUnlock()
 	promDistPutBlockRPCs.Inc()
@@ -60,11 +89,21 @@ func (d *Distributor) PutBlock(ctx context.Context, ref torus.BlockRef, data []b
 		}
 	}
 	if !ok {
-		clog.Warningf("trying to write block that doesn't belong to me.")
+		blockLog(ref, "").Warningf("trying to write block that doesn't belong to me.")
+	}
+	if !d.fences.admit(ref.Volume(), torus.LockGeneration(ctx)) {
+		promDistPutBlockRPCFailures.Inc()
+		return torus.ErrFenced
+	}
+	// Peers that haven't seen our last heartbeat may not know we're full.
+	if torus.BlockStoreReadOnly(d.blocks) {
+		promDistPutBlockRPCFailures.Inc()
+		return torus.ErrOutOfSpace
 	}
 
 	// WriteBlock to my storage file.
 	err = d.blocks.WriteBlock(ctx, ref, data)
+	d.invalidateBlock(ref)
 	if err != nil {
 		return err
 	}
@@ -75,15 +114,9 @@ func (d *Distributor) PutBlock(ctx context.Context, ref torus.BlockRef, data []b
 }
 
 func (d *Distributor) RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error) {
-	tracer := opentracing.GlobalTracer()
-	if span := opentracing.SpanFromContext(ctx); span != nil {
-		span := tracer.StartSpan("Checking rebalnce", opentracing.ChildOf(span.Context()))
-		// TODO set tag
-		ctx = opentracing.ContextWithSpan(ctx, span)
-		defer span.Finish()
-	} else {
-		clog.Warningf("failed to create span for RebalanceCheck")
-	}
+	span, ctx := torus.StartChildSpan(ctx, "Checking rebalance")
+	span.SetTag("blocks", len(refs))
+	defer span.Finish()
 	out := make([]bool, len(refs))
 	for i, x := range refs {
 		ok, err := d.blocks.HasBlock(ctx, x)
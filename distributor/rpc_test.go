@@ -5,12 +5,15 @@ import (
 	"encoding/binary"
 	"fmt"
 	"golang.org/x/net/context"
+	"io/ioutil"
 	"math/rand"
 	"net/url"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols/tdp"
 	"github.com/alternative-storage/torus/metadata/temp"
 	"github.com/alternative-storage/torus/models"
 	"github.com/alternative-storage/torus/ring"
@@ -69,13 +72,18 @@ func TestPutBlock(t *testing.T) {
 }
 
 func createN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
+	return createNScheme(t, n, "http")
+}
+
+// createNScheme is createN with the peers speaking the protocol of scheme.
+func createNScheme(t testing.TB, n int, scheme string) ([]*torus.Server, *temp.Server) {
 	var out []*torus.Server
 	s := temp.NewServer()
 	rand.Seed(time.Now().UnixNano())
 	for i := 0; i < n; i++ {
 		srv := newServer(s)
 		// TODO :0 doesn't work and currently uses workaround.
-		addr := fmt.Sprintf("http://127.0.0.1:%d", 20000+rand.Intn(1000))
+		addr := fmt.Sprintf("%s://127.0.0.1:%d", scheme, 20000+rand.Intn(1000))
 		uri, err := url.Parse(addr)
 		if err != nil {
 			t.Fatal(err)
@@ -92,7 +100,15 @@ func createN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
 }
 
 func ringN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
-	servers, mds := createN(t, n)
+	return ringNRep(t, n, 2)
+}
+
+func ringNRep(t testing.TB, n int, rep int) ([]*torus.Server, *temp.Server) {
+	return ringNRepScheme(t, n, rep, "http")
+}
+
+func ringNRepScheme(t testing.TB, n int, rep int, scheme string) ([]*torus.Server, *temp.Server) {
+	servers, mds := createNScheme(t, n, scheme)
 	var peers torus.PeerInfoList
 	for _, s := range servers {
 		peers = append(peers, &models.PeerInfo{
@@ -101,7 +117,6 @@ func ringN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
 		})
 	}
 
-	rep := 2
 	ringType := ring.Ketama
 	if n == 1 {
 		rep = 1
@@ -125,3 +140,46 @@ func ringN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
 	time.Sleep(10 * time.Millisecond)
 	return servers, mds
 }
+
+// BenchmarkServeBlock reads a block from mfile storage over a reused tdp
+// connection, as peers do in the steady state. Run with -benchmem: the
+// block read from storage goes back to its pool once it has been sent.
+func BenchmarkServeBlock(b *testing.B) {
+	dir, err := ioutil.TempDir("", "torus-serve")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	torus.MkdirsFor(dir)
+	cfg := torus.Config{
+		StorageSize: StorageSize,
+		DataDir:     []string{dir},
+	}
+	blocks, err := torus.CreateBlockStore("mfile", "bench", cfg, torus.GlobalMetadata{BlockSize: BlockSize})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer blocks.Close()
+	ref := benchRef(0)
+	if err := blocks.WriteBlock(context.Background(), ref, bytes.Repeat([]byte{1}, BlockSize)); err != nil {
+		b.Fatal(err)
+	}
+	srv, err := tdp.Serve("127.0.0.1:0", rpcHandler{&Distributor{blocks: blocks}}, BlockSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := tdp.Dial(srv.ListenAddr().String(), time.Second, BlockSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	b.ReportAllocs()
+	b.SetBytes(BlockSize)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := conn.Block(context.Background(), ref); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package distributor
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+const (
+	// scrubSaveInterval is how often a pass checkpoints its position.
+	scrubSaveInterval = 30 * time.Second
+	// scrubPassGap spaces out passes, so that a node with little data
+	// doesn't scrub it over and over.
+	scrubPassGap = time.Minute
+)
+
+var errScrubClosed = errors.New("distributor: scrubber closed")
+
+// scrubMarks holds the local blocks the scrubber found to be bad. Reads skip
+// the local copy of a marked block, and the copy read from a peer in its
+// place is written back over it.
+type scrubMarks struct {
+	mut sync.Mutex
+	bad map[torus.BlockRef]bool
+}
+
+func (m *scrubMarks) mark(ref torus.BlockRef) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.bad == nil {
+		m.bad = make(map[torus.BlockRef]bool)
+	}
+	m.bad[ref] = true
+}
+
+func (m *scrubMarks) clear(ref torus.BlockRef) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	delete(m.bad, ref)
+}
+
+func (m *scrubMarks) has(ref torus.BlockRef) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.bad[ref]
+}
+
+// keep drops the marks of blocks not in refs, which are gone from local
+// storage.
+func (m *scrubMarks) keep(refs []torus.BlockRef) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if len(m.bad) == 0 {
+		return
+	}
+	live := make(map[torus.BlockRef]bool, len(refs))
+	for _, ref := range refs {
+		live[ref] = true
+	}
+	for ref := range m.bad {
+		if !live[ref] {
+			delete(m.bad, ref)
+		}
+	}
+}
+
+// scrubber reads every block in local storage in turn, at rate bytes per
+// second, and checks it against the checksum its volume recorded for it.
+type scrubber struct {
+	d    *Distributor
+	rate uint64
+	// status is checkpointed to the metadata service, if it keeps them.
+	status torus.ScrubStatus
+}
+
+func newScrubber(d *Distributor) *scrubber {
+	return &scrubber{
+		d:      d,
+		rate:   d.srv.Cfg.ScrubRate,
+		status: torus.ScrubStatus{UUID: d.UUID()},
+	}
+}
+
+func (d *Distributor) scrubLoop(closer chan struct{}) {
+	s := newScrubber(d)
+	if st, ok := d.srv.MDS.(torus.ScrubTracker); ok {
+		status, err := st.GetScrubStatus(d.UUID())
+		if err != nil {
+			clog.Errorf("scrub: couldn't load checkpoint, starting over: %v", err)
+		} else {
+			s.status = status
+		}
+	}
+	for {
+		err := s.pass(closer)
+		if err == errScrubClosed {
+			return
+		}
+		if err != nil {
+			clog.Errorf("scrub: pass failed: %v", err)
+		}
+		select {
+		case <-closer:
+			return
+		case <-d.scrubNow:
+		case <-time.After(scrubPassGap):
+		}
+	}
+}
+
+// TriggerScrub starts the next scrub pass of s without waiting out the gap
+// between passes. A pass already under way is left to finish first. It fails
+// if replication isn't open on s, or s doesn't scrub its storage.
+func TriggerScrub(s *torus.Server) error {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return errors.New("distributor: replication isn't open")
+	}
+	if d.scrubNow == nil {
+		return errors.New("distributor: scrubbing is disabled; restart with a scrub rate to enable it")
+	}
+	select {
+	case d.scrubNow <- struct{}{}:
+	default:
+		// A pass is already due.
+	}
+	return nil
+}
+
+// pass scrubs the local blocks in order, starting after the position of an
+// unfinished pass.
+func (s *scrubber) pass(closer chan struct{}) error {
+	st := &s.status
+	if st.PassStart.IsZero() {
+		st.PassStart = time.Now().UTC()
+		st.Position = nil
+		st.Checked = 0
+		st.Errors = 0
+	}
+	sums, err := s.checksums()
+	if err != nil {
+		return err
+	}
+	refs, err := s.localBlocks()
+	if err != nil {
+		return err
+	}
+	s.d.scrubMarks.keep(refs)
+	i := sort.Search(len(refs), func(i int) bool {
+		return bytes.Compare(refs[i].ToBytes(), st.Position) > 0
+	})
+	clog.Infof("scrub: checking %d of %d local blocks", len(refs)-i, len(refs))
+	delay := time.Duration(s.d.BlockSize() * uint64(time.Second) / s.rate)
+	saved := time.Now()
+	for _, ref := range refs[i:] {
+		select {
+		case <-closer:
+			s.save()
+			return errScrubClosed
+		case <-time.After(delay):
+		}
+		if sum, ok := sums[ref]; ok {
+			promDistScrubBlocks.Inc()
+			st.Checked++
+			if !s.check(ref, sum) {
+				st.Errors++
+				st.TotalErrors++
+			}
+		}
+		st.Position = ref.ToBytes()
+		if time.Since(saved) > scrubSaveInterval {
+			s.save()
+			saved = time.Now()
+		}
+	}
+	st.LastFullPass = time.Now().UTC()
+	st.LastPassErrors = st.Errors
+	st.PassStart = time.Time{}
+	st.Position = nil
+	s.save()
+	clog.Infof("scrub: pass done, checked %d blocks and found %d bad", st.Checked, st.Errors)
+	return nil
+}
+
+// check reads the local copy of ref and reports whether it matches sum,
+// marking it bad if it doesn't. A block deleted since the pass began counts
+// as good.
+func (s *scrubber) check(ref torus.BlockRef, sum uint32) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	data, err := s.d.blocks.GetBlock(ctx, ref)
+	if err == torus.ErrBlockNotExist {
+		return true
+	}
+	defer torus.ReleaseBlock(s.d.blocks, data)
+	if err == nil && crc32.ChecksumIEEE(data) == sum {
+		return true
+	}
+	promDistScrubErrors.Inc()
+	if err != nil {
+		clog.Errorf("scrub: couldn't read block %s: %v", ref, err)
+	} else {
+		clog.Errorf("scrub: block %s doesn't match its checksum", ref)
+	}
+	s.d.scrubMarks.mark(ref)
+	return false
+}
+
+// checksums gathers the checksums of the blocks of every volume. Volumes
+// that can't be read are left out, and their blocks aren't checked.
+func (s *scrubber) checksums() (map[torus.BlockRef]uint32, error) {
+	vols, _, err := s.d.srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[torus.BlockRef]uint32)
+	for _, v := range vols {
+		sums, err := torus.BlockChecksums(s.d.srv, v)
+		if err != nil {
+			clog.Warningf("scrub: skipping volume %s: %v", v.Name, err)
+			continue
+		}
+		for ref, sum := range sums {
+			out[ref] = sum
+		}
+	}
+	return out, nil
+}
+
+// localBlocks returns the refs of the blocks in local storage, sorted by
+// their bytes, which is the order passes check them in.
+func (s *scrubber) localBlocks() ([]torus.BlockRef, error) {
+	var refs []torus.BlockRef
+	it := s.d.blocks.BlockIterator()
+	defer it.Close()
+	for it.Next() {
+		refs = append(refs, it.BlockRef())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(refsByBytes(refs))
+	return refs, nil
+}
+
+type refsByBytes []torus.BlockRef
+
+func (r refsByBytes) Len() int      { return len(r) }
+func (r refsByBytes) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r refsByBytes) Less(i, j int) bool {
+	return bytes.Compare(r[i].ToBytes(), r[j].ToBytes()) < 0
+}
+
+func (s *scrubber) save() {
+	s.status.Updated = time.Now().UTC()
+	st, ok := s.d.srv.MDS.(torus.ScrubTracker)
+	if !ok {
+		return
+	}
+	if err := st.SetScrubStatus(s.status); err != nil {
+		clog.Errorf("scrub: couldn't checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/blockset"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+)
+
+const scrubTestVolumeType = "scrub-test"
+
+var scrubTestBlocksets = make(map[string]torus.Blockset)
+
+func init() {
+	torus.RegisterBlockChecksums(scrubTestVolumeType, func(_ *torus.Server, vol *models.Volume) (map[torus.BlockRef]uint32, error) {
+		return blockset.BlockChecksums(scrubTestBlocksets[vol.Name]), nil
+	})
+}
+
+func TestScrub(t *testing.T) {
+	srvs, _ := ringNRep(t, 3, 3)
+	defer closeAll(t, srvs...)
+	d := srvs[0].Blocks.(*Distributor)
+	bs, err := blockset.CreateBlocksetFromSpec(blockset.MustParseBlockLayerSpec("crc,base"), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		data := bytes.Repeat([]byte{byte(i + 1)}, BlockSize)
+		if err := bs.PutBlock(ctx, torus.NewINodeRef(1, 1), i, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs := bs.GetAllBlockRefs()
+	waitFor(t, func() bool {
+		for _, s := range srvs {
+			for _, ref := range refs {
+				if ok, _ := s.Blocks.(*Distributor).blocks.HasBlock(ctx, ref); !ok {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	scrubTestBlocksets["scrubbed"] = bs
+	err = srvs[0].MDS.(*temp.Client).CreateVolume(&models.Volume{
+		Name: "scrubbed",
+		Id:   1,
+		Type: scrubTestVolumeType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := refs[2]
+	if err := d.blocks.WriteBlock(ctx, bad, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	s := newScrubber(d)
+	s.rate = 1 << 40
+	if err := s.pass(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	st, err := d.srv.MDS.(torus.ScrubTracker).GetScrubStatus(d.UUID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastFullPass.IsZero() || st.Checked != 4 || st.LastPassErrors != 1 || st.TotalErrors != 1 {
+		t.Fatalf("expected a finished pass over 4 blocks with 1 error, got %+v", st)
+	}
+	if !d.scrubMarks.has(bad) {
+		t.Fatalf("expected %s to be marked bad", bad)
+	}
+
+	// The next read goes to another replica, and repairs the local copy.
+	got, err := bs.GetBlock(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte{3}, BlockSize)
+	if !bytes.Equal(got, want) {
+		t.Fatal("read back the corrupt copy")
+	}
+	waitFor(t, func() bool {
+		local, err := d.blocks.GetBlock(ctx, bad)
+		return err == nil && bytes.Equal(local, want) && !d.scrubMarks.has(bad)
+	})
+
+	// A pass that was cut short carries on after its position.
+	local, err := s.localBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.status = torus.ScrubStatus{
+		UUID:      d.UUID(),
+		PassStart: time.Now(),
+		Position:  local[1].ToBytes(),
+		Checked:   2,
+	}
+	if err := s.pass(make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if s.status.Checked != 4 || s.status.LastPassErrors != 0 {
+		t.Fatalf("expected the pass to check the last 2 blocks cleanly, got %+v", s.status)
+	}
+}
@@ -0,0 +1,87 @@
+package distributor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alternative-storage/torus"
+)
+
+// CacheStats reports on the block read cache.
+type CacheStats struct {
+	// Size is the number of blocks the cache holds at most.
+	Size      int    `json:"size"`
+	SizeBytes uint64 `json:"size_bytes"`
+	Policy    string `json:"policy"`
+	Blocks    int    `json:"blocks"`
+	// ResidentBytes is the size of the blocks the cache holds.
+	ResidentBytes uint64 `json:"resident_bytes"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+}
+
+// GetCacheStats returns the state of the block read cache, and false if
+// replication isn't open on s or there is no cache.
+func GetCacheStats(s *torus.Server) (CacheStats, bool) {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok || d.readCache == nil {
+		return CacheStats{}, false
+	}
+	st := d.readCache.stats()
+	return CacheStats{
+		Size:          st.size,
+		SizeBytes:     uint64(st.size) * d.BlockSize(),
+		Policy:        st.policy,
+		Blocks:        st.entries,
+		ResidentBytes: st.bytes,
+		Hits:          st.hits,
+		Misses:        st.misses,
+		Evictions:     st.evictions,
+	}, true
+}
+
+// ResizeCache changes the size of the block read cache to size bytes,
+// evicting blocks to fit. A size of zero stops the cache from taking new
+// blocks. It fails if replication isn't open on s, or the cache was
+// disabled when it was.
+func ResizeCache(s *torus.Server, size uint64) error {
+	d, ok := s.Blocks.(*Distributor)
+	if !ok {
+		return errors.New("distributor: replication isn't open")
+	}
+	if d.readCache == nil {
+		return errors.New("distributor: the read cache is disabled; restart with a cache size to enable it")
+	}
+	d.readCache.resize(cacheBlocks(size, d.BlockSize()))
+	return nil
+}
+
+// GetStorageStats returns the operation counts of the local block store, and
+// false if it doesn't count them.
+func GetStorageStats(s *torus.Server) (torus.BlockStoreStats, bool) {
+	blocks := s.Blocks
+	if d, ok := blocks.(*Distributor); ok {
+		blocks = d.blocks
+	}
+	st, ok := blocks.(torus.StatsBlockStore)
+	if !ok {
+		return torus.BlockStoreStats{}, false
+	}
+	return st.Stats(), true
+}
+
+// ResizeStorage resizes the local block store to sizes, one per data
+// directory. It fails if the store can't be resized while it's open, or with
+// a *torus.ShrinkError if it holds more blocks than would fit.
+func ResizeStorage(s *torus.Server, sizes []uint64) error {
+	blocks := s.Blocks
+	if d, ok := blocks.(*Distributor); ok {
+		blocks = d.blocks
+	}
+	rs, ok := blocks.(torus.ResizableBlockStore)
+	if !ok {
+		return fmt.Errorf("distributor: %s storage can't be resized while it's open", blocks.Kind())
+	}
+	return rs.Resize(sizes)
+}
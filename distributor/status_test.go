@@ -0,0 +1,80 @@
+package distributor
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+	"golang.org/x/net/context"
+)
+
+func TestStatusStats(t *testing.T) {
+	mds := temp.NewServer()
+	defer mds.Close()
+	srv := newServer(mds)
+	srv.Cfg.ReadCacheSize = 1024 * BlockSize
+	if err := OpenReplication(srv); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// Let the ring watcher subscribe.
+	time.Sleep(10 * time.Millisecond)
+	r, err := ring.CreateRing(&models.Ring{
+		Type:    uint32(ring.Single),
+		Peers:   torus.PeerInfoList{&models.PeerInfo{UUID: srv.MDS.UUID(), TotalBlocks: StorageSize / BlockSize}},
+		Version: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    1,
+	}
+	data := bytes.Repeat([]byte{1}, BlockSize)
+	if err := srv.Blocks.WriteBlock(context.Background(), ref, data); err != nil {
+		t.Fatal(err)
+	}
+	// The write fills the cache, so the first read hits it.
+	for i := 0; i < 2; i++ {
+		if _, err := srv.Blocks.GetBlock(context.Background(), ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := ref
+	other.Index = 2
+	srv.Blocks.GetBlock(context.Background(), other)
+
+	c, ok := GetCacheStats(srv)
+	if !ok {
+		t.Fatal("expected cache stats")
+	}
+	if c.Size != 1024 || c.SizeBytes != 1024*BlockSize || c.Blocks != 1 || c.Hits != 2 || c.Misses != 1 {
+		t.Fatalf("unexpected cache stats %+v", c)
+	}
+	s, ok := GetStorageStats(srv)
+	if !ok {
+		t.Fatal("expected storage stats")
+	}
+	if s.Writes != 1 || s.Reads != 0 || s.ReadErrors == 0 {
+		t.Fatalf("unexpected storage stats %+v", s)
+	}
+
+	uncached := newServer(mds)
+	if err := OpenReplication(uncached); err != nil {
+		t.Fatal(err)
+	}
+	defer uncached.Close()
+	if _, ok := GetCacheStats(uncached); ok {
+		t.Fatal("expected no cache stats without a cache")
+	}
+}
@@ -2,9 +2,7 @@ package distributor
 
 import (
 	"errors"
-	"runtime"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/alternative-storage/torus"
@@ -15,114 +13,279 @@ import (
 
 var (
 	ErrNoPeersBlock = errors.New("distributor: no peers available for a block")
+	ErrNotReady     = errors.New("distributor: waiting for the ring to reach the minimum number of peers")
 )
 
+// GetBlock returns the block i. It may be shared with the read cache, so the
+// caller must neither modify it nor put it back in a pool.
 func (d *Distributor) GetBlock(ctx context.Context, i torus.BlockRef) ([]byte, error) {
-	span := opentracing.GlobalTracer().StartSpan("Read Block")
-	span.SetTag("INode", i.INodeRef.String())
-	ctx = opentracing.ContextWithSpan(ctx, span)
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Read Block")
+	torus.SetBlockRefTags(span, i)
 	defer span.Finish()
+	ctx, cancel := d.withIOTimeout(ctx)
+	defer cancel()
 
+	start := time.Now()
+	blk, source, err := d.getBlock(ctx, i)
+	err = ioErr(ctx, err)
+	d.volumes.observeRead(i, source, start, len(blk), err)
+	return blk, err
+}
+
+// getBlock returns the block along with where it came from: the cache, local
+// storage or a peer.
+func (d *Distributor) getBlock(ctx context.Context, i torus.BlockRef) ([]byte, string, error) {
 	d.mut.RLock()
 	defer d.mut.RUnlock()
 	promDistBlockRequests.Inc()
-	bcache, ok := d.readCache.Get(string(i.ToBytes()))
-	if ok {
+	ctx = d.withCacheVersion(ctx)
+	rr := torus.ReplicaReadFromContext(ctx)
+	if rr != nil {
+		rr.Ref = i
+		rr.Peer = ""
+	}
+	scrubBad := d.scrubMarks.has(i)
+	if scrubBad && rr != nil && !rr.Bad.Has(d.UUID()) {
+		// Read another copy, which is then written over the local one.
+		rr.Bad = append(rr.Bad, d.UUID())
+	}
+	if scrubBad || (rr != nil && len(rr.Bad) != 0) {
+		// The cache may hold the copy found to be bad.
+		d.readCache.Remove(string(i.ToBytes()))
+	} else if bcache, ok := d.readCache.Get(string(i.ToBytes())); ok {
 		promDistBlockCacheHits.Inc()
-		return bcache.([]byte), nil
+		return bcache.([]byte), readSourceCache, nil
 	}
+	promDistBlockCacheMisses.Inc()
 	peers, err := d.ring.GetPeers(i)
 	if err != nil {
 		promDistBlockFailures.Inc()
-		return nil, err
+		return nil, "", err
+	}
+	if rr != nil {
+		peers = withoutPeers(peers, rr.Bad)
 	}
+	peers = d.client.breakers.preferClosed(peers)
 	if len(peers.Peers) == 0 {
 		promDistBlockFailures.Inc()
-		return nil, ErrNoPeersBlock
+		return nil, "", ErrNoPeersBlock
 	}
 	writeLevel := d.getWriteFromServer()
+	localBad := scrubBad || (rr != nil && rr.Bad.Has(d.UUID()))
 	for _, p := range peers.Peers[:peers.Replication] {
-		if p == d.UUID() || writeLevel == torus.WriteLocal {
+		if (p == d.UUID() || writeLevel == torus.WriteLocal) && !localBad {
 			b, err := d.blocks.GetBlock(ctx, i)
 			if err == nil {
 				promDistBlockLocalHits.Inc()
-				return b, nil
+				d.cacheBlock(ctx, i, b, true)
+				if rr != nil {
+					rr.Peer, rr.Data = d.UUID(), b
+				}
+				return b, readSourceLocal, nil
 			}
 			promDistBlockLocalFailures.Inc()
 			break
 		}
 	}
-	var blk []byte
+	var (
+		blk  []byte
+		peer string
+	)
+	if d.srv.Cfg.HedgeAfter > 0 {
+		blk, peer, err = d.readHedged(ctx, i, peers)
+		if err == nil {
+			if rr != nil {
+				rr.Peer, rr.Data = peer, blk
+			}
+			return blk, d.readSource(peer), nil
+		}
+		// Fall back on the read level's own retries.
+	}
 	readLevel := d.getReadFromServer()
 	switch readLevel {
 	case torus.ReadBlock:
-		blk, err = d.readWithBackoff(ctx, i, peers)
+		blk, peer, err = d.readWithBackoff(ctx, i, peers)
 	case torus.ReadSequential:
-		blk, err = d.readSequential(ctx, i, peers, clientTimeout)
+		blk, peer, err = d.readSequential(ctx, i, peers, clientTimeout)
 	case torus.ReadSpread:
-		blk, err = d.readSpread(ctx, i, peers)
+		blk, peer, err = d.readSpread(ctx, i, peers)
 	default:
 		panic("unhandled read level")
 	}
 	if err != nil {
 		// We completely failed!
 		promDistBlockFailures.Inc()
-		clog.Errorf("no peers for block %s: %v", i, err)
+		blockLog(i, "").Errorf("no peers for block: %v", err)
+		return nil, "", err
+	}
+	if rr != nil {
+		rr.Peer, rr.Data = peer, blk
+	}
+	return blk, d.readSource(peer), nil
+}
+
+// readSource returns where a block read from peer came from.
+func (d *Distributor) readSource(peer string) string {
+	if peer == d.UUID() {
+		return readSourceLocal
+	}
+	return readSourcePeer
+}
+
+// GetBlockRange reads length bytes at offset within a block. A fully cached
+// or local block is sliced in place; otherwise only the requested range is
+// fetched from a peer, and the result is not added to the block cache.
+func (d *Distributor) GetBlockRange(ctx context.Context, i torus.BlockRef, offset, length uint64) ([]byte, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Read Block Range")
+	torus.SetBlockRefTags(span, i)
+	defer span.Finish()
+
+	if offset+length > d.BlockSize() || offset+length < offset {
+		return nil, torus.ErrInvalid
 	}
+	ctx, cancel := d.withIOTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	blk, source, err := d.getBlockRange(ctx, i, offset, length)
+	err = ioErr(ctx, err)
+	d.volumes.observeRead(i, source, start, len(blk), err)
 	return blk, err
 }
 
-func (d *Distributor) readWithBackoff(ctx context.Context, ref torus.BlockRef, peers torus.PeerPermutation) ([]byte, error) {
+func (d *Distributor) getBlockRange(ctx context.Context, i torus.BlockRef, offset, length uint64) ([]byte, string, error) {
+	blk, source, err := d.readRange(ctx, i, offset, length)
+	if err != ErrNoPeersBlock {
+		return blk, source, err
+	}
+	// Nobody could serve the range on the first pass; fall back to the full
+	// block path, which retries according to the read level.
+	blk, source, err = d.getBlock(ctx, i)
+	if err != nil {
+		return nil, "", err
+	}
+	blk, err = sliceRange(blk, offset, length)
+	return blk, source, err
+}
+
+func sliceRange(blk []byte, offset, length uint64) ([]byte, error) {
+	if uint64(len(blk)) < offset+length {
+		return nil, torus.ErrInvalid
+	}
+	return blk[offset : offset+length], nil
+}
+
+func (d *Distributor) readRange(ctx context.Context, i torus.BlockRef, offset, length uint64) ([]byte, string, error) {
+	d.mut.RLock()
+	defer d.mut.RUnlock()
+	promDistBlockRequests.Inc()
+	bcache, ok := d.readCache.Get(string(i.ToBytes()))
+	if ok {
+		promDistBlockCacheHits.Inc()
+		b, err := sliceRange(bcache.([]byte), offset, length)
+		return b, readSourceCache, err
+	}
+	promDistBlockCacheMisses.Inc()
+	peers, err := d.ring.GetPeers(i)
+	if err != nil {
+		promDistBlockFailures.Inc()
+		return nil, "", err
+	}
+	peers = d.client.breakers.preferClosed(peers)
+	for _, p := range peers.Peers {
+		if p != d.UUID() {
+			continue
+		}
+		b, err := torus.GetBlockRange(ctx, d.blocks, i, offset, length)
+		if err == nil {
+			promDistBlockLocalHits.Inc()
+			return b, readSourceLocal, nil
+		}
+		promDistBlockLocalFailures.Inc()
+		break
+	}
+	for _, p := range peers.Peers {
+		if p == d.UUID() {
+			continue
+		}
+		getctx, cancel := context.WithTimeout(ctx, peerTimeout(ctx, clientTimeout))
+		start := time.Now()
+		b, err := d.client.GetBlockRange(getctx, p, i, offset, length)
+		cancel()
+		d.volumes.observe(i, volumeOpFetch, start, len(b), err)
+		if err == nil {
+			promDistBlockPeerHits.WithLabelValues(p).Inc()
+			return b, readSourcePeer, nil
+		}
+		promDistBlockPeerFailures.WithLabelValues(p).Inc()
+		blockLog(i, p).Warningf("block range from peer failed, trying next peer: %s", err)
+	}
+	return nil, "", ErrNoPeersBlock
+}
+
+// readWithBackoff returns the block along with the UUID of the peer that
+// served it, as do readSequential and readSpread.
+func (d *Distributor) readWithBackoff(ctx context.Context, ref torus.BlockRef, peers torus.PeerPermutation) ([]byte, string, error) {
 	for i := uint(0); i < 10; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
 		timeout := clientTimeout * (1 << i)
-		blk, err := d.readSequential(ctx, ref, peers, timeout)
+		blk, peer, err := d.readSequential(ctx, ref, peers, timeout)
 		if err == nil {
-			return blk, err
+			return blk, peer, err
 		}
-		clog.Warningf("failed peers, retry count %d: %v", i, err)
+		blockLog(ref, "").Warningf("failed peers, retry count %d: %v", i, err)
 	}
-	return nil, ErrNoPeersBlock
+	return nil, "", ErrNoPeersBlock
 }
 
-func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation, timeout time.Duration) ([]byte, error) {
+func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation, timeout time.Duration) ([]byte, string, error) {
 	for _, p := range peers.Peers {
 		// If it's local, just try to get it.
 		if p == d.UUID() {
 			b, err := d.blocks.GetBlock(ctx, i)
 			if err == nil {
 				promDistBlockLocalHits.Inc()
-				return b, nil
+				return b, p, nil
 			}
 			promDistBlockLocalFailures.Inc()
-			clog.Debugf("failed local peer (again): %s", err)
+			blockLog(i, p).Debugf("failed local peer (again): %s", err)
 			continue
 		}
 		// Fetch block from remote. First pass through peers
 		// with a timeout, then through the list without.
-		getctx, cancel := context.WithTimeout(ctx, timeout)
+		getctx, cancel := context.WithTimeout(ctx, peerTimeout(ctx, timeout))
 		blk, err := d.readFromPeer(getctx, i, p)
 		cancel()
 
 		if err == nil {
-			return blk, nil
+			return blk, p, nil
 		}
 
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
 		// If this peer didn't have it, continue
 		if err == torus.ErrBlockUnavailable || err == torus.ErrNoPeer {
-			clog.Warningf("block %s from %s failed, trying next peer", i, p)
+			blockLog(i, p).Warningf("block from peer failed, trying next peer")
 			continue
 		}
 
 		// If there was a more significant error, fail hard.
 		promDistBlockFailures.Inc()
-		clog.Errorf("failed remote peer %s: %s", p, err)
-		return nil, err
+		blockLog(i, p).Errorf("failed remote peer: %s", err)
+		return nil, "", err
 	}
-	return nil, ErrNoPeersBlock
+	return nil, "", ErrNoPeersBlock
 }
 
-func (d *Distributor) readSpread(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation) ([]byte, error) {
-	resch := make(chan []byte)
+type peerBlock struct {
+	blk  []byte
+	peer string
+}
+
+func (d *Distributor) readSpread(ctx context.Context, i torus.BlockRef, peers torus.PeerPermutation) ([]byte, string, error) {
+	resch := make(chan peerBlock)
 	errch := make(chan error, peers.Replication)
 	var once sync.Once
 	count := 0
@@ -136,7 +299,7 @@ func (d *Distributor) readSpread(ctx context.Context, i torus.BlockRef, peers to
 			cancel()
 			if err == nil {
 				once.Do(func() {
-					resch <- blk
+					resch <- peerBlock{blk, peer}
 					close(resch)
 				})
 				return
@@ -145,26 +308,82 @@ func (d *Distributor) readSpread(ctx context.Context, i torus.BlockRef, peers to
 		}(p)
 		count++
 	}
+	if count == 0 {
+		return nil, "", ErrNoPeersBlock
+	}
 
 	for {
 		select {
-		case blk := <-resch:
-			return blk, nil
+		case res := <-resch:
+			return res.blk, res.peer, nil
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
 		case err := <-errch:
 			clog.Debugf("failed spread-read %s: %s", i, err)
 			count--
 			if count == 0 {
-				return nil, ErrNoPeersBlock
+				return nil, "", ErrNoPeersBlock
 			}
 		}
 	}
 }
 
+// cacheBlock adds a block to the block cache as the cache policy of its
+// volume allows. Blocks read from local storage are only cached for
+// aggressive volumes, and blocks read ahead of a reader are kept apart from
+// the others. Blocks read under withCacheVersion are left out if the block
+// was written since the read started.
+func (d *Distributor) cacheBlock(ctx context.Context, i torus.BlockRef, data []byte, local bool) {
+	if d.readCache == nil {
+		return
+	}
+	var since *uint64
+	if gen, ok := ctx.Value(cacheVersionKey{}).(uint64); ok {
+		since = &gen
+	}
+	switch d.policies.get(i.Volume()).cache {
+	case torus.CachePolicyNoCache:
+	case torus.CachePolicyAggressive:
+		if local {
+			// Local storage may hand out its own memory, which is
+			// reused once the block is gone.
+			data = append([]byte(nil), data...)
+		}
+		d.readCache.put(string(i.ToBytes()), data, true, since)
+	default:
+		if local {
+			break
+		}
+		if torus.ReadaheadFromContext(ctx) {
+			d.readCache.putAhead(string(i.ToBytes()), data, since)
+		} else {
+			d.readCache.put(string(i.ToBytes()), data, false, since)
+		}
+	}
+}
+
+// cacheVersionKey is the context key of the cache generation a read started
+// at.
+type cacheVersionKey struct{}
+
+// withCacheVersion marks ctx as that of a read starting now, whose blocks
+// aren't cached if they are written while it goes on.
+func (d *Distributor) withCacheVersion(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheVersionKey{}, d.readCache.version())
+}
+
+// invalidateBlock drops a block being written or deleted from the cache.
+func (d *Distributor) invalidateBlock(i torus.BlockRef) {
+	d.readCache.Invalidate(string(i.ToBytes()))
+}
+
 func (d *Distributor) readFromPeer(ctx context.Context, i torus.BlockRef, peer string) ([]byte, error) {
+	start := time.Now()
 	blk, err := d.client.GetBlock(ctx, peer, i)
+	d.volumes.observe(i, volumeOpFetch, start, len(blk), err)
 	// If we're successful, store that.
 	if err == nil {
-		d.readCache.Put(string(i.ToBytes()), blk)
+		d.cacheBlock(ctx, i, blk, false)
 		promDistBlockPeerHits.WithLabelValues(peer).Inc()
 		return blk, nil
 	}
@@ -181,32 +400,65 @@ func (d *Distributor) getReadFromServer() torus.ReadLevel {
 }
 
 func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []byte) error {
-	span := opentracing.GlobalTracer().StartSpan("Write Block")
-	span.SetTag("INode", i.INodeRef.String())
-	ctx = opentracing.ContextWithSpan(ctx, span)
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Write Block")
+	torus.SetBlockRefTags(span, i)
 	defer span.Finish()
+	ctx, cancel := d.withIOTimeout(ctx)
+	defer cancel()
 
+	start := time.Now()
+	err := ioErr(ctx, d.writeBlock(ctx, i, data))
+	d.volumes.observe(i, volumeOpWrite, start, len(data), err)
+	return err
+}
+
+func (d *Distributor) writeBlock(ctx context.Context, i torus.BlockRef, data []byte) error {
 	d.mut.RLock()
 	defer d.mut.RUnlock()
+	if !d.peersReady {
+		return ErrNotReady
+	}
+	if !d.fences.admit(i.Volume(), torus.LockGeneration(ctx)) {
+		return torus.ErrFenced
+	}
 	peers, err := d.ring.GetPeers(i)
 	if err != nil {
 		return err
 	}
+	peers = withoutDraining(d.ring, peers)
 	if len(peers.Peers) == 0 {
 		return ErrNoPeersBlock
 	}
+	peers = withoutReadOnly(peers, d.ReadOnlyPeers())
+	if len(peers.Peers) == 0 {
+		return torus.ErrOutOfSpace
+	}
 	defer func() {
-		if err == nil {
-			d.readCache.Put(string(i.ToBytes()), data)
+		// Whatever the outcome, what was cached is no longer the
+		// block, nor is what reads under way got from peers the write
+		// hadn't reached yet.
+		d.invalidateBlock(i)
+		if err == nil && d.readCache != nil && d.policies.get(i.Volume()).cache != torus.CachePolicyNoCache {
+			// data is the caller's to reuse once the write returns.
+			d.cacheBlock(ctx, i, append([]byte(nil), data...), false)
 		}
 	}()
-	switch d.getWriteFromServer() {
+	level := d.getWriteFromServer()
+	consistency := d.policies.get(i.Volume()).consistency
+	if consistency != "" {
+		// The volume's own choice takes precedence over the server's.
+		level = torus.WriteAll
+	}
+	switch level {
 	case torus.WriteLocal:
-		err = d.blocks.WriteBlock(ctx, i, data)
-		if err == nil {
-			return nil
+		if !torus.BlockStoreReadOnly(d.blocks) {
+			err = d.blocks.WriteBlock(ctx, i, data)
+			if err == nil {
+				d.syncs.wrote(d.UUID())
+				return nil
+			}
+			clog.Debugf("Couldn't write locally; writing to cluster: %s", err)
 		}
-		clog.Debugf("Couldn't write locally; writing to cluster: %s", err)
 		fallthrough
 	case torus.WriteOne:
 		for _, p := range peers.Peers[:peers.Replication] {
@@ -216,6 +468,7 @@ func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []b
 				if err != nil {
 					clog.Noticef("WriteOne error, local: %s", err)
 				} else {
+					d.syncs.wrote(d.UUID())
 					return nil
 				}
 			}
@@ -223,57 +476,210 @@ func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []b
 		for _, p := range peers.Peers {
 			err = d.client.PutBlock(ctx, p, i, data)
 			if err == nil {
+				d.syncs.wrote(p)
 				return nil
 			}
 			clog.Noticef("WriteOne error, remote: %s", err)
 		}
 		return torus.ErrNoPeer
 	case torus.WriteAll:
-		var wg sync.WaitGroup
-		toWrite := int32(peers.Replication)
-		peerChan := make(chan string, len(peers.Peers))
-		for index := 0; int32(index) < toWrite && index < len(peers.Peers) && index < runtime.GOMAXPROCS(0); index++ {
-			wg.Add(1)
-			go d.writer(ctx, i, data, &toWrite, peerChan, &wg)
-		}
+		err = d.writeQuorum(ctx, i, data, peers, consistency)
+		return err
+	}
+	return nil
+}
+
+// withoutDraining drops the peers r is draining from peers, so that they
+// aren't written to, even as spares.
+func withoutDraining(r torus.Ring, peers torus.PeerPermutation) torus.PeerPermutation {
+	rd, ok := r.(torus.RingDrainer)
+	if !ok {
+		return peers
+	}
+	return withoutPeers(peers, rd.Draining())
+}
+
+// withoutReadOnly drops the read-only peers from peers, keeping the
+// replication level, so that the spares after them take their replicas.
+func withoutReadOnly(peers torus.PeerPermutation, readOnly torus.PeerList) torus.PeerPermutation {
+	if len(readOnly) == 0 {
+		return peers
+	}
+	out := peers.Peers.AndNot(readOnly)
+	rep := peers.Replication
+	if rep > len(out) {
+		rep = len(out)
+	}
+	return torus.PeerPermutation{
+		Replication: rep,
+		Peers:       out,
+	}
+}
 
-		// Keep the number of writer threads less than toWrite. If you create the threads
-		// more than target peers, extra peers would store the data.
-		for index := 0; index < len(peers.Peers) && int32(index) < atomic.LoadInt32(&toWrite); index++ {
-			peerChan <- peers.Peers[index]
+// ReadOnlyPeers returns the peers that take no new blocks: the read-only
+// ones, as of their last heartbeat, or right away for this node, and the
+// cordoned ones.
+func (d *Distributor) ReadOnlyPeers() torus.PeerList {
+	out := d.cordons.peers()
+	for uuid, p := range d.srv.GetPeerMap() {
+		if p.ReadOnly && uuid != d.UUID() {
+			out = append(out, uuid)
 		}
-		close(peerChan)
+	}
+	if d.ReadOnly() {
+		out = append(out, d.UUID())
+	}
+	return out
+}
+
+// writeQuorum fans the block out to every replica in the permutation at once
+// and returns as soon as enough of them have acknowledged. Replicas that are
+// still in flight at that point finish in the background. A replica that
+// fails is retried against the spare peers at the tail of the permutation.
+// How many acknowledgements are enough is set by the volume's consistency,
+// or else by the WriteQuorum of the configuration. If too few replicas
+// acknowledge, it returns torus.ErrNoPeer.
+//
+// The replicas write a pooled copy of data, since the caller may reuse data
+// once this returns while stragglers still send it. The copy goes back to the
+// pool once the last of them is done; anything they hand it to, like the
+// handoff queue, keeps a copy of its own.
+func (d *Distributor) writeQuorum(ctx context.Context, i torus.BlockRef, data []byte, peers torus.PeerPermutation, consistency string) error {
+	replicas := peers.Replication
+	if replicas > len(peers.Peers) {
+		replicas = len(peers.Peers)
+	}
+	quorum := d.getWriteQuorum(replicas, consistency)
+
+	spares := make(chan string, len(peers.Peers)-replicas)
+	for _, p := range peers.Peers[replicas:] {
+		spares <- p
+	}
+	close(spares)
+
+	// Stragglers outlive this call, so they must not be cancelled along
+	// with the caller's context. They get the I/O timeout of their own.
+	bgctx, cancel := d.withIOTimeout(context.Background())
+	bgctx = opentracing.ContextWithSpan(bgctx, opentracing.SpanFromContext(ctx))
+	bufs := torus.BlockBufs(d.BlockSize())
+	data = bufs.Copy(data)
+	results := make(chan error, replicas)
+	var wg sync.WaitGroup
+	for _, p := range peers.Peers[:replicas] {
+		wg.Add(1)
+		// Registered here, so that a Sync once this call returns waits
+		// for the stragglers.
+		epoch := d.syncs.begin()
+		go func(peer string) {
+			defer wg.Done()
+			written, err := d.writeReplica(bgctx, i, data, peer, spares)
+			if err != nil && quorum != replicas && d.client.breakers.state(peer) != circuitClosed {
+				// The write can do without this copy; the peer gets
+				// it once it answers again.
+				d.handOff(peer, i, data)
+			}
+			d.syncs.done(epoch, written)
+			results <- err
+		}(p)
+	}
+	go func() {
 		wg.Wait()
-		if toWrite == int32(peers.Replication) {
-			clog.Errorf("error WriteAll to all peers")
-			return torus.ErrNoPeer
+		cancel()
+		bufs.Put(data)
+	}()
+
+	acked := 0
+	for n := 0; n < replicas; n++ {
+		var err error
+		select {
+		case err = <-results:
+		case <-ctx.Done():
+			promDistBlockWriteQuorumFailures.Inc()
+			clog.Errorf("error WriteAll: %d of %d replicas acknowledged %s before timing out", acked, replicas, i)
+			return ctx.Err()
+		}
+		if err == nil {
+			acked++
+			if acked >= quorum {
+				promDistBlockWriteQuorum.Inc()
+				return nil
+			}
+			continue
+		}
+		clog.Noticef("error WriteAll to replica of %s: %s", i, err)
+		if acked+(replicas-n-1) < quorum {
+			break
 		}
 	}
-	return nil
+	promDistBlockWriteQuorumFailures.Inc()
+	clog.Errorf("error WriteAll: %d of %d replicas acknowledged %s, needed %d", acked, replicas, i, quorum)
+	// The block isn't referenced by any INode until the write succeeds, so
+	// the copies peers took are garbage, and collected as the blocks of an
+	// INode that was never committed are, by the rebalancer. Don't leave a
+	// local copy lying around for it to spread in the meantime, though.
+	for _, p := range peers.Peers {
+		if p != d.UUID() {
+			continue
+		}
+		if err := d.blocks.DeleteBlock(context.Background(), i); err != nil && err != torus.ErrBlockNotExist {
+			blockLog(i, "").Debugf("couldn't drop partially replicated block: %s", err)
+		}
+	}
+	return torus.ErrNoPeer
 }
 
-func (d *Distributor) writer(ctx context.Context, i torus.BlockRef, data []byte, toWrite *int32, peerChan chan string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// writeReplica writes one copy of the block to peer, falling back to the next
+// spare peer until one succeeds or the spares run out. It returns the peer
+// that took the copy.
+func (d *Distributor) writeReplica(ctx context.Context, i torus.BlockRef, data []byte, peer string, spares <-chan string) (string, error) {
 	for {
-		p, ok := <-peerChan
-		if !ok {
-			return
-		}
 		var err error
-		if p == d.UUID() {
+		if peer == d.UUID() {
 			err = d.blocks.WriteBlock(ctx, i, data)
 		} else {
-			err = d.client.PutBlock(ctx, p, i, data)
+			err = d.client.PutBlock(ctx, peer, i, data)
 		}
-		if err != nil {
-			clog.Noticef("error WriteAll to peer %s: %s", p, err)
-		} else {
-			atomic.AddInt32(toWrite, -1)
+		if err == nil {
+			return peer, nil
 		}
+		blockLog(i, peer).Noticef("error WriteAll to peer: %s", err)
+		next, ok := <-spares
+		if !ok {
+			return "", err
+		}
+		peer = next
 	}
 }
 
+func (d *Distributor) getWriteQuorum(replicas int, consistency string) int {
+	switch consistency {
+	case torus.ConsistencySync:
+		return replicas
+	case torus.ConsistencyQuorum:
+		return replicas/2 + 1
+	case torus.ConsistencyAsync:
+		return 1
+	}
+	q := d.srv.Cfg.WriteQuorum
+	if q <= 0 || q > replicas {
+		// Zero waits for every replica.
+		return replicas
+	}
+	return q
+}
+
+// WriteBuf returns the local storage a peer's write of i is read into. It
+// turns the write away as PutBlock does: when it is fenced, or when local
+// storage is full.
 func (d *Distributor) WriteBuf(ctx context.Context, i torus.BlockRef) ([]byte, error) {
+	if !d.fences.admit(i.Volume(), torus.LockGeneration(ctx)) {
+		promDistPutBlockRPCFailures.Inc()
+		return nil, torus.ErrFenced
+	}
+	if torus.BlockStoreReadOnly(d.blocks) {
+		promDistPutBlockRPCFailures.Inc()
+		return nil, torus.ErrOutOfSpace
+	}
 	return d.blocks.WriteBuf(ctx, i)
 }
 
@@ -282,7 +688,9 @@ func (d *Distributor) HasBlock(ctx context.Context, i torus.BlockRef) (bool, err
 }
 
 func (d *Distributor) DeleteBlock(ctx context.Context, i torus.BlockRef) error {
-	return d.blocks.DeleteBlock(ctx, i)
+	err := d.blocks.DeleteBlock(ctx, i)
+	d.invalidateBlock(i)
+	return err
 }
 
 func (d *Distributor) NumBlocks() uint64 {
@@ -301,6 +709,17 @@ func (d *Distributor) BlockIterator() torus.BlockIterator {
 	return d.blocks.BlockIterator()
 }
 
+// ReadOnly reports whether local storage is too full to take new blocks.
+func (d *Distributor) ReadOnly() bool {
+	return torus.BlockStoreReadOnly(d.blocks)
+}
+
+// OpenCircuits returns the peers whose circuit is open, which requests
+// aren't being sent to.
+func (d *Distributor) OpenCircuits() []string {
+	return d.client.breakers.open()
+}
+
 func (d *Distributor) Flush() error {
 	return d.blocks.Flush()
 }
@@ -6,6 +6,7 @@ import (
 	"golang.org/x/net/context"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/alternative-storage/torus"
 )
@@ -57,3 +58,291 @@ func TestWriteBlock(t *testing.T) {
 		t.Fatalf("read operation didn't return expected data for block ref %q\nexpected first 8 bytes: %v\nactual first 8 bytes: %v", data, ret[:8], data[:8])
 	}
 }
+
+func TestGetBlockRange(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	addr := &url.URL{
+		Scheme: "http",
+		Host:   "127.0.0.1:0",
+	}
+	dist, err := newDistributor(srvs[0], addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+
+	data := make([]byte, BlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    3,
+	}
+	err = dist.WriteBlock(context.Background(), ref, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := dist.GetBlockRange(context.Background(), ref, 100, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret, data[100:164]) {
+		t.Fatal("range read didn't return expected data")
+	}
+
+	_, err = dist.GetBlockRange(context.Background(), ref, BlockSize-1, 2)
+	if err != torus.ErrInvalid {
+		t.Fatalf("expected ErrInvalid for out of bounds range, got %v", err)
+	}
+}
+
+func TestWriteSkipsDraining(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	drained := srvs[2].MDS.UUID()
+	if _, err := torus.DrainPeer(srvs[0].MDS, drained, true); err != nil {
+		t.Fatal(err)
+	}
+	addr := &url.URL{
+		Scheme: "http",
+		Host:   "127.0.0.1:0",
+	}
+	dist, err := newDistributor(srvs[0], addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+
+	for i := 0; i < 32; i++ {
+		ref := torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, 2),
+			Index:    torus.IndexID(i),
+		}
+		peers, err := dist.ring.GetPeers(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peers.Peers[:peers.Replication].Has(drained) {
+			t.Fatalf("draining peer %s is a replica of %s", drained, ref)
+		}
+		if withoutDraining(dist.ring, peers).Peers.Has(drained) {
+			t.Fatalf("draining peer %s is a spare for %s", drained, ref)
+		}
+		if err := dist.WriteBlock(context.Background(), ref, make([]byte, BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srvs[2].Blocks.UsedBlocks(); n != 0 {
+		t.Fatalf("expected no blocks written to the draining peer, got %d", n)
+	}
+}
+
+func TestIOTimeout(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	srvs[0].Cfg.IOTimeout = time.Nanosecond
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    4,
+	}
+	for _, rl := range []torus.ReadLevel{torus.ReadBlock, torus.ReadSequential, torus.ReadSpread} {
+		srvs[0].Cfg.ReadLevel = rl
+		_, err = dist.GetBlock(context.Background(), ref)
+		if err != ErrIOTimeout {
+			t.Fatalf("read level %d: expected ErrIOTimeout, got %v", rl, err)
+		}
+	}
+	err = dist.WriteBlock(context.Background(), ref, make([]byte, BlockSize))
+	if err != ErrIOTimeout {
+		t.Fatalf("expected ErrIOTimeout writing, got %v", err)
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	if d := peerTimeout(context.Background(), clientTimeout); d != clientTimeout {
+		t.Fatalf("expected %s without a deadline, got %s", clientTimeout, d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if d := peerTimeout(ctx, clientTimeout); d > 100*time.Millisecond {
+		t.Fatalf("expected at most half the time left, got %s", d)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if d := peerTimeout(ctx, clientTimeout); d != clientTimeout {
+		t.Fatalf("expected %s with a distant deadline, got %s", clientTimeout, d)
+	}
+}
+
+func benchDistributor(b *testing.B, quorum int) (*Distributor, func()) {
+	srvs, _ := ringNRep(b, 3, 3)
+	srvs[0].Cfg.WriteLevel = torus.WriteAll
+	srvs[0].Cfg.WriteQuorum = quorum
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dist, func() {
+		dist.Close()
+		for _, s := range srvs {
+			s.Close()
+		}
+	}
+}
+
+func benchRef(n int) torus.BlockRef {
+	return torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 1),
+		Index:    torus.IndexID(n + 1),
+	}
+}
+
+// BenchmarkWriteBlockSequential writes each replica one after the other, as
+// the write path used to, for comparison with BenchmarkWriteBlockParallel.
+func BenchmarkWriteBlockSequential(b *testing.B) {
+	dist, done := benchDistributor(b, 0)
+	defer done()
+	data := make([]byte, BlockSize)
+	ctx := context.Background()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ref := benchRef(n)
+		peers, err := dist.ring.GetPeers(ref)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, p := range peers.Peers[:peers.Replication] {
+			if p == dist.UUID() {
+				err = dist.blocks.WriteBlock(ctx, ref, data)
+			} else {
+				err = dist.client.PutBlock(ctx, p, ref, data)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWriteBlockParallel(b *testing.B) {
+	dist, done := benchDistributor(b, 0)
+	defer done()
+	data := make([]byte, BlockSize)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := dist.WriteBlock(context.Background(), benchRef(n), data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteBlockQuorum is the steady-state write path. Run with
+// -benchmem: the copy the replicas write goes back to its pool once the last
+// of them is done.
+func BenchmarkWriteBlockQuorum(b *testing.B) {
+	dist, done := benchDistributor(b, 2)
+	defer done()
+	data := make([]byte, BlockSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := dist.WriteBlock(context.Background(), benchRef(n), data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// readOnlyStore is a block store that reports itself too full to take new
+// blocks, while still storing them.
+type readOnlyStore struct {
+	torus.BlockStore
+}
+
+func (readOnlyStore) ReadOnly() bool { return true }
+
+func TestWriteSkipsReadOnly(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer closeAll(t, srvs...)
+	full := srvs[2].Blocks.(*Distributor)
+	full.mut.Lock()
+	full.blocks = readOnlyStore{full.blocks}
+	full.mut.Unlock()
+
+	for _, s := range srvs[:2] {
+		d := s.Blocks.(*Distributor)
+		for i := 0; i < 16; i++ {
+			ref := torus.BlockRef{
+				INodeRef: torus.NewINodeRef(1, 2),
+				Index:    torus.IndexID(i),
+			}
+			if err := d.WriteBlock(context.Background(), ref, make([]byte, BlockSize)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := full.blocks.UsedBlocks(); n != 0 {
+		t.Fatalf("expected no blocks written to the read-only peer, got %d", n)
+	}
+	for _, s := range srvs[:2] {
+		if n := s.Blocks.(*Distributor).blocks.UsedBlocks(); n != 16 {
+			t.Fatalf("expected the other peers to take every replica, got %d blocks", n)
+		}
+	}
+}
+
+func TestReadSource(t *testing.T) {
+	srvs, _ := ringN(t, 3)
+	defer func() {
+		for _, s := range srvs {
+			s.Close()
+		}
+	}()
+	srvs[0].Cfg.WriteLevel = torus.WriteLocal
+	srvs[0].Cfg.ReadCacheSize = 100 * BlockSize
+	dist, err := newDistributor(srvs[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dist.Close()
+
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    1,
+	}
+	data := make([]byte, BlockSize)
+	if err := dist.WriteBlock(context.Background(), ref, data); err != nil {
+		t.Fatal(err)
+	}
+	// Writing caches the block.
+	if _, source, err := dist.getBlock(context.Background(), ref); err != nil || source != readSourceCache {
+		t.Fatalf("expected a cached read, got %q (%v)", source, err)
+	}
+	if _, source, err := dist.getBlockRange(context.Background(), ref, 0, 8); err != nil || source != readSourceCache {
+		t.Fatalf("expected a cached range read, got %q (%v)", source, err)
+	}
+	dist.readCache.Remove(string(ref.ToBytes()))
+	if _, source, err := dist.getBlock(context.Background(), ref); err != nil || source != readSourceLocal {
+		t.Fatalf("expected a local read, got %q (%v)", source, err)
+	}
+}
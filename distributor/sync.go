@@ -0,0 +1,156 @@
+package distributor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/protocols"
+)
+
+// syncClientTimeout bounds how long a peer may take to make its blocks
+// durable.
+const syncClientTimeout = 10 * time.Second
+
+var errSyncUnsupported = errors.New("distributor: peer connection doesn't support sync")
+
+// syncTracker remembers which peers were written to since the last sync, and
+// which writes are still in flight, so that a sync covers every block
+// written before it.
+type syncTracker struct {
+	mut  sync.Mutex
+	cond *sync.Cond
+	// epoch advances with each sync; inflight counts the writes begun in
+	// each epoch that haven't finished yet.
+	epoch    uint64
+	inflight map[uint64]int
+	dirty    map[string]bool
+}
+
+func newSyncTracker() *syncTracker {
+	t := &syncTracker{
+		inflight: make(map[uint64]int),
+		dirty:    make(map[string]bool),
+	}
+	t.cond = sync.NewCond(&t.mut)
+	return t
+}
+
+// begin registers a write. It must be matched by a call to done with the
+// epoch it returns.
+func (t *syncTracker) begin() uint64 {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.inflight[t.epoch]++
+	return t.epoch
+}
+
+// done finishes a write begun in epoch, and marks peer as needing a sync if
+// the write reached it. peer is empty if it reached no one.
+func (t *syncTracker) done(epoch uint64, peer string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if peer != "" {
+		t.dirty[peer] = true
+	}
+	if t.inflight[epoch]--; t.inflight[epoch] == 0 {
+		delete(t.inflight, epoch)
+		t.cond.Broadcast()
+	}
+}
+
+// wrote marks peer as needing a sync.
+func (t *syncTracker) wrote(peer string) {
+	t.done(t.begin(), peer)
+}
+
+// take waits for the writes begun so far to finish, and returns the peers
+// they reached, forgetting them.
+func (t *syncTracker) take() []string {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	epoch := t.epoch
+	t.epoch++
+	for t.pendingBefore(epoch) {
+		t.cond.Wait()
+	}
+	var peers []string
+	for p := range t.dirty {
+		peers = append(peers, p)
+	}
+	t.dirty = make(map[string]bool)
+	return peers
+}
+
+func (t *syncTracker) pendingBefore(epoch uint64) bool {
+	for e := range t.inflight {
+		if e <= epoch {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync makes every block written through this distributor durable on each of
+// the peers that acknowledged it, including this one, and fails if any of
+// them can't confirm it. Replica writes still in flight are waited for first.
+//
+// A peer that fails to sync isn't asked again by the next Sync; the blocks
+// written before a failed Sync should be written again.
+func (d *Distributor) Sync(ctx context.Context) error {
+	peers := d.syncs.take()
+	if len(peers) == 0 {
+		return nil
+	}
+	errs := make(chan error, len(peers))
+	for _, p := range peers {
+		go func(peer string) {
+			if peer == d.UUID() {
+				errs <- torus.SyncBlockStore(ctx, d.blocks)
+				return
+			}
+			syncctx, cancel := context.WithTimeout(ctx, syncClientTimeout)
+			defer cancel()
+			err := d.client.Sync(syncctx, peer)
+			if err != nil {
+				err = fmt.Errorf("distributor: couldn't sync peer %s: %v", peer, err)
+			}
+			errs <- err
+		}(p)
+	}
+	var failed error
+	for range peers {
+		if err := <-errs; err != nil {
+			promDistSyncFailures.Inc()
+			clog.Error(err)
+			failed = err
+		}
+	}
+	promDistSyncs.Inc()
+	return failed
+}
+
+// Sync asks a peer to make the blocks it stored durable.
+func (d *distClient) Sync(ctx context.Context, uuid string) error {
+	conn, err := d.acquire(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	defer d.putConn(uuid, conn)
+	s, ok := conn.(protocols.SyncRPC)
+	if !ok {
+		// Nothing was asked of the peer.
+		d.breakers.record(uuid, context.Canceled)
+		return errSyncUnsupported
+	}
+	err = s.Sync(ctx)
+	d.breakers.record(uuid, err)
+	if err != nil {
+		d.resetConn(uuid, conn)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package distributor
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestSyncFailsWithPeerDown(t *testing.T) {
+	srvs, _ := ringNRep(t, 3, 3)
+	defer closeAll(t, srvs[:2]...)
+	d := srvs[0].Blocks.(*Distributor)
+	ctx := context.Background()
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 2),
+		Index:    1,
+	}
+	if err := d.WriteBlock(ctx, ref, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every replica acknowledges the write, but one is gone before it
+	// confirms the sync.
+	ref.Index = 2
+	if err := d.WriteBlock(ctx, ref, make([]byte, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := srvs[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ctx); err == nil {
+		t.Fatal("sync succeeded with a replica down")
+	}
+}
+
+func TestSyncTrackerWaitsForWrites(t *testing.T) {
+	st := newSyncTracker()
+	epoch := st.begin()
+	st.wrote("a")
+	taken := make(chan []string)
+	go func() {
+		taken <- st.take()
+	}()
+	waitFor(t, func() bool {
+		st.mut.Lock()
+		defer st.mut.Unlock()
+		return st.epoch != epoch
+	})
+	select {
+	case <-taken:
+		t.Fatal("take returned with a write in flight")
+	default:
+	}
+	// Writes begun after the sync started don't hold it up.
+	later := st.begin()
+	st.done(epoch, "b")
+	peers := <-taken
+	if len(peers) != 2 {
+		t.Fatalf("expected peers a and b, got %v", peers)
+	}
+	st.done(later, "c")
+	if peers := st.take(); len(peers) != 1 || peers[0] != "c" {
+		t.Fatalf("expected peer c, got %v", peers)
+	}
+}
@@ -0,0 +1,117 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/distributor/rebalance"
+)
+
+// rebalanceRefresh is how long the rebalance settings are cached before they
+// are fetched again, and so how long a pause or a new rate limit takes to
+// reach a running node.
+const rebalanceRefresh = 5 * time.Second
+
+// pausePoll is how often a paused rebalancer looks to see if it was resumed.
+const pausePoll = time.Second
+
+// rebalanceControl caches the cluster-wide rebalance settings.
+type rebalanceControl struct {
+	mds torus.MetadataService
+
+	mut       sync.Mutex
+	settings  torus.RebalanceSettings
+	lastFetch time.Time
+}
+
+func newRebalanceControl(mds torus.MetadataService) *rebalanceControl {
+	return &rebalanceControl{mds: mds}
+}
+
+// get returns the current settings. If the MetadataService doesn't store
+// them, rebalancing is unthrottled; if they can't be fetched, the last known
+// settings stay in use.
+func (r *rebalanceControl) get() torus.RebalanceSettings {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if time.Since(r.lastFetch) >= rebalanceRefresh {
+		r.refresh()
+	}
+	return r.settings
+}
+
+func (r *rebalanceControl) refresh() {
+	r.lastFetch = time.Now()
+	rc, ok := r.mds.(torus.RebalanceController)
+	if !ok {
+		return
+	}
+	rs, err := rc.GetRebalanceSettings()
+	if err != nil {
+		clog.Debugf("couldn't get rebalance settings: %v", err)
+		return
+	}
+	r.settings = rs
+}
+
+// tokenBucket paces a stream of bytes to a rate that may change over time.
+// It holds at most a second's worth of tokens, so an idle stream can't save
+// up for a burst.
+type tokenBucket struct {
+	mut    sync.Mutex
+	rate   uint64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes' worth of tokens at the given rate and returns how
+// long the caller must wait before sending them. A rate of zero is
+// unlimited.
+func (b *tokenBucket) reserve(n int, rate uint64, now time.Time) time.Duration {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if rate == 0 {
+		b.rate = 0
+		return 0
+	}
+	if rate != b.rate || b.last.IsZero() {
+		b.rate = rate
+		b.tokens = float64(rate)
+		b.last = now
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// throttledSender limits the rate at which the rebalancer sends blocks to
+// other peers.
+type throttledSender struct {
+	rebalance.CheckAndSender
+	ctl    *rebalanceControl
+	bucket tokenBucket
+}
+
+func (t *throttledSender) PutBlock(ctx context.Context, peer string, ref torus.BlockRef, data []byte) error {
+	wait := t.bucket.reserve(len(data), t.ctl.get().RateLimit, time.Now())
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return t.CheckAndSender.PutBlock(ctx, peer, ref, data)
+}
@@ -0,0 +1,56 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Unix(0, 0)
+	if d := b.reserve(1000, 0, now); d != 0 {
+		t.Fatalf("expected no wait when unlimited, got %v", d)
+	}
+	// A full second's worth goes out at once, then the rest is paced.
+	if d := b.reserve(1000, 1000, now); d != 0 {
+		t.Fatalf("expected the first second to be free, got %v", d)
+	}
+	if d := b.reserve(500, 1000, now); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v", d)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if d := b.reserve(500, 1000, now); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v", d)
+	}
+	// Idling doesn't save up more than a second's worth.
+	now = now.Add(time.Hour)
+	if d := b.reserve(2000, 1000, now); d != time.Second {
+		t.Fatalf("expected to wait 1s after idling, got %v", d)
+	}
+	// Changing the rate starts over.
+	if d := b.reserve(4000, 4000, now); d != 0 {
+		t.Fatalf("expected no wait at a new rate, got %v", d)
+	}
+}
+
+func TestRebalanceControl(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	ctl := newRebalanceControl(mds)
+	if rs := ctl.get(); rs != (torus.RebalanceSettings{}) {
+		t.Fatalf("expected unset settings, got %+v", rs)
+	}
+	want := torus.RebalanceSettings{RateLimit: 1 << 20, Paused: true}
+	if err := mds.SetRebalanceSettings(want); err != nil {
+		t.Fatal(err)
+	}
+	if rs := ctl.get(); rs != (torus.RebalanceSettings{}) {
+		t.Fatalf("expected cached settings until the refresh, got %+v", rs)
+	}
+	ctl.lastFetch = time.Time{}
+	if rs := ctl.get(); rs != want {
+		t.Fatalf("expected %+v, got %+v", want, rs)
+	}
+}
@@ -0,0 +1,180 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+const (
+	volumeOpRead  = "read"
+	volumeOpWrite = "write"
+	// volumeOpFetch is a single request for a block, or part of one, made
+	// to another peer on behalf of a read.
+	volumeOpFetch = "fetch"
+
+	// Where a read block came from.
+	readSourceCache = "cache"
+	readSourceLocal = "local"
+	readSourcePeer  = "peer"
+
+	// otherVolumeLabel collects every volume past the tracking cap, as well
+	// as volumes whose name isn't known to the metadata service.
+	otherVolumeLabel = "other"
+
+	// volumeNameRefresh is how often the volume list is fetched again, and
+	// so how long a new volume may be labeled as other, and the series of a
+	// deleted one kept.
+	volumeNameRefresh = 30 * time.Second
+)
+
+// volumeMetrics labels per-volume counters with the volume name. At most max
+// volumes get their own label, on a first-come basis, to keep the number of
+// exported series bounded; the series of a deleted volume are dropped, and
+// its label goes to the next volume to get one. Volume names are fetched in
+// the background, one request at a time, and volumes are labeled as other
+// until theirs is known.
+type volumeMetrics struct {
+	mds torus.MetadataService
+	max int
+
+	mut     sync.Mutex
+	names   map[torus.VolumeID]string
+	labels  map[torus.VolumeID]string
+	tracked int
+	// lastFetch is when the last fetch of the volume list finished.
+	lastFetch time.Time
+	fetching  bool
+}
+
+func newVolumeMetrics(mds torus.MetadataService, max int) *volumeMetrics {
+	return &volumeMetrics{
+		mds:    mds,
+		max:    max,
+		names:  make(map[torus.VolumeID]string),
+		labels: make(map[torus.VolumeID]string),
+	}
+}
+
+// observe records an op of n bytes on a block of ref's volume that began at
+// start.
+func (v *volumeMetrics) observe(ref torus.BlockRef, op string, start time.Time, n int, err error) {
+	l := v.label(ref.Volume())
+	promDistVolumeOps.WithLabelValues(l, op).Inc()
+	promDistVolumeOpDuration.WithLabelValues(l, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		promDistVolumeErrors.WithLabelValues(l, op, volumeErrorReason(err)).Inc()
+		return
+	}
+	promDistVolumeBytes.WithLabelValues(l, op).Add(float64(n))
+}
+
+// observeRead records a read like observe, and, if it succeeded, where the
+// block came from.
+func (v *volumeMetrics) observeRead(ref torus.BlockRef, source string, start time.Time, n int, err error) {
+	v.observe(ref, volumeOpRead, start, n, err)
+	if err == nil {
+		promDistVolumeReadDuration.WithLabelValues(v.label(ref.Volume()), source).Observe(time.Since(start).Seconds())
+	}
+}
+
+// volumeErrorReasons are the reasons volumeErrorReason returns.
+var volumeErrorReasons = []string{
+	"timeout", "unavailable", "not_ready", "not_exist", "out_of_space",
+	"read_only", "fenced", "closed", "other",
+}
+
+func volumeErrorReason(err error) string {
+	switch err {
+	case ErrIOTimeout:
+		return "timeout"
+	case ErrNoPeersBlock:
+		return "unavailable"
+	case ErrNotReady:
+		return "not_ready"
+	}
+	return torus.ErrorReason(err)
+}
+
+func (v *volumeMetrics) label(vid torus.VolumeID) string {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	if !v.fetching && time.Since(v.lastFetch) >= volumeNameRefresh {
+		v.fetching = true
+		go v.refresh()
+	}
+	if l, ok := v.labels[vid]; ok {
+		return l
+	}
+	name, ok := v.names[vid]
+	if !ok {
+		return otherVolumeLabel
+	}
+	l := otherVolumeLabel
+	if v.tracked < v.max {
+		l = name
+		v.tracked++
+	}
+	v.labels[vid] = l
+	return l
+}
+
+// refresh fetches the volume list, and forgets the volumes that are no longer
+// in it.
+func (v *volumeMetrics) refresh() {
+	vols, _, err := v.mds.GetVolumes()
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	v.lastFetch = time.Now()
+	v.fetching = false
+	if err != nil {
+		clog.Debugf("couldn't list volumes for metrics: %v", err)
+		return
+	}
+	names := make(map[torus.VolumeID]string)
+	for _, x := range vols {
+		names[torus.VolumeID(x.Id)] = x.Name
+	}
+	v.names = names
+	for vid, l := range v.labels {
+		if _, ok := names[vid]; ok {
+			continue
+		}
+		delete(v.labels, vid)
+		if l == otherVolumeLabel {
+			continue
+		}
+		v.tracked--
+		if !v.labeled(l) {
+			// A volume of the same name created since may have the
+			// label too.
+			deleteVolumeSeries(l)
+		}
+	}
+}
+
+// labeled reports whether a volume is labeled l. v.mut must be held.
+func (v *volumeMetrics) labeled(l string) bool {
+	for _, x := range v.labels {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteVolumeSeries drops the series labeled with volume l.
+func deleteVolumeSeries(l string) {
+	for _, op := range []string{volumeOpRead, volumeOpWrite, volumeOpFetch} {
+		promDistVolumeOps.DeleteLabelValues(l, op)
+		promDistVolumeBytes.DeleteLabelValues(l, op)
+		promDistVolumeOpDuration.DeleteLabelValues(l, op)
+		for _, reason := range volumeErrorReasons {
+			promDistVolumeErrors.DeleteLabelValues(l, op, reason)
+		}
+	}
+	for _, source := range []string{readSourceCache, readSourceLocal, readSourcePeer} {
+		promDistVolumeReadDuration.DeleteLabelValues(l, source)
+	}
+}
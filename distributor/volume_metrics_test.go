@@ -0,0 +1,75 @@
+package distributor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+)
+
+func TestVolumeMetricsLabel(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	for i, name := range []string{"a", "b"} {
+		err := mds.CreateVolume(&models.Volume{
+			Name: name,
+			Id:   uint64(i + 1),
+			Type: "block",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := newVolumeMetrics(mds, 1)
+	// Volumes are labeled as other until their names have been fetched.
+	if l := v.label(1); l != otherVolumeLabel {
+		t.Fatalf("expected volume of unknown name to be %s, got %s", otherVolumeLabel, l)
+	}
+	waitFor(t, func() bool { return v.label(1) == "a" })
+	if l := v.label(2); l != otherVolumeLabel {
+		t.Fatalf("expected volume past the cap to be %s, got %s", otherVolumeLabel, l)
+	}
+	if l := v.label(1); l != "a" {
+		t.Fatalf("expected label a to stick, got %s", l)
+	}
+	if l := v.label(3); l != otherVolumeLabel {
+		t.Fatalf("expected unknown volume to be %s, got %s", otherVolumeLabel, l)
+	}
+
+	// A deleted volume's series go, and its label to the next volume.
+	promDistVolumeOps.WithLabelValues("a", volumeOpRead).Inc()
+	if err := mds.DeleteVolume("a"); err != nil {
+		t.Fatal(err)
+	}
+	err := mds.CreateVolume(&models.Volume{Name: "c", Id: 3, Type: "block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.mut.Lock()
+	v.lastFetch = time.Now().Add(-volumeNameRefresh)
+	v.mut.Unlock()
+	waitFor(t, func() bool { return v.label(3) == "c" })
+	if promDistVolumeOps.DeleteLabelValues("a", volumeOpRead) {
+		t.Fatal("expected the series of the deleted volume to be gone")
+	}
+}
+
+func TestVolumeErrorReason(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{ErrIOTimeout, "timeout"},
+		{ErrNoPeersBlock, "unavailable"},
+		{ErrNotReady, "not_ready"},
+		{torus.ErrBlockNotExist, "not_exist"},
+		{torus.ErrOutOfSpace, "out_of_space"},
+		{errors.New("disk on fire"), "other"},
+	} {
+		if got := volumeErrorReason(tt.err); got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.want, got)
+		}
+	}
+}
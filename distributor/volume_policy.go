@@ -0,0 +1,87 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+// policyRefresh is how long the policies of the volumes are cached before
+// the volume list is fetched again, and so how long a change takes to reach
+// the read and write paths.
+const policyRefresh = 10 * time.Second
+
+// volumePolicy is what a volume chose for how its blocks are handled.
+type volumePolicy struct {
+	consistency string
+	cache       string
+}
+
+// volumePolicies caches the policy of each volume. The volume list is
+// fetched again in the background once the cache is older than
+// policyRefresh, by one request at a time, while the last known policies
+// stay in use. Only the first fetch is waited for.
+type volumePolicies struct {
+	mds torus.MetadataService
+
+	mut      sync.Mutex
+	policies map[torus.VolumeID]volumePolicy
+	// lastFetch is when the last fetch finished, or the zero time before
+	// the first one does.
+	lastFetch time.Time
+	// fetching is closed once the fetch under way, if any, is done.
+	fetching chan struct{}
+}
+
+func newVolumePolicies(mds torus.MetadataService) *volumePolicies {
+	return &volumePolicies{
+		mds:      mds,
+		policies: make(map[torus.VolumeID]volumePolicy),
+	}
+}
+
+// get returns the policy of a volume. Volumes that set nothing get the zero
+// policy, which follows the server's configuration. If the volume list can't
+// be fetched, the last known policies stay in use.
+func (v *volumePolicies) get(vid torus.VolumeID) volumePolicy {
+	v.mut.Lock()
+	if v.fetching == nil && time.Since(v.lastFetch) >= policyRefresh {
+		v.fetching = make(chan struct{})
+		go v.refresh(v.fetching)
+	}
+	if v.lastFetch.IsZero() {
+		wait := v.fetching
+		v.mut.Unlock()
+		<-wait
+		v.mut.Lock()
+	}
+	defer v.mut.Unlock()
+	return v.policies[vid]
+}
+
+// refresh fetches the volume list, and closes done once the policies are
+// up to date, or couldn't be fetched.
+func (v *volumePolicies) refresh(done chan struct{}) {
+	vols, _, err := v.mds.GetVolumes()
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	defer close(done)
+	v.lastFetch = time.Now()
+	v.fetching = nil
+	if err != nil {
+		clog.Debugf("couldn't list volumes for their policies: %v", err)
+		return
+	}
+	policies := make(map[torus.VolumeID]volumePolicy)
+	for _, x := range vols {
+		p := volumePolicy{
+			consistency: x.Consistency,
+			cache:       x.CachePolicy,
+		}
+		if p != (volumePolicy{}) {
+			policies[torus.VolumeID(x.Id)] = p
+		}
+	}
+	v.policies = policies
+}
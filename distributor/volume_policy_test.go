@@ -0,0 +1,139 @@
+package distributor
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"golang.org/x/net/context"
+)
+
+func TestCachePinnedEviction(t *testing.T) {
+	c := newCache(3)
+	c.PutPinned("image", 1)
+	c.Put("a", 2)
+	c.Put("b", 3)
+	c.Put("c", 4)
+	if _, ok := c.Get("image"); !ok {
+		t.Fatal("pinned entry was evicted before unpinned ones")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expected the oldest unpinned entry to be evicted")
+	}
+	c.PutPinned("b", 3)
+	c.PutPinned("c", 4)
+	c.PutPinned("d", 5)
+	if _, ok := c.Get("image"); ok {
+		t.Fatal("expected the oldest pinned entry to go once nothing else is left")
+	}
+	for _, k := range []string{"b", "c", "d"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("expected %s to be cached", k)
+		}
+	}
+}
+
+func TestCacheBlockPolicy(t *testing.T) {
+	mds := temp.NewClient(torus.Config{}, temp.NewServer())
+	for i, p := range []string{"", torus.CachePolicyAggressive, torus.CachePolicyNoCache} {
+		err := mds.CreateVolume(&models.Volume{
+			Name:        p,
+			Id:          uint64(i + 1),
+			Type:        "block",
+			CachePolicy: p,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &Distributor{
+		readCache: newCache(10),
+		policies:  newVolumePolicies(mds),
+	}
+	ref := func(vol torus.VolumeID) torus.BlockRef {
+		return torus.BlockRef{INodeRef: torus.NewINodeRef(vol, 1), Index: 1}
+	}
+	cached := func(vol torus.VolumeID) bool {
+		_, ok := d.readCache.Get(string(ref(vol).ToBytes()))
+		return ok
+	}
+	tests := []struct {
+		vol   torus.VolumeID
+		local bool
+		want  bool
+	}{
+		{1, true, false},
+		{1, false, true},
+		{2, true, true},
+		{3, false, false},
+	}
+	for _, tt := range tests {
+		d.readCache = newCache(10)
+		d.cacheBlock(context.Background(), ref(tt.vol), []byte{1}, tt.local)
+		if got := cached(tt.vol); got != tt.want {
+			t.Errorf("volume %d, local %v: expected cached %v, got %v", tt.vol, tt.local, tt.want, got)
+		}
+	}
+}
+
+// slowVolumes is a metadata service whose volume list takes until release
+// is closed, counting the times it is asked for.
+type slowVolumes struct {
+	torus.MetadataService
+	release chan struct{}
+	calls   int32
+}
+
+func (s *slowVolumes) GetVolumes() ([]*models.Volume, torus.VolumeID, error) {
+	atomic.AddInt32(&s.calls, 1)
+	<-s.release
+	return s.MetadataService.GetVolumes()
+}
+
+func TestVolumePoliciesRefresh(t *testing.T) {
+	client := temp.NewClient(torus.Config{}, temp.NewServer())
+	mds := &slowVolumes{
+		MetadataService: client,
+		release:         make(chan struct{}),
+	}
+	close(mds.release)
+	v := newVolumePolicies(mds)
+	if p := v.get(1); p != (volumePolicy{}) {
+		t.Fatalf("expected the zero policy, got %+v", p)
+	}
+	err := client.CreateVolume(&models.Volume{
+		Name:        "vol",
+		Id:          1,
+		Type:        "block",
+		Consistency: torus.ConsistencySync,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once stale, the policies are fetched again in the background, once,
+	// and the old ones served in the meantime.
+	mds.release = make(chan struct{})
+	v.mut.Lock()
+	v.lastFetch = time.Now().Add(-policyRefresh)
+	v.mut.Unlock()
+	for i := 0; i < 10; i++ {
+		if p := v.get(1); p != (volumePolicy{}) {
+			t.Fatalf("expected the last known policy while refreshing, got %+v", p)
+		}
+	}
+	close(mds.release)
+	deadline := time.Now().Add(time.Second)
+	for v.get(1).consistency != torus.ConsistencySync {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the new policy once the refresh was done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&mds.calls); n != 2 {
+		t.Fatalf("expected 2 fetches of the volume list, got %d", n)
+	}
+}
@@ -1,6 +1,10 @@
 package torus
 
-import "errors"
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
 
 var (
 	// ErrBlockUnavailable is returned when a function fails to retrieve a known
@@ -31,6 +35,10 @@ var (
 	// ErrNotExist is returned if the entity doesn't already exist
 	ErrNotExist = errors.New("torus: doesn't exist")
 
+	// ErrPartialInit is returned when initializing a metadata service that
+	// holds some, but not all, of the metadata written by an init.
+	ErrPartialInit = errors.New("torus: metadata is partially initialized; wipe it and init again")
+
 	// ErrAgain is returned if the operation was interrupted. The call was valid, and
 	// may be tried again.
 	ErrAgain = errors.New("torus: interrupted, try again")
@@ -63,9 +71,42 @@ var (
 	// ErrLocked is returned if the resource is locked.
 	ErrLocked = errors.New("torus: locked")
 
+	// ErrFenced is returned when a write is made under a volume lock that
+	// has since been taken over by another holder.
+	ErrFenced = errors.New("torus: volume lock was taken over")
+
+	// ErrReadOnly is returned when writing to a file opened read-only.
+	ErrReadOnly = errors.New("torus: file is read-only")
+
 	// ErrLeaseNotFound is returned if the lease cannot be found.
 	ErrLeaseNotFound = errors.New("torus: lease not found")
 
 	// ErrUsage is returned if the command usage is wrong.
 	ErrUsage = errors.New("torus: wrong command usage")
+
+	// ErrWrongCluster is returned if local storage belongs to another
+	// cluster than the metadata service.
+	ErrWrongCluster = errors.New("torus: local storage belongs to another cluster")
 )
+
+// ErrorReason classifies err for the reason label of error metrics, keeping
+// the number of label values small.
+func ErrorReason(err error) string {
+	switch err {
+	case ErrBlockNotExist, ErrNotExist:
+		return "not_exist"
+	case ErrBlockUnavailable, ErrINodeUnavailable, ErrNoPeer:
+		return "unavailable"
+	case ErrOutOfSpace:
+		return "out_of_space"
+	case ErrReadOnly:
+		return "read_only"
+	case ErrFenced:
+		return "fenced"
+	case ErrClosed:
+		return "closed"
+	case context.DeadlineExceeded, context.Canceled:
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,125 @@
+package torus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxPendingClusterEvents is how many events can wait to be recorded in the
+// background at once. Events past that are dropped.
+const maxPendingClusterEvents = 256
+
+// closeFlushTimeout is how long closing a Server waits for the events
+// waiting to be recorded.
+const closeFlushTimeout = 2 * time.Second
+
+type pendingClusterEvent struct {
+	log ClusterEventLog
+	e   AuditEvent
+}
+
+// contextBound is implemented by metadata services whose calls are made
+// under the context given to WithContext.
+type contextBound interface {
+	Context() context.Context
+}
+
+// clusterEvents records the events passed to RecordClusterEvent one at a
+// time, in the order they were passed.
+var clusterEvents struct {
+	once    sync.Once
+	queue   chan pendingClusterEvent
+	pending sync.WaitGroup
+}
+
+// RecordClusterEvent records e in the cluster event log of mds, if it keeps
+// one, stamping it with the time, the UUID of mds as the node it came from,
+// and the local user and host if it has no source. It doesn't wait for e to
+// be recorded, so that a slow or unreachable metadata service never holds up
+// the caller; events that can't be queued are dropped, and failures to
+// record one are only logged. Processes about to exit should call
+// FlushClusterEvents first; closing a Server does.
+func RecordClusterEvent(mds MetadataService, e AuditEvent) {
+	if _, ok := mds.(contextBound); ok {
+		// The event is recorded after the caller is done, and with it
+		// its context.
+		mds = mds.WithContext(context.Background())
+	}
+	el, ok := mds.(ClusterEventLog)
+	if !ok {
+		return
+	}
+	if e.Node == "" {
+		e.Node = mds.UUID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Source == "" {
+		e.Source = localAuditSource()
+	}
+	clusterEvents.once.Do(func() {
+		clusterEvents.queue = make(chan pendingClusterEvent, maxPendingClusterEvents)
+		go recordClusterEvents()
+	})
+	clusterEvents.pending.Add(1)
+	select {
+	case clusterEvents.queue <- pendingClusterEvent{log: el, e: e}:
+	default:
+		clusterEvents.pending.Done()
+		clog.Warningf("too many cluster events waiting to be recorded; dropped %s event", e.Op)
+	}
+}
+
+func recordClusterEvents() {
+	for p := range clusterEvents.queue {
+		if err := p.log.RecordClusterEvent(p.e); err != nil {
+			clog.Errorf("couldn't record %s event in the cluster event log: %v", p.e.Op, err)
+		}
+		clusterEvents.pending.Done()
+	}
+}
+
+// FlushClusterEvents waits up to timeout for the events passed to
+// RecordClusterEvent to be recorded, and reports whether they all were.
+func FlushClusterEvents(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		clusterEvents.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ClusterEventName names an event recorded at t by node uuid in a metadata
+// service that keeps one key per event, so that the keys sort by time.
+func ClusterEventName(t time.Time, uuid string) string {
+	return fmt.Sprintf("%020d-%s", t.UnixNano(), uuid)
+}
+
+// ClusterEventExpired reports whether the event named name by
+// ClusterEventName is older than MaxClusterEventAge at now. The name may
+// carry the rest of the key before it, up to a slash.
+func ClusterEventExpired(name string, now time.Time) bool {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "-"); i >= 0 {
+		name = name[:i]
+	}
+	ns, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return false
+	}
+	return now.Sub(time.Unix(0, ns)) > MaxClusterEventAge
+}
@@ -0,0 +1,78 @@
+package torus
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventMDS keeps cluster events, and can be held up to stand for a slow
+// metadata service.
+type eventMDS struct {
+	MetadataService
+	hold   chan struct{}
+	mut    sync.Mutex
+	events []AuditEvent
+}
+
+func (m *eventMDS) UUID() string { return "node-a" }
+
+func (m *eventMDS) RecordClusterEvent(e AuditEvent) error {
+	<-m.hold
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *eventMDS) GetClusterEvents() ([]AuditEvent, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return append([]AuditEvent(nil), m.events...), nil
+}
+
+func TestRecordClusterEvent(t *testing.T) {
+	m := &eventMDS{hold: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		RecordClusterEvent(m, AuditEvent{Op: AuditVolumeCreate, Source: "admin"})
+		RecordClusterEvent(m, AuditEvent{Op: AuditVolumeDelete, Source: "admin"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected recording events not to wait on the metadata service")
+	}
+	if FlushClusterEvents(10 * time.Millisecond) {
+		t.Fatal("expected the flush to time out while the metadata service is held up")
+	}
+	close(m.hold)
+	if !FlushClusterEvents(time.Second) {
+		t.Fatal("expected the events to be recorded once the metadata service is back")
+	}
+	events, _ := m.GetClusterEvents()
+	if len(events) != 2 || events[0].Op != AuditVolumeCreate || events[1].Op != AuditVolumeDelete {
+		t.Fatalf("expected both events in order, got %+v", events)
+	}
+	for _, e := range events {
+		if e.Node != "node-a" || e.Time.IsZero() {
+			t.Fatalf("expected the event stamped with the node and time, got %+v", e)
+		}
+	}
+}
+
+func TestClusterEventExpired(t *testing.T) {
+	now := time.Now()
+	old := "/torus/events/" + ClusterEventName(now.Add(-MaxClusterEventAge-time.Minute), "node-a")
+	if !ClusterEventExpired(old, now) {
+		t.Fatalf("expected %s to have expired", old)
+	}
+	recent := ClusterEventName(now.Add(-time.Hour), "node-a")
+	if ClusterEventExpired(recent, now) {
+		t.Fatalf("expected %s not to have expired", recent)
+	}
+	if ClusterEventExpired("garbage", now) {
+		t.Fatal("expected a key that isn't an event name to be kept")
+	}
+}
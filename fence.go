@@ -0,0 +1,19 @@
+package torus
+
+import "golang.org/x/net/context"
+
+// WithLockGeneration returns ctx carrying gen, the generation of the volume
+// lock the writes made as part of ctx are made under. Peers refuse writes
+// made under an earlier generation of a volume's lock than the latest they
+// have seen, so that a holder the lock was taken over from can't write over
+// its new holder.
+func WithLockGeneration(ctx context.Context, gen uint64) context.Context {
+	return context.WithValue(ctx, CtxLockGeneration, gen)
+}
+
+// LockGeneration returns the lock generation ctx carries, or zero if it
+// carries none.
+func LockGeneration(ctx context.Context) uint64 {
+	gen, _ := ctx.Value(CtxLockGeneration).(uint64)
+	return gen
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -36,6 +37,19 @@ var (
 		Name: "torus_server_file_written_bytes",
 		Help: "Number of bytes written to a file on this server",
 	}, []string{"volume"})
+	promFileReadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_server_file_read_bytes",
+		Help: "Number of bytes read from a file on this server",
+	}, []string{"volume"})
+	promFileOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_server_file_op_duration_seconds",
+		Help:    "Time taken by reads and writes of a file on this server, whole or failed",
+		Buckets: LatencyBuckets,
+	}, []string{"volume", "op"})
+	promFileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_server_file_errors_total",
+		Help: "Number of failed reads and writes of a file on this server, by reason",
+	}, []string{"volume", "op", "reason"})
 	promFileBlockRead = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "torus_server_file_block_read_us",
 		Help:    "Histogram of ms taken to read a block through the layers and into the file abstraction",
@@ -46,6 +60,25 @@ var (
 		Help:    "Histogram of ms taken to write a block through the layers and into the file abstraction",
 		Buckets: prometheus.ExponentialBuckets(50.0, 2, 20),
 	})
+	promFileReadaheadBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_server_file_readahead_blocks_total",
+		Help: "Number of blocks fetched ahead of sequential readers of a file on this server",
+	}, []string{"volume"})
+)
+
+// LatencyBuckets are the histogram buckets, in seconds, of the latencies of
+// storage operations, from 100µs to 10s.
+var LatencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5,
+	1, 2.5, 5, 10,
+}
+
+const (
+	fileOpRead  = "read"
+	fileOpWrite = "write"
 )
 
 func init() {
@@ -54,8 +87,12 @@ func init() {
 	prometheus.MustRegister(promFileSyncs)
 	prometheus.MustRegister(promFileChangedSyncs)
 	prometheus.MustRegister(promFileWrittenBytes)
+	prometheus.MustRegister(promFileReadBytes)
+	prometheus.MustRegister(promFileOpDuration)
+	prometheus.MustRegister(promFileErrors)
 	prometheus.MustRegister(promFileBlockRead)
 	prometheus.MustRegister(promFileBlockWrite)
+	prometheus.MustRegister(promFileReadaheadBlocks)
 }
 
 type File struct {
@@ -76,6 +113,15 @@ type File struct {
 
 	writeINodeRef INodeRef
 	writeOpen     bool
+	// lockGen is the generation of the volume lock the file is written
+	// under, sent along with its writes. Zero if it holds none.
+	lockGen uint64
+
+	// readEnd is where the last read finished, used to tell sequential
+	// reads from random ones. Accessed atomically.
+	readEnd int64
+	// ra fetches blocks ahead of sequential reads, if enabled.
+	ra *readahead
 }
 
 func (f *File) WriteOpen() bool {
@@ -89,19 +135,27 @@ func (f *File) Replaces() uint64 {
 func (s *Server) CreateFile(volume *models.Volume, inode *models.INode, blocks Blockset) (*File, error) {
 	md := s.MDS.GlobalMetadata()
 	clog.Tracef("Creating File For Inode %d:%d", inode.Volume, inode.INode)
-	return &File{
+	f := &File{
 		volume:  volume,
 		inode:   inode,
 		srv:     s,
 		blocks:  blocks,
 		blkSize: int64(md.BlockSize),
 		cache:   newSingleBlockCache(blocks, md.BlockSize),
-	}, nil
+	}
+	if n := s.Cfg.ReadaheadMaxBytes; n != 0 {
+		blocks := n / md.BlockSize
+		if blocks == 0 {
+			blocks = 1
+		}
+		f.ra = newReadahead(s.getContext(), int(blocks), f.readAhead)
+	}
+	return f, nil
 }
 
 func (f *File) openWrite() error {
 	if f.ReadOnly {
-		return ErrLocked
+		return ErrReadOnly
 	}
 	if f.writeOpen {
 		return nil
@@ -121,8 +175,25 @@ func (f *File) openWrite() error {
 	return nil
 }
 
-func (f *File) writeToBlock(i, from, to int, data []byte) (int, error) {
-	return f.cache.writeToBlock(f.getContext(), i, from, to, data)
+func (f *File) writeToBlock(ctx context.Context, i, from, to int, data []byte) (int, error) {
+	return f.cache.writeToBlock(ctx, i, from, to, data)
+}
+
+// SetLockGeneration has the writes to the file made under generation gen of
+// its volume's lock.
+func (f *File) SetLockGeneration(gen uint64) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.lockGen = gen
+}
+
+// fenceContext returns ctx carrying the lock generation of the file, if it
+// has one.
+func (f *File) fenceContext(ctx context.Context) context.Context {
+	if f.lockGen == 0 {
+		return ctx
+	}
+	return WithLockGeneration(ctx, f.lockGen)
 }
 
 func (f *File) getContext() context.Context {
@@ -136,6 +207,18 @@ func (f *File) Write(b []byte) (n int, err error) {
 }
 
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	return f.writeAt(f.getContext(), b, off)
+}
+
+// WriteAtContext is WriteAt as part of the operation in ctx, such as a
+// traced request.
+func (f *File) WriteAtContext(ctx context.Context, b []byte, off int64) (n int, err error) {
+	return f.writeAt(f.srv.ExtendContext(ctx), b, off)
+}
+
+func (f *File) writeAt(ctx context.Context, b []byte, off int64) (n int, err error) {
+	defer f.observe(fileOpWrite, time.Now(), &err)
+	ctx = f.fenceContext(ctx)
 	f.mut.Lock()
 	defer f.mut.Unlock()
 	err = f.openWrite()
@@ -178,7 +261,7 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 			frontlen = toWrite
 		}
 		clog.Tracef("head writing block at index %d, inoderef %s", blkIndex, f.writeINodeRef)
-		wrote, err := f.writeToBlock(blkIndex, int(blkOff), int(blkOff)+frontlen, b[:frontlen])
+		wrote, err := f.writeToBlock(ctx, blkIndex, int(blkOff), int(blkOff)+frontlen, b[:frontlen])
 		if err != nil {
 			return n, err
 		} else if wrote != frontlen {
@@ -208,7 +291,7 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 			clog.Tracef("bulk writing block at index %d, inoderef %s", blkIndex, f.writeINodeRef)
 		}
 		start := time.Now()
-		err = f.blocks.PutBlock(f.getContext(), f.writeINodeRef, blkIndex, b[:f.blkSize])
+		err = f.blocks.PutBlock(ctx, f.writeINodeRef, blkIndex, b[:f.blkSize])
 		if err != nil {
 			promFileWrittenBytes.WithLabelValues(f.volume.Name).Add(float64(n))
 			return n, err
@@ -235,7 +318,7 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 	if clog.LevelAt(capnslog.TRACE) {
 		clog.Tracef("tail writing block at index %d, inoderef %s", blkIndex, f.writeINodeRef)
 	}
-	wrote, err := f.writeToBlock(blkIndex, 0, toWrite, b)
+	wrote, err := f.writeToBlock(ctx, blkIndex, 0, toWrite, b)
 	if err != nil {
 		promFileWrittenBytes.WithLabelValues(f.volume.Name).Add(float64(n))
 		return n, err
@@ -249,13 +332,36 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 	return n, nil
 }
 
+// observe records the duration of an op on f that began at start, and the
+// error it ended with, if any. Reads that stop short at the end of the file
+// aren't failures.
+func (f *File) observe(op string, start time.Time, err *error) {
+	promFileOpDuration.WithLabelValues(f.volume.Name, op).Observe(time.Since(start).Seconds())
+	if *err != nil && *err != io.EOF {
+		promFileErrors.WithLabelValues(f.volume.Name, op, ErrorReason(*err)).Inc()
+	}
+}
+
 func (f *File) Read(b []byte) (n int, err error) {
 	n, err = f.ReadAt(b, f.offset)
 	f.offset += int64(n)
 	return
 }
 
-func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
+func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	return f.readAt(f.getContext(), b, off)
+}
+
+// ReadAtContext is ReadAt as part of the operation in ctx.
+func (f *File) ReadAtContext(ctx context.Context, b []byte, off int64) (n int, err error) {
+	return f.readAt(f.srv.ExtendContext(ctx), b, off)
+}
+
+func (f *File) readAt(ctx context.Context, b []byte, off int64) (n int, ferr error) {
+	defer func() {
+		promFileReadBytes.WithLabelValues(f.volume.Name).Add(float64(n))
+	}()
+	defer f.observe(fileOpRead, time.Now(), &ferr)
 	f.mut.RLock()
 	defer f.mut.RUnlock()
 	toRead := len(b)
@@ -268,23 +374,42 @@ func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
 		ferr = io.EOF
 		clog.Tracef("read is longer than file")
 	}
+	// Sequential readers are better served by pulling in whole blocks, but a
+	// small random read only needs to fetch the bytes it asked for.
+	random := off != atomic.LoadInt64(&f.readEnd)
+	defer func() { atomic.StoreInt64(&f.readEnd, off) }()
 	for toRead > n {
 		blkIndex := int(off / f.blkSize)
 		blkOff := off - int64(int(f.blkSize)*blkIndex)
+		thisRead := f.blkSize - blkOff
+		if int64(toRead-n) < thisRead {
+			thisRead = int64(toRead - n)
+		}
 		if clog.LevelAt(capnslog.TRACE) {
 			clog.Tracef("getting block index %d", blkIndex)
 		}
-		blk, err := f.cache.getBlock(f.getContext(), blkIndex)
-		if err != nil {
-			return n, err
+		if !random && int64(toRead-n) > thisRead {
+			// The read runs on into the next block; fetch those it
+			// covers together.
+			f.cache.readBlocks(ctx, blkIndex, int((off+int64(toRead-n)-1)/f.blkSize)+1)
 		}
-		thisRead := f.blkSize - blkOff
-		if int64(toRead-n) < thisRead {
-			thisRead = int64(toRead - n)
+		var count int
+		if random && thisRead < f.blkSize {
+			data, err := f.cache.getBlockRange(ctx, blkIndex, uint64(blkOff), uint64(thisRead))
+			if err != nil {
+				return n, err
+			}
+			count = copy(b[n:], data)
+		} else {
+			blk, err := f.cache.getBlock(ctx, blkIndex)
+			if err != nil {
+				return n, err
+			}
+			count = copy(b[n:], blk[blkOff:blkOff+thisRead])
 		}
-		count := copy(b[n:], blk[blkOff:blkOff+thisRead])
 		n += count
 		off += int64(count)
+		f.ra.read(blkIndex, f.blocks.Length())
 	}
 	if toRead != n {
 		//panic("Read more than n bytes?")
@@ -292,6 +417,29 @@ func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
 	return n, ferr
 }
 
+// readAhead fetches blocks [from, to) of f, for the block store to cache
+// ahead of a sequential reader. Blocks that fail are left for the reader to
+// find out about.
+func (f *File) readAhead(ctx context.Context, from, to int) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	if n := f.blocks.Length(); to > n {
+		to = n
+	}
+	if from >= to {
+		return
+	}
+	ctx = WithReadahead(ctx)
+	if r, ok := f.blocks.(BlocksetBatchReader); ok {
+		r.GetBlocks(ctx, from, to)
+	} else {
+		for i := from; i < to && ctx.Err() == nil; i++ {
+			f.blocks.GetBlock(ctx, i)
+		}
+	}
+	promFileReadaheadBlocks.WithLabelValues(f.volume.Name).Add(float64(to - from))
+}
+
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	// TODO(mischief): validate offset
 	switch whence {
@@ -313,6 +461,7 @@ func (f *File) Close() error {
 	if f == nil {
 		return ErrInvalid
 	}
+	f.ra.close()
 	promOpenFiles.WithLabelValues(f.volume.Name).Dec()
 	return nil
 }
@@ -332,7 +481,10 @@ func (f *File) Truncate(size int64) error {
 	return nil
 }
 
-// Trim zeroes data in the middle of a file.
+// Trim zeroes data in the middle of a file. The blocks wholly inside the
+// range are dropped from the blockset, leaving them to be garbage collected,
+// and read back as zeroes. Blocks only partly inside it are left as they are,
+// as a trim only says the data is no longer needed.
 func (f *File) Trim(offset, length int64) error {
 	clog.Debugf("trimming %d %d", offset, length)
 	err := f.openWrite()
@@ -345,6 +497,7 @@ func (f *File) Trim(offset, length int64) error {
 		blkFrom += 1
 	}
 	blkTo := (offset + length) / f.blkSize
+	f.cache.trim(int(blkFrom), int(blkTo))
 	return f.blocks.Trim(int(blkFrom), int(blkTo))
 }
 
@@ -357,6 +510,7 @@ func (f *File) SyncAllWrites() (INodeRef, error) {
 }
 
 func (f *File) SyncINode(ctx context.Context) (INodeRef, error) {
+	ctx = f.fenceContext(ctx)
 	ref := f.writeINodeRef
 	blkdata, err := MarshalBlocksetToProto(f.blocks)
 	if err != nil {
@@ -376,7 +530,16 @@ func (f *File) SyncINode(ctx context.Context) (INodeRef, error) {
 }
 
 func (f *File) SyncBlocks() error {
-	err := f.cache.sync(f.getContext())
+	return f.syncBlocks(f.getContext())
+}
+
+// SyncBlocksContext is SyncBlocks as part of the operation in ctx.
+func (f *File) SyncBlocksContext(ctx context.Context) error {
+	return f.syncBlocks(f.srv.ExtendContext(ctx))
+}
+
+func (f *File) syncBlocks(ctx context.Context) error {
+	err := f.cache.sync(f.fenceContext(ctx))
 	if err != nil {
 		clog.Error("sync: couldn't sync block")
 		return err
@@ -161,3 +161,43 @@ func TestWriteAtBulk(t *testing.T) {
 		t.Fatal("byte strings aren't equal")
 	}
 }
+
+func TestTrim(t *testing.T) {
+	f := newFile("TestTrim", t)
+	defer f.Close()
+
+	// Four blocks of 256 bytes.
+	data := makeTestData(1024)
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SyncAllWrites(); err != nil {
+		t.Fatalf("can't sync: %v", err)
+	}
+	// Leave a write to the third block unsynced, so it's in the cache.
+	if _, err := f.WriteAt([]byte("pending"), 600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the second and third blocks are wholly trimmed.
+	if err := f.Trim(100, 800); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		b := make([]byte, len(data))
+		if _, err := f.ReadAt(b, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:256], data[:256]) || !bytes.Equal(b[768:], data[768:]) {
+			t.Fatal("partly trimmed blocks changed")
+		}
+		if !bytes.Equal(b[256:768], make([]byte, 512)) {
+			t.Fatal("trimmed blocks don't read back as zeroes")
+		}
+	}
+	check()
+	if _, err := f.SyncAllWrites(); err != nil {
+		t.Fatalf("can't sync: %v", err)
+	}
+	check()
+}
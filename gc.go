@@ -0,0 +1,151 @@
+package torus
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// gcTimeLayout is the layout of the bounds of a GC window.
+const gcTimeLayout = "15:04"
+
+// GCSettings control garbage collection on every node of the cluster.
+type GCSettings struct {
+	// WindowStart and WindowEnd bound the time of day, as "15:04" in each
+	// node's local time, during which dead blocks are deleted. The window
+	// wraps past midnight if it ends before it starts. Empty is any time.
+	WindowStart string `json:"window_start,omitempty"`
+	WindowEnd   string `json:"window_end,omitempty"`
+	// RateLimit caps the bytes per second of dead blocks each node deletes.
+	// Zero is unlimited.
+	RateLimit uint64 `json:"rate_limit,omitempty"`
+	// RunRequested is when a pass was last asked for. Each node that sees
+	// it change collects in its next pass, window or not.
+	RunRequested time.Time `json:"run_requested"`
+}
+
+// ParseGCWindow parses a window of the form "01:00-05:00" into its start and
+// end.
+func ParseGCWindow(s string) (start, end string, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("gc window %q isn't of the form HH:MM-HH:MM", s)
+	}
+	var t [2]time.Time
+	for i, p := range parts {
+		t[i], err = time.Parse(gcTimeLayout, strings.TrimSpace(p))
+		if err != nil {
+			return "", "", fmt.Errorf("gc window %q: %v", s, err)
+		}
+	}
+	if t[0].Equal(t[1]) {
+		return "", "", fmt.Errorf("gc window %q is empty", s)
+	}
+	return t[0].Format(gcTimeLayout), t[1].Format(gcTimeLayout), nil
+}
+
+// Window returns the window as "01:00-05:00", or "always" if there is none.
+func (s GCSettings) Window() string {
+	if s.WindowStart == "" || s.WindowEnd == "" {
+		return "always"
+	}
+	return s.WindowStart + "-" + s.WindowEnd
+}
+
+// InWindow reports whether t falls inside the window, in t's location. A
+// window with a bound that doesn't parse is treated as no window at all.
+func (s GCSettings) InWindow(t time.Time) bool {
+	if s.WindowStart == "" || s.WindowEnd == "" {
+		return true
+	}
+	start, err := time.Parse(gcTimeLayout, s.WindowStart)
+	if err != nil {
+		return true
+	}
+	end, err := time.Parse(gcTimeLayout, s.WindowEnd)
+	if err != nil {
+		return true
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	from := time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	to := time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute
+	if from < to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// GCStatus is what a node's garbage collector did in its last pass over the
+// node's local storage.
+type GCStatus struct {
+	UUID string `json:"uuid"`
+	// LastPass is when the last pass finished.
+	LastPass        time.Time `json:"last_pass"`
+	BlocksExamined  uint64    `json:"blocks_examined"`
+	BlocksReclaimed uint64    `json:"blocks_reclaimed"`
+	BytesFreed      uint64    `json:"bytes_freed"`
+	// BlocksDeferred counts the dead blocks the pass found outside the
+	// window and left for a later one.
+	BlocksDeferred uint64 `json:"blocks_deferred"`
+	// OrphanedINodes counts the INodes left behind by crashed writers whose
+	// blocks the pass found dead.
+	OrphanedINodes uint64 `json:"orphaned_inodes"`
+	// Forced is set if the pass was asked for with a run request.
+	Forced bool `json:"forced,omitempty"`
+	// Tombstones is the progress, by volume ID, in reclaiming each deleted
+	// volume there was a tombstone for as the pass started.
+	Tombstones map[uint64]TombstoneProgress `json:"tombstones,omitempty"`
+	Updated    time.Time                    `json:"updated"`
+}
+
+// VolumeTombstone marks a deleted volume until every node has reclaimed its
+// blocks. It is written along with the deletion, so that a volume deleted
+// while nodes are down, or whose reclamation is cut short, is still seen
+// through by later passes.
+type VolumeTombstone struct {
+	Name    string    `json:"name"`
+	ID      uint64    `json:"id"`
+	Type    string    `json:"type"`
+	Size    uint64    `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	// Secure is set if the volume's blocks are overwritten with zeros
+	// where they are stored before they are deleted.
+	Secure bool `json:"secure,omitempty"`
+}
+
+// TombstoneProgress is how far a node has got in reclaiming the blocks of a
+// deleted volume.
+type TombstoneProgress struct {
+	// Reclaimed counts the blocks of the volume the node has deleted since
+	// it was deleted, or since the node started, if later.
+	Reclaimed uint64 `json:"reclaimed"`
+	// Remaining counts those its last pass found and left behind, outside
+	// the GC window or failing to delete them.
+	Remaining uint64 `json:"remaining"`
+	// Erased counts the reclaimed blocks that were overwritten first, for
+	// a volume deleted securely.
+	Erased uint64 `json:"erased,omitempty"`
+}
+
+// ReclaimProgress sums the progress the nodes of peers report in reclaiming
+// the blocks of deleted volume vid, and counts those done: the nodes whose
+// last pass started after the volume was deleted and left none of its blocks
+// behind. Once all of them are, the volume's blocks are gone.
+func ReclaimProgress(vid uint64, peers PeerList, statuses []GCStatus) (p TombstoneProgress, done int) {
+	for _, st := range statuses {
+		if !peers.Has(st.UUID) {
+			continue
+		}
+		tp, ok := st.Tombstones[vid]
+		if !ok {
+			continue
+		}
+		p.Reclaimed += tp.Reclaimed
+		p.Remaining += tp.Remaining
+		p.Erased += tp.Erased
+		if tp.Remaining == 0 {
+			done++
+		}
+	}
+	return p, done
+}
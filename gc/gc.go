@@ -22,6 +22,28 @@ type GC interface {
 	Clear()
 }
 
+// Stats counts what a GC found dead since it was last cleared.
+type Stats struct {
+	// OrphanedINodes counts the INodes left behind by writers that
+	// crashed before committing them, and OrphanedBlocks their blocks.
+	OrphanedINodes int
+	OrphanedBlocks int
+}
+
+// StatsGC is implemented by GCs that count what they find dead.
+type StatsGC interface {
+	Stats() Stats
+}
+
+// GetStats returns what g found dead since it was last cleared, or nothing
+// if it doesn't count.
+func GetStats(g GC) Stats {
+	if s, ok := g.(StatsGC); ok {
+		return s.Stats()
+	}
+	return Stats{}
+}
+
 type INodeFetcher interface {
 	GetINode(context.Context, torus.INodeRef) (*models.INode, error)
 }
@@ -63,6 +85,16 @@ func (c *controller) IsDead(ref torus.BlockRef) bool {
 	return false
 }
 
+func (c *controller) Stats() Stats {
+	var out Stats
+	for _, x := range c.gcs {
+		s := GetStats(x)
+		out.OrphanedINodes += s.OrphanedINodes
+		out.OrphanedBlocks += s.OrphanedBlocks
+	}
+	return out
+}
+
 func (c *controller) Clear() {
 	for _, x := range c.gcs {
 		x.Clear()
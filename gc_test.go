@@ -0,0 +1,76 @@
+package torus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGCWindow(t *testing.T) {
+	for _, tt := range []struct {
+		in         string
+		start, end string
+		ok         bool
+	}{
+		{"01:00-05:00", "01:00", "05:00", true},
+		{"22:30 - 2:15", "22:30", "02:15", true},
+		{"01:00", "", "", false},
+		{"01:00-25:00", "", "", false},
+		{"03:00-03:00", "", "", false},
+	} {
+		start, end, err := ParseGCWindow(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: expected ok=%v, got %v", tt.in, tt.ok, err)
+			continue
+		}
+		if start != tt.start || end != tt.end {
+			t.Errorf("%q: expected %s-%s, got %s-%s", tt.in, tt.start, tt.end, start, end)
+		}
+	}
+}
+
+func TestGCInWindow(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2017, 3, 1, hour, min, 0, 0, time.UTC)
+	}
+	night := GCSettings{WindowStart: "01:00", WindowEnd: "05:00"}
+	wrap := GCSettings{WindowStart: "22:00", WindowEnd: "02:00"}
+	for _, tt := range []struct {
+		s    GCSettings
+		t    time.Time
+		want bool
+	}{
+		{GCSettings{}, at(12, 0), true},
+		{night, at(0, 59), false},
+		{night, at(1, 0), true},
+		{night, at(4, 59), true},
+		{night, at(5, 0), false},
+		{wrap, at(21, 59), false},
+		{wrap, at(23, 0), true},
+		{wrap, at(1, 30), true},
+		{wrap, at(2, 0), false},
+	} {
+		if got := tt.s.InWindow(tt.t); got != tt.want {
+			t.Errorf("window %s at %s: expected %v, got %v", tt.s.Window(), tt.t.Format("15:04"), tt.want, got)
+		}
+	}
+}
+
+func TestReclaimProgress(t *testing.T) {
+	statuses := []GCStatus{
+		{UUID: "a", Tombstones: map[uint64]TombstoneProgress{7: {Reclaimed: 10}}},
+		{UUID: "b", Tombstones: map[uint64]TombstoneProgress{7: {Reclaimed: 4, Remaining: 6}}},
+		{UUID: "c"},
+		// Not in the ring any more.
+		{UUID: "d", Tombstones: map[uint64]TombstoneProgress{7: {Reclaimed: 100, Remaining: 1}}},
+	}
+	p, done := ReclaimProgress(7, PeerList{"a", "b", "c"}, statuses)
+	if p.Reclaimed != 14 || p.Remaining != 6 {
+		t.Fatalf("expected 14 reclaimed and 6 remaining, got %+v", p)
+	}
+	if done != 1 {
+		t.Fatalf("expected 1 peer done, got %d", done)
+	}
+	if _, done = ReclaimProgress(8, PeerList{"a", "b", "c"}, statuses); done != 0 {
+		t.Fatalf("expected no peer done with an unknown volume, got %d", done)
+	}
+}
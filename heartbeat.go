@@ -2,6 +2,7 @@ package torus
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"net/url"
 	"time"
@@ -13,11 +14,27 @@ import (
 )
 
 const (
-	currentProtocolVersion = 1
-	minProtocolVersion     = 0
+	// ProtocolVersion is the version of the protocol this server speaks to
+	// its peers. It is advertised in the server's PeerInfo, and peers
+	// connecting to each other agree on the highest version both speak.
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest version of the peer protocol this
+	// server still speaks. Version 1 is that of servers from before
+	// peers agreed on a version when connecting.
+	MinProtocolVersion = 1
 
-	heartbeatTimeout  = 1 * time.Second
-	heartbeatInterval = 5 * time.Second
+	heartbeatTimeout = 1 * time.Second
+
+	// DefaultHeartbeatInterval is how often a node heartbeats when its
+	// config doesn't say.
+	DefaultHeartbeatInterval = 5 * time.Second
+	// DefaultPeerTimeout is how long a peer may go without a heartbeat
+	// when the cluster wasn't initialized with a timeout of its own.
+	DefaultPeerTimeout = 30 * time.Second
+
+	// heartbeatJitter is the fraction of the interval each heartbeat is
+	// moved by at random, so that nodes started together drift apart.
+	heartbeatJitter = 0.1
 )
 
 var (
@@ -29,11 +46,26 @@ var (
 		Name: "torus_server_peers_total",
 		Help: "Number of peers this server sees",
 	})
+	promHeartbeatFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_server_heartbeat_failures_total",
+		Help: "Number of heartbeats that failed to renew the lease or register the server",
+	})
+	promLeaseRegrants = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_server_lease_regrants_total",
+		Help: "Number of times this server's lease had expired and a new one was granted",
+	})
+	promHeartbeatWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_server_heartbeat_writes_total",
+		Help: "Number of heartbeats that wrote this server's peer info to mds, rather than only renewing its lease",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(promHeartbeats)
 	prometheus.MustRegister(promServerPeers)
+	prometheus.MustRegister(promHeartbeatFailures)
+	prometheus.MustRegister(promLeaseRegrants)
+	prometheus.MustRegister(promHeartbeatWrites)
 }
 
 // BeginHeartbeat spawns a goroutine for heartbeats. Non-blocking.
@@ -45,15 +77,25 @@ func (s *Server) BeginHeartbeat(addr *url.URL) error {
 	// Test the cluster's version on startup.
 	peers := s.UpdatePeerMap()
 	for uuid, p := range peers {
-		if p.ProtocolVersion < minProtocolVersion {
+		if p.ProtocolVersion < MinProtocolVersion {
 			// Fail to start.
-			return fmt.Errorf("cluster too old: peer %s has protocol version %d (minimum is %d, current is %d)", uuid, p.ProtocolVersion, minProtocolVersion, currentProtocolVersion)
+			return fmt.Errorf("cluster too old: peer %s has protocol version %d (minimum is %d, current is %d)", uuid, p.ProtocolVersion, MinProtocolVersion, ProtocolVersion)
 		}
 	}
 
 	// Update our data.
-	s.peerInfo.ProtocolVersion = currentProtocolVersion
-	if addr != nil {
+	s.peerInfo.ProtocolVersion = ProtocolVersion
+	if addr != nil && s.Cfg.AdvertiseAddress != "" {
+		advertiseURI, err := url.Parse(s.Cfg.AdvertiseAddress)
+		if err != nil {
+			return err
+		}
+		err = s.checkAdvertiseAddress(advertiseURI, peers)
+		if err != nil {
+			return err
+		}
+		s.peerInfo.Address = advertiseURI.String()
+	} else if addr != nil {
 		ipaddr, port, err := net.SplitHostPort(addr.Host)
 		if err != nil {
 			return err
@@ -66,7 +108,17 @@ func (s *Server) BeginHeartbeat(addr *url.URL) error {
 		}
 		s.peerInfo.Address = advertiseURI.String()
 	}
-	var err error
+	timeout := s.MDS.GlobalMetadata().PeerTimeoutOrDefault()
+	if s.Cfg.PeerTimeout != 0 && s.Cfg.PeerTimeout != timeout {
+		clog.Warningf("ignoring a peer timeout of %s; the cluster was initialized with %s", s.Cfg.PeerTimeout, timeout)
+	}
+	err := CheckPeerTimeout(s.Cfg.HeartbeatIntervalOrDefault(), timeout)
+	if err != nil {
+		return err
+	}
+	s.infoMut.Lock()
+	s.peerTimeout = timeout
+	s.infoMut.Unlock()
 	err = s.createOrRenewLease(context.Background())
 	if err != nil {
 		return err
@@ -74,49 +126,155 @@ func (s *Server) BeginHeartbeat(addr *url.URL) error {
 	s.UpdateRebalanceInfo(&models.RebalanceInfo{})
 	ch := make(chan interface{})
 	s.closeChans = append(s.closeChans, ch)
-	go s.heartbeat(ch)
+	s.heartbeatDone = make(chan struct{})
+	go s.heartbeat(ch, s.heartbeatDone)
 	s.heartbeating = true
 	return nil
 }
 
-func (s *Server) heartbeat(cl chan interface{}) {
+func (s *Server) heartbeat(cl chan interface{}, done chan struct{}) {
+	defer close(done)
+	interval := s.Cfg.HeartbeatIntervalOrDefault()
+	failures := 0
+	// The first heartbeat registers the node at once; the next comes at a
+	// random point of the interval, so that nodes started together don't
+	// write to etcd together.
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	delay := time.Duration(rnd.Int63n(int64(interval)))
 	for {
-		s.oneHeartbeat()
+		if err := s.oneHeartbeat(); err != nil {
+			promHeartbeatFailures.Inc()
+			failures++
+		} else {
+			if failures != 0 {
+				clog.Infof("heartbeating again after %d failures", failures)
+			}
+			failures = 0
+		}
+		if delay == 0 {
+			delay = jitter(rnd, heartbeatDelay(failures, interval))
+		}
 		select {
 		case <-cl:
 			// TODO(barakmich): Clean up.
 			return
-		case <-time.After(heartbeatInterval):
+		case <-time.After(delay):
 			clog.Trace("heartbeating again")
 		}
+		delay = 0
 	}
 }
 
+// jitter moves d by up to heartbeatJitter of it either way, at random.
+func jitter(rnd *rand.Rand, d time.Duration) time.Duration {
+	j := int64(float64(d) * heartbeatJitter)
+	if j <= 0 {
+		return d
+	}
+	return d + time.Duration(rnd.Int63n(2*j+1)-j)
+}
+
+// heartbeatDelay returns how long to wait for the next heartbeat after
+// failures failed ones in a row. The first retries come sooner than the
+// usual interval, so that a node gets back into the cluster quickly once
+// etcd is back, backing off to the interval while it isn't.
+func heartbeatDelay(failures int, interval time.Duration) time.Duration {
+	if failures == 0 {
+		return interval
+	}
+	d := heartbeatTimeout
+	for i := 1; i < failures && d < interval; i++ {
+		d *= 2
+	}
+	if d > interval {
+		d = interval
+	}
+	return d
+}
+
+// CheckPeerTimeout returns an error if a peer timeout wouldn't leave a node
+// heartbeating every interval room to miss a heartbeat without being taken
+// for gone.
+func CheckPeerTimeout(interval, timeout time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("heartbeat interval must be positive, not %s", interval)
+	}
+	if timeout <= 2*interval {
+		return fmt.Errorf("peer timeout %s must be more than twice the heartbeat interval %s", timeout, interval)
+	}
+	return nil
+}
+
 func (s *Server) AddTimeoutCallback(f func(uuid string)) {
 	s.timeoutCallbacks = append(s.timeoutCallbacks, f)
 }
 
-func (s *Server) oneHeartbeat() {
+// oneHeartbeat renews the server's lease and registers it under it,
+// returning the first error in doing so.
+//
+// The lease is what keeps the server registered, so the server's PeerInfo
+// is only written again when something in it besides LastSeen changed, the
+// lease changed, or its LastSeen is within two heartbeat intervals of the
+// peer timeout, so that the LastSeen of a live peer stays within it. The
+// used blocks, which change with every write, are only counted again when
+// the PeerInfo is written for its age.
+func (s *Server) oneHeartbeat() error {
 	promHeartbeats.Inc()
 
-	s.mut.Lock()
-	s.peerInfo.TotalBlocks = s.Blocks.NumBlocks()
-	s.peerInfo.UsedBlocks = s.Blocks.UsedBlocks()
-	s.mut.Unlock()
-
 	ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
 	defer cancel()
-	err := s.createOrRenewLease(ctx)
-	if err != nil {
-		clog.Warningf("failed to create or renew lease: %s", err)
+	leaseErr := s.createOrRenewLease(ctx)
+	if leaseErr != nil {
+		clog.Warningf("failed to create or renew lease: %s", leaseErr)
 	}
+	lease := s.Lease()
+
 	s.infoMut.Lock()
-	defer s.infoMut.Unlock()
-	err = s.MDS.WithContext(ctx).RegisterPeer(s.lease, s.peerInfo)
+	refreshAfter := s.peerTimeout - 2*s.Cfg.HeartbeatIntervalOrDefault()
+	refresh := s.published == nil || s.publishedLease != lease || time.Since(s.publishedAt) >= refreshAfter
+	s.peerInfo.TotalBlocks = s.Blocks.NumBlocks()
+	if refresh {
+		s.peerInfo.UsedBlocks = s.Blocks.UsedBlocks()
+	}
+	s.peerInfo.ReadOnly = BlockStoreReadOnly(s.Blocks)
+	s.peerInfo.OpenCircuits = BlockStoreOpenCircuits(s.Blocks)
+	var err error
+	if refresh || !s.peerInfo.Equal(s.published) {
+		promHeartbeatWrites.Inc()
+		err = s.MDS.WithContext(ctx).RegisterPeer(lease, s.peerInfo)
+		if err == nil {
+			s.markPublished(lease)
+		} else {
+			s.published = nil
+		}
+	}
+	s.infoMut.Unlock()
+	if err == ErrLeaseNotFound {
+		// The lease expired between renewing it and using it.
+		s.forgetLease(lease)
+	}
 	if err != nil {
 		clog.Warningf("couldn't register heartbeat: %s", err)
 	}
 	s.updatePeerMap()
+	if leaseErr != nil {
+		return leaseErr
+	}
+	return err
+}
+
+// markPublished records the server's PeerInfo as written under lease, for
+// later heartbeats to compare against. infoMut must be held.
+func (s *Server) markPublished(lease int64) {
+	p := *s.peerInfo
+	if p.RebalanceInfo != nil {
+		// Rebalancing updates its info in place.
+		ri := *p.RebalanceInfo
+		p.RebalanceInfo = &ri
+	}
+	s.published = &p
+	s.publishedLease = lease
+	s.publishedAt = time.Now()
 }
 
 func (s *Server) updatePeerMap() {
@@ -129,13 +287,12 @@ func (s *Server) updatePeerMap() {
 	}
 	promServerPeers.Set(float64(len(peers)))
 
-	s.mut.Lock()
-	defer s.mut.Unlock()
-
+	var timedOut []string
+	s.peersMut.Lock()
 	for _, p := range peers {
 		s.peersMap[p.UUID] = p
 	}
-	for k := range s.peersMap {
+	for k, v := range s.peersMap {
 		found := false
 		for _, p := range peers {
 			if p.UUID == k {
@@ -144,10 +301,19 @@ func (s *Server) updatePeerMap() {
 			}
 		}
 		if !found {
-			for _, f := range s.timeoutCallbacks {
-				f(k)
+			timedOut = append(timedOut, k)
+			if !v.TimedOut {
+				// The old PeerInfo may be in a map GetPeerMap returned.
+				p := *v
+				p.TimedOut = true
+				s.peersMap[k] = &p
 			}
-			s.peersMap[k].TimedOut = true
+		}
+	}
+	s.peersMut.Unlock()
+	for _, k := range timedOut {
+		for _, f := range s.timeoutCallbacks {
+			f(k)
 		}
 	}
 }
@@ -163,6 +329,39 @@ func (s *Server) UpdateRebalanceInfo(ri *models.RebalanceInfo) {
 	s.peerInfo.RebalanceInfo = ri
 }
 
+// RebalanceInfo returns the rebalance state this server last reported.
+func (s *Server) RebalanceInfo() *models.RebalanceInfo {
+	s.infoMut.Lock()
+	defer s.infoMut.Unlock()
+	return s.peerInfo.RebalanceInfo
+}
+
+// checkAdvertiseAddress refuses to advertise an unspecified or loopback
+// address once the cluster has other members, as they couldn't reach it.
+func (s *Server) checkAdvertiseAddress(u *url.URL, peers map[string]*models.PeerInfo) error {
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !(ip.IsUnspecified() || ip.IsLoopback())) {
+		return nil
+	}
+	members := map[string]bool{s.MDS.UUID(): true}
+	for uuid := range peers {
+		members[uuid] = true
+	}
+	if r, err := s.MDS.GetRing(); err == nil {
+		for _, uuid := range r.Members() {
+			members[uuid] = true
+		}
+	}
+	if len(members) > 1 {
+		return fmt.Errorf("can't advertise %s to a cluster of %d members; the others couldn't reach it", u.Host, len(members))
+	}
+	return nil
+}
+
 func autodetectIP(ip string) string {
 	// We can't advertise "all IPs"
 	if ip != "0.0.0.0" {
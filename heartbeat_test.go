@@ -0,0 +1,303 @@
+package torus
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus/models"
+
+	"golang.org/x/net/context"
+)
+
+var errUnavailable = errors.New("etcd unavailable")
+
+// leaseMDS keeps leases and the peers registered under them, and can be made
+// unreachable or lose leases, as through an etcd restart or a partition.
+type leaseMDS struct {
+	MetadataService
+	mut       sync.Mutex
+	down      bool
+	lastLease int64
+	leases    map[int64]bool
+	peers     map[string]int64
+	writes    int
+}
+
+func newLeaseMDS() *leaseMDS {
+	return &leaseMDS{leases: make(map[int64]bool), peers: make(map[string]int64)}
+}
+
+func (m *leaseMDS) WithContext(ctx context.Context) MetadataService { return m }
+func (m *leaseMDS) UUID() string                                    { return "a" }
+
+func (m *leaseMDS) GetLease() (int64, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.down {
+		return 0, errUnavailable
+	}
+	m.lastLease++
+	m.leases[m.lastLease] = true
+	return m.lastLease, nil
+}
+
+func (m *leaseMDS) RenewLease(lease int64) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.down {
+		return errUnavailable
+	}
+	if !m.leases[lease] {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (m *leaseMDS) RegisterPeer(lease int64, p *models.PeerInfo) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.down {
+		return errUnavailable
+	}
+	if !m.leases[lease] {
+		return ErrLeaseNotFound
+	}
+	m.peers[p.UUID] = lease
+	m.writes++
+	return nil
+}
+
+func (m *leaseMDS) GetPeers() (PeerInfoList, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.down {
+		return nil, errUnavailable
+	}
+	var out PeerInfoList
+	for uuid, lease := range m.peers {
+		if m.leases[lease] {
+			out = append(out, &models.PeerInfo{UUID: uuid})
+		}
+	}
+	return out, nil
+}
+
+// expire drops every lease, and with them the peers registered under them.
+func (m *leaseMDS) expire() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.leases = make(map[int64]bool)
+}
+
+func (m *leaseMDS) setDown(down bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.down = down
+}
+
+// registered returns the lease the peer is registered under, if any.
+func (m *leaseMDS) registered(uuid string) int64 {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if lease := m.peers[uuid]; m.leases[lease] {
+		return lease
+	}
+	return 0
+}
+
+type countingBlockStore struct {
+	BlockStore
+}
+
+func (countingBlockStore) NumBlocks() uint64  { return 10 }
+func (countingBlockStore) UsedBlocks() uint64 { return 1 }
+
+func TestHeartbeatLeaseRecovery(t *testing.T) {
+	mds := newLeaseMDS()
+	s := &Server{
+		MDS:      mds,
+		Blocks:   countingBlockStore{},
+		peersMap: make(map[string]*models.PeerInfo),
+		peerInfo: &models.PeerInfo{UUID: "a"},
+	}
+	if err := s.oneHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Lease()
+	if first == 0 || mds.registered("a") != first {
+		t.Fatalf("expected the peer registered under lease %d, got %d", first, mds.registered("a"))
+	}
+
+	// While etcd is unreachable the lease is kept, as it may outlive the
+	// outage.
+	mds.setDown(true)
+	if err := s.oneHeartbeat(); err == nil {
+		t.Fatal("expected the heartbeat to fail while etcd is down")
+	}
+	if s.Lease() != first || s.LeaseErr() == nil {
+		t.Fatalf("expected lease %d kept with an error, got %d (%v)", first, s.Lease(), s.LeaseErr())
+	}
+	mds.setDown(false)
+	if err := s.oneHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Lease() != first || s.LeaseErr() != nil {
+		t.Fatalf("expected lease %d to carry on, got %d (%v)", first, s.Lease(), s.LeaseErr())
+	}
+
+	// Back after the lease expired, the node takes a new one and registers
+	// again under it.
+	mds.expire()
+	if _, ok := s.GetPeerMap()["a"]; !ok {
+		t.Fatal("expected the peer map to still hold the node")
+	}
+	if err := s.oneHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	second := s.Lease()
+	if second == first || mds.registered("a") != second {
+		t.Fatalf("expected the peer registered under a new lease, got lease %d, registered under %d", second, mds.registered("a"))
+	}
+	if p := s.GetPeerMap()["a"]; p == nil || p.TimedOut {
+		t.Fatalf("expected the node back in the peer map, got %+v", p)
+	}
+}
+
+func TestPeerMapConcurrentReads(t *testing.T) {
+	mds := newLeaseMDS()
+	s := &Server{
+		MDS:      mds,
+		Blocks:   countingBlockStore{},
+		peersMap: make(map[string]*models.PeerInfo),
+		peerInfo: &models.PeerInfo{UUID: "a"},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			lease, _ := mds.GetLease()
+			mds.RegisterPeer(lease, &models.PeerInfo{UUID: "b"})
+			s.updatePeerMap()
+			// The peer drops out, and is marked timed out.
+			mds.expire()
+			s.updatePeerMap()
+		}
+	}()
+	for {
+		for _, p := range s.GetPeerMap() {
+			_ = p.TimedOut
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+// usedBlockStore holds a changing number of blocks.
+type usedBlockStore struct {
+	BlockStore
+	used uint64
+}
+
+func (*usedBlockStore) NumBlocks() uint64    { return 10 }
+func (b *usedBlockStore) UsedBlocks() uint64 { return b.used }
+
+func TestHeartbeatSkipsUnchanged(t *testing.T) {
+	mds := newLeaseMDS()
+	blocks := &usedBlockStore{used: 1}
+	s := &Server{
+		MDS:         mds,
+		Blocks:      blocks,
+		peersMap:    make(map[string]*models.PeerInfo),
+		peerInfo:    &models.PeerInfo{UUID: "a"},
+		peerTimeout: DefaultPeerTimeout,
+	}
+	beat := func(writes int) {
+		if err := s.oneHeartbeat(); err != nil {
+			t.Fatal(err)
+		}
+		if mds.writes != writes {
+			t.Fatalf("expected %d writes, got %d", writes, mds.writes)
+		}
+	}
+	beat(1)
+
+	// Only the lease is renewed while nothing changes, even the used
+	// blocks.
+	blocks.used = 2
+	beat(1)
+	beat(1)
+	if s.peerInfo.UsedBlocks != 1 {
+		t.Fatalf("expected the used blocks to wait for the refresh, got %d", s.peerInfo.UsedBlocks)
+	}
+
+	s.UpdateRebalanceInfo(&models.RebalanceInfo{Rebalancing: true})
+	beat(2)
+	beat(2)
+
+	// The peer info is written again before it's as old as the peer
+	// timeout.
+	s.publishedAt = time.Now().Add(-DefaultPeerTimeout + 2*DefaultHeartbeatInterval)
+	beat(3)
+	if s.peerInfo.UsedBlocks != 2 {
+		t.Fatalf("expected the used blocks counted again, got %d", s.peerInfo.UsedBlocks)
+	}
+
+	// A new lease needs the peer registered under it.
+	mds.expire()
+	beat(4)
+	if mds.registered("a") != s.Lease() {
+		t.Fatalf("expected the peer registered under lease %d", s.Lease())
+	}
+}
+
+func TestJitter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		d := jitter(rnd, DefaultHeartbeatInterval)
+		if d < DefaultHeartbeatInterval*9/10 || d > DefaultHeartbeatInterval*11/10 {
+			t.Fatalf("expected within a tenth of %s, got %s", DefaultHeartbeatInterval, d)
+		}
+	}
+}
+
+func TestHeartbeatDelay(t *testing.T) {
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, DefaultHeartbeatInterval},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, DefaultHeartbeatInterval},
+		{100, DefaultHeartbeatInterval},
+	} {
+		if got := heartbeatDelay(tt.failures, DefaultHeartbeatInterval); got != tt.want {
+			t.Errorf("after %d failures: expected %s, got %s", tt.failures, tt.want, got)
+		}
+	}
+}
+
+func TestCheckPeerTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		interval, timeout time.Duration
+		ok                bool
+	}{
+		{DefaultHeartbeatInterval, DefaultPeerTimeout, true},
+		{time.Second, 3 * time.Second, true},
+		{time.Second, 2 * time.Second, false},
+		{5 * time.Second, 5 * time.Second, false},
+		{0, DefaultPeerTimeout, false},
+	} {
+		err := CheckPeerTimeout(tt.interval, tt.timeout)
+		if (err == nil) != tt.ok {
+			t.Errorf("interval %s, timeout %s: expected ok=%v, got %v", tt.interval, tt.timeout, tt.ok, err)
+		}
+	}
+}
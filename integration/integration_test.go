@@ -28,12 +28,16 @@ const (
 )
 
 func newServer(t testing.TB, md *temp.Server) *torus.Server {
+	return newServerWith(t, md, torus.Config{})
+}
+
+// newServerWith returns a server with its own storage, configured as cfg
+// otherwise.
+func newServerWith(t testing.TB, md *temp.Server, cfg torus.Config) *torus.Server {
 	dir, _ := ioutil.TempDir("", "torus-integration")
 	torus.MkdirsFor(dir)
-	cfg := torus.Config{
-		StorageSize: StorageSize,
-		DataDir:     dir,
-	}
+	cfg.StorageSize = StorageSize
+	cfg.DataDir = []string{dir}
 	mds := temp.NewClient(cfg, md)
 	gmd := mds.GlobalMetadata()
 	blocks, err := torus.CreateBlockStore("mfile", "current", cfg, gmd)
@@ -104,9 +108,11 @@ func closeAll(t testing.TB, c ...*torus.Server) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = os.RemoveAll(x.Cfg.DataDir)
-		if err != nil {
-			t.Fatal(err)
+		for _, dir := range x.Cfg.DataDir {
+			err = os.RemoveAll(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
 		}
 	}
 }
@@ -329,3 +335,75 @@ func BenchmarkLoadThree(b *testing.B) {
 	closeAll(b, servers...)
 	b.StartTimer()
 }
+
+func BenchmarkReadSequential(b *testing.B)          { benchmarkRead(b, 0, false) }
+func BenchmarkReadSequentialReadahead(b *testing.B) { benchmarkRead(b, 8*BlockSize, false) }
+func BenchmarkReadRandom(b *testing.B)              { benchmarkRead(b, 0, true) }
+func BenchmarkReadRandomReadahead(b *testing.B)     { benchmarkRead(b, 8*BlockSize, true) }
+
+// benchmarkRead reads a volume whose blocks are all on other peers in small
+// reads, in order or at random, with a readahead of up to readahead bytes.
+func benchmarkRead(b *testing.B, readahead uint64, random bool) {
+	b.StopTimer()
+
+	servers, mds := ringN(b, 3)
+	client := newServerWith(b, mds, torus.Config{
+		ReadCacheSize:     1,
+		ReadaheadMaxBytes: readahead,
+	})
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	blkSize := int(client.MDS.GlobalMetadata().BlockSize)
+	// Larger than the cache, so that each pass reads from the peers.
+	size := blkSize * 400
+	data := makeTestData(size)
+	volname := "testvol"
+	if err := block.CreateBlockVolume(client.MDS, volname, uint64(size)); err != nil {
+		b.Fatalf("couldn't create block volume %s: %v", volname, err)
+	}
+	blockvol, err := block.OpenBlockVolume(client, volname)
+	if err != nil {
+		b.Fatalf("couldn't open block volume %s: %v", volname, err)
+	}
+	f, err := blockvol.OpenBlockFile()
+	if err != nil {
+		b.Fatalf("couldn't open blockfile %s: %v", volname, err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		b.Fatalf("couldn't write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		b.Fatalf("couldn't close: %v", err)
+	}
+	f, err = blockvol.OpenBlockFile()
+	if err != nil {
+		b.Fatalf("couldn't open blockfile %s: %v", volname, err)
+	}
+	buf := make([]byte, blkSize/2)
+
+	b.SetBytes(int64(size))
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		for off := 0; off < size; off += len(buf) {
+			at := off
+			if random {
+				at = rand.Intn(size/len(buf)) * len(buf)
+			}
+			if _, err := f.ReadAt(buf, int64(at)); err != nil {
+				b.Fatalf("couldn't read at %d: %v", at, err)
+			}
+			if !bytes.Equal(buf, data[at:at+len(buf)]) {
+				b.Fatalf("read the wrong data at %d", at)
+			}
+		}
+	}
+
+	b.StopTimer()
+	f.Close()
+	closeAll(b, servers...)
+	b.StartTimer()
+}
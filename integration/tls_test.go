@@ -0,0 +1,204 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/block"
+	"github.com/alternative-storage/torus/distributor"
+	"github.com/alternative-storage/torus/metadata/temp"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+// writePeerCerts writes a CA, and a certificate it signs for 127.0.0.1, to
+// dir, returning a config that uses them for peer TLS.
+func writePeerCerts(t *testing.T, dir string) torus.Config {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "torus test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "torus test peer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	peerDER, err := x509.CreateCertificate(rand.Reader, peer, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := torus.Config{
+		PeerCertFile: filepath.Join(dir, "peer.pem"),
+		PeerKeyFile:  filepath.Join(dir, "peer-key.pem"),
+		PeerCAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	for path, block := range map[string]*pem.Block{
+		cfg.PeerCertFile: {Type: "CERTIFICATE", Bytes: peerDER},
+		cfg.PeerKeyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		cfg.PeerCAFile:   {Type: "CERTIFICATE", Bytes: caDER},
+	} {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+func readVol(t *testing.T, srv *torus.Server, volname string) ([]byte, error) {
+	blockvol, err := block.OpenBlockVolume(srv, volname)
+	if err != nil {
+		return nil, err
+	}
+	f, err := blockvol.OpenBlockFile()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := &bytes.Buffer{}
+	_, err = io.Copy(out, f)
+	return out.Bytes(), err
+}
+
+func TestPeerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := writePeerCerts(t, dir)
+
+	partial := cfg
+	partial.PeerCAFile = ""
+	if _, err := torus.LoadPeerTLS(partial); err == nil {
+		t.Fatal("expected peer TLS without a CA to be refused")
+	}
+
+	mds := temp.NewServer()
+	var servers []*torus.Server
+	for i := 0; i < 3; i++ {
+		srv := newServerWith(t, mds, cfg)
+		uri, _ := url.Parse(fmt.Sprintf("tdp://127.0.0.1:%d", 40100+i))
+		if err := distributor.ListenReplication(srv, uri); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, srv)
+	}
+	defer closeAll(t, servers...)
+	time.Sleep(10 * time.Millisecond)
+	setRing := func(version, n int) {
+		var peers torus.PeerInfoList
+		for _, s := range servers[:n] {
+			peers = append(peers, &models.PeerInfo{
+				UUID:        s.MDS.UUID(),
+				TotalBlocks: StorageSize / BlockSize,
+			})
+		}
+		r, err := ring.CreateRing(&models.Ring{
+			Type:              uint32(ring.Ketama),
+			Peers:             peers,
+			ReplicationFactor: uint32(n),
+			Version:           uint32(version),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mds.SetRing(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setRing(2, 2)
+
+	// Write and read back over TLS.
+	client := newServerWith(t, mds, cfg)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 100
+	data := makeTestData(size)
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		t.Fatalf("couldn't copy: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("couldn't sync: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("couldn't close: %v", err)
+	}
+	got, err := readVol(t, client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("bytes not equal")
+	}
+
+	// Rebalance onto the third peer, which only sees blocks over TLS.
+	if servers[2].Blocks.UsedBlocks() != 0 {
+		t.Fatal("expected the peer outside the ring to hold no blocks")
+	}
+	setRing(3, 3)
+	deadline := time.Now().Add(30 * time.Second)
+	for servers[2].Blocks.UsedBlocks() < 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rebalance moved only %d blocks to the new peer", servers[2].Blocks.UsedBlocks())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// A peer without TLS is refused up front.
+	plain := newServer(t, mds)
+	if err := distributor.OpenReplication(plain); err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	start := time.Now()
+	if _, err := readVol(t, plain, "testvol"); err == nil {
+		t.Fatal("expected a peer without TLS to be unable to read")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected a peer without TLS to fail fast, took %s", d)
+	}
+}
@@ -0,0 +1,160 @@
+// Package dockerplugin serves the HTTP API Docker talks to volume plugins
+// over, on top of a Driver that does the work.
+package dockerplugin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "dockerplugin")
+
+const contentType = "application/vnd.docker.plugins.v1.2+json"
+
+// Volume is a volume as Docker lists and inspects it.
+type Volume struct {
+	Name string
+	// Mountpoint is where the volume is mounted on this host, if it is.
+	Mountpoint string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+// Driver manages the volumes of a plugin. Mount and Unmount are called once
+// for each container using a volume, each with an ID of its own.
+type Driver interface {
+	Create(name string, opts map[string]string) error
+	Remove(name string) error
+	Mount(name, id string) (string, error)
+	Unmount(name, id string) error
+	Path(name string) (string, error)
+	// Get returns the volume called name, or an error if there's none.
+	Get(name string) (*Volume, error)
+	List() ([]*Volume, error)
+}
+
+// Scopes of the volumes of a plugin: local volumes are only known on the
+// host they were created on, global ones on every host running the plugin.
+const (
+	ScopeLocal  = "local"
+	ScopeGlobal = "global"
+)
+
+type request struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type capabilities struct {
+	Scope string
+}
+
+type response struct {
+	Err          string
+	Mountpoint   string        `json:",omitempty"`
+	Volume       *Volume       `json:",omitempty"`
+	Volumes      []*Volume     `json:",omitempty"`
+	Capabilities *capabilities `json:",omitempty"`
+	Implements   []string      `json:",omitempty"`
+}
+
+// NewHandler returns the handler of the plugin API, passing the requests
+// for volumes of the given scope on to d.
+func NewHandler(d Driver, scope string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path string, f func(req *request) *response) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			var req request
+			// Activate and List may come with an empty body.
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				writeResponse(w, http.StatusBadRequest, &response{Err: err.Error()})
+				return
+			}
+			clog.Debugf("%s %s", path, req.Name)
+			resp := f(&req)
+			status := http.StatusOK
+			if resp.Err != "" {
+				clog.Errorf("%s %s: %s", path, req.Name, resp.Err)
+				status = http.StatusInternalServerError
+			}
+			writeResponse(w, status, resp)
+		})
+	}
+	handle("/Plugin.Activate", func(*request) *response {
+		return &response{Implements: []string{"VolumeDriver"}}
+	})
+	handle("/VolumeDriver.Capabilities", func(*request) *response {
+		return &response{Capabilities: &capabilities{Scope: scope}}
+	})
+	handle("/VolumeDriver.Create", func(req *request) *response {
+		return errResponse(d.Create(req.Name, req.Opts))
+	})
+	handle("/VolumeDriver.Remove", func(req *request) *response {
+		return errResponse(d.Remove(req.Name))
+	})
+	handle("/VolumeDriver.Mount", func(req *request) *response {
+		mp, err := d.Mount(req.Name, req.ID)
+		if err != nil {
+			return errResponse(err)
+		}
+		return &response{Mountpoint: mp}
+	})
+	handle("/VolumeDriver.Unmount", func(req *request) *response {
+		return errResponse(d.Unmount(req.Name, req.ID))
+	})
+	handle("/VolumeDriver.Path", func(req *request) *response {
+		mp, err := d.Path(req.Name)
+		if err != nil {
+			return errResponse(err)
+		}
+		return &response{Mountpoint: mp}
+	})
+	handle("/VolumeDriver.Get", func(req *request) *response {
+		v, err := d.Get(req.Name)
+		if err != nil {
+			return errResponse(err)
+		}
+		return &response{Volume: v}
+	})
+	handle("/VolumeDriver.List", func(*request) *response {
+		vs, err := d.List()
+		if err != nil {
+			return errResponse(err)
+		}
+		return &response{Volumes: vs}
+	})
+	return mux
+}
+
+func errResponse(err error) *response {
+	if err != nil {
+		return &response{Err: err.Error()}
+	}
+	return &response{}
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp *response) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		clog.Errorf("couldn't write response: %v", err)
+	}
+}
+
+// ListenUnix listens on the plugin socket at path, replacing the socket a
+// previous run left behind.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
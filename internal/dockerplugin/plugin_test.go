@@ -0,0 +1,137 @@
+package dockerplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeDriver struct {
+	created map[string]map[string]string
+	mounts  map[string]string
+}
+
+func (d *fakeDriver) Create(name string, opts map[string]string) error {
+	if _, ok := d.created[name]; ok {
+		return errors.New("exists")
+	}
+	d.created[name] = opts
+	return nil
+}
+
+func (d *fakeDriver) Remove(name string) error {
+	delete(d.created, name)
+	return nil
+}
+
+func (d *fakeDriver) Mount(name, id string) (string, error) {
+	if owner, ok := d.mounts[name]; ok && owner != id {
+		return "", errors.New("volume is in use")
+	}
+	d.mounts[name] = id
+	return "/mnt/" + name, nil
+}
+
+func (d *fakeDriver) Unmount(name, id string) error {
+	delete(d.mounts, name)
+	return nil
+}
+
+func (d *fakeDriver) Path(name string) (string, error) {
+	if _, ok := d.mounts[name]; ok {
+		return "/mnt/" + name, nil
+	}
+	return "", nil
+}
+
+func (d *fakeDriver) Get(name string) (*Volume, error) {
+	if _, ok := d.created[name]; !ok {
+		return nil, errors.New("no such volume")
+	}
+	mp, _ := d.Path(name)
+	return &Volume{Name: name, Mountpoint: mp}, nil
+}
+
+func (d *fakeDriver) List() ([]*Volume, error) {
+	var out []*Volume
+	for name := range d.created {
+		v, _ := d.Get(name)
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func call(t *testing.T, h http.Handler, path, body string) (int, *response) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	if ct := w.Header().Get("Content-Type"); ct != contentType {
+		t.Fatalf("%s: unexpected content type %q", path, ct)
+	}
+	var resp response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return w.Code, &resp
+}
+
+func TestHandler(t *testing.T) {
+	d := &fakeDriver{
+		created: make(map[string]map[string]string),
+		mounts:  make(map[string]string),
+	}
+	h := NewHandler(d, ScopeGlobal)
+
+	_, resp := call(t, h, "/Plugin.Activate", "")
+	if len(resp.Implements) != 1 || resp.Implements[0] != "VolumeDriver" {
+		t.Fatalf("unexpected activation %+v", resp)
+	}
+	_, resp = call(t, h, "/VolumeDriver.Capabilities", "{}")
+	if resp.Capabilities == nil || resp.Capabilities.Scope != ScopeGlobal {
+		t.Fatalf("unexpected capabilities %+v", resp)
+	}
+
+	code, resp := call(t, h, "/VolumeDriver.Create", `{"Name":"vol01","Opts":{"size":"1GiB"}}`)
+	if code != http.StatusOK || resp.Err != "" {
+		t.Fatalf("create failed: %d %q", code, resp.Err)
+	}
+	if d.created["vol01"]["size"] != "1GiB" {
+		t.Fatalf("options didn't reach the driver: %v", d.created["vol01"])
+	}
+	code, resp = call(t, h, "/VolumeDriver.Create", `{"Name":"vol01"}`)
+	if code != http.StatusInternalServerError || resp.Err != "exists" {
+		t.Fatalf("expected the driver's error, got %d %q", code, resp.Err)
+	}
+
+	_, resp = call(t, h, "/VolumeDriver.Mount", `{"Name":"vol01","ID":"a"}`)
+	if resp.Err != "" || resp.Mountpoint != "/mnt/vol01" {
+		t.Fatalf("unexpected mount %+v", resp)
+	}
+	_, resp = call(t, h, "/VolumeDriver.Mount", `{"Name":"vol01","ID":"b"}`)
+	if resp.Err != "volume is in use" {
+		t.Fatalf("expected the second mount to fail, got %+v", resp)
+	}
+	_, resp = call(t, h, "/VolumeDriver.Get", `{"Name":"vol01"}`)
+	if resp.Volume == nil || resp.Volume.Mountpoint != "/mnt/vol01" {
+		t.Fatalf("unexpected volume %+v", resp.Volume)
+	}
+	_, resp = call(t, h, "/VolumeDriver.Unmount", `{"Name":"vol01","ID":"a"}`)
+	if resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	_, resp = call(t, h, "/VolumeDriver.Path", `{"Name":"vol01"}`)
+	if resp.Mountpoint != "" {
+		t.Fatalf("expected no mountpoint after unmounting, got %q", resp.Mountpoint)
+	}
+
+	_, resp = call(t, h, "/VolumeDriver.List", "")
+	if len(resp.Volumes) != 1 || resp.Volumes[0].Name != "vol01" {
+		t.Fatalf("unexpected volumes %+v", resp.Volumes)
+	}
+	code, _ = call(t, h, "/VolumeDriver.Create", `{"Name":`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected a bad request, got %d", code)
+	}
+}
@@ -0,0 +1,215 @@
+package flagconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// commands lists the tables a config file may have, one per command that
+// reads it.
+var commands = []string{"torusd", "torusctl", "torusblk"}
+
+// A fileEntry is a flag set by a config file.
+type fileEntry struct {
+	table string
+	key   string
+	value string
+	line  int
+}
+
+var (
+	bareKey   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	numberVal = regexp.MustCompile(`^[+-]?[0-9][0-9_]*(\.[0-9_]+)?$`)
+)
+
+// isFlagFile reports whether path is a config file setting flags, rather
+// than the JSON file of etcd profiles.
+func isFlagFile(path string) bool {
+	return filepath.Ext(path) == ".toml"
+}
+
+// ApplyConfigFile sets the flags of set from the file given by --config, if
+// it is a TOML file. Flags given on the command line are left alone, so they
+// override the file, which in turn overrides the defaults.
+//
+// The file holds one `flag-name = value` per line, in the subset of TOML
+// made of strings, numbers, booleans and arrays of strings; an array sets a
+// comma-separated flag. Keys before the first table apply to every command,
+// and keys in a [torusd], [torusctl] or [torusblk] table only to that one.
+// Keys that aren't flags of command are an error.
+func ApplyConfigFile(set *flag.FlagSet, command string) error {
+	if config == "" || !isFlagFile(config) {
+		return nil
+	}
+	f, err := os.Open(config)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", config, err)
+	}
+	defer f.Close()
+	entries, err := parseConfigFile(config, f)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.table != "" && e.table != command {
+			continue
+		}
+		fl := set.Lookup(e.key)
+		if fl == nil || e.key == "config" {
+			return fmt.Errorf("%s:%d: unknown key %q for %s", config, e.line, e.key, command)
+		}
+		if set.Changed(e.key) {
+			continue
+		}
+		if err := set.Set(e.key, e.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %s", config, e.line, e.key, err)
+		}
+	}
+	return nil
+}
+
+// parseConfigFile reads the entries of a config file; name is only used in
+// errors.
+func parseConfigFile(name string, r io.Reader) ([]fileEntry, error) {
+	var (
+		out   []fileEntry
+		table string
+		line  int
+		seen  = make(map[string]int)
+	)
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%s:%d: %s", name, line, fmt.Sprintf(format, args...))
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if text[0] == '[' {
+			end := strings.IndexByte(text, ']')
+			if end < 0 || !isComment(text[end+1:]) {
+				return nil, errorf("malformed table header %q", text)
+			}
+			table = strings.TrimSpace(text[1:end])
+			if !isCommand(table) {
+				return nil, errorf("unknown table [%s]; expected one of %s", table, strings.Join(commands, ", "))
+			}
+			continue
+		}
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			return nil, errorf("expected key = value")
+		}
+		key := strings.TrimSpace(text[:eq])
+		if !bareKey.MatchString(key) {
+			return nil, errorf("invalid key %q", key)
+		}
+		value, rest, err := parseValue(strings.TrimSpace(text[eq+1:]))
+		if err != nil {
+			return nil, errorf("%s: %s", key, err)
+		}
+		if !isComment(rest) {
+			return nil, errorf("%s: unexpected %q after value", key, strings.TrimSpace(rest))
+		}
+		if prev, ok := seen[table+"."+key]; ok {
+			return nil, errorf("%s is already set on line %d", key, prev)
+		}
+		seen[table+"."+key] = line
+		out = append(out, fileEntry{table: table, key: key, value: value, line: line})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", name, err)
+	}
+	return out, nil
+}
+
+// parseValue parses the value at the start of s into the string form flags
+// are set from, and returns the rest of s.
+func parseValue(s string) (string, string, error) {
+	if s == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"', '\'':
+		return parseString(s)
+	case '[':
+		var elems []string
+		rest := strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+				return "", "", fmt.Errorf("arrays may only hold strings, on a single line")
+			}
+			v, r, err := parseString(rest)
+			if err != nil {
+				return "", "", err
+			}
+			elems = append(elems, v)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+		return strings.Join(elems, ","), rest[1:], nil
+	}
+	end := strings.IndexAny(s, " \t#")
+	if end < 0 {
+		end = len(s)
+	}
+	v := s[:end]
+	switch {
+	case v == "true" || v == "false":
+	case numberVal.MatchString(v):
+		v = strings.Replace(v, "_", "", -1)
+	default:
+		return "", "", fmt.Errorf("invalid value %q; strings must be quoted", v)
+	}
+	return v, s[end:], nil
+}
+
+// parseString parses the double-quoted basic string or single-quoted literal
+// string at the start of s.
+func parseString(s string) (string, string, error) {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && q == '"':
+			i++
+		case s[i] == q:
+			if q == '\'' {
+				return s[1:i], s[i+1:], nil
+			}
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+func isCommand(s string) bool {
+	for _, c := range commands {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
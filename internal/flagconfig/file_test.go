@@ -0,0 +1,60 @@
+package flagconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	const file = `# Storage node settings
+etcd = ["https://10.0.0.1:2379", 'https://10.0.0.2:2379']
+etcd-ca-file = "/etc/torus/ca.pem" # trusted CA
+
+[torusd]
+data-dir = "/var/lib/torus"
+size = "20GiB"
+auto-join = true
+min-peers = 1_0
+
+[torusctl]
+debug = false
+`
+	entries, err := parseConfigFile("torusd.toml", strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileEntry{
+		{"", "etcd", "https://10.0.0.1:2379,https://10.0.0.2:2379", 2},
+		{"", "etcd-ca-file", "/etc/torus/ca.pem", 3},
+		{"torusd", "data-dir", "/var/lib/torus", 6},
+		{"torusd", "size", "20GiB", 7},
+		{"torusd", "auto-join", "true", 8},
+		{"torusd", "min-peers", "10", 9},
+		{"torusctl", "debug", "false", 12},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("expected %v, got %v", want, entries)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"size = 20GiB", "c.toml:1: size: invalid value"},
+		{"\n\ndata-dir = \"/a", "c.toml:3: data-dir: unterminated string"},
+		{"[torusd]\nsize = \"1GiB\"\nsize = \"2GiB\"", "c.toml:3: size is already set on line 2"},
+		{"[torus]", "c.toml:1: unknown table [torus]"},
+		{"etcd = [1, 2]", "c.toml:1: etcd: arrays may only hold strings"},
+		{"debug = true false", "c.toml:1: debug: unexpected \"false\" after value"},
+		{"just a line", "c.toml:1: expected key = value"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfigFile("c.toml", strings.NewReader(tt.file))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%q: expected error %q, got %v", tt.file, tt.err, err)
+		}
+	}
+}
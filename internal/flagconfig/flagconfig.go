@@ -7,11 +7,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alternative-storage/torus"
 	cli "github.com/alternative-storage/torus/cliconfig"
@@ -25,30 +27,98 @@ const (
 )
 
 var (
-	localBlockSizeStr string
-	localBlockSize    uint64
-	readCacheSizeStr  string
-	readCacheSize     uint64
-	readLevel         string
-	writeLevel        string
-	etcdAddress       string
-	etcdCertFile      string
-	etcdKeyFile       string
-	etcdCAFile        string
-	config            string
-	profile           string
+	localBlockSizeStr    string
+	localBlockSize       uint64
+	readCacheSizeStr     string
+	readCacheSize        uint64
+	cachePolicy          string
+	readaheadStr         string
+	writeBufferStr       string
+	writeCoalesce        time.Duration
+	readLevel            string
+	writeLevel           string
+	writeQuorum          int
+	maxVolumeMetrics     int
+	ringHistory          int
+	tempPersistPath      string
+	transferChunkSizeStr string
+	wireChecksum         bool
+	ioTimeout            time.Duration
+	hedgeAfter           time.Duration
+	maxHedges            int
+	maxPeerConns         int
+	maxBatchBytesStr     string
+	peerPoolSize         int
+	breakerThreshold     float64
+	breakerWindow        time.Duration
+	breakerProbe         time.Duration
+	auditLog             string
+	masterKeyFile        string
+	masterKeyEnv         string
+	peerCertFile         string
+	peerKeyFile          string
+	peerCAFile           string
+	etcdAddress          string
+	etcdCertFile         string
+	etcdKeyFile          string
+	etcdCAFile           string
+	metadataPrefix       string
+	etcdUsername         string
+	etcdPassword         string
+	etcdPasswordFile     string
+	metadataCacheSize    int
+	heartbeatInterval    time.Duration
+	inodeGCWindow        time.Duration
+	peerTimeout          time.Duration
+	config               string
+	profile              string
 )
 
 func AddConfigFlags(set *flag.FlagSet) {
 	set.StringVarP(&localBlockSizeStr, "write-cache-size", "", "128MiB", "Maximum amount of memory to use for the local write cache")
-	set.StringVarP(&readCacheSizeStr, "read-cache-size", "", "50MiB", "Amount of memory to use for read cache")
+	set.StringVarP(&readCacheSizeStr, "cache-size", "", "50MiB", "Amount of memory to cache blocks in (0 disables the cache)")
+	set.StringVarP(&readCacheSizeStr, "read-cache-size", "", "50MiB", "Amount of memory to cache blocks in (0 disables the cache)")
+	set.MarkDeprecated("read-cache-size", "use --cache-size instead")
+	set.StringVarP(&cachePolicy, "cache-policy", "", "lru", "How the cache picks blocks to evict: lru, or 2q to keep one-off reads such as scans from pushing out blocks read again and again")
+	set.StringVarP(&readaheadStr, "readahead", "", "4MiB", "Fetch up to this much of a file ahead of a sequential reader into the cache (0 disables readahead)")
+	set.DurationVarP(&writeCoalesce, "write-coalesce-window", "", 0, "Buffer the writes to a block volume for up to this long, applying those to the same block together (0 disables write coalescing)")
+	set.StringVarP(&writeBufferStr, "write-buffer-size", "", "16MiB", "Amount of memory the writes to each open block volume are buffered in when write coalescing is enabled")
 	set.StringVarP(&readLevel, "read-level", "", "block", "Read replication level (spread, seq or block)")
 	set.StringVarP(&writeLevel, "write-level", "", "all", "Write replication level (all, one or local)")
-	set.StringVarP(&etcdAddress, "etcd", "C", "", "Address for talking to etcd (default \"http://127.0.0.1:2379\")")
+	set.IntVarP(&writeQuorum, "write-quorum", "", 0, "Number of replicas that must acknowledge a write under write-level all (0 waits for every replica)")
+	set.IntVarP(&ringHistory, "ring-history", "", torus.DefaultRingHistory, "Number of the last rings set on the cluster to keep in the metadata service, for rolling back")
+	set.IntVarP(&maxVolumeMetrics, "max-volume-metrics", "", 64, "Maximum number of volumes to export per-volume metrics for; the rest are reported as \"other\"")
+	set.StringVarP(&tempPersistPath, "temp-persist-path", "", "", "File to persist the temp metadata service to, so it survives restarts (empty keeps it in memory only)")
+	set.StringVarP(&transferChunkSizeStr, "transfer-chunk-size", "", "0", "Split blocks sent between peers into frames of this size (tdp protocol only; 0 sends whole blocks)")
+	set.BoolVarP(&wireChecksum, "wire-checksum", "", false, "Checksum blocks sent between peers and refuse corrupted transfers (tdp protocol only; all peers must support it)")
+	set.DurationVarP(&ioTimeout, "io-timeout", "", 0, "Fail block reads and writes that take longer than this, trying other replicas first for reads (0 waits indefinitely)")
+	set.DurationVarP(&hedgeAfter, "hedge-after", "", 0, "Also read a block from the next replica if the first hasn't answered within this long, taking whichever answers first (0 disables hedged reads)")
+	set.IntVarP(&maxHedges, "max-hedges", "", 16, "Maximum number of hedged reads in flight at once")
+	set.StringVarP(&maxBatchBytesStr, "max-batch-bytes", "", "4MiB", "Fetch runs of blocks a sequential read needs from the same peer in requests of up to this size (tdp protocol only; 0 fetches one block at a time)")
+	set.IntVarP(&maxPeerConns, "max-peer-conns", "", 0, "Maximum number of connections open to other peers at once, closing idle ones to make room (0 is unlimited)")
+	set.IntVarP(&peerPoolSize, "peer-pool-size", "", 1, "Number of connections to open to each peer, so that requests to it don't wait on one another")
+	set.Float64VarP(&breakerThreshold, "breaker-threshold", "", 0.5, "Fraction of the requests to a peer that may fail within the breaker window before requests to it fail right away (0 disables circuit breaking)")
+	set.DurationVarP(&breakerWindow, "breaker-window", "", 10*time.Second, "How far back the failures of requests to a peer are counted")
+	set.DurationVarP(&breakerProbe, "breaker-probe-interval", "", 5*time.Second, "How often a single request is let through to a peer whose circuit is open, to find out whether it has recovered")
+	set.StringVarP(&auditLog, "audit-log", "", "", "File to append a record of ring changes and other administrative operations to")
+	set.StringVarP(&masterKeyFile, "master-key-file", "", "", "File holding the hex-encoded master key that encrypted volumes' keys are wrapped with")
+	set.StringVarP(&masterKeyEnv, "master-key-env", "", "TORUS_MASTER_KEY", "Environment variable holding the master key, if no master-key-file is given")
+	set.StringVarP(&peerCertFile, "peer-cert-file", "", "", "Certificate this node presents to other peers, securing replication with mutually authenticated TLS (needs --peer-key-file and --peer-ca-file)")
+	set.StringVarP(&peerKeyFile, "peer-key-file", "", "", "Key for the peer certificate")
+	set.StringVarP(&peerCAFile, "peer-ca-file", "", "", "CA that peer certificates must be signed by")
+	set.StringVarP(&etcdAddress, "etcd", "C", "", "Comma-separated addresses for talking to etcd (default \"http://127.0.0.1:2379\"), or a consul://host:port address to keep metadata in Consul instead")
 	set.StringVarP(&etcdCertFile, "etcd-cert-file", "", "", "Certificate to use to authenticate against etcd")
 	set.StringVarP(&etcdKeyFile, "etcd-key-file", "", "", "Key for Certificate")
 	set.StringVarP(&etcdCAFile, "etcd-ca-file", "", "", "CA to authenticate etcd against")
-	set.StringVarP(&config, "config", "", "", "path to torus config file")
+	set.StringVarP(&metadataPrefix, "metadata-prefix", "", "", "Key prefix to keep torus metadata under in etcd, for sharing etcd with others; every node and client of the cluster must use the same one (default \"/github.com/alternative-storage/torus\")")
+	set.StringVarP(&etcdUsername, "etcd-username", "", "", "User to log in to etcd as, on clusters with auth enabled")
+	set.StringVarP(&etcdPassword, "etcd-password", "", "", "Password of --etcd-username")
+	set.StringVarP(&etcdPasswordFile, "etcd-password-file", "", "", "File holding the password of --etcd-username, in place of --etcd-password")
+	set.IntVarP(&metadataCacheSize, "metadata-cache-size", "", 1024, "Number of volume and INode lookups to cache from etcd, kept current by watching it (negative disables the cache)")
+	set.DurationVarP(&inodeGCWindow, "inode-gc-window", "", 24*time.Hour, "How long an INode a writer allocated may go uncommitted before its blocks are collected as left behind by a crash; must be longer than any writer goes between syncs (0 never collects them)")
+	set.DurationVarP(&heartbeatInterval, "heartbeat-interval", "", torus.DefaultHeartbeatInterval, "How often to renew this node's lease and registration in the metadata service")
+	set.DurationVarP(&peerTimeout, "peer-timeout", "", 0, "How long a peer may go without a heartbeat before the cluster considers it missing; set when the cluster is initialized, and must be more than twice the heartbeat interval (default 30s)")
+	set.StringVarP(&config, "config", "", "", "path to torus config file: a .toml file setting any of the flags, or a JSON file of etcd profiles")
 	set.StringVarP(&profile, "profile", "", "default", "profile to use in torus config file")
 }
 
@@ -84,7 +154,8 @@ func BuildConfigFromFlags() torus.Config {
 	if config == "" {
 		config = defaultConfigPath()
 	}
-	if config != "" {
+	// TOML files were applied to the flags already, by ApplyConfigFile.
+	if config != "" && !isFlagFile(config) {
 		conf, err := LoadConfigFile(config)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, err.Error())
@@ -106,7 +177,27 @@ func BuildConfigFromFlags() torus.Config {
 
 	readCacheSize, err = humanize.ParseBytes(readCacheSizeStr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing read-cache-size: %s\n", err)
+		fmt.Fprintf(os.Stderr, "error parsing cache-size: %s\n", err)
+		os.Exit(1)
+	}
+	switch cachePolicy {
+	case "lru", "2q":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid cache-policy %q: must be lru or 2q\n", cachePolicy)
+		os.Exit(1)
+	}
+	readahead, err := humanize.ParseBytes(readaheadStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing readahead: %s\n", err)
+		os.Exit(1)
+	}
+	if writeCoalesce < 0 {
+		fmt.Fprintf(os.Stderr, "write-coalesce-window must not be negative: %s\n", writeCoalesce)
+		os.Exit(1)
+	}
+	writeBuffer, err := humanize.ParseBytes(writeBufferStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing write-buffer-size: %s\n", err)
 		os.Exit(1)
 	}
 	localBlockSize, err = humanize.ParseBytes(localBlockSizeStr)
@@ -127,18 +218,155 @@ func BuildConfigFromFlags() torus.Config {
 		os.Exit(1)
 	}
 
+	if writeQuorum < 0 {
+		fmt.Fprintf(os.Stderr, "write-quorum must not be negative: %d\n", writeQuorum)
+		os.Exit(1)
+	}
+
+	if ringHistory < 1 {
+		fmt.Fprintf(os.Stderr, "ring-history must be at least 1: %d\n", ringHistory)
+		os.Exit(1)
+	}
+
+	if maxVolumeMetrics < 0 {
+		fmt.Fprintf(os.Stderr, "max-volume-metrics must not be negative: %d\n", maxVolumeMetrics)
+		os.Exit(1)
+	}
+
+	transferChunkSize, err := humanize.ParseBytes(transferChunkSizeStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing transfer-chunk-size: %s\n", err)
+		os.Exit(1)
+	}
+	if transferChunkSize > math.MaxUint32 {
+		fmt.Fprintf(os.Stderr, "transfer-chunk-size must be less than 4GiB: %s\n", transferChunkSizeStr)
+		os.Exit(1)
+	}
+
+	if ioTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "io-timeout must not be negative: %s\n", ioTimeout)
+		os.Exit(1)
+	}
+
+	if hedgeAfter < 0 {
+		fmt.Fprintf(os.Stderr, "hedge-after must not be negative: %s\n", hedgeAfter)
+		os.Exit(1)
+	}
+
+	if maxHedges < 0 {
+		fmt.Fprintf(os.Stderr, "max-hedges must not be negative: %d\n", maxHedges)
+		os.Exit(1)
+	}
+
+	if maxPeerConns < 0 {
+		fmt.Fprintf(os.Stderr, "max-peer-conns must not be negative: %d\n", maxPeerConns)
+		os.Exit(1)
+	}
+
+	if peerPoolSize < 0 {
+		fmt.Fprintf(os.Stderr, "peer-pool-size must not be negative: %d\n", peerPoolSize)
+		os.Exit(1)
+	}
+
+	if breakerThreshold < 0 || breakerThreshold > 1 {
+		fmt.Fprintf(os.Stderr, "breaker-threshold must be between 0 and 1: %g\n", breakerThreshold)
+		os.Exit(1)
+	}
+
+	if breakerWindow < 0 {
+		fmt.Fprintf(os.Stderr, "breaker-window must not be negative: %s\n", breakerWindow)
+		os.Exit(1)
+	}
+
+	if breakerProbe < 0 {
+		fmt.Fprintf(os.Stderr, "breaker-probe-interval must not be negative: %s\n", breakerProbe)
+		os.Exit(1)
+	}
+
+	maxBatchBytes, err := humanize.ParseBytes(maxBatchBytesStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing max-batch-bytes: %s\n", err)
+		os.Exit(1)
+	}
+
+	if inodeGCWindow < 0 {
+		fmt.Fprintf(os.Stderr, "inode-gc-window must not be negative: %s\n", inodeGCWindow)
+		os.Exit(1)
+	}
+
+	if peerTimeout != 0 {
+		if err := torus.CheckPeerTimeout(heartbeatInterval, peerTimeout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	if etcdAddress == "" {
 		etcdAddress = defaultEtcdAddress
 	}
 
 	cfg := torus.Config{
-		StorageSize:     localBlockSize,
-		ReadCacheSize:   readCacheSize,
-		WriteLevel:      wl,
-		ReadLevel:       rl,
-		MetadataAddress: etcdAddress,
+		StorageSize:          localBlockSize,
+		ReadCacheSize:        readCacheSize,
+		CachePolicy:          cachePolicy,
+		ReadaheadMaxBytes:    readahead,
+		WriteCoalesceWindow:  writeCoalesce,
+		WriteBufferBytes:     writeBuffer,
+		WriteLevel:           wl,
+		ReadLevel:            rl,
+		WriteQuorum:          writeQuorum,
+		MaxVolumeMetrics:     maxVolumeMetrics,
+		RingHistory:          ringHistory,
+		TempPersistPath:      tempPersistPath,
+		TransferChunkSize:    transferChunkSize,
+		WireChecksum:         wireChecksum,
+		IOTimeout:            ioTimeout,
+		HedgeAfter:           hedgeAfter,
+		MaxHedges:            maxHedges,
+		MaxPeerConns:         maxPeerConns,
+		MaxBatchBytes:        maxBatchBytes,
+		PeerPoolSize:         peerPoolSize,
+		BreakerThreshold:     breakerThreshold,
+		BreakerWindow:        breakerWindow,
+		BreakerProbeInterval: breakerProbe,
+		AuditLog:             auditLog,
+		MasterKeyFile:        masterKeyFile,
+		MasterKeyEnv:         masterKeyEnv,
+		PeerCertFile:         peerCertFile,
+		PeerKeyFile:          peerKeyFile,
+		PeerCAFile:           peerCAFile,
+		MetadataAddress:      etcdAddress,
+		MetadataPrefix:       metadataPrefix,
+		MetadataUsername:     etcdUsername,
+		MetadataPassword:     etcdPassword,
+		MetadataCacheSize:    metadataCacheSize,
+		INodeGCWindow:        inodeGCWindow,
+		HeartbeatInterval:    heartbeatInterval,
+		PeerTimeout:          peerTimeout,
+	}
+	if etcdPasswordFile != "" {
+		if etcdPassword != "" {
+			fmt.Fprintln(os.Stderr, "etcd-password and etcd-password-file are mutually exclusive")
+			os.Exit(1)
+		}
+		pw, err := ioutil.ReadFile(etcdPasswordFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't read etcd password file: %s\n", err)
+			os.Exit(1)
+		}
+		cfg.MetadataPassword = strings.TrimRight(string(pw), "\r\n")
+	}
+	if cfg.MetadataPassword != "" && cfg.MetadataUsername == "" {
+		fmt.Fprintln(os.Stderr, "an etcd password needs an etcd-username")
+		os.Exit(1)
+	}
+	if _, err := torus.LoadPeerTLS(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	etcdURL, err := url.Parse(etcdAddress)
+	// The first address names the server for TLS; the others are expected
+	// to share its certificate.
+	etcdURL, err := url.Parse(strings.Split(etcdAddress, ",")[0])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "invalid etcd address: %s", err)
 		os.Exit(1)
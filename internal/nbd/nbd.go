@@ -15,6 +15,9 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -30,6 +33,7 @@ const (
 	ioctlClearQueue    = 43781
 	ioctlSetSizeBlocks = 43783
 	ioctlDisconnect    = 43784
+	ioctlSetTimeout    = 43785
 	ioctlSetFlags      = 43786
 )
 
@@ -45,11 +49,15 @@ const (
 	flagHasFlags  = (1 << 0) // nbd-server supports flags
 	flagSendFlush = (1 << 2) // can flush writeback cache
 	flagSendTrim  = (1 << 5) // Send TRIM (discard)
-	// flagReadOnly   = (1 << 1) // device is read-only
-	// flagSendFUA    = (1 << 3) // Send FUA (Force Unit Access)
+	flagReadOnly  = (1 << 1) // device is read-only
+	flagSendFUA   = (1 << 3) // Send FUA (Force Unit Access)
 	// flagRotational = (1 << 4) // Use elevator algorithm - rotational media
 )
 
+const (
+	cmdFlagFUA = (1 << 0) // write must be durable before the reply
+)
+
 const (
 	magicRequest = 0x25609513
 	magicReply   = 0x67446698
@@ -79,6 +87,29 @@ type Device interface {
 	Close() error
 }
 
+// contextDevice is implemented by devices that can serve a request as part of
+// its trace, carried in ctx.
+type contextDevice interface {
+	ReadAtContext(ctx context.Context, b []byte, off int64) (n int, err error)
+	WriteAtContext(ctx context.Context, b []byte, off int64) (n int, err error)
+	SyncContext(ctx context.Context) error
+}
+
+// readOnlyDevice is implemented by devices that may refuse writes. Such
+// devices are exported with the read-only flag set.
+type readOnlyDevice interface {
+	IsReadOnly() bool
+}
+
+// deviceFlags returns the flags describing what a device supports.
+func deviceFlags(dev Device) uint16 {
+	flags := uint16(flagSendFlush | flagSendTrim | flagSendFUA)
+	if ro, ok := dev.(readOnlyDevice); ok && ro.IsReadOnly() {
+		flags |= flagReadOnly
+	}
+	return flags
+}
+
 // NBD implements nbd device operations.
 type NBD struct {
 	device    Device
@@ -88,6 +119,9 @@ type NBD struct {
 	socket    int
 	setsocket int
 	closer    chan error
+	// timeout is how long the kernel waits for a request to be answered
+	// before failing it, or zero to leave it at the kernel's default.
+	timeout time.Duration
 }
 
 func Create(device Device, size int64, blocksize int64) *NBD {
@@ -134,6 +168,25 @@ func (nbd *NBD) SetBlockSize(blocksize int64) error {
 	return nil
 }
 
+// SetTimeout sets how long the kernel waits for a request to the device to
+// be answered before failing it, rounded up to a second. It takes effect
+// when the device is served.
+func (nbd *NBD) SetTimeout(d time.Duration) {
+	nbd.timeout = d
+}
+
+func (nbd *NBD) setKernelTimeout() error {
+	secs := (nbd.timeout + time.Second - 1) / time.Second
+	if err := ioctl(nbd.nbd.Fd(), ioctlSetTimeout, uintptr(secs)); err != nil {
+		return &os.PathError{
+			Path: nbd.nbd.Name(),
+			Op:   "ioctl NBD_SET_TIMEOUT",
+			Err:  err,
+		}
+	}
+	return nil
+}
+
 func FindDevice() (string, error) {
 	// FIXME: Oh god... fixme.
 	// find free nbd device
@@ -186,7 +239,12 @@ func (nbd *NBD) Serve() error {
 		// even when disconnected. Changing it only when connected is fine -- but keep my intent.
 		blksized = false
 	}
-	if err := ioctl(nbd.nbd.Fd(), ioctlSetFlags, uintptr(flagSendFlush|flagSendTrim)); err != nil {
+	if nbd.timeout > 0 {
+		if err := nbd.setKernelTimeout(); err != nil {
+			return err
+		}
+	}
+	if err := ioctl(nbd.nbd.Fd(), ioctlSetFlags, uintptr(deviceFlags(nbd.device))); err != nil {
 		switch err {
 		case syscall.ENOTTY:
 			clog.Error(fmt.Sprintf("ioctl returned: %v. kernel version may be old. flush thread will run every 30sec", err))
@@ -316,7 +374,7 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 			return fmt.Errorf("nbd: invalid magic: 0x%x", magic)
 		}
 
-		cmd, _ := hdr.command()
+		cmd, cmdFlags := hdr.command()
 		if cmd == cmdWrite {
 			buf = hdr.resize(buf)
 			if _, err := io.ReadFull(c.rw, buf[16:]); err != nil {
@@ -324,16 +382,22 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 			}
 		}
 		c.mu.Unlock()
+		span, ctx := startRequestSpan(cmd, hdr)
 		switch cmd {
 		case cmdRead:
 			buf = hdr.resize(buf)
-			if _, err := dev.ReadAt(buf[16:], hdr.offset()); err != nil {
+			if _, err := readAt(ctx, dev, buf[16:], hdr.offset()); err != nil {
 				hdr.putReplyHeader(buf, errIO)
 			} else {
 				hdr.putReplyHeader(buf, 0)
 			}
 		case cmdWrite:
-			if _, err := dev.WriteAt(buf[16:], hdr.offset()); err != nil {
+			_, err := writeAt(ctx, dev, buf[16:], hdr.offset())
+			if err == nil && cmdFlags&cmdFlagFUA != 0 {
+				err = syncDevice(ctx, dev)
+			}
+			if err != nil {
+				clog.Printf("write error: %s", err)
 				hdr.putReplyHeader(buf, errIO)
 			} else {
 				hdr.putReplyHeader(buf, 0)
@@ -345,20 +409,27 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 			}
 			fallthrough
 		case cmdFlush:
-			if err := dev.Sync(); err != nil {
+			// Only acknowledge a flush once the writes before it are
+			// durable; the kernel passes the error on to fsync.
+			if err := syncDevice(ctx, dev); err != nil {
 				clog.Printf("sync error: %s", err)
+				hdr.putReplyHeader(buf, errIO)
+			} else {
+				hdr.putReplyHeader(buf, 0)
 			}
-			hdr.putReplyHeader(buf, 0)
 			buf = buf[:16]
 		case cmdDisc:
 			// FIXME: We're actually supposed to wait for outstanding requests to finish.
-			if err := dev.Sync(); err != nil {
+			if err := syncDevice(ctx, dev); err != nil {
 				clog.Printf("sync error: %s", err)
 			}
+			span.Finish()
 			return c.rw.Close()
 		default:
+			span.Finish()
 			return errors.New("nbd: invalid command")
 		}
+		span.Finish()
 
 		// FIXME: Are we sure this whole write is going to be atomic?
 		if _, err := c.rw.Write(buf); err != nil {
@@ -367,6 +438,43 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 	}
 }
 
+var cmdNames = map[uint16]string{
+	cmdRead:  "read",
+	cmdWrite: "write",
+	cmdDisc:  "disconnect",
+	cmdFlush: "flush",
+	cmdTrim:  "trim",
+}
+
+// startRequestSpan starts the span that a request's trace begins with.
+func startRequestSpan(cmd uint16, hdr *reqHeader) (opentracing.Span, context.Context) {
+	span := opentracing.GlobalTracer().StartSpan("nbd: " + cmdNames[cmd])
+	span.SetTag("offset", hdr.offset())
+	span.SetTag("length", hdr.length())
+	return span, opentracing.ContextWithSpan(context.Background(), span)
+}
+
+func readAt(ctx context.Context, dev Device, b []byte, off int64) (int, error) {
+	if cd, ok := dev.(contextDevice); ok {
+		return cd.ReadAtContext(ctx, b, off)
+	}
+	return dev.ReadAt(b, off)
+}
+
+func writeAt(ctx context.Context, dev Device, b []byte, off int64) (int, error) {
+	if cd, ok := dev.(contextDevice); ok {
+		return cd.WriteAtContext(ctx, b, off)
+	}
+	return dev.WriteAt(b, off)
+}
+
+func syncDevice(ctx context.Context, dev Device) error {
+	if cd, ok := dev.(contextDevice); ok {
+		return cd.SyncContext(ctx)
+	}
+	return dev.Sync()
+}
+
 type reqHeader [28]byte
 
 func (h *reqHeader) command() (cmd, flags uint16) {
@@ -2,9 +2,12 @@ package nbd
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,11 +26,22 @@ const (
 	nbdOptExportName = 0x1
 	nbdOptAbort      = 0x2
 	nbdOptList       = 0x3
+	nbdOptInfo       = 0x6
+	nbdOptGo         = 0x7
 
 	// option replies
-	nbdRepAck      = 0x1
-	nbdRepServer   = 0x2
-	nbdRepErrUnsup = 0x80000001
+	nbdRepAck        = 0x1
+	nbdRepServer     = 0x2
+	nbdRepInfo       = 0x3
+	nbdRepErrUnsup   = 0x80000001
+	nbdRepErrInvalid = 0x80000003
+	nbdRepErrUnknown = 0x80000006
+
+	nbdInfoExport = 0x0
+
+	// maxOptLen bounds the data of an option, which is at most an export
+	// name and a few info requests for the options we support.
+	maxOptLen = 4096 + 64
 
 	tcpKeepAlive = 10 * time.Second
 )
@@ -37,18 +51,19 @@ type DeviceFinder interface {
 	ListDevices() ([]string, error)
 }
 
+// errAbort is returned when the client ends the handshake.
+var errAbort = errors.New("nbd: client aborted the handshake")
+
 type NBDServer struct {
-	l      *net.TCPListener
+	l      net.Listener
 	finder DeviceFinder
 }
 
+// NewNBDServer listens for NBD clients on addr, which is either a TCP
+// address, optionally prefixed with "tcp:", or "unix:" followed by the path of
+// a Unix socket.
 func NewNBDServer(addr string, finder DeviceFinder) (*NBDServer, error) {
-	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-
-	ln, err := net.ListenTCP("tcp", tcpaddr)
+	ln, err := listen(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -61,15 +76,42 @@ func NewNBDServer(addr string, finder DeviceFinder) (*NBDServer, error) {
 	return ns, nil
 }
 
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	ln, err := net.Listen("unix", path)
+	if err == nil {
+		return ln, nil
+	}
+	// A socket left behind by a server that died can be replaced, but not
+	// one another server still answers on.
+	fi, serr := os.Stat(path)
+	if serr != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil, err
+	}
+	if c, derr := net.Dial("unix", path); derr == nil {
+		c.Close()
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
 func (s *NBDServer) Serve() error {
 	for {
-		c, err := s.l.AcceptTCP()
+		c, err := s.l.Accept()
 		if err != nil {
 			return err
 		}
 
-		c.SetKeepAlive(true)
-		c.SetKeepAlivePeriod(tcpKeepAlive)
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(tcpKeepAlive)
+		}
 
 		conn := &NBDConn{
 			c:      c,
@@ -138,23 +180,30 @@ func (c *NBDConn) handler() error {
 	c.tracef("reading options")
 
 	// get options
-	if err := c.options(); err != nil {
+	gone, err := c.options()
+	if err == errAbort {
+		c.tracef("client aborted")
+		return nil
+	}
+	if err != nil {
 		return fmt.Errorf("handshake failure: %v", err)
 	}
 
-	// send transmission flags
-	if err := binary.Write(c.c, binary.BigEndian, c.device.Size()); err != nil {
-		return err
-	}
+	// NBD_OPT_GO has already sent the size and transmission flags.
+	if !gone {
+		if err := binary.Write(c.c, binary.BigEndian, c.device.Size()); err != nil {
+			return err
+		}
 
-	if err := binary.Write(c.c, binary.BigEndian, uint16(flagHasFlags|flagSendFlush|flagSendTrim)); err != nil {
-		return err
-	}
+		if err := binary.Write(c.c, binary.BigEndian, flagHasFlags|deviceFlags(c.device)); err != nil {
+			return err
+		}
 
-	// reserved zero pad
-	zpad := make([]byte, 124)
-	if err := writeFull(c.c, zpad); err != nil {
-		return err
+		// reserved zero pad
+		zpad := make([]byte, 124)
+		if err := writeFull(c.c, zpad); err != nil {
+			return err
+		}
 	}
 
 	c.tracef("serving")
@@ -179,40 +228,46 @@ func (c *NBDConn) handler() error {
 	return nil
 }
 
-// do nbd option exchange and return once export name is given.
-func (c *NBDConn) options() error {
+// do nbd option exchange and return once the client picked an export, with
+// NBD_OPT_EXPORT_NAME, or with NBD_OPT_GO, in which case gone is set.
+func (c *NBDConn) options() (gone bool, err error) {
 	for {
 		opt, err := c.getOpt()
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		switch opt.opt {
 		case nbdOptExportName:
 			if len(opt.data) == 0 {
-				return fmt.Errorf("nbdserve doesn't support empty volume name. client needs to specify it")
+				return false, fmt.Errorf("nbdserve doesn't support empty volume name. client needs to specify it")
 			}
 			dev, err := c.finder.FindDevice(string(opt.data))
 			if err != nil {
 				// terminate the connection on failure
-				return err
+				return false, err
 			}
 
 			c.device = dev
 			c.export = string(opt.data)
 
 			// got dev, done with options.
-			return nil
+			return false, nil
+		case nbdOptInfo, nbdOptGo:
+			done, err := c.optGo(opt)
+			if err != nil || done {
+				return done, err
+			}
 		case nbdOptAbort:
-			if err := c.optReply(nbdOptList, nbdRepAck, nil); err != nil {
-				return err
+			if err := c.optReply(nbdOptAbort, nbdRepAck, nil); err != nil {
+				return false, err
 			}
 
-			return nil
+			return false, errAbort
 		case nbdOptList:
 			devs, err := c.finder.ListDevices()
 			if err != nil {
-				return err
+				return false, err
 			}
 
 			for _, d := range devs {
@@ -221,21 +276,60 @@ func (c *NBDConn) options() error {
 				binary.BigEndian.PutUint32(buf[0:4], uint32(len(d)))
 				copy(buf[4:], []byte(d))
 				if err := c.optReply(nbdOptList, nbdRepServer, buf); err != nil {
-					return err
+					return false, err
 				}
 			}
 
 			if err := c.optReply(nbdOptList, nbdRepAck, nil); err != nil {
-				return err
+				return false, err
 			}
 		default:
 			if err := c.optReply(opt.opt, nbdRepErrUnsup, nil); err != nil {
-				return err
+				return false, err
 			}
 		}
 	}
 }
 
+// optGo answers NBD_OPT_INFO or NBD_OPT_GO with the size and flags of the
+// export named, returning whether the client went on to use it. Clients
+// asking for an export that can't be opened get an error and may go on
+// with other options.
+func (c *NBDConn) optGo(opt *option) (bool, error) {
+	// export name length, export name, number of info requests, requests
+	d := opt.data
+	if len(d) < 4 || uint32(len(d)-4) < binary.BigEndian.Uint32(d) {
+		return false, c.optReply(opt.opt, nbdRepErrInvalid, nil)
+	}
+	name := string(d[4 : 4+binary.BigEndian.Uint32(d)])
+	if name == "" {
+		return false, c.optReply(opt.opt, nbdRepErrUnknown, []byte("an export name is required"))
+	}
+	dev, err := c.finder.FindDevice(name)
+	if err != nil {
+		c.errorf("can't open export %s: %v", name, err)
+		return false, c.optReply(opt.opt, nbdRepErrUnknown, []byte(err.Error()))
+	}
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info[0:2], nbdInfoExport)
+	binary.BigEndian.PutUint64(info[2:10], dev.Size())
+	binary.BigEndian.PutUint16(info[10:12], flagHasFlags|deviceFlags(dev))
+	if err := c.optReply(opt.opt, nbdRepInfo, info); err != nil {
+		dev.Close()
+		return false, err
+	}
+	if err := c.optReply(opt.opt, nbdRepAck, nil); err != nil {
+		dev.Close()
+		return false, err
+	}
+	if opt.opt == nbdOptInfo {
+		return false, dev.Close()
+	}
+	c.device = dev
+	c.export = name
+	return true, nil
+}
+
 func writeFull(w io.Writer, buf []byte) error {
 	n, err := w.Write(buf)
 	if err != nil {
@@ -286,29 +380,18 @@ func (c *NBDConn) getOpt() (*option, error) {
 		return nil, err
 	}
 
-	if optLen > 4096 {
+	if optLen > maxOptLen {
 		return nil, fmt.Errorf("strange option length: %d", optLen)
 	}
 
-	switch opt {
-	case nbdOptExportName:
-		o := &option{
-			opt:  opt,
-			data: make([]byte, optLen),
-		}
-
-		if optLen > 0 {
-			if _, err := io.ReadFull(c.c, o.data); err != nil {
-				return nil, err
-			}
-		}
-
-		return o, nil
-	case nbdOptAbort, nbdOptList:
-		return &option{opt: opt}, nil
-	default:
-		return nil, fmt.Errorf("unknown option %032b", opt)
+	o := &option{
+		opt:  opt,
+		data: make([]byte, optLen),
+	}
+	if _, err := io.ReadFull(c.c, o.data); err != nil {
+		return nil, err
 	}
+	return o, nil
 }
 
 func (c *NBDConn) Close() error {
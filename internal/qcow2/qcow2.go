@@ -0,0 +1,197 @@
+// Package qcow2 reads the disk images of qemu's qcow2 format, versions 2 and
+// 3, as long as they have no backing file and aren't compressed or
+// encrypted.
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	// offsetMask picks the host offset out of an L1 or L2 entry.
+	offsetMask = 0x00fffffffffffe00
+	// compressedFlag marks an L2 entry for a compressed cluster.
+	compressedFlag = 1 << 62
+	// zeroFlag marks an L2 entry for a cluster that reads as zeroes.
+	zeroFlag = 1
+
+	// incompatDirty is the only incompatible feature we can read an image
+	// with: its refcounts may be stale, which reading doesn't care about.
+	incompatDirty = 1
+)
+
+// ErrNotQcow2 is returned when opening an image that isn't a qcow2 image.
+var ErrNotQcow2 = errors.New("qcow2: not a qcow2 image")
+
+// Image is an open qcow2 image. It reads back as the guest sees the disk;
+// clusters never written read as zeroes.
+type Image struct {
+	r           io.ReaderAt
+	size        uint64
+	clusterBits uint
+	l2Bits      uint
+	l1          []uint64
+
+	// l2 is the L2 table last read, at l2Offset, as reads are mostly
+	// sequential.
+	l2Offset uint64
+	l2       []uint64
+}
+
+// IsQcow2 reports whether r starts with the magic of a qcow2 image.
+func IsQcow2(r io.ReaderAt) bool {
+	b := make([]byte, len(magic))
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return false
+	}
+	return string(b) == string(magic)
+}
+
+// Open reads the header and L1 table of the image in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	hdr := make([]byte, 104)
+	n, err := r.ReadAt(hdr, 0)
+	if n < 72 {
+		if err == nil || err == io.EOF {
+			return nil, ErrNotQcow2
+		}
+		return nil, err
+	}
+	if string(hdr[:4]) != string(magic) {
+		return nil, ErrNotQcow2
+	}
+	be := binary.BigEndian
+	version := be.Uint32(hdr[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("qcow2: version %d isn't supported", version)
+	}
+	if be.Uint64(hdr[8:]) != 0 {
+		return nil, errors.New("qcow2: images with a backing file aren't supported")
+	}
+	if be.Uint32(hdr[32:]) != 0 {
+		return nil, errors.New("qcow2: encrypted images aren't supported")
+	}
+	if version == 3 {
+		if n < 104 {
+			return nil, ErrNotQcow2
+		}
+		if f := be.Uint64(hdr[72:]) &^ incompatDirty; f != 0 {
+			return nil, fmt.Errorf("qcow2: image has unsupported incompatible features %#x", f)
+		}
+	}
+	img := &Image{
+		r:           r,
+		size:        be.Uint64(hdr[24:]),
+		clusterBits: uint(be.Uint32(hdr[20:])),
+	}
+	if img.clusterBits < 9 || img.clusterBits > 21 {
+		return nil, fmt.Errorf("qcow2: invalid cluster size 2^%d", img.clusterBits)
+	}
+	img.l2Bits = img.clusterBits - 3
+	l1Size := be.Uint32(hdr[36:])
+	// Enough L1 entries for the whole disk.
+	perL1 := uint64(1) << (img.clusterBits + img.l2Bits)
+	if uint64(l1Size) < (img.size+perL1-1)/perL1 {
+		return nil, errors.New("qcow2: L1 table is too small for the image size")
+	}
+	img.l1, err = img.readTable(be.Uint64(hdr[40:]), int(l1Size))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Size returns the size of the disk in bytes.
+func (img *Image) Size() uint64 {
+	return img.size
+}
+
+// ClusterSize returns the size of the image's clusters in bytes.
+func (img *Image) ClusterSize() uint64 {
+	return 1 << img.clusterBits
+}
+
+func (img *Image) readTable(off uint64, n int) ([]uint64, error) {
+	b := make([]byte, n*8)
+	if _, err := img.r.ReadAt(b, int64(off)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("qcow2: couldn't read table at %d: %v", off, err)
+	}
+	out := make([]uint64, n)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint64(b[i*8:])
+	}
+	return out, nil
+}
+
+// cluster returns the host offset of the cluster holding the guest offset
+// off, or 0 if it reads as zeroes.
+func (img *Image) cluster(off uint64) (uint64, error) {
+	l1i := off >> (img.clusterBits + img.l2Bits)
+	l2Offset := img.l1[l1i] & offsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	if l2Offset != img.l2Offset || img.l2 == nil {
+		l2, err := img.readTable(l2Offset, 1<<img.l2Bits)
+		if err != nil {
+			return 0, err
+		}
+		img.l2Offset, img.l2 = l2Offset, l2
+	}
+	e := img.l2[(off>>img.clusterBits)&(1<<img.l2Bits-1)]
+	if e&compressedFlag != 0 {
+		return 0, fmt.Errorf("qcow2: cluster at %d is compressed, which isn't supported", off)
+	}
+	if e&zeroFlag != 0 {
+		return 0, nil
+	}
+	return e & offsetMask, nil
+}
+
+// ReadAt reads the guest's disk. It isn't safe to call concurrently.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+	var n int
+	for len(p) > 0 {
+		if uint64(off) >= img.size {
+			return n, io.EOF
+		}
+		csize := img.ClusterSize()
+		in := uint64(off) & (csize - 1)
+		chunk := csize - in
+		if rest := img.size - uint64(off); chunk > rest {
+			chunk = rest
+		}
+		if chunk > uint64(len(p)) {
+			chunk = uint64(len(p))
+		}
+		host, err := img.cluster(uint64(off))
+		if err != nil {
+			return n, err
+		}
+		if host == 0 {
+			for i := range p[:chunk] {
+				p[i] = 0
+			}
+		} else if _, err := img.r.ReadAt(p[:chunk], int64(host+in)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		n += int(chunk)
+		off += int64(chunk)
+		p = p[chunk:]
+	}
+	return n, nil
+}
@@ -0,0 +1,95 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// makeImage builds a v3 image of 8 clusters of 512 bytes, with guest cluster
+// 2 holding data, cluster 5 marked as zeroes and the rest unallocated.
+func makeImage() (img []byte, disk []byte) {
+	const cs = 512
+	img = make([]byte, 4*cs)
+	be := binary.BigEndian
+	copy(img, magic)
+	be.PutUint32(img[4:], 3)
+	be.PutUint32(img[20:], 9)
+	be.PutUint64(img[24:], 8*cs)
+	be.PutUint32(img[36:], 1)
+	be.PutUint64(img[40:], cs)
+	be.PutUint32(img[100:], 104)
+	// L1 at cluster 1 pointing to the L2 table at cluster 2.
+	be.PutUint64(img[cs:], 1<<63|2*cs)
+	// L2: guest cluster 2 is at host cluster 3, guest cluster 5 is zero.
+	be.PutUint64(img[2*cs+2*8:], 1<<63|3*cs)
+	be.PutUint64(img[2*cs+5*8:], zeroFlag)
+	disk = make([]byte, 8*cs)
+	for i := 0; i < cs; i++ {
+		img[3*cs+i] = byte(i)
+		disk[2*cs+i] = byte(i)
+	}
+	return img, disk
+}
+
+func TestReadImage(t *testing.T) {
+	b, disk := makeImage()
+	r := bytes.NewReader(b)
+	if !IsQcow2(r) {
+		t.Fatal("expected the image to be recognized")
+	}
+	img, err := Open(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != uint64(len(disk)) {
+		t.Fatalf("expected size %d, got %d", len(disk), img.Size())
+	}
+	got := make([]byte, len(disk))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, disk) {
+		t.Fatal("image didn't read back as the disk")
+	}
+	// A read straddling clusters, running past the end.
+	got = make([]byte, 300)
+	n, err := img.ReadAt(got, 1000)
+	if err != nil || n != 300 || !bytes.Equal(got, disk[1000:1300]) {
+		t.Fatalf("unexpected read across clusters: %d, %v", n, err)
+	}
+	n, err = img.ReadAt(got, int64(len(disk))-100)
+	if err != io.EOF || n != 100 {
+		t.Fatalf("expected a short read at the end, got %d, %v", n, err)
+	}
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		edit func(b []byte)
+	}{
+		{"raw", func(b []byte) { copy(b, "\x00\x00\x00\x00") }},
+		{"version", func(b []byte) { binary.BigEndian.PutUint32(b[4:], 4) }},
+		{"backing file", func(b []byte) { binary.BigEndian.PutUint64(b[8:], 1024) }},
+		{"encrypted", func(b []byte) { binary.BigEndian.PutUint32(b[32:], 1) }},
+		{"features", func(b []byte) { binary.BigEndian.PutUint64(b[72:], 1<<2) }},
+	} {
+		b, _ := makeImage()
+		tt.edit(b)
+		if _, err := Open(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: expected the image to be refused", tt.name)
+		}
+	}
+
+	b, _ := makeImage()
+	binary.BigEndian.PutUint64(b[2*512+2*8:], 1<<62|3*512)
+	img, err := Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadAt(make([]byte, 512), 1024); err == nil {
+		t.Fatal("expected reading a compressed cluster to fail")
+	}
+}
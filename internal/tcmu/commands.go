@@ -1,6 +1,8 @@
 package torustcmu
 
 import (
+	"encoding/binary"
+
 	"github.com/alternative-storage/go-tcmu"
 	"github.com/alternative-storage/go-tcmu/scsi"
 )
@@ -15,6 +17,23 @@ func (h *torusHandler) handleSyncCommand(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse,
 	return cmd.Ok(), nil
 }
 
+func (h *torusHandler) handleReadCapacity10(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse, error) {
+	sizes := cmd.Device().Sizes()
+	data := make([]byte, 8)
+	last := uint64(sizes.VolumeSize/sizes.BlockSize) - 1
+	if last > 0xffffffff {
+		// Too large to say; the initiator asks READ CAPACITY (16).
+		last = 0xffffffff
+	}
+	binary.BigEndian.PutUint32(data[0:4], uint32(last))
+	binary.BigEndian.PutUint32(data[4:8], uint32(sizes.BlockSize))
+	if _, err := cmd.Write(data); err != nil {
+		clog.Errorf("readCapacity10 failed: %v", err)
+		return cmd.MediumError(), nil
+	}
+	return cmd.Ok(), nil
+}
+
 func (h *torusHandler) handleReportDeviceID(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse, error) {
 	v := h.name
 	// The SCSI spec only allows lengths representable in one byte (byte 3). We
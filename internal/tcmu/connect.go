@@ -2,21 +2,75 @@ package torustcmu
 
 import (
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/alternative-storage/go-tcmu"
 	"github.com/alternative-storage/go-tcmu/scsi"
-	"github.com/alternative-storage/torus/block"
 	"github.com/coreos/pkg/capnslog"
 )
 
 const (
 	defaultBlockSize = 4 * 1024
 	devPath          = "/dev/torus"
+	hba              = 30
+
+	// readCapacity10 is asked for by initiators, like those of VMware and
+	// Windows, before READ CAPACITY (16).
+	readCapacity10 = 0x25
 )
 
 var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "tcmu")
 
-func ConnectAndServe(f *block.BlockFile, name string, closer chan bool) error {
+// Device is the volume a SCSI device serves, such as a *block.BlockFile.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Size() uint64
+}
+
+func ConnectAndServe(f Device, name string, closer chan bool) error {
+	d, err := openDevice(f, name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	fmt.Printf("Attached to %s/%s. Server loop begins ... \n", devPath, name)
+	<-closer
+	return nil
+}
+
+// ServeISCSI exports the volume as the iSCSI target t until closer is
+// closed.
+func ServeISCSI(f Device, name string, t *ISCSITarget, closer chan bool) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	// A target left behind by a torusblk that didn't exit cleanly would
+	// keep the backstore in use.
+	if err := t.remove(iscsiConfigDir); err != nil {
+		return fmt.Errorf("couldn't remove stale iSCSI target %s: %v", t.IQN, err)
+	}
+	d, err := openDevice(f, name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	defer func() {
+		if err := t.remove(iscsiConfigDir); err != nil {
+			clog.Errorf("couldn't remove iSCSI target %s: %v", t.IQN, err)
+		}
+	}()
+	if err := t.create(iscsiConfigDir, fmt.Sprintf(backstoreDirFmt, hba, name)); err != nil {
+		return fmt.Errorf("couldn't create iSCSI target %s: %v", t.IQN, err)
+	}
+	fmt.Printf("Serving %s as iSCSI target %s on %s\n", name, t.IQN, strings.Join(t.Portals, ", "))
+	<-closer
+	return nil
+}
+
+func openDevice(f Device, name string) (*tcmu.Device, error) {
 	wwn := tcmu.NaaWWN{
 		// TODO(barakmich): CoreOS OUI here
 		OUI:      "000000",
@@ -28,7 +82,7 @@ func ConnectAndServe(f *block.BlockFile, name string, closer chan bool) error {
 	n := 1
 
 	h := &tcmu.SCSIHandler{
-		HBA:        30,
+		HBA:        hba,
 		LUN:        0,
 		WWN:        wwn,
 		VolumeName: name,
@@ -48,18 +102,11 @@ func ConnectAndServe(f *block.BlockFile, name string, closer chan bool) error {
 				},
 			}, n),
 	}
-	d, err := tcmu.OpenTCMUDevice(devPath, h)
-	defer d.Close()
-	if err != nil {
-		return err
-	}
-	fmt.Printf("Attached to %s/%s. Server loop begins ... \n", devPath, name)
-	<-closer
-	return nil
+	return tcmu.OpenTCMUDevice(devPath, h)
 }
 
 type torusHandler struct {
-	file *block.BlockFile
+	file Device
 	name string
 	inq  *tcmu.InquiryInfo
 }
@@ -70,6 +117,8 @@ func (h *torusHandler) HandleCommand(cmd *tcmu.SCSICmd) (tcmu.SCSIResponse, erro
 		return tcmu.EmulateInquiry(cmd, h.inq)
 	case scsi.TestUnitReady:
 		return tcmu.EmulateTestUnitReady(cmd)
+	case readCapacity10:
+		return h.handleReadCapacity10(cmd)
 	case scsi.ServiceActionIn16:
 		return tcmu.EmulateServiceActionIn(cmd)
 	case scsi.ModeSense, scsi.ModeSense10:
@@ -0,0 +1,227 @@
+package torustcmu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// iqnPrefix names the targets made up from volume names.
+	iqnPrefix = "iqn.2017-01.com.github.alternative-storage.torus:"
+	// iscsiLUNLink is the name of the link from the target's LUN to the
+	// backstore.
+	iscsiLUNLink = "torus"
+)
+
+var (
+	// iscsiConfigDir is where LIO's iSCSI fabric is configured. Creating
+	// it loads the fabric module.
+	iscsiConfigDir = "/sys/kernel/config/target/iscsi"
+	// backstoreDirFmt is where the TCMU backstore of each volume lives,
+	// by HBA and volume name.
+	backstoreDirFmt = "/sys/kernel/config/target/core/user_%d/%s"
+)
+
+// ISCSITarget describes how a volume is exported over iSCSI through the
+// kernel's LIO target.
+type ISCSITarget struct {
+	// IQN names the target.
+	IQN string
+	// Portals are the addresses, as IP:PORT, to listen for initiators on.
+	Portals []string
+	// CHAPUser and CHAPPassword, if set, are the credentials initiators
+	// must log in with. MutualUser and MutualPassword, if set as well, are
+	// the ones the target answers with, for mutual CHAP.
+	CHAPUser       string
+	CHAPPassword   string
+	MutualUser     string
+	MutualPassword string
+	// Initiators, if set, are the IQNs of the only initiators allowed to
+	// log in; otherwise any initiator may.
+	Initiators []string
+}
+
+// DefaultIQN makes up the name of the target a volume is exported as.
+func DefaultIQN(name string) string {
+	return iqnPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+}
+
+// Validate checks the target's settings before any of them are applied.
+func (t *ISCSITarget) Validate() error {
+	if !strings.HasPrefix(t.IQN, "iqn.") && !strings.HasPrefix(t.IQN, "eui.") && !strings.HasPrefix(t.IQN, "naa.") {
+		return fmt.Errorf("invalid target name %q: must start with iqn., eui. or naa.", t.IQN)
+	}
+	if len(t.Portals) == 0 {
+		return fmt.Errorf("no portals to listen on")
+	}
+	if (t.CHAPUser == "") != (t.CHAPPassword == "") {
+		return fmt.Errorf("CHAP needs both a user and a password")
+	}
+	if (t.MutualUser == "") != (t.MutualPassword == "") {
+		return fmt.Errorf("mutual CHAP needs both a user and a password")
+	}
+	if t.MutualUser != "" && t.CHAPUser == "" {
+		return fmt.Errorf("mutual CHAP needs CHAP credentials too")
+	}
+	return nil
+}
+
+func (t *ISCSITarget) tpgDir(root string) string {
+	return filepath.Join(root, t.IQN, "tpgt_1")
+}
+
+// create sets up the target under root with a single LUN backed by
+// backstore, and enables it.
+func (t *ISCSITarget) create(root, backstore string) error {
+	tpg := t.tpgDir(root)
+	lun := filepath.Join(tpg, "lun", "lun_0")
+	if err := os.MkdirAll(lun, 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(backstore, filepath.Join(lun, iscsiLUNLink)); err != nil {
+		return err
+	}
+	for _, p := range t.Portals {
+		if err := os.MkdirAll(filepath.Join(tpg, "np", p), 0755); err != nil {
+			return fmt.Errorf("couldn't listen on %s: %v", p, err)
+		}
+	}
+	attrs := map[string]string{
+		"authentication": "0",
+	}
+	if t.CHAPUser != "" {
+		attrs["authentication"] = "1"
+	}
+	if len(t.Initiators) == 0 {
+		// Let any initiator log in and write, with the credentials of
+		// the TPG.
+		attrs["generate_node_acls"] = "1"
+		attrs["cache_dynamic_acls"] = "1"
+		attrs["demo_mode_write_protect"] = "0"
+		if err := t.writeAuth(filepath.Join(tpg, "auth")); err != nil {
+			return err
+		}
+	}
+	for _, iqn := range t.Initiators {
+		acl := filepath.Join(tpg, "acls", iqn)
+		mapped := filepath.Join(acl, "lun_0")
+		if err := os.MkdirAll(mapped, 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(lun, filepath.Join(mapped, iscsiLUNLink)); err != nil {
+			return err
+		}
+		if err := t.writeAuth(filepath.Join(acl, "auth")); err != nil {
+			return err
+		}
+	}
+	for k, v := range attrs {
+		if err := writeAttr(filepath.Join(tpg, "attrib", k), v); err != nil {
+			return err
+		}
+	}
+	return writeAttr(filepath.Join(tpg, "enable"), "1")
+}
+
+func (t *ISCSITarget) writeAuth(dir string) error {
+	if t.CHAPUser == "" {
+		return nil
+	}
+	attrs := [][2]string{
+		{"userid", t.CHAPUser},
+		{"password", t.CHAPPassword},
+	}
+	if t.MutualUser != "" {
+		attrs = append(attrs,
+			[2]string{"userid_mutual", t.MutualUser},
+			[2]string{"password_mutual", t.MutualPassword},
+		)
+	}
+	for _, a := range attrs {
+		if err := writeAttr(filepath.Join(dir, a[0]), a[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove tears down the target under root, if there is one, in the order
+// configfs requires: links before the directories holding them, and
+// directories before their parents. The sessions of logged in initiators
+// are dropped, and they log in again once the target is back.
+func (t *ISCSITarget) remove(root string) error {
+	target := filepath.Join(root, t.IQN)
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		return nil
+	}
+	tpgs, err := filepath.Glob(filepath.Join(target, "tpgt_*"))
+	if err != nil {
+		return err
+	}
+	for _, tpg := range tpgs {
+		if err := writeAttr(filepath.Join(tpg, "enable"), "0"); err != nil {
+			clog.Debugf("couldn't disable %s: %v", tpg, err)
+		}
+		acls, _ := filepath.Glob(filepath.Join(tpg, "acls", "*"))
+		for _, acl := range acls {
+			if err := removeLUNs(acl); err != nil {
+				return err
+			}
+			if err := os.Remove(acl); err != nil {
+				return err
+			}
+		}
+		if err := removeLUNs(filepath.Join(tpg, "lun")); err != nil {
+			return err
+		}
+		nps, _ := filepath.Glob(filepath.Join(tpg, "np", "*"))
+		for _, np := range nps {
+			if err := os.Remove(np); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(tpg); err != nil {
+			return err
+		}
+	}
+	return os.Remove(target)
+}
+
+// removeLUNs removes the lun_* directories in dir, along with the links in
+// them.
+func removeLUNs(dir string) error {
+	luns, _ := filepath.Glob(filepath.Join(dir, "lun_*"))
+	for _, lun := range luns {
+		links, err := ioutil.ReadDir(lun)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if l.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			if err := os.Remove(filepath.Join(lun, l.Name())); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(lun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAttr(path, value string) error {
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
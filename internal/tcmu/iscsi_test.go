@@ -0,0 +1,88 @@
+package torustcmu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultIQN(t *testing.T) {
+	iqn := DefaultIQN("Vol_01@snap")
+	if iqn != iqnPrefix+"vol-01-snap" {
+		t.Fatalf("unexpected IQN %q", iqn)
+	}
+	if err := (&ISCSITarget{IQN: iqn, Portals: []string{"0.0.0.0:3260"}}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestISCSITargetValidate(t *testing.T) {
+	for _, tt := range []ISCSITarget{
+		{IQN: "vol01", Portals: []string{"0.0.0.0:3260"}},
+		{IQN: DefaultIQN("vol01")},
+		{IQN: DefaultIQN("vol01"), Portals: []string{"0.0.0.0:3260"}, CHAPUser: "u"},
+		{IQN: DefaultIQN("vol01"), Portals: []string{"0.0.0.0:3260"}, MutualUser: "u", MutualPassword: "p"},
+	} {
+		if err := tt.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", tt)
+		}
+	}
+}
+
+func readAttr(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestISCSITargetCreate(t *testing.T) {
+	root, err := ioutil.TempDir("", "iscsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	target := &ISCSITarget{
+		IQN:          DefaultIQN("vol01"),
+		Portals:      []string{"0.0.0.0:3260"},
+		CHAPUser:     "user",
+		CHAPPassword: "secret",
+		Initiators:   []string{"iqn.1994-05.com.redhat:client01"},
+	}
+	// configfs makes these along with the TPG and ACL.
+	tpg := target.tpgDir(root)
+	acl := filepath.Join(tpg, "acls", target.Initiators[0])
+	for _, dir := range []string{filepath.Join(tpg, "attrib"), filepath.Join(acl, "auth")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.create(root, "/backstore/vol01"); err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Readlink(filepath.Join(tpg, "lun", "lun_0", iscsiLUNLink))
+	if err != nil || link != "/backstore/vol01" {
+		t.Fatalf("LUN links to %q, %v", link, err)
+	}
+	link, err = os.Readlink(filepath.Join(acl, "lun_0", iscsiLUNLink))
+	if err != nil || link != filepath.Join(tpg, "lun", "lun_0") {
+		t.Fatalf("initiator's LUN links to %q, %v", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(tpg, "np", "0.0.0.0:3260")); err != nil {
+		t.Fatal(err)
+	}
+	if v := readAttr(t, filepath.Join(acl, "auth", "userid")); v != "user" {
+		t.Fatalf("unexpected CHAP user %q", v)
+	}
+	if v := readAttr(t, filepath.Join(tpg, "attrib", "authentication")); v != "1" {
+		t.Fatalf("authentication is %q", v)
+	}
+	if _, err := os.Stat(filepath.Join(tpg, "attrib", "generate_node_acls")); !os.IsNotExist(err) {
+		t.Fatal("any initiator may log in despite the ACL")
+	}
+	if v := readAttr(t, filepath.Join(tpg, "enable")); v != "1" {
+		t.Fatalf("enable is %q", v)
+	}
+}
@@ -0,0 +1,113 @@
+package torus
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Limits on the labels of a volume, which are kept on its record in the
+// metadata service.
+const (
+	MaxVolumeLabels     = 64
+	MaxLabelKeyLength   = 63
+	MaxLabelValueLength = 255
+)
+
+// The characters other than letters and digits allowed in label keys and
+// values.
+const (
+	labelKeyPunctuation   = "-_./"
+	labelValuePunctuation = "-_."
+)
+
+// ValidateLabel checks the key and value of a volume label. Keys are 1 to
+// MaxLabelKeyLength letters, digits, and any of "-_./", starting with a
+// letter or digit, such as team or app.example.com/tier. Values are up to
+// MaxLabelValueLength letters, digits and any of "-_.", and may be empty.
+func ValidateLabel(key, value string) error {
+	if key == "" {
+		return errors.New("label key can't be empty")
+	}
+	if len(key) > MaxLabelKeyLength {
+		return fmt.Errorf("label key %q is longer than %d characters", key, MaxLabelKeyLength)
+	}
+	if !isLabelAlnum(key[0]) {
+		return fmt.Errorf("label key %q must start with a letter or digit", key)
+	}
+	for i := 0; i < len(key); i++ {
+		if !isLabelAlnum(key[i]) && strings.IndexByte(labelKeyPunctuation, key[i]) < 0 {
+			return fmt.Errorf("label key %q may only have letters, digits and any of %q", key, labelKeyPunctuation)
+		}
+	}
+	if len(value) > MaxLabelValueLength {
+		return fmt.Errorf("value of label %s is longer than %d characters", key, MaxLabelValueLength)
+	}
+	for i := 0; i < len(value); i++ {
+		if !isLabelAlnum(value[i]) && strings.IndexByte(labelValuePunctuation, value[i]) < 0 {
+			return fmt.Errorf("value of label %s may only have letters, digits and any of %q", key, labelValuePunctuation)
+		}
+	}
+	return nil
+}
+
+func isLabelAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// ValidateLabels checks each of labels, and that there aren't more than
+// MaxVolumeLabels of them.
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > MaxVolumeLabels {
+		return fmt.Errorf("a volume can't have more than %d labels", MaxVolumeLabels)
+	}
+	for k, v := range labels {
+		if err := ValidateLabel(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses labels given as key=value, refusing invalid ones and
+// keys given twice.
+func ParseLabels(in []string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, l := range in {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not key=value", l)
+		}
+		if _, ok := out[kv[0]]; ok {
+			return nil, fmt.Errorf("label %s given twice", kv[0])
+		}
+		if err := ValidateLabel(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+		out[kv[0]] = kv[1]
+	}
+	return out, nil
+}
+
+// MatchLabels reports whether labels has every key=value pair of selector.
+// The empty selector matches any labels.
+func MatchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatLabels returns labels as key=value pairs, sorted by key and joined
+// by commas.
+func FormatLabels(labels map[string]string) string {
+	out := make([]string, 0, len(labels))
+	for k, v := range labels {
+		out = append(out, k+"="+v)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
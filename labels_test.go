@@ -0,0 +1,68 @@
+package torus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLabel(t *testing.T) {
+	for _, l := range [][2]string{
+		{"team", "storage"},
+		{"app.example.com/tier", "db-1"},
+		{"env", ""},
+		{"0", "A_b.c"},
+	} {
+		if err := ValidateLabel(l[0], l[1]); err != nil {
+			t.Errorf("expected %s=%s to be valid, got %v", l[0], l[1], err)
+		}
+	}
+	for _, l := range [][2]string{
+		{"", "x"},
+		{"-team", "x"},
+		{"te am", "x"},
+		{"team", "a/b"},
+		{"team", "a=b"},
+		{strings.Repeat("k", MaxLabelKeyLength+1), "x"},
+		{"team", strings.Repeat("v", MaxLabelValueLength+1)},
+	} {
+		if err := ValidateLabel(l[0], l[1]); err == nil {
+			t.Errorf("expected %q=%q to be rejected", l[0], l[1])
+		}
+	}
+}
+
+func TestParseAndMatchLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"team=storage", "env=prod", "tier="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatLabels(labels); got != "env=prod,team=storage,tier=" {
+		t.Fatalf("unexpected labels %s", got)
+	}
+	if _, err := ParseLabels([]string{"team=a", "team=b"}); err == nil {
+		t.Fatal("expected a key given twice to be rejected")
+	}
+	if _, err := ParseLabels([]string{"team"}); err == nil {
+		t.Fatal("expected a label without a value to be rejected")
+	}
+
+	for _, c := range []struct {
+		sel   []string
+		match bool
+	}{
+		{nil, true},
+		{[]string{"team=storage"}, true},
+		{[]string{"team=storage", "env=prod"}, true},
+		{[]string{"team=storage", "env=dev"}, false},
+		{[]string{"owner=bob"}, false},
+		{[]string{"tier="}, true},
+	} {
+		sel, err := ParseLabels(c.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if MatchLabels(labels, sel) != c.match {
+			t.Errorf("expected selector %v to match %t", c.sel, c.match)
+		}
+	}
+}
@@ -28,10 +28,20 @@ func MkdirsFor(dir string) error {
 
 func NewServer(cfg Config, metadataServiceKind, blockStoreKind string) (*Server, error) {
 	clog.Tracef("starting %s server...", blockStoreKind)
-	err := MkdirsFor(cfg.DataDir)
+	err := MkdirsFor(cfg.MetadataDir())
 	if err != nil {
 		return nil, err
 	}
+	for i, dir := range cfg.DataDir {
+		if i == 0 {
+			continue
+		}
+		// The block store leaves out the directories it can't use, so one
+		// failing doesn't keep the node from starting.
+		if err := MkdirsFor(dir); err != nil {
+			clog.Errorf("couldn't create data directory %s: %v", dir, err)
+		}
+	}
 
 	mds, err := CreateMetadataService(metadataServiceKind, cfg)
 	if err != nil {
@@ -39,6 +49,17 @@ func NewServer(cfg Config, metadataServiceKind, blockStoreKind string) (*Server,
 	}
 
 	global := mds.GlobalMetadata()
+	for i, dir := range cfg.DataDir {
+		// Data directories that couldn't be created are left out by the
+		// block store.
+		if _, err := os.Stat(filepath.Join(dir, "metadata")); i != 0 && err != nil {
+			continue
+		}
+		if err := checkClusterID(dir, global); err != nil {
+			mds.Close()
+			return nil, err
+		}
+	}
 
 	blocks, err := CreateBlockStore(blockStoreKind, "current", cfg, global)
 	if err != nil {
@@ -60,14 +81,25 @@ func NewMemoryServer() *Server {
 }
 
 func NewServerByImpl(cfg Config, mds MetadataService, blocks BlockStore) (*Server, error) {
+	audit, err := OpenAuditLog(cfg.AuditLog)
+	if err != nil {
+		return nil, err
+	}
 	return &Server{
+		Audit:    audit,
 		Blocks:   blocks,
 		MDS:      mds,
 		INodes:   NewINodeStore(blocks),
 		peersMap: make(map[string]*models.PeerInfo),
 		Cfg:      cfg,
 		peerInfo: &models.PeerInfo{
-			UUID: mds.UUID(),
+			UUID:   mds.UUID(),
+			Zone:   cfg.Zone,
+			Rack:   cfg.Rack,
+			Labels: cfg.Labels,
+			TLS:    cfg.PeerTLS(),
+
+			Version: Version,
 		},
 	}, nil
 }
@@ -0,0 +1,197 @@
+package torus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+// LogFormats are the formats SetLogFormat accepts.
+var LogFormats = []string{"text", "json"}
+
+// structuredLogs is set once a formatter that keeps LogFields apart from the
+// message is installed.
+var structuredLogs int32
+
+// SetLogFormat sets how every logger writes its output: "text" leaves
+// capnslog's own formatter in place, and "json" writes one JSON object per
+// line to stderr. Whatever is logged before it is called is written as text.
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		return nil
+	case "json":
+		capnslog.SetFormatter(NewJSONFormatter(os.Stderr))
+		atomic.StoreInt32(&structuredLogs, 1)
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q (%s)", format, strings.Join(LogFormats, ", "))
+}
+
+// LogFields are key/value pairs describing a log message, such as the peer or
+// block it concerns. Loggers given them through WithFields keep them apart
+// from the message when logging JSON, and append them to it otherwise.
+type LogFields map[string]interface{}
+
+// String returns the fields as space-separated key=value pairs, sorted by
+// key.
+func (f LogFields) String() string {
+	keys := f.keys()
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", k, f[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f LogFields) keys() []string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// BlockLogFields returns the fields describing a block: the block itself
+// and its volume.
+func BlockLogFields(ref BlockRef) LogFields {
+	return LogFields{
+		"block":  ref,
+		"volume": uint64(ref.Volume()),
+	}
+}
+
+// FieldLogger logs through a package logger, with fields attached to every
+// message.
+type FieldLogger struct {
+	l      *capnslog.PackageLogger
+	fields LogFields
+}
+
+// WithFields returns a logger that logs through l with fields attached.
+func WithFields(l *capnslog.PackageLogger, fields LogFields) FieldLogger {
+	return FieldLogger{l: l, fields: fields}
+}
+
+func (l FieldLogger) logf(level capnslog.LogLevel, format string, args []interface{}) {
+	if !l.l.LevelAt(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if len(l.fields) == 0 {
+		l.l.Log(level, msg)
+		return
+	}
+	if atomic.LoadInt32(&structuredLogs) == 1 {
+		l.l.Log(level, msg, l.fields)
+		return
+	}
+	l.l.Log(level, msg+" "+l.fields.String())
+}
+
+func (l FieldLogger) Errorf(format string, args ...interface{}) {
+	l.logf(capnslog.ERROR, format, args)
+}
+
+func (l FieldLogger) Warningf(format string, args ...interface{}) {
+	l.logf(capnslog.WARNING, format, args)
+}
+
+func (l FieldLogger) Noticef(format string, args ...interface{}) {
+	l.logf(capnslog.NOTICE, format, args)
+}
+
+func (l FieldLogger) Infof(format string, args ...interface{}) {
+	l.logf(capnslog.INFO, format, args)
+}
+
+func (l FieldLogger) Debugf(format string, args ...interface{}) {
+	l.logf(capnslog.DEBUG, format, args)
+}
+
+func (l FieldLogger) Tracef(format string, args ...interface{}) {
+	l.logf(capnslog.TRACE, format, args)
+}
+
+// jsonFormatter is a capnslog formatter writing one JSON object per line.
+type jsonFormatter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONFormatter returns a capnslog formatter that writes each message to
+// w as a JSON object on a line of its own, with the time, level, package and
+// message, and the LogFields logged with it as further keys. Fields can't
+// replace the first four.
+func NewJSONFormatter(w io.Writer) capnslog.Formatter {
+	return &jsonFormatter{w: w}
+}
+
+func (j *jsonFormatter) Format(pkg string, level capnslog.LogLevel, depth int, entries ...interface{}) {
+	var (
+		fields LogFields
+		msg    []interface{}
+	)
+	for _, e := range entries {
+		if f, ok := e.(LogFields); ok {
+			fields = f
+			continue
+		}
+		msg = append(msg, e)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeJSONField(&buf, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	writeJSONField(&buf, "level", strings.ToLower(level.String()), false)
+	writeJSONField(&buf, "package", pkg, false)
+	writeJSONField(&buf, "message", strings.TrimSuffix(fmt.Sprint(msg...), "\n"), false)
+	for _, k := range fields.keys() {
+		switch k {
+		case "time", "level", "package", "message":
+			continue
+		}
+		writeJSONField(&buf, k, jsonValue(fields[k]), false)
+	}
+	buf.WriteString("}\n")
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Write(buf.Bytes())
+}
+
+func (j *jsonFormatter) Flush() {}
+
+func writeJSONField(buf *bytes.Buffer, key string, v interface{}, first bool) {
+	if !first {
+		buf.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// jsonValue returns what a field's value is written as: errors and values
+// with a String method as their text, and everything else as it marshals.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
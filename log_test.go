@@ -0,0 +1,76 @@
+package torus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+func TestJSONFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewJSONFormatter(&buf)
+	ref := BlockRef{INodeRef: NewINodeRef(3, 4), Index: 5}
+	fields := BlockLogFields(ref)
+	fields["peer"] = "abc"
+	fields["err"] = errors.New("boom")
+	fields["level"] = "not the level"
+	f.Format("distributor", capnslog.WARNING, 0, "block from peer failed", fields)
+	f.Format("distributor", capnslog.INFO, 0, "no fields\n")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %q", len(lines), buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"level":   "warning",
+		"package": "distributor",
+		"message": "block from peer failed",
+		"block":   ref.String(),
+		"volume":  float64(3),
+		"peer":    "abc",
+		"err":     "boom",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+	if _, ok := got["time"]; !ok {
+		t.Error("no time")
+	}
+	if len(got) != len(want)+1 {
+		t.Errorf("unexpected keys: %v", got)
+	}
+
+	got = nil
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["message"] != "no fields" || got["level"] != "info" {
+		t.Errorf("unexpected second line: %v", got)
+	}
+}
+
+func TestLogFieldsString(t *testing.T) {
+	s := LogFields{"volume": 2, "block": "b", "peer": "p"}.String()
+	if s != "block=b peer=p volume=2" {
+		t.Fatalf("unexpected fields: %q", s)
+	}
+}
+
+func TestSetLogFormat(t *testing.T) {
+	if err := SetLogFormat("text"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLogFormat("xml"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
@@ -3,11 +3,15 @@ package torus
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/alternative-storage/torus/models"
 	"github.com/coreos/pkg/capnslog"
+	"github.com/pborman/uuid"
 )
 
 var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "torus")
@@ -17,12 +21,14 @@ type MetadataKind int
 const (
 	EtcdMetadata MetadataKind = iota
 	TempMetadata
+	ConsulMetadata
 )
 
 // MetadataService is the interface representing the basic ways to manipulate
 // consistently stored fileystem metadata.
 type MetadataService interface {
 	GetVolumes() ([]*models.Volume, VolumeID, error)
+	// GetVolume returns ErrNotExist if there's no volume of that name.
 	GetVolume(volume string) (*models.Volume, error)
 	NewVolumeID() (VolumeID, error)
 	Kind() MetadataKind
@@ -55,6 +61,88 @@ type MetadataService interface {
 	GetLockStatus(vid uint64) string
 }
 
+// LeaseRevoker is implemented by MetadataServices that can give up a lease
+// before it expires.
+type LeaseRevoker interface {
+	RevokeLease(int64) error
+}
+
+// RebalanceController is implemented by MetadataServices that store the
+// cluster-wide rebalance settings, which nodes pick up while running.
+type RebalanceController interface {
+	GetRebalanceSettings() (RebalanceSettings, error)
+	SetRebalanceSettings(RebalanceSettings) error
+}
+
+// PeerCordoner is implemented by MetadataServices that store the peers
+// cordoned for maintenance, apart from the peers' own heartbeats.
+type PeerCordoner interface {
+	GetCordons() ([]Cordon, error)
+	// SetCordon stores c, replacing any cordon of the same peer.
+	SetCordon(c Cordon) error
+	// RemoveCordon drops the cordon of uuid. It returns ErrNotExist if
+	// there is none.
+	RemoveCordon(uuid string) error
+}
+
+// GCController is implemented by MetadataServices that store the
+// cluster-wide garbage collection settings, which nodes follow with a watch,
+// the status each node publishes after a garbage collection pass, and the
+// tombstones of deleted volumes whose blocks are being reclaimed.
+type GCController interface {
+	GetGCSettings() (GCSettings, error)
+	SetGCSettings(GCSettings) error
+	// WatchGCSettings sends the settings, and then the new settings each
+	// time they change, until ctx is done. The channel is closed then.
+	WatchGCSettings(ctx context.Context) <-chan GCSettings
+	SetGCStatus(GCStatus) error
+	GetGCStatuses() ([]GCStatus, error)
+	// GetTombstones returns the tombstones of the deleted volumes. Block
+	// volumes leave one when they are deleted.
+	GetTombstones() ([]VolumeTombstone, error)
+	// RemoveTombstone drops the tombstone of volume vid, once no node holds
+	// its blocks.
+	RemoveTombstone(vid VolumeID) error
+}
+
+// ClusterEventLog is implemented by MetadataServices that keep a log of
+// events every node can read, such as the peers nodes evicted on their own.
+// Only the most recent MaxClusterEvents are kept, for up to
+// MaxClusterEventAge. Nodes record events with RecordClusterEvent.
+type ClusterEventLog interface {
+	// RecordClusterEvent appends e to the log, stamping it with the time if
+	// it has none.
+	RecordClusterEvent(e AuditEvent) error
+	// GetClusterEvents returns the events of the log, oldest first.
+	GetClusterEvents() ([]AuditEvent, error)
+}
+
+// ClusterEventWatcher is implemented by ClusterEventLogs that can follow the
+// log as events are recorded.
+type ClusterEventWatcher interface {
+	// WatchClusterEvents sends the events recorded from now on, in order,
+	// until ctx is done. The channel is closed then.
+	WatchClusterEvents(ctx context.Context) <-chan AuditEvent
+}
+
+// MaxClusterEvents is the number of events a ClusterEventLog keeps, and
+// MaxClusterEventAge how long it keeps them for.
+const (
+	MaxClusterEvents   = 1000
+	MaxClusterEventAge = 7 * 24 * time.Hour
+)
+
+// ScrubTracker is implemented by MetadataServices that store the progress
+// of each node's scrubber, so that it survives restarts and can be shown for
+// the whole cluster.
+type ScrubTracker interface {
+	// GetScrubStatus returns a zero ScrubStatus for a node that hasn't
+	// stored one.
+	GetScrubStatus(uuid string) (ScrubStatus, error)
+	SetScrubStatus(ScrubStatus) error
+	GetScrubStatuses() ([]ScrubStatus, error)
+}
+
 type DebugMetadataService interface {
 	DumpMetadata(io.Writer) error
 }
@@ -62,6 +150,33 @@ type DebugMetadataService interface {
 type GlobalMetadata struct {
 	BlockSize        uint64
 	DefaultBlockSpec BlockLayerSpec
+	// KetamaVNodes is the average number of virtual nodes per peer on ketama
+	// rings. Zero leaves it to the ring's placement scheme.
+	KetamaVNodes int
+	// RingType names the type of ring the cluster was initialized with, and
+	// that new rings are made of by default. It is empty for clusters
+	// initialized before it was recorded.
+	RingType string `json:",omitempty"`
+	// MetadataPrefix is the key prefix the metadata was initialized under,
+	// for metadata services that have one. It is empty for clusters
+	// initialized before it was recorded, which use the default.
+	MetadataPrefix string `json:",omitempty"`
+	// PeerTimeout is how long a peer may go without a heartbeat before
+	// every node considers it missing. Zero uses DefaultPeerTimeout.
+	PeerTimeout time.Duration `json:",omitempty"`
+	// ClusterID identifies the cluster, so that nodes don't mix up storage
+	// of another cluster with its own. It is generated by InitMDS, and is
+	// empty for clusters initialized before it was.
+	ClusterID string `json:",omitempty"`
+}
+
+// PeerTimeoutOrDefault returns g.PeerTimeout, or the default if it isn't
+// set.
+func (g GlobalMetadata) PeerTimeoutOrDefault() time.Duration {
+	if g.PeerTimeout == 0 {
+		return DefaultPeerTimeout
+	}
+	return g.PeerTimeout
 }
 
 // CreateMetadataServiceFunc is the signature of a constructor used to create
@@ -98,6 +213,19 @@ func CreateMetadataService(name string, cfg Config) (MetadataService, error) {
 	return nil, fmt.Errorf("torus: the metadata service %q doesn't exist", name)
 }
 
+// MetadataServiceFor names the metadata service that cfg.MetadataAddress is
+// for: the scheme of its first address, such as consul://host:8500, if a
+// metadata service of that name is registered, and etcd otherwise.
+func MetadataServiceFor(cfg Config) string {
+	addr := strings.Split(cfg.MetadataAddress, ",")[0]
+	if i := strings.Index(addr, "://"); i > 0 {
+		if _, ok := metadataServices[addr[:i]]; ok {
+			return addr[:i]
+		}
+	}
+	return "etcd"
+}
+
 // InitMDSFunc is the signature of a function which preformats a metadata service.
 type InitMDSFunc func(cfg Config, gmd GlobalMetadata, ringType RingType) error
 
@@ -120,7 +248,27 @@ func RegisterMetadataInit(name string, newFunc InitMDSFunc) {
 // InitMDS calls the specific init function provided by a metadata package.
 func InitMDS(name string, cfg Config, gmd GlobalMetadata, ringType RingType) error {
 	clog.Debugf("running InitMDS for service type: %s", name)
-	return initMDSFuncs[name](cfg, gmd, ringType)
+	if gmd.ClusterID == "" {
+		gmd.ClusterID = uuid.New()
+	}
+	err := initMDSFuncs[name](cfg, gmd, ringType)
+	audit, aerr := OpenAuditLog(cfg.AuditLog)
+	if aerr != nil {
+		clog.Errorf("couldn't open audit log: %v", aerr)
+		return err
+	}
+	defer audit.Close()
+	audit.Record(AuditEvent{
+		Op: AuditInit,
+		Details: map[string]string{
+			"metadata":   name,
+			"block_size": strconv.FormatUint(gmd.BlockSize, 10),
+			"ring_type":  strconv.Itoa(int(ringType)),
+			"cluster_id": gmd.ClusterID,
+		},
+		Err: AuditErr(err),
+	})
+	return err
 }
 
 type WipeMDSFunc func(cfg Config) error
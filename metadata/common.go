@@ -7,10 +7,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/alternative-storage/torus"
+	"github.com/coreos/pkg/capnslog"
 	"github.com/pborman/uuid"
 )
 
+var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "metadata")
+
 func MakeUUID() string {
 	return uuid.NewUUID().String()
 }
@@ -39,3 +44,29 @@ func GetUUID(datadir string) (string, error) {
 	}
 	return string(bytes), nil
 }
+
+// CheckInitState tells why an init found some of the keys it writes already
+// present, as marked in found. If all of them are, the metadata was
+// initialized before. If only some are, they were left by something other
+// than a complete init, such as an init from before inits were transactional
+// that failed partway, and the metadata has to be wiped before it can be
+// used.
+func CheckInitState(keys []string, found map[string]bool) error {
+	var present, missing []string
+	for _, k := range keys {
+		if found[k] {
+			present = append(present, k)
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	switch {
+	case len(missing) == 0:
+		return torus.ErrExists
+	case len(present) == 0:
+		// The keys went away between the compare and the gets.
+		return torus.ErrAgain
+	}
+	clog.Errorf("metadata has %s but not %s", strings.Join(present, ", "), strings.Join(missing, ", "))
+	return torus.ErrPartialInit
+}
@@ -0,0 +1,33 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestCheckInitState(t *testing.T) {
+	keys := []string{"meta/volumeminter", "meta/globalmetadata", "meta/the-one-ring"}
+	all := make(map[string]bool)
+	for _, k := range keys {
+		all[k] = true
+	}
+	if err := CheckInitState(keys, all); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists for complete metadata, got %v", err)
+	}
+	if err := CheckInitState(keys, nil); err != torus.ErrAgain {
+		t.Fatalf("expected ErrAgain when none of the keys are left, got %v", err)
+	}
+	// An init that failed after writing some of its keys, whichever they are.
+	for _, k := range keys {
+		partial := map[string]bool{k: true}
+		if err := CheckInitState(keys, partial); err != torus.ErrPartialInit {
+			t.Fatalf("expected ErrPartialInit with only %s, got %v", k, err)
+		}
+		delete(all, k)
+		if err := CheckInitState(keys, all); err != torus.ErrPartialInit {
+			t.Fatalf("expected ErrPartialInit without %s, got %v", k, err)
+		}
+		all[k] = true
+	}
+}
@@ -0,0 +1,339 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// Client talks to the HTTP API of a Consul agent. It covers the parts of the
+// KV store, transactions and sessions that the metadata service needs.
+type Client struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+// KVPair is a key of the KV store, as Consul returns it.
+type KVPair struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Flags       uint64
+	Session     string
+}
+
+// TxnOp is one operation of a transaction. Index is the ModifyIndex that a
+// check-index or cas operation compares against, and Session the session a
+// lock operation acquires the key with.
+type TxnOp struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+// OpSet sets key to value.
+func OpSet(key string, value []byte) TxnOp {
+	return TxnOp{Verb: "set", Key: key, Value: value}
+}
+
+// OpLock sets key to value and acquires it with session, so that the key is
+// deleted when the session ends.
+func OpLock(key string, value []byte, session string) TxnOp {
+	return TxnOp{Verb: "lock", Key: key, Value: value, Session: session}
+}
+
+// OpCheckIndex fails the transaction unless key was last modified at index,
+// or, for an index of zero, unless key doesn't exist.
+func OpCheckIndex(key string, index uint64) TxnOp {
+	if index == 0 {
+		return OpCheckNotExists(key)
+	}
+	return TxnOp{Verb: "check-index", Key: key, Index: index}
+}
+
+// OpCheckNotExists fails the transaction if key exists.
+func OpCheckNotExists(key string) TxnOp {
+	return TxnOp{Verb: "check-not-exists", Key: key}
+}
+
+// OpDelete deletes key.
+func OpDelete(key string) TxnOp {
+	return TxnOp{Verb: "delete", Key: key}
+}
+
+// OpDeleteTree deletes every key starting with prefix.
+func OpDeleteTree(prefix string) TxnOp {
+	return TxnOp{Verb: "delete-tree", Key: prefix}
+}
+
+// NewClient returns a client for the agent at addr, a consul://host:port URL.
+// The agent is spoken to over HTTPS if cfg.TLS is set. An ACL token is
+// taken from CONSUL_HTTP_TOKEN, as the consul command does.
+func NewClient(addr string, cfg torus.Config) (*Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "consul" || u.Host == "" {
+		return nil, fmt.Errorf("consul: invalid address %q, expected consul://host:port", addr)
+	}
+	if cfg.MetadataPrefix != "" {
+		return nil, errors.New("consul: metadata prefixes are only supported with etcd")
+	}
+	if cfg.MetadataUsername != "" {
+		return nil, errors.New("consul: use CONSUL_HTTP_TOKEN rather than an etcd username")
+	}
+	c := &Client{
+		http:  &http.Client{},
+		base:  "http://" + u.Host,
+		token: os.Getenv("CONSUL_HTTP_TOKEN"),
+	}
+	if cfg.TLS != nil {
+		c.http.Transport = &http.Transport{TLSClientConfig: cfg.TLS}
+		c.base = "https://" + u.Host
+	}
+	return c, nil
+}
+
+// consulError is an unexpected response from the agent.
+type consulError struct {
+	status int
+	msg    string
+}
+
+func (e *consulError) Error() string {
+	return fmt.Sprintf("consul: %d %s", e.status, strings.TrimSpace(e.msg))
+}
+
+// do makes a request of the agent, returning the response if its status is
+// one of ok. The caller closes its body.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body io.Reader, ok ...int) (*http.Response, error) {
+	u := c.base + path
+	if len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ok {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return nil, &consulError{status: resp.StatusCode, msg: string(msg)}
+}
+
+// kvPath is the path of key in the KV API. Keys are escaped segment by
+// segment, as volume names may hold any character.
+func kvPath(key string) string {
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return "/v1/kv/" + strings.Join(segs, "/")
+}
+
+func (c *Client) list(ctx context.Context, key string, q url.Values) ([]*KVPair, uint64, error) {
+	resp, err := c.do(ctx, "GET", kvPath(key), q, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, index, nil
+	}
+	var out []*KVPair
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, err
+	}
+	return out, index, nil
+}
+
+// Get returns key, or nil if it doesn't exist.
+func (c *Client) Get(ctx context.Context, key string) (*KVPair, error) {
+	kvs, _, err := c.list(ctx, key, nil)
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	return kvs[0], nil
+}
+
+// List returns the keys starting with prefix, in order.
+func (c *Client) List(ctx context.Context, prefix string) ([]*KVPair, error) {
+	kvs, _, err := c.list(ctx, prefix, url.Values{"recurse": {""}})
+	return kvs, err
+}
+
+// Watch waits up to wait for key to change after index, the index returned
+// by the previous call, and returns it and the index to pass to the next.
+// An index of zero returns at once.
+func (c *Client) Watch(ctx context.Context, key string, index uint64, wait time.Duration) (*KVPair, uint64, error) {
+	q := url.Values{
+		"index": {strconv.FormatUint(index, 10)},
+		"wait":  {fmt.Sprintf("%dms", wait/time.Millisecond)},
+	}
+	kvs, index, err := c.list(ctx, key, q)
+	if err != nil || len(kvs) == 0 {
+		return nil, index, err
+	}
+	return kvs[0], index, nil
+}
+
+// put writes value to key, returning whether the agent applied it, which is
+// only in doubt for writes conditioned by q.
+func (c *Client) put(ctx context.Context, key string, value []byte, q url.Values) (bool, error) {
+	resp, err := c.do(ctx, "PUT", kvPath(key), q, bytes.NewReader(value), http.StatusOK)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var ok bool
+	err = json.NewDecoder(resp.Body).Decode(&ok)
+	return ok, err
+}
+
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	_, err := c.put(ctx, key, value, nil)
+	return err
+}
+
+// CAS writes value to key if it was last modified at index, or, for an index
+// of zero, if it doesn't exist, and returns whether it did.
+func (c *Client) CAS(ctx context.Context, key string, value []byte, index uint64) (bool, error) {
+	return c.put(ctx, key, value, url.Values{"cas": {strconv.FormatUint(index, 10)}})
+}
+
+// Acquire writes value to key and acquires it with session, unless another
+// session holds it, and returns whether it did.
+func (c *Client) Acquire(ctx context.Context, key string, value []byte, session string) (bool, error) {
+	return c.put(ctx, key, value, url.Values{"acquire": {session}})
+}
+
+func (c *Client) delete(ctx context.Context, key string, q url.Values) (bool, error) {
+	resp, err := c.do(ctx, "DELETE", kvPath(key), q, nil, http.StatusOK)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var ok bool
+	err = json.NewDecoder(resp.Body).Decode(&ok)
+	return ok, err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.delete(ctx, key, nil)
+	return err
+}
+
+// DeleteCAS deletes key if it was last modified at index, and returns whether
+// it did.
+func (c *Client) DeleteCAS(ctx context.Context, key string, index uint64) (bool, error) {
+	return c.delete(ctx, key, url.Values{"cas": {strconv.FormatUint(index, 10)}})
+}
+
+// DeleteTree deletes every key starting with prefix.
+func (c *Client) DeleteTree(ctx context.Context, prefix string) error {
+	_, err := c.delete(ctx, prefix, url.Values{"recurse": {""}})
+	return err
+}
+
+// Txn applies ops atomically. It returns false, having applied none of them,
+// if one of their checks failed.
+func (c *Client) Txn(ctx context.Context, ops ...TxnOp) (bool, error) {
+	type kvOp struct {
+		KV TxnOp
+	}
+	body := make([]kvOp, len(ops))
+	for i, op := range ops {
+		body[i].KV = op
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(ctx, "PUT", "/v1/txn", nil, bytes.NewReader(b), http.StatusOK, http.StatusConflict)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// CreateSession creates a session that ends unless renewed within ttl,
+// deleting the keys it holds.
+func (c *Client) CreateSession(ctx context.Context, ttl time.Duration) (string, error) {
+	b, err := json.Marshal(map[string]string{
+		"TTL":      fmt.Sprintf("%ds", ttl/time.Second),
+		"Behavior": "delete",
+		// Keys a session held may be taken again at once; without this,
+		// a lock held by a node that died stays unavailable for a while
+		// after the session ends.
+		"LockDelay": "0s",
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(ctx, "PUT", "/v1/session/create", nil, bytes.NewReader(b), http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		ID string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	return out.ID, err
+}
+
+// RenewSession restarts the TTL of a session. It returns
+// torus.ErrLeaseNotFound if the session has ended.
+func (c *Client) RenewSession(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, "PUT", "/v1/session/renew/"+url.PathEscape(id), nil, nil, http.StatusOK)
+	if err != nil {
+		if e, ok := err.(*consulError); ok && e.status == http.StatusNotFound {
+			return torus.ErrLeaseNotFound
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DestroySession ends a session, deleting the keys it holds.
+func (c *Client) DestroySession(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, "PUT", "/v1/session/destroy/"+url.PathEscape(id), nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
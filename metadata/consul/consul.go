@@ -0,0 +1,715 @@
+// Package consul implements the metadata service on the KV store of Consul,
+// for clusters that run it rather than etcd. It is selected by a
+// consul://host:port metadata address, and keeps the same keys as the etcd
+// metadata service. Consul sessions stand in for etcd leases.
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "consul")
+
+const (
+	// KeyPrefix is the same as the etcd one, less the leading slash, which
+	// Consul keys don't have.
+	KeyPrefix = "github.com/alternative-storage/torus/"
+	// lastSeenSlack is how far past the peer timeout a peer's last
+	// heartbeat may be before it's ignored even though its session is
+	// still there, allowing for skew between the nodes' clocks.
+	lastSeenSlack = 20 * time.Second
+	// minSessionTTL is the shortest session TTL Consul accepts.
+	minSessionTTL = 10 * time.Second
+	// ringWait is how long a blocking query for the ring waits for a
+	// change before it's made again.
+	ringWait = 5 * time.Minute
+)
+
+var (
+	promAtomicRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_consul_atomic_retries",
+		Help: "Number of times an atomic update failed and needed to be retried",
+	}, []string{"key"})
+	promOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_consul_base_ops_total",
+		Help: "Number of metadata operations against consul",
+	}, []string{"kind"})
+	promOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_consul_op_duration_seconds",
+		Help:    "Latency of metadata operations against consul",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"kind"})
+	promOpErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_consul_op_errors_total",
+		Help: "Number of metadata operations against consul that returned an error, by reason",
+	}, []string{"kind", "reason"})
+)
+
+func init() {
+	torus.RegisterMetadataService("consul", newConsulMetadata)
+	torus.RegisterMetadataInit("consul", initConsulMetadata)
+	torus.RegisterMetadataWipe("consul", wipeConsulMetadata)
+	torus.RegisterSetRing("consul", setRing)
+
+	prometheus.MustRegister(promAtomicRetries)
+	prometheus.MustRegister(promOps)
+	prometheus.MustRegister(promOpDuration)
+	prometheus.MustRegister(promOpErrors)
+}
+
+// observeOp records one metadata operation of the given kind that started at
+// start and returned *err. It is meant to be deferred.
+func observeOp(kind string, start time.Time, err *error) {
+	promOps.WithLabelValues(kind).Inc()
+	promOpDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		promOpErrors.WithLabelValues(kind, opErrorReason(*err)).Inc()
+	}
+}
+
+// opErrorReason classifies an error for promOpErrors, as the etcd metadata
+// service does.
+func opErrorReason(err error) string {
+	switch err {
+	case torus.ErrNonSequentialRing:
+		return "non_sequential_ring"
+	case torus.ErrAgain:
+		return "again"
+	case torus.ErrNotExist, torus.ErrNoGlobalMetadata:
+		return "not_exist"
+	case context.DeadlineExceeded, context.Canceled:
+		return "timeout"
+	}
+	return "other"
+}
+
+func MkKey(s ...string) string {
+	return KeyPrefix + strings.Join(s, "/")
+}
+
+// mkPrefix is the prefix of the keys under MkKey(s...).
+func mkPrefix(s ...string) string {
+	return MkKey(s...) + "/"
+}
+
+type consulCtx struct {
+	consul *Consul
+	ctx    context.Context
+}
+
+type Consul struct {
+	consulCtx
+	mut          sync.RWMutex
+	cfg          torus.Config
+	global       torus.GlobalMetadata
+	volumesCache map[string]*models.Volume
+
+	ringListeners []chan torus.Ring
+	stopWatch     context.CancelFunc
+
+	Client *Client
+
+	// Leases are handed out as numbers standing for the sessions in
+	// sessions.
+	leaseMut  sync.Mutex
+	sessions  map[int64]string
+	lastLease int64
+
+	uuid string
+}
+
+// address returns the first of the comma-separated metadata addresses of
+// cfg. Consul is reached through one agent, which forwards to the servers.
+func address(cfg torus.Config) string {
+	return strings.Split(cfg.MetadataAddress, ",")[0]
+}
+
+func newConsulMetadata(cfg torus.Config) (torus.MetadataService, error) {
+	var uuid string
+	var err error
+	if cfg.MetadataDir() == "" {
+		uuid = metadata.MakeUUID()
+	} else {
+		uuid, err = metadata.GetUUID(cfg.MetadataDir())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(address(cfg), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Consul{
+		cfg:          cfg,
+		Client:       client,
+		volumesCache: make(map[string]*models.Volume),
+		sessions:     make(map[int64]string),
+		uuid:         uuid,
+	}
+	c.consulCtx.consul = c
+	err = c.getGlobalMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.watchRingUpdates(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *consulCtx) Kind() torus.MetadataKind {
+	return torus.ConsulMetadata
+}
+
+func (c *Consul) Close() error {
+	c.stopWatch()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, l := range c.ringListeners {
+		close(l)
+	}
+	c.ringListeners = nil
+	return nil
+}
+
+func (c *Consul) getGlobalMetadata() error {
+	kv, err := c.Client.Get(context.Background(), MkKey("meta", "globalmetadata"))
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return torus.ErrNoGlobalMetadata
+	}
+	var gmd torus.GlobalMetadata
+	err = json.Unmarshal(kv.Value, &gmd)
+	if err != nil {
+		return err
+	}
+	c.global = gmd
+	return nil
+}
+
+func (c *Consul) WithContext(ctx context.Context) torus.MetadataService {
+	return &consulCtx{
+		consul: c,
+		ctx:    ctx,
+	}
+}
+
+func (c *Consul) SubscribeNewRings(ch chan torus.Ring) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.ringListeners = append(c.ringListeners, ch)
+}
+
+func (c *Consul) UnsubscribeNewRings(ch chan torus.Ring) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for i, l := range c.ringListeners {
+		if ch == l {
+			c.ringListeners = append(c.ringListeners[:i], c.ringListeners[i+1:]...)
+		}
+	}
+}
+
+// Session returns the Consul session that lease stands for.
+func (c *Consul) Session(lease int64) (string, error) {
+	c.leaseMut.Lock()
+	defer c.leaseMut.Unlock()
+	s, ok := c.sessions[lease]
+	if !ok {
+		return "", torus.ErrLeaseNotFound
+	}
+	return s, nil
+}
+
+// Context-sensitive calls
+
+func (c *consulCtx) getContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c *consulCtx) WithContext(ctx context.Context) torus.MetadataService {
+	return c.consul.WithContext(ctx)
+}
+
+// Context returns the context calls are made under.
+func (c *consulCtx) Context() context.Context {
+	return c.getContext()
+}
+
+// Unwrap returns the Consul calls are made through, for packages keeping
+// metadata of their own in it.
+func (c *consulCtx) Unwrap() *Consul {
+	return c.consul
+}
+
+func (c *consulCtx) Close() error {
+	return c.consul.Close()
+}
+
+func (c *consulCtx) GlobalMetadata() torus.GlobalMetadata {
+	return c.consul.global
+}
+
+func (c *consulCtx) UUID() string {
+	return c.consul.uuid
+}
+
+// RegisterPeer keeps p under the node's key, held by the session of lease so
+// that it goes away with the node.
+func (c *consulCtx) RegisterPeer(lease int64, p *models.PeerInfo) (err error) {
+	defer observeOp("register-peer", time.Now(), &err)
+	if lease == 0 {
+		return errors.New("no lease")
+	}
+	session, err := c.consul.Session(lease)
+	if err != nil {
+		return err
+	}
+	p.LastSeen = time.Now().UnixNano()
+	data, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	key := MkKey("nodes", p.UUID)
+	for {
+		ok, err := c.consul.Client.Acquire(c.getContext(), key, data, session)
+		if err != nil || ok {
+			return err
+		}
+		// The key is held by the session of an earlier run of this node,
+		// which hasn't timed out yet. End it, as etcd would overwrite the
+		// key.
+		kv, err := c.consul.Client.Get(c.getContext(), key)
+		if err != nil {
+			return err
+		}
+		if kv != nil && kv.Session != "" && kv.Session != session {
+			clog.Infof("ending stale session %s of peer %s", kv.Session, p.UUID)
+			if err := c.consul.Client.DestroySession(c.getContext(), kv.Session); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *consulCtx) GetPeers() (_ torus.PeerInfoList, err error) {
+	defer observeOp("get-peers", time.Now(), &err)
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("nodes"))
+	if err != nil {
+		return nil, err
+	}
+	var out []*models.PeerInfo
+	for _, x := range kvs {
+		var p models.PeerInfo
+		err := p.Unmarshal(x.Value)
+		if err != nil {
+			// Intentionally ignore a peer that doesn't unmarshal properly.
+			clog.Errorf("peer at key %s didn't unmarshal correctly: %v", x.Key, err)
+			continue
+		}
+		if time.Since(time.Unix(0, p.LastSeen)) > c.consul.global.PeerTimeoutOrDefault()+lastSeenSlack {
+			clog.Warningf("peer at key %s didn't unregister; its session should have ended", x.Key)
+			continue
+		}
+		out = append(out, &p)
+	}
+	return torus.PeerInfoList(out), nil
+}
+
+// AtomicModifyFunc is a class of commutative functions that, given the current
+// state of a key's value `in`, returns the new state of the key `out`, and
+// `data` to be returned to the calling function on success, or an `err`.
+//
+// This function may be run multiple times, if the value has changed in the time
+// between getting the data and setting the new value.
+type AtomicModifyFunc func(in []byte) (out []byte, data interface{}, err error)
+
+func (c *consulCtx) AtomicModifyKey(key string, f AtomicModifyFunc) (interface{}, error) {
+	for {
+		kv, err := c.consul.Client.Get(c.getContext(), key)
+		if err != nil {
+			return nil, err
+		}
+		var index uint64
+		value := []byte{}
+		if kv != nil {
+			index = kv.ModifyIndex
+			value = kv.Value
+		}
+		newBytes, fval, err := f(value)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := c.consul.Client.CAS(c.getContext(), key, newBytes, index)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return fval, nil
+		}
+		promAtomicRetries.WithLabelValues(key).Inc()
+	}
+}
+
+func BytesAddOne(in []byte) ([]byte, interface{}, error) {
+	newval := BytesToUint64(in) + 1
+	return Uint64ToBytes(newval), newval, nil
+}
+
+func (c *consulCtx) GetVolumes() (_ []*models.Volume, _ torus.VolumeID, err error) {
+	defer observeOp("get-volumes", time.Now(), &err)
+	minter, err := c.consul.Client.Get(c.getContext(), MkKey("meta", "volumeminter"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if minter == nil {
+		return nil, 0, torus.ErrNoGlobalMetadata
+	}
+	list, err := c.consul.Client.List(c.getContext(), mkPrefix("volumeid"))
+	if err != nil {
+		return nil, 0, err
+	}
+	var out []*models.Volume
+	for _, x := range list {
+		v := &models.Volume{}
+		err := v.Unmarshal(x.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, v)
+	}
+	clog.Tracef("got volume list: %v", out)
+	return out, torus.VolumeID(BytesToUint64(minter.Value)), nil
+}
+
+func (c *consulCtx) GetVolume(volume string) (_ *models.Volume, err error) {
+	defer observeOp("get-volume", time.Now(), &err)
+	c.consul.mut.Lock()
+	defer c.consul.mut.Unlock()
+	if v, ok := c.consul.volumesCache[volume]; ok {
+		return v, nil
+	}
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("volumes", volume))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, torus.ErrNotExist
+	}
+	vid := BytesToUint64(kv.Value)
+	kv, err = c.consul.Client.Get(c.getContext(), MkKey("volumeid", Uint64ToHex(vid)))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, fmt.Errorf("consul: volume ID %q not found", Uint64ToHex(vid))
+	}
+	v := &models.Volume{}
+	err = v.Unmarshal(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	c.consul.volumesCache[volume] = v
+	clog.Tracef("got volume: %v", volume)
+	return v, nil
+}
+
+func (c *consulCtx) GetLockStatus(vid uint64) string {
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(vid), "blocklock"))
+	if err != nil {
+		clog.Debugf("Failed to get lock status: %v", err)
+		return "unknown"
+	}
+	if kv == nil {
+		return "free"
+	}
+	return "in-use"
+}
+
+// GetLease creates a session, which holds the keys tied to the lease.
+func (c *consulCtx) GetLease() (_ int64, err error) {
+	defer observeOp("get-lease", time.Now(), &err)
+	ttl := c.consul.global.PeerTimeoutOrDefault()
+	if ttl < minSessionTTL {
+		ttl = minSessionTTL
+	}
+	session, err := c.consul.Client.CreateSession(c.getContext(), ttl)
+	if err != nil {
+		return 0, err
+	}
+	c.consul.leaseMut.Lock()
+	defer c.consul.leaseMut.Unlock()
+	c.consul.lastLease++
+	c.consul.sessions[c.consul.lastLease] = session
+	clog.Tracef("created new session %s for lease %d, TTL %s", session, c.consul.lastLease, ttl)
+	return c.consul.lastLease, nil
+}
+
+func (c *consulCtx) RenewLease(lease int64) (err error) {
+	defer observeOp("renew-lease", time.Now(), &err)
+	session, err := c.consul.Session(lease)
+	if err != nil {
+		return err
+	}
+	err = c.consul.Client.RenewSession(c.getContext(), session)
+	if err == torus.ErrLeaseNotFound {
+		c.consul.dropLease(lease)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	clog.Tracef("renewed session %s for lease %d", session, lease)
+	return nil
+}
+
+func (c *consulCtx) RevokeLease(lease int64) (err error) {
+	defer observeOp("revoke-lease", time.Now(), &err)
+	session, err := c.consul.Session(lease)
+	if err != nil {
+		return err
+	}
+	err = c.consul.Client.DestroySession(c.getContext(), session)
+	if err != nil {
+		return err
+	}
+	c.consul.dropLease(lease)
+	return nil
+}
+
+func (c *Consul) dropLease(lease int64) {
+	c.leaseMut.Lock()
+	defer c.leaseMut.Unlock()
+	delete(c.sessions, lease)
+}
+
+func (c *consulCtx) GetRebalanceSettings() (_ torus.RebalanceSettings, err error) {
+	defer observeOp("get-rebalance", time.Now(), &err)
+	var rs torus.RebalanceSettings
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("meta", "rebalance"))
+	if err != nil || kv == nil {
+		return rs, err
+	}
+	err = json.Unmarshal(kv.Value, &rs)
+	return rs, err
+}
+
+func (c *consulCtx) SetRebalanceSettings(rs torus.RebalanceSettings) (err error) {
+	defer observeOp("set-rebalance", time.Now(), &err)
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	return c.consul.Client.Put(c.getContext(), MkKey("meta", "rebalance"), b)
+}
+
+// RecordClusterEvent stores e under a key sorting by time, then drops the
+// oldest events past torus.MaxClusterEvents or torus.MaxClusterEventAge.
+func (c *consulCtx) RecordClusterEvent(e torus.AuditEvent) (err error) {
+	defer observeOp("record-event", time.Now(), &err)
+	now := time.Now().UTC()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	key := MkKey("events", torus.ClusterEventName(e.Time, c.UUID()))
+	err = c.consul.Client.Put(c.getContext(), key, b)
+	if err != nil {
+		return err
+	}
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("events"))
+	if err != nil {
+		return err
+	}
+	for i, kv := range kvs {
+		if i >= len(kvs)-torus.MaxClusterEvents && !torus.ClusterEventExpired(kv.Key, now) {
+			break
+		}
+		err = c.consul.Client.Delete(c.getContext(), kv.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetClusterEvents returns the stored events, numbering each by the Consul
+// index that created it.
+func (c *consulCtx) GetClusterEvents() (_ []torus.AuditEvent, err error) {
+	defer observeOp("get-events", time.Now(), &err)
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("events"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]torus.AuditEvent, 0, len(kvs))
+	for _, kv := range kvs {
+		var e torus.AuditEvent
+		if err := json.Unmarshal(kv.Value, &e); err != nil {
+			clog.Errorf("event at key %s didn't unmarshal correctly: %v", kv.Key, err)
+			continue
+		}
+		e.Seq = kv.CreateIndex
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (c *consulCtx) GetScrubStatus(uuid string) (_ torus.ScrubStatus, err error) {
+	defer observeOp("get-scrub", time.Now(), &err)
+	st := torus.ScrubStatus{UUID: uuid}
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("scrub", uuid))
+	if err != nil || kv == nil {
+		return st, err
+	}
+	err = json.Unmarshal(kv.Value, &st)
+	return st, err
+}
+
+func (c *consulCtx) SetScrubStatus(st torus.ScrubStatus) (err error) {
+	defer observeOp("set-scrub", time.Now(), &err)
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return c.consul.Client.Put(c.getContext(), MkKey("scrub", st.UUID), b)
+}
+
+func (c *consulCtx) GetScrubStatuses() (_ []torus.ScrubStatus, err error) {
+	defer observeOp("get-scrubs", time.Now(), &err)
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("scrub"))
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.ScrubStatus
+	for _, kv := range kvs {
+		var st torus.ScrubStatus
+		if err := json.Unmarshal(kv.Value, &st); err != nil {
+			clog.Errorf("scrub status at key %s didn't unmarshal correctly: %v", kv.Key, err)
+			continue
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func (c *consulCtx) GetRing() (torus.Ring, error) {
+	r, _, err := c.getRing()
+	return r, err
+}
+
+// getRing returns the ring and the index it was last modified at.
+func (c *consulCtx) getRing() (_ torus.Ring, _ uint64, err error) {
+	defer observeOp("get-ring", time.Now(), &err)
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("meta", "the-one-ring"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if kv == nil {
+		return nil, 0, torus.ErrNoGlobalMetadata
+	}
+	r, err := ring.Unmarshal(kv.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	clog.Tracef("got ring at index: %v", kv.ModifyIndex)
+	return r, kv.ModifyIndex, nil
+}
+
+func (c *consulCtx) SubscribeNewRings(ch chan torus.Ring) {
+	c.consul.SubscribeNewRings(ch)
+}
+
+func (c *consulCtx) UnsubscribeNewRings(ch chan torus.Ring) {
+	c.consul.UnsubscribeNewRings(ch)
+}
+
+// SetRing replaces the ring with one of the next version. It returns
+// ErrNonSequentialRing if ring doesn't follow the current one, and ErrAgain
+// if the ring changed while it was being replaced.
+func (c *consulCtx) SetRing(ring torus.Ring) (err error) {
+	defer observeOp("set-ring", time.Now(), &err)
+	oldr, index, err := c.getRing()
+	if err != nil {
+		return err
+	}
+	if oldr.Version() != ring.Version()-1 {
+		return torus.ErrNonSequentialRing
+	}
+	b, err := ring.Marshal()
+	if err != nil {
+		return err
+	}
+	ok, err := c.consul.Client.CAS(c.getContext(), MkKey("meta", "the-one-ring"), b, index)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	clog.Tracef("set ring version: %v", ring.Version())
+	return torus.ErrAgain
+}
+
+func (c *consulCtx) CommitINodeIndex(vid torus.VolumeID) (_ torus.INodeID, err error) {
+	defer observeOp("commit-inode-index", time.Now(), &err)
+	c.consul.mut.Lock()
+	defer c.consul.mut.Unlock()
+	newID, err := c.AtomicModifyKey(MkKey("volumemeta", Uint64ToHex(uint64(vid)), "inode"), BytesAddOne)
+	if err != nil {
+		return 0, err
+	}
+	clog.Tracef("committed inode index: %v", vid)
+	return torus.INodeID(newID.(uint64)), nil
+}
+
+func (c *consulCtx) NewVolumeID() (_ torus.VolumeID, err error) {
+	defer observeOp("new-volume-id", time.Now(), &err)
+	c.consul.mut.Lock()
+	defer c.consul.mut.Unlock()
+	newID, err := c.AtomicModifyKey(MkKey("meta", "volumeminter"), BytesAddOne)
+	if err != nil {
+		return 0, err
+	}
+	clog.Tracef("made new volume ID: %v", newID)
+	return torus.VolumeID(newID.(uint64)), nil
+}
+
+func (c *consulCtx) GetINodeIndex(vid torus.VolumeID) (_ torus.INodeID, err error) {
+	defer observeOp("get-inode-index", time.Now(), &err)
+	c.consul.mut.Lock()
+	defer c.consul.mut.Unlock()
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "inode"))
+	if err != nil {
+		return torus.INodeID(0), err
+	}
+	if kv == nil {
+		return torus.INodeID(0), torus.ErrNotExist
+	}
+	id := BytesToUint64(kv.Value)
+	clog.Tracef("got INode Index: %v", id)
+	return torus.INodeID(id), nil
+}
@@ -0,0 +1,231 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func newTestConsul(t *testing.T) (*fakeConsul, *Consul) {
+	f := newFakeConsul()
+	cfg := torus.Config{MetadataAddress: f.addr()}
+	if got := torus.MetadataServiceFor(cfg); got != "consul" {
+		t.Fatalf("expected %s to select consul, got %s", cfg.MetadataAddress, got)
+	}
+	err := torus.InitMDS("consul", cfg, torus.GlobalMetadata{BlockSize: 4096}, ring.Ketama)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torus.InitMDS("consul", cfg, torus.GlobalMetadata{BlockSize: 4096}, ring.Ketama); err != torus.ErrExists {
+		t.Fatalf("expected a second init to fail with ErrExists, got %v", err)
+	}
+	mds, err := torus.CreateMetadataService("consul", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mds.GlobalMetadata().BlockSize != 4096 {
+		t.Fatalf("wrong global metadata: %+v", mds.GlobalMetadata())
+	}
+	return f, mds.(*Consul)
+}
+
+func nextRing(t *testing.T, r torus.Ring) torus.Ring {
+	next, err := r.(torus.ModifyableRing).ChangeReplication(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return next
+}
+
+func TestConsulSetRing(t *testing.T) {
+	f, c := newTestConsul(t)
+	defer f.Close()
+	defer c.Close()
+	ch := make(chan torus.Ring, 1)
+	c.SubscribeNewRings(ch)
+
+	r, err := c.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := nextRing(t, r)
+	if err := c.SetRing(next); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		if got.Version() != next.Version() {
+			t.Fatalf("watch gave ring version %d, expected %d", got.Version(), next.Version())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new ring wasn't seen by the watch")
+	}
+	c.UnsubscribeNewRings(ch)
+	if err := c.SetRing(next); err != torus.ErrNonSequentialRing {
+		t.Fatalf("expected ErrNonSequentialRing setting the same version again, got %v", err)
+	}
+
+	// Another node replaces the ring between the read and the write.
+	last := nextRing(t, next)
+	f.mut.Lock()
+	f.beforeCAS = func(key string) {
+		f.beforeCAS = nil
+		f.set(key, f.kv[key].Value, "")
+	}
+	f.mut.Unlock()
+	if err := c.SetRing(last); err != torus.ErrAgain {
+		t.Fatalf("expected ErrAgain when the ring changed underneath, got %v", err)
+	}
+	if err := c.SetRing(last); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulLeases(t *testing.T) {
+	f, c := newTestConsul(t)
+	defer f.Close()
+	defer c.Close()
+
+	lease, err := c.GetLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterPeer(lease, &models.PeerInfo{UUID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// A restarted node takes its key back from its earlier session.
+	lease2, err := c.GetLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterPeer(lease2, &models.PeerInfo{UUID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := c.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].UUID != "a" {
+		t.Fatalf("expected peer a, got %v", peers)
+	}
+	if err := c.RenewLease(lease2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RevokeLease(lease2); err != nil {
+		t.Fatal(err)
+	}
+	peers, err = c.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected the peer to go with its session, got %v", peers)
+	}
+	if err := c.RenewLease(lease2); err != torus.ErrLeaseNotFound {
+		t.Fatalf("expected ErrLeaseNotFound renewing a revoked lease, got %v", err)
+	}
+}
+
+func TestConsulVolumeIDs(t *testing.T) {
+	f, c := newTestConsul(t)
+	defer f.Close()
+	defer c.Close()
+
+	for want := torus.VolumeID(2); want < 5; want++ {
+		id, err := c.NewVolumeID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Fatalf("expected volume ID %d, got %d", want, id)
+		}
+	}
+	_, high, err := c.GetVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if high != 4 {
+		t.Fatalf("expected the highest volume ID to be 4, got %d", high)
+	}
+	if _, err := c.GetVolume("nope"); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist for a missing volume, got %v", err)
+	}
+}
+
+func TestConsulPeerTimeout(t *testing.T) {
+	f, c := newTestConsul(t)
+	defer f.Close()
+	defer c.Close()
+
+	p := models.PeerInfo{UUID: "late", LastSeen: time.Now().Add(-40 * time.Second).UnixNano()}
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mut.Lock()
+	f.set(MkKey("nodes", p.UUID), data, "")
+	f.mut.Unlock()
+
+	peers, err := c.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("expected the peer within the default timeout, got %d peers", len(peers))
+	}
+	c.global.PeerTimeout = 10 * time.Second
+	peers, err = c.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("expected the peer past the cluster's timeout to be left out, got %d peers", len(peers))
+	}
+}
+
+func TestConsulWatchGCSettings(t *testing.T) {
+	f, c := newTestConsul(t)
+	defer f.Close()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := c.WatchGCSettings(ctx)
+	next := func() torus.GCSettings {
+		select {
+		case gs := <-ch:
+			return gs
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for gc settings")
+		}
+		return torus.GCSettings{}
+	}
+	if gs := next(); gs != (torus.GCSettings{}) {
+		t.Fatalf("expected unset settings first, got %+v", gs)
+	}
+	want := torus.GCSettings{WindowStart: "01:00", WindowEnd: "05:00", RateLimit: 1 << 20}
+	if err := c.SetGCSettings(want); err != nil {
+		t.Fatal(err)
+	}
+	if gs := next(); gs != want {
+		t.Fatalf("expected %+v, got %+v", want, gs)
+	}
+	// Other keys changing wakes the query without sending anything.
+	if _, err := c.NewVolumeID(); err != nil {
+		t.Fatal(err)
+	}
+	want.RateLimit = 0
+	if err := c.SetGCSettings(want); err != nil {
+		t.Fatal(err)
+	}
+	if gs := next(); gs != want {
+		t.Fatalf("expected %+v, got %+v", want, gs)
+	}
+	cancel()
+	for range ch {
+	}
+}
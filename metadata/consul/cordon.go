@@ -0,0 +1,48 @@
+package consul
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+func (c *consulCtx) GetCordons() (_ []torus.Cordon, err error) {
+	defer observeOp("get-cordons", time.Now(), &err)
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("cordons"))
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.Cordon
+	for _, kv := range kvs {
+		var cd torus.Cordon
+		if err := json.Unmarshal(kv.Value, &cd); err != nil {
+			clog.Errorf("cordon at key %s didn't unmarshal correctly: %v", kv.Key, err)
+			continue
+		}
+		out = append(out, cd)
+	}
+	return out, nil
+}
+
+func (c *consulCtx) SetCordon(cd torus.Cordon) (err error) {
+	defer observeOp("set-cordon", time.Now(), &err)
+	b, err := json.Marshal(cd)
+	if err != nil {
+		return err
+	}
+	return c.consul.Client.Put(c.getContext(), MkKey("cordons", cd.UUID), b)
+}
+
+func (c *consulCtx) RemoveCordon(uuid string) (err error) {
+	defer observeOp("remove-cordon", time.Now(), &err)
+	key := MkKey("cordons", uuid)
+	kv, err := c.consul.Client.Get(c.getContext(), key)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return torus.ErrNotExist
+	}
+	return c.consul.Client.Delete(c.getContext(), key)
+}
@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"io"
+	"strings"
+
+	"github.com/alternative-storage/torus/models"
+)
+
+func (c *consulCtx) DumpMetadata(w io.Writer) error {
+	io.WriteString(w, "## Volumes\n")
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("volumeid"))
+	if err != nil {
+		return err
+	}
+	for _, x := range kvs {
+		io.WriteString(w, x.Key+":\n")
+		v := &models.Volume{}
+		v.Unmarshal(x.Value)
+		io.WriteString(w, v.String())
+		io.WriteString(w, "\n")
+	}
+	kvs, err = c.consul.Client.List(c.getContext(), mkPrefix("volumemeta"))
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, "## INodes\n")
+	for _, x := range kvs {
+		if !strings.HasSuffix(x.Key, "/inode") {
+			continue
+		}
+		io.WriteString(w, x.Key+":\n")
+		io.WriteString(w, Uint64ToHex(BytesToUint64(x.Value)))
+		io.WriteString(w, "\n")
+	}
+	io.WriteString(w, "## BlockLocks\n")
+	for _, x := range kvs {
+		if !strings.HasSuffix(x.Key, "/blocklock") {
+			continue
+		}
+		io.WriteString(w, x.Key+":\n")
+		io.WriteString(w, string(x.Value))
+		io.WriteString(w, "\n")
+	}
+	return nil
+}
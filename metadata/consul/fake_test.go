@@ -0,0 +1,249 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeConsul serves the parts of the Consul HTTP API that Client uses, from
+// memory. Sessions never time out.
+type fakeConsul struct {
+	mut      sync.Mutex
+	index    uint64
+	kv       map[string]*KVPair
+	sessions map[string]bool
+	changed  chan struct{}
+	// beforeCAS, if set, is called before a cas write is checked.
+	beforeCAS func(key string)
+	srv       *httptest.Server
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		kv:       make(map[string]*KVPair),
+		sessions: make(map[string]bool),
+		changed:  make(chan struct{}),
+	}
+	f.srv = httptest.NewServer(f)
+	return f
+}
+
+// addr is the metadata address of the server.
+func (f *fakeConsul) addr() string {
+	return "consul://" + strings.TrimPrefix(f.srv.URL, "http://")
+}
+
+func (f *fakeConsul) Close() {
+	f.srv.Close()
+}
+
+// bump starts a new index, waking blocking queries. f.mut is held.
+func (f *fakeConsul) bump() uint64 {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return f.index
+}
+
+func (f *fakeConsul) set(key string, value []byte, session string) {
+	idx := f.bump()
+	kv, ok := f.kv[key]
+	if !ok {
+		kv = &KVPair{Key: key, CreateIndex: idx}
+		f.kv[key] = kv
+	}
+	kv.Value = value
+	kv.ModifyIndex = idx
+	if session != "" {
+		kv.Session = session
+	}
+}
+
+func (f *fakeConsul) del(key string, tree bool) {
+	f.bump()
+	for k := range f.kv {
+		if k == key || (tree && strings.HasPrefix(k, key)) {
+			delete(f.kv, k)
+		}
+	}
+}
+
+func (f *fakeConsul) list(key string, tree bool) []*KVPair {
+	var out []*KVPair
+	for k, kv := range f.kv {
+		if k == key || (tree && strings.HasPrefix(k, key)) {
+			c := *kv
+			out = append(out, &c)
+		}
+	}
+	sort.Sort(kvsByKey(out))
+	return out
+}
+
+type kvsByKey []*KVPair
+
+func (k kvsByKey) Len() int           { return len(k) }
+func (k kvsByKey) Less(i, j int) bool { return k[i].Key < k[j].Key }
+func (k kvsByKey) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+// apply checks op if check is set, returning whether it would succeed, and
+// applies it otherwise. f.mut is held.
+func (f *fakeConsul) apply(op TxnOp, check bool) bool {
+	kv := f.kv[op.Key]
+	switch op.Verb {
+	case "check-not-exists":
+		return kv == nil
+	case "check-index":
+		return kv != nil && kv.ModifyIndex == op.Index
+	case "lock":
+		if check {
+			return f.sessions[op.Session] && (kv == nil || kv.Session == "" || kv.Session == op.Session)
+		}
+		f.set(op.Key, op.Value, op.Session)
+	case "set":
+		if !check {
+			f.set(op.Key, op.Value, "")
+		}
+	case "delete", "delete-tree":
+		if !check {
+			f.del(op.Key, op.Verb == "delete-tree")
+		}
+	default:
+		panic("fake consul: unknown verb " + op.Verb)
+	}
+	return true
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	_, recurse := q["recurse"]
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case "GET":
+			f.get(w, r, key, recurse)
+		case "PUT":
+			value, _ := ioutil.ReadAll(r.Body)
+			f.mut.Lock()
+			defer f.mut.Unlock()
+			if _, ok := q["cas"]; ok && f.beforeCAS != nil {
+				f.beforeCAS(key)
+			}
+			kv := f.kv[key]
+			ok := true
+			if cas := q.Get("cas"); cas != "" {
+				idx, _ := strconv.ParseUint(cas, 10, 64)
+				ok = (idx == 0 && kv == nil) || (kv != nil && kv.ModifyIndex == idx)
+			}
+			session := q.Get("acquire")
+			if session != "" {
+				ok = f.sessions[session] && (kv == nil || kv.Session == "" || kv.Session == session)
+			}
+			if ok {
+				f.set(key, value, session)
+			}
+			json.NewEncoder(w).Encode(ok)
+		case "DELETE":
+			f.mut.Lock()
+			defer f.mut.Unlock()
+			kv := f.kv[key]
+			ok := true
+			if cas := q.Get("cas"); cas != "" {
+				idx, _ := strconv.ParseUint(cas, 10, 64)
+				ok = kv != nil && kv.ModifyIndex == idx
+			}
+			if ok {
+				f.del(key, recurse)
+			}
+			json.NewEncoder(w).Encode(ok)
+		}
+	case r.URL.Path == "/v1/txn":
+		var ops []struct {
+			KV TxnOp
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mut.Lock()
+		defer f.mut.Unlock()
+		for _, op := range ops {
+			if !f.apply(op.KV, true) {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"Errors":[{"What":"check failed"}]}`)
+				return
+			}
+		}
+		for _, op := range ops {
+			f.apply(op.KV, false)
+		}
+		fmt.Fprint(w, `{"Results":[]}`)
+	case r.URL.Path == "/v1/session/create":
+		f.mut.Lock()
+		defer f.mut.Unlock()
+		id := fmt.Sprintf("session-%d", f.bump())
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		f.mut.Lock()
+		defer f.mut.Unlock()
+		if !f.sessions[strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")] {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "[]")
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		f.mut.Lock()
+		defer f.mut.Unlock()
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for k, kv := range f.kv {
+			if kv.Session == id {
+				f.del(k, false)
+			}
+		}
+		fmt.Fprint(w, "true")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) get(w http.ResponseWriter, r *http.Request, key string, recurse bool) {
+	q := r.URL.Query()
+	f.mut.Lock()
+	if idx, _ := strconv.ParseUint(first(q["index"]), 10, 64); idx != 0 && idx >= f.index {
+		wait, _ := time.ParseDuration(first(q["wait"]))
+		ch := f.changed
+		f.mut.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+		}
+		f.mut.Lock()
+	}
+	defer f.mut.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	kvs := f.list(key, recurse)
+	if len(kvs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func first(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
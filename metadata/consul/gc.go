@@ -0,0 +1,129 @@
+package consul
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func (c *consulCtx) GetGCSettings() (_ torus.GCSettings, err error) {
+	defer observeOp("get-gc", time.Now(), &err)
+	var gs torus.GCSettings
+	kv, err := c.consul.Client.Get(c.getContext(), MkKey("meta", "gc"))
+	if err != nil || kv == nil {
+		return gs, err
+	}
+	err = json.Unmarshal(kv.Value, &gs)
+	return gs, err
+}
+
+func (c *consulCtx) SetGCSettings(gs torus.GCSettings) (err error) {
+	defer observeOp("set-gc", time.Now(), &err)
+	b, err := json.Marshal(gs)
+	if err != nil {
+		return err
+	}
+	return c.consul.Client.Put(c.getContext(), MkKey("meta", "gc"), b)
+}
+
+// WatchGCSettings follows the settings with blocking queries, sending them
+// and then the new settings each time they change, until ctx is done.
+func (c *consulCtx) WatchGCSettings(ctx context.Context) <-chan torus.GCSettings {
+	ch := make(chan torus.GCSettings)
+	go func() {
+		defer close(ch)
+		key := MkKey("meta", "gc")
+		var wait, modified uint64
+		first := true
+		for {
+			kv, next, err := c.consul.Client.Watch(ctx, key, wait, ringWait)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				clog.Errorf("error watching gc settings: %s", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			// The index may go backwards, such as when the servers lose
+			// their state; start over from the current one.
+			if next < wait {
+				next = 0
+			}
+			wait = next
+			var gs torus.GCSettings
+			var index uint64
+			if kv != nil {
+				index = kv.ModifyIndex
+				if err := json.Unmarshal(kv.Value, &gs); err != nil {
+					clog.Errorf("gc settings didn't unmarshal correctly: %v", err)
+					continue
+				}
+			}
+			if !first && index == modified {
+				continue
+			}
+			first = false
+			modified = index
+			select {
+			case ch <- gs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (c *consulCtx) SetGCStatus(st torus.GCStatus) (err error) {
+	defer observeOp("set-gc-status", time.Now(), &err)
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return c.consul.Client.Put(c.getContext(), MkKey("gc", st.UUID), b)
+}
+
+func (c *consulCtx) GetGCStatuses() (_ []torus.GCStatus, err error) {
+	defer observeOp("get-gc-statuses", time.Now(), &err)
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("gc"))
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.GCStatus
+	for _, kv := range kvs {
+		var st torus.GCStatus
+		if err := json.Unmarshal(kv.Value, &st); err != nil {
+			clog.Errorf("gc status at key %s didn't unmarshal correctly: %v", kv.Key, err)
+			continue
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func (c *consulCtx) GetTombstones() (_ []torus.VolumeTombstone, err error) {
+	defer observeOp("get-tombstones", time.Now(), &err)
+	kvs, err := c.consul.Client.List(c.getContext(), mkPrefix("tombstones"))
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.VolumeTombstone
+	for _, kv := range kvs {
+		var t torus.VolumeTombstone
+		if err := json.Unmarshal(kv.Value, &t); err != nil {
+			clog.Errorf("tombstone at key %s didn't unmarshal correctly: %v", kv.Key, err)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (c *consulCtx) RemoveTombstone(vid torus.VolumeID) (err error) {
+	defer observeOp("remove-tombstone", time.Now(), &err)
+	return c.consul.Client.Delete(c.getContext(), MkKey("tombstones", Uint64ToHex(uint64(vid))))
+}
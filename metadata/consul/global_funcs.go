@@ -0,0 +1,121 @@
+package consul
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+
+	"golang.org/x/net/context"
+)
+
+func initConsulMetadata(cfg torus.Config, gmd torus.GlobalMetadata, ringType torus.RingType) error {
+	clog.Tracef("Initializing consul metadata at %v", cfg.MetadataAddress)
+	gmdbytes, err := json.Marshal(gmd)
+	if err != nil {
+		return err
+	}
+	emptyRing, err := ring.CreateRing(ring.WithPlacement(ring.WithVNodes(&models.Ring{
+		Type:              uint32(ringType),
+		Version:           1,
+		ReplicationFactor: 2,
+	}, gmd.KetamaVNodes), ring.CurrentPlacement))
+	if err != nil {
+		return err
+	}
+	ringb, err := emptyRing.Marshal()
+	if err != nil {
+		return err
+	}
+
+	client, err := NewClient(address(cfg), cfg)
+	if err != nil {
+		return err
+	}
+
+	// Everything is written in one transaction, on the condition that none
+	// of it is there yet, so an init either happens entirely or not at all.
+	values := map[string][]byte{
+		MkKey("meta", "volumeminter"):   Uint64ToBytes(1),
+		MkKey("meta", "globalmetadata"): gmdbytes,
+		MkKey("meta", "the-one-ring"):   ringb,
+	}
+	var ops []TxnOp
+	for _, k := range initKeys {
+		ops = append(ops, OpCheckNotExists(k))
+	}
+	for _, k := range initKeys {
+		ops = append(ops, OpSet(k, values[k]))
+	}
+	ok, err := client.Txn(context.Background(), ops...)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	// A failed transaction returns nothing it read, so look at the keys
+	// on their own.
+	found := make(map[string]bool)
+	for _, k := range initKeys {
+		kv, err := client.Get(context.Background(), k)
+		if err != nil {
+			return err
+		}
+		found[k] = kv != nil
+	}
+	return checkInitState(found)
+}
+
+// initKeys are the keys an init writes.
+var initKeys = []string{
+	MkKey("meta", "volumeminter"),
+	MkKey("meta", "globalmetadata"),
+	MkKey("meta", "the-one-ring"),
+}
+
+// checkInitState tells why an init found some of initKeys already present.
+func checkInitState(found map[string]bool) error {
+	return metadata.CheckInitState(initKeys, found)
+}
+
+func wipeConsulMetadata(cfg torus.Config) error {
+	clog.Tracef("Wiping consul metadata at %v", cfg.MetadataAddress)
+	client, err := NewClient(address(cfg), cfg)
+	if err != nil {
+		return err
+	}
+	return client.DeleteTree(context.Background(), KeyPrefix)
+}
+
+func setRing(cfg torus.Config, r torus.Ring) (err error) {
+	defer observeOp("set-ring", time.Now(), &err)
+	clog.Tracef("Setting ring data at %v", cfg.MetadataAddress)
+	client, err := NewClient(address(cfg), cfg)
+	if err != nil {
+		return err
+	}
+
+	kv, err := client.Get(context.Background(), MkKey("meta", "the-one-ring"))
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return torus.ErrNoGlobalMetadata
+	}
+	oldr, err := ring.Unmarshal(kv.Value)
+	if err != nil {
+		return err
+	}
+	if oldr.Version() != r.Version()-1 {
+		return torus.ErrNonSequentialRing
+	}
+	b, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+	return client.Put(context.Background(), MkKey("meta", "the-one-ring"), b)
+}
@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func (c *Consul) watchRingUpdates() error {
+	r, index, err := c.getRing()
+	if err != nil {
+		clog.Errorf("can't get initial ring: %s", err)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopWatch = cancel
+	go c.watchRing(ctx, r, index)
+	return nil
+}
+
+// watchRing follows the ring with blocking queries, starting from the ring r
+// at index, until ctx is done.
+func (c *Consul) watchRing(ctx context.Context, r torus.Ring, index uint64) {
+	key := MkKey("meta", "the-one-ring")
+	wait := index
+	for {
+		kv, next, err := c.Client.Watch(ctx, key, wait, ringWait)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			clog.Errorf("error watching ring: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		// The index may go backwards, such as when the servers lose their
+		// state; start over from the current one.
+		if next < wait {
+			next = 0
+		}
+		wait = next
+		if kv == nil || kv.ModifyIndex <= index {
+			continue
+		}
+		index = kv.ModifyIndex
+		newRing, err := ring.Unmarshal(kv.Value)
+		if err != nil {
+			clog.Debugf("corrupted ring: %#v", kv.Value)
+			clog.Errorf("Failed to unmarshal ring: %s", err)
+			clog.Error("corrupted ring? Continuing with current ring")
+			continue
+		}
+
+		clog.Infof("got new ring")
+		if r.Version() == newRing.Version() {
+			clog.Warningf("Same ring version: %d", r.Version())
+		}
+		c.mut.RLock()
+		for _, x := range c.ringListeners {
+			// Close stops the watch before closing the listeners, which
+			// may no longer be read from.
+			select {
+			case x <- newRing:
+			case <-ctx.Done():
+			}
+		}
+		r = newRing
+		c.mut.RUnlock()
+	}
+}
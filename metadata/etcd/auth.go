@@ -0,0 +1,227 @@
+package etcd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alternative-storage/torus"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"golang.org/x/net/context"
+)
+
+// retiredClientGrace is how long a client replaced after its auth token
+// expired is kept open, so that calls already made through it can finish.
+const retiredClientGrace = time.Minute
+
+// clientConfig returns the etcd client configuration for cfg.
+func clientConfig(cfg torus.Config) etcdv3.Config {
+	return etcdv3.Config{
+		Endpoints: endpoints(cfg),
+		TLS:       cfg.TLS,
+		Username:  cfg.MetadataUsername,
+		Password:  cfg.MetadataPassword,
+	}
+}
+
+// isAuthErr reports whether err means the auth token a call was made with
+// is no longer valid, and logging in again would let it through.
+func isAuthErr(err error) bool {
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrInvalidAuthToken, rpctypes.ErrAuthOldRevision:
+		return true
+	}
+	return false
+}
+
+// authConn is the KV, Lease and Watcher of one logged-in client.
+type authConn struct {
+	client  *etcdv3.Client
+	kv      etcdv3.KV
+	lease   etcdv3.Lease
+	watcher etcdv3.Watcher
+}
+
+// authClient logs in again, with a new client, when the auth token of the
+// current one is refused. It is installed in the KV, Lease and Watcher of
+// the client it wraps, so that everything holding that client goes through
+// it. Watches aren't retried; whoever reads one calls reauth on an auth
+// error and watches again.
+type authClient struct {
+	dial func() (*etcdv3.Client, error)
+	orig *etcdv3.Client
+
+	mut    sync.Mutex
+	cur    *authConn
+	closed bool
+}
+
+// wrapAuth installs an authClient in client, dialing replacements with
+// dial.
+func wrapAuth(client *etcdv3.Client, dial func() (*etcdv3.Client, error)) *authClient {
+	a := &authClient{
+		dial: dial,
+		orig: client,
+		cur:  &authConn{client, client.KV, client.Lease, client.Watcher},
+	}
+	client.KV = &authKV{KV: client.KV, a: a}
+	client.Lease = &authLease{Lease: client.Lease, a: a}
+	client.Watcher = &authWatcher{Watcher: client.Watcher, a: a}
+	return a
+}
+
+func (a *authClient) conn() *authConn {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	return a.cur
+}
+
+// reauth replaces old, whose token was refused, with a newly logged-in
+// client, unless that already happened.
+func (a *authClient) reauth(old *authConn) (*authConn, error) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.cur != old || a.closed {
+		return a.cur, nil
+	}
+	client, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	clog.Infof("etcd auth token was refused; logged in again")
+	a.cur = &authConn{client, client.KV, client.Lease, client.Watcher}
+	if old.client != a.orig {
+		time.AfterFunc(retiredClientGrace, func() { old.client.Close() })
+	}
+	return a.cur, nil
+}
+
+// retry calls f with the current client, and once more with a new one if
+// its token was refused.
+func (a *authClient) retry(f func(c *authConn) error) error {
+	c := a.conn()
+	err := f(c)
+	if !isAuthErr(err) {
+		return err
+	}
+	c, err = a.reauth(c)
+	if err != nil {
+		return err
+	}
+	return f(c)
+}
+
+// close closes the client logged in last, if it isn't the wrapped one.
+func (a *authClient) close() error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.closed = true
+	if a.cur.client == a.orig {
+		return nil
+	}
+	return a.cur.client.Close()
+}
+
+type authKV struct {
+	etcdv3.KV
+	a *authClient
+}
+
+func (k *authKV) Get(ctx context.Context, key string, opts ...etcdv3.OpOption) (resp *etcdv3.GetResponse, err error) {
+	err = k.a.retry(func(c *authConn) error {
+		resp, err = c.kv.Get(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (k *authKV) Put(ctx context.Context, key, val string, opts ...etcdv3.OpOption) (resp *etcdv3.PutResponse, err error) {
+	err = k.a.retry(func(c *authConn) error {
+		resp, err = c.kv.Put(ctx, key, val, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (k *authKV) Delete(ctx context.Context, key string, opts ...etcdv3.OpOption) (resp *etcdv3.DeleteResponse, err error) {
+	err = k.a.retry(func(c *authConn) error {
+		resp, err = c.kv.Delete(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (k *authKV) Txn(ctx context.Context) etcdv3.Txn {
+	return &authTxn{a: k.a, ctx: ctx}
+}
+
+// authTxn records a transaction so it can be committed again through a new
+// client.
+type authTxn struct {
+	a            *authClient
+	ctx          context.Context
+	cmps         []etcdv3.Cmp
+	thens, elses []etcdv3.Op
+}
+
+func (t *authTxn) If(cs ...etcdv3.Cmp) etcdv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *authTxn) Then(ops ...etcdv3.Op) etcdv3.Txn {
+	t.thens = append(t.thens, ops...)
+	return t
+}
+
+func (t *authTxn) Else(ops ...etcdv3.Op) etcdv3.Txn {
+	t.elses = append(t.elses, ops...)
+	return t
+}
+
+func (t *authTxn) Commit() (resp *etcdv3.TxnResponse, err error) {
+	err = t.a.retry(func(c *authConn) error {
+		resp, err = c.kv.Txn(t.ctx).If(t.cmps...).Then(t.thens...).Else(t.elses...).Commit()
+		return err
+	})
+	return resp, err
+}
+
+type authLease struct {
+	etcdv3.Lease
+	a *authClient
+}
+
+func (l *authLease) Grant(ctx context.Context, ttl int64) (resp *etcdv3.LeaseGrantResponse, err error) {
+	err = l.a.retry(func(c *authConn) error {
+		resp, err = c.lease.Grant(ctx, ttl)
+		return err
+	})
+	return resp, err
+}
+
+func (l *authLease) Revoke(ctx context.Context, id etcdv3.LeaseID) (resp *etcdv3.LeaseRevokeResponse, err error) {
+	err = l.a.retry(func(c *authConn) error {
+		resp, err = c.lease.Revoke(ctx, id)
+		return err
+	})
+	return resp, err
+}
+
+func (l *authLease) KeepAliveOnce(ctx context.Context, id etcdv3.LeaseID) (resp *etcdv3.LeaseKeepAliveResponse, err error) {
+	err = l.a.retry(func(c *authConn) error {
+		resp, err = c.lease.KeepAliveOnce(ctx, id)
+		return err
+	})
+	return resp, err
+}
+
+type authWatcher struct {
+	etcdv3.Watcher
+	a *authClient
+}
+
+func (w *authWatcher) Watch(ctx context.Context, key string, opts ...etcdv3.OpOption) etcdv3.WatchChan {
+	return w.a.conn().watcher.Watch(ctx, key, opts...)
+}
@@ -0,0 +1,169 @@
+package etcd
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// fakeKV answers every call with err, counting them.
+type fakeKV struct {
+	etcdv3.KV
+	err   error
+	calls int
+}
+
+func (f *fakeKV) Get(ctx context.Context, key string, opts ...etcdv3.OpOption) (*etcdv3.GetResponse, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &etcdv3.GetResponse{}, nil
+}
+
+func (f *fakeKV) Txn(ctx context.Context) etcdv3.Txn {
+	return &fakeTxn{f}
+}
+
+type fakeTxn struct{ f *fakeKV }
+
+func (t *fakeTxn) If(cs ...etcdv3.Cmp) etcdv3.Txn   { return t }
+func (t *fakeTxn) Then(ops ...etcdv3.Op) etcdv3.Txn { return t }
+func (t *fakeTxn) Else(ops ...etcdv3.Op) etcdv3.Txn { return t }
+
+func (t *fakeTxn) Commit() (*etcdv3.TxnResponse, error) {
+	t.f.calls++
+	if t.f.err != nil {
+		return nil, t.f.err
+	}
+	return &etcdv3.TxnResponse{Succeeded: true}, nil
+}
+
+func TestAuthReauth(t *testing.T) {
+	expired := &fakeKV{err: rpctypes.ErrInvalidAuthToken}
+	client := &etcdv3.Client{KV: expired}
+	var dialed []*fakeKV
+	a := wrapAuth(client, func() (*etcdv3.Client, error) {
+		kv := &fakeKV{}
+		dialed = append(dialed, kv)
+		return &etcdv3.Client{KV: kv}, nil
+	})
+
+	if _, err := client.Get(context.Background(), "k"); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialed) != 1 || expired.calls != 1 || dialed[0].calls != 1 {
+		t.Fatalf("expected one refused call and one retry through a new client, got %d dials, %d refused", len(dialed), expired.calls)
+	}
+	resp, err := client.Txn(context.Background()).If().Then().Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Succeeded || len(dialed) != 1 || dialed[0].calls != 2 {
+		t.Fatalf("expected the transaction to go through the new client, got %d dials", len(dialed))
+	}
+
+	// A refusal through a client that was already replaced doesn't log in
+	// again.
+	stale := &authConn{client: client, kv: expired}
+	if c, err := a.reauth(stale); err != nil || c != a.conn() {
+		t.Fatalf("expected the current client back, got %v", err)
+	}
+	if len(dialed) != 1 {
+		t.Fatalf("expected no more dials, got %d", len(dialed))
+	}
+}
+
+func TestAuthOtherErrors(t *testing.T) {
+	failing := &fakeKV{err: errors.New("boom")}
+	client := &etcdv3.Client{KV: failing}
+	dials := 0
+	wrapAuth(client, func() (*etcdv3.Client, error) {
+		dials++
+		return nil, errors.New("unexpected dial")
+	})
+	if _, err := client.Get(context.Background(), "k"); err != failing.err {
+		t.Fatalf("expected the error to be passed through, got %v", err)
+	}
+	if dials != 0 || failing.calls != 1 {
+		t.Fatalf("expected no retry, got %d dials and %d calls", dials, failing.calls)
+	}
+}
+
+// TestAuthPrefixAccount runs against an etcd with auth enabled, as the user
+// TORUS_ETCD_TEST_USERNAME, whose role need only grant readwrite on the
+// /torus-test/ prefix.
+func TestAuthPrefixAccount(t *testing.T) {
+	cfg := testEtcdConfig(t)
+	cfg.MetadataUsername = os.Getenv("TORUS_ETCD_TEST_USERNAME")
+	cfg.MetadataPassword = os.Getenv("TORUS_ETCD_TEST_PASSWORD")
+	if cfg.MetadataUsername == "" {
+		t.Skip("set TORUS_ETCD_TEST_USERNAME and TORUS_ETCD_TEST_PASSWORD to run tests against etcd with auth")
+	}
+	defer torus.WipeMDS("etcd", cfg)
+	e := initTestEtcd(t, cfg)
+	defer e.Close()
+	if e.auth == nil {
+		t.Fatal("expected the client to log in")
+	}
+
+	lease, err := e.GetLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterPeer(lease, &models.PeerInfo{UUID: e.UUID()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RenewLease(lease); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.NewVolumeID(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log in again as though the token had expired; the ring watch and
+	// everything else carry on through the new client.
+	ch := make(chan torus.Ring, 1)
+	e.SubscribeNewRings(ch)
+	defer e.UnsubscribeNewRings(ch)
+	if _, err := e.auth.reauth(e.auth.conn()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RevokeLease(lease); err != nil {
+		t.Fatal(err)
+	}
+	r, err := e.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := r.(torus.ModifyableRing).ChangeReplication(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRing(next); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		if got.Version() != next.Version() {
+			t.Fatalf("watch gave ring version %d, expected %d", got.Version(), next.Version())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new ring wasn't seen by the watch")
+	}
+
+	wrong := cfg
+	wrong.MetadataPassword += "-wrong"
+	if _, err := torus.CreateMetadataService("etcd", wrong); err == nil {
+		t.Fatal("expected a wrong password to be refused")
+	}
+}
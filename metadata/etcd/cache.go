@@ -0,0 +1,229 @@
+package etcd
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/alternative-storage/torus"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// defaultCacheSize is the number of keys cached when the config doesn't say.
+const defaultCacheSize = 1024
+
+var (
+	promCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_etcd_cache_hits_total",
+		Help: "Number of metadata lookups answered from the etcd cache",
+	}, []string{"kind"})
+	promCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_etcd_cache_misses_total",
+		Help: "Number of metadata lookups that had to go to etcd",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(promCacheHits)
+	prometheus.MustRegister(promCacheMisses)
+}
+
+// kvCache is a least-recently-used cache of etcd values, including the
+// absence of a key. It is kept current by a watch of the metadata prefix,
+// which invalidates every key that changes; until that watch is running,
+// or once it ends, nothing is cached.
+type kvCache struct {
+	mut     sync.Mutex
+	size    int
+	enabled bool
+	// gen counts invalidations, so that a value read before one isn't
+	// cached after it.
+	gen     uint64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+	found bool
+}
+
+func newKVCache(size int) *kvCache {
+	return &kvCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached value of key, and whether it was cached.
+func (c *kvCache) get(key string) (value []byte, found bool, ok bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	c.lru.MoveToFront(el)
+	ent := el.Value.(*cacheEntry)
+	return ent.value, ent.found, true
+}
+
+// generation returns the generation a value about to be read should be put
+// with.
+func (c *kvCache) generation() uint64 {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.gen
+}
+
+// put caches the value of key read during gen, unless the cache was
+// invalidated since.
+func (c *kvCache) put(key string, value []byte, found bool, gen uint64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.enabled || gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key, value, found}
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, value, found})
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops keys from the cache.
+func (c *kvCache) invalidate(keys ...string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.gen++
+	for _, k := range keys {
+		if el, ok := c.entries[k]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// reset empties the cache, and turns caching on or off.
+func (c *kvCache) reset(enabled bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.gen++
+	c.enabled = enabled
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// cacheSize returns the number of keys to cache for cfg, or zero to cache
+// none.
+func cacheSize(cfg torus.Config) int {
+	switch {
+	case cfg.MetadataCacheSize < 0:
+		return 0
+	case cfg.MetadataCacheSize == 0:
+		return defaultCacheSize
+	}
+	return cfg.MetadataCacheSize
+}
+
+// CachedGet returns the value of key and whether it exists, from the cache
+// if it's there. kind labels the lookup in the cache metrics. It is for
+// lookups that may be as stale as the watch of the metadata is slow; reads
+// that a compare-and-swap depends on go to etcd.
+func (e *Etcd) CachedGet(ctx context.Context, kind string, key string) ([]byte, bool, error) {
+	if e.cache == nil {
+		return e.get(ctx, key)
+	}
+	if value, found, ok := e.cache.get(key); ok {
+		promCacheHits.WithLabelValues(kind).Inc()
+		return value, found, nil
+	}
+	promCacheMisses.WithLabelValues(kind).Inc()
+	gen := e.cache.generation()
+	value, found, err := e.get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	e.cache.put(key, value, found, gen)
+	return value, found, nil
+}
+
+// Invalidate drops keys from the cache, so that this node sees its own
+// writes to them right away rather than once the watch catches up.
+func (e *Etcd) Invalidate(keys ...string) {
+	if e.cache != nil {
+		e.cache.invalidate(keys...)
+	}
+}
+
+func (e *Etcd) get(ctx context.Context, key string) ([]byte, bool, error) {
+	resp, err := e.Client.Get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+	return resp.Kvs[0].Value, true, nil
+}
+
+// watchCache turns the cache on, invalidating it from a watch of the
+// metadata prefix.
+func (e *Etcd) watchCache() error {
+	rev, err := e.currentRevision(e.watchCtx)
+	if err != nil {
+		return err
+	}
+	e.cache.reset(true)
+	watch := func(ctx context.Context, rev int64) error {
+		err := e.invalidateFrom(ctx, rev)
+		// Without the watch, nothing can be trusted to stay current.
+		e.cache.reset(false)
+		return err
+	}
+	restart := func(ctx context.Context) (int64, error) {
+		rev, err := e.currentRevision(ctx)
+		if err == nil {
+			e.cache.reset(true)
+		}
+		return rev, err
+	}
+	go e.keepWatching(e.watchCtx, "cache", rev, watch, restart)
+	return nil
+}
+
+// currentRevision returns the revision of the etcd cluster.
+func (e *Etcd) currentRevision(ctx context.Context) (int64, error) {
+	resp, err := e.Client.Get(ctx, e.MkKey("meta", "globalmetadata"), etcdv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// invalidateFrom invalidates the keys that change after rev, until the
+// watch ends, returning the error it ended with, if any.
+func (e *Etcd) invalidateFrom(ctx context.Context, rev int64) error {
+	wch := e.Client.Watch(ctx, e.MkKey()+"/", etcdv3.WithPrefix(), etcdv3.WithRev(rev+1))
+	for resp := range wch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		keys := make([]string, len(resp.Events))
+		for i, ev := range resp.Events {
+			keys[i] = string(ev.Kv.Key)
+		}
+		e.cache.invalidate(keys...)
+	}
+	return nil
+}
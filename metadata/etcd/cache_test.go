@@ -0,0 +1,110 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestKVCacheBound(t *testing.T) {
+	c := newKVCache(2)
+	c.reset(true)
+	c.put("a", []byte("1"), true, c.generation())
+	c.put("b", nil, false, c.generation())
+	if _, _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	// b is now the least recently used, so it makes room for c.
+	c.put("c", []byte("3"), true, c.generation())
+	if _, _, ok := c.get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if v, found, ok := c.get("a"); !ok || !found || string(v) != "1" {
+		t.Fatalf("expected a=1 to be cached, got %q %v %v", v, found, ok)
+	}
+	if _, found, ok := c.get("c"); !ok || !found {
+		t.Fatal("expected c to be cached")
+	}
+}
+
+func TestKVCacheInvalidate(t *testing.T) {
+	c := newKVCache(10)
+	c.put("a", []byte("1"), true, c.generation())
+	if _, _, ok := c.get("a"); ok {
+		t.Fatal("expected nothing to be cached before the cache is enabled")
+	}
+	c.reset(true)
+	c.put("a", []byte("1"), true, c.generation())
+	c.invalidate("a")
+	if _, _, ok := c.get("a"); ok {
+		t.Fatal("expected a to be invalidated")
+	}
+
+	// A value read before an invalidation may be older than it.
+	gen := c.generation()
+	c.invalidate("b")
+	c.put("a", []byte("stale"), true, gen)
+	if _, _, ok := c.get("a"); ok {
+		t.Fatal("expected a value read before an invalidation not to be cached")
+	}
+
+	c.put("a", []byte("1"), true, c.generation())
+	c.reset(false)
+	if _, _, ok := c.get("a"); ok {
+		t.Fatal("expected disabling the cache to empty it")
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	for _, tt := range []struct {
+		size, want int
+	}{
+		{0, defaultCacheSize},
+		{-1, 0},
+		{10, 10},
+	} {
+		if got := cacheSize(torus.Config{MetadataCacheSize: tt.size}); got != tt.want {
+			t.Errorf("cache size %d: expected %d, got %d", tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestCacheWatchInvalidation(t *testing.T) {
+	cfg := testEtcdConfig(t)
+	defer torus.WipeMDS("etcd", cfg)
+	e := initTestEtcd(t, cfg)
+	defer e.Close()
+	mds, err := torus.CreateMetadataService("etcd", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := mds.(*Etcd)
+	defer other.Close()
+
+	key := e.MkKey("volumes", "cached")
+	if _, found, err := e.CachedGet(context.Background(), "test", key); err != nil || found {
+		t.Fatalf("expected no volume yet, got %v", err)
+	}
+	// Another node creates the key; the absence cached above goes once the
+	// watch sees it.
+	if _, err := other.Client.Put(context.Background(), key, "x"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, found, err := e.CachedGet(context.Background(), "test", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found && string(v) == "x" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the cache wasn't invalidated by the watch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
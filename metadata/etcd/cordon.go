@@ -0,0 +1,50 @@
+package etcd
+
+import (
+	"encoding/json"
+	"time"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+
+	"github.com/alternative-storage/torus"
+)
+
+func (c *etcdCtx) GetCordons() (_ []torus.Cordon, err error) {
+	defer observeOp("get-cordons", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("cordons"), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.Cordon
+	for _, kv := range resp.Kvs {
+		var cd torus.Cordon
+		if err := json.Unmarshal(kv.Value, &cd); err != nil {
+			clog.Errorf("cordon at key %s didn't unmarshal correctly: %v", string(kv.Key), err)
+			continue
+		}
+		out = append(out, cd)
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) SetCordon(cd torus.Cordon) (err error) {
+	defer observeOp("set-cordon", time.Now(), &err)
+	b, err := json.Marshal(cd)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd.Client.Put(c.getContext(), c.etcd.MkKey("cordons", cd.UUID), string(b))
+	return err
+}
+
+func (c *etcdCtx) RemoveCordon(uuid string) (err error) {
+	defer observeOp("remove-cordon", time.Now(), &err)
+	resp, err := c.etcd.Client.Delete(c.getContext(), c.etcd.MkKey("cordons", uuid))
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return torus.ErrNotExist
+	}
+	return nil
+}
@@ -10,7 +10,7 @@ import (
 
 func (c *etcdCtx) DumpMetadata(w io.Writer) error {
 	io.WriteString(w, "## Volumes\n")
-	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumeid"), etcdv3.WithPrefix())
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("volumeid"), etcdv3.WithPrefix())
 	if err != nil {
 		return err
 	}
@@ -22,7 +22,7 @@ func (c *etcdCtx) DumpMetadata(w io.Writer) error {
 		io.WriteString(w, "\n")
 	}
 	io.WriteString(w, "## INodes\n")
-	resp, err = c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", "inode"), etcdv3.WithPrefix())
+	resp, err = c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("volumemeta", "inode"), etcdv3.WithPrefix())
 	if err != nil {
 		return err
 	}
@@ -33,7 +33,7 @@ func (c *etcdCtx) DumpMetadata(w io.Writer) error {
 		io.WriteString(w, "\n")
 	}
 	io.WriteString(w, "## BlockLocks\n")
-	resp, err = c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", "blocklock"), etcdv3.WithPrefix())
+	resp, err = c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("volumemeta", "blocklock"), etcdv3.WithPrefix())
 	if err != nil {
 		return err
 	}
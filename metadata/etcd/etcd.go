@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,9 +26,7 @@ import (
 var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "etcd")
 
 const (
-	KeyPrefix      = "/github.com/alternative-storage/torus/"
-	peerTimeoutMax = 50 * time.Second
-	leaseTTL       = 30
+	KeyPrefix = "/github.com/alternative-storage/torus/"
 )
 
 var (
@@ -39,6 +38,15 @@ var (
 		Name: "torus_etcd_base_ops_total",
 		Help: "Number of times an atomic update failed and needed to be retried",
 	}, []string{"kind"})
+	promOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_etcd_op_duration_seconds",
+		Help:    "Latency of metadata operations against etcd",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"kind"})
+	promOpErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_etcd_op_errors_total",
+		Help: "Number of metadata operations against etcd that returned an error, by reason",
+	}, []string{"kind", "reason"})
 )
 
 func init() {
@@ -49,6 +57,34 @@ func init() {
 
 	prometheus.MustRegister(promAtomicRetries)
 	prometheus.MustRegister(promOps)
+	prometheus.MustRegister(promOpDuration)
+	prometheus.MustRegister(promOpErrors)
+}
+
+// observeOp records one metadata operation of the given kind that started at
+// start and returned *err. It is meant to be deferred.
+func observeOp(kind string, start time.Time, err *error) {
+	promOps.WithLabelValues(kind).Inc()
+	promOpDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		promOpErrors.WithLabelValues(kind, opErrorReason(*err)).Inc()
+	}
+}
+
+// opErrorReason classifies an error for promOpErrors. ErrNonSequentialRing
+// and ErrAgain mean the caller has to retry, so they get their own reasons.
+func opErrorReason(err error) string {
+	switch err {
+	case torus.ErrNonSequentialRing:
+		return "non_sequential_ring"
+	case torus.ErrAgain:
+		return "again"
+	case torus.ErrNotExist, torus.ErrNoGlobalMetadata:
+		return "not_exist"
+	case context.DeadlineExceeded, context.Canceled:
+		return "timeout"
+	}
+	return "other"
 }
 
 type etcdCtx struct {
@@ -58,42 +94,61 @@ type etcdCtx struct {
 
 type Etcd struct {
 	etcdCtx
-	mut          sync.RWMutex
-	cfg          torus.Config
-	global       torus.GlobalMetadata
-	volumesCache map[string]*models.Volume
+	mut    sync.RWMutex
+	cfg    torus.Config
+	global torus.GlobalMetadata
+	// cache, if set, holds volume and INode lookups.
+	cache *kvCache
 
 	ringListeners []chan torus.Ring
+	// watchCtx is the context of the watches of etcd, which stopWatch
+	// ends.
+	watchCtx  context.Context
+	stopWatch context.CancelFunc
 
 	Client *etcdv3.Client
+	// auth, if the client logs in, replaces it when its token expires.
+	auth *authClient
 
-	uuid string
+	prefix string
+	uuid   string
+}
+
+// endpoints splits the comma-separated etcd addresses of cfg.
+func endpoints(cfg torus.Config) []string {
+	return strings.Split(cfg.MetadataAddress, ",")
 }
 
 func newEtcdMetadata(cfg torus.Config) (torus.MetadataService, error) {
 	var uuid string
 	var err error
-	if cfg.DataDir == "" {
+	if cfg.MetadataDir() == "" {
 		uuid = metadata.MakeUUID()
 	} else {
-		uuid, err = metadata.GetUUID(cfg.DataDir)
+		uuid, err = metadata.GetUUID(cfg.MetadataDir())
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	v3cfg := etcdv3.Config{Endpoints: []string{cfg.MetadataAddress}, TLS: cfg.TLS}
+	v3cfg := clientConfig(cfg)
 	client, err := etcdv3.New(v3cfg)
 	if err != nil {
 		return nil, err
 	}
+	var auth *authClient
+	if v3cfg.Username != "" {
+		auth = wrapAuth(client, func() (*etcdv3.Client, error) { return etcdv3.New(v3cfg) })
+	}
 
 	e := &Etcd{
-		cfg:          cfg,
-		Client:       client,
-		volumesCache: make(map[string]*models.Volume),
-		uuid:         uuid,
+		cfg:    cfg,
+		Client: client,
+		auth:   auth,
+		prefix: keyPrefix(cfg),
+		uuid:   uuid,
 	}
+	e.watchCtx, e.stopWatch = context.WithCancel(context.Background())
 	// We do this so that referring to e, you can either call the functions
 	// directly (with a nil context) or, create another reference using
 	// WithContext(), below.
@@ -102,9 +157,18 @@ func newEtcdMetadata(cfg torus.Config) (torus.MetadataService, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = checkPrefix(e.global, e.prefix); err != nil {
+		return nil, err
+	}
 	if err = e.watchRingUpdates(); err != nil {
 		return nil, err
 	}
+	if size := cacheSize(cfg); size != 0 {
+		e.cache = newKVCache(size)
+		if err = e.watchCache(); err != nil {
+			return nil, err
+		}
+	}
 	return e, nil
 }
 
@@ -113,18 +177,27 @@ func (e *etcdCtx) Kind() torus.MetadataKind {
 }
 
 func (e *Etcd) Close() error {
+	e.stopWatch()
 	for _, l := range e.ringListeners {
 		close(l)
 	}
+	if e.auth != nil {
+		e.auth.close()
+	}
 	return e.Client.Close()
 }
 
+// MkKey returns the key made of s under the prefix of the metadata.
+func (e *Etcd) MkKey(s ...string) string {
+	return mkKey(e.prefix, s...)
+}
+
 func (e *Etcd) getGlobalMetadata() error {
 	txn := e.Client.Txn(context.Background())
 	resp, err := txn.If(
-		etcdv3.Compare(etcdv3.Version(MkKey("meta", "globalmetadata")), ">", 0),
+		etcdv3.Compare(etcdv3.Version(e.MkKey("meta", "globalmetadata")), ">", 0),
 	).Then(
-		etcdv3.OpGet(MkKey("meta", "globalmetadata")),
+		etcdv3.OpGet(e.MkKey("meta", "globalmetadata")),
 	).Commit()
 	if err != nil {
 		return err
@@ -178,6 +251,17 @@ func (c *etcdCtx) WithContext(ctx context.Context) torus.MetadataService {
 	return c.etcd.WithContext(ctx)
 }
 
+// Context returns the context calls are made under.
+func (c *etcdCtx) Context() context.Context {
+	return c.getContext()
+}
+
+// Unwrap returns the Etcd calls are made through, for packages keeping
+// metadata of their own in it.
+func (c *etcdCtx) Unwrap() *Etcd {
+	return c.etcd
+}
+
 func (c *etcdCtx) Close() error {
 	return c.etcd.Close()
 }
@@ -190,11 +274,11 @@ func (c *etcdCtx) UUID() string {
 	return c.etcd.uuid
 }
 
-func (c *etcdCtx) RegisterPeer(lease int64, p *models.PeerInfo) error {
+func (c *etcdCtx) RegisterPeer(lease int64, p *models.PeerInfo) (err error) {
+	defer observeOp("register-peer", time.Now(), &err)
 	if lease == 0 {
 		return errors.New("no lease")
 	}
-	promOps.WithLabelValues("register-peer").Inc()
 	p.LastSeen = time.Now().UnixNano()
 	data, err := p.Marshal()
 	if err != nil {
@@ -203,13 +287,16 @@ func (c *etcdCtx) RegisterPeer(lease int64, p *models.PeerInfo) error {
 
 	lid := etcdv3.LeaseID(lease)
 	_, err = c.etcd.Client.Put(
-		c.getContext(), MkKey("nodes", p.UUID), string(data), etcdv3.WithLease(lid))
+		c.getContext(), c.etcd.MkKey("nodes", p.UUID), string(data), etcdv3.WithLease(lid))
+	if rpctypes.Error(err) == rpctypes.ErrLeaseNotFound {
+		return torus.ErrLeaseNotFound
+	}
 	return err
 }
 
-func (c *etcdCtx) GetPeers() (torus.PeerInfoList, error) {
-	promOps.WithLabelValues("get-peers").Inc()
-	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("nodes"), etcdv3.WithPrefix())
+func (c *etcdCtx) GetPeers() (_ torus.PeerInfoList, err error) {
+	defer observeOp("get-peers", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("nodes"), etcdv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
@@ -222,10 +309,9 @@ func (c *etcdCtx) GetPeers() (torus.PeerInfoList, error) {
 			clog.Errorf("peer at key %s didn't unmarshal correctly: %v", string(x.Key), err)
 			continue
 		}
-		if time.Since(time.Unix(0, p.LastSeen)) > peerTimeoutMax {
-			clog.Warningf("peer at key %s didn't unregister; should be fixed with leases in etcdv3", string(x.Key))
-			continue
-		}
+		// The key is there only as long as the peer's lease, which is
+		// what keeps it registered; its LastSeen is only refreshed when
+		// it changes or grows old.
 		out = append(out, &p)
 	}
 	return torus.PeerInfoList(out), nil
@@ -287,11 +373,11 @@ func BytesAddOne(in []byte) ([]byte, interface{}, error) {
 	return Uint64ToBytes(newval), newval, nil
 }
 
-func (c *etcdCtx) GetVolumes() ([]*models.Volume, torus.VolumeID, error) {
-	promOps.WithLabelValues("get-volumes").Inc()
+func (c *etcdCtx) GetVolumes() (_ []*models.Volume, _ torus.VolumeID, err error) {
+	defer observeOp("get-volumes", time.Now(), &err)
 	txn := c.etcd.Client.Txn(c.getContext()).Then(
-		etcdv3.OpGet(MkKey("meta", "volumeminter")),
-		etcdv3.OpGet(MkKey("volumeid"), etcdv3.WithPrefix()),
+		etcdv3.OpGet(c.etcd.MkKey("meta", "volumeminter")),
+		etcdv3.OpGet(c.etcd.MkKey("volumeid"), etcdv3.WithPrefix()),
 	)
 	resp, err := txn.Commit()
 	if err != nil {
@@ -312,41 +398,35 @@ func (c *etcdCtx) GetVolumes() ([]*models.Volume, torus.VolumeID, error) {
 	return out, torus.VolumeID(highwater), nil
 }
 
-func (c *etcdCtx) GetVolume(volume string) (*models.Volume, error) {
-	if v, ok := c.etcd.volumesCache[volume]; ok {
-		return v, nil
-	}
-	c.etcd.mut.Lock()
-	defer c.etcd.mut.Unlock()
-	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumes", volume))
+func (c *etcdCtx) GetVolume(volume string) (_ *models.Volume, err error) {
+	defer observeOp("get-volume", time.Now(), &err)
+	idb, found, err := c.etcd.CachedGet(c.getContext(), "volume", c.etcd.MkKey("volumes", volume))
 	if err != nil {
 		return nil, err
 	}
-	if len(resp.Kvs) == 0 {
-		return nil, fmt.Errorf("etcd: volume %q not found", volume)
-
+	if !found {
+		return nil, torus.ErrNotExist
 	}
-	vid := BytesToUint64(resp.Kvs[0].Value)
-	resp, err = c.etcd.Client.Get(c.getContext(), MkKey("volumeid", Uint64ToHex(vid)))
+	vid := BytesToUint64(idb)
+	vb, found, err := c.etcd.CachedGet(c.getContext(), "volume", c.etcd.MkKey("volumeid", Uint64ToHex(vid)))
 	if err != nil {
 		return nil, err
 	}
-	if len(resp.Kvs) == 0 {
+	if !found {
 		return nil, fmt.Errorf("etcd: volume ID %q not found", Uint64ToHex(vid))
 
 	}
 	v := &models.Volume{}
-	err = v.Unmarshal(resp.Kvs[0].Value)
+	err = v.Unmarshal(vb)
 	if err != nil {
 		return nil, err
 	}
-	c.etcd.volumesCache[volume] = v
 	clog.Tracef("got volume: %v", volume)
 	return v, nil
 }
 
 func (c *etcdCtx) GetLockStatus(vid uint64) string {
-	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "blocklock"))
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("volumemeta", Uint64ToHex(uint64(vid)), "blocklock"))
 	if err != nil {
 		clog.Debugf("Failed to get lock status: %v", err)
 		return "unknown"
@@ -357,20 +437,29 @@ func (c *etcdCtx) GetLockStatus(vid uint64) string {
 	return "in-use"
 }
 
-func (c *etcdCtx) GetLease() (int64, error) {
-	resp, err := c.etcd.Client.Grant(c.getContext(), leaseTTL)
+func (c *etcdCtx) GetLease() (_ int64, err error) {
+	defer observeOp("get-lease", time.Now(), &err)
+	ttl := leaseTTL(c.etcd.global.PeerTimeoutOrDefault())
+	resp, err := c.etcd.Client.Grant(c.getContext(), ttl)
 	if err != nil {
 		return 0, err
 	}
-	clog.Tracef("created new lease for %d, TTL %d", resp.ID, leaseTTL)
+	clog.Tracef("created new lease for %d, TTL %d", resp.ID, ttl)
 	return int64(resp.ID), nil
 }
 
-func (c *etcdCtx) RenewLease(lease int64) error {
+// leaseTTL returns the TTL in seconds of a lease that expires once a peer has
+// gone timeout without renewing it.
+func leaseTTL(timeout time.Duration) int64 {
+	return int64((timeout + time.Second - 1) / time.Second)
+}
+
+func (c *etcdCtx) RenewLease(lease int64) (err error) {
+	defer observeOp("renew-lease", time.Now(), &err)
 	lid := etcdv3.LeaseID(lease)
 	resp, err := c.etcd.Client.KeepAliveOnce(c.getContext(), lid)
 	if err != nil {
-		if err == rpctypes.ErrLeaseNotFound {
+		if rpctypes.Error(err) == rpctypes.ErrLeaseNotFound {
 			return torus.ErrLeaseNotFound
 		}
 		return err
@@ -378,13 +467,143 @@ func (c *etcdCtx) RenewLease(lease int64) error {
 	clog.Tracef("updated lease for %d, TTL %d", resp.ID, resp.TTL)
 	return nil
 }
+
+func (c *etcdCtx) RevokeLease(lease int64) (err error) {
+	defer observeOp("revoke-lease", time.Now(), &err)
+	_, err = c.etcd.Client.Revoke(c.getContext(), etcdv3.LeaseID(lease))
+	if rpctypes.Error(err) == rpctypes.ErrLeaseNotFound {
+		return torus.ErrLeaseNotFound
+	}
+	return err
+}
+
+func (c *etcdCtx) GetRebalanceSettings() (_ torus.RebalanceSettings, err error) {
+	defer observeOp("get-rebalance", time.Now(), &err)
+	var rs torus.RebalanceSettings
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("meta", "rebalance"))
+	if err != nil {
+		return rs, err
+	}
+	if len(resp.Kvs) == 0 {
+		return rs, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &rs)
+	return rs, err
+}
+
+func (c *etcdCtx) SetRebalanceSettings(rs torus.RebalanceSettings) (err error) {
+	defer observeOp("set-rebalance", time.Now(), &err)
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd.Client.Put(c.getContext(), c.etcd.MkKey("meta", "rebalance"), string(b))
+	return err
+}
+
+// RecordClusterEvent stores e under a key sorting by time, then drops the
+// oldest events past torus.MaxClusterEvents or torus.MaxClusterEventAge.
+func (c *etcdCtx) RecordClusterEvent(e torus.AuditEvent) (err error) {
+	defer observeOp("record-event", time.Now(), &err)
+	now := time.Now().UTC()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	key := c.etcd.MkKey("events", torus.ClusterEventName(e.Time, c.UUID()))
+	_, err = c.etcd.Client.Put(c.getContext(), key, string(b))
+	if err != nil {
+		return err
+	}
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("events"), etcdv3.WithPrefix(), etcdv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	for i, kv := range resp.Kvs {
+		if i >= len(resp.Kvs)-torus.MaxClusterEvents && !torus.ClusterEventExpired(string(kv.Key), now) {
+			break
+		}
+		_, err = c.etcd.Client.Delete(c.getContext(), string(kv.Key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetClusterEvents returns the stored events, numbering each by the etcd
+// revision that created it.
+func (c *etcdCtx) GetClusterEvents() (_ []torus.AuditEvent, err error) {
+	defer observeOp("get-events", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("events"), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]torus.AuditEvent, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var e torus.AuditEvent
+		if err := json.Unmarshal(kv.Value, &e); err != nil {
+			clog.Errorf("event at key %s didn't unmarshal correctly: %v", string(kv.Key), err)
+			continue
+		}
+		e.Seq = uint64(kv.CreateRevision)
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) GetScrubStatus(uuid string) (_ torus.ScrubStatus, err error) {
+	defer observeOp("get-scrub", time.Now(), &err)
+	st := torus.ScrubStatus{UUID: uuid}
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("scrub", uuid))
+	if err != nil {
+		return st, err
+	}
+	if len(resp.Kvs) == 0 {
+		return st, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &st)
+	return st, err
+}
+
+func (c *etcdCtx) SetScrubStatus(st torus.ScrubStatus) (err error) {
+	defer observeOp("set-scrub", time.Now(), &err)
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd.Client.Put(c.getContext(), c.etcd.MkKey("scrub", st.UUID), string(b))
+	return err
+}
+
+func (c *etcdCtx) GetScrubStatuses() (_ []torus.ScrubStatus, err error) {
+	defer observeOp("get-scrubs", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("scrub"), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.ScrubStatus
+	for _, kv := range resp.Kvs {
+		var st torus.ScrubStatus
+		if err := json.Unmarshal(kv.Value, &st); err != nil {
+			clog.Errorf("scrub status at key %s didn't unmarshal correctly: %v", string(kv.Key), err)
+			continue
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
 func (c *etcdCtx) GetRing() (torus.Ring, error) {
 	r, _, err := c.getRing()
 	return r, err
 }
-func (c *etcdCtx) getRing() (torus.Ring, int64, error) {
-	promOps.WithLabelValues("get-ring").Inc()
-	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("meta", "the-one-ring"))
+func (c *etcdCtx) getRing() (_ torus.Ring, _ int64, err error) {
+	defer observeOp("get-ring", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("meta", "the-one-ring"))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -408,6 +627,13 @@ func (c *etcdCtx) UnsubscribeNewRings(ch chan torus.Ring) {
 }
 
 func (c *etcdCtx) SetRing(ring torus.Ring) error {
+	return c.SetRingWithMessage(ring, "")
+}
+
+// SetRingWithMessage replaces the ring with one of the next version, keeping
+// it in the ring history along with message.
+func (c *etcdCtx) SetRingWithMessage(ring torus.Ring, message string) (err error) {
+	defer observeOp("set-ring", time.Now(), &err)
 	oldr, etcdver, err := c.getRing()
 	if err != nil {
 		return err
@@ -419,29 +645,35 @@ func (c *etcdCtx) SetRing(ring torus.Ring) error {
 	if err != nil {
 		return err
 	}
-	key := MkKey("meta", "the-one-ring")
+	key := c.etcd.MkKey("meta", "the-one-ring")
+	ops, err := ringHistoryOps(c.getContext(), c.etcd.Client, c.etcd.prefix, oldr, ring.Version(), b, c.etcd.uuid, message)
+	if err != nil {
+		return err
+	}
 	txn := c.etcd.Client.Txn(c.getContext()).If(
 		etcdv3.Compare(etcdv3.Version(key), "=", etcdver),
 	).Then(
-		etcdv3.OpPut(key, string(b)),
+		append([]etcdv3.Op{etcdv3.OpPut(key, string(b))}, ops...)...,
 	)
 	resp, err := txn.Commit()
 	if err != nil {
 		return err
 	}
 	if resp.Succeeded {
+		trimRingHistory(c.getContext(), c.etcd.Client, c.etcd.prefix, torus.RingHistoryToKeep(c.etcd.cfg))
 		return nil
 	}
 	clog.Tracef("set ring version: %v", ring.Version())
 	return torus.ErrAgain
 }
 
-func (c *etcdCtx) CommitINodeIndex(vid torus.VolumeID) (torus.INodeID, error) {
-	promOps.WithLabelValues("commit-inode-index").Inc()
+func (c *etcdCtx) CommitINodeIndex(vid torus.VolumeID) (_ torus.INodeID, err error) {
+	defer observeOp("commit-inode-index", time.Now(), &err)
 	c.etcd.mut.Lock()
 	defer c.etcd.mut.Unlock()
-	k := []byte(MkKey("volumemeta", Uint64ToHex(uint64(vid)), "inode"))
+	k := []byte(c.etcd.MkKey("volumemeta", Uint64ToHex(uint64(vid)), "inode"))
 	newID, err := c.AtomicModifyKey(k, BytesAddOne)
+	c.etcd.Invalidate(string(k))
 	if err != nil {
 		return 0, err
 	}
@@ -449,10 +681,11 @@ func (c *etcdCtx) CommitINodeIndex(vid torus.VolumeID) (torus.INodeID, error) {
 	return torus.INodeID(newID.(uint64)), nil
 }
 
-func (c *etcdCtx) NewVolumeID() (torus.VolumeID, error) {
+func (c *etcdCtx) NewVolumeID() (_ torus.VolumeID, err error) {
+	defer observeOp("new-volume-id", time.Now(), &err)
 	c.etcd.mut.Lock()
 	defer c.etcd.mut.Unlock()
-	k := []byte(MkKey("meta", "volumeminter"))
+	k := []byte(c.etcd.MkKey("meta", "volumeminter"))
 	newID, err := c.AtomicModifyKey(k, BytesAddOne)
 	if err != nil {
 		return 0, err
@@ -461,18 +694,16 @@ func (c *etcdCtx) NewVolumeID() (torus.VolumeID, error) {
 	return torus.VolumeID(newID.(uint64)), nil
 }
 
-func (c *etcdCtx) GetINodeIndex(vid torus.VolumeID) (torus.INodeID, error) {
-	promOps.WithLabelValues("get-inode-index").Inc()
-	c.etcd.mut.Lock()
-	defer c.etcd.mut.Unlock()
-	resp, err := c.etcd.Client.Get(c.getContext(), MkKey("volumemeta", Uint64ToHex(uint64(vid)), "inode"))
+func (c *etcdCtx) GetINodeIndex(vid torus.VolumeID) (_ torus.INodeID, err error) {
+	defer observeOp("get-inode-index", time.Now(), &err)
+	b, found, err := c.etcd.CachedGet(c.getContext(), "inode-index", c.etcd.MkKey("volumemeta", Uint64ToHex(uint64(vid)), "inode"))
 	if err != nil {
 		return torus.INodeID(0), err
 	}
-	if len(resp.Kvs) != 1 {
+	if !found {
 		return torus.INodeID(0), torus.ErrNotExist
 	}
-	id := BytesToUint64(resp.Kvs[0].Value)
+	id := BytesToUint64(b)
 	clog.Tracef("god INode Index: %v", id)
 	return torus.INodeID(id), nil
 }
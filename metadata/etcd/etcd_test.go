@@ -0,0 +1,139 @@
+package etcd
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+)
+
+// testEtcdConfig returns the config of a cluster under a prefix of its own in
+// the etcd at TORUS_ETCD_TEST_ENDPOINTS, skipping t if there is none. The
+// cluster is wiped once t is done.
+func testEtcdConfig(t *testing.T) torus.Config {
+	endpoints := os.Getenv("TORUS_ETCD_TEST_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("set TORUS_ETCD_TEST_ENDPOINTS to run tests against etcd")
+	}
+	return torus.Config{
+		MetadataAddress: endpoints,
+		MetadataPrefix:  "/torus-test/" + metadata.MakeUUID(),
+	}
+}
+
+func initTestEtcd(t *testing.T, cfg torus.Config) *Etcd {
+	err := torus.InitMDS("etcd", cfg, torus.GlobalMetadata{BlockSize: 4096}, ring.Ketama)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mds, err := torus.CreateMetadataService("etcd", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mds.(*Etcd)
+}
+
+func TestPrefixRingWatch(t *testing.T) {
+	cfg := testEtcdConfig(t)
+	defer torus.WipeMDS("etcd", cfg)
+	e := initTestEtcd(t, cfg)
+	defer e.Close()
+
+	resp, err := e.Client.Get(context.Background(), cfg.MetadataPrefix+"/meta/the-one-ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("expected the ring under %s", cfg.MetadataPrefix)
+	}
+
+	ch := make(chan torus.Ring, 1)
+	e.SubscribeNewRings(ch)
+	r, err := e.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := r.(torus.ModifyableRing).ChangeReplication(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRing(next); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		if got.Version() != next.Version() {
+			t.Fatalf("watch gave ring version %d, expected %d", got.Version(), next.Version())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new ring wasn't seen by the watch")
+	}
+	e.UnsubscribeNewRings(ch)
+}
+
+func TestPrefixMismatch(t *testing.T) {
+	cfg := testEtcdConfig(t)
+	defer torus.WipeMDS("etcd", cfg)
+	e := initTestEtcd(t, cfg)
+	defer e.Close()
+
+	other := cfg
+	other.MetadataPrefix = cfg.MetadataPrefix + "-other"
+	defer torus.WipeMDS("etcd", other)
+	if _, err := torus.CreateMetadataService("etcd", other); err != torus.ErrNoGlobalMetadata {
+		t.Fatalf("expected ErrNoGlobalMetadata under an empty prefix, got %v", err)
+	}
+	// Metadata copied from another prefix still names the one it was
+	// initialized under.
+	for _, k := range []string{"globalmetadata", "the-one-ring", "volumeminter"} {
+		resp, err := e.Client.Get(context.Background(), e.MkKey("meta", k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := strings.Replace(e.MkKey("meta", k), cfg.MetadataPrefix, other.MetadataPrefix, 1)
+		if _, err := e.Client.Put(context.Background(), key, string(resp.Kvs[0].Value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := torus.CreateMetadataService("etcd", other); err == nil || !strings.Contains(err.Error(), "initialized under prefix") {
+		t.Fatalf("expected a prefix mismatch, got %v", err)
+	}
+	if err := torus.InitMDS("etcd", cfg, torus.GlobalMetadata{BlockSize: 4096}, ring.Ketama); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists initializing the prefix again, got %v", err)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	cfg := testEtcdConfig(t)
+	defer torus.WipeMDS("etcd", cfg)
+	e := initTestEtcd(t, cfg)
+	defer e.Close()
+
+	lease, err := e.GetLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterPeer(lease, &models.PeerInfo{UUID: e.UUID()}); err != nil {
+		t.Fatal(err)
+	}
+	// The lease goes behind the node's back, as it would if etcd didn't
+	// hear from it for its TTL.
+	if _, err := e.Client.Revoke(context.Background(), etcdv3.LeaseID(lease)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RenewLease(lease); err != torus.ErrLeaseNotFound {
+		t.Fatalf("expected ErrLeaseNotFound renewing a lost lease, got %v", err)
+	}
+	if err := e.RegisterPeer(lease, &models.PeerInfo{UUID: e.UUID()}); err != torus.ErrLeaseNotFound {
+		t.Fatalf("expected ErrLeaseNotFound registering under a lost lease, got %v", err)
+	}
+}
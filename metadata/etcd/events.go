@@ -0,0 +1,87 @@
+package etcd
+
+import (
+	"encoding/json"
+	"time"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// WatchClusterEvents sends the events recorded from now on, in order, until
+// ctx is done or the metadata service is closed. Events recorded while the
+// watch is down are read back once it is up again.
+func (c *etcdCtx) WatchClusterEvents(ctx context.Context) <-chan torus.AuditEvent {
+	e := c.etcd
+	ch := make(chan torus.AuditEvent)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-e.watchCtx.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	prefix := e.MkKey("events")
+	// last is the revision that created the last event sent.
+	var last int64
+	send := func(key, value []byte, rev int64) {
+		var ev torus.AuditEvent
+		if err := json.Unmarshal(value, &ev); err != nil {
+			clog.Errorf("event at key %s didn't unmarshal correctly: %v", string(key), err)
+			return
+		}
+		ev.Seq = uint64(rev)
+		last = rev
+		select {
+		case ch <- ev:
+		case <-ctx.Done():
+		}
+	}
+	// Reading the events created since the last one sent passes on those
+	// the watch missed.
+	read := func(ctx context.Context) (int64, error) {
+		resp, err := e.Client.Get(ctx, prefix, etcdv3.WithPrefix(), etcdv3.WithMinCreateRev(last+1))
+		if err != nil {
+			return 0, err
+		}
+		for _, kv := range resp.Kvs {
+			send(kv.Key, kv.Value, kv.CreateRevision)
+		}
+		return resp.Header.Revision, nil
+	}
+	watch := func(ctx context.Context, rev int64) error {
+		for resp := range e.Client.Watch(ctx, prefix, etcdv3.WithPrefix(), etcdv3.WithRev(rev+1)) {
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			for _, ev := range resp.Events {
+				if ev.Type == etcdv3.EventTypeDelete || !ev.IsCreate() {
+					continue
+				}
+				send(ev.Kv.Key, ev.Kv.Value, ev.Kv.CreateRevision)
+			}
+		}
+		return nil
+	}
+	go func() {
+		defer close(ch)
+		for {
+			resp, err := e.Client.Get(ctx, prefix, etcdv3.WithPrefix(), etcdv3.WithCountOnly())
+			if err == nil {
+				last = resp.Header.Revision
+				e.keepWatching(ctx, "events", last, watch, read)
+				return
+			}
+			clog.Errorf("can't read cluster events: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(maxRewatchDelay):
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,161 @@
+package etcd
+
+import (
+	"encoding/json"
+	"time"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+func (c *etcdCtx) GetGCSettings() (_ torus.GCSettings, err error) {
+	defer observeOp("get-gc", time.Now(), &err)
+	var gs torus.GCSettings
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("meta", "gc"))
+	if err != nil {
+		return gs, err
+	}
+	if len(resp.Kvs) == 0 {
+		return gs, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &gs)
+	return gs, err
+}
+
+func (c *etcdCtx) SetGCSettings(gs torus.GCSettings) (err error) {
+	defer observeOp("set-gc", time.Now(), &err)
+	b, err := json.Marshal(gs)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd.Client.Put(c.getContext(), c.etcd.MkKey("meta", "gc"), string(b))
+	return err
+}
+
+// WatchGCSettings sends the settings, and then the new settings each time
+// they change, until ctx is done or the metadata service is closed.
+func (c *etcdCtx) WatchGCSettings(ctx context.Context) <-chan torus.GCSettings {
+	e := c.etcd
+	ch := make(chan torus.GCSettings)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-e.watchCtx.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	key := e.MkKey("meta", "gc")
+	send := func(value []byte) {
+		var gs torus.GCSettings
+		if value != nil {
+			if err := json.Unmarshal(value, &gs); err != nil {
+				clog.Errorf("gc settings didn't unmarshal correctly: %v", err)
+				return
+			}
+		}
+		select {
+		case ch <- gs:
+		case <-ctx.Done():
+		}
+	}
+	// Reading the settings again passes on any change the watch missed.
+	read := func(ctx context.Context) (int64, error) {
+		resp, err := e.Client.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		var value []byte
+		if len(resp.Kvs) != 0 {
+			value = resp.Kvs[0].Value
+		}
+		send(value)
+		return resp.Header.Revision, nil
+	}
+	watch := func(ctx context.Context, rev int64) error {
+		for resp := range e.Client.Watch(ctx, key, etcdv3.WithRev(rev+1)) {
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			for _, ev := range resp.Events {
+				if ev.Type == etcdv3.EventTypeDelete {
+					send(nil)
+					continue
+				}
+				send(ev.Kv.Value)
+			}
+		}
+		return nil
+	}
+	go func() {
+		defer close(ch)
+		for {
+			rev, err := read(ctx)
+			if err == nil {
+				e.keepWatching(ctx, "gc settings", rev, watch, read)
+				return
+			}
+			clog.Errorf("can't read gc settings: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(maxRewatchDelay):
+			}
+		}
+	}()
+	return ch
+}
+
+func (c *etcdCtx) SetGCStatus(st torus.GCStatus) (err error) {
+	defer observeOp("set-gc-status", time.Now(), &err)
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd.Client.Put(c.getContext(), c.etcd.MkKey("gc", st.UUID), string(b))
+	return err
+}
+
+func (c *etcdCtx) GetGCStatuses() (_ []torus.GCStatus, err error) {
+	defer observeOp("get-gc-statuses", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("gc"), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.GCStatus
+	for _, kv := range resp.Kvs {
+		var st torus.GCStatus
+		if err := json.Unmarshal(kv.Value, &st); err != nil {
+			clog.Errorf("gc status at key %s didn't unmarshal correctly: %v", string(kv.Key), err)
+			continue
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) GetTombstones() (_ []torus.VolumeTombstone, err error) {
+	defer observeOp("get-tombstones", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("tombstones"), etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.VolumeTombstone
+	for _, kv := range resp.Kvs {
+		var t torus.VolumeTombstone
+		if err := json.Unmarshal(kv.Value, &t); err != nil {
+			clog.Errorf("tombstone at key %s didn't unmarshal correctly: %v", string(kv.Key), err)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) RemoveTombstone(vid torus.VolumeID) (err error) {
+	defer observeOp("remove-tombstone", time.Now(), &err)
+	_, err = c.etcd.Client.Delete(c.getContext(), c.etcd.MkKey("tombstones", Uint64ToHex(uint64(vid))))
+	return err
+}
@@ -2,8 +2,10 @@ package etcd
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/metadata"
 	"github.com/alternative-storage/torus/models"
 	"github.com/alternative-storage/torus/ring"
 
@@ -13,15 +15,17 @@ import (
 
 func initEtcdMetadata(cfg torus.Config, gmd torus.GlobalMetadata, ringType torus.RingType) error {
 	clog.Tracef("Initializing etcd metadata at %v", cfg.MetadataAddress)
+	prefix := keyPrefix(cfg)
+	gmd.MetadataPrefix = prefix
 	gmdbytes, err := json.Marshal(gmd)
 	if err != nil {
 		return err
 	}
-	emptyRing, err := ring.CreateRing(&models.Ring{
+	emptyRing, err := ring.CreateRing(ring.WithPlacement(ring.WithVNodes(&models.Ring{
 		Type:              uint32(ringType),
 		Version:           1,
 		ReplicationFactor: 2,
-	})
+	}, gmd.KetamaVNodes), ring.CurrentPlacement))
 	if err != nil {
 		return err
 	}
@@ -30,55 +34,79 @@ func initEtcdMetadata(cfg torus.Config, gmd torus.GlobalMetadata, ringType torus
 		return err
 	}
 
-	client, err := etcdv3.New(etcdv3.Config{Endpoints: []string{cfg.MetadataAddress}, TLS: cfg.TLS})
+	client, err := etcdv3.New(clientConfig(cfg))
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	txn := client.Txn(context.Background())
-	resp, err := txn.If(
-		etcdv3.Compare(etcdv3.Version(MkKey("meta", "globalmetadata")), "=", 0),
-	).Then(
-		etcdv3.OpPut(MkKey("meta", "volumeminter"), string(Uint64ToBytes(1))),
-		etcdv3.OpPut(MkKey("meta", "globalmetadata"), string(gmdbytes)),
-	).Commit()
-	if err != nil {
-		return err
+	// Everything is written in one transaction, on the condition that none
+	// of it is there yet, so an init either happens entirely or not at all.
+	keys := initKeys(prefix)
+	values := map[string]string{
+		mkKey(prefix, "meta", "volumeminter"):   string(Uint64ToBytes(1)),
+		mkKey(prefix, "meta", "globalmetadata"): string(gmdbytes),
+		mkKey(prefix, "meta", "the-one-ring"):   string(ringb),
 	}
-	if !resp.Succeeded {
-		return torus.ErrExists
+	var (
+		cmps []etcdv3.Cmp
+		puts []etcdv3.Op
+		gets []etcdv3.Op
+	)
+	for _, k := range keys {
+		cmps = append(cmps, etcdv3.Compare(etcdv3.Version(k), "=", 0))
+		puts = append(puts, etcdv3.OpPut(k, values[k]))
+		gets = append(gets, etcdv3.OpGet(k, etcdv3.WithCountOnly()))
 	}
-	_, err = client.Put(context.Background(), MkKey("meta", "the-one-ring"), string(ringb))
+	resp, err := client.Txn(context.Background()).If(cmps...).Then(puts...).Else(gets...).Commit()
 	if err != nil {
 		return err
 	}
-	return nil
+	if resp.Succeeded {
+		return nil
+	}
+	found := make(map[string]bool)
+	for i, r := range resp.Responses {
+		found[keys[i]] = r.GetResponseRange().Count > 0
+	}
+	return metadata.CheckInitState(keys, found)
+}
+
+// initKeys are the keys an init under prefix writes.
+func initKeys(prefix string) []string {
+	return []string{
+		mkKey(prefix, "meta", "volumeminter"),
+		mkKey(prefix, "meta", "globalmetadata"),
+		mkKey(prefix, "meta", "the-one-ring"),
+	}
 }
 
 func wipeEtcdMetadata(cfg torus.Config) error {
 	clog.Tracef("Wiping etcd metadata at %v", cfg.MetadataAddress)
-	client, err := etcdv3.New(etcdv3.Config{Endpoints: []string{cfg.MetadataAddress}, TLS: cfg.TLS})
+	client, err := etcdv3.New(clientConfig(cfg))
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	_, err = client.Delete(context.Background(), MkKey(), etcdv3.WithPrefix())
+	// The slash keeps the wipe from reaching into prefixes that merely
+	// start the same.
+	_, err = client.Delete(context.Background(), keyPrefix(cfg)+"/", etcdv3.WithPrefix())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func setRing(cfg torus.Config, r torus.Ring) error {
+func setRing(cfg torus.Config, r torus.Ring) (err error) {
+	defer observeOp("set-ring", time.Now(), &err)
 	clog.Tracef("Setting ring data at %v", cfg.MetadataAddress)
-	client, err := etcdv3.New(etcdv3.Config{Endpoints: []string{cfg.MetadataAddress}, TLS: cfg.TLS})
+	client, err := etcdv3.New(clientConfig(cfg))
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	resp, err := client.Get(context.Background(), MkKey("meta", "the-one-ring"))
+	resp, err := client.Get(context.Background(), mkKey(keyPrefix(cfg), "meta", "the-one-ring"))
 	if err != nil {
 		return err
 	}
@@ -96,6 +124,17 @@ func setRing(cfg torus.Config, r torus.Ring) error {
 	if err != nil {
 		return err
 	}
-	_, err = client.Put(context.Background(), MkKey("meta", "the-one-ring"), string(b))
-	return err
+	prefix := keyPrefix(cfg)
+	ops, err := ringHistoryOps(context.Background(), client, prefix, oldr, r.Version(), b, "", "")
+	if err != nil {
+		return err
+	}
+	_, err = client.Txn(context.Background()).Then(
+		append([]etcdv3.Op{etcdv3.OpPut(mkKey(prefix, "meta", "the-one-ring"), string(b))}, ops...)...,
+	).Commit()
+	if err != nil {
+		return err
+	}
+	trimRingHistory(context.Background(), client, prefix, torus.RingHistoryToKeep(cfg))
+	return nil
 }
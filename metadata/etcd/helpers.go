@@ -5,13 +5,37 @@ import (
 	"encoding/binary"
 	"fmt"
 	"path"
+
+	"github.com/alternative-storage/torus"
 )
 
-func MkKey(s ...string) string {
-	s = append([]string{KeyPrefix}, s...)
+// keyPrefix returns the prefix of the keys of the metadata at cfg, cleaned
+// so that differently written forms of a prefix match.
+func keyPrefix(cfg torus.Config) string {
+	if cfg.MetadataPrefix == "" {
+		return path.Clean(KeyPrefix)
+	}
+	return path.Join("/", cfg.MetadataPrefix)
+}
+
+func mkKey(prefix string, s ...string) string {
+	s = append([]string{prefix}, s...)
 	return path.Join(s...)
 }
 
+// checkPrefix fails if the metadata found under prefix, of which gmd is the
+// global metadata, was initialized under another prefix.
+func checkPrefix(gmd torus.GlobalMetadata, prefix string) error {
+	recorded := gmd.MetadataPrefix
+	if recorded == "" {
+		recorded = keyPrefix(torus.Config{})
+	}
+	if recorded != prefix {
+		return fmt.Errorf("etcd: metadata under %s was initialized under prefix %s", prefix, recorded)
+	}
+	return nil
+}
+
 func Uint64ToBytes(x uint64) []byte {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.LittleEndian, x)
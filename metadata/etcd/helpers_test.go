@@ -0,0 +1,64 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		key    string
+	}{
+		{"", "/github.com/alternative-storage/torus/meta/the-one-ring"},
+		{"/github.com/alternative-storage/torus/", "/github.com/alternative-storage/torus/meta/the-one-ring"},
+		{"team-a/torus", "/team-a/torus/meta/the-one-ring"},
+		{"/team-a/torus/", "/team-a/torus/meta/the-one-ring"},
+	}
+	for _, tt := range tests {
+		p := keyPrefix(torus.Config{MetadataPrefix: tt.prefix})
+		if got := mkKey(p, "meta", "the-one-ring"); got != tt.key {
+			t.Errorf("prefix %q: got key %s, expected %s", tt.prefix, got, tt.key)
+		}
+	}
+}
+
+func TestCheckPrefix(t *testing.T) {
+	def := keyPrefix(torus.Config{})
+	tests := []struct {
+		recorded string
+		prefix   string
+		ok       bool
+	}{
+		// Clusters from before prefixes were recorded use the default.
+		{"", def, true},
+		{"", "/team-a/torus", false},
+		{"/team-a/torus", "/team-a/torus", true},
+		{"/team-a/torus", "/team-b/torus", false},
+		{def, def, true},
+	}
+	for _, tt := range tests {
+		err := checkPrefix(torus.GlobalMetadata{MetadataPrefix: tt.recorded}, tt.prefix)
+		if (err == nil) != tt.ok {
+			t.Errorf("recorded %q, using %q: got %v", tt.recorded, tt.prefix, err)
+		}
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		ttl     int64
+	}{
+		{torus.DefaultPeerTimeout, 30},
+		{10 * time.Second, 10},
+		{2500 * time.Millisecond, 3},
+	}
+	for _, tt := range tests {
+		if got := leaseTTL(tt.timeout); got != tt.ttl {
+			t.Errorf("timeout %s: got TTL %d, expected %d", tt.timeout, got, tt.ttl)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+// ringHistoryKey returns the key the ring of version is kept under in the
+// ring history. Versions are zero-padded so that the keys sort in order.
+func ringHistoryKey(prefix string, version int) string {
+	return mkKey(prefix, "ring-history", fmt.Sprintf("%016x", version))
+}
+
+// ringHistoryOps returns the operations that add the ring of version,
+// marshaled as b, to the ring history, along with the ring it replaces,
+// oldr, if it isn't there already.
+func ringHistoryOps(ctx context.Context, client *etcdv3.Client, prefix string, oldr torus.Ring, version int, b []byte, uuid, message string) ([]etcdv3.Op, error) {
+	entry, err := json.Marshal(torus.RingHistoryEntry{
+		Version: version,
+		Ring:    b,
+		Time:    time.Now().UTC(),
+		Client:  uuid,
+		Message: message,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ops := []etcdv3.Op{etcdv3.OpPut(ringHistoryKey(prefix, version), string(entry))}
+	resp, err := client.Get(ctx, ringHistoryKey(prefix, oldr.Version()), etcdv3.WithCountOnly())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Count != 0 {
+		return ops, nil
+	}
+	// The ring being replaced was set before the history was kept.
+	ob, err := oldr.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	old, err := json.Marshal(torus.RingHistoryEntry{
+		Version: oldr.Version(),
+		Ring:    ob,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, etcdv3.OpPut(ringHistoryKey(prefix, oldr.Version()), string(old))), nil
+}
+
+// trimRingHistory drops all but the last keep rings from the ring history.
+// Failing to is logged; the rings are dropped by the next ring change.
+func trimRingHistory(ctx context.Context, client *etcdv3.Client, prefix string, keep int) {
+	resp, err := client.Get(ctx, mkKey(prefix, "ring-history")+"/", etcdv3.WithPrefix(), etcdv3.WithKeysOnly(),
+		etcdv3.WithSort(etcdv3.SortByKey, etcdv3.SortAscend))
+	if err != nil {
+		clog.Warningf("couldn't list the ring history to trim it: %v", err)
+		return
+	}
+	for i := 0; i < len(resp.Kvs)-keep; i++ {
+		if _, err := client.Delete(ctx, string(resp.Kvs[i].Key)); err != nil {
+			clog.Warningf("couldn't trim the ring history: %v", err)
+			return
+		}
+	}
+}
+
+// RingHistory returns the rings kept in the ring history, oldest first.
+func (c *etcdCtx) RingHistory() (_ []torus.RingHistoryEntry, err error) {
+	defer observeOp("get-ring-history", time.Now(), &err)
+	resp, err := c.etcd.Client.Get(c.getContext(), c.etcd.MkKey("ring-history")+"/", etcdv3.WithPrefix(),
+		etcdv3.WithSort(etcdv3.SortByKey, etcdv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.RingHistoryEntry
+	for _, kv := range resp.Kvs {
+		var e torus.RingHistoryEntry
+		if err := json.Unmarshal(kv.Value, &e); err != nil {
+			clog.Errorf("ring history at key %s didn't unmarshal correctly: %v", string(kv.Key), err)
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
@@ -1,6 +1,7 @@
 package etcd
 
 import (
+	etcdv3 "github.com/coreos/etcd/clientv3"
 	"golang.org/x/net/context"
 
 	"github.com/alternative-storage/torus"
@@ -8,24 +9,64 @@ import (
 )
 
 func (e *Etcd) watchRingUpdates() error {
-	r, err := e.GetRing()
+	r, rev, err := e.readRing(e.watchCtx)
 	if err != nil {
 		clog.Errorf("can't get initial ring: %s", err)
 		return err
 	}
-	go e.watchRing(r)
+	watch := func(ctx context.Context, rev int64) error {
+		var err error
+		r, err = e.watchRingFrom(ctx, r, rev)
+		return err
+	}
+	// Pass on any ring set while the watch was down.
+	restart := func(ctx context.Context) (int64, error) {
+		newRing, rev, err := e.readRing(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if newRing.Version() > r.Version() {
+			clog.Infof("got new ring")
+			e.sendRing(newRing)
+			r = newRing
+		}
+		return rev, nil
+	}
+	go e.keepWatching(e.watchCtx, "ring", rev, watch, restart)
 	return nil
 }
 
-func (e *Etcd) watchRing(r torus.Ring) {
-	ctx, cancel := context.WithCancel(e.getContext())
-	defer cancel()
-	wch := e.Client.Watch(ctx, MkKey("meta", "the-one-ring"))
+// readRing returns the ring and the revision it was read at.
+func (e *Etcd) readRing(ctx context.Context) (torus.Ring, int64, error) {
+	resp, err := e.Client.Get(ctx, e.MkKey("meta", "the-one-ring"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, torus.ErrNoGlobalMetadata
+	}
+	r, err := ring.Unmarshal(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, resp.Header.Revision, nil
+}
 
+func (e *Etcd) sendRing(r torus.Ring) {
+	e.mut.RLock()
+	defer e.mut.RUnlock()
+	for _, x := range e.ringListeners {
+		x <- r
+	}
+}
+
+// watchRingFrom passes the rings set after rev to the listeners until the
+// watch ends, returning the last ring and the error it ended with, if any.
+func (e *Etcd) watchRingFrom(ctx context.Context, r torus.Ring, rev int64) (torus.Ring, error) {
+	wch := e.Client.Watch(ctx, e.MkKey("meta", "the-one-ring"), etcdv3.WithRev(rev+1))
 	for resp := range wch {
 		if err := resp.Err(); err != nil {
-			clog.Errorf("error watching ring: %s", err)
-			return
+			return r, err
 		}
 		for _, ev := range resp.Events {
 			newRing, err := ring.Unmarshal(ev.Kv.Value)
@@ -40,12 +81,9 @@ func (e *Etcd) watchRing(r torus.Ring) {
 			if r.Version() == newRing.Version() {
 				clog.Warningf("Same ring version: %d", r.Version())
 			}
-			e.mut.RLock()
-			for _, x := range e.ringListeners {
-				x <- newRing
-			}
+			e.sendRing(newRing)
 			r = newRing
-			e.mut.RUnlock()
 		}
 	}
+	return r, nil
 }
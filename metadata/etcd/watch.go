@@ -0,0 +1,72 @@
+package etcd
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+const (
+	minRewatchDelay = 100 * time.Millisecond
+	maxRewatchDelay = 10 * time.Second
+)
+
+var errWatchClosed = errors.New("etcd: watch closed")
+
+var promWatchRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "torus_etcd_watch_restarts_total",
+	Help: "Number of times a watch of etcd ended and was started again",
+}, []string{"watch"})
+
+func init() {
+	prometheus.MustRegister(promWatchRestarts)
+}
+
+// keepWatching runs watch, from rev, until ctx is done.
+// A watch that ends any other way, as when etcd restarts or compacts away
+// the revision it was at, is started again with a backoff. Before that,
+// restart catches up on whatever the watch missed and returns the revision
+// to watch from; if the watch ended because the auth token expired, the
+// client logs in again first.
+func (e *Etcd) keepWatching(ctx context.Context, name string, rev int64, watch func(ctx context.Context, rev int64) error, restart func(ctx context.Context) (int64, error)) {
+	delay := minRewatchDelay
+	for {
+		start := time.Now()
+		err := watch(ctx, rev)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errWatchClosed
+		}
+		if time.Since(start) > maxRewatchDelay {
+			// It ran long enough that this is a new problem.
+			delay = minRewatchDelay
+		}
+		promWatchRestarts.WithLabelValues(name).Inc()
+		clog.Errorf("error watching %s: %s", name, err)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRewatchDelay {
+				delay = maxRewatchDelay
+			}
+			if e.auth != nil && isAuthErr(err) {
+				if _, err = e.auth.reauth(e.auth.conn()); err != nil {
+					clog.Errorf("can't log in to etcd again to watch %s: %s", name, err)
+					continue
+				}
+			}
+			if rev, err = restart(ctx); err == nil {
+				break
+			}
+			clog.Errorf("can't watch %s again yet: %s", name, err)
+		}
+		clog.Infof("watching %s again", name)
+	}
+}
@@ -0,0 +1,58 @@
+package etcd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestKeepWatching(t *testing.T) {
+	e := &Etcd{}
+	e.watchCtx, e.stopWatch = context.WithCancel(context.Background())
+	watched := make(chan int64, 10)
+	watches, restarts := 0, 0
+	watch := func(ctx context.Context, rev int64) error {
+		watched <- rev
+		watches++
+		switch watches {
+		case 1:
+			return errors.New("etcd went away")
+		case 2:
+			// The watch channel closing without an error is no better.
+			return nil
+		}
+		<-ctx.Done()
+		return nil
+	}
+	restart := func(ctx context.Context) (int64, error) {
+		restarts++
+		if restarts == 1 {
+			return 0, errors.New("etcd still away")
+		}
+		return int64(10 * restarts), nil
+	}
+	done := make(chan struct{})
+	go func() {
+		e.keepWatching(e.watchCtx, "test", 1, watch, restart)
+		close(done)
+	}()
+
+	for _, want := range []int64{1, 20, 30} {
+		select {
+		case rev := <-watched:
+			if rev != want {
+				t.Fatalf("expected a watch from revision %d, got %d", want, rev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a watch from revision %d", want)
+		}
+	}
+	e.stopWatch()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing to end the watch")
+	}
+}
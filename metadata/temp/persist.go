@@ -0,0 +1,212 @@
+package temp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+	"github.com/coreos/pkg/capnslog"
+)
+
+var clog = capnslog.NewPackageLogger("github.com/alternative-storage/torus", "temp")
+
+// persistInterval is how often a persistent Server writes its state to disk.
+const persistInterval = 5 * time.Second
+
+// persistedState is the on-disk form of a Server. Peers and ring listeners
+// are left out; peers re-register themselves when they come back up.
+//
+// Values stored with SetData are encoded as-is, so their concrete types must
+// be registered with gob.Register by whoever stores them.
+type persistedState struct {
+	Vol         torus.VolumeID
+	INodes      map[torus.VolumeID]torus.INodeID
+	Volumes     map[string]*models.Volume
+	Global      torus.GlobalMetadata
+	Ring        []byte
+	RingHistory []torus.RingHistoryEntry
+	Keys        map[string]interface{}
+	Rebalance   torus.RebalanceSettings
+	Events      []torus.AuditEvent
+	Scrubs      map[string]torus.ScrubStatus
+	Cordons     map[string]torus.Cordon
+	GC          torus.GCSettings
+	GCStatus    map[string]torus.GCStatus
+	Tombstones  map[torus.VolumeID]torus.VolumeTombstone
+}
+
+// NewPersistentServer returns a Server backed by the file at path. Existing
+// state is loaded from the file if there is one. The state is written back
+// every persistInterval and when the Server is closed.
+func NewPersistentServer(path string) (*Server, error) {
+	s := NewServer()
+	s.persistPath = path
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.persistClose = make(chan struct{})
+	s.persistDone = make(chan struct{})
+	go s.persistLoop()
+	return s, nil
+}
+
+func (s *Server) load() error {
+	data, err := ioutil.ReadFile(s.persistPath)
+	if os.IsNotExist(err) {
+		// Even the empty state is new to the disk.
+		s.gen++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st persistedState
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&st)
+	if err != nil {
+		return err
+	}
+	r, err := ring.Unmarshal(st.Ring)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.vol = st.Vol
+	s.global = st.Global
+	s.ring = r
+	s.ringHistory = st.RingHistory
+	s.rebal = st.Rebalance
+	s.events = st.Events
+	if n := len(s.events); n > 0 {
+		s.eventSeq = s.events[n-1].Seq
+	}
+	if st.INodes != nil {
+		s.inode = st.INodes
+	}
+	if st.Volumes != nil {
+		s.volIndex = st.Volumes
+	}
+	if st.Keys != nil {
+		s.keys = st.Keys
+	}
+	if st.Scrubs != nil {
+		s.scrubs = st.Scrubs
+	}
+	if st.Cordons != nil {
+		s.cordons = st.Cordons
+	}
+	s.gc = st.GC
+	if st.GCStatus != nil {
+		s.gcStatus = st.GCStatus
+	}
+	if st.Tombstones != nil {
+		s.tombstones = st.Tombstones
+	}
+	return nil
+}
+
+// encodeState returns the state, and its gen, unless it is the state last
+// written, in which case it returns nil. The gen tells changes apart, as gob
+// encodes maps in no particular order.
+func (s *Server) encodeState() ([]byte, uint64, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	if s.gen == s.persistedGen {
+		return nil, s.gen, nil
+	}
+	rb, err := s.ring.Marshal()
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&persistedState{
+		Vol:         s.vol,
+		INodes:      s.inode,
+		Volumes:     s.volIndex,
+		Global:      s.global,
+		Ring:        rb,
+		RingHistory: s.ringHistory,
+		Keys:        s.keys,
+		Rebalance:   s.rebal,
+		Events:      s.events,
+		Scrubs:      s.scrubs,
+		Cordons:     s.cordons,
+		GC:          s.gc,
+		GCStatus:    s.gcStatus,
+		Tombstones:  s.tombstones,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), s.gen, nil
+}
+
+// persist writes the current state if it changed since the last write. The
+// state goes to a temporary file in the same directory which is then renamed
+// over the old one, so a crash never leaves a partial file behind, and the
+// directory synced so that the rename survives one.
+func (s *Server) persist() error {
+	data, gen, err := s.encodeState()
+	if err != nil || data == nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.persistPath), filepath.Base(s.persistPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.persistPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := syncDir(filepath.Dir(s.persistPath)); err != nil {
+		return err
+	}
+	s.persistedGen = gen
+	return nil
+}
+
+// syncDir makes the entries of dir, such as a file just renamed into it,
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Server) persistLoop() {
+	defer close(s.persistDone)
+	t := time.NewTicker(persistInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.persist(); err != nil {
+				clog.Errorf("couldn't persist metadata to %s: %v", s.persistPath, err)
+			}
+		case <-s.persistClose:
+			return
+		}
+	}
+}
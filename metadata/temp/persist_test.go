@@ -0,0 +1,185 @@
+package temp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func TestPersistentServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mds")
+
+	srv, err := NewPersistentServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(torus.Config{}, srv)
+	vid, err := c.NewVolumeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.CreateVolume(&models.Volume{
+		Name: "vol",
+		Id:   uint64(vid),
+		Type: "block",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CommitINodeIndex(vid); err != nil {
+		t.Fatal(err)
+	}
+	c.SetData("key", "value")
+	r, err := ring.CreateRing(&models.Ring{
+		Type:    uint32(ring.Empty),
+		Version: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+	rs := torus.RebalanceSettings{RateLimit: 1 << 20, Paused: true}
+	if err := c.SetRebalanceSettings(rs); err != nil {
+		t.Fatal(err)
+	}
+	ev := torus.AuditEvent{Op: torus.AuditPeerAutoEvict, Details: map[string]string{"peer": "p"}}
+	if err := c.RecordClusterEvent(ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetCordon(torus.Cordon{UUID: "p", Reason: "reboot"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err = NewPersistentServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c = NewClient(torus.Config{}, srv)
+	vol, err := c.GetVolume("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torus.VolumeID(vol.Id) != vid {
+		t.Fatalf("expected volume id %d, got %d", vid, vol.Id)
+	}
+	idx, err := c.GetINodeIndex(vid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 2 {
+		t.Fatalf("expected inode index 2, got %d", idx)
+	}
+	next, err := c.NewVolumeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != vid+1 {
+		t.Fatalf("expected next volume id %d, got %d", vid+1, next)
+	}
+	if v, ok := c.GetData("key"); !ok || v.(string) != "value" {
+		t.Fatalf("expected stored data to survive, got %v", v)
+	}
+	r, err = c.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version() != 2 {
+		t.Fatalf("expected ring version 2, got %d", r.Version())
+	}
+	got, err := c.GetRebalanceSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rs {
+		t.Fatalf("expected rebalance settings %+v, got %+v", rs, got)
+	}
+	cordons, err := c.GetCordons()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cordons) != 1 || cordons[0].UUID != "p" || cordons[0].Reason != "reboot" {
+		t.Fatalf("expected the cordon to survive, got %+v", cordons)
+	}
+	events, err := c.GetClusterEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Op != ev.Op || events[0].Seq != 1 {
+		t.Fatalf("expected the recorded event to survive, got %+v", events)
+	}
+	if err := c.RecordClusterEvent(ev); err != nil {
+		t.Fatal(err)
+	}
+	events, err = c.GetClusterEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[len(events)-1].Seq != 2 {
+		t.Fatalf("expected event numbering to carry on, got %+v", events)
+	}
+	if c.GlobalMetadata().BlockSize != 256 {
+		t.Fatalf("unexpected block size %d", c.GlobalMetadata().BlockSize)
+	}
+}
+
+func TestPersistOnlyChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mds")
+
+	srv, err := NewPersistentServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c := NewClient(torus.Config{}, srv)
+	// Maps of several entries, which gob encodes in any order.
+	for _, uuid := range []string{"a", "b", "c", "d"} {
+		if err := c.SetCordon(torus.Cordon{UUID: uuid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("expected the state to be written: %v", err)
+	}
+	// Unchanged, the state isn't written again.
+	for i := 0; i < 10; i++ {
+		if err := srv.persist(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the unchanged state not to be written, got %v", err)
+	}
+	if err := c.RemoveCordon("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the changed state to be written: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package temp
+
+import (
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+	"github.com/alternative-storage/torus/ring"
+)
+
+func TestRingHistoryRollback(t *testing.T) {
+	c := NewClient(torus.Config{RingHistory: 3}, NewServer())
+	peers := torus.PeerInfoList{
+		&models.PeerInfo{UUID: "a", TotalBlocks: 100},
+		&models.PeerInfo{UUID: "b", TotalBlocks: 100},
+		&models.PeerInfo{UUID: "c", TotalBlocks: 100},
+	}
+	for v := 2; v <= 5; v++ {
+		r, err := ring.CreateRing(&models.Ring{
+			Type:              uint32(ring.Mod),
+			Peers:             peers,
+			ReplicationFactor: uint32(v - 1),
+			Version:           uint32(v),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := torus.SetRingWithMessage(c, r, "change"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := c.RingHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 3 || h[0].Version != 3 || h[2].Version != 5 {
+		t.Fatalf("expected the last 3 rings kept, got %+v", h)
+	}
+	if h[2].Client != c.UUID() || h[2].Message != "change" || h[2].Time.IsZero() {
+		t.Fatalf("expected the ring kept with who set it and why, got %+v", h[2])
+	}
+
+	r, err := ring.Rollback(c, 3, "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version() != 6 {
+		t.Fatalf("expected the rollback to be version 6, got %d", r.Version())
+	}
+	cur, err := c.GetRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	perm, err := cur.GetPeers(torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Version() != 6 || perm.Replication != 2 {
+		t.Fatalf("expected version 3's replication of 2 as version 6, got %d at version %d", perm.Replication, cur.Version())
+	}
+	h, _ = c.RingHistory()
+	if last := h[len(h)-1]; last.Version != 6 || last.Message != "undo" {
+		t.Fatalf("expected the rollback in the history, got %+v", last)
+	}
+
+	if _, err := ring.Rollback(c, 2, ""); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist for a ring no longer kept, got %v", err)
+	}
+	if _, err := ring.Rollback(c, 6, ""); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists for the current ring, got %v", err)
+	}
+}
@@ -1,9 +1,8 @@
 package temp
 
 import (
-	"errors"
-	"fmt"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -26,13 +25,38 @@ type Server struct {
 
 	volIndex map[string]*models.Volume
 	global   torus.GlobalMetadata
+	rebal    torus.RebalanceSettings
+	events   []torus.AuditEvent
+	eventSeq uint64
+	scrubs   map[string]torus.ScrubStatus
+	cordons  map[string]torus.Cordon
 	peers    torus.PeerInfoList
 	ring     torus.Ring
 	newRing  torus.Ring
+	// ringHistory holds the last rings set, oldest first.
+	ringHistory []torus.RingHistoryEntry
+
+	gc torus.GCSettings
+	// gcChanged is closed and replaced each time gc is set, waking its
+	// watchers.
+	gcChanged chan struct{}
+	gcStatus  map[string]torus.GCStatus
+	// tombstones holds the deleted volumes whose blocks are being
+	// reclaimed.
+	tombstones map[torus.VolumeID]torus.VolumeTombstone
 
 	keys map[string]interface{}
 
 	ringListeners []chan torus.Ring
+
+	// gen counts the changes to the state, each made under lock.
+	gen uint64
+
+	persistPath  string
+	persistClose chan struct{}
+	persistDone  chan struct{}
+	// persistedGen is the gen of the state last written.
+	persistedGen uint64
 }
 
 type Client struct {
@@ -40,6 +64,8 @@ type Client struct {
 	uuid   string
 	srv    *Server
 	leader bool
+	// ownsSrv is set when the client created srv itself, and so closes it.
+	ownsSrv bool
 }
 
 func NewServer() *Server {
@@ -56,9 +82,15 @@ func NewServer() *Server {
 			BlockSize:        256,
 			DefaultBlockSpec: blockset.MustParseBlockLayerSpec("crc,base"),
 		},
-		ring:  r,
-		keys:  make(map[string]interface{}),
-		inode: make(map[torus.VolumeID]torus.INodeID),
+		ring:    r,
+		keys:    make(map[string]interface{}),
+		inode:   make(map[torus.VolumeID]torus.INodeID),
+		scrubs:  make(map[string]torus.ScrubStatus),
+		cordons: make(map[string]torus.Cordon),
+
+		gcChanged:  make(chan struct{}),
+		gcStatus:   make(map[string]torus.GCStatus),
+		tombstones: make(map[torus.VolumeID]torus.VolumeTombstone),
 	}
 }
 
@@ -71,7 +103,22 @@ func NewClient(cfg torus.Config, srv *Server) *Client {
 }
 
 func NewTemp(cfg torus.Config) (torus.MetadataService, error) {
-	return NewClient(cfg, NewServer()), nil
+	if cfg.TempPersistPath == "" {
+		return NewClient(cfg, NewServer()), nil
+	}
+	srv, err := NewPersistentServer(cfg.TempPersistPath)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(cfg, srv)
+	c.ownsSrv = true
+	return c, nil
+}
+
+// lock locks s for a change to its state.
+func (s *Server) lock() {
+	s.mut.Lock()
+	s.gen++
 }
 
 func (t *Client) Kind() torus.MetadataKind {
@@ -99,7 +146,15 @@ func (t *Client) GetPeers() (torus.PeerInfoList, error) {
 }
 
 func (t *Client) RegisterPeer(_ int64, pi *models.PeerInfo) error {
-	t.srv.mut.Lock()
+	// The caller goes on updating pi, as the heartbeat does, so a copy is
+	// kept, as the other metadata services keep it marshaled.
+	p := *pi
+	if p.RebalanceInfo != nil {
+		ri := *p.RebalanceInfo
+		p.RebalanceInfo = &ri
+	}
+	pi = &p
+	t.srv.lock()
 	defer t.srv.mut.Unlock()
 	for i, p := range t.srv.peers {
 		if p.UUID == pi.UUID {
@@ -112,7 +167,7 @@ func (t *Client) RegisterPeer(_ int64, pi *models.PeerInfo) error {
 }
 
 func (t *Client) NewVolumeID() (torus.VolumeID, error) {
-	t.srv.mut.Lock()
+	t.srv.lock()
 	defer t.srv.mut.Unlock()
 
 	t.srv.vol++
@@ -120,7 +175,7 @@ func (t *Client) NewVolumeID() (torus.VolumeID, error) {
 }
 
 func (t *Client) CommitINodeIndex(vol torus.VolumeID) (torus.INodeID, error) {
-	t.srv.mut.Lock()
+	t.srv.lock()
 	defer t.srv.mut.Unlock()
 
 	t.srv.inode[vol]++
@@ -145,6 +200,18 @@ func (t *Client) CreateVolume(volume *models.Volume) error {
 	return nil
 }
 
+// UpdateVolume replaces the description of an existing volume.
+func (t *Client) UpdateVolume(volume *models.Volume) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+
+	if _, ok := t.srv.volIndex[volume.Name]; !ok {
+		return torus.ErrNotExist
+	}
+	t.srv.volIndex[volume.Name] = volume
+	return nil
+}
+
 func (t *Client) GetVolume(volume string) (*models.Volume, error) {
 	t.srv.mut.RLock()
 	defer t.srv.mut.RUnlock()
@@ -152,7 +219,176 @@ func (t *Client) GetVolume(volume string) (*models.Volume, error) {
 	if vol, ok := t.srv.volIndex[volume]; ok {
 		return vol, nil
 	}
-	return nil, errors.New(fmt.Sprintf("temp: volume %q not found", volume))
+	return nil, torus.ErrNotExist
+}
+
+func (t *Client) GetRebalanceSettings() (torus.RebalanceSettings, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	return t.srv.rebal, nil
+}
+
+func (t *Client) SetRebalanceSettings(rs torus.RebalanceSettings) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	t.srv.rebal = rs
+	return nil
+}
+
+func (t *Client) GetCordons() ([]torus.Cordon, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	var out []torus.Cordon
+	for _, c := range t.srv.cordons {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (t *Client) SetCordon(c torus.Cordon) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	t.srv.cordons[c.UUID] = c
+	return nil
+}
+
+func (t *Client) RemoveCordon(uuid string) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	if _, ok := t.srv.cordons[uuid]; !ok {
+		return torus.ErrNotExist
+	}
+	delete(t.srv.cordons, uuid)
+	return nil
+}
+
+func (t *Client) GetGCSettings() (torus.GCSettings, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	return t.srv.gc, nil
+}
+
+func (t *Client) SetGCSettings(gs torus.GCSettings) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	t.srv.gc = gs
+	close(t.srv.gcChanged)
+	t.srv.gcChanged = make(chan struct{})
+	return nil
+}
+
+func (t *Client) WatchGCSettings(ctx context.Context) <-chan torus.GCSettings {
+	ch := make(chan torus.GCSettings)
+	go func() {
+		defer close(ch)
+		for {
+			t.srv.mut.RLock()
+			gs, changed := t.srv.gc, t.srv.gcChanged
+			t.srv.mut.RUnlock()
+			select {
+			case ch <- gs:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (t *Client) SetGCStatus(st torus.GCStatus) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	t.srv.gcStatus[st.UUID] = st
+	return nil
+}
+
+func (t *Client) GetGCStatuses() ([]torus.GCStatus, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	var out []torus.GCStatus
+	for _, st := range t.srv.gcStatus {
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func (t *Client) GetTombstones() ([]torus.VolumeTombstone, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	var out []torus.VolumeTombstone
+	for _, ts := range t.srv.tombstones {
+		out = append(out, ts)
+	}
+	return out, nil
+}
+
+func (t *Client) RemoveTombstone(vid torus.VolumeID) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	delete(t.srv.tombstones, vid)
+	return nil
+}
+
+func (t *Client) RecordClusterEvent(e torus.AuditEvent) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	t.srv.eventSeq++
+	e.Seq = t.srv.eventSeq
+	now := time.Now().UTC()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	t.srv.events = append(t.srv.events, e)
+	n := len(t.srv.events) - torus.MaxClusterEvents
+	if n < 0 {
+		n = 0
+	}
+	for n < len(t.srv.events) && now.Sub(t.srv.events[n].Time) > torus.MaxClusterEventAge {
+		n++
+	}
+	if n > 0 {
+		t.srv.events = append([]torus.AuditEvent(nil), t.srv.events[n:]...)
+	}
+	return nil
+}
+
+func (t *Client) GetClusterEvents() ([]torus.AuditEvent, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	out := make([]torus.AuditEvent, len(t.srv.events))
+	copy(out, t.srv.events)
+	return out, nil
+}
+
+func (t *Client) GetScrubStatus(uuid string) (torus.ScrubStatus, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	if st, ok := t.srv.scrubs[uuid]; ok {
+		return st, nil
+	}
+	return torus.ScrubStatus{UUID: uuid}, nil
+}
+
+func (t *Client) SetScrubStatus(st torus.ScrubStatus) error {
+	t.srv.lock()
+	defer t.srv.mut.Unlock()
+	t.srv.scrubs[st.UUID] = st
+	return nil
+}
+
+func (t *Client) GetScrubStatuses() ([]torus.ScrubStatus, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	var out []torus.ScrubStatus
+	for _, st := range t.srv.scrubs {
+		out = append(out, st)
+	}
+	return out, nil
 }
 
 func (t *Client) GetRing() (torus.Ring, error) {
@@ -188,21 +424,63 @@ func (s *Server) UnsubscribeNewRings(ch chan torus.Ring) {
 }
 
 func (t *Client) Close() error {
-	t.srv.mut.Lock()
-	defer t.srv.mut.Unlock()
+	if t.ownsSrv {
+		return t.srv.Close()
+	}
 	return nil
 }
 
 func (t *Client) SetRing(ring torus.Ring) error {
-	return t.srv.SetRing(ring)
+	return t.SetRingWithMessage(ring, "")
+}
+
+func (t *Client) SetRingWithMessage(ring torus.Ring, message string) error {
+	return t.srv.setRing(ring, torus.RingHistoryEntry{
+		Time:    time.Now().UTC(),
+		Client:  t.uuid,
+		Message: message,
+	}, torus.RingHistoryToKeep(t.cfg))
+}
+
+func (t *Client) RingHistory() ([]torus.RingHistoryEntry, error) {
+	t.srv.mut.RLock()
+	defer t.srv.mut.RUnlock()
+	return append([]torus.RingHistoryEntry(nil), t.srv.ringHistory...), nil
 }
 
 func (s *Server) SetRing(ring torus.Ring) error {
-	s.mut.Lock()
+	return s.setRing(ring, torus.RingHistoryEntry{Time: time.Now().UTC()}, torus.DefaultRingHistory)
+}
+
+// setRing replaces the ring, keeping it in the last keep entries of the ring
+// history as entry.
+func (s *Server) setRing(ring torus.Ring, entry torus.RingHistoryEntry, keep int) error {
+	s.lock()
 	defer s.mut.Unlock()
 	if ring.Version()-1 != s.ring.Version() {
 		return torus.ErrNonSequentialRing
 	}
+	b, err := ring.Marshal()
+	if err != nil {
+		return err
+	}
+	if len(s.ringHistory) == 0 {
+		// The ring being replaced was set before the history was kept.
+		ob, err := s.ring.Marshal()
+		if err != nil {
+			return err
+		}
+		s.ringHistory = append(s.ringHistory, torus.RingHistoryEntry{
+			Version: s.ring.Version(),
+			Ring:    ob,
+		})
+	}
+	entry.Version = ring.Version()
+	entry.Ring = b
+	s.ringHistory = append(s.ringHistory, entry)
+	if n := len(s.ringHistory) - keep; n > 0 {
+		s.ringHistory = append([]torus.RingHistoryEntry(nil), s.ringHistory[n:]...)
+	}
 	s.ring = ring
 	for _, c := range s.ringListeners {
 		c <- s.ring
@@ -227,7 +505,13 @@ func (t *Client) GetINodeIndexes() (map[torus.VolumeID]torus.INodeID, error) {
 }
 
 func (s *Server) Close() error {
-	return nil
+	if s.persistClose == nil {
+		return nil
+	}
+	close(s.persistClose)
+	<-s.persistDone
+	s.persistClose = nil
+	return s.persist()
 }
 
 func (t *Client) WithContext(_ context.Context) torus.MetadataService {
@@ -235,7 +519,7 @@ func (t *Client) WithContext(_ context.Context) torus.MetadataService {
 }
 
 func (t *Client) LockData() {
-	t.srv.mut.Lock()
+	t.srv.lock()
 }
 
 func (t *Client) UnlockData() {
@@ -251,9 +535,31 @@ func (t *Client) SetData(x string, v interface{}) {
 	t.srv.keys[x] = v
 }
 
+// DeleteVolume deletes volume name, leaving a tombstone for it until its
+// blocks are reclaimed.
 func (t *Client) DeleteVolume(name string) error {
-	t.srv.mut.Lock()
+	return t.deleteVolume(name, false)
+}
+
+// SecureDeleteVolume deletes volume name like DeleteVolume, with a tombstone
+// that has its blocks overwritten before they are reclaimed.
+func (t *Client) SecureDeleteVolume(name string) error {
+	return t.deleteVolume(name, true)
+}
+
+func (t *Client) deleteVolume(name string, secure bool) error {
+	t.srv.lock()
 	defer t.srv.mut.Unlock()
+	if vol, ok := t.srv.volIndex[name]; ok {
+		t.srv.tombstones[torus.VolumeID(vol.Id)] = torus.VolumeTombstone{
+			Name:    vol.Name,
+			ID:      vol.Id,
+			Type:    vol.Type,
+			Size:    vol.MaxBytes,
+			Deleted: time.Now().UTC(),
+			Secure:  secure,
+		}
+	}
 	delete(t.srv.keys, name)
 	delete(t.srv.volIndex, name)
 	return nil
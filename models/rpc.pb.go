@@ -53,6 +53,10 @@ const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 
 type BlockRequest struct {
 	BlockRef *BlockRef `protobuf:"bytes,1,opt,name=block_ref,json=blockRef" json:"block_ref,omitempty"`
+	// If length is non-zero, only the bytes in [offset, offset+length) of the
+	// block are returned.
+	Offset uint64 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint64 `protobuf:"varint,3,opt,name=length,proto3" json:"length,omitempty"`
 }
 
 func (m *BlockRequest) Reset()                    { *m = BlockRequest{} }
@@ -67,6 +71,20 @@ func (m *BlockRequest) GetBlockRef() *BlockRef {
 	return nil
 }
 
+func (m *BlockRequest) GetOffset() uint64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *BlockRequest) GetLength() uint64 {
+	if m != nil {
+		return m.Length
+	}
+	return 0
+}
+
 type BlockResponse struct {
 	Ok   bool   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
 	Data []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
@@ -92,8 +110,10 @@ func (m *BlockResponse) GetData() []byte {
 }
 
 type PutBlockRequest struct {
-	Refs   []*BlockRef `protobuf:"bytes,1,rep,name=refs" json:"refs,omitempty"`
-	Blocks [][]byte    `protobuf:"bytes,2,rep,name=blocks" json:"blocks,omitempty"`
+	Refs           []*BlockRef `protobuf:"bytes,1,rep,name=refs" json:"refs,omitempty"`
+	Blocks         [][]byte    `protobuf:"bytes,2,rep,name=blocks" json:"blocks,omitempty"`
+	Sync           bool        `protobuf:"varint,3,opt,name=sync,proto3" json:"sync,omitempty"`
+	LockGeneration uint64      `protobuf:"varint,4,opt,name=lock_generation,json=lockGeneration,proto3" json:"lock_generation,omitempty"`
 }
 
 func (m *PutBlockRequest) Reset()                    { *m = PutBlockRequest{} }
@@ -115,6 +135,20 @@ func (m *PutBlockRequest) GetBlocks() [][]byte {
 	return nil
 }
 
+func (m *PutBlockRequest) GetSync() bool {
+	if m != nil {
+		return m.Sync
+	}
+	return false
+}
+
+func (m *PutBlockRequest) GetLockGeneration() uint64 {
+	if m != nil {
+		return m.LockGeneration
+	}
+	return 0
+}
+
 type PutResponse struct {
 	Ok  bool   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
 	Err string `protobuf:"bytes,2,opt,name=err,proto3" json:"err,omitempty"`
@@ -215,6 +249,12 @@ func (this *BlockRequest) VerboseEqual(that interface{}) error {
 	if !this.BlockRef.Equal(that1.BlockRef) {
 		return fmt.Errorf("BlockRef this(%v) Not Equal that(%v)", this.BlockRef, that1.BlockRef)
 	}
+	if this.Offset != that1.Offset {
+		return fmt.Errorf("Offset this(%v) Not Equal that(%v)", this.Offset, that1.Offset)
+	}
+	if this.Length != that1.Length {
+		return fmt.Errorf("Length this(%v) Not Equal that(%v)", this.Length, that1.Length)
+	}
 	return nil
 }
 func (this *BlockRequest) Equal(that interface{}) bool {
@@ -245,6 +285,12 @@ func (this *BlockRequest) Equal(that interface{}) bool {
 	if !this.BlockRef.Equal(that1.BlockRef) {
 		return false
 	}
+	if this.Offset != that1.Offset {
+		return false
+	}
+	if this.Length != that1.Length {
+		return false
+	}
 	return true
 }
 func (this *BlockResponse) VerboseEqual(that interface{}) error {
@@ -354,6 +400,12 @@ func (this *PutBlockRequest) VerboseEqual(that interface{}) error {
 			return fmt.Errorf("Blocks this[%v](%v) Not Equal that[%v](%v)", i, this.Blocks[i], i, that1.Blocks[i])
 		}
 	}
+	if this.Sync != that1.Sync {
+		return fmt.Errorf("Sync this(%v) Not Equal that(%v)", this.Sync, that1.Sync)
+	}
+	if this.LockGeneration != that1.LockGeneration {
+		return fmt.Errorf("LockGeneration this(%v) Not Equal that(%v)", this.LockGeneration, that1.LockGeneration)
+	}
 	return nil
 }
 func (this *PutBlockRequest) Equal(that interface{}) bool {
@@ -397,6 +449,12 @@ func (this *PutBlockRequest) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if this.Sync != that1.Sync {
+		return false
+	}
+	if this.LockGeneration != that1.LockGeneration {
+		return false
+	}
 	return true
 }
 func (this *PutResponse) VerboseEqual(that interface{}) error {
@@ -775,6 +833,16 @@ func (m *BlockRequest) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i += n1
 	}
+	if m.Offset != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintRpc(dAtA, i, uint64(m.Offset))
+	}
+	if m.Length != 0 {
+		dAtA[i] = 0x18
+		i++
+		i = encodeVarintRpc(dAtA, i, uint64(m.Length))
+	}
 	return i, nil
 }
 
@@ -847,6 +915,21 @@ func (m *PutBlockRequest) MarshalTo(dAtA []byte) (int, error) {
 			i += copy(dAtA[i:], b)
 		}
 	}
+	if m.Sync {
+		dAtA[i] = 0x18
+		i++
+		if m.Sync {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if m.LockGeneration != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintRpc(dAtA, i, uint64(m.LockGeneration))
+	}
 	return i, nil
 }
 
@@ -982,6 +1065,8 @@ func NewPopulatedBlockRequest(r randyRpc, easy bool) *BlockRequest {
 	if r.Intn(10) != 0 {
 		this.BlockRef = NewPopulatedBlockRef(r, easy)
 	}
+	this.Offset = uint64(uint64(r.Uint32()))
+	this.Length = uint64(uint64(r.Uint32()))
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -1018,6 +1103,8 @@ func NewPopulatedPutBlockRequest(r randyRpc, easy bool) *PutBlockRequest {
 			this.Blocks[i][j] = byte(r.Intn(256))
 		}
 	}
+	this.Sync = bool(bool(r.Intn(2) == 0))
+	this.LockGeneration = uint64(uint64(r.Uint32()))
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -1141,6 +1228,12 @@ func (m *BlockRequest) Size() (n int) {
 		l = m.BlockRef.Size()
 		n += 1 + l + sovRpc(uint64(l))
 	}
+	if m.Offset != 0 {
+		n += 1 + sovRpc(uint64(m.Offset))
+	}
+	if m.Length != 0 {
+		n += 1 + sovRpc(uint64(m.Length))
+	}
 	return n
 }
 
@@ -1172,6 +1265,12 @@ func (m *PutBlockRequest) Size() (n int) {
 			n += 1 + l + sovRpc(uint64(l))
 		}
 	}
+	if m.Sync {
+		n += 2
+	}
+	if m.LockGeneration != 0 {
+		n += 1 + sovRpc(uint64(m.LockGeneration))
+	}
 	return n
 }
 
@@ -1287,6 +1386,44 @@ func (m *BlockRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Offset", wireType)
+			}
+			m.Offset = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Offset |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Length", wireType)
+			}
+			m.Length = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Length |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -1498,6 +1635,45 @@ func (m *PutBlockRequest) Unmarshal(dAtA []byte) error {
 			m.Blocks = append(m.Blocks, make([]byte, postIndex-iNdEx))
 			copy(m.Blocks[len(m.Blocks)-1], dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sync", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Sync = bool(v != 0)
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LockGeneration", wireType)
+			}
+			m.LockGeneration = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.LockGeneration |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -1938,31 +2114,31 @@ var (
 func init() { proto.RegisterFile("rpc.proto", fileDescriptorRpc) }
 
 var fileDescriptorRpc = []byte{
-	// 401 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x74, 0x52, 0xb1, 0x8e, 0xd3, 0x40,
-	0x10, 0x65, 0x9d, 0x4b, 0x64, 0x4f, 0xcc, 0x71, 0x5a, 0xee, 0x0e, 0xcb, 0x12, 0x2b, 0xcb, 0xba,
-	0x22, 0xcd, 0xd9, 0xd2, 0x85, 0x82, 0x86, 0x26, 0x48, 0x88, 0x2e, 0xd1, 0x42, 0x8f, 0x6c, 0x67,
-	0xed, 0x44, 0x71, 0xb2, 0x61, 0x77, 0xcd, 0x77, 0xf0, 0x19, 0x7c, 0x02, 0x25, 0x25, 0x1d, 0x7c,
-	0x42, 0x62, 0x7e, 0x82, 0x12, 0x79, 0x6d, 0x87, 0x8b, 0x95, 0x74, 0xf3, 0x66, 0xde, 0xce, 0x7b,
-	0x6f, 0x6c, 0xb0, 0xc4, 0x36, 0x09, 0xb6, 0x82, 0x2b, 0x8e, 0x07, 0x6b, 0x3e, 0x67, 0xb9, 0x74,
-	0x87, 0x8a, 0x8b, 0x42, 0xd6, 0x4d, 0xf7, 0x3e, 0x5b, 0xaa, 0x45, 0x11, 0x07, 0x09, 0x5f, 0x87,
-	0x19, 0xcf, 0x78, 0xa8, 0xdb, 0x71, 0x91, 0x6a, 0xa4, 0x81, 0xae, 0x6a, 0xba, 0xff, 0x06, 0xec,
-	0x49, 0xce, 0x93, 0x15, 0x65, 0x9f, 0x0b, 0x26, 0x15, 0xbe, 0x07, 0x2b, 0xae, 0xf0, 0x27, 0xc1,
-	0x52, 0x07, 0x79, 0x68, 0x34, 0x7c, 0xb8, 0x0a, 0x6a, 0x9d, 0xa0, 0x21, 0xa6, 0xd4, 0x8c, 0x9b,
-	0xca, 0x1f, 0xc3, 0xd3, 0xa6, 0x2b, 0xb7, 0x7c, 0x23, 0x19, 0xbe, 0x04, 0x83, 0xaf, 0xf4, 0x43,
-	0x93, 0x1a, 0x7c, 0x85, 0x31, 0x5c, 0xcc, 0x23, 0x15, 0x39, 0x86, 0x87, 0x46, 0x36, 0xd5, 0xb5,
-	0x3f, 0x85, 0x67, 0xb3, 0x42, 0x1d, 0xc9, 0xde, 0xc1, 0x85, 0x60, 0xa9, 0x74, 0x90, 0xd7, 0x3b,
-	0xa9, 0xa8, 0xa7, 0xf8, 0x16, 0x06, 0x5a, 0x59, 0x3a, 0x86, 0xd7, 0x1b, 0xd9, 0xb4, 0x41, 0x7e,
-	0x08, 0xc3, 0x59, 0xa1, 0xce, 0x7a, 0xb8, 0x82, 0x1e, 0x13, 0x42, 0x5b, 0xb0, 0x68, 0x55, 0xfa,
-	0xef, 0xe1, 0x86, 0xb2, 0x38, 0xca, 0xa3, 0x4d, 0xc2, 0xde, 0x2e, 0xd8, 0x7f, 0x1f, 0x21, 0xc0,
-	0x21, 0xfe, 0x79, 0x37, 0x56, 0x9b, 0x5f, 0xfa, 0xef, 0xe0, 0xb6, 0xbb, 0xa9, 0x71, 0x71, 0x0d,
-	0xfd, 0x2f, 0x51, 0xbe, 0x9c, 0xeb, 0x2d, 0x26, 0xad, 0x41, 0x15, 0x41, 0xaa, 0x48, 0x15, 0x52,
-	0xdb, 0xe9, 0xd3, 0x06, 0x3d, 0xfc, 0x42, 0x60, 0x7f, 0xac, 0x3e, 0xe3, 0x07, 0xc5, 0x45, 0x94,
-	0x31, 0xfc, 0x0a, 0xfa, 0x5a, 0x0f, 0x5f, 0x77, 0xe4, 0xb5, 0x51, 0xf7, 0xa6, 0xd3, 0x6d, 0x44,
-	0x5f, 0x83, 0xd9, 0x9e, 0x16, 0xbf, 0x68, 0x29, 0x9d, 0x63, 0xbb, 0xcf, 0x1f, 0x0d, 0x0e, 0x2f,
-	0xa7, 0x70, 0x79, 0x1c, 0x04, 0xbf, 0x6c, 0x69, 0x27, 0x4f, 0xe5, 0x92, 0x73, 0xe3, 0x7a, 0xe1,
-	0xe4, 0x6e, 0xb7, 0x27, 0xe8, 0xef, 0x9e, 0xa0, 0x6f, 0x25, 0x41, 0xdf, 0x4b, 0x82, 0x7e, 0x94,
-	0x04, 0xfd, 0x2c, 0x09, 0xfa, 0x5d, 0x12, 0xb4, 0x2b, 0x09, 0xfa, 0xfa, 0x87, 0x3c, 0x89, 0x07,
-	0xfa, 0x37, 0x1c, 0xff, 0x0b, 0x00, 0x00, 0xff, 0xff, 0x64, 0xb0, 0x77, 0x23, 0xd7, 0x02, 0x00,
-	0x00,
+	// 405 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x75, 0x52, 0xcd, 0x4e, 0xc2, 0x40,
+	0x10, 0xb6, 0xfc, 0xa5, 0x0c, 0x88, 0x64, 0x05, 0x24, 0x4d, 0x6c, 0x4c, 0xc3, 0xc1, 0x8b, 0x6d,
+	0x02, 0x1e, 0x3c, 0x63, 0x62, 0xbc, 0x61, 0x56, 0xef, 0xa6, 0x2d, 0xdb, 0x42, 0x28, 0x2c, 0x76,
+	0xb7, 0x3e, 0x87, 0x8f, 0xe1, 0x23, 0x78, 0xf4, 0xe8, 0x4d, 0x1f, 0x01, 0xf5, 0x25, 0x3c, 0xba,
+	0xdd, 0xb6, 0x28, 0x0d, 0x1c, 0xbe, 0x64, 0xbe, 0x99, 0xd9, 0x6f, 0xbe, 0x9d, 0x5d, 0xa8, 0x86,
+	0x4b, 0xd7, 0x5c, 0x86, 0x94, 0x53, 0x54, 0x99, 0xd3, 0x31, 0x09, 0x98, 0x56, 0xe3, 0x34, 0x8c,
+	0x58, 0x92, 0xd4, 0xce, 0xfc, 0x29, 0x9f, 0x44, 0x8e, 0xe9, 0xd2, 0xb9, 0xe5, 0x53, 0x9f, 0x5a,
+	0x32, 0xed, 0x44, 0x9e, 0x64, 0x92, 0xc8, 0x28, 0x69, 0x37, 0xe6, 0x50, 0x1f, 0x06, 0xd4, 0x9d,
+	0x61, 0xf2, 0x10, 0x11, 0xc6, 0xd1, 0x19, 0x54, 0x9d, 0x98, 0xdf, 0x87, 0xc4, 0xeb, 0x2a, 0x27,
+	0xca, 0x69, 0xad, 0xdf, 0x34, 0x93, 0x39, 0x66, 0xda, 0xe8, 0x61, 0xd5, 0x49, 0x23, 0xd4, 0x81,
+	0x0a, 0xf5, 0x3c, 0x46, 0x78, 0xb7, 0x20, 0x7a, 0x4b, 0x38, 0x65, 0x71, 0x3e, 0x20, 0x0b, 0x9f,
+	0x4f, 0xba, 0xc5, 0x24, 0x9f, 0x30, 0x63, 0x00, 0xfb, 0xa9, 0x0a, 0x5b, 0xd2, 0x05, 0x23, 0xa8,
+	0x01, 0x05, 0x3a, 0x93, 0x83, 0x54, 0x2c, 0x22, 0x84, 0xa0, 0x34, 0xb6, 0xb9, 0x2d, 0xe5, 0xea,
+	0x58, 0xc6, 0xc6, 0x08, 0x0e, 0x6e, 0x22, 0xbe, 0x61, 0xb3, 0x07, 0x25, 0x61, 0x90, 0x89, 0x83,
+	0xc5, 0xad, 0x0e, 0x65, 0x35, 0x76, 0x21, 0x9d, 0x32, 0x21, 0x57, 0x14, 0x72, 0x29, 0x33, 0x2c,
+	0xa8, 0x09, 0xc1, 0x9d, 0x1e, 0x9a, 0x50, 0x24, 0x61, 0x28, 0x2d, 0x54, 0x71, 0x1c, 0x1a, 0xd7,
+	0xd0, 0xc6, 0xc4, 0xb1, 0x03, 0x7b, 0xe1, 0x92, 0xcb, 0x09, 0xf9, 0xf3, 0x61, 0x01, 0xac, 0xd7,
+	0xb5, 0xdb, 0x4d, 0x35, 0xdb, 0x17, 0x33, 0xae, 0xa0, 0x93, 0x57, 0x4a, 0x5d, 0xb4, 0xa0, 0xfc,
+	0x68, 0x07, 0xd3, 0xb1, 0x54, 0x51, 0x71, 0x42, 0xe2, 0x2b, 0x30, 0x6e, 0xf3, 0x88, 0x49, 0x3b,
+	0x65, 0x9c, 0xb2, 0xfe, 0xbb, 0x02, 0xf5, 0xbb, 0xf8, 0xd9, 0x6f, 0xc5, 0xe3, 0xdb, 0x3e, 0x41,
+	0xe7, 0x50, 0x96, 0xf3, 0x50, 0x2b, 0x37, 0x5e, 0x1a, 0xd5, 0xda, 0xb9, 0x6c, 0x3a, 0xf4, 0x02,
+	0xd4, 0x6c, 0xb5, 0xe8, 0x28, 0x6b, 0xc9, 0x2d, 0x5b, 0x3b, 0xfc, 0x57, 0x58, 0x9f, 0x1c, 0x41,
+	0x63, 0xf3, 0x22, 0xe8, 0x38, 0x6b, 0xdb, 0xba, 0x2a, 0x4d, 0xdf, 0x55, 0x4e, 0x04, 0x87, 0xbd,
+	0xd5, 0xa7, 0xae, 0xfc, 0x08, 0x3c, 0x7f, 0xe9, 0xca, 0x8b, 0xc0, 0xab, 0xc0, 0x9b, 0xc0, 0x87,
+	0xc0, 0x4a, 0xe0, 0xe9, 0x5b, 0xdf, 0x73, 0x2a, 0xf2, 0xdb, 0x0e, 0x7e, 0x01, 0x44, 0xbd, 0x07,
+	0x08, 0x07, 0x03, 0x00, 0x00,
 }
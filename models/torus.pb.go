@@ -95,6 +95,29 @@ type Volume struct {
 	Type string `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
 	// TODO(barakmich): Respect sizes for FILE volumes.
 	MaxBytes uint64 `protobuf:"varint,4,opt,name=max_bytes,json=maxBytes,proto3" json:"max_bytes,omitempty"`
+	// Consistency is how many replicas acknowledge a write before it
+	// completes: "sync", "quorum" or "async". Empty follows the server's
+	// configured write level.
+	Consistency string `protobuf:"bytes,5,opt,name=consistency,proto3" json:"consistency,omitempty"`
+	// CachePolicy is how blocks of the volume are admitted to the block
+	// cache: "aggressive", "default" or "no-cache". Empty is "default".
+	CachePolicy string `protobuf:"bytes,6,opt,name=cache_policy,json=cachePolicy,proto3" json:"cache_policy,omitempty"`
+	// WrappedKey is the data key of an encrypted volume, wrapped by the
+	// cluster's master key. Empty for unencrypted volumes.
+	WrappedKey []byte `protobuf:"bytes,7,opt,name=wrapped_key,json=wrappedKey,proto3" json:"wrapped_key,omitempty"`
+	// BlockSpec is the block layer spec the volume's blocks are laid out
+	// by. Empty follows the cluster's default block spec.
+	BlockSpec string `protobuf:"bytes,8,opt,name=block_spec,json=blockSpec,proto3" json:"block_spec,omitempty"`
+	// MaxIops and MaxBytesPerSec limit the I/O operations and bytes per
+	// second of the volume on the node it is attached to. Zero is unlimited.
+	MaxIops        uint64 `protobuf:"varint,9,opt,name=max_iops,json=maxIops,proto3" json:"max_iops,omitempty"`
+	MaxBytesPerSec uint64 `protobuf:"varint,10,opt,name=max_bytes_per_sec,json=maxBytesPerSec,proto3" json:"max_bytes_per_sec,omitempty"`
+	// QosBurst is how long, in nanoseconds, the volume may run at the limits
+	// after a lull, before it is held to them. Zero is a second.
+	QosBurst int64 `protobuf:"varint,11,opt,name=qos_burst,json=qosBurst,proto3" json:"qos_burst,omitempty"`
+	// Labels are arbitrary key=value pairs tagging the volume, such as the
+	// team or environment it belongs to.
+	Labels map[string]string `protobuf:"bytes,12,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 }
 
 func (m *Volume) Reset()                    { *m = Volume{} }
@@ -130,6 +153,62 @@ func (m *Volume) GetMaxBytes() uint64 {
 	return 0
 }
 
+func (m *Volume) GetConsistency() string {
+	if m != nil {
+		return m.Consistency
+	}
+	return ""
+}
+
+func (m *Volume) GetCachePolicy() string {
+	if m != nil {
+		return m.CachePolicy
+	}
+	return ""
+}
+
+func (m *Volume) GetWrappedKey() []byte {
+	if m != nil {
+		return m.WrappedKey
+	}
+	return nil
+}
+
+func (m *Volume) GetBlockSpec() string {
+	if m != nil {
+		return m.BlockSpec
+	}
+	return ""
+}
+
+func (m *Volume) GetMaxIops() uint64 {
+	if m != nil {
+		return m.MaxIops
+	}
+	return 0
+}
+
+func (m *Volume) GetMaxBytesPerSec() uint64 {
+	if m != nil {
+		return m.MaxBytesPerSec
+	}
+	return 0
+}
+
+func (m *Volume) GetQosBurst() int64 {
+	if m != nil {
+		return m.QosBurst
+	}
+	return 0
+}
+
+func (m *Volume) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
 type PeerInfo struct {
 	UUID          string         `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
 	Address       string         `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
@@ -141,6 +220,24 @@ type PeerInfo struct {
 	// ProtocolVersion is set by each peer to know if we're out of date or if a
 	// protocol migration has occured.
 	ProtocolVersion uint64 `protobuf:"varint,8,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	// Topology labels, used to spread the replicas of a block across failure
+	// domains. Either may be empty.
+	Zone string `protobuf:"bytes,9,opt,name=zone,proto3" json:"zone,omitempty"`
+	Rack string `protobuf:"bytes,10,opt,name=rack,proto3" json:"rack,omitempty"`
+	// Free-form labels, such as rack=r1 or zone=us-east-1a, that rings may
+	// place replicas by.
+	Labels map[string]string `protobuf:"bytes,11,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// TLS is set by peers that serve and dial replication over mutually
+	// authenticated TLS only.
+	TLS bool `protobuf:"varint,12,opt,name=tls,proto3" json:"tls,omitempty"`
+	// ReadOnly is set by peers whose storage is full, or nearly so. They
+	// serve the blocks they hold but take no new ones.
+	ReadOnly bool `protobuf:"varint,13,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	// OpenCircuits lists the peers this one has stopped sending requests to
+	// because too many of them failed.
+	OpenCircuits []string `protobuf:"bytes,14,rep,name=open_circuits,json=openCircuits" json:"open_circuits,omitempty"`
+	// Version is the torus release the peer runs.
+	Version string `protobuf:"bytes,15,opt,name=version,proto3" json:"version,omitempty"`
 }
 
 func (m *PeerInfo) Reset()                    { *m = PeerInfo{} }
@@ -204,10 +301,66 @@ func (m *PeerInfo) GetProtocolVersion() uint64 {
 	return 0
 }
 
+func (m *PeerInfo) GetZone() string {
+	if m != nil {
+		return m.Zone
+	}
+	return ""
+}
+
+func (m *PeerInfo) GetRack() string {
+	if m != nil {
+		return m.Rack
+	}
+	return ""
+}
+
+func (m *PeerInfo) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *PeerInfo) GetTLS() bool {
+	if m != nil {
+		return m.TLS
+	}
+	return false
+}
+
+func (m *PeerInfo) GetReadOnly() bool {
+	if m != nil {
+		return m.ReadOnly
+	}
+	return false
+}
+
+func (m *PeerInfo) GetOpenCircuits() []string {
+	if m != nil {
+		return m.OpenCircuits
+	}
+	return nil
+}
+
+func (m *PeerInfo) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
 type RebalanceInfo struct {
 	LastRebalanceFinish int64  `protobuf:"varint,1,opt,name=last_rebalance_finish,json=lastRebalanceFinish,proto3" json:"last_rebalance_finish,omitempty"`
 	LastRebalanceBlocks uint64 `protobuf:"varint,2,opt,name=last_rebalance_blocks,json=lastRebalanceBlocks,proto3" json:"last_rebalance_blocks,omitempty"`
 	Rebalancing         bool   `protobuf:"varint,3,opt,name=rebalancing,proto3" json:"rebalancing,omitempty"`
+	// Progress of the current pass over the local blocks.
+	RebalanceStart int64  `protobuf:"varint,4,opt,name=rebalance_start,json=rebalanceStart,proto3" json:"rebalance_start,omitempty"`
+	BlocksTotal    uint64 `protobuf:"varint,5,opt,name=blocks_total,json=blocksTotal,proto3" json:"blocks_total,omitempty"`
+	BlocksChecked  uint64 `protobuf:"varint,6,opt,name=blocks_checked,json=blocksChecked,proto3" json:"blocks_checked,omitempty"`
+	BytesMoved     uint64 `protobuf:"varint,7,opt,name=bytes_moved,json=bytesMoved,proto3" json:"bytes_moved,omitempty"`
+	// The ring version this peer has finished rebalancing onto.
+	RingVersion uint32 `protobuf:"varint,8,opt,name=ring_version,json=ringVersion,proto3" json:"ring_version,omitempty"`
 }
 
 func (m *RebalanceInfo) Reset()                    { *m = RebalanceInfo{} }
@@ -236,6 +389,41 @@ func (m *RebalanceInfo) GetRebalancing() bool {
 	return false
 }
 
+func (m *RebalanceInfo) GetRebalanceStart() int64 {
+	if m != nil {
+		return m.RebalanceStart
+	}
+	return 0
+}
+
+func (m *RebalanceInfo) GetBlocksTotal() uint64 {
+	if m != nil {
+		return m.BlocksTotal
+	}
+	return 0
+}
+
+func (m *RebalanceInfo) GetBlocksChecked() uint64 {
+	if m != nil {
+		return m.BlocksChecked
+	}
+	return 0
+}
+
+func (m *RebalanceInfo) GetBytesMoved() uint64 {
+	if m != nil {
+		return m.BytesMoved
+	}
+	return 0
+}
+
+func (m *RebalanceInfo) GetRingVersion() uint32 {
+	if m != nil {
+		return m.RingVersion
+	}
+	return 0
+}
+
 type Ring struct {
 	Type              uint32            `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
 	Version           uint32            `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
@@ -557,6 +745,35 @@ func (this *Volume) VerboseEqual(that interface{}) error {
 	if this.MaxBytes != that1.MaxBytes {
 		return fmt.Errorf("MaxBytes this(%v) Not Equal that(%v)", this.MaxBytes, that1.MaxBytes)
 	}
+	if this.Consistency != that1.Consistency {
+		return fmt.Errorf("Consistency this(%v) Not Equal that(%v)", this.Consistency, that1.Consistency)
+	}
+	if this.CachePolicy != that1.CachePolicy {
+		return fmt.Errorf("CachePolicy this(%v) Not Equal that(%v)", this.CachePolicy, that1.CachePolicy)
+	}
+	if !bytes.Equal(this.WrappedKey, that1.WrappedKey) {
+		return fmt.Errorf("WrappedKey this(%v) Not Equal that(%v)", this.WrappedKey, that1.WrappedKey)
+	}
+	if this.BlockSpec != that1.BlockSpec {
+		return fmt.Errorf("BlockSpec this(%v) Not Equal that(%v)", this.BlockSpec, that1.BlockSpec)
+	}
+	if this.MaxIops != that1.MaxIops {
+		return fmt.Errorf("MaxIops this(%v) Not Equal that(%v)", this.MaxIops, that1.MaxIops)
+	}
+	if this.MaxBytesPerSec != that1.MaxBytesPerSec {
+		return fmt.Errorf("MaxBytesPerSec this(%v) Not Equal that(%v)", this.MaxBytesPerSec, that1.MaxBytesPerSec)
+	}
+	if this.QosBurst != that1.QosBurst {
+		return fmt.Errorf("QosBurst this(%v) Not Equal that(%v)", this.QosBurst, that1.QosBurst)
+	}
+	if len(this.Labels) != len(that1.Labels) {
+		return fmt.Errorf("Labels this(%v) Not Equal that(%v)", len(this.Labels), len(that1.Labels))
+	}
+	for i := range this.Labels {
+		if this.Labels[i] != that1.Labels[i] {
+			return fmt.Errorf("Labels this[%v](%v) Not Equal that[%v](%v)", i, this.Labels[i], i, that1.Labels[i])
+		}
+	}
 	return nil
 }
 func (this *Volume) Equal(that interface{}) bool {
@@ -596,6 +813,35 @@ func (this *Volume) Equal(that interface{}) bool {
 	if this.MaxBytes != that1.MaxBytes {
 		return false
 	}
+	if this.Consistency != that1.Consistency {
+		return false
+	}
+	if this.CachePolicy != that1.CachePolicy {
+		return false
+	}
+	if !bytes.Equal(this.WrappedKey, that1.WrappedKey) {
+		return false
+	}
+	if this.BlockSpec != that1.BlockSpec {
+		return false
+	}
+	if this.MaxIops != that1.MaxIops {
+		return false
+	}
+	if this.MaxBytesPerSec != that1.MaxBytesPerSec {
+		return false
+	}
+	if this.QosBurst != that1.QosBurst {
+		return false
+	}
+	if len(this.Labels) != len(that1.Labels) {
+		return false
+	}
+	for i := range this.Labels {
+		if this.Labels[i] != that1.Labels[i] {
+			return false
+		}
+	}
 	return true
 }
 func (this *PeerInfo) VerboseEqual(that interface{}) error {
@@ -647,6 +893,37 @@ func (this *PeerInfo) VerboseEqual(that interface{}) error {
 	if this.ProtocolVersion != that1.ProtocolVersion {
 		return fmt.Errorf("ProtocolVersion this(%v) Not Equal that(%v)", this.ProtocolVersion, that1.ProtocolVersion)
 	}
+	if this.Zone != that1.Zone {
+		return fmt.Errorf("Zone this(%v) Not Equal that(%v)", this.Zone, that1.Zone)
+	}
+	if this.Rack != that1.Rack {
+		return fmt.Errorf("Rack this(%v) Not Equal that(%v)", this.Rack, that1.Rack)
+	}
+	if len(this.Labels) != len(that1.Labels) {
+		return fmt.Errorf("Labels this(%v) Not Equal that(%v)", len(this.Labels), len(that1.Labels))
+	}
+	for i := range this.Labels {
+		if this.Labels[i] != that1.Labels[i] {
+			return fmt.Errorf("Labels this[%v](%v) Not Equal that[%v](%v)", i, this.Labels[i], i, that1.Labels[i])
+		}
+	}
+	if this.TLS != that1.TLS {
+		return fmt.Errorf("TLS this(%v) Not Equal that(%v)", this.TLS, that1.TLS)
+	}
+	if this.ReadOnly != that1.ReadOnly {
+		return fmt.Errorf("ReadOnly this(%v) Not Equal that(%v)", this.ReadOnly, that1.ReadOnly)
+	}
+	if len(this.OpenCircuits) != len(that1.OpenCircuits) {
+		return fmt.Errorf("OpenCircuits this(%v) Not Equal that(%v)", len(this.OpenCircuits), len(that1.OpenCircuits))
+	}
+	for i := range this.OpenCircuits {
+		if this.OpenCircuits[i] != that1.OpenCircuits[i] {
+			return fmt.Errorf("OpenCircuits this[%v](%v) Not Equal that[%v](%v)", i, this.OpenCircuits[i], i, that1.OpenCircuits[i])
+		}
+	}
+	if this.Version != that1.Version {
+		return fmt.Errorf("Version this(%v) Not Equal that(%v)", this.Version, that1.Version)
+	}
 	return nil
 }
 func (this *PeerInfo) Equal(that interface{}) bool {
@@ -698,6 +975,37 @@ func (this *PeerInfo) Equal(that interface{}) bool {
 	if this.ProtocolVersion != that1.ProtocolVersion {
 		return false
 	}
+	if this.Zone != that1.Zone {
+		return false
+	}
+	if this.Rack != that1.Rack {
+		return false
+	}
+	if len(this.Labels) != len(that1.Labels) {
+		return false
+	}
+	for i := range this.Labels {
+		if this.Labels[i] != that1.Labels[i] {
+			return false
+		}
+	}
+	if this.TLS != that1.TLS {
+		return false
+	}
+	if this.ReadOnly != that1.ReadOnly {
+		return false
+	}
+	if len(this.OpenCircuits) != len(that1.OpenCircuits) {
+		return false
+	}
+	for i := range this.OpenCircuits {
+		if this.OpenCircuits[i] != that1.OpenCircuits[i] {
+			return false
+		}
+	}
+	if this.Version != that1.Version {
+		return false
+	}
 	return true
 }
 func (this *RebalanceInfo) VerboseEqual(that interface{}) error {
@@ -734,6 +1042,21 @@ func (this *RebalanceInfo) VerboseEqual(that interface{}) error {
 	if this.Rebalancing != that1.Rebalancing {
 		return fmt.Errorf("Rebalancing this(%v) Not Equal that(%v)", this.Rebalancing, that1.Rebalancing)
 	}
+	if this.RebalanceStart != that1.RebalanceStart {
+		return fmt.Errorf("RebalanceStart this(%v) Not Equal that(%v)", this.RebalanceStart, that1.RebalanceStart)
+	}
+	if this.BlocksTotal != that1.BlocksTotal {
+		return fmt.Errorf("BlocksTotal this(%v) Not Equal that(%v)", this.BlocksTotal, that1.BlocksTotal)
+	}
+	if this.BlocksChecked != that1.BlocksChecked {
+		return fmt.Errorf("BlocksChecked this(%v) Not Equal that(%v)", this.BlocksChecked, that1.BlocksChecked)
+	}
+	if this.BytesMoved != that1.BytesMoved {
+		return fmt.Errorf("BytesMoved this(%v) Not Equal that(%v)", this.BytesMoved, that1.BytesMoved)
+	}
+	if this.RingVersion != that1.RingVersion {
+		return fmt.Errorf("RingVersion this(%v) Not Equal that(%v)", this.RingVersion, that1.RingVersion)
+	}
 	return nil
 }
 func (this *RebalanceInfo) Equal(that interface{}) bool {
@@ -770,6 +1093,21 @@ func (this *RebalanceInfo) Equal(that interface{}) bool {
 	if this.Rebalancing != that1.Rebalancing {
 		return false
 	}
+	if this.RebalanceStart != that1.RebalanceStart {
+		return false
+	}
+	if this.BlocksTotal != that1.BlocksTotal {
+		return false
+	}
+	if this.BlocksChecked != that1.BlocksChecked {
+		return false
+	}
+	if this.BytesMoved != that1.BytesMoved {
+		return false
+	}
+	if this.RingVersion != that1.RingVersion {
+		return false
+	}
 	return true
 }
 func (this *Ring) VerboseEqual(that interface{}) error {
@@ -1142,6 +1480,62 @@ func (m *Volume) MarshalTo(dAtA []byte) (int, error) {
 		i++
 		i = encodeVarintTorus(dAtA, i, uint64(m.MaxBytes))
 	}
+	if len(m.Consistency) > 0 {
+		dAtA[i] = 0x2a
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.Consistency)))
+		i += copy(dAtA[i:], m.Consistency)
+	}
+	if len(m.CachePolicy) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.CachePolicy)))
+		i += copy(dAtA[i:], m.CachePolicy)
+	}
+	if len(m.WrappedKey) > 0 {
+		dAtA[i] = 0x3a
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.WrappedKey)))
+		i += copy(dAtA[i:], m.WrappedKey)
+	}
+	if len(m.BlockSpec) > 0 {
+		dAtA[i] = 0x42
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.BlockSpec)))
+		i += copy(dAtA[i:], m.BlockSpec)
+	}
+	if m.MaxIops != 0 {
+		dAtA[i] = 0x48
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.MaxIops))
+	}
+	if m.MaxBytesPerSec != 0 {
+		dAtA[i] = 0x50
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.MaxBytesPerSec))
+	}
+	if m.QosBurst != 0 {
+		dAtA[i] = 0x58
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.QosBurst))
+	}
+	if len(m.Labels) > 0 {
+		for k, _ := range m.Labels {
+			dAtA[i] = 0x62
+			i++
+			v := m.Labels[k]
+			mapSize := 1 + len(k) + sovTorus(uint64(len(k))) + 1 + len(v) + sovTorus(uint64(len(v)))
+			i = encodeVarintTorus(dAtA, i, uint64(mapSize))
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintTorus(dAtA, i, uint64(len(k)))
+			i += copy(dAtA[i:], k)
+			dAtA[i] = 0x12
+			i++
+			i = encodeVarintTorus(dAtA, i, uint64(len(v)))
+			i += copy(dAtA[i:], v)
+		}
+	}
 	return i, nil
 }
 
@@ -1212,6 +1606,76 @@ func (m *PeerInfo) MarshalTo(dAtA []byte) (int, error) {
 		i++
 		i = encodeVarintTorus(dAtA, i, uint64(m.ProtocolVersion))
 	}
+	if len(m.Zone) > 0 {
+		dAtA[i] = 0x4a
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.Zone)))
+		i += copy(dAtA[i:], m.Zone)
+	}
+	if len(m.Rack) > 0 {
+		dAtA[i] = 0x52
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.Rack)))
+		i += copy(dAtA[i:], m.Rack)
+	}
+	if len(m.Labels) > 0 {
+		for k, _ := range m.Labels {
+			dAtA[i] = 0x5a
+			i++
+			v := m.Labels[k]
+			mapSize := 1 + len(k) + sovTorus(uint64(len(k))) + 1 + len(v) + sovTorus(uint64(len(v)))
+			i = encodeVarintTorus(dAtA, i, uint64(mapSize))
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintTorus(dAtA, i, uint64(len(k)))
+			i += copy(dAtA[i:], k)
+			dAtA[i] = 0x12
+			i++
+			i = encodeVarintTorus(dAtA, i, uint64(len(v)))
+			i += copy(dAtA[i:], v)
+		}
+	}
+	if m.TLS {
+		dAtA[i] = 0x60
+		i++
+		if m.TLS {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if m.ReadOnly {
+		dAtA[i] = 0x68
+		i++
+		if m.ReadOnly {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if len(m.OpenCircuits) > 0 {
+		for _, s := range m.OpenCircuits {
+			dAtA[i] = 0x72
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
+	}
+	if len(m.Version) > 0 {
+		dAtA[i] = 0x7a
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(len(m.Version)))
+		i += copy(dAtA[i:], m.Version)
+	}
 	return i, nil
 }
 
@@ -1250,16 +1714,41 @@ func (m *RebalanceInfo) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i++
 	}
-	return i, nil
-}
-
-func (m *Ring) Marshal() (dAtA []byte, err error) {
-	size := m.Size()
-	dAtA = make([]byte, size)
-	n, err := m.MarshalTo(dAtA)
-	if err != nil {
-		return nil, err
-	}
+	if m.RebalanceStart != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.RebalanceStart))
+	}
+	if m.BlocksTotal != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.BlocksTotal))
+	}
+	if m.BlocksChecked != 0 {
+		dAtA[i] = 0x30
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.BlocksChecked))
+	}
+	if m.BytesMoved != 0 {
+		dAtA[i] = 0x38
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.BytesMoved))
+	}
+	if m.RingVersion != 0 {
+		dAtA[i] = 0x40
+		i++
+		i = encodeVarintTorus(dAtA, i, uint64(m.RingVersion))
+	}
+	return i, nil
+}
+
+func (m *Ring) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
 	return dAtA[:n], nil
 }
 
@@ -1452,6 +1941,27 @@ func NewPopulatedVolume(r randyTorus, easy bool) *Volume {
 	this.Id = uint64(uint64(r.Uint32()))
 	this.Type = string(randStringTorus(r))
 	this.MaxBytes = uint64(uint64(r.Uint32()))
+	this.Consistency = string(randStringTorus(r))
+	this.CachePolicy = string(randStringTorus(r))
+	v4 := r.Intn(100)
+	this.WrappedKey = make([]byte, v4)
+	for i := 0; i < v4; i++ {
+		this.WrappedKey[i] = byte(r.Intn(256))
+	}
+	this.BlockSpec = string(randStringTorus(r))
+	this.MaxIops = uint64(uint64(r.Uint32()))
+	this.MaxBytesPerSec = uint64(uint64(r.Uint32()))
+	this.QosBurst = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.QosBurst *= -1
+	}
+	if r.Intn(10) != 0 {
+		v101 := r.Intn(10)
+		this.Labels = make(map[string]string)
+		for i := 0; i < v101; i++ {
+			this.Labels[randStringTorus(r)] = randStringTorus(r)
+		}
+	}
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -1472,6 +1982,23 @@ func NewPopulatedPeerInfo(r randyTorus, easy bool) *PeerInfo {
 		this.RebalanceInfo = NewPopulatedRebalanceInfo(r, easy)
 	}
 	this.ProtocolVersion = uint64(uint64(r.Uint32()))
+	this.Zone = string(randStringTorus(r))
+	this.Rack = string(randStringTorus(r))
+	if r.Intn(10) != 0 {
+		v5 := r.Intn(10)
+		this.Labels = make(map[string]string)
+		for i := 0; i < v5; i++ {
+			this.Labels[randStringTorus(r)] = randStringTorus(r)
+		}
+	}
+	this.TLS = bool(bool(r.Intn(2) == 0))
+	this.ReadOnly = bool(bool(r.Intn(2) == 0))
+	v100 := r.Intn(10)
+	this.OpenCircuits = make([]string, v100)
+	for i := 0; i < v100; i++ {
+		this.OpenCircuits[i] = string(randStringTorus(r))
+	}
+	this.Version = string(randStringTorus(r))
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -1485,6 +2012,14 @@ func NewPopulatedRebalanceInfo(r randyTorus, easy bool) *RebalanceInfo {
 	}
 	this.LastRebalanceBlocks = uint64(uint64(r.Uint32()))
 	this.Rebalancing = bool(bool(r.Intn(2) == 0))
+	this.RebalanceStart = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.RebalanceStart *= -1
+	}
+	this.BlocksTotal = uint64(uint64(r.Uint32()))
+	this.BlocksChecked = uint64(uint64(r.Uint32()))
+	this.BytesMoved = uint64(uint64(r.Uint32()))
+	this.RingVersion = uint32(r.Uint32())
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -1496,21 +2031,21 @@ func NewPopulatedRing(r randyTorus, easy bool) *Ring {
 	this.Version = uint32(r.Uint32())
 	this.ReplicationFactor = uint32(r.Uint32())
 	if r.Intn(10) != 0 {
-		v4 := r.Intn(5)
-		this.Peers = make([]*PeerInfo, v4)
-		for i := 0; i < v4; i++ {
+		v6 := r.Intn(5)
+		this.Peers = make([]*PeerInfo, v6)
+		for i := 0; i < v6; i++ {
 			this.Peers[i] = NewPopulatedPeerInfo(r, easy)
 		}
 	}
 	if r.Intn(10) != 0 {
-		v5 := r.Intn(10)
+		v7 := r.Intn(10)
 		this.Attrs = make(map[string][]byte)
-		for i := 0; i < v5; i++ {
-			v6 := r.Intn(100)
-			v7 := randStringTorus(r)
-			this.Attrs[v7] = make([]byte, v6)
-			for i := 0; i < v6; i++ {
-				this.Attrs[v7][i] = byte(r.Intn(256))
+		for i := 0; i < v7; i++ {
+			v8 := r.Intn(100)
+			v9 := randStringTorus(r)
+			this.Attrs[v9] = make([]byte, v8)
+			for i := 0; i < v8; i++ {
+				this.Attrs[v9][i] = byte(r.Intn(256))
 			}
 		}
 	}
@@ -1557,9 +2092,9 @@ func randUTF8RuneTorus(r randyTorus) rune {
 	return rune(ru + 61)
 }
 func randStringTorus(r randyTorus) string {
-	v8 := r.Intn(100)
-	tmps := make([]rune, v8)
-	for i := 0; i < v8; i++ {
+	v10 := r.Intn(100)
+	tmps := make([]rune, v10)
+	for i := 0; i < v10; i++ {
 		tmps[i] = randUTF8RuneTorus(r)
 	}
 	return string(tmps)
@@ -1581,11 +2116,11 @@ func randFieldTorus(dAtA []byte, r randyTorus, fieldNumber int, wire int) []byte
 	switch wire {
 	case 0:
 		dAtA = encodeVarintPopulateTorus(dAtA, uint64(key))
-		v9 := r.Int63()
+		v11 := r.Int63()
 		if r.Intn(2) == 0 {
-			v9 *= -1
+			v11 *= -1
 		}
-		dAtA = encodeVarintPopulateTorus(dAtA, uint64(v9))
+		dAtA = encodeVarintPopulateTorus(dAtA, uint64(v11))
 	case 1:
 		dAtA = encodeVarintPopulateTorus(dAtA, uint64(key))
 		dAtA = append(dAtA, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -1669,6 +2204,39 @@ func (m *Volume) Size() (n int) {
 	if m.MaxBytes != 0 {
 		n += 1 + sovTorus(uint64(m.MaxBytes))
 	}
+	l = len(m.Consistency)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
+	l = len(m.CachePolicy)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
+	l = len(m.WrappedKey)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
+	l = len(m.BlockSpec)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
+	if m.MaxIops != 0 {
+		n += 1 + sovTorus(uint64(m.MaxIops))
+	}
+	if m.MaxBytesPerSec != 0 {
+		n += 1 + sovTorus(uint64(m.MaxBytesPerSec))
+	}
+	if m.QosBurst != 0 {
+		n += 1 + sovTorus(uint64(m.QosBurst))
+	}
+	if len(m.Labels) > 0 {
+		for k, v := range m.Labels {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovTorus(uint64(len(k))) + 1 + len(v) + sovTorus(uint64(len(v)))
+			n += mapEntrySize + 1 + sovTorus(uint64(mapEntrySize))
+		}
+	}
 	return n
 }
 
@@ -1702,6 +2270,38 @@ func (m *PeerInfo) Size() (n int) {
 	if m.ProtocolVersion != 0 {
 		n += 1 + sovTorus(uint64(m.ProtocolVersion))
 	}
+	l = len(m.Zone)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
+	l = len(m.Rack)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
+	if len(m.Labels) > 0 {
+		for k, v := range m.Labels {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovTorus(uint64(len(k))) + 1 + len(v) + sovTorus(uint64(len(v)))
+			n += mapEntrySize + 1 + sovTorus(uint64(mapEntrySize))
+		}
+	}
+	if m.TLS {
+		n += 2
+	}
+	if m.ReadOnly {
+		n += 2
+	}
+	if len(m.OpenCircuits) > 0 {
+		for _, s := range m.OpenCircuits {
+			l = len(s)
+			n += 1 + l + sovTorus(uint64(l))
+		}
+	}
+	l = len(m.Version)
+	if l > 0 {
+		n += 1 + l + sovTorus(uint64(l))
+	}
 	return n
 }
 
@@ -1717,6 +2317,21 @@ func (m *RebalanceInfo) Size() (n int) {
 	if m.Rebalancing {
 		n += 2
 	}
+	if m.RebalanceStart != 0 {
+		n += 1 + sovTorus(uint64(m.RebalanceStart))
+	}
+	if m.BlocksTotal != 0 {
+		n += 1 + sovTorus(uint64(m.BlocksTotal))
+	}
+	if m.BlocksChecked != 0 {
+		n += 1 + sovTorus(uint64(m.BlocksChecked))
+	}
+	if m.BytesMoved != 0 {
+		n += 1 + sovTorus(uint64(m.BytesMoved))
+	}
+	if m.RingVersion != 0 {
+		n += 1 + sovTorus(uint64(m.RingVersion))
+	}
 	return n
 }
 
@@ -2272,59 +2887,9 @@ func (m *Volume) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipTorus(dAtA[iNdEx:])
-			if err != nil {
-				return err
-			}
-			if skippy < 0 {
-				return ErrInvalidLengthTorus
-			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
-			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *PeerInfo) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowTorus
-			}
-			if iNdEx >= l {
-				return io.ErrUnexpectedEOF
-			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= (uint64(b) & 0x7F) << shift
-			if b < 0x80 {
-				break
-			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: PeerInfo: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: PeerInfo: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
-		case 1:
+		case 5:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field UUID", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Consistency", wireType)
 			}
 			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
@@ -2349,11 +2914,11 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.UUID = string(dAtA[iNdEx:postIndex])
+			m.Consistency = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
-		case 2:
+		case 6:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Address", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field CachePolicy", wireType)
 			}
 			var stringLen uint64
 			for shift := uint(0); ; shift += 7 {
@@ -2378,13 +2943,13 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.Address = string(dAtA[iNdEx:postIndex])
+			m.CachePolicy = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
-		case 3:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field LastSeen", wireType)
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WrappedKey", wireType)
 			}
-			m.LastSeen = 0
+			var byteLen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowTorus
@@ -2394,16 +2959,57 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.LastSeen |= (int64(b) & 0x7F) << shift
+				byteLen |= (int(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 4:
+			if byteLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.WrappedKey = append(m.WrappedKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.WrappedKey == nil {
+				m.WrappedKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlockSpec", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.BlockSpec = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field TotalBlocks", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxIops", wireType)
 			}
-			m.TotalBlocks = 0
+			m.MaxIops = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowTorus
@@ -2413,16 +3019,16 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.TotalBlocks |= (uint64(b) & 0x7F) << shift
+				m.MaxIops |= (uint64(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 5:
+		case 10:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field UsedBlocks", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxBytesPerSec", wireType)
 			}
-			m.UsedBlocks = 0
+			m.MaxBytesPerSec = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowTorus
@@ -2432,16 +3038,16 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.UsedBlocks |= (uint64(b) & 0x7F) << shift
+				m.MaxBytesPerSec |= (uint64(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 6:
+		case 11:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field TimedOut", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field QosBurst", wireType)
 			}
-			var v int
+			m.QosBurst = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowTorus
@@ -2451,15 +3057,14 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				v |= (int(b) & 0x7F) << shift
+				m.QosBurst |= (int64(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			m.TimedOut = bool(v != 0)
-		case 7:
+		case 12:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field RebalanceInfo", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Labels", wireType)
 			}
 			var msglen int
 			for shift := uint(0); ; shift += 7 {
@@ -2483,18 +3088,7 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			if m.RebalanceInfo == nil {
-				m.RebalanceInfo = &RebalanceInfo{}
-			}
-			if err := m.RebalanceInfo.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
-			}
-			iNdEx = postIndex
-		case 8:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field ProtocolVersion", wireType)
-			}
-			m.ProtocolVersion = 0
+			var keykey uint64
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowTorus
@@ -2504,34 +3098,618 @@ func (m *PeerInfo) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.ProtocolVersion |= (uint64(b) & 0x7F) << shift
+				keykey |= (uint64(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipTorus(dAtA[iNdEx:])
-			if err != nil {
-				return err
+			var stringLenmapkey uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLenmapkey |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
 			}
-			if skippy < 0 {
+			intStringLenmapkey := int(stringLenmapkey)
+			if intStringLenmapkey < 0 {
 				return ErrInvalidLengthTorus
 			}
-			if (iNdEx + skippy) > l {
+			postStringIndexmapkey := iNdEx + intStringLenmapkey
+			if postStringIndexmapkey > l {
 				return io.ErrUnexpectedEOF
 			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *RebalanceInfo) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
+			mapkey := string(dAtA[iNdEx:postStringIndexmapkey])
+			iNdEx = postStringIndexmapkey
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			if iNdEx < postIndex {
+				var valuekey uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowTorus
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					valuekey |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				var stringLenmapvalue uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowTorus
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					stringLenmapvalue |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				intStringLenmapvalue := int(stringLenmapvalue)
+				if intStringLenmapvalue < 0 {
+					return ErrInvalidLengthTorus
+				}
+				postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+				if postStringIndexmapvalue > l {
+					return io.ErrUnexpectedEOF
+				}
+				mapvalue := string(dAtA[iNdEx:postStringIndexmapvalue])
+				iNdEx = postStringIndexmapvalue
+				m.Labels[mapkey] = mapvalue
+			} else {
+				var mapvalue string
+				m.Labels[mapkey] = mapvalue
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipTorus(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthTorus
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *PeerInfo) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowTorus
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: PeerInfo: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: PeerInfo: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UUID", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.UUID = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Address", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Address = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LastSeen", wireType)
+			}
+			m.LastSeen = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.LastSeen |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TotalBlocks", wireType)
+			}
+			m.TotalBlocks = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TotalBlocks |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UsedBlocks", wireType)
+			}
+			m.UsedBlocks = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.UsedBlocks |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TimedOut", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.TimedOut = bool(v != 0)
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RebalanceInfo", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.RebalanceInfo == nil {
+				m.RebalanceInfo = &RebalanceInfo{}
+			}
+			if err := m.RebalanceInfo.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProtocolVersion", wireType)
+			}
+			m.ProtocolVersion = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ProtocolVersion |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Zone", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Zone = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Rack", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Rack = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Labels", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			var keykey uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				keykey |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			var stringLenmapkey uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLenmapkey |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLenmapkey := int(stringLenmapkey)
+			if intStringLenmapkey < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postStringIndexmapkey := iNdEx + intStringLenmapkey
+			if postStringIndexmapkey > l {
+				return io.ErrUnexpectedEOF
+			}
+			mapkey := string(dAtA[iNdEx:postStringIndexmapkey])
+			iNdEx = postStringIndexmapkey
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			if iNdEx < postIndex {
+				var valuekey uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowTorus
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					valuekey |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				var stringLenmapvalue uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowTorus
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					stringLenmapvalue |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				intStringLenmapvalue := int(stringLenmapvalue)
+				if intStringLenmapvalue < 0 {
+					return ErrInvalidLengthTorus
+				}
+				postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+				if postStringIndexmapvalue > l {
+					return io.ErrUnexpectedEOF
+				}
+				mapvalue := string(dAtA[iNdEx:postStringIndexmapvalue])
+				iNdEx = postStringIndexmapvalue
+				m.Labels[mapkey] = mapvalue
+			} else {
+				var mapvalue string
+				m.Labels[mapkey] = mapvalue
+			}
+			iNdEx = postIndex
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TLS", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.TLS = bool(v != 0)
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ReadOnly", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ReadOnly = bool(v != 0)
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field OpenCircuits", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.OpenCircuits = append(m.OpenCircuits, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 15:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTorus
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Version = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipTorus(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthTorus
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *RebalanceInfo) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
 		preIndex := iNdEx
@@ -2617,6 +3795,101 @@ func (m *RebalanceInfo) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Rebalancing = bool(v != 0)
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RebalanceStart", wireType)
+			}
+			m.RebalanceStart = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RebalanceStart |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlocksTotal", wireType)
+			}
+			m.BlocksTotal = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BlocksTotal |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlocksChecked", wireType)
+			}
+			m.BlocksChecked = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BlocksChecked |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BytesMoved", wireType)
+			}
+			m.BytesMoved = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BytesMoved |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RingVersion", wireType)
+			}
+			m.RingVersion = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTorus
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RingVersion |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipTorus(dAtA[iNdEx:])
@@ -3196,49 +4469,54 @@ var (
 func init() { proto.RegisterFile("torus.proto", fileDescriptorTorus) }
 
 var fileDescriptorTorus = []byte{
-	// 702 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xa4, 0x54, 0xcf, 0x6e, 0xd3, 0x4e,
-	0x10, 0xfe, 0x6d, 0x62, 0xa7, 0xce, 0xa4, 0xe9, 0xaf, 0x2c, 0x2d, 0x58, 0x2d, 0x72, 0x42, 0x84,
-	0x50, 0x40, 0x6a, 0x2a, 0x95, 0x4b, 0x55, 0x71, 0x21, 0x40, 0xa5, 0x4a, 0x08, 0xd0, 0xa2, 0x56,
-	0xe2, 0x80, 0x22, 0x27, 0xde, 0xa4, 0xab, 0x3a, 0xbb, 0x91, 0xbd, 0xae, 0x1a, 0x9e, 0x82, 0x2b,
-	0x6f, 0x00, 0x6f, 0xc0, 0x91, 0x23, 0x47, 0x9e, 0xa0, 0x6a, 0xcd, 0x1b, 0x20, 0x0e, 0x1c, 0x91,
-	0x67, 0xed, 0x34, 0x15, 0x70, 0x00, 0x6e, 0xfb, 0x7d, 0xf3, 0x67, 0x67, 0xbe, 0xd9, 0x59, 0xa8,
-	0x69, 0x15, 0x25, 0x71, 0x67, 0x12, 0x29, 0xad, 0x68, 0x65, 0xac, 0x02, 0x1e, 0xc6, 0x6b, 0x1b,
-	0x23, 0xa1, 0x0f, 0x93, 0x7e, 0x67, 0xa0, 0xc6, 0x9b, 0x23, 0x35, 0x52, 0x9b, 0x68, 0xee, 0x27,
-	0x43, 0x44, 0x08, 0xf0, 0x64, 0xc2, 0x5a, 0x5f, 0x09, 0xd8, 0x7b, 0x4f, 0x55, 0xc0, 0xe9, 0x35,
-	0xa8, 0x1c, 0xab, 0x30, 0x19, 0x73, 0x97, 0x34, 0x49, 0xdb, 0x62, 0x39, 0xa2, 0x0d, 0xb0, 0x85,
-	0x54, 0x01, 0x77, 0x4b, 0x19, 0xdd, 0xad, 0xa6, 0xa7, 0x0d, 0x13, 0xc1, 0x0c, 0x4f, 0xd7, 0xc0,
-	0x19, 0x8a, 0x90, 0xc7, 0xe2, 0x35, 0x77, 0x2d, 0x0c, 0x9d, 0x61, 0xda, 0x01, 0xdb, 0xd7, 0x3a,
-	0x8a, 0xdd, 0x85, 0x66, 0xb9, 0x5d, 0xdb, 0x72, 0x3b, 0xa6, 0xca, 0x0e, 0x26, 0xe8, 0x3c, 0xc8,
-	0x4c, 0x8f, 0xa5, 0x8e, 0xa6, 0xcc, 0xb8, 0xd1, 0xbb, 0x50, 0xe9, 0x87, 0x6a, 0x70, 0x14, 0xbb,
-	0x0e, 0x06, 0xd0, 0x22, 0xa0, 0x9b, 0xb1, 0x4f, 0xfc, 0x29, 0x8f, 0x58, 0xee, 0xb1, 0xb6, 0x0d,
-	0x70, 0x91, 0x80, 0x2e, 0x43, 0xf9, 0x88, 0x4f, 0xb1, 0xf6, 0x2a, 0xcb, 0x8e, 0x74, 0x05, 0xec,
-	0x63, 0x3f, 0x4c, 0x4c, 0xe1, 0x55, 0x66, 0xc0, 0x4e, 0x69, 0x9b, 0xb4, 0x76, 0x00, 0x2e, 0xf2,
-	0x51, 0x0a, 0x96, 0x9e, 0x4e, 0x4c, 0xdb, 0x75, 0x86, 0x67, 0xea, 0xc2, 0xc2, 0x40, 0x49, 0xcd,
-	0xa5, 0xc6, 0xe8, 0x45, 0x56, 0xc0, 0xd6, 0x2b, 0xa8, 0x1c, 0x18, 0x61, 0x28, 0x58, 0xd2, 0xcf,
-	0xe5, 0xaa, 0x32, 0x3c, 0xd3, 0x25, 0x28, 0x89, 0xc0, 0x28, 0xc5, 0x4a, 0x22, 0x98, 0xe5, 0x2e,
-	0x1b, 0x1f, 0xcc, 0xbd, 0x0e, 0xd5, 0xb1, 0x7f, 0xd2, 0xeb, 0x4f, 0x35, 0x8f, 0x0b, 0xc1, 0xc6,
-	0xfe, 0x49, 0x37, 0xc3, 0xad, 0xf7, 0x25, 0x70, 0x9e, 0x73, 0x1e, 0xed, 0xc9, 0xa1, 0xa2, 0x37,
-	0xc0, 0x4a, 0x12, 0x11, 0x98, 0x1b, 0xba, 0x4e, 0x7a, 0xda, 0xb0, 0xf6, 0xf7, 0xf7, 0x1e, 0x31,
-	0x64, 0xb3, 0x1a, 0xfd, 0x20, 0x88, 0x78, 0x1c, 0xe7, 0x1d, 0x16, 0x30, 0xbb, 0x21, 0xf4, 0x63,
-	0xdd, 0x8b, 0x39, 0x97, 0x78, 0x75, 0x99, 0x39, 0x19, 0xf1, 0x82, 0x73, 0x49, 0x6f, 0xc2, 0xa2,
-	0x56, 0xda, 0x0f, 0x7b, 0xb9, 0xd0, 0xa6, 0x82, 0x1a, 0x72, 0xa8, 0x4a, 0x4c, 0x1b, 0x50, 0x4b,
-	0x62, 0x1e, 0x14, 0x1e, 0x36, 0x7a, 0x40, 0x46, 0xe5, 0x0e, 0xeb, 0x50, 0xd5, 0x62, 0xcc, 0x83,
-	0x9e, 0x4a, 0xb4, 0x5b, 0x69, 0x92, 0xb6, 0xc3, 0x1c, 0x24, 0x9e, 0x25, 0x9a, 0xde, 0x87, 0xa5,
-	0x88, 0xf7, 0xfd, 0xd0, 0x97, 0x03, 0xde, 0x13, 0x72, 0xa8, 0xdc, 0x85, 0x26, 0x69, 0xd7, 0xb6,
-	0x56, 0x8b, 0x59, 0xb2, 0xc2, 0x9a, 0x35, 0xc9, 0xea, 0xd1, 0x3c, 0xa4, 0x77, 0x60, 0x19, 0x5f,
-	0xe6, 0x40, 0x85, 0xbd, 0x63, 0x1e, 0xc5, 0x42, 0x49, 0xd7, 0xc1, 0x02, 0xfe, 0x2f, 0xf8, 0x03,
-	0x43, 0xb7, 0xde, 0x12, 0xa8, 0x5f, 0xca, 0x45, 0xb7, 0x60, 0x15, 0x1b, 0xbf, 0xb8, 0x7f, 0x28,
-	0xa4, 0x88, 0x0f, 0x51, 0xc1, 0x32, 0xbb, 0x9a, 0x19, 0x67, 0x11, 0xbb, 0x68, 0xfa, 0x45, 0x4c,
-	0xde, 0xb6, 0x99, 0xe2, 0xe5, 0x98, 0xbc, 0xff, 0x26, 0xd4, 0x0a, 0x77, 0x21, 0x47, 0x28, 0xb1,
-	0xc3, 0xe6, 0xa9, 0xd6, 0x37, 0x02, 0x16, 0x13, 0x72, 0xf4, 0xbb, 0xd7, 0x55, 0xb4, 0x56, 0x42,
-	0xba, 0x80, 0x74, 0x03, 0x68, 0xc4, 0x27, 0xa1, 0x18, 0xf8, 0x5a, 0x28, 0xd9, 0x1b, 0xfa, 0x03,
-	0xad, 0x22, 0xcc, 0x5f, 0x67, 0x57, 0xe6, 0x2c, 0xbb, 0x68, 0xa0, 0xb7, 0xc1, 0x9e, 0x70, 0x1e,
-	0x65, 0x43, 0xcc, 0xb6, 0x65, 0xb9, 0x50, 0xb8, 0x78, 0x41, 0xcc, 0x98, 0xe9, 0x46, 0xb1, 0x86,
-	0x36, 0xfa, 0x5d, 0x9f, 0x4d, 0x42, 0xc8, 0xd1, 0xcf, 0x5b, 0xf8, 0x67, 0x9b, 0xb5, 0x38, 0xbf,
-	0x59, 0x2f, 0xc1, 0x41, 0x89, 0x18, 0x1f, 0xfe, 0xfd, 0x87, 0xb2, 0x02, 0x36, 0x8e, 0x00, 0xfb,
-	0xb6, 0x98, 0x01, 0xad, 0x87, 0xe0, 0x18, 0xaf, 0x7f, 0x48, 0xdd, 0xbd, 0x75, 0x76, 0xee, 0x91,
-	0xef, 0xe7, 0x1e, 0x79, 0x97, 0x7a, 0xe4, 0x43, 0xea, 0x91, 0x8f, 0xa9, 0x47, 0x3e, 0xa5, 0x1e,
-	0xf9, 0x9c, 0x7a, 0xe4, 0x2c, 0xf5, 0xc8, 0x9b, 0x2f, 0xde, 0x7f, 0xfd, 0x0a, 0xbe, 0xb4, 0x7b,
-	0x3f, 0x02, 0x00, 0x00, 0xff, 0xff, 0x8b, 0xd7, 0x00, 0x05, 0x61, 0x05, 0x00, 0x00,
+	// 769 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xa5, 0x54, 0xcb, 0x6e, 0x13, 0x31,
+	0x14, 0x65, 0x92, 0x49, 0x3a, 0xb9, 0x69, 0xda, 0x62, 0x28, 0x8c, 0x0a, 0x6a, 0x4b, 0xc4, 0xa3,
+	0x20, 0x35, 0x95, 0xca, 0xa6, 0xaa, 0xd8, 0x90, 0x42, 0xa5, 0x4a, 0xbc, 0xe4, 0xd2, 0x4a, 0x2c,
+	0xd0, 0x68, 0x32, 0x71, 0xd2, 0x51, 0x26, 0xe3, 0x68, 0xec, 0x89, 0x48, 0xbf, 0x82, 0xcf, 0x60,
+	0xc3, 0x9e, 0x25, 0x4b, 0x96, 0xf0, 0x03, 0xa8, 0x94, 0x3f, 0x40, 0x2c, 0x58, 0x62, 0x5f, 0xcf,
+	0x24, 0xa9, 0x80, 0x05, 0xb0, 0xb0, 0xe4, 0x7b, 0xee, 0xc3, 0xd7, 0xe7, 0x5c, 0x1b, 0xaa, 0x92,
+	0x27, 0xa9, 0x68, 0x0c, 0x12, 0x2e, 0x39, 0x29, 0xf7, 0x79, 0x9b, 0x45, 0x62, 0x69, 0xbd, 0x1b,
+	0xca, 0xa3, 0xb4, 0xd5, 0x08, 0x78, 0x7f, 0xa3, 0xcb, 0xbb, 0x7c, 0x03, 0xdd, 0xad, 0xb4, 0x83,
+	0x16, 0x1a, 0xb8, 0x33, 0x69, 0xf5, 0x6f, 0x16, 0x94, 0xf6, 0x9e, 0xa8, 0x54, 0x72, 0x09, 0xca,
+	0x43, 0x1e, 0xa5, 0x7d, 0xe6, 0x5a, 0xab, 0xd6, 0x9a, 0x4d, 0x33, 0x8b, 0xac, 0x40, 0x29, 0x8c,
+	0x55, 0x80, 0x5b, 0xd0, 0x70, 0xb3, 0x72, 0xfa, 0x79, 0xc5, 0x64, 0x50, 0x83, 0x93, 0x25, 0x70,
+	0x3a, 0x61, 0xc4, 0x44, 0x78, 0xcc, 0x5c, 0x1b, 0x53, 0xc7, 0x36, 0x69, 0x40, 0xc9, 0x97, 0x32,
+	0x11, 0xee, 0xcc, 0x6a, 0x71, 0xad, 0xba, 0xe9, 0x36, 0x4c, 0x97, 0x0d, 0x2c, 0xd0, 0xb8, 0xaf,
+	0x5d, 0x0f, 0x63, 0x99, 0x8c, 0xa8, 0x09, 0x23, 0x77, 0xa0, 0xdc, 0x8a, 0x78, 0xd0, 0x13, 0xae,
+	0x83, 0x09, 0x24, 0x4f, 0x68, 0x6a, 0xf4, 0x91, 0x3f, 0x62, 0x09, 0xcd, 0x22, 0x96, 0xb6, 0x00,
+	0x26, 0x05, 0xc8, 0x02, 0x14, 0x7b, 0x6c, 0x84, 0xbd, 0x57, 0xa8, 0xde, 0x92, 0x8b, 0x50, 0x1a,
+	0xfa, 0x51, 0x6a, 0x1a, 0xaf, 0x50, 0x63, 0x6c, 0x17, 0xb6, 0xac, 0xfa, 0x36, 0xc0, 0xa4, 0x1e,
+	0x21, 0x60, 0xcb, 0xd1, 0xc0, 0x5c, 0xbb, 0x46, 0x71, 0x4f, 0x5c, 0x98, 0x09, 0x78, 0x2c, 0x59,
+	0x2c, 0x31, 0x7b, 0x96, 0xe6, 0x66, 0xfd, 0x25, 0x94, 0x0f, 0x0d, 0x31, 0x2a, 0x2f, 0xf6, 0x33,
+	0xba, 0x2a, 0x14, 0xf7, 0x64, 0x0e, 0x0a, 0x61, 0xdb, 0x30, 0x45, 0xd5, 0x6e, 0x5c, 0xbb, 0x68,
+	0x62, 0xb0, 0xf6, 0x15, 0xa8, 0xf4, 0xfd, 0x57, 0x5e, 0x6b, 0x24, 0x99, 0xc8, 0x09, 0x53, 0x40,
+	0x53, 0xdb, 0xf5, 0x4f, 0x05, 0x70, 0x9e, 0x31, 0x96, 0xec, 0xc5, 0x1d, 0x4e, 0xae, 0x82, 0x9d,
+	0xa6, 0xaa, 0x1e, 0x9e, 0xd0, 0x74, 0x14, 0xf3, 0xf6, 0xc1, 0xc1, 0xde, 0x03, 0x8a, 0xa8, 0xee,
+	0xd1, 0x6f, 0xb7, 0x13, 0x26, 0x44, 0x76, 0xc3, 0xdc, 0xd4, 0x27, 0x44, 0xbe, 0x90, 0x9e, 0x60,
+	0x2c, 0xc6, 0xa3, 0x8b, 0xd4, 0xd1, 0xc0, 0xbe, 0xb2, 0xc9, 0x35, 0x98, 0x95, 0x5c, 0xfa, 0x91,
+	0x97, 0x11, 0x6d, 0x3a, 0xa8, 0x22, 0x86, 0xac, 0x08, 0x25, 0x79, 0x35, 0x15, 0xac, 0x9d, 0x47,
+	0x94, 0x30, 0x02, 0x34, 0x94, 0x05, 0xa8, 0x03, 0x64, 0xd8, 0x57, 0x11, 0x3c, 0x95, 0x6e, 0x59,
+	0xb9, 0x1d, 0xea, 0x20, 0xf0, 0x34, 0x95, 0xe4, 0x1e, 0xcc, 0x25, 0xac, 0xe5, 0x47, 0x7e, 0x1c,
+	0x30, 0x2f, 0x54, 0xf7, 0x50, 0xe2, 0x5b, 0x4a, 0xcb, 0xc5, 0x5c, 0x4b, 0x9a, 0x7b, 0xf5, 0x25,
+	0x69, 0x2d, 0x99, 0x36, 0xc9, 0x6d, 0x58, 0xc0, 0xc9, 0x0c, 0x78, 0xe4, 0x0d, 0x59, 0x22, 0x42,
+	0x1e, 0xab, 0x59, 0xd0, 0x0d, 0xcc, 0xe7, 0xf8, 0xa1, 0x81, 0x35, 0xb9, 0xc7, 0x3c, 0x66, 0x6e,
+	0xc5, 0x90, 0xab, 0xf7, 0x1a, 0x4b, 0xfc, 0xa0, 0xe7, 0x82, 0xc1, 0xf4, 0xbe, 0xfe, 0xb6, 0x00,
+	0xb5, 0x33, 0x67, 0x92, 0x4d, 0x58, 0x44, 0x82, 0x26, 0x7d, 0x76, 0xc2, 0x38, 0x14, 0x47, 0xc8,
+	0x74, 0x91, 0x5e, 0xd0, 0xce, 0x71, 0xc6, 0x2e, 0xba, 0x7e, 0x93, 0x93, 0xd1, 0x63, 0xd4, 0x3e,
+	0x9b, 0x93, 0xf1, 0xb4, 0x0a, 0xd5, 0x3c, 0x3c, 0x8c, 0xbb, 0x28, 0x85, 0x43, 0xa7, 0x21, 0x72,
+	0x0b, 0xe6, 0x27, 0x05, 0x85, 0xf4, 0x13, 0x89, 0x82, 0x14, 0xe9, 0x84, 0xc3, 0x7d, 0x8d, 0x6a,
+	0xd9, 0xcc, 0x79, 0x1e, 0x2a, 0x95, 0x89, 0x52, 0x35, 0xd8, 0x73, 0x0d, 0x91, 0x1b, 0x30, 0x97,
+	0x85, 0x04, 0x47, 0x2c, 0xe8, 0xb1, 0x36, 0x4a, 0x63, 0xd3, 0x9a, 0x41, 0x77, 0x0c, 0xa8, 0xd5,
+	0xc5, 0xd9, 0xf3, 0xfa, 0x7c, 0xa8, 0x62, 0x66, 0x8c, 0xba, 0x08, 0x3d, 0xd6, 0x48, 0xfd, 0xbb,
+	0x05, 0x36, 0xd5, 0xcd, 0xfd, 0xe1, 0x65, 0xe4, 0xb2, 0x14, 0x10, 0xce, 0x4d, 0xb2, 0x0e, 0x24,
+	0x61, 0x83, 0x28, 0x0c, 0x7c, 0xa9, 0x4c, 0xaf, 0xe3, 0x07, 0xea, 0x7f, 0xc2, 0x3b, 0xd7, 0xe8,
+	0xf9, 0x29, 0xcf, 0x2e, 0x3a, 0xc8, 0x4d, 0x28, 0x0d, 0xd4, 0xa0, 0xeb, 0x01, 0xd4, 0x2f, 0x7d,
+	0x21, 0x9f, 0x8e, 0x7c, 0xfa, 0xa9, 0x71, 0xab, 0xb2, 0xd9, 0x17, 0x52, 0xc2, 0xb8, 0xcb, 0xe3,
+	0x29, 0x52, 0x1d, 0xfe, 0xfa, 0x83, 0xfc, 0xdd, 0xaf, 0x30, 0x3b, 0xfd, 0x2b, 0xbc, 0x00, 0x07,
+	0x65, 0xa3, 0xac, 0xf3, 0xef, 0x9f, 0xa1, 0x2a, 0x8f, 0x6c, 0xe3, 0xbd, 0x6d, 0x6a, 0x8c, 0xfa,
+	0x0e, 0x38, 0x26, 0xea, 0x3f, 0x4a, 0x37, 0xaf, 0x9f, 0x7c, 0x59, 0xb6, 0x7e, 0xa8, 0xf5, 0xe6,
+	0x74, 0xd9, 0x7a, 0xa7, 0xd6, 0x7b, 0xb5, 0x3e, 0xa8, 0xf5, 0x51, 0xad, 0x13, 0xb5, 0x5e, 0x7f,
+	0x5d, 0x3e, 0xd7, 0x2a, 0xe3, 0x2b, 0xb9, 0xfb, 0x13, 0x9e, 0xaa, 0x33, 0xcd, 0x1d, 0x06, 0x00,
+	0x00,
 }
@@ -0,0 +1,128 @@
+package torus
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// readaheadTrigger is how many blocks of a file must be read one after
+	// the other before the blocks past them are fetched ahead.
+	readaheadTrigger = 3
+	// readaheadStart is how many blocks are fetched ahead at first. The
+	// window doubles with each fetch, up to its cap.
+	readaheadStart = 2
+)
+
+// readahead follows the blocks read from a file, and once they are read in
+// order, fetches the ones past them in the background so that they are
+// cached by the time the reader gets to them. The window grows as long as the
+// reader keeps on, and starts over once it reads elsewhere.
+type readahead struct {
+	maxBlocks int
+	// fetch reads blocks [from, to) of the file into the cache.
+	fetch func(ctx context.Context, from, to int)
+
+	mut sync.Mutex
+	// last is the block read last, and run the number of blocks read in
+	// order up to it.
+	last int
+	run  int
+	// window is how many blocks are kept fetched past the reader, and
+	// ahead the block up to which they have been.
+	window int
+	ahead  int
+	// busy is set while a fetch is under way; there is one at a time.
+	busy   bool
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newReadahead returns a readahead fetching up to maxBlocks ahead with fetch,
+// or nil if maxBlocks is zero.
+func newReadahead(ctx context.Context, maxBlocks int, fetch func(ctx context.Context, from, to int)) *readahead {
+	if maxBlocks <= 0 {
+		return nil
+	}
+	ra := &readahead{
+		maxBlocks: maxBlocks,
+		fetch:     fetch,
+		last:      -1,
+	}
+	ra.ctx, ra.cancel = context.WithCancel(ctx)
+	return ra
+}
+
+// read notes that block i of a file of length blocks was read, and starts
+// fetching the blocks after it if the reader is sequential and nearing the
+// end of those fetched already.
+func (ra *readahead) read(i, length int) {
+	if ra == nil {
+		return
+	}
+	ra.mut.Lock()
+	defer ra.mut.Unlock()
+	switch i {
+	case ra.last:
+		return
+	case ra.last + 1:
+		ra.run++
+	default:
+		ra.run = 1
+		ra.window = 0
+		ra.ahead = 0
+	}
+	ra.last = i
+	if ra.run < readaheadTrigger || ra.busy || ra.closed {
+		return
+	}
+	if ra.window == 0 {
+		ra.window = readaheadStart
+		if ra.window > ra.maxBlocks {
+			ra.window = ra.maxBlocks
+		}
+	}
+	if ra.ahead <= i {
+		ra.ahead = i + 1
+	}
+	if ra.ahead-i-1 > ra.window/2 {
+		// Still well ahead of the reader.
+		return
+	}
+	from, to := ra.ahead, i+1+ra.window
+	if to > length {
+		to = length
+	}
+	if from >= to {
+		return
+	}
+	ra.ahead = to
+	ra.window *= 2
+	if ra.window > ra.maxBlocks {
+		ra.window = ra.maxBlocks
+	}
+	ra.busy = true
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		ra.fetch(ra.ctx, from, to)
+		ra.mut.Lock()
+		ra.busy = false
+		ra.mut.Unlock()
+	}()
+}
+
+// close cancels the fetch under way, if any, and waits for it to stop.
+func (ra *readahead) close() {
+	if ra == nil {
+		return
+	}
+	ra.mut.Lock()
+	ra.closed = true
+	ra.cancel()
+	ra.mut.Unlock()
+	ra.wg.Wait()
+}
@@ -0,0 +1,78 @@
+package torus
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type fetchRecorder struct {
+	mut     sync.Mutex
+	fetched [][2]int
+}
+
+func (r *fetchRecorder) fetch(ctx context.Context, from, to int) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.fetched = append(r.fetched, [2]int{from, to})
+}
+
+// readAll reads blocks [from, to) of a file of length blocks with ra, one at
+// a time, waiting for the fetch each starts, if any.
+func readAll(ra *readahead, from, to, length int) {
+	for i := from; i < to; i++ {
+		ra.read(i, length)
+		ra.wg.Wait()
+	}
+}
+
+func TestReadaheadWindow(t *testing.T) {
+	r := &fetchRecorder{}
+	ra := newReadahead(context.Background(), 8, r.fetch)
+	defer ra.close()
+	readAll(ra, 0, 2, 100)
+	// A block read again isn't a new one.
+	readAll(ra, 1, 2, 100)
+	if len(r.fetched) != 0 {
+		t.Fatalf("expected nothing fetched before %d blocks were read in order, got %v", readaheadTrigger, r.fetched)
+	}
+	readAll(ra, 2, 20, 100)
+	// The window doubles up to 8 blocks, and more are fetched once the
+	// reader is halfway through those fetched already.
+	want := [][2]int{{3, 5}, {5, 8}, {8, 13}, {13, 17}, {17, 21}, {21, 25}}
+	if !reflect.DeepEqual(r.fetched, want) {
+		t.Fatalf("expected fetches %v, got %v", want, r.fetched)
+	}
+
+	// Reading elsewhere starts over, and nothing is fetched past the end.
+	r.fetched = nil
+	readAll(ra, 95, 100, 100)
+	want = [][2]int{{98, 100}}
+	if !reflect.DeepEqual(r.fetched, want) {
+		t.Fatalf("expected fetches %v, got %v", want, r.fetched)
+	}
+}
+
+func TestReadaheadClose(t *testing.T) {
+	started := make(chan struct{})
+	ra := newReadahead(context.Background(), 8, func(ctx context.Context, from, to int) {
+		close(started)
+		<-ctx.Done()
+	})
+	for i := 0; i < readaheadTrigger; i++ {
+		ra.read(i, 100)
+	}
+	<-started
+	// close cancels the fetch, and waits for it.
+	ra.close()
+	ra.read(readaheadTrigger, 100)
+
+	if newReadahead(context.Background(), 0, nil) != nil {
+		t.Fatal("expected no readahead without a window")
+	}
+	var none *readahead
+	none.read(0, 1)
+	none.close()
+}
@@ -0,0 +1,61 @@
+package torus
+
+import (
+	"time"
+
+	"github.com/alternative-storage/torus/models"
+)
+
+// RebalanceSettings control rebalancing on every node of the cluster.
+type RebalanceSettings struct {
+	// RateLimit caps the bytes per second each node sends to other peers
+	// while rebalancing. Zero is unlimited.
+	RateLimit uint64 `json:"rate_limit,omitempty"`
+	// Paused stops rebalancing until it is resumed, across restarts.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// RebalanceProgress summarizes a peer's progress through a rebalance pass.
+type RebalanceProgress struct {
+	UUID        string `json:"uuid"`
+	Rebalancing bool   `json:"rebalancing"`
+	// BlocksRemaining is the number of local blocks not yet examined in the
+	// current pass; only some of them will need to move.
+	BlocksRemaining uint64 `json:"blocks_remaining"`
+	BlocksChecked   uint64 `json:"blocks_checked"`
+	BytesMoved      uint64 `json:"bytes_moved"`
+	// Throughput is in bytes per second, averaged over the pass so far.
+	Throughput float64 `json:"throughput"`
+	// ETA is zero if it can't be estimated yet.
+	ETA time.Duration `json:"eta"`
+	// RingVersion is the ring version the peer last finished rebalancing
+	// onto.
+	RingVersion int `json:"ring_version"`
+}
+
+// NewRebalanceProgress computes the progress described by ri as of now.
+func NewRebalanceProgress(uuid string, ri *models.RebalanceInfo, now time.Time) RebalanceProgress {
+	out := RebalanceProgress{UUID: uuid}
+	if ri == nil {
+		return out
+	}
+	out.Rebalancing = ri.Rebalancing
+	out.BlocksChecked = ri.BlocksChecked
+	out.BytesMoved = ri.BytesMoved
+	out.RingVersion = int(ri.RingVersion)
+	if ri.BlocksTotal > ri.BlocksChecked {
+		out.BlocksRemaining = ri.BlocksTotal - ri.BlocksChecked
+	}
+	if ri.RebalanceStart == 0 {
+		return out
+	}
+	elapsed := now.Sub(time.Unix(0, ri.RebalanceStart))
+	if elapsed <= 0 {
+		return out
+	}
+	out.Throughput = float64(ri.BytesMoved) / elapsed.Seconds()
+	if ri.BlocksChecked != 0 {
+		out.ETA = time.Duration(float64(elapsed) * float64(out.BlocksRemaining) / float64(ri.BlocksChecked))
+	}
+	return out
+}
@@ -2,6 +2,7 @@ package torus
 
 import (
 	"math/big"
+	"time"
 
 	"github.com/alternative-storage/torus/models"
 )
@@ -33,6 +34,25 @@ type RingRemover interface {
 	RemovePeers(PeerList) (Ring, error)
 }
 
+// RingDrainer is implemented by rings that can drain peers. A draining peer
+// stays a member, serving reads of the blocks it holds while rebalancing
+// copies them to the rest of the ring, but no new blocks are placed on it:
+// draining peers come last in the permutations of the ring, past its
+// replicas.
+type RingDrainer interface {
+	ModifyableRing
+	Draining() PeerList
+	SetDraining(PeerList) (Ring, error)
+}
+
+// RingReweigher is implemented by rings that place blocks on their members
+// by capacity. Reweigh returns the ring with the capacity of the members
+// among peers set to theirs, or ErrExists if none of them changed.
+type RingReweigher interface {
+	ModifyableRing
+	Reweigh(PeerInfoList) (Ring, error)
+}
+
 type PeerPermutation struct {
 	Replication int
 	Peers       PeerList
@@ -126,6 +146,25 @@ func (pi PeerInfoList) Union(b PeerInfoList) PeerInfoList {
 	return out
 }
 
+// Reweigh returns pi with the capacity of the peers in b, and whether any of
+// them changed. The peers of pi are copied rather than changed.
+func (pi PeerInfoList) Reweigh(b PeerInfoList) (PeerInfoList, bool) {
+	var out PeerInfoList
+	changed := false
+	for _, x := range pi {
+		for _, y := range b {
+			if y.UUID == x.UUID && y.TotalBlocks != x.TotalBlocks {
+				c := *x
+				c.TotalBlocks = y.TotalBlocks
+				x = &c
+				changed = true
+			}
+		}
+		out = append(out, x)
+	}
+	return out, changed
+}
+
 func (pi PeerInfoList) Intersect(b PeerInfoList) PeerInfoList {
 	var out PeerInfoList
 	for _, x := range pi {
@@ -144,6 +183,19 @@ func (pi PeerInfoList) PeerList() PeerList {
 	return PeerList(out)
 }
 
+// Storing returns the peers that store data, leaving out witnesses: peers
+// that are members of the ring but have no capacity, and so are never given
+// blocks.
+func (pi PeerInfoList) Storing() PeerInfoList {
+	var out PeerInfoList
+	for _, x := range pi {
+		if x.TotalBlocks != 0 {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
 func (pi PeerInfoList) GetWeights() map[string]int {
 	out := make(map[string]int)
 	if len(pi) == 0 {
@@ -159,3 +211,156 @@ func (pi PeerInfoList) GetWeights() map[string]int {
 	}
 	return out
 }
+
+// EvictPeer removes the peer from the ring right away, without waiting for it
+// to time out or be drained, retrying while other nodes change the ring at the
+// same time. It returns the ring the peer was removed from. Blocks the peer
+// held are under-replicated until a rebalance copies them elsewhere, and lost
+// if it held the only copy.
+func EvictPeer(mds MetadataService, uuid string) (Ring, error) {
+	for {
+		r, err := mds.GetRing()
+		if err != nil {
+			return nil, err
+		}
+		if !r.Members().Has(uuid) {
+			return nil, ErrNoPeer
+		}
+		rr, ok := r.(RingRemover)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		newRing, err := rr.RemovePeers(PeerList{uuid})
+		if err != nil {
+			return nil, err
+		}
+		err = mds.SetRing(newRing)
+		if err == ErrNonSequentialRing || err == ErrAgain {
+			clog.Debugf("ring changed while evicting %s, trying again: %v", uuid, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// DrainPeer marks a member of the ring as draining, or stops draining it if
+// drain is false, and returns the ring it replaced.
+func DrainPeer(mds MetadataService, uuid string, drain bool) (Ring, error) {
+	for {
+		r, err := mds.GetRing()
+		if err != nil {
+			return nil, err
+		}
+		if !r.Members().Has(uuid) {
+			return nil, ErrNoPeer
+		}
+		rd, ok := r.(RingDrainer)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		draining := rd.Draining()
+		if drain == draining.Has(uuid) {
+			return nil, ErrExists
+		}
+		if drain {
+			draining = draining.Union(PeerList{uuid})
+		} else {
+			draining = draining.AndNot(PeerList{uuid})
+		}
+		newRing, err := rd.SetDraining(draining)
+		if err != nil {
+			return nil, err
+		}
+		err = mds.SetRing(newRing)
+		if err == ErrNonSequentialRing || err == ErrAgain {
+			clog.Debugf("ring changed while draining %s, trying again: %v", uuid, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// ReweighPeer sets the capacity a member of the ring is weighted by to
+// totalBlocks, and returns the ring it replaced. Rings that don't weigh their
+// members return ErrNotSupported, and ErrExists is returned if the member
+// already has that capacity.
+func ReweighPeer(mds MetadataService, uuid string, totalBlocks uint64) (Ring, error) {
+	for {
+		r, err := mds.GetRing()
+		if err != nil {
+			return nil, err
+		}
+		if !r.Members().Has(uuid) {
+			return nil, ErrNoPeer
+		}
+		rw, ok := r.(RingReweigher)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		newRing, err := rw.Reweigh(PeerInfoList{{UUID: uuid, TotalBlocks: totalBlocks}})
+		if err != nil {
+			return nil, err
+		}
+		err = mds.SetRing(newRing)
+		if err == ErrNonSequentialRing || err == ErrAgain {
+			clog.Debugf("ring changed while reweighing %s, trying again: %v", uuid, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// DefaultRingHistory is how many of the last rings set on a cluster its
+// metadata service keeps, unless configured otherwise.
+const DefaultRingHistory = 10
+
+// RingHistoryEntry is a ring set on the cluster, as kept in its ring history.
+type RingHistoryEntry struct {
+	Version int `json:"version"`
+	// Ring is the ring, marshaled.
+	Ring []byte `json:"ring"`
+	// Time is when the ring was set, and Client the UUID of the metadata
+	// client that set it. Both are zero for a ring set before the history
+	// was kept.
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	// Message is the note the ring was set with, if any.
+	Message string `json:"message,omitempty"`
+}
+
+// RingHistorian is implemented by MetadataServices that keep the last rings
+// set on the cluster, so that a bad ring change can be rolled back.
+type RingHistorian interface {
+	// SetRingWithMessage is SetRing, recording message in the history
+	// along with the ring.
+	SetRingWithMessage(ring Ring, message string) error
+	// RingHistory returns the rings kept, oldest first.
+	RingHistory() ([]RingHistoryEntry, error)
+}
+
+// SetRingWithMessage sets the ring through mds, recording message with it if
+// mds keeps a ring history.
+func SetRingWithMessage(mds MetadataService, r Ring, message string) error {
+	if h, ok := mds.(RingHistorian); ok {
+		return h.SetRingWithMessage(r, message)
+	}
+	return mds.SetRing(r)
+}
+
+// RingHistoryToKeep returns how many rings a metadata service configured
+// with cfg keeps in its history.
+func RingHistoryToKeep(cfg Config) int {
+	if cfg.RingHistory <= 0 {
+		return DefaultRingHistory
+	}
+	return cfg.RingHistory
+}
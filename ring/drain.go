@@ -0,0 +1,72 @@
+package ring
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+const drainingAttr = "draining"
+
+// WithDraining records the peers a ring is draining in its description.
+func WithDraining(r *models.Ring, draining torus.PeerList) *models.Ring {
+	if len(draining) == 0 {
+		return r
+	}
+	if r.Attrs == nil {
+		r.Attrs = make(map[string][]byte)
+	}
+	r.Attrs[drainingAttr] = []byte(strings.Join(draining, ","))
+	return r
+}
+
+func drainingFromRing(r *models.Ring) torus.PeerList {
+	b, ok := r.Attrs[drainingAttr]
+	if !ok || len(b) == 0 {
+		return nil
+	}
+	return torus.PeerList(strings.Split(string(b), ","))
+}
+
+// checkDraining checks that draining leaves enough of the peers storing data
+// to hold every replica.
+func checkDraining(peers torus.PeerInfoList, draining torus.PeerList, rep int) error {
+	members := peers.PeerList()
+	for _, p := range draining {
+		if !members.Has(p) {
+			return fmt.Errorf("ring: can't drain %s, which isn't in the ring", p)
+		}
+	}
+	left := len(peers.Storing().PeerList().AndNot(draining))
+	if left < rep {
+		return fmt.Errorf("ring: draining %d peers would leave %d storing data, fewer than the replication level of %d", len(draining), left, rep)
+	}
+	return nil
+}
+
+// drainLast moves the draining peers of perm past its replicas, keeping the
+// order of the rest, so that the next peers in line take their place.
+func drainLast(perm torus.PeerPermutation, draining torus.PeerList) torus.PeerPermutation {
+	if len(draining) == 0 {
+		return perm
+	}
+	out := make(torus.PeerList, 0, len(perm.Peers))
+	var last torus.PeerList
+	for _, p := range perm.Peers {
+		if draining.Has(p) {
+			last = append(last, p)
+		} else {
+			out = append(out, p)
+		}
+	}
+	rep := perm.Replication
+	if rep > len(out) {
+		rep = len(out)
+	}
+	return torus.PeerPermutation{
+		Peers:       append(out, last...),
+		Replication: rep,
+	}
+}
@@ -0,0 +1,79 @@
+package ring
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+func TestDrainPeers(t *testing.T) {
+	for _, typ := range []torus.RingType{Ketama, Mod} {
+		r, err := CreateRing(&models.Ring{
+			Type:              uint32(typ),
+			Peers:             makeEvenPeers(4),
+			ReplicationFactor: 2,
+			Version:           1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr, err := r.(torus.RingDrainer).SetDraining(torus.PeerList{"peer-0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dr.Version() != 2 {
+			t.Fatalf("expected version 2, got %d", dr.Version())
+		}
+		b, err := dr.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr, err = Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dr.(torus.RingDrainer).Draining(); !reflect.DeepEqual(got, torus.PeerList{"peer-0"}) {
+			t.Fatalf("expected draining to survive marshaling, got %v", got)
+		}
+		for i := 0; i < 256; i++ {
+			ref := torus.BlockRef{
+				INodeRef: torus.NewINodeRef(1, torus.INodeID(i/64)),
+				Index:    torus.IndexID(i % 64),
+			}
+			before, err := r.GetPeers(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := dr.GetPeers(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Replication != 2 {
+				t.Fatalf("expected replication 2, got %d", after.Replication)
+			}
+			// The draining peer serves reads last, and the next
+			// peers in line take its place.
+			want := append(before.Peers.AndNot(torus.PeerList{"peer-0"}), "peer-0")
+			if !reflect.DeepEqual(after.Peers, want) {
+				t.Fatalf("%v ring: expected %v, got %v", typ, want, after.Peers)
+			}
+		}
+
+		removed, err := dr.(torus.RingRemover).RemovePeers(torus.PeerList{"peer-0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := removed.(torus.RingDrainer).Draining(); len(d) != 0 {
+			t.Fatalf("expected removed peer to stop draining, got %v", d)
+		}
+
+		if _, err := r.(torus.RingDrainer).SetDraining(torus.PeerList{"peer-0", "peer-1", "peer-2"}); err == nil {
+			t.Fatal("expected draining below the replication level to fail")
+		}
+		if _, err := r.(torus.RingDrainer).SetDraining(torus.PeerList{"bogus"}); err == nil {
+			t.Fatal("expected draining a non-member to fail")
+		}
+	}
+}
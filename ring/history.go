@@ -0,0 +1,65 @@
+package ring
+
+import (
+	"fmt"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+// FromHistory returns the ring of version kept in the ring history of mds,
+// renumbered as version next, so that it can be set again.
+func FromHistory(mds torus.MetadataService, version, next int) (torus.Ring, error) {
+	h, ok := mds.(torus.RingHistorian)
+	if !ok {
+		return nil, torus.ErrNotSupported
+	}
+	entries, err := h.RingHistory()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Version != version {
+			continue
+		}
+		var r models.Ring
+		if err := r.Unmarshal(e.Ring); err != nil {
+			return nil, err
+		}
+		if torus.RingType(r.Type) == Union {
+			return nil, fmt.Errorf("ring: version %d is a union ring, which can't be set again", version)
+		}
+		r.Version = uint32(next)
+		return CreateRing(&r)
+	}
+	return nil, torus.ErrNotExist
+}
+
+// Rollback sets the ring of version kept in the ring history of mds again,
+// as the next version of the ring, recording message with it. It retries
+// while other nodes change the ring at the same time, and returns the ring it
+// set. The cluster rebalances onto it as it would onto any new ring.
+func Rollback(mds torus.MetadataService, version int, message string) (torus.Ring, error) {
+	for {
+		cur, err := mds.GetRing()
+		if err != nil {
+			return nil, err
+		}
+		if cur.Version() == version {
+			return nil, torus.ErrExists
+		}
+		r, err := FromHistory(mds, version, cur.Version()+1)
+		if err != nil {
+			return nil, err
+		}
+		err = torus.SetRingWithMessage(mds, r, message)
+		if err == torus.ErrNonSequentialRing || err == torus.ErrAgain {
+			clog.Debugf("ring changed while rolling back to version %d, trying again: %v", version, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
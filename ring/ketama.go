@@ -4,22 +4,28 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/models"
-
-	"github.com/serialx/hashring"
 )
 
 type ketama struct {
-	version int
-	rep     int
-	peers   torus.PeerInfoList
-	ring    *hashring.HashRing
+	version   int
+	rep       int
+	vnodes    int
+	placement int
+	domain    string // the label key of ketama-zones rings
+	draining  torus.PeerList
+	peers     torus.PeerInfoList
+	data      torus.PeerInfoList // the peers that store blocks
+	ring      nodeLocator
+	topo      *topology
 }
 
 func init() {
 	registerRing(Ketama, "ketama", makeKetama)
+	registerRing(KetamaZones, "ketama-zones", makeKetama)
 }
 
 func makeKetama(r *models.Ring) (torus.Ring, error) {
@@ -27,25 +33,67 @@ func makeKetama(r *models.Ring) (torus.Ring, error) {
 	if rep == 0 {
 		rep = 1
 	}
+	vnodes, err := vnodesFromRing(r)
+	if err != nil {
+		return nil, err
+	}
+	placement, err := placementFromRing(r)
+	if err != nil {
+		return nil, err
+	}
+	var domain string
+	if torus.RingType(r.Type) == KetamaZones {
+		domain = string(r.Attrs[domainAttr])
+		if domain == "" {
+			return nil, errors.New("ring: ketama-zones ring has no domain label")
+		}
+	}
 	pi := torus.PeerInfoList(r.Peers)
-	if rep > len(pi) {
-		clog.Noticef("Using ring that requests replication level %d, but has only %d peers. Add nodes to match replication.", rep, len(pi))
+	data := pi.Storing()
+	if rep > len(data) {
+		clog.Noticef("Using ring that requests replication level %d, but has only %d peers storing data. Add nodes to match replication.", rep, len(data))
+	}
+	if domain != "" {
+		checkDomains(data, domain, rep)
 	}
 	return &ketama{
-		version: int(r.Version),
-		peers:   pi,
-		rep:     rep,
-		ring:    hashring.NewWithWeights(pi.GetWeights()),
+		version:   int(r.Version),
+		peers:     pi,
+		data:      data,
+		rep:       rep,
+		vnodes:    vnodes,
+		placement: placement,
+		domain:    domain,
+		draining:  drainingFromRing(r),
+		ring:      newNodeLocator(data.GetWeights(), vnodes, placement),
+		topo:      newTopology(data, domain),
 	}, nil
 }
 
+// checkDomains warns when a ketama-zones ring can't keep every replica in a
+// domain of its own.
+func checkDomains(data torus.PeerInfoList, domain string, rep int) {
+	domains := make(map[string]bool)
+	for _, p := range data {
+		d, ok := p.Labels[domain]
+		if !ok {
+			clog.Noticef("peer %s has no %s label; it counts as a domain of its own", p.UUID, domain)
+			d = "peer:" + p.UUID
+		}
+		domains[d] = true
+	}
+	if len(domains) < rep {
+		clog.Noticef("ring spreads replicas by %s, but has only %d of them for replication level %d; some blocks will have replicas in the same %s", domain, len(domains), rep, domain)
+	}
+}
+
 func (k *ketama) GetPeers(key torus.BlockRef) (torus.PeerPermutation, error) {
-	s, ok := k.ring.GetNodes(string(key.ToBytes()), len(k.peers))
+	s, ok := k.ring.GetNodes(string(key.ToBytes()), len(k.data))
 	if !ok {
 		if len(s) == 0 {
 			return torus.PeerPermutation{}, errors.New("couldn't get any nodes")
 		}
-		for _, x := range k.peers {
+		for _, x := range k.data {
 			has := false
 			for _, y := range s {
 				if y == x.UUID {
@@ -59,32 +107,52 @@ func (k *ketama) GetPeers(key torus.BlockRef) (torus.PeerPermutation, error) {
 		}
 	}
 
-	if len(s) != len(k.peers) {
+	if len(s) != len(k.data) {
 		return torus.PeerPermutation{}, errors.New("couldn't get sufficient nodes")
 	}
 
 	rep := k.rep
-	if len(k.peers) < k.rep {
-		rep = len(k.peers)
+	if len(k.data) < k.rep {
+		rep = len(k.data)
 	}
 
-	return torus.PeerPermutation{
+	return drainLast(k.topo.spread(torus.PeerPermutation{
 		Peers:       s,
 		Replication: rep,
-	}, nil
+	}), k.draining), nil
 }
 
 func (k *ketama) Members() torus.PeerList { return k.peers.PeerList() }
 
 func (k *ketama) Describe() string {
-	s := fmt.Sprintf("Ring: Ketama\nReplication:%d\nPeers:", k.rep)
+	s := "Ring: Ketama\n"
+	if k.domain != "" {
+		s = fmt.Sprintf("Ring: KetamaZones\nDomain:%s\n", k.domain)
+	}
+	s += fmt.Sprintf("Replication:%d\n", k.rep)
+	if k.vnodes != 0 {
+		s += fmt.Sprintf("VNodes:%d\n", k.vnodes)
+	}
+	if k.placement != PlacementLegacy {
+		s += fmt.Sprintf("Placement:%d\n", k.placement)
+	}
+	if len(k.draining) != 0 {
+		s += fmt.Sprintf("Draining:%s\n", strings.Join(k.draining, ","))
+	}
+	s += "Peers:"
 	for _, x := range k.peers {
 		s += fmt.Sprintf("\n\t%s", x)
 	}
 	return s
 }
-func (k *ketama) Type() torus.RingType { return Ketama }
-func (k *ketama) Version() int         { return k.version }
+func (k *ketama) Type() torus.RingType {
+	if k.domain != "" {
+		return KetamaZones
+	}
+	return Ketama
+}
+
+func (k *ketama) Version() int { return k.version }
 
 func (k *ketama) Marshal() ([]byte, error) {
 	var out models.Ring
@@ -93,6 +161,12 @@ func (k *ketama) Marshal() ([]byte, error) {
 	out.ReplicationFactor = uint32(k.rep)
 	out.Type = uint32(k.Type())
 	out.Peers = k.peers
+	WithVNodes(&out, k.vnodes)
+	WithPlacement(&out, k.placement)
+	if k.domain != "" {
+		WithDomain(&out, k.domain)
+	}
+	WithDraining(&out, k.draining)
 	return out.Marshal()
 }
 
@@ -102,10 +176,16 @@ func (k *ketama) AddPeers(peers torus.PeerInfoList) (torus.Ring, error) {
 		return nil, torus.ErrExists
 	}
 	newk := &ketama{
-		version: k.version + 1,
-		rep:     k.rep,
-		peers:   newPeers,
-		ring:    hashring.NewWithWeights(newPeers.GetWeights()),
+		version:   k.version + 1,
+		rep:       k.rep,
+		vnodes:    k.vnodes,
+		placement: k.placement,
+		domain:    k.domain,
+		draining:  k.draining,
+		peers:     newPeers,
+		data:      newPeers.Storing(),
+		ring:      newNodeLocator(newPeers.Storing().GetWeights(), k.vnodes, k.placement),
+		topo:      newTopology(newPeers.Storing(), k.domain),
 	}
 	return newk, nil
 }
@@ -117,20 +197,73 @@ func (k *ketama) RemovePeers(pl torus.PeerList) (torus.Ring, error) {
 	}
 
 	newk := &ketama{
-		version: k.version + 1,
-		rep:     k.rep,
-		peers:   newPeers,
-		ring:    hashring.NewWithWeights(newPeers.GetWeights()),
+		version:   k.version + 1,
+		rep:       k.rep,
+		vnodes:    k.vnodes,
+		placement: k.placement,
+		domain:    k.domain,
+		draining:  k.draining.AndNot(pl),
+		peers:     newPeers,
+		data:      newPeers.Storing(),
+		ring:      newNodeLocator(newPeers.Storing().GetWeights(), k.vnodes, k.placement),
+		topo:      newTopology(newPeers.Storing(), k.domain),
+	}
+	return newk, nil
+}
+
+func (k *ketama) Reweigh(peers torus.PeerInfoList) (torus.Ring, error) {
+	newPeers, changed := k.peers.Reweigh(peers)
+	if !changed {
+		return nil, torus.ErrExists
+	}
+	newk := &ketama{
+		version:   k.version + 1,
+		rep:       k.rep,
+		vnodes:    k.vnodes,
+		placement: k.placement,
+		domain:    k.domain,
+		draining:  k.draining,
+		peers:     newPeers,
+		data:      newPeers.Storing(),
+		ring:      newNodeLocator(newPeers.Storing().GetWeights(), k.vnodes, k.placement),
+		topo:      newTopology(newPeers.Storing(), k.domain),
 	}
 	return newk, nil
 }
 
 func (k *ketama) ChangeReplication(r int) (torus.Ring, error) {
 	newk := &ketama{
-		version: k.version + 1,
-		rep:     r,
-		peers:   k.peers,
-		ring:    k.ring,
+		version:   k.version + 1,
+		rep:       r,
+		vnodes:    k.vnodes,
+		placement: k.placement,
+		domain:    k.domain,
+		draining:  k.draining,
+		peers:     k.peers,
+		data:      k.data,
+		ring:      k.ring,
+		topo:      k.topo,
+	}
+	return newk, nil
+}
+
+func (k *ketama) Draining() torus.PeerList { return k.draining }
+
+func (k *ketama) SetDraining(draining torus.PeerList) (torus.Ring, error) {
+	if err := checkDraining(k.peers, draining, k.rep); err != nil {
+		return nil, err
+	}
+	newk := &ketama{
+		version:   k.version + 1,
+		rep:       k.rep,
+		vnodes:    k.vnodes,
+		placement: k.placement,
+		domain:    k.domain,
+		draining:  draining,
+		peers:     k.peers,
+		data:      k.data,
+		ring:      k.ring,
+		topo:      k.topo,
 	}
 	return newk, nil
 }
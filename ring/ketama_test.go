@@ -28,6 +28,7 @@ func makeTinyPeers(t *testing.T) torus.Ring {
 	return &ketama{
 		version: 1,
 		peers:   pi,
+		data:    pi,
 		rep:     2,
 		ring:    hashring.NewWithWeights(pi.GetWeights()),
 	}
@@ -92,3 +93,25 @@ func TestChangeReplication(t *testing.T) {
 		t.Fatalf("Got wrong replications")
 	}
 }
+
+func TestReweigh(t *testing.T) {
+	k := makeTinyPeers(t).(torus.RingReweigher)
+	if _, err := k.Reweigh(torus.PeerInfoList{{UUID: "a", TotalBlocks: 20 * 1024 * 1024 * 2}}); err != torus.ErrExists {
+		t.Fatalf("expected reweighing to the same capacity to change nothing, got %v", err)
+	}
+	newk, err := k.Reweigh(torus.PeerInfoList{{UUID: "c", TotalBlocks: 20 * 1024 * 1024 * 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newk.Version() != 2 {
+		t.Fatalf("Faild to update version to %d, expected %d", newk.Version(), 2)
+	}
+	for _, p := range newk.(*ketama).peers {
+		if p.TotalBlocks != 20*1024*1024*2 {
+			t.Fatalf("expected every peer to have the same capacity, got %d for %s", p.TotalBlocks, p.UUID)
+		}
+	}
+	if k.(*ketama).peers[2].TotalBlocks != 100*1024*2 {
+		t.Fatal("expected the old ring to be left as it was")
+	}
+}
@@ -5,15 +5,19 @@ import (
 	"hash/crc32"
 	"reflect"
 	"sort"
+	"strings"
 
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/models"
 )
 
 type mod struct {
-	version int
-	rep     int
-	peers   torus.PeerInfoList
+	version  int
+	rep      int
+	peers    torus.PeerInfoList
+	data     torus.PeerInfoList // the peers that store blocks
+	draining torus.PeerList
+	topo     *topology
 }
 
 func init() {
@@ -26,43 +30,51 @@ func makeMod(r *models.Ring) (torus.Ring, error) {
 		rep = 1
 	}
 	pil := torus.PeerInfoList(r.Peers)
-	if rep > len(pil) {
-		clog.Noticef("Requested replication level %d, but has only %d peers. Add nodes to match replication.", rep, len(pil))
+	data := pil.Storing()
+	if rep > len(data) {
+		clog.Noticef("Requested replication level %d, but has only %d peers storing data. Add nodes to match replication.", rep, len(data))
 	}
 	return &mod{
-		version: int(r.Version),
-		peers:   pil,
-		rep:     rep,
+		version:  int(r.Version),
+		peers:    pil,
+		data:     data,
+		draining: drainingFromRing(r),
+		rep:      rep,
+		topo:     newTopology(data, ""),
 	}, nil
 }
 
 func (m *mod) GetPeers(key torus.BlockRef) (torus.PeerPermutation, error) {
-	peerlist := sort.StringSlice([]string(m.peers.PeerList()))
+	peerlist := sort.StringSlice([]string(m.data.PeerList()))
 	if len(peerlist) == 0 {
 		return torus.PeerPermutation{}, fmt.Errorf("couldn't get any nodes")
 	}
-	if len(peerlist) != len(m.peers) {
+	if len(peerlist) != len(m.data) {
 		return torus.PeerPermutation{}, fmt.Errorf("couldn't get sufficient nodes")
 	}
 	permute := make([]string, len(peerlist))
 	crc := crc32.ChecksumIEEE(key.ToBytes())
-	sum := int(crc) % len(m.peers)
+	sum := int(crc) % len(m.data)
 	copy(permute, peerlist[sum:])
 	copy(permute[len(peerlist)-sum:], peerlist[:sum])
 	rep := m.rep
-	if len(m.peers) < m.rep {
-		rep = len(m.peers)
+	if len(m.data) < m.rep {
+		rep = len(m.data)
 	}
-	return torus.PeerPermutation{
+	return drainLast(m.topo.spread(torus.PeerPermutation{
 		Peers:       permute,
 		Replication: rep,
-	}, nil
+	}), m.draining), nil
 }
 
 func (m *mod) Members() torus.PeerList { return m.peers.PeerList() }
 
 func (m *mod) Describe() string {
-	s := fmt.Sprintf("Ring: Mod\nReplication:%d\nPeers:", m.rep)
+	s := fmt.Sprintf("Ring: Mod\nReplication:%d\n", m.rep)
+	if len(m.draining) != 0 {
+		s += fmt.Sprintf("Draining:%s\n", strings.Join(m.draining, ","))
+	}
+	s += "Peers:"
 	for _, x := range m.peers {
 		s += fmt.Sprintf("\n\t%s", x)
 	}
@@ -78,6 +90,7 @@ func (m *mod) Marshal() ([]byte, error) {
 	out.ReplicationFactor = uint32(m.rep)
 	out.Type = uint32(m.Type())
 	out.Peers = m.peers
+	WithDraining(&out, m.draining)
 	return out.Marshal()
 }
 
@@ -87,9 +100,12 @@ func (m *mod) AddPeers(peers torus.PeerInfoList) (torus.Ring, error) {
 		return nil, torus.ErrExists
 	}
 	newm := &mod{
-		version: m.version + 1,
-		rep:     m.rep,
-		peers:   newPeers,
+		version:  m.version + 1,
+		rep:      m.rep,
+		peers:    newPeers,
+		data:     newPeers.Storing(),
+		draining: m.draining,
+		topo:     newTopology(newPeers.Storing(), ""),
 	}
 	return newm, nil
 }
@@ -101,18 +117,41 @@ func (m *mod) RemovePeers(pl torus.PeerList) (torus.Ring, error) {
 	}
 
 	newm := &mod{
-		version: m.version + 1,
-		rep:     m.rep,
-		peers:   newPeers,
+		version:  m.version + 1,
+		rep:      m.rep,
+		peers:    newPeers,
+		data:     newPeers.Storing(),
+		draining: m.draining.AndNot(pl),
+		topo:     newTopology(newPeers.Storing(), ""),
 	}
 	return newm, nil
 }
 
 func (m *mod) ChangeReplication(r int) (torus.Ring, error) {
 	newm := &mod{
-		version: m.version + 1,
-		rep:     r,
-		peers:   m.peers,
+		version:  m.version + 1,
+		rep:      r,
+		peers:    m.peers,
+		data:     m.data,
+		draining: m.draining,
+		topo:     m.topo,
+	}
+	return newm, nil
+}
+
+func (m *mod) Draining() torus.PeerList { return m.draining }
+
+func (m *mod) SetDraining(draining torus.PeerList) (torus.Ring, error) {
+	if err := checkDraining(m.peers, draining, m.rep); err != nil {
+		return nil, err
+	}
+	newm := &mod{
+		version:  m.version + 1,
+		rep:      m.rep,
+		peers:    m.peers,
+		data:     m.data,
+		draining: draining,
+		topo:     m.topo,
 	}
 	return newm, nil
 }
@@ -0,0 +1,200 @@
+package ring
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/alternative-storage/torus"
+)
+
+// ChangePreview estimates what replacing a ring with another would do to
+// the blocks of the cluster. The counts are for every block the preview was
+// made for, scaled up from the ones examined if it was made from a sample.
+type ChangePreview struct {
+	// Total is the number of blocks the preview is for, and Examined the
+	// number of them looked at.
+	Total    int `json:"total"`
+	Examined int `json:"examined"`
+	// Moving is the number of blocks that gain a replica on a peer not
+	// holding them, and Copies the number of replicas made.
+	Moving int `json:"moving"`
+	Copies int `json:"copies"`
+	// Moves counts the replicas copied from each peer to each other one.
+	Moves []PeerMove `json:"moves,omitempty"`
+	// Peers counts the replicas each peer gains and drops.
+	Peers []PeerChange `json:"peers,omitempty"`
+	// UnderReplicated is the number of blocks the new ring keeps fewer
+	// replicas of than the old one, as when it lowers replication or has
+	// too few peers storing data for it.
+	UnderReplicated int `json:"under_replicated"`
+	// Exposed is the number of blocks with fewer replicas than the new
+	// replication factor on the peers serving them while the cluster
+	// rebalances, which reads them from the old replicas first.
+	Exposed int `json:"exposed"`
+	// Relocated is the number of blocks every replica of which moves.
+	Relocated int `json:"relocated"`
+	// Warnings describe what makes the change dangerous, if anything.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// PeerMove is a number of replicas copied from one peer to another. From is
+// empty for blocks no peer held before.
+type PeerMove struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Blocks int    `json:"blocks"`
+}
+
+// PeerChange is the number of replicas a peer gains and drops.
+type PeerChange struct {
+	UUID    string `json:"uuid"`
+	Gained  int    `json:"gained"`
+	Dropped int    `json:"dropped"`
+}
+
+// PreviewChange estimates the blocks of refs moved by replacing oldRing with
+// newRing, and flags the blocks the change leaves with fewer replicas than it
+// should. If sample is positive and smaller than the number of refs, only
+// that many, spread evenly, are examined. Peers not in up are taken to hold
+// nothing; a nil up takes every peer to be.
+func PreviewChange(oldRing, newRing torus.Ring, refs []torus.BlockRef, sample int, up torus.PeerList) (*ChangePreview, error) {
+	if sample <= 0 || sample > len(refs) {
+		sample = len(refs)
+	}
+	union := NewUnionRing(oldRing, newRing)
+	moves := make(map[PeerMove]int)
+	gained := make(map[string]int)
+	dropped := make(map[string]int)
+	p := &ChangePreview{Total: len(refs), Examined: sample}
+	oldRep, newRep := 0, 0
+	for i := 0; i < sample; i++ {
+		ref := refs[i*len(refs)/sample]
+		o, err := oldRing.GetPeers(ref)
+		if err != nil {
+			return nil, err
+		}
+		n, err := newRing.GetPeers(ref)
+		if err != nil {
+			return nil, err
+		}
+		u, err := union.GetPeers(ref)
+		if err != nil {
+			return nil, err
+		}
+		if o.Replication > oldRep {
+			oldRep = o.Replication
+		}
+		if n.Replication > newRep {
+			newRep = n.Replication
+		}
+		before, after := replicas(o), replicas(n)
+		dests := after.AndNot(before)
+		leaving := before.AndNot(after)
+		if len(dests) != 0 {
+			p.Moving++
+			p.Copies += len(dests)
+		}
+		for j, to := range dests {
+			// Rebalancing pairs the peers taking up a block with
+			// those giving it up where it can.
+			from := ""
+			switch {
+			case j < len(leaving):
+				from = leaving[j]
+			case len(before) != 0:
+				from = before[0]
+			}
+			moves[PeerMove{From: from, To: to}]++
+			gained[to]++
+		}
+		for _, peer := range leaving {
+			dropped[peer]++
+		}
+		if len(after) < len(before) {
+			p.UnderReplicated++
+		}
+		if len(before) != 0 && len(before.Intersect(after)) == 0 {
+			p.Relocated++
+		}
+		held := replicas(u).Intersect(before)
+		if up != nil {
+			held = held.Intersect(up)
+		}
+		if len(before) != 0 && len(held) < n.Replication {
+			p.Exposed++
+		}
+	}
+
+	scale := func(c int) int {
+		if sample == 0 || sample == len(refs) {
+			return c
+		}
+		return int(float64(c)*float64(len(refs))/float64(sample) + 0.5)
+	}
+	p.Moving, p.Copies = scale(p.Moving), scale(p.Copies)
+	p.UnderReplicated, p.Exposed, p.Relocated = scale(p.UnderReplicated), scale(p.Exposed), scale(p.Relocated)
+	for m, c := range moves {
+		m.Blocks = scale(c)
+		p.Moves = append(p.Moves, m)
+	}
+	sort.Sort(peerMoves(p.Moves))
+	for _, peer := range torus.PeerList(keys(gained)).Union(keys(dropped)) {
+		p.Peers = append(p.Peers, PeerChange{
+			UUID:    peer,
+			Gained:  scale(gained[peer]),
+			Dropped: scale(dropped[peer]),
+		})
+	}
+	sort.Sort(peerChanges(p.Peers))
+
+	if oldRing.Type() != newRing.Type() && oldRing.Type() != Empty {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("the ring type changes from %s to %s, which places most blocks anew", RingTypeName(oldRing.Type()), RingTypeName(newRing.Type())))
+	}
+	if newRep < oldRep {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("replication drops from %d to %d", oldRep, newRep))
+	}
+	if p.UnderReplicated != 0 {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%d blocks keep fewer replicas in the new ring than they have now", p.UnderReplicated))
+	}
+	if p.Exposed != 0 {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%d blocks have fewer than %d replicas on the peers serving them until rebalancing copies them", p.Exposed, newRep))
+	}
+	if p.Relocated != 0 {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%d blocks move every replica, and are read only from peers giving them up until they are copied", p.Relocated))
+	}
+	return p, nil
+}
+
+// replicas returns the peers of perm holding a replica.
+func replicas(perm torus.PeerPermutation) torus.PeerList {
+	if perm.Replication < len(perm.Peers) {
+		return perm.Peers[:perm.Replication]
+	}
+	return perm.Peers
+}
+
+func keys(m map[string]int) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type peerMoves []PeerMove
+
+func (m peerMoves) Len() int      { return len(m) }
+func (m peerMoves) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m peerMoves) Less(i, j int) bool {
+	if m[i].From != m[j].From {
+		return m[i].From < m[j].From
+	}
+	return m[i].To < m[j].To
+}
+
+type peerChanges []PeerChange
+
+func (c peerChanges) Len() int           { return len(c) }
+func (c peerChanges) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c peerChanges) Less(i, j int) bool { return c[i].UUID < c[j].UUID }
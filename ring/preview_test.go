@@ -0,0 +1,154 @@
+package ring
+
+import (
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+func previewRefs(n int) []torus.BlockRef {
+	refs := make([]torus.BlockRef, n)
+	for i := range refs {
+		refs[i] = torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, torus.INodeID(i/64+1)),
+			Index:    torus.IndexID(i % 64),
+		}
+	}
+	return refs
+}
+
+func TestPreviewAddPeer(t *testing.T) {
+	r, err := CreateRing(&models.Ring{
+		Type:              uint32(Ketama),
+		Peers:             makeEvenPeers(4),
+		ReplicationFactor: 2,
+		Version:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := previewRefs(1024)
+
+	p, err := PreviewChange(r, r, refs, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Moving != 0 || p.Copies != 0 || len(p.Warnings) != 0 {
+		t.Fatalf("expected nothing to move with the same ring, got %+v", p)
+	}
+
+	added, err := r.(torus.RingAdder).AddPeers(torus.PeerInfoList{&models.PeerInfo{
+		UUID:        "peer-4",
+		TotalBlocks: 1024,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = PreviewChange(r, added, refs, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Total != 1024 || p.Examined != 1024 {
+		t.Fatalf("expected every block examined, got %d of %d", p.Examined, p.Total)
+	}
+	if p.Moving == 0 || p.Moving == p.Total {
+		t.Fatalf("expected some but not all blocks to move, got %d", p.Moving)
+	}
+	// Only the new peer takes up blocks, and it gets about its share.
+	copies := 0
+	for _, m := range p.Moves {
+		if m.To != "peer-4" || m.From == "" {
+			t.Fatalf("unexpected move %+v", m)
+		}
+		copies += m.Blocks
+	}
+	if copies != p.Copies {
+		t.Fatalf("expected moves to add up to %d copies, got %d", p.Copies, copies)
+	}
+	if p.Copies < 2*1024/5/2 || p.Copies > 2*1024/5*2 {
+		t.Fatalf("expected about a fifth of the replicas to move, got %d", p.Copies)
+	}
+	if len(p.Warnings) != 0 {
+		t.Fatalf("expected adding a peer to be safe, got %v", p.Warnings)
+	}
+
+	// A sample scales up to about the same.
+	s, err := PreviewChange(r, added, refs, 256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Examined != 256 || s.Total != 1024 {
+		t.Fatalf("expected 256 of 1024 blocks examined, got %d of %d", s.Examined, s.Total)
+	}
+	if s.Copies < p.Copies/2 || s.Copies > p.Copies*2 {
+		t.Fatalf("expected the sample to estimate about %d copies, got %d", p.Copies, s.Copies)
+	}
+}
+
+func TestPreviewDangerousChanges(t *testing.T) {
+	r, err := CreateRing(&models.Ring{
+		Type:              uint32(Mod),
+		Peers:             makeEvenPeers(3),
+		ReplicationFactor: 2,
+		Version:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := previewRefs(256)
+
+	one, err := r.(torus.ModifyableRing).ChangeReplication(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := PreviewChange(r, one, refs, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Copies != 0 || p.UnderReplicated != len(refs) || len(p.Warnings) == 0 {
+		t.Fatalf("expected every block to lose a replica, with a warning, got %+v", p)
+	}
+
+	// Left with one peer, the ring can't hold two replicas.
+	single, err := CreateRing(&models.Ring{
+		Type:              uint32(Mod),
+		Peers:             makeEvenPeers(1),
+		ReplicationFactor: 2,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = PreviewChange(r, single, refs, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.UnderReplicated != len(refs) || len(p.Warnings) == 0 {
+		t.Fatalf("expected every block under-replicated, with a warning, got %+v", p)
+	}
+
+	// With a peer down, the blocks it holds are short a replica until
+	// they're copied.
+	more, err := r.(torus.RingAdder).AddPeers(torus.PeerInfoList{&models.PeerInfo{
+		UUID:        "peer-3",
+		TotalBlocks: 1024,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = PreviewChange(r, more, refs, 0, torus.PeerList{"peer-1", "peer-2", "peer-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exposed == 0 {
+		t.Fatalf("expected blocks held by a down peer to be exposed, got %+v", p)
+	}
+	p, err = PreviewChange(r, more, refs, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exposed != 0 {
+		t.Fatalf("expected nothing exposed with every peer up, got %d", p.Exposed)
+	}
+}
@@ -4,6 +4,10 @@
 package ring
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/alternative-storage/torus"
 	"github.com/alternative-storage/torus/models"
 	"github.com/coreos/pkg/capnslog"
@@ -17,6 +21,7 @@ const (
 	Mod
 	Union
 	Ketama
+	KetamaZones
 )
 
 func Unmarshal(b []byte) (torus.Ring, error) {
@@ -63,3 +68,44 @@ func RingTypeFromString(s string) (torus.RingType, bool) {
 	v, ok := ringNames[s]
 	return v, ok
 }
+
+// RingTypeName returns the name a ring type is registered under, the reverse
+// of RingTypeFromString.
+func RingTypeName(t torus.RingType) string {
+	for name, v := range ringNames {
+		if v == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+// initTypes are the ring types that can start out without any peers, and so
+// can be created when a cluster is initialized.
+var initTypes = map[torus.RingType]bool{
+	Empty:  true,
+	Mod:    true,
+	Ketama: true,
+}
+
+// InitTypes returns the names of the ring types a cluster can be initialized
+// with.
+func InitTypes() []string {
+	var out []string
+	for name, t := range ringNames {
+		if initTypes[t] {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// InitTypeFromString looks up a ring type a cluster can be initialized with.
+func InitTypeFromString(s string) (torus.RingType, error) {
+	t, ok := ringNames[s]
+	if !ok || !initTypes[t] {
+		return 0, fmt.Errorf("ring: unknown ring type %q (try one of %s)", s, strings.Join(InitTypes(), ", "))
+	}
+	return t, nil
+}
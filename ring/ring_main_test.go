@@ -0,0 +1,44 @@
+package ring
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInitTypes(t *testing.T) {
+	if got, want := InitTypes(), []string{"empty", "ketama", "mod"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected init types %v, got %v", want, got)
+	}
+	rt, err := InitTypeFromString("mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt != Mod {
+		t.Fatalf("expected mod, got %d", rt)
+	}
+	for _, name := range []string{"single", "union", "bogus"} {
+		_, err := InitTypeFromString(name)
+		if err == nil {
+			t.Fatalf("expected %q to be refused", name)
+		}
+		if !strings.Contains(err.Error(), "ketama") {
+			t.Fatalf("expected the error to list the ring types, got %v", err)
+		}
+	}
+}
+
+func TestRingTypeName(t *testing.T) {
+	for _, name := range []string{"empty", "single", "mod", "union", "ketama", "ketama-zones"} {
+		rt, ok := RingTypeFromString(name)
+		if !ok {
+			t.Fatalf("ring type %s not registered", name)
+		}
+		if got := RingTypeName(rt); got != name {
+			t.Errorf("expected name %s for type %d, got %s", name, rt, got)
+		}
+	}
+	if got := RingTypeName(99); got != "unknown(99)" {
+		t.Errorf("expected an unknown type, got %s", got)
+	}
+}
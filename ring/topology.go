@@ -0,0 +1,130 @@
+package ring
+
+import (
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+const domainAttr = "domain"
+
+// WithDomain records the label key a ketama-zones ring keeps the replicas
+// of a block in distinct values of.
+func WithDomain(r *models.Ring, key string) *models.Ring {
+	if r.Attrs == nil {
+		r.Attrs = make(map[string][]byte)
+	}
+	r.Attrs[domainAttr] = []byte(key)
+	return r
+}
+
+// topology holds the zone and rack labels of the peers of a ring, and their
+// values of its domain label, if it has one.
+type topology struct {
+	zone   map[string]string
+	rack   map[string]string
+	domain map[string]string
+}
+
+// newTopology returns nil if none of the peers carry topology labels, in
+// which case placement is left to the ring alone.
+func newTopology(peers torus.PeerInfoList, domain string) *topology {
+	var t *topology
+	for _, p := range peers {
+		d := ""
+		if domain != "" {
+			d = p.Labels[domain]
+		}
+		if p.Zone == "" && p.Rack == "" && d == "" {
+			continue
+		}
+		if t == nil {
+			t = &topology{
+				zone: make(map[string]string),
+				rack: make(map[string]string),
+			}
+		}
+		if d != "" {
+			if t.domain == nil {
+				t.domain = make(map[string]string)
+			}
+			t.domain[p.UUID] = d
+		}
+		if p.Zone != "" {
+			t.zone[p.UUID] = p.Zone
+		}
+		if p.Rack != "" {
+			// Racks are only unique within a zone.
+			t.rack[p.UUID] = p.Zone + "/" + p.Rack
+		}
+	}
+	return t
+}
+
+// spread reorders a permutation so that its replicas land in distinct
+// domains, if the ring has them, then distinct zones, then distinct racks,
+// before falling back to the ring's own order. As long as there are as many
+// domains as replicas, no two replicas share one. Peers
+// keep their relative order within each preference level, and peers past the
+// replicas keep the ring's order, so the result is as stable as the ring.
+// A peer without a label never conflicts with another.
+func (t *topology) spread(perm torus.PeerPermutation) torus.PeerPermutation {
+	if t == nil || perm.Replication <= 1 {
+		return perm
+	}
+	chosen := make([]string, 0, len(perm.Peers))
+	taken := make(map[string]bool)
+	domains := make(map[string]bool)
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+	fits := []func(p string) bool{
+		func(p string) bool { return !labelUsed(zones, t.zone, p) && !labelUsed(racks, t.rack, p) },
+		func(p string) bool { return !labelUsed(zones, t.zone, p) },
+		func(p string) bool { return !labelUsed(racks, t.rack, p) },
+		func(p string) bool { return true },
+	}
+	if t.domain != nil {
+		var inDomain []func(p string) bool
+		for _, fit := range fits {
+			fit := fit
+			inDomain = append(inDomain, func(p string) bool {
+				return !labelUsed(domains, t.domain, p) && fit(p)
+			})
+		}
+		fits = append(inDomain, fits...)
+	}
+	for _, fit := range fits {
+		for _, p := range perm.Peers {
+			if len(chosen) == perm.Replication {
+				break
+			}
+			if taken[p] || !fit(p) {
+				continue
+			}
+			taken[p] = true
+			chosen = append(chosen, p)
+			if d, ok := t.domain[p]; ok {
+				domains[d] = true
+			}
+			if z, ok := t.zone[p]; ok {
+				zones[z] = true
+			}
+			if r, ok := t.rack[p]; ok {
+				racks[r] = true
+			}
+		}
+	}
+	for _, p := range perm.Peers {
+		if !taken[p] {
+			chosen = append(chosen, p)
+		}
+	}
+	return torus.PeerPermutation{
+		Peers:       chosen,
+		Replication: perm.Replication,
+	}
+}
+
+func labelUsed(set map[string]bool, labels map[string]string, p string) bool {
+	l, ok := labels[p]
+	return ok && set[l]
+}
@@ -0,0 +1,211 @@
+package ring
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+func makeZonedPeers(zones ...string) torus.PeerInfoList {
+	var pi torus.PeerInfoList
+	for i, z := range zones {
+		pi = append(pi, &models.PeerInfo{
+			UUID:        string('a' + rune(i)),
+			TotalBlocks: 1024,
+			Zone:        z,
+		})
+	}
+	return pi
+}
+
+func TestTopologySpreadsZones(t *testing.T) {
+	peers := makeZonedPeers("east", "east", "east", "west", "west")
+	zoneOf := make(map[string]string)
+	for _, p := range peers {
+		zoneOf[p.UUID] = p.Zone
+	}
+	for _, typ := range []torus.RingType{Ketama, Mod} {
+		r, err := CreateRing(&models.Ring{
+			Type:              uint32(typ),
+			Peers:             peers,
+			ReplicationFactor: 2,
+			Version:           1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			perm, err := r.GetPeers(torus.BlockRef{
+				INodeRef: torus.NewINodeRef(1, torus.INodeID(i)),
+				Index:    1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(perm.Peers) != len(peers) {
+				t.Fatalf("expected a permutation of all %d peers, got %v", len(peers), perm.Peers)
+			}
+			if zoneOf[perm.Peers[0]] == zoneOf[perm.Peers[1]] {
+				t.Fatalf("ring type %d put both replicas in zone %s: %v", typ, zoneOf[perm.Peers[0]], perm.Peers)
+			}
+		}
+	}
+}
+
+func TestTopologyUnlabeled(t *testing.T) {
+	peers := makeZonedPeers("", "", "", "")
+	if newTopology(peers, "") != nil {
+		t.Fatal("expected no topology for unlabeled peers")
+	}
+	perm := torus.PeerPermutation{
+		Peers:       torus.PeerList{"c", "a", "d", "b"},
+		Replication: 2,
+	}
+	var topo *topology
+	if out := topo.spread(perm); !reflect.DeepEqual(out, perm) {
+		t.Fatalf("expected permutation to be unchanged, got %v", out)
+	}
+}
+
+func TestTopologyFallsBack(t *testing.T) {
+	// Only two zones for three replicas: the third goes wherever the ring
+	// says, and a different rack is preferred.
+	peers := torus.PeerInfoList{
+		&models.PeerInfo{UUID: "a", Zone: "east", Rack: "1"},
+		&models.PeerInfo{UUID: "b", Zone: "east", Rack: "1"},
+		&models.PeerInfo{UUID: "c", Zone: "east", Rack: "2"},
+		&models.PeerInfo{UUID: "d", Zone: "west", Rack: "1"},
+	}
+	out := newTopology(peers, "").spread(torus.PeerPermutation{
+		Peers:       torus.PeerList{"a", "b", "c", "d"},
+		Replication: 3,
+	})
+	expect := torus.PeerList{"a", "d", "c", "b"}
+	if !reflect.DeepEqual(out.Peers, expect) {
+		t.Fatalf("expected %v, got %v", expect, out.Peers)
+	}
+}
+
+func makeLabeledPeers(key string, values ...string) torus.PeerInfoList {
+	var pi torus.PeerInfoList
+	for i, v := range values {
+		pi = append(pi, &models.PeerInfo{
+			UUID:        string('a' + rune(i)),
+			TotalBlocks: 1024,
+			Labels:      map[string]string{key: v},
+		})
+	}
+	return pi
+}
+
+// domainsOf returns the number of distinct values of key among the
+// replicas of each of n blocks.
+func domainsOf(t *testing.T, r torus.Ring, peers torus.PeerInfoList, key string, n int) []int {
+	label := make(map[string]string)
+	for _, p := range peers {
+		label[p.UUID] = p.Labels[key]
+	}
+	var out []int
+	for i := 0; i < n; i++ {
+		perm, err := r.GetPeers(torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, torus.INodeID(i)),
+			Index:    1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for _, p := range perm.Peers[:perm.Replication] {
+			seen[label[p]] = true
+		}
+		out = append(out, len(seen))
+	}
+	return out
+}
+
+func TestKetamaZones(t *testing.T) {
+	peers := makeLabeledPeers("rack", "r1", "r1", "r1", "r2", "r2", "r3", "r3")
+	r, err := CreateRing(WithDomain(&models.Ring{
+		Type:              uint32(KetamaZones),
+		Peers:             peers,
+		ReplicationFactor: 3,
+		Version:           1,
+	}, "rack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range domainsOf(t, r, peers, "rack", 1000) {
+		if n != 3 {
+			t.Fatalf("block %d has its 3 replicas in %d racks", i, n)
+		}
+	}
+
+	// A plain ketama ring ignores the labels.
+	plain, err := CreateRing(&models.Ring{
+		Type:              uint32(Ketama),
+		Peers:             peers,
+		ReplicationFactor: 3,
+		Version:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := 0
+	for _, n := range domainsOf(t, plain, peers, "rack", 1000) {
+		if n != 3 {
+			shared++
+		}
+	}
+	if shared == 0 {
+		t.Fatal("expected a plain ketama ring to put some replicas in the same rack")
+	}
+
+	// The domain survives adding peers and marshaling.
+	r, err = r.(torus.RingAdder).AddPeers(torus.PeerInfoList{
+		&models.PeerInfo{UUID: "z", TotalBlocks: 1024, Labels: map[string]string{"rack": "r4"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type() != KetamaZones || r.(*ketama).domain != "rack" {
+		t.Fatalf("expected a ketama-zones ring by rack, got type %d by %q", r.Type(), r.(*ketama).domain)
+	}
+
+	_, err = CreateRing(&models.Ring{
+		Type:    uint32(KetamaZones),
+		Version: 1,
+	})
+	if err == nil {
+		t.Fatal("expected a ketama-zones ring without a domain to be refused")
+	}
+}
+
+func TestKetamaZonesFallsBack(t *testing.T) {
+	// Two racks for three replicas: two are in distinct racks, and the
+	// third shares one.
+	peers := makeLabeledPeers("rack", "r1", "r1", "r1", "r2", "r2")
+	r, err := CreateRing(WithDomain(&models.Ring{
+		Type:              uint32(KetamaZones),
+		Peers:             peers,
+		ReplicationFactor: 3,
+		Version:           1,
+	}, "rack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range domainsOf(t, r, peers, "rack", 1000) {
+		if n != 2 {
+			t.Fatalf("block %d has its 3 replicas in %d racks", i, n)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ring
+
+import (
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+// Transition is the progress of the cluster onto its current ring. A ring
+// change is complete once every peer of the ring that is up has finished a
+// rebalance pass on it, and the cluster isn't on a union ring.
+type Transition struct {
+	RingVersion int `json:"ring_version"`
+	// Union is set while the cluster is still on the union of an old and a
+	// new ring.
+	Union bool `json:"union"`
+	// Started is when the ring was set, if the metadata service keeps a
+	// ring history. It is zero otherwise.
+	Started time.Time `json:"-"`
+	// BlocksRemaining and BytesMoved add up the passes of the peers still
+	// rebalancing, and ETA is the longest of their estimates.
+	BlocksRemaining uint64           `json:"blocks_remaining"`
+	BytesMoved      uint64           `json:"bytes_moved"`
+	ETA             time.Duration    `json:"eta"`
+	Peers           []TransitionPeer `json:"peers"`
+	Done            bool             `json:"done"`
+}
+
+// TransitionPeer is the progress of one peer of the ring. Peers that are
+// down can't finish, and don't hold up the transition.
+type TransitionPeer struct {
+	torus.RebalanceProgress
+	Up   bool `json:"up"`
+	Done bool `json:"done"`
+}
+
+// Pending returns the peers that are up and haven't finished rebalancing
+// onto the ring.
+func (t *Transition) Pending() []TransitionPeer {
+	var out []TransitionPeer
+	for _, p := range t.Peers {
+		if p.Up && !p.Done {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// NewTransition computes the progress onto r of its members, from the
+// rebalance info they last sent in peers. Peers not heard from within
+// timeout of now are taken to be down.
+func NewTransition(r torus.Ring, peers torus.PeerInfoList, timeout time.Duration, now time.Time) *Transition {
+	t := &Transition{
+		RingVersion: r.Version(),
+		Union:       r.Type() == Union,
+		Peers:       []TransitionPeer{},
+	}
+	for _, uuid := range r.Members() {
+		tp := TransitionPeer{RebalanceProgress: torus.RebalanceProgress{UUID: uuid}}
+		if i := peers.UUIDAt(uuid); i != -1 {
+			p := peers[i]
+			seen := time.Unix(0, p.LastSeen)
+			tp.RebalanceProgress = torus.NewRebalanceProgress(uuid, p.RebalanceInfo, seen)
+			tp.Up = p.Address != "" && now.Sub(seen) <= timeout
+			tp.Done = tp.RingVersion >= r.Version() && !tp.Rebalancing
+		}
+		if tp.Up && !tp.Done {
+			t.BlocksRemaining += tp.BlocksRemaining
+			t.BytesMoved += tp.BytesMoved
+			if tp.ETA > t.ETA {
+				t.ETA = tp.ETA
+			}
+		}
+		t.Peers = append(t.Peers, tp)
+	}
+	t.Done = !t.Union && len(t.Pending()) == 0
+	return t
+}
+
+// CurrentTransition returns the progress of the cluster onto the current
+// ring of mds.
+func CurrentTransition(mds torus.MetadataService) (*Transition, error) {
+	r, err := mds.GetRing()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := mds.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	t := NewTransition(r, peers, mds.GlobalMetadata().PeerTimeoutOrDefault(), time.Now())
+	if h, ok := mds.(torus.RingHistorian); ok {
+		entries, err := h.RingHistory()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Version == r.Version() {
+				t.Started = e.Time
+			}
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,72 @@
+package ring
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+func TestTransition(t *testing.T) {
+	peers := makeEvenPeers(3)
+	r, err := CreateRing(&models.Ring{
+		Type:              uint32(Mod),
+		Peers:             peers,
+		ReplicationFactor: 2,
+		Version:           4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, p := range peers {
+		p.Address = "http://" + p.UUID
+		p.LastSeen = now.UnixNano()
+		p.RebalanceInfo = &models.RebalanceInfo{RingVersion: 4}
+	}
+	peers[1].RebalanceInfo = &models.RebalanceInfo{
+		Rebalancing:    true,
+		RebalanceStart: now.Add(-time.Minute).UnixNano(),
+		BlocksTotal:    100,
+		BlocksChecked:  25,
+		BytesMoved:     1000,
+		RingVersion:    3,
+	}
+
+	tr := NewTransition(r, peers, time.Minute, now)
+	if tr.Done || tr.RingVersion != 4 {
+		t.Fatalf("expected version 4 still rebalancing, got %+v", tr)
+	}
+	pending := tr.Pending()
+	if len(pending) != 1 || pending[0].UUID != "peer-1" {
+		t.Fatalf("expected only peer-1 pending, got %+v", pending)
+	}
+	if tr.BlocksRemaining != 75 || tr.BytesMoved != 1000 || tr.ETA != 3*time.Minute {
+		t.Fatalf("expected peer-1's progress, got %d blocks, %d bytes, ETA %v", tr.BlocksRemaining, tr.BytesMoved, tr.ETA)
+	}
+
+	// A peer that is down can't finish, and doesn't hold up the rest.
+	peers[1].LastSeen = now.Add(-time.Hour).UnixNano()
+	tr = NewTransition(r, peers, time.Minute, now)
+	if !tr.Done || tr.Peers[1].Up {
+		t.Fatalf("expected the transition done without the down peer, got %+v", tr)
+	}
+
+	// The cluster isn't done while it's on a union ring.
+	next, err := r.(torus.ModifyableRing).ChangeReplication(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers[1].LastSeen = now.UnixNano()
+	peers[1].RebalanceInfo = &models.RebalanceInfo{RingVersion: 5}
+	for _, p := range peers {
+		p.RebalanceInfo.RingVersion = 5
+	}
+	if tr = NewTransition(next, peers, time.Minute, now); !tr.Done {
+		t.Fatalf("expected version 5 done, got %+v", tr)
+	}
+	if tr = NewTransition(NewUnionRing(r, next), peers, time.Minute, now); tr.Done || !tr.Union {
+		t.Fatalf("expected a union ring not to be done, got %+v", tr)
+	}
+}
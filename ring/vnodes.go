@@ -0,0 +1,201 @@
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/alternative-storage/torus/models"
+	"github.com/serialx/hashring"
+)
+
+// MaxVNodes is the largest number of virtual nodes per peer a ketama ring
+// accepts.
+const MaxVNodes = 4096
+
+const (
+	vnodesAttr    = "vnodes"
+	placementAttr = "placement"
+)
+
+// Ketama placement schemes. The scheme a ring was made with is recorded in
+// it, so that every member places blocks the same way for a given ring
+// version, and members refuse rings made with a scheme newer than they know.
+const (
+	// PlacementLegacy is the placement of rings that don't record one.
+	PlacementLegacy = iota
+	// PlacementCapacity gives each peer virtual nodes in proportion to its
+	// TotalBlocks, enough of them that blocks land close to proportionally.
+	PlacementCapacity
+
+	// CurrentPlacement is the placement new rings are made with.
+	CurrentPlacement = PlacementCapacity
+)
+
+// capacityVNodes is the average number of virtual nodes per peer under
+// PlacementCapacity, for rings that don't set their own.
+const capacityVNodes = 4096
+
+// ValidateVNodes checks a virtual node count before it is fixed in the
+// global metadata. Zero selects the default of the ring's placement scheme.
+func ValidateVNodes(n int) error {
+	if n < 0 || n > MaxVNodes {
+		return fmt.Errorf("ring: virtual node count %d out of range [0, %d]", n, MaxVNodes)
+	}
+	return nil
+}
+
+// WithVNodes records the virtual node count in the ring description, so
+// that every member unmarshaling it builds the same ring.
+func WithVNodes(r *models.Ring, vnodes int) *models.Ring {
+	if vnodes == 0 {
+		return r
+	}
+	if r.Attrs == nil {
+		r.Attrs = make(map[string][]byte)
+	}
+	r.Attrs[vnodesAttr] = []byte(strconv.Itoa(vnodes))
+	return r
+}
+
+// WithPlacement records the placement scheme in the ring description.
+func WithPlacement(r *models.Ring, placement int) *models.Ring {
+	if placement == PlacementLegacy {
+		return r
+	}
+	if r.Attrs == nil {
+		r.Attrs = make(map[string][]byte)
+	}
+	r.Attrs[placementAttr] = []byte(strconv.Itoa(placement))
+	return r
+}
+
+func placementFromRing(r *models.Ring) (int, error) {
+	b, ok := r.Attrs[placementAttr]
+	if !ok {
+		return PlacementLegacy, nil
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, err
+	}
+	if n < PlacementLegacy || n > CurrentPlacement {
+		return 0, fmt.Errorf("ring: unknown placement scheme %d; this node may need upgrading", n)
+	}
+	return n, nil
+}
+
+func vnodesFromRing(r *models.Ring) (int, error) {
+	b, ok := r.Attrs[vnodesAttr]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, err
+	}
+	return n, ValidateVNodes(n)
+}
+
+// nodeLocator finds the distinct nodes responsible for a key, in preference
+// order.
+type nodeLocator interface {
+	GetNodes(key string, size int) ([]string, bool)
+}
+
+func newNodeLocator(weights map[string]int, vnodes, placement int) nodeLocator {
+	if placement == PlacementCapacity {
+		if vnodes == 0 {
+			vnodes = capacityVNodes
+		}
+		// Rounding down would cost small nodes a noticeable part of
+		// their share.
+		return newVNodeRing(weights, vnodes, roundHalf)
+	}
+	if vnodes == 0 {
+		return hashring.NewWithWeights(weights)
+	}
+	return newVNodeRing(weights, vnodes, math.Floor)
+}
+
+func roundHalf(x float64) float64 {
+	return math.Floor(x + 0.5)
+}
+
+// vnodeRing is a consistent hash ring where each node owns a number of
+// points proportional to its weight, averaging vnodes points per node.
+type vnodeRing struct {
+	points []uint32
+	owners map[uint32]string
+	nodes  int
+}
+
+func newVNodeRing(weights map[string]int, vnodes int, round func(float64) float64) *vnodeRing {
+	r := &vnodeRing{
+		owners: make(map[uint32]string),
+		nodes:  len(weights),
+	}
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	// Walk the nodes in a fixed order so that hash collisions resolve the
+	// same way everywhere.
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := 1
+		if total != 0 {
+			n = int(round(float64(vnodes*len(weights)) * float64(weights[name]) / float64(total)))
+		}
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			p := hashKey(name + "-" + strconv.Itoa(i))
+			if _, ok := r.owners[p]; ok {
+				continue
+			}
+			r.owners[p] = name
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Sort(uint32Slice(r.points))
+	return r
+}
+
+func (r *vnodeRing) GetNodes(key string, size int) ([]string, bool) {
+	if size > r.nodes || len(r.points) == 0 {
+		return nil, false
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	out := make([]string, 0, size)
+	seen := make(map[string]bool, size)
+	for i := 0; i < len(r.points) && len(out) < size; i++ {
+		name := r.owners[r.points[(start+i)%len(r.points)]]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	return out, len(out) == size
+}
+
+func hashKey(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,216 @@
+package ring
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+func makeEvenPeers(n int) torus.PeerInfoList {
+	var pi torus.PeerInfoList
+	for i := 0; i < n; i++ {
+		pi = append(pi, &models.PeerInfo{
+			UUID:        fmt.Sprintf("peer-%d", i),
+			TotalBlocks: 1024,
+		})
+	}
+	return pi
+}
+
+// primaryDeviation returns the relative standard deviation of the number of
+// keys each peer is primary for.
+func primaryDeviation(t *testing.T, r torus.Ring, peers int, keys int) float64 {
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		p, err := r.GetPeers(torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, torus.INodeID(i/64)),
+			Index:    torus.IndexID(i % 64),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[p.Peers[0]]++
+	}
+	mean := float64(keys) / float64(peers)
+	var sq float64
+	for i := 0; i < peers; i++ {
+		d := float64(counts[fmt.Sprintf("peer-%d", i)]) - mean
+		sq += d * d
+	}
+	return math.Sqrt(sq/float64(peers)) / mean
+}
+
+func TestVNodesDistribution(t *testing.T) {
+	const (
+		peers = 16
+		keys  = 64 * 1024
+	)
+	var last float64
+	for _, vn := range []int{0, 4, 16, 64, 256, 1024} {
+		r, err := CreateRing(WithVNodes(&models.Ring{
+			Type:              uint32(Ketama),
+			Peers:             makeEvenPeers(peers),
+			ReplicationFactor: 2,
+			Version:           1,
+		}, vn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev := primaryDeviation(t, r, peers, keys)
+		t.Logf("vnodes %4d: relative stddev of primaries %.3f", vn, dev)
+		switch vn {
+		case 0:
+			// The library default; kept as the default for compatibility.
+			if dev > 0.5 {
+				t.Errorf("default ring is badly unbalanced: %.3f", dev)
+			}
+		case 4:
+		default:
+			if dev > last*1.1 {
+				t.Errorf("raising vnodes to %d made the distribution worse: %.3f > %.3f", vn, dev, last)
+			}
+		}
+		if vn != 0 {
+			last = dev
+		}
+	}
+	if last > 0.1 {
+		t.Errorf("expected a well balanced ring at high vnode counts, got %.3f", last)
+	}
+}
+
+func TestVNodesMarshal(t *testing.T) {
+	r, err := CreateRing(WithVNodes(&models.Ring{
+		Type:              uint32(Ketama),
+		Peers:             makeEvenPeers(3),
+		ReplicationFactor: 2,
+		Version:           1,
+	}, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.(*ketama).vnodes != 100 {
+		t.Fatalf("expected vnodes to survive marshaling, got %d", r2.(*ketama).vnodes)
+	}
+	ref := torus.BlockRef{
+		INodeRef: torus.NewINodeRef(3, 4),
+		Index:    5,
+	}
+	p1, _ := r.GetPeers(ref)
+	p2, _ := r2.GetPeers(ref)
+	if !reflect.DeepEqual(p1.Peers, p2.Peers) {
+		t.Fatalf("rings disagree after marshaling: %v vs %v", p1.Peers, p2.Peers)
+	}
+
+	_, err = CreateRing(WithVNodes(&models.Ring{
+		Type:    uint32(Ketama),
+		Version: 1,
+	}, MaxVNodes+1))
+	if err == nil {
+		t.Fatal("expected out of range vnodes to be rejected")
+	}
+}
+
+func TestCapacityPlacement(t *testing.T) {
+	const keys = 256 * 1024
+	capacities := []uint64{500, 1000, 2000, 4000, 8000, 8000, 750, 3000}
+	var pi torus.PeerInfoList
+	var total uint64
+	for i, c := range capacities {
+		pi = append(pi, &models.PeerInfo{
+			UUID:        fmt.Sprintf("peer-%d", i),
+			TotalBlocks: c * 1024,
+		})
+		total += c
+	}
+	r, err := CreateRing(WithPlacement(&models.Ring{
+		Type:              uint32(Ketama),
+		Peers:             pi,
+		ReplicationFactor: 1,
+		Version:           1,
+	}, PlacementCapacity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		p, err := r.GetPeers(torus.BlockRef{
+			INodeRef: torus.NewINodeRef(1, torus.INodeID(i/64)),
+			Index:    torus.IndexID(i % 64),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[p.Peers[0]]++
+	}
+	for i, c := range capacities {
+		want := float64(keys) * float64(c) / float64(total)
+		got := float64(counts[fmt.Sprintf("peer-%d", i)])
+		t.Logf("peer-%d: capacity %5d, %6.0f blocks, expected %6.0f", i, c, got, want)
+		if math.Abs(got-want)/want > 0.05 {
+			t.Errorf("peer-%d holds %.0f blocks, more than 5%% off its share of %.0f", i, got, want)
+		}
+	}
+}
+
+func TestPlacementVersion(t *testing.T) {
+	r, err := CreateRing(WithPlacement(&models.Ring{
+		Type:              uint32(Ketama),
+		Peers:             makeEvenPeers(3),
+		ReplicationFactor: 2,
+		Version:           1,
+	}, CurrentPlacement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = r.(torus.RingAdder).AddPeers(torus.PeerInfoList{
+		&models.PeerInfo{UUID: "peer-3", TotalBlocks: 4096},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := r2.(*ketama).placement; p != CurrentPlacement {
+		t.Fatalf("expected placement %d to survive adding peers and marshaling, got %d", CurrentPlacement, p)
+	}
+
+	// Rings without a placement keep the one they were made with.
+	r, err = CreateRing(&models.Ring{
+		Type:    uint32(Ketama),
+		Peers:   makeEvenPeers(3),
+		Version: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := r.(*ketama).placement; p != PlacementLegacy {
+		t.Fatalf("expected a ring without a placement to be legacy, got %d", p)
+	}
+
+	_, err = CreateRing(WithPlacement(&models.Ring{
+		Type:    uint32(Ketama),
+		Version: 1,
+	}, CurrentPlacement+1))
+	if err == nil {
+		t.Fatal("expected a ring with an unknown placement to be refused")
+	}
+}
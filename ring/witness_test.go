@@ -0,0 +1,76 @@
+package ring
+
+import (
+	"testing"
+
+	"github.com/alternative-storage/torus"
+	"github.com/alternative-storage/torus/models"
+)
+
+func TestWitnessNotPlaced(t *testing.T) {
+	peers := torus.PeerInfoList{
+		&models.PeerInfo{UUID: "a", TotalBlocks: 1024},
+		&models.PeerInfo{UUID: "b", TotalBlocks: 1024},
+		&models.PeerInfo{UUID: "w"},
+	}
+	for _, rt := range []torus.RingType{Ketama, Mod} {
+		r, err := CreateRing(&models.Ring{
+			Type:              uint32(rt),
+			Peers:             peers,
+			ReplicationFactor: 3,
+			Version:           1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Members().Has("w") {
+			t.Fatalf("ring type %d: witness should be a member", rt)
+		}
+		for i := 0; i < 1000; i++ {
+			perm, err := r.GetPeers(torus.BlockRef{
+				INodeRef: torus.NewINodeRef(1, torus.INodeID(i)),
+				Index:    torus.IndexID(i),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm.Replication != 2 {
+				t.Fatalf("ring type %d: expected replication capped at 2 storing peers, got %d", rt, perm.Replication)
+			}
+			if perm.Peers.Has("w") {
+				t.Fatalf("ring type %d: witness placed in %v", rt, perm.Peers)
+			}
+		}
+	}
+}
+
+func TestAddWitness(t *testing.T) {
+	r, err := CreateRing(&models.Ring{
+		Type: uint32(Ketama),
+		Peers: torus.PeerInfoList{
+			&models.PeerInfo{UUID: "a", TotalBlocks: 1024},
+			&models.PeerInfo{UUID: "b", TotalBlocks: 1024},
+		},
+		ReplicationFactor: 2,
+		Version:           1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRing, err := r.(torus.RingAdder).AddPeers(torus.PeerInfoList{
+		&models.PeerInfo{UUID: "w"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !newRing.Members().Has("w") {
+		t.Fatal("witness wasn't added")
+	}
+	perm, err := newRing.GetPeers(torus.BlockRef{INodeRef: torus.NewINodeRef(1, 2), Index: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm.Peers.Has("w") {
+		t.Fatalf("witness placed in %v", perm.Peers)
+	}
+}
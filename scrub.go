@@ -0,0 +1,65 @@
+package torus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alternative-storage/torus/models"
+)
+
+// ScrubStatus is the progress of a node's scrubber, which reads every block
+// in the node's local storage in turn and checks it against the checksum the
+// block's volume recorded for it.
+type ScrubStatus struct {
+	UUID string `json:"uuid"`
+	// PassStart is when the current pass began, and Position is the last
+	// block it checked, as from BlockRef.ToBytes, so that a restarted node
+	// carries on from there. Checked and Errors count the blocks the pass
+	// checked and found to be bad.
+	PassStart time.Time `json:"pass_start"`
+	Position  []byte    `json:"position,omitempty"`
+	Checked   uint64    `json:"checked"`
+	Errors    uint64    `json:"errors"`
+	// LastFullPass is when the last complete pass finished, and
+	// LastPassErrors the bad blocks it found.
+	LastFullPass   time.Time `json:"last_full_pass"`
+	LastPassErrors uint64    `json:"last_pass_errors"`
+	// TotalErrors counts the bad blocks found by every pass.
+	TotalErrors uint64    `json:"total_errors"`
+	Updated     time.Time `json:"updated"`
+}
+
+// BlockChecksumFunc returns the CRC-32 (IEEE) that each block of vol it can
+// tell should have, as held in storage.
+type BlockChecksumFunc func(srv *Server, vol *models.Volume) (map[BlockRef]uint32, error)
+
+var blockChecksumFuncs map[string]BlockChecksumFunc
+
+// RegisterBlockChecksums is the hook used by volume types to give the
+// scrubber the checksums of their blocks. It is usually called in the init()
+// of the package that implements the volume type.
+func RegisterBlockChecksums(volumeType string, f BlockChecksumFunc) {
+	if blockChecksumFuncs == nil {
+		blockChecksumFuncs = make(map[string]BlockChecksumFunc)
+	}
+
+	if _, ok := blockChecksumFuncs[volumeType]; ok {
+		panic("torus: attempted to register block checksums for " + volumeType + " twice")
+	}
+
+	blockChecksumFuncs[volumeType] = f
+}
+
+// BlockChecksums returns the checksums of the blocks of vol, or nil if its
+// type doesn't provide them.
+func BlockChecksums(srv *Server, vol *models.Volume) (map[BlockRef]uint32, error) {
+	f, ok := blockChecksumFuncs[vol.Type]
+	if !ok {
+		return nil, nil
+	}
+	sums, err := f(srv, vol)
+	if err != nil {
+		return nil, fmt.Errorf("torus: couldn't get checksums of volume %s: %v", vol.Name, err)
+	}
+	return sums, nil
+}
@@ -1,8 +1,10 @@
 package torus
 
 import (
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -24,6 +26,9 @@ func init() {
 const (
 	CtxWriteLevel int = iota
 	CtxReadLevel
+	CtxReplicaRead
+	CtxLockGeneration
+	CtxReadahead
 )
 
 // Server is the type representing the generic distributed block store.
@@ -33,6 +38,8 @@ type Server struct {
 	Blocks     BlockStore
 	MDS        MetadataService
 	INodes     *INodeStore
+	Audit      *AuditLog
+	peersMut   sync.RWMutex // protects peersMap
 	peersMap   map[string]*models.PeerInfo
 	closeChans []chan interface{}
 	Cfg        Config
@@ -40,26 +47,56 @@ type Server struct {
 	ctx        context.Context
 
 	lease    int64
+	leaseErr error
 	leaseMut sync.RWMutex
 
+	// published is the PeerInfo last written to the MDS, under
+	// publishedLease at publishedAt, guarded by infoMut like peerInfo.
+	published      *models.PeerInfo
+	publishedLease int64
+	publishedAt    time.Time
+	peerTimeout    time.Duration
+
 	heartbeating     bool
+	heartbeatDone    chan struct{}
+	shuttingDown     bool
 	ReplicationOpen  bool
 	timeoutCallbacks []func(string)
 }
 
+// createOrRenewLease renews the server's lease, granting a new one if it
+// has none or etcd no longer knows it. Failing to reach etcd doesn't give up
+// on the lease: it may well outlive the outage, and with it the peer's
+// registration and anything else held under it.
 func (s *Server) createOrRenewLease(ctx context.Context) error {
 	s.leaseMut.Lock()
 	defer s.leaseMut.Unlock()
 	if s.lease != 0 {
 		err := s.MDS.WithContext(ctx).RenewLease(s.lease)
-		if err == nil {
-			return nil
+		s.leaseErr = err
+		if err != ErrLeaseNotFound {
+			return err
 		}
-		clog.Errorf("Failed to renew, grant new lease for %d: %s", s.lease, err)
+		clog.Warningf("lease %d expired, granting a new one", s.lease)
+		promLeaseRegrants.Inc()
+	}
+	lease, err := s.MDS.WithContext(ctx).GetLease()
+	s.leaseErr = err
+	if err != nil {
+		return err
+	}
+	s.lease = lease
+	return nil
+}
+
+// forgetLease drops the server's lease, if it is still lease, so that the
+// next heartbeat grants a new one.
+func (s *Server) forgetLease(lease int64) {
+	s.leaseMut.Lock()
+	defer s.leaseMut.Unlock()
+	if s.lease == lease {
+		s.lease = 0
 	}
-	var err error
-	s.lease, err = s.MDS.WithContext(ctx).GetLease()
-	return err
 }
 
 func (s *Server) Lease() int64 {
@@ -68,10 +105,69 @@ func (s *Server) Lease() int64 {
 	return s.lease
 }
 
-func (s *Server) Close() error {
+// LeaseErr returns the error of the last attempt to renew or grant the
+// server's lease, or nil if it succeeded.
+func (s *Server) LeaseErr() error {
+	s.leaseMut.RLock()
+	defer s.leaseMut.RUnlock()
+	return s.leaseErr
+}
+
+// ShuttingDown reports whether Shutdown has been called.
+func (s *Server) ShuttingDown() bool {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.shuttingDown
+}
+
+func (s *Server) stopBackground() {
 	for _, c := range s.closeChans {
 		close(c)
 	}
+	s.closeChans = nil
+}
+
+// Shutdown gets the server ready to be closed without leaving work behind.
+// It stops taking replication requests and waits for the writes in progress
+// to reach storage, then stops heartbeating and gives up its lease, so that
+// peers see the node go right away rather than when the lease expires. It
+// gives up as soon as ctx is done. Close must still be called afterwards.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mut.Lock()
+	s.shuttingDown = true
+	s.mut.Unlock()
+	if d, ok := s.Blocks.(DrainingBlockStore); ok {
+		if err := d.Drain(ctx); err != nil {
+			return fmt.Errorf("couldn't drain writes: %v", err)
+		}
+	}
+	s.stopBackground()
+	if s.heartbeatDone != nil {
+		select {
+		case <-s.heartbeatDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	lease := s.Lease()
+	if r, ok := s.MDS.WithContext(ctx).(LeaseRevoker); ok && lease != 0 {
+		if err := r.RevokeLease(lease); err != nil {
+			return fmt.Errorf("couldn't revoke lease %d: %v", lease, err)
+		}
+		s.leaseMut.Lock()
+		s.lease = 0
+		s.leaseMut.Unlock()
+	}
+	return nil
+}
+
+func (s *Server) Close() error {
+	s.stopBackground()
+	// Give the events recorded so far a chance to reach the metadata service
+	// before it goes away.
+	if !FlushClusterEvents(closeFlushTimeout) {
+		clog.Warningf("closing with cluster events still waiting to be recorded")
+	}
 	err := s.MDS.Close()
 	if err != nil {
 		clog.Errorf("couldn't close mds: %s", err)
@@ -87,6 +183,11 @@ func (s *Server) Close() error {
 		clog.Errorf("couldn't close blocks: %s", err)
 		return err
 	}
+	err = s.Audit.Close()
+	if err != nil {
+		clog.Errorf("couldn't close audit log: %s", err)
+		return err
+	}
 	return nil
 }
 
@@ -112,9 +213,11 @@ func (s *Server) ExtendContext(ctx context.Context) context.Context {
 	return rl
 }
 
+// GetPeerMap returns a copy of the peers as of the last heartbeat. The
+// PeerInfos in it aren't changed afterwards, and mustn't be.
 func (s *Server) GetPeerMap() map[string]*models.PeerInfo {
-	s.infoMut.Lock()
-	defer s.infoMut.Unlock()
+	s.peersMut.RLock()
+	defer s.peersMut.RUnlock()
 	out := make(map[string]*models.PeerInfo)
 	for k, v := range s.peersMap {
 		out[k] = v
@@ -244,6 +244,62 @@ func ParseReadLevel(s string) (rl ReadLevel, err error) {
 	return
 }
 
+// Write consistencies a volume may choose. They override the server's write
+// level for the blocks of that volume.
+const (
+	// ConsistencySync acknowledges a write once every replica has it.
+	ConsistencySync = "sync"
+	// ConsistencyQuorum acknowledges a write once a majority of the
+	// replicas have it.
+	ConsistencyQuorum = "quorum"
+	// ConsistencyAsync acknowledges a write once one replica has it, and
+	// copies it to the others in the background.
+	ConsistencyAsync = "async"
+)
+
+// ValidateConsistency checks a volume's write consistency against the
+// replication factor of the ring. The empty consistency, which follows the
+// server's write level, is always valid.
+func ValidateConsistency(c string, replication int) error {
+	switch c {
+	case "", ConsistencySync:
+		return nil
+	case ConsistencyQuorum:
+		if replication < 3 {
+			return fmt.Errorf("consistency %q needs a replication factor of at least 3, have %d", c, replication)
+		}
+		return nil
+	case ConsistencyAsync:
+		if replication < 2 {
+			return fmt.Errorf("consistency %q needs a replication factor of at least 2, have %d", c, replication)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid consistency %q; use one of 'sync', 'quorum', or 'async'", c)
+}
+
+// Cache policies a volume may choose for the block cache.
+const (
+	// CachePolicyAggressive admits every block read or written, and keeps
+	// the volume's blocks over those of other volumes when evicting.
+	CachePolicyAggressive = "aggressive"
+	// CachePolicyDefault admits blocks written and blocks fetched from
+	// other peers.
+	CachePolicyDefault = "default"
+	// CachePolicyNoCache keeps the volume's blocks out of the cache.
+	CachePolicyNoCache = "no-cache"
+)
+
+// ValidateCachePolicy checks a volume's cache policy. The empty policy is
+// the same as CachePolicyDefault.
+func ValidateCachePolicy(p string) error {
+	switch p {
+	case "", CachePolicyAggressive, CachePolicyDefault, CachePolicyNoCache:
+		return nil
+	}
+	return fmt.Errorf("invalid cache policy %q; use one of 'aggressive', 'default', or 'no-cache'", p)
+}
+
 // BlockStore is the interface representing the standardized methods to
 // interact with something storing blocks.
 type BlockStore interface {
@@ -260,6 +316,208 @@ type BlockStore interface {
 	// TODO(barakmich) FreeBlocks()
 }
 
+// BlockStoreStats counts the block reads and writes a BlockStore has served
+// since it was opened.
+type BlockStoreStats struct {
+	Reads       uint64 `json:"reads"`
+	ReadErrors  uint64 `json:"read_errors"`
+	Writes      uint64 `json:"writes"`
+	WriteErrors uint64 `json:"write_errors"`
+}
+
+// StatsBlockStore is implemented by BlockStores that count the operations
+// they serve.
+type StatsBlockStore interface {
+	Stats() BlockStoreStats
+}
+
+// DrainingBlockStore is implemented by BlockStores that serve requests from
+// other nodes. Drain stops taking new requests and waits for the writes in
+// progress to reach storage, or for ctx to be done.
+type DrainingBlockStore interface {
+	Drain(ctx context.Context) error
+}
+
+// SyncingBlockStore is implemented by BlockStores whose Flush may return
+// before the blocks are durable. Sync returns once every block written before
+// it was called is, or with an error if that can't be made sure of.
+type SyncingBlockStore interface {
+	Sync(ctx context.Context) error
+}
+
+// SyncBlockStore makes the blocks written to s durable, falling back on Flush
+// for stores that don't implement SyncingBlockStore.
+func SyncBlockStore(ctx context.Context, s BlockStore) error {
+	if ss, ok := s.(SyncingBlockStore); ok {
+		return ss.Sync(ctx)
+	}
+	return s.Flush()
+}
+
+// ReadOnlyBlockStore is implemented by BlockStores that stop taking new
+// blocks once they are nearly full, or the disk under them is.
+type ReadOnlyBlockStore interface {
+	// ReadOnly reports whether the store is past its high-water mark, or
+	// has run out of space, and hasn't been under its low-water mark since.
+	ReadOnly() bool
+}
+
+// BlockStoreReadOnly reports whether s is too full to take new blocks. Stores
+// that don't implement ReadOnlyBlockStore never are.
+func BlockStoreReadOnly(s BlockStore) bool {
+	if ro, ok := s.(ReadOnlyBlockStore); ok {
+		return ro.ReadOnly()
+	}
+	return false
+}
+
+// BlockReleaser is implemented by BlockStores whose GetBlock hands out
+// pooled buffers.
+type BlockReleaser interface {
+	// ReleaseBlock gives back a block returned by GetBlock, once nothing
+	// refers to it any more.
+	ReleaseBlock(b []byte)
+}
+
+// ReleaseBlock gives b, a block read from s that nothing refers to any more,
+// back to s if it pools its buffers.
+func ReleaseBlock(s BlockStore, b []byte) {
+	if r, ok := s.(BlockReleaser); ok && b != nil {
+		r.ReleaseBlock(b)
+	}
+}
+
+// CircuitBreakingBlockStore is implemented by BlockStores that stop sending
+// requests to peers too many of which fail.
+type CircuitBreakingBlockStore interface {
+	// OpenCircuits returns the peers requests aren't being sent to.
+	OpenCircuits() []string
+}
+
+// BlockStoreOpenCircuits returns the peers s has stopped sending requests to,
+// if it breaks circuits.
+func BlockStoreOpenCircuits(s BlockStore) []string {
+	if cb, ok := s.(CircuitBreakingBlockStore); ok {
+		return cb.OpenCircuits()
+	}
+	return nil
+}
+
+// ResizableBlockStore is implemented by BlockStores whose capacity can
+// change while they're open. Resize sets the storage of each data directory
+// to the bytes in sizes, in the order of Config.DataDir; shrinking storage
+// below the blocks it holds fails with a *ShrinkError, leaving it as it was.
+type ResizableBlockStore interface {
+	Resize(sizes []uint64) error
+}
+
+// ShrinkError is returned when storage is resized smaller than the blocks it
+// holds take.
+type ShrinkError struct {
+	Dir    string
+	Used   uint64
+	Blocks uint64
+}
+
+func (e *ShrinkError) Error() string {
+	return fmt.Sprintf("torus: can't shrink the storage in %s to %d blocks, as %d blocks are in use", e.Dir, e.Blocks, e.Used)
+}
+
+// BlockRangeReader is implemented by BlockStores that can return part of a
+// block without materializing the whole block first.
+type BlockRangeReader interface {
+	GetBlockRange(ctx context.Context, b BlockRef, offset, length uint64) ([]byte, error)
+}
+
+// BlockBatchReader is implemented by BlockStores that can fetch several
+// blocks more cheaply together than one at a time. errs[i] is the error
+// reading refs[i]; one block failing doesn't fail the others.
+type BlockBatchReader interface {
+	GetBlocks(ctx context.Context, refs []BlockRef) (data [][]byte, errs []error)
+}
+
+// ReplicaRead follows a read through the copies of a block held by different
+// peers. A reader that finds the copy it got to be bad adds its peer to Bad
+// and reads again; BlockStores that keep replicas skip the peers in Bad and
+// note where each copy came from.
+type ReplicaRead struct {
+	// Ref, Peer and Data describe the last copy read: the block, the UUID of
+	// the peer that served it, and the block as that peer has it. Peer is
+	// empty if the copy didn't come straight from a peer, such as from a
+	// cache.
+	Ref  BlockRef
+	Peer string
+	Data []byte
+	Bad  PeerList
+}
+
+// WithReplicaRead returns a context whose block reads are followed by rr.
+func WithReplicaRead(ctx context.Context, rr *ReplicaRead) context.Context {
+	return context.WithValue(ctx, CtxReplicaRead, rr)
+}
+
+// ReplicaReadFromContext returns the ReplicaRead attached to ctx, if any.
+func ReplicaReadFromContext(ctx context.Context) *ReplicaRead {
+	rr, _ := ctx.Value(CtxReplicaRead).(*ReplicaRead)
+	return rr
+}
+
+// WithReadahead marks ctx as that of blocks fetched ahead of a sequential
+// reader. BlockStores that cache blocks keep them from pushing out those that
+// have been asked for.
+func WithReadahead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, CtxReadahead, true)
+}
+
+// ReadaheadFromContext reports whether the blocks read with ctx are fetched
+// ahead of a reader.
+func ReadaheadFromContext(ctx context.Context) bool {
+	ra, _ := ctx.Value(CtxReadahead).(bool)
+	return ra
+}
+
+// ReplicaRepairer is implemented by BlockStores that keep replicas of blocks
+// on several peers. RepairBlock overwrites the copies of block ref held by
+// peers with data in the background, and may drop the repair if too many are
+// already pending.
+type ReplicaRepairer interface {
+	RepairBlock(ref BlockRef, data []byte, peers []string)
+}
+
+// GetBlockRange returns length bytes of block b starting at offset. If the
+// store doesn't support range reads, the full block is read and sliced.
+func GetBlockRange(ctx context.Context, s BlockStore, b BlockRef, offset, length uint64) ([]byte, error) {
+	if offset+length > s.BlockSize() || offset+length < offset {
+		return nil, ErrInvalid
+	}
+	if r, ok := s.(BlockRangeReader); ok {
+		return r.GetBlockRange(ctx, b, offset, length)
+	}
+	data, err := s.GetBlock(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) < offset+length {
+		return nil, ErrInvalid
+	}
+	return data[offset : offset+length], nil
+}
+
+// GetBlocks reads every block in refs, returning each block's error
+// alongside it. If the store can't batch reads, the blocks are read one at a
+// time.
+func GetBlocks(ctx context.Context, s BlockStore, refs []BlockRef) ([][]byte, []error) {
+	if r, ok := s.(BlockBatchReader); ok {
+		return r.GetBlocks(ctx, refs)
+	}
+	data := make([][]byte, len(refs))
+	errs := make([]error, len(refs))
+	for i, ref := range refs {
+		data[i], errs[i] = s.GetBlock(ctx, ref)
+	}
+	return data, errs
+}
+
 type BlockIterator interface {
 	Err() error
 	Next() bool
@@ -287,3 +545,20 @@ func CreateBlockStore(kind string, name string, cfg Config, gmd GlobalMetadata)
 	clog.Infof("creating blockstore: %s", kind)
 	return blockStores[kind](name, cfg, gmd)
 }
+
+// OverwritingBlockStore is implemented by BlockStores that can overwrite the
+// contents of a block where they are stored, for deleting volumes securely.
+type OverwritingBlockStore interface {
+	// OverwriteBlock overwrites the stored contents of ref with zeros and
+	// syncs them. The block is still there, to be deleted.
+	OverwriteBlock(ctx context.Context, ref BlockRef) error
+}
+
+// OverwriteBlock overwrites the stored contents of ref in s with zeros. It
+// returns ErrNotSupported if s can't.
+func OverwriteBlock(ctx context.Context, s BlockStore, ref BlockRef) error {
+	if o, ok := s.(OverwritingBlockStore); ok {
+		return o.OverwriteBlock(ctx, ref)
+	}
+	return ErrNotSupported
+}
@@ -17,12 +17,17 @@ func init() {
 	torus.RegisterBlockStore("block_device", newBlockDeviceBlockStore)
 }
 
+// headerBufs holds buffers for reading and writing block headers, which are
+// touched several times for every block looked up.
+var headerBufs = torus.NewBlockBufPool(blockDevice.BlockSize)
+
 func (d *deviceBlock) readBlockHeader(offset uint64) (blockDevice.BlockHeaders, error) {
 	_, err := d.deviceFile.Seek(int64(offset), os.SEEK_SET)
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, blockDevice.BlockSize)
+	buf := headerBufs.Get()
+	defer headerBufs.Put(buf)
 	n, err := d.deviceFile.Read(buf)
 	if err != nil {
 		return nil, err
@@ -50,7 +55,9 @@ func DeserializeBlockHeader(buf []byte) (blockDevice.BlockHeaders, error) {
 }
 
 func (d *deviceBlock) writeBlockHeader(hdrs blockDevice.BlockHeaders, offset uint64) error {
-	buf, err := SerializeBlockHeader(hdrs)
+	buf := headerBufs.Get()
+	defer headerBufs.Put(buf)
+	err := hdrs.Marshal(buf)
 	if err != nil {
 		return err
 	}
@@ -61,7 +68,7 @@ func (d *deviceBlock) writeBlockHeader(hdrs blockDevice.BlockHeaders, offset uin
 	}
 	n, err := d.deviceFile.Write(buf)
 	if err != nil {
-		return err
+		return d.space.noSpace(err, d.UsedBlocks())
 	}
 	if uint64(n) != blockDevice.BlockSize {
 		return fmt.Errorf("Wrote an unexpected number of bytes? %d", n)
@@ -77,6 +84,7 @@ type deviceBlock struct {
 
 	cfg        torus.Config
 	globalMeta torus.GlobalMetadata
+	space      spaceGuard
 }
 
 func newBlockDeviceBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
@@ -101,6 +109,14 @@ func newBlockDeviceBlockStore(name string, cfg torus.Config, meta torus.GlobalMe
 	mdata, err := d.readMetadata()
 	if err != nil {
 		f.Close()
+		switch err {
+		case blockDevice.ErrNotFormatted:
+			return nil, fmt.Errorf("device %s has not been formatted for torus; format it with torusctl mkfs-device", cfg.BlockDevice)
+		case blockDevice.ErrBadChecksum:
+			return nil, fmt.Errorf("the superblock of device %s is corrupt; check the device, or format it again with torusctl mkfs-device --wipe, losing its blocks", cfg.BlockDevice)
+		case blockDevice.ErrNewerFormat:
+			return nil, fmt.Errorf("device %s was formatted by a newer version of torus, with a superblock format past version %d; upgrade torusd on this node", cfg.BlockDevice, blockDevice.FormatVersion)
+		}
 		return nil, err
 	}
 
@@ -108,7 +124,29 @@ func newBlockDeviceBlockStore(name string, cfg torus.Config, meta torus.GlobalMe
 
 	if mdata.TorusBlockSize != meta.BlockSize {
 		f.Close()
-		return nil, fmt.Errorf("device %s has been formatted with block size %d, and the cluster is using block size %d", cfg.BlockDevice, mdata.TorusBlockSize, meta.BlockSize)
+		return nil, fmt.Errorf("device %s has been formatted with block size %d, and the cluster is using block size %d; format it again with torusctl mkfs-device --wipe, losing its blocks", cfg.BlockDevice, mdata.TorusBlockSize, meta.BlockSize)
+	}
+	if mdata.Capacity > deviceSize {
+		f.Close()
+		return nil, fmt.Errorf("device %s was formatted with %d bytes, and has only %d now; it may be the wrong device, or have shrunk", cfg.BlockDevice, mdata.Capacity, deviceSize)
+	}
+	if meta.ClusterID != "" {
+		switch mdata.ClusterID {
+		case meta.ClusterID:
+		case "":
+			mdata.ClusterID = meta.ClusterID
+			if err := d.writeMetadata(); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("couldn't record the cluster on device %s: %v", cfg.BlockDevice, err)
+			}
+		default:
+			f.Close()
+			return nil, fmt.Errorf("%v: device %s holds blocks of cluster %s, and the metadata service is of cluster %s; start torusd with --force-reclaim to wipe it", torus.ErrWrongCluster, cfg.BlockDevice, mdata.ClusterID, meta.ClusterID)
+		}
+	}
+	d.space.setMarks(cfg, d.NumBlocks())
+	if cfg.JournalDir != "" {
+		clog.Warningf("block_device: writes aren't journaled on block devices; ignoring journal dir %s", cfg.JournalDir)
 	}
 
 	return d, nil
@@ -119,7 +157,12 @@ func (d *deviceBlock) Kind() string {
 }
 
 func (d *deviceBlock) Flush() error {
-	return d.deviceFile.Sync()
+	return d.space.noSpace(d.deviceFile.Sync(), d.UsedBlocks())
+}
+
+// ReadOnly reports whether the device is too full to take new blocks.
+func (d *deviceBlock) ReadOnly() bool {
+	return d.space.check(d.UsedBlocks())
 }
 
 func (d *deviceBlock) Close() error {
@@ -143,17 +186,24 @@ func (d *deviceBlock) GetBlock(ctx context.Context, b torus.BlockRef) ([]byte, e
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, d.metadata.TorusBlockSize)
+	buf := torus.BlockBufs(d.metadata.TorusBlockSize).Get()
 	n, err := d.deviceFile.Read(buf)
 	if err != nil {
+		d.ReleaseBlock(buf)
 		return nil, err
 	}
 	if uint64(n) != d.metadata.TorusBlockSize {
+		d.ReleaseBlock(buf)
 		return nil, fmt.Errorf("Read an unexpected number of bytes? %d", n)
 	}
 	return buf, nil
 }
 
+// ReleaseBlock gives back a block returned by GetBlock.
+func (d *deviceBlock) ReleaseBlock(b []byte) {
+	torus.BlockBufs(d.metadata.TorusBlockSize).Put(b)
+}
+
 func (d *deviceBlock) WriteBlock(ctx context.Context, b torus.BlockRef, data []byte) error {
 	if uint64(len(data)) != d.metadata.TorusBlockSize {
 		return fmt.Errorf("data buffer does not match block size")
@@ -215,7 +265,8 @@ func (d *deviceBlock) WriteBlock(ctx context.Context, b torus.BlockRef, data []b
 		}
 		if currOffset == offset {
 			// oh my, it looks like we looped all the way around the device
-			return fmt.Errorf("device is full")
+			d.space.outOfSpace(d.UsedBlocks())
+			return torus.ErrOutOfSpace
 		}
 		currHdrs, err := d.readBlockHeader(currOffset)
 		if err != nil {
@@ -273,7 +324,7 @@ func (d *deviceBlock) writeData(offset uint64, data []byte) error {
 	}
 	n, err := d.deviceFile.Write(data)
 	if err != nil {
-		return err
+		return d.space.noSpace(err, d.UsedBlocks())
 	}
 	if n != len(data) {
 		return fmt.Errorf("Wrote an unexpected number of bytes? %d", n)
@@ -285,11 +336,39 @@ func (d *deviceBlock) WriteBuf(ctx context.Context, b torus.BlockRef) ([]byte, e
 	return nil, fmt.Errorf("not implemented")
 }
 
+// OverwriteBlock zeroes the data of block b on the device, with BLKZEROOUT if
+// the device supports it and by writing zeros otherwise, and syncs it.
+func (d *deviceBlock) OverwriteBlock(ctx context.Context, b torus.BlockRef) error {
+	offset, found, err := d.findBlockOffset(b)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return torus.ErrBlockNotExist
+	}
+	start := offset + blockDevice.BlockSize
+	if err := blockDevice.ZeroRange(d.deviceFile, start, d.metadata.TorusBlockSize); err != nil {
+		clog.Debugf("block_device: can't zero out block range, writing zeros: %v", err)
+		if err := d.writeData(start, make([]byte, d.metadata.TorusBlockSize)); err != nil {
+			return err
+		}
+	}
+	if err := d.deviceFile.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteBlock only drops the block from its headers; the data is left where
+// it is, to be overwritten by a later block.
 func (d *deviceBlock) DeleteBlock(ctx context.Context, b torus.BlockRef) error {
 	// Find the block
 	offset, found, err := d.findBlockOffset(b)
+	if err != nil {
+		return err
+	}
 	if !found {
-		return fmt.Errorf("block doesn't exist")
+		return torus.ErrBlockNotExist
 	}
 	// Read its headers
 	hdrs, err := d.readBlockHeader(offset)
@@ -483,7 +562,7 @@ func (d *deviceBlock) writeMetadata() error {
 	}
 	n, err := d.deviceFile.Write(buf)
 	if err != nil {
-		return err
+		return d.space.noSpace(err, d.UsedBlocks())
 	}
 	if n != len(buf) {
 		return fmt.Errorf("Unexpected number of bytes written!! %d", n)
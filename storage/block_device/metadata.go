@@ -3,16 +3,54 @@ package block_device
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"hash/crc32"
 	"time"
 )
 
+// FormatVersion is the superblock format written by this version of torus,
+// and the newest it can read. Devices formatted before superblocks had a
+// version read as version 0, and have no checksum.
+const FormatVersion = 1
+
+var (
+	// ErrNotFormatted is returned for a device without a torus superblock.
+	ErrNotFormatted = errors.New("device has not been formatted for torus")
+	// ErrBadChecksum is returned for a superblock that doesn't match its
+	// checksum.
+	ErrBadChecksum = errors.New("superblock checksum mismatch")
+	// ErrNewerFormat is returned for a superblock written in a format newer
+	// than FormatVersion.
+	ErrNewerFormat = errors.New("superblock format is newer than this version of torus")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Metadata struct {
 	TorusBlockSize     uint64
 	FormattedTimestamp time.Time
 	UsedBlocks         uint64
+	// ClusterID is the cluster the device holds blocks for. It is empty
+	// until the device is first used by a node.
+	ClusterID string
+	// FormatVersion is the format the superblock was written in.
+	FormatVersion uint32
+	// Capacity is the size of the device in bytes when it was formatted.
+	// It is zero on devices formatted before it was recorded.
+	Capacity uint64
 }
 
+// ClusterIDLen is the room the superblock has for the cluster ID.
+const ClusterIDLen = 36
+
+// Offsets into the superblock past the magic sentence.
+const (
+	clusterIDOffset = 24
+	versionOffset   = clusterIDOffset + ClusterIDLen
+	capacityOffset  = versionOffset + 4
+	checksumOffset  = capacityOffset + 8
+)
+
 func (m *Metadata) Marshal() []byte {
 	buf := make([]byte, MetadataSize)
 	for i, b := range MagicSentence {
@@ -21,20 +59,53 @@ func (m *Metadata) Marshal() []byte {
 	binary.BigEndian.PutUint64(buf[MagicLen:MagicLen+8], m.TorusBlockSize)
 	binary.BigEndian.PutUint64(buf[MagicLen+8:MagicLen+16], uint64(m.FormattedTimestamp.Unix()))
 	binary.BigEndian.PutUint64(buf[MagicLen+16:MagicLen+24], m.UsedBlocks)
+	copy(buf[MagicLen+clusterIDOffset:MagicLen+versionOffset], m.ClusterID)
+	binary.BigEndian.PutUint32(buf[MagicLen+versionOffset:MagicLen+capacityOffset], m.FormatVersion)
+	binary.BigEndian.PutUint64(buf[MagicLen+capacityOffset:MagicLen+checksumOffset], m.Capacity)
+	binary.BigEndian.PutUint32(buf[MagicLen+checksumOffset:MagicLen+checksumOffset+4], crc32.Checksum(buf[:MagicLen+checksumOffset], crcTable))
 
 	return buf
 }
 
 func (m *Metadata) Unmarshal(buf []byte) error {
-	if !bytes.Equal(MagicSentence, buf[:MagicLen]) {
-		return fmt.Errorf("device has not been formatted for torus")
+	if len(buf) < MagicLen || !bytes.Equal(MagicSentence, buf[:MagicLen]) {
+		return ErrNotFormatted
+	}
+	if uint64(len(buf)) < MetadataSize {
+		full := make([]byte, MetadataSize)
+		copy(full, buf)
+		buf = full
+	}
+
+	m.FormatVersion = binary.BigEndian.Uint32(buf[MagicLen+versionOffset : MagicLen+capacityOffset])
+	if m.FormatVersion > FormatVersion {
+		return ErrNewerFormat
+	}
+	if m.FormatVersion > 0 {
+		sum := binary.BigEndian.Uint32(buf[MagicLen+checksumOffset : MagicLen+checksumOffset+4])
+		if sum != crc32.Checksum(buf[:MagicLen+checksumOffset], crcTable) {
+			return ErrBadChecksum
+		}
 	}
 
 	m.TorusBlockSize = binary.BigEndian.Uint64(buf[MagicLen : MagicLen+8])
 	timeStampNum := binary.BigEndian.Uint64(buf[MagicLen+8 : MagicLen+16])
 	m.UsedBlocks = binary.BigEndian.Uint64(buf[MagicLen+16 : MagicLen+24])
+	m.ClusterID = string(bytes.TrimRight(buf[MagicLen+clusterIDOffset:MagicLen+versionOffset], "\x00"))
+	m.Capacity = binary.BigEndian.Uint64(buf[MagicLen+capacityOffset : MagicLen+checksumOffset])
 
 	m.FormattedTimestamp = time.Unix(int64(timeStampNum), 0)
 
 	return nil
 }
+
+// IsBlank reports whether the superblock buf is all zeros, as on a device
+// that was never formatted.
+func IsBlank(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
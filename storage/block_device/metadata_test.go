@@ -51,4 +51,76 @@ func TestMetadataUnmarshal(t *testing.T) {
 	if m.UsedBlocks != 0x1111111122222222 {
 		t.Errorf("Unmarshalled data didn't have expected timestamp")
 	}
+	if m.ClusterID != "" {
+		t.Errorf("expected no cluster ID on a short superblock, got %q", m.ClusterID)
+	}
+}
+
+func TestMetadataClusterID(t *testing.T) {
+	id := "0b8a9f2e-6c1d-4f3a-9e5b-7d2c1a0f4e3b"
+	m := &Metadata{TorusBlockSize: 512 * 1024, ClusterID: id}
+	got := &Metadata{}
+	if err := got.Unmarshal(m.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if got.ClusterID != id {
+		t.Errorf("expected cluster ID %s, got %q", id, got.ClusterID)
+	}
+	m.ClusterID = ""
+	if err := got.Unmarshal(m.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if got.ClusterID != "" {
+		t.Errorf("expected no cluster ID, got %q", got.ClusterID)
+	}
+}
+
+func TestMetadataVersion(t *testing.T) {
+	m := &Metadata{
+		TorusBlockSize: 512 * 1024,
+		FormatVersion:  FormatVersion,
+		Capacity:       1 << 30,
+	}
+	got := &Metadata{}
+	if err := got.Unmarshal(m.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if got.FormatVersion != FormatVersion || got.Capacity != 1<<30 {
+		t.Errorf("expected version %d and capacity %d, got %d and %d", FormatVersion, 1<<30, got.FormatVersion, got.Capacity)
+	}
+
+	data := m.Marshal()
+	data[MagicLen+1] ^= 0xff
+	if err := got.Unmarshal(data); err != ErrBadChecksum {
+		t.Errorf("expected a corrupt superblock to fail its checksum, got %v", err)
+	}
+
+	m.FormatVersion = FormatVersion + 1
+	if err := got.Unmarshal(m.Marshal()); err != ErrNewerFormat {
+		t.Errorf("expected a newer superblock format to be refused, got %v", err)
+	}
+
+	// Superblocks written before they had a version have no checksum.
+	m.FormatVersion = 0
+	data = m.Marshal()
+	for i := MagicLen + checksumOffset; i < MagicLen+checksumOffset+4; i++ {
+		data[i] = 0
+	}
+	if err := got.Unmarshal(data); err != nil {
+		t.Errorf("expected a superblock without a version to be read, got %v", err)
+	}
+}
+
+func TestMetadataNotFormatted(t *testing.T) {
+	buf := make([]byte, MetadataSize)
+	if !IsBlank(buf) {
+		t.Error("expected a zeroed superblock to be blank")
+	}
+	if err := (&Metadata{}).Unmarshal(buf); err != ErrNotFormatted {
+		t.Errorf("expected a blank device not to be formatted, got %v", err)
+	}
+	copy(buf, "garbage")
+	if IsBlank(buf) {
+		t.Error("expected garbage not to be blank")
+	}
 }
@@ -19,3 +19,15 @@ func GetDeviceSize(deviceFile *os.File) (uint64, error) {
 	numBytes := numBlocks * 512
 	return uint64(numBytes), nil
 }
+
+// ZeroRange has the device zero out length bytes at offset with BLKZEROOUT.
+// It fails if deviceFile isn't a block device or the kernel doesn't support
+// it.
+func ZeroRange(deviceFile *os.File, offset, length uint64) error {
+	r := [2]uint64{offset, length}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(deviceFile.Fd()), uintptr(C.BLKZEROOUT), uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -66,13 +66,13 @@ func newDeviceBlockTester(deviceSize uint64) (*deviceBlockTester, error) {
 		return nil, err
 	}
 	stderr("formatting block device")
-	err = mkfs.Mkfs(mkfs.DefaultBlockSize, true, lodevice)
+	err = mkfs.Mkfs(mkfs.DefaultBlockSize, "", true, lodevice)
 	if err != nil {
 		return nil, err
 	}
 
 	cfg := torus.Config{
-		DataDir:         "",
+		DataDir:         nil,
 		BlockDevice:     lodevice,
 		StorageSize:     0,
 		MetadataAddress: "",
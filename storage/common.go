@@ -6,6 +6,9 @@
 package storage
 
 import (
+	"sync/atomic"
+
+	"github.com/alternative-storage/torus"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -45,6 +48,10 @@ var (
 		Name: "torus_storage_failed_deleted_blocks",
 		Help: "Number of blocks failed to be deleted from local block storage",
 	}, []string{"storage"})
+	promBlocksOverwritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_overwritten_blocks",
+		Help: "Number of blocks overwritten with zeros in local block storage to erase them",
+	}, []string{"storage"})
 	promStorageFlushes = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "torus_storage_flushes",
 		Help: "Number of times the storage layer is synced to disk",
@@ -53,6 +60,26 @@ var (
 		Name: "torus_storage_block_bytes",
 		Help: "Number of bytes per block in the storage layer",
 	})
+	promFreeExtents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_storage_free_extents",
+		Help: "Number of runs of contiguous free blocks in local storage",
+	}, []string{"storage"})
+	promLargestFreeExtent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_storage_largest_free_extent_blocks",
+		Help: "Length in blocks of the longest run of free blocks in local storage",
+	}, []string{"storage"})
+	promFailedDirs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_storage_failed_dirs",
+		Help: "Number of data directories left out of local storage after failing",
+	})
+	promJournalReplayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_journal_replayed_entries",
+		Help: "Number of block writes and deletes replayed from the journal of local storage",
+	}, []string{"storage"})
+	promDefragMoves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_defrag_moved_blocks",
+		Help: "Number of blocks moved by defragmentation of local storage",
+	}, []string{"storage"})
 )
 
 func init() {
@@ -64,6 +91,30 @@ func init() {
 	prometheus.MustRegister(promBlockWritesFailed)
 	prometheus.MustRegister(promBlocksDeleted)
 	prometheus.MustRegister(promBlockDeletesFailed)
+	prometheus.MustRegister(promBlocksOverwritten)
 	prometheus.MustRegister(promStorageFlushes)
 	prometheus.MustRegister(promBytesPerBlock)
+	prometheus.MustRegister(promFreeExtents)
+	prometheus.MustRegister(promLargestFreeExtent)
+	prometheus.MustRegister(promDefragMoves)
+	prometheus.MustRegister(promFailedDirs)
+	prometheus.MustRegister(promJournalReplayed)
+}
+
+// opStats counts block reads and writes alongside the prometheus counters, so
+// that a block store embedding it can report them through Stats.
+type opStats struct {
+	reads       uint64
+	readErrors  uint64
+	writes      uint64
+	writeErrors uint64
+}
+
+func (s *opStats) Stats() torus.BlockStoreStats {
+	return torus.BlockStoreStats{
+		Reads:       atomic.LoadUint64(&s.reads),
+		ReadErrors:  atomic.LoadUint64(&s.readErrors),
+		Writes:      atomic.LoadUint64(&s.writes),
+		WriteErrors: atomic.LoadUint64(&s.writeErrors),
+	}
 }
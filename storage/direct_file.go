@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// blockFile holds the data of an mfile store, one block per slot.
+type blockFile interface {
+	// ReadBlock returns a copy of the n-th block, which the caller may keep
+	// however the file changes after.
+	ReadBlock(n uint64) ([]byte, error)
+	WriteBlock(n uint64, data []byte) error
+	NumBlocks() uint64
+	// Resize changes the size of the file to size bytes. Blocks past the
+	// new end are lost, and slices returned before are invalid.
+	Resize(size uint64) error
+	Flush() error
+	Sync() error
+	Close() error
+}
+
+var (
+	_ blockFile = &MFile{}
+	_ blockFile = &directFile{}
+)
+
+// Storage I/O modes of the mfile store, as set in torus.Config.StorageIOMode.
+const (
+	// IOModeMmap maps the data file into memory, leaving caching to the
+	// kernel page cache. It's the default.
+	IOModeMmap = "mmap"
+	// IOModeDirect reads and writes the data file with O_DIRECT, bypassing
+	// the page cache, so that blocks are only cached once, by torus.
+	IOModeDirect = "direct"
+)
+
+// IOModes are the storage I/O modes of the mfile store.
+var IOModes = []string{IOModeMmap, IOModeDirect}
+
+// openDataFile opens the data file of an mfile store in the I/O mode given.
+func openDataFile(path string, size, blkSize uint64, mode string) (blockFile, error) {
+	switch mode {
+	case "", IOModeMmap:
+		return CreateOrOpenMFile(path, size, blkSize)
+	case IOModeDirect:
+		return CreateOrOpenDirectFile(path, size, blkSize)
+	}
+	return nil, fmt.Errorf("storage: unknown I/O mode %q", mode)
+}
+
+// directFile is a block file read and written with O_DIRECT. Every transfer
+// goes through a buffer aligned to the logical sector size of the device,
+// which the block size must be a multiple of.
+type directFile struct {
+	f       *os.File
+	blkSize uint64
+	size    uint64
+	align   uint64
+	// bufs holds aligned buffers for writes, which copy the block into one
+	// before writing it.
+	bufs sync.Pool
+}
+
+func CreateOrOpenDirectFile(path string, size uint64, blkSize uint64) (*directFile, error) {
+	if err := sizeFile(path, size); err != nil {
+		return nil, err
+	}
+	return OpenDirectFile(path, blkSize)
+}
+
+// OpenDirectFile opens the file at path for O_DIRECT I/O of blkSize blocks,
+// refusing block sizes that aren't a multiple of the logical sector size.
+func OpenDirectFile(path string, blkSize uint64) (*directFile, error) {
+	f, err := openDirect(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	align := logicalSectorSize(st)
+	if blkSize%align != 0 {
+		f.Close()
+		return nil, fmt.Errorf("block size %d is not a multiple of the logical sector size %d of %s, as direct I/O needs", blkSize, align, path)
+	}
+	df := &directFile{
+		f:       f,
+		blkSize: blkSize,
+		size:    uint64(st.Size()),
+		align:   align,
+	}
+	if df.size%blkSize != 0 {
+		f.Close()
+		return nil, fmt.Errorf("File size is not a multiple of the block size: %d size, %d blksize", df.size, blkSize)
+	}
+	df.bufs.New = func() interface{} {
+		return alignedBuf(blkSize, align)
+	}
+	return df, nil
+}
+
+// alignedBuf returns a buffer of size bytes starting at a multiple of align.
+func alignedBuf(size, align uint64) []byte {
+	b := make([]byte, size+align)
+	off := uint64(uintptr(unsafe.Pointer(&b[0])) % uintptr(align))
+	if off != 0 {
+		off = align - off
+	}
+	return b[off : off+size : off+size]
+}
+
+// ReadBlock reads the n-th block into a new buffer.
+func (d *directFile) ReadBlock(n uint64) ([]byte, error) {
+	offset := n * d.blkSize
+	if offset >= d.size {
+		return nil, errors.New("Offset too large")
+	}
+	buf := alignedBuf(d.blkSize, d.align)
+	if _, err := d.f.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteBlock writes data to the n-th block, padding it with zeros.
+func (d *directFile) WriteBlock(n uint64, data []byte) error {
+	if uint64(len(data)) > d.blkSize {
+		return errors.New("Data block too large")
+	}
+	offset := n * d.blkSize
+	if offset >= d.size {
+		return errors.New("Offset too large")
+	}
+	buf := d.bufs.Get().([]byte)
+	defer d.bufs.Put(buf)
+	zero(buf[copy(buf, data):])
+	_, err := d.f.WriteAt(buf, int64(offset))
+	return err
+}
+
+func (d *directFile) NumBlocks() uint64 {
+	return d.size / d.blkSize
+}
+
+func (d *directFile) Resize(size uint64) error {
+	if size%d.blkSize != 0 {
+		return fmt.Errorf("File size is not a multiple of the block size: %d size, %d blksize", size, d.blkSize)
+	}
+	if err := d.f.Truncate(int64(size)); err != nil {
+		return err
+	}
+	d.size = size
+	return nil
+}
+
+// Flush does nothing, as writes bypass the page cache on their way to the
+// device.
+func (d *directFile) Flush() error {
+	return nil
+}
+
+// Sync waits for the device to have written the blocks, as direct writes may
+// still sit in its cache.
+func (d *directFile) Sync() error {
+	return d.f.Sync()
+}
+
+func (d *directFile) Close() error {
+	if err := d.f.Sync(); err != nil {
+		d.f.Close()
+		return err
+	}
+	return d.f.Close()
+}
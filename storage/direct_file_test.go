@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+)
+
+// directBlockSize is a multiple of every logical sector size.
+const directBlockSize = 64 * 1024
+
+// skipNoDirect skips tb if err is the file system not supporting O_DIRECT.
+func skipNoDirect(tb testing.TB, err error) {
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	if err == syscall.EINVAL || err == torus.ErrNotSupported {
+		tb.Skip("direct I/O isn't supported here")
+	}
+}
+
+func TestDirectFile(t *testing.T) {
+	n, err := makeTempFilename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(n)
+	d, err := CreateOrOpenDirectFile(n, directBlockSize*4, directBlockSize)
+	if err != nil {
+		skipNoDirect(t, err)
+		t.Fatal(err)
+	}
+	data := []byte("some data")
+	if err := d.WriteBlock(2, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = OpenDirectFile(n, directBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	b, err := d.ReadBlock(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != directBlockSize || !bytes.Equal(b[:len(data)], data) {
+		t.Fatal("Got useless data back")
+	}
+	if !bytes.Equal(b[len(data):], make([]byte, directBlockSize-len(data))) {
+		t.Fatal("block wasn't padded with zeros")
+	}
+	if _, err := d.ReadBlock(4); err == nil {
+		t.Fatal("expected an error reading past the end")
+	}
+}
+
+func TestDirectFileUnalignedBlockSize(t *testing.T) {
+	n, err := makeTempFilename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(n)
+	_, err = CreateOrOpenDirectFile(n, 1000*4, 1000)
+	skipNoDirect(t, err)
+	if err == nil {
+		t.Fatal("expected a block size that isn't a multiple of the sector size to be refused")
+	}
+}
+
+func TestMFileDirectMode(t *testing.T) {
+	dir, err := makeTempFilename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := torus.MkdirsFor(dir); err != nil {
+		t.Fatal(err)
+	}
+	cfg := torus.Config{StorageIOMode: IOModeDirect}
+	gmd := torus.GlobalMetadata{BlockSize: directBlockSize}
+	m, err := openMFileBlock("current", "current", dir, 8*directBlockSize, cfg, gmd)
+	if err != nil {
+		skipNoDirect(t, err)
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := m.WriteBuf(nil, testRef(1)); err != torus.ErrNotSupported {
+		t.Fatalf("expected WriteBuf to be unsupported in direct mode, got %v", err)
+	}
+	data := bytes.Repeat([]byte{7}, directBlockSize)
+	if err := m.WriteBlock(nil, testRef(1), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sync(nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.GetBlock(nil, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Got useless data back")
+	}
+}
+
+// benchmarkMFileIO writes, or reads, blocks of an mfile store in the I/O
+// mode given, syncing every 64 writes.
+func benchmarkMFileIO(b *testing.B, mode string, write bool) {
+	dir, err := makeTempFilename()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := torus.MkdirsFor(dir); err != nil {
+		b.Fatal(err)
+	}
+	const nBlocks = 256 // 16 MB
+	cfg := torus.Config{StorageIOMode: mode}
+	gmd := torus.GlobalMetadata{BlockSize: directBlockSize}
+	m, err := openMFileBlock("current", "current", dir, nBlocks*directBlockSize, cfg, gmd)
+	if err != nil {
+		skipNoDirect(b, err)
+		b.Fatal(err)
+	}
+	defer m.Close()
+	data := bytes.Repeat([]byte{1}, directBlockSize)
+	if !write {
+		for i := 0; i < nBlocks; i++ {
+			if err := m.WriteBlock(nil, testRef(i), data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.SetBytes(directBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ref := testRef(i % nBlocks)
+		if !write {
+			if _, err := m.GetBlock(nil, ref); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		if i >= nBlocks {
+			if err := m.DeleteBlock(nil, ref); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := m.WriteBlock(nil, ref, data); err != nil {
+			b.Fatal(err)
+		}
+		if i%64 == 63 {
+			if err := m.Sync(nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMFileMmapWrites(b *testing.B) {
+	benchmarkMFileIO(b, IOModeMmap, true)
+}
+
+func BenchmarkMFileDirectWrites(b *testing.B) {
+	benchmarkMFileIO(b, IOModeDirect, true)
+}
+
+func BenchmarkMFileMmapReads(b *testing.B) {
+	benchmarkMFileIO(b, IOModeMmap, false)
+}
+
+func BenchmarkMFileDirectReads(b *testing.B) {
+	benchmarkMFileIO(b, IOModeDirect, false)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultSectorSize is assumed when the logical sector size of the device
+// under a file can't be found. Disks use either it or 512 bytes.
+const defaultSectorSize = 4096
+
+func openDirect(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|syscall.O_DIRECT, 0644)
+}
+
+// fdatasync waits for the data of f to be on disk.
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// logicalSectorSize returns the logical sector size of the device fi is on,
+// from sysfs. Partitions take theirs from the disk they're on.
+func logicalSectorSize(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return defaultSectorSize
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return defaultSectorSize
+	}
+	for _, p := range []string{
+		filepath.Join(dir, "queue", "logical_block_size"),
+		filepath.Join(filepath.Dir(dir), "queue", "logical_block_size"),
+	} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err == nil && n != 0 {
+			return n
+		}
+	}
+	return defaultSectorSize
+}
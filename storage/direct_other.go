@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"os"
+
+	"github.com/alternative-storage/torus"
+)
+
+const defaultSectorSize = 4096
+
+func openDirect(path string) (*os.File, error) {
+	return nil, torus.ErrNotSupported
+}
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+func logicalSectorSize(fi os.FileInfo) uint64 {
+	return defaultSectorSize
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/alternative-storage/torus"
+)
+
+// journalMaxBytes is how large the journal of a store may grow before the
+// store is synced and the journal emptied.
+const journalMaxBytes = 64 * 1024 * 1024
+
+const (
+	journalWrite byte = iota + 1
+	journalDelete
+)
+
+// journalHeaderSize is the size of an entry before its data: the operation,
+// the block ref and the length of the data. The entry ends with the CRC32 of
+// all of it.
+const journalHeaderSize = 1 + torus.BlockRefByteSize + 4
+
+// testHookJournalAppended, if set, is called by tests between a block write
+// being journaled and applied to the store.
+var testHookJournalAppended func()
+
+// journal is the write-ahead log of an mfile store. Each block write and
+// delete is appended to it and made durable before it's applied to the store,
+// so that a crash in the middle of applying it, which can leave a block torn,
+// is undone by replaying the journal when the store is opened again. Once the
+// store has been synced, its journal is emptied.
+type journal struct {
+	f    *os.File
+	size int64
+}
+
+func journalPath(dir, label string) string {
+	return filepath.Join(dir, fmt.Sprintf("journal-%s.log", label))
+}
+
+func openJournal(path string) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &journal{f: f, size: fi.Size()}, nil
+}
+
+// append adds an entry for op on ref, with data for writes, and waits for it
+// to be on disk.
+func (j *journal) append(op byte, ref torus.BlockRef, data []byte) error {
+	buf := make([]byte, journalHeaderSize+len(data)+4)
+	buf[0] = op
+	ref.ToBytesBuf(buf[1 : 1+torus.BlockRefByteSize])
+	binary.LittleEndian.PutUint32(buf[1+torus.BlockRefByteSize:], uint32(len(data)))
+	copy(buf[journalHeaderSize:], data)
+	n := len(buf) - 4
+	binary.LittleEndian.PutUint32(buf[n:], crc32.ChecksumIEEE(buf[:n]))
+	if _, err := j.f.WriteAt(buf, j.size); err != nil {
+		return err
+	}
+	if err := fdatasync(j.f); err != nil {
+		return err
+	}
+	j.size += int64(len(buf))
+	return nil
+}
+
+// replay calls f on each entry of the journal in turn. It stops at the first
+// entry that's incomplete or doesn't match its checksum, which is the last
+// append, cut short by a crash before it was applied.
+func (j *journal) replay(f func(op byte, ref torus.BlockRef, data []byte) error) (int, error) {
+	r := io.NewSectionReader(j.f, 0, 1<<62)
+	hdr := make([]byte, journalHeaderSize)
+	n := 0
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return n, nil
+		}
+		op := hdr[0]
+		ref := torus.BlockRefFromBytes(hdr[1 : 1+torus.BlockRefByteSize])
+		l := binary.LittleEndian.Uint32(hdr[1+torus.BlockRefByteSize:])
+		if (op != journalWrite && op != journalDelete) || l > 1<<30 {
+			return n, nil
+		}
+		rest := make([]byte, int(l)+4)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return n, nil
+		}
+		data := rest[:l]
+		sum := crc32.Update(crc32.ChecksumIEEE(hdr), crc32.IEEETable, data)
+		if sum != binary.LittleEndian.Uint32(rest[l:]) {
+			return n, nil
+		}
+		if err := f(op, ref, data); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// reset empties the journal, once the store holds everything in it.
+func (j *journal) reset() error {
+	if j.size == 0 {
+		return nil
+	}
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if err := fdatasync(j.f); err != nil {
+		return err
+	}
+	j.size = 0
+	return nil
+}
+
+// wipe overwrites the journal with zeros, so that the block data in it is
+// gone from the disk, and then empties it.
+func (j *journal) wipe() error {
+	if j.size == 0 {
+		return nil
+	}
+	zeros := make([]byte, 1<<20)
+	for off := int64(0); off < j.size; off += int64(len(zeros)) {
+		n := j.size - off
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+		if _, err := j.f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+	}
+	if err := fdatasync(j.f); err != nil {
+		return err
+	}
+	return j.reset()
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+)
+
+var journalTestData = bytes.Repeat([]byte{0x5a}, BlockSize)
+
+func openJournaledStore(t *testing.T, dir string) *mfileBlock {
+	if err := torus.MkdirsFor(dir); err != nil {
+		t.Fatal(err)
+	}
+	cfg := torus.Config{JournalDir: filepath.Join(dir, "journal")}
+	gmd := torus.GlobalMetadata{BlockSize: BlockSize}
+	m, err := openMFileBlock("current", "current", dir, 8*BlockSize, cfg, gmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// tearBlock overwrites half of the slot of ref, as a write cut short would.
+func tearBlock(t *testing.T, m *mfileBlock, ref torus.BlockRef) {
+	if err := m.dataFile.WriteBlock(uint64(m.refIndex[ref]), make([]byte, BlockSize/2)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkJournaledBlock(t *testing.T, m *mfileBlock, ref torus.BlockRef) {
+	data, err := m.GetBlock(nil, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, journalTestData) {
+		t.Fatal("the block wasn't restored from the journal")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := openJournaledStore(t, dir)
+	if err := m.WriteBlock(nil, testRef(1), journalTestData); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sync(nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.journal.size != 0 {
+		t.Fatalf("expected the journal to be emptied by a sync, it holds %d bytes", m.journal.size)
+	}
+	if _, err := m.WriteBuf(nil, testRef(3)); err != torus.ErrNotSupported {
+		t.Fatalf("expected WriteBuf to be unsupported with a journal, got %v", err)
+	}
+	if err := m.WriteBlock(nil, testRef(2), journalTestData); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteBlock(nil, testRef(1)); err != nil {
+		t.Fatal(err)
+	}
+	tearBlock(t, m, testRef(2))
+	// Leave the store as a crash would, without syncing or closing it.
+	m.stopMaintenance()
+
+	m = openJournaledStore(t, dir)
+	defer m.Close()
+	checkJournaledBlock(t, m, testRef(2))
+	if ok, _ := m.HasBlock(nil, testRef(1)); ok {
+		t.Fatal("the delete wasn't replayed")
+	}
+}
+
+// TestJournalCrashHelper is run by TestJournalCrash in a process of its own,
+// which it kills partway through a block write.
+func TestJournalCrashHelper(t *testing.T) {
+	dir := os.Getenv("TORUS_JOURNAL_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only run by TestJournalCrash")
+	}
+	m := openJournaledStore(t, dir)
+	kill := func() {
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+		select {}
+	}
+	switch os.Getenv("TORUS_JOURNAL_CRASH") {
+	case "append":
+		testHookJournalAppended = kill
+		m.WriteBlock(nil, testRef(1), journalTestData)
+	case "torn":
+		if err := m.WriteBlock(nil, testRef(1), journalTestData); err != nil {
+			t.Fatal(err)
+		}
+		tearBlock(t, m, testRef(1))
+		kill()
+	}
+	t.Fatal("expected to be killed")
+}
+
+func TestJournalCrash(t *testing.T) {
+	for _, stage := range []string{"append", "torn"} {
+		dir, err := ioutil.TempDir("", "torus-journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestJournalCrashHelper$")
+		cmd.Env = append(os.Environ(), "TORUS_JOURNAL_CRASH_DIR="+dir, "TORUS_JOURNAL_CRASH="+stage)
+		err = cmd.Run()
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("%s: expected the helper to be killed, got %v", stage, err)
+		}
+		if ws, ok := ee.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGKILL {
+			t.Fatalf("%s: expected the helper to be killed, got %v", stage, err)
+		}
+
+		m := openJournaledStore(t, dir)
+		checkJournaledBlock(t, m, testRef(1))
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOverwriteJournaledBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torus-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := openJournaledStore(t, dir)
+	defer m.Close()
+	if err := m.WriteBlock(nil, testRef(1), journalTestData); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.OverwriteBlock(nil, testRef(1)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.GetBlock(nil, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, make([]byte, BlockSize)) {
+		t.Fatal("the block wasn't overwritten with zeros")
+	}
+	if m.journal.size != 0 {
+		t.Fatalf("expected the journal to be wiped, it holds %d bytes", m.journal.size)
+	}
+	if err := m.OverwriteBlock(nil, testRef(2)); err != torus.ErrBlockNotExist {
+		t.Fatalf("expected overwriting a missing block to fail, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/context"
 
@@ -22,13 +23,22 @@ func init() {
 
 type mfileBlock struct {
 	mut       sync.RWMutex
-	dataFile  *MFile
+	dataFile  blockFile
 	refFile   *MFile
 	refIndex  map[torus.BlockRef]int
 	closed    bool
 	lastFree  int
 	name      string
+	dir       string
 	blocksize uint64
+	opStats
+	space spaceGuard
+	// journal, if set, logs block writes and deletes before they're applied.
+	journal *journal
+
+	maintStop chan struct{}
+	maintDone chan struct{}
+	stopOnce  sync.Once
 	// NB: Still room for improvement. Free lists, smart allocation, etc.
 }
 
@@ -48,7 +58,17 @@ func loadIndex(m *MFile) (map[torus.BlockRef]int, error) {
 		if bytes.Equal(blankRefBytes, b) {
 			continue
 		}
-		out[torus.BlockRefFromBytes(b)] = int(i)
+		ref := torus.BlockRefFromBytes(b)
+		if j, ok := out[ref]; ok {
+			// The block is stored twice, either by a defragmentation
+			// move cut short or by a write of a block that was already
+			// there. The later slot is the one that's complete.
+			clog.Debugf("block %s stored at both %d and %d; freeing %d", ref, j, i, j)
+			if err := m.WriteBlock(uint64(j), blankRefBytes); err != nil {
+				return nil, err
+			}
+		}
+		out[ref] = int(i)
 	}
 	if clog.LevelAt(capnslog.DEBUG) {
 		var mem runtime.MemStats
@@ -60,20 +80,28 @@ func loadIndex(m *MFile) (map[torus.BlockRef]int, error) {
 }
 
 func newMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	if len(cfg.DataDir) > 1 {
+		return newMultiDirBlockStore(name, cfg, meta)
+	}
+	return openMFileBlock(name, name, cfg.MetadataDir(), cfg.StorageSize, cfg, meta)
+}
 
-	storageSize := cfg.StorageSize
-	offset := cfg.StorageSize % meta.BlockSize
+// openMFileBlock opens the mfile store of the given name in dir, of size
+// bytes, creating it if need be. label names it in metrics and logs.
+func openMFileBlock(name, label, dir string, size uint64, cfg torus.Config, meta torus.GlobalMetadata) (*mfileBlock, error) {
+	storageSize := size
+	offset := size % meta.BlockSize
 	if offset != 0 {
-		storageSize = cfg.StorageSize - offset
+		storageSize = size - offset
 		clog.Infof("resizing to %v bytes to make an even multiple of blocksize: %v\n", storageSize, meta.BlockSize)
 	}
 
 	nBlocks := storageSize / meta.BlockSize
 	promBytesPerBlock.Set(float64(meta.BlockSize))
-	promBlocksAvail.WithLabelValues(name).Set(float64(nBlocks))
-	dpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("data-%s.blk", name))
-	mpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("map-%s.blk", name))
-	d, err := CreateOrOpenMFile(dpath, storageSize, meta.BlockSize)
+	promBlocksAvail.WithLabelValues(label).Set(float64(nBlocks))
+	dpath := filepath.Join(dir, "block", fmt.Sprintf("data-%s.blk", name))
+	mpath := filepath.Join(dir, "block", fmt.Sprintf("map-%s.blk", name))
+	d, err := openDataFile(dpath, storageSize, meta.BlockSize, cfg.StorageIOMode)
 	if err != nil {
 		return nil, err
 	}
@@ -88,14 +116,65 @@ func newMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata
 	if m.NumBlocks() != d.NumBlocks() {
 		panic("non-equal number of blocks between data and metadata")
 	}
-	promBlocks.WithLabelValues(name).Set(float64(len(refIndex)))
-	return &mfileBlock{
+	promBlocks.WithLabelValues(label).Set(float64(len(refIndex)))
+	mb := &mfileBlock{
 		dataFile:  d,
 		refFile:   m,
 		refIndex:  refIndex,
-		name:      name,
+		name:      label,
+		dir:       dir,
 		blocksize: meta.BlockSize,
-	}, nil
+		maintStop: make(chan struct{}),
+		maintDone: make(chan struct{}),
+	}
+	mb.space.setMarks(cfg, nBlocks)
+	if cfg.JournalDir != "" {
+		if err := mb.openJournal(journalPath(cfg.JournalDir, label)); err != nil {
+			mb.close()
+			return nil, err
+		}
+	}
+	go mb.maintain(cfg.DefragInterval)
+	return mb, nil
+}
+
+// openJournal opens the journal at path, and replays what it holds from
+// before the store was last closed.
+func (m *mfileBlock) openJournal(path string) error {
+	j, err := openJournal(path)
+	if err != nil {
+		return err
+	}
+	n, err := j.replay(m.applyJournal)
+	if err == nil && n != 0 {
+		clog.Infof("mfile: replayed %d journal entries for %s", n, m.name)
+		promJournalReplayed.WithLabelValues(m.name).Add(float64(n))
+		err = m.sync()
+	}
+	if err == nil {
+		err = j.reset()
+	}
+	if err != nil {
+		j.Close()
+		return fmt.Errorf("mfile: replaying journal %s: %v", path, err)
+	}
+	m.journal = j
+	return nil
+}
+
+// applyJournal applies a journal entry to the store again. A block already
+// in it is rewritten in place, as its slot may be torn.
+func (m *mfileBlock) applyJournal(op byte, ref torus.BlockRef, data []byte) error {
+	index := m.findIndex(ref)
+	switch {
+	case op == journalDelete && index == -1:
+		return nil
+	case op == journalDelete:
+		return m.deleteBlock(ref)
+	case index != -1:
+		return m.dataFile.WriteBlock(uint64(index), data)
+	}
+	return m.writeBlock(ref, data)
 }
 
 func (m *mfileBlock) Kind() string { return "mfile" }
@@ -119,6 +198,11 @@ func (m *mfileBlock) UsedBlocks() uint64 {
 	return uint64(len(m.refIndex))
 }
 
+// ReadOnly reports whether the store is too full to take new blocks.
+func (m *mfileBlock) ReadOnly() bool {
+	return m.space.check(m.UsedBlocks())
+}
+
 func (m *mfileBlock) Flush() error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
@@ -129,17 +213,113 @@ func (m *mfileBlock) flush() error {
 	err := m.dataFile.Flush()
 
 	if err != nil {
-		return err
+		return m.space.noSpace(err, uint64(len(m.refIndex)))
 	}
 	err = m.refFile.Flush()
 	if err != nil {
+		return m.space.noSpace(err, uint64(len(m.refIndex)))
+	}
+	promStorageFlushes.WithLabelValues(m.name).Inc()
+	return nil
+}
+
+// Sync is like Flush, but waits for the files to be written to disk. The
+// journal, if any, is emptied once they are.
+func (m *mfileBlock) Sync(_ context.Context) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if err := m.sync(); err != nil {
 		return err
 	}
+	if m.journal != nil {
+		return m.journal.reset()
+	}
+	return nil
+}
+
+func (m *mfileBlock) sync() error {
+	err := m.dataFile.Sync()
+	if err != nil {
+		return m.space.noSpace(err, uint64(len(m.refIndex)))
+	}
+	err = m.refFile.Sync()
+	if err != nil {
+		return m.space.noSpace(err, uint64(len(m.refIndex)))
+	}
 	promStorageFlushes.WithLabelValues(m.name).Inc()
 	return nil
 }
 
+// Resize grows or shrinks the store to the one size in sizes, rounded down
+// to a multiple of the block size. Shrinking first moves the blocks past the
+// new end into free slots before it.
+func (m *mfileBlock) Resize(sizes []uint64) error {
+	if len(sizes) != 1 {
+		return fmt.Errorf("storage: %d sizes given for 1 data directory", len(sizes))
+	}
+	return m.resize(sizes[0])
+}
+
+func (m *mfileBlock) resize(size uint64) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return torus.ErrClosed
+	}
+	n := size / m.blocksize
+	if n == 0 {
+		return fmt.Errorf("storage: %d bytes can't hold a block of %d bytes", size, m.blocksize)
+	}
+	old := m.numBlocks()
+	if n == old {
+		return nil
+	}
+	if used := uint64(len(m.refIndex)); n < used {
+		return &torus.ShrinkError{Dir: m.dir, Used: used, Blocks: n}
+	}
+	if n < old {
+		lo, hi := uint64(0), old
+		moved := 0
+		for hi > n {
+			done, err := m.moveLast(&lo, &hi)
+			if err != nil {
+				return fmt.Errorf("storage: moving blocks out of the way of shrinking %s: %v", m.dir, err)
+			}
+			if done {
+				break
+			}
+			moved++
+			promDefragMoves.WithLabelValues(m.name).Inc()
+		}
+		clog.Infof("mfile %s: moved %d blocks to shrink to %d blocks", m.name, moved, n)
+		if err := m.sync(); err != nil {
+			return err
+		}
+	}
+	// The ref file goes first when growing and last when shrinking, so
+	// that it's never shorter than the data file.
+	files := []blockFile{m.refFile, m.dataFile}
+	sizes := []uint64{n * torus.BlockRefByteSize, n * m.blocksize}
+	if n < old {
+		files[0], files[1] = files[1], files[0]
+		sizes[0], sizes[1] = sizes[1], sizes[0]
+	}
+	for i, f := range files {
+		if err := f.Resize(sizes[i]); err != nil {
+			return m.space.noSpace(err, uint64(len(m.refIndex)))
+		}
+	}
+	if uint64(m.lastFree) >= n {
+		m.lastFree = 0
+	}
+	m.space.setBlocks(n)
+	promBlocksAvail.WithLabelValues(m.name).Set(float64(n))
+	clog.Infof("mfile %s: resized from %d to %d blocks", m.name, old, n)
+	return nil
+}
+
 func (m *mfileBlock) Close() error {
+	m.stopMaintenance()
 	m.mut.Lock()
 	defer m.mut.Unlock()
 	return m.close()
@@ -159,7 +339,12 @@ func (m *mfileBlock) close() error {
 		return err
 	}
 	m.closed = true
-	return nil
+	if m.journal != nil {
+		// Closing the files wrote them to disk, so the journal is done with.
+		err = m.journal.reset()
+		m.journal.Close()
+	}
+	return err
 }
 
 func (m *mfileBlock) findIndex(s torus.BlockRef) int {
@@ -199,16 +384,30 @@ func (m *mfileBlock) GetBlock(_ context.Context, s torus.BlockRef) ([]byte, erro
 	defer m.mut.RUnlock()
 	if m.closed {
 		promBlocksFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.readErrors, 1)
 		return nil, torus.ErrClosed
 	}
 	index := m.findIndex(s)
 	if index == -1 {
 		promBlocksFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.readErrors, 1)
 		return nil, torus.ErrBlockNotExist
 	}
 	clog.Tracef("mfile: getting block at index %d", index)
+	data, err := m.dataFile.ReadBlock(uint64(index))
+	if err != nil {
+		promBlocksFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.readErrors, 1)
+		return nil, err
+	}
 	promBlocksRetrieved.WithLabelValues(m.name).Inc()
-	return m.dataFile.GetBlock(uint64(index)), nil
+	atomic.AddUint64(&m.reads, 1)
+	return data, nil
+}
+
+// ReleaseBlock gives back a block returned by GetBlock.
+func (m *mfileBlock) ReleaseBlock(b []byte) {
+	torus.BlockBufs(m.blocksize).Put(b)
 }
 
 func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte) error {
@@ -216,29 +415,68 @@ func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte
 	defer m.mut.Unlock()
 	if m.closed {
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.writeErrors, 1)
 		return torus.ErrClosed
 	}
+	if m.journal == nil {
+		return m.writeBlock(s, data)
+	}
+	if err := m.journal.append(journalWrite, s, data); err != nil {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.writeErrors, 1)
+		return m.space.noSpace(err, uint64(len(m.refIndex)))
+	}
+	if testHookJournalAppended != nil {
+		testHookJournalAppended()
+	}
+	if err := m.writeBlock(s, data); err != nil {
+		return err
+	}
+	return m.checkpoint()
+}
+
+// checkpoint syncs the store and empties the journal once it has grown past
+// journalMaxBytes.
+func (m *mfileBlock) checkpoint() error {
+	if m.journal.size < journalMaxBytes {
+		return nil
+	}
+	if err := m.sync(); err != nil {
+		return err
+	}
+	return m.journal.reset()
+}
+
+func (m *mfileBlock) writeBlock(s torus.BlockRef, data []byte) error {
 	index := m.findEmpty()
 	if index == -1 {
 		clog.Error("mfile: out of space in data")
+		m.space.outOfSpace(uint64(len(m.refIndex)))
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.writeErrors, 1)
 		return torus.ErrOutOfSpace
 	}
 	clog.Tracef("mfile: writing block at index %d", index)
 	err := m.dataFile.WriteBlock(uint64(index), data)
 	if err != nil {
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return err
+		atomic.AddUint64(&m.writeErrors, 1)
+		return m.space.noSpace(err, uint64(len(m.refIndex)))
 	}
 	err = m.refFile.WriteBlock(uint64(index), s.ToBytes())
 	if err != nil {
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		atomic.AddUint64(&m.writeErrors, 1)
 		return err
 	}
 	if v := m.findIndex(s); v != -1 {
 		// we already have it
 		clog.Debug("mfile: block already exists: ", s)
-		olddata := m.dataFile.GetBlock(uint64(v))
+		olddata, err := m.dataFile.ReadBlock(uint64(v))
+		if err != nil {
+			return err
+		}
+		defer m.ReleaseBlock(olddata)
 		if !bytes.Equal(olddata, data) {
 			clog.Error("getting wrong data for block: ", s)
 			clog.Errorf("old: %v, new: %v", olddata[:10], data[:10])
@@ -250,54 +488,71 @@ func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte
 	promBlocks.WithLabelValues(m.name).Inc()
 	m.refIndex[s] = index
 	promBlocksWritten.WithLabelValues(m.name).Inc()
+	atomic.AddUint64(&m.writes, 1)
 	return nil
 }
 
-func (m *mfileBlock) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, error) {
+// WriteBuf returns torus.ErrNotSupported, and blocks must be written with
+// WriteBlock: a slot handed out to be filled in place could be moved or
+// unmapped by a resize before the caller was done with it.
+func (m *mfileBlock) WriteBuf(_ context.Context, _ torus.BlockRef) ([]byte, error) {
+	return nil, torus.ErrNotSupported
+}
+
+func (m *mfileBlock) DeleteBlock(_ context.Context, s torus.BlockRef) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 	if m.closed {
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return nil, torus.ErrClosed
-	}
-	index := m.findEmpty()
-	if index == -1 {
-		clog.Error("mfile: out of space in metadata")
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return nil, torus.ErrOutOfSpace
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		return torus.ErrClosed
 	}
-	clog.Tracef("mfile: writing block at index %d", index)
-	buf := m.dataFile.GetBlock(uint64(index))
-	err := m.refFile.WriteBlock(uint64(index), s.ToBytes())
-	if err != nil {
-		promBlockWritesFailed.WithLabelValues(m.name).Inc()
-		return nil, err
+	if m.findIndex(s) == -1 {
+		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+		clog.Errorf("mfile: deleting non-existent thing? %s", s)
+		return torus.ErrBlockNotExist
 	}
-	if v := m.findIndex(s); v != -1 {
-		// we already have it
-		clog.Debug("mfile: block already exists: ", s)
-		// Not an error, if we already have it
-		return nil, torus.ErrExists
+	if m.journal != nil {
+		if err := m.journal.append(journalDelete, s, nil); err != nil {
+			promBlockDeletesFailed.WithLabelValues(m.name).Inc()
+			return err
+		}
 	}
-	promBlocks.WithLabelValues(m.name).Inc()
-	m.refIndex[s] = index
-	promBlocksWritten.WithLabelValues(m.name).Inc()
-	return buf, nil
+	return m.deleteBlock(s)
 }
 
-func (m *mfileBlock) DeleteBlock(_ context.Context, s torus.BlockRef) error {
+// OverwriteBlock writes zeros over the data of block s and syncs the store.
+// The journal, which may hold the data too, is synced and wiped first.
+func (m *mfileBlock) OverwriteBlock(_ context.Context, s torus.BlockRef) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 	if m.closed {
-		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
 		return torus.ErrClosed
 	}
 	index := m.findIndex(s)
 	if index == -1 {
-		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
-		clog.Errorf("mfile: deleting non-existent thing? %s", s)
 		return torus.ErrBlockNotExist
 	}
+	if m.journal != nil {
+		if err := m.sync(); err != nil {
+			return err
+		}
+		if err := m.journal.wipe(); err != nil {
+			return err
+		}
+	}
+	err := m.dataFile.WriteBlock(uint64(index), make([]byte, m.blocksize))
+	if err != nil {
+		return err
+	}
+	if err := m.sync(); err != nil {
+		return err
+	}
+	promBlocksOverwritten.WithLabelValues(m.name).Inc()
+	return nil
+}
+
+func (m *mfileBlock) deleteBlock(s torus.BlockRef) error {
+	index := m.findIndex(s)
 	err := m.refFile.WriteBlock(uint64(index), blankRefBytes)
 	if err != nil {
 		promBlockDeletesFailed.WithLabelValues(m.name).Inc()
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/alternative-storage/torus"
+)
+
+const (
+	// fragStatsInterval is how often the free space metrics of an mfile
+	// store are brought up to date.
+	fragStatsInterval = time.Minute
+	// defragIdleWait is how long a store must see no reads or writes
+	// before a defragmentation pass starts.
+	defragIdleWait = time.Second
+	// defragThrottle is the pause between two block moves of a pass.
+	defragThrottle = 5 * time.Millisecond
+)
+
+// Fragmentation describes how the free space of a block store is laid out.
+type Fragmentation struct {
+	FreeBlocks uint64
+	// FreeExtents is the number of runs of contiguous free blocks.
+	FreeExtents uint64
+	// LargestExtent is the length in blocks of the longest run.
+	LargestExtent uint64
+}
+
+// Fragmentation scans the store for its free extents.
+func (m *mfileBlock) Fragmentation() Fragmentation {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	var f Fragmentation
+	if m.closed {
+		return f
+	}
+	var run uint64
+	for i := uint64(0); i < m.numBlocks(); i++ {
+		if !m.slotFree(i) {
+			run = 0
+			continue
+		}
+		f.FreeBlocks++
+		if run == 0 {
+			f.FreeExtents++
+		}
+		run++
+		if run > f.LargestExtent {
+			f.LargestExtent = run
+		}
+	}
+	return f
+}
+
+// slotFree reports whether no block is stored at index i. It goes by the ref
+// file rather than the index, as that's what allocation goes by.
+func (m *mfileBlock) slotFree(i uint64) bool {
+	return bytes.Equal(m.refFile.GetBlock(i), blankRefBytes)
+}
+
+func (m *mfileBlock) updateFragMetrics() {
+	f := m.Fragmentation()
+	promFreeExtents.WithLabelValues(m.name).Set(float64(f.FreeExtents))
+	promLargestFreeExtent.WithLabelValues(m.name).Set(float64(f.LargestExtent))
+}
+
+// maintain keeps the fragmentation metrics current and, if defragInterval
+// is set, runs a defragmentation pass that often, until the store is closed.
+func (m *mfileBlock) maintain(defragInterval time.Duration) {
+	defer close(m.maintDone)
+	m.updateFragMetrics()
+	stats := time.NewTicker(fragStatsInterval)
+	defer stats.Stop()
+	var defrag <-chan time.Time
+	if defragInterval > 0 {
+		t := time.NewTicker(defragInterval)
+		defer t.Stop()
+		defrag = t.C
+	}
+	for {
+		select {
+		case <-m.maintStop:
+			return
+		case <-stats.C:
+			m.updateFragMetrics()
+		case <-defrag:
+			before := m.Stats()
+			select {
+			case <-m.maintStop:
+				return
+			case <-time.After(defragIdleWait):
+			}
+			if m.Stats() != before {
+				clog.Debugf("mfile %s: busy, skipping defragmentation", m.name)
+				continue
+			}
+			moved, err := m.defrag(m.maintStop)
+			if err != nil {
+				clog.Errorf("mfile %s: defragmentation failed after moving %d blocks: %v", m.name, moved, err)
+			} else if moved > 0 {
+				clog.Infof("mfile %s: defragmentation moved %d blocks", m.name, moved)
+			}
+			m.updateFragMetrics()
+		}
+	}
+}
+
+// stopMaintenance stops the maintenance loop, if one was started, and waits
+// for a pass in progress to finish its current move.
+func (m *mfileBlock) stopMaintenance() {
+	if m.maintStop == nil {
+		return
+	}
+	m.stopOnce.Do(func() {
+		close(m.maintStop)
+		<-m.maintDone
+	})
+}
+
+// defrag compacts the blocks of the store towards the start of its files,
+// so that the free space ends up in a single extent at the end. Blocks are
+// moved one at a time, from the last used slot to the first free one. The
+// pass stops early when stop is closed, or as soon as the store is read from
+// or written to.
+func (m *mfileBlock) defrag(stop <-chan struct{}) (int, error) {
+	moved := 0
+	lo, hi := uint64(0), m.NumBlocks()
+	idle := m.Stats()
+	for {
+		done, err := m.moveOne(&lo, &hi, idle)
+		if err != nil || done {
+			return moved, err
+		}
+		moved++
+		promDefragMoves.WithLabelValues(m.name).Inc()
+		select {
+		case <-stop:
+			return moved, nil
+		case <-time.After(defragThrottle):
+		}
+	}
+}
+
+// moveOne moves the block in the last used slot below hi to the first free
+// slot at or above lo, and reports whether the pass is over: there's nothing
+// left to move, or the store's counters moved on from idle.
+//
+// Each step is synced to disk before the next: the data is copied, the ref
+// is written at the new slot, then cleared at the old one. A crash before
+// the second step leaves the copy unreferenced, and a crash before the third
+// leaves the block referenced twice, which loadIndex resolves by keeping the
+// later slot. Either way the block is neither lost nor duplicated.
+func (m *mfileBlock) moveOne(lo, hi *uint64, idle torus.BlockStoreStats) (bool, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed || m.Stats() != idle {
+		return true, nil
+	}
+	return m.moveLast(lo, hi)
+}
+
+// moveLast is moveOne for a caller holding the lock, without regard to the
+// store being used.
+func (m *mfileBlock) moveLast(lo, hi *uint64) (bool, error) {
+	var src, dst uint64
+	var ref torus.BlockRef
+	for {
+		for *lo < *hi && !m.slotFree(*lo) {
+			*lo++
+		}
+		for *hi > *lo && m.slotFree(*hi-1) {
+			*hi--
+		}
+		if *lo >= *hi {
+			return true, nil
+		}
+		src, dst = *hi-1, *lo
+		ref = torus.BlockRefFromBytes(m.refFile.GetBlock(src))
+		if v, ok := m.refIndex[ref]; ok && uint64(v) == src {
+			break
+		}
+		// A leftover of writing a block that was already stored. Nothing
+		// refers to it, so the slot is simply freed.
+		if err := m.refFile.WriteBlock(src, blankRefBytes); err != nil {
+			return false, err
+		}
+		if err := m.refFile.Sync(); err != nil {
+			return false, err
+		}
+	}
+	data, err := m.dataFile.ReadBlock(src)
+	if err != nil {
+		return false, err
+	}
+	defer m.ReleaseBlock(data)
+	if err := m.dataFile.WriteBlock(dst, data); err != nil {
+		return false, err
+	}
+	if err := m.dataFile.Sync(); err != nil {
+		return false, err
+	}
+	if err := m.refFile.WriteBlock(dst, ref.ToBytes()); err != nil {
+		return false, err
+	}
+	if err := m.refFile.Sync(); err != nil {
+		return false, err
+	}
+	if err := m.refFile.WriteBlock(src, blankRefBytes); err != nil {
+		return false, err
+	}
+	if err := m.refFile.Sync(); err != nil {
+		return false, err
+	}
+	m.refIndex[ref] = int(dst)
+	// Carry on allocating past the compacted blocks.
+	m.lastFree = int(dst)
+	*lo++
+	*hi--
+	return false, nil
+}
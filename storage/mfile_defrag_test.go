@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+)
+
+func newTestMFileBlock(t *testing.T, n uint64) *mfileBlock {
+	mpath, err := makeTempFilename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := CreateOrOpenMFile(mpath, mBlockSize*n, mBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dpath, err := makeTempFilename()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := CreateOrOpenMFile(dpath, BlockSize*n, BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refIndex, err := loadIndex(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mfileBlock{
+		refFile:  m,
+		dataFile: d,
+		refIndex: refIndex,
+	}
+}
+
+func testRef(i int) torus.BlockRef {
+	return torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, torus.INodeID(i)),
+		Index:    torus.IndexID(i),
+	}
+}
+
+func TestMFileDefrag(t *testing.T) {
+	mfb := newTestMFileBlock(t, 16)
+	defer mfb.Close()
+	for i := 0; i < 12; i++ {
+		if err := mfb.WriteBlock(nil, testRef(i), bytes.Repeat([]byte{byte(i)}, 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{0, 3, 4, 7, 9} {
+		if err := mfb.DeleteBlock(nil, testRef(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := mfb.Fragmentation()
+	if f.FreeBlocks != 9 || f.FreeExtents < 2 {
+		t.Fatalf("expected 9 fragmented free blocks, got %+v", f)
+	}
+
+	moved, err := mfb.defrag(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Fatal("expected blocks to be moved")
+	}
+	f = mfb.Fragmentation()
+	if f.FreeExtents != 1 || f.LargestExtent != 9 {
+		t.Fatalf("expected a single free extent of 9 blocks, got %+v", f)
+	}
+	for i := 0; i < 12; i++ {
+		has, _ := mfb.HasBlock(nil, testRef(i))
+		switch i {
+		case 0, 3, 4, 7, 9:
+			if has {
+				t.Fatalf("deleted block %d came back", i)
+			}
+			continue
+		}
+		b, err := mfb.GetBlock(nil, testRef(i))
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if !bytes.Equal(b[:64], bytes.Repeat([]byte{byte(i)}, 64)) {
+			t.Fatalf("block %d has the wrong data after defragmentation", i)
+		}
+	}
+
+	// Compacted stores are left alone.
+	moved, err = mfb.defrag(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Fatalf("expected nothing to move, moved %d", moved)
+	}
+}
+
+func TestMFileDefragStopsOnIO(t *testing.T) {
+	mfb := newTestMFileBlock(t, 8)
+	defer mfb.Close()
+	for i := 0; i < 6; i++ {
+		if err := mfb.WriteBlock(nil, testRef(i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mfb.DeleteBlock(nil, testRef(0)); err != nil {
+		t.Fatal(err)
+	}
+	lo, hi := uint64(0), mfb.NumBlocks()
+	idle := mfb.Stats()
+	if _, err := mfb.GetBlock(nil, testRef(1)); err != nil {
+		t.Fatal(err)
+	}
+	done, err := mfb.moveOne(&lo, &hi, idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Fatal("expected the pass to stop after a read")
+	}
+}
+
+// A move cut short after the new slot is referenced leaves the block in two
+// slots. Loading the index keeps one of them and frees the other.
+func TestLoadIndexDuplicateRef(t *testing.T) {
+	mfb := newTestMFileBlock(t, 8)
+	defer mfb.Close()
+	ref := testRef(1)
+	if err := mfb.WriteBlock(nil, ref, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	src := uint64(mfb.refIndex[ref])
+	dst := (src + 1) % mfb.NumBlocks()
+	data, err := mfb.dataFile.ReadBlock(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mfb.dataFile.WriteBlock(dst, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfb.refFile.WriteBlock(dst, ref.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := loadIndex(mfb.refFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 1 {
+		t.Fatalf("expected one block, got %d", len(index))
+	}
+	used := 0
+	for i := uint64(0); i < mfb.NumBlocks(); i++ {
+		if !mfb.slotFree(i) {
+			used++
+		}
+	}
+	if used != 1 {
+		t.Fatalf("expected the duplicate slot to be freed, %d slots in use", used)
+	}
+}
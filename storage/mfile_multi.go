@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/alternative-storage/torus"
+)
+
+var _ torus.BlockStore = &multiDirBlock{}
+
+// multiDirBlock spreads the blocks of a node across mfile stores in several
+// data directories, each sized on its own. New blocks go to the least full
+// store that takes them. A directory that fails is left out, and only the
+// blocks it held go missing, for the rebalancer to fetch again.
+//
+// mut only guards the choice of store; each store serializes its own reads
+// and writes, so that those of different directories go on in parallel.
+type multiDirBlock struct {
+	mut sync.RWMutex
+	// refLocks serialize the writes and deletes of each block, so that a
+	// new block can't be placed in two directories at once.
+	refLocks [64]sync.Mutex
+	name     string
+	dirs     []string
+	// stores holds the store of each of dirs, or nil if the directory has
+	// failed.
+	stores    []*mfileBlock
+	closed    bool
+	blocksize uint64
+}
+
+func newMultiDirBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	sizes := cfg.DataDirSizes
+	if len(sizes) != len(cfg.DataDir) {
+		sizes = make([]uint64, len(cfg.DataDir))
+		for i := range sizes {
+			sizes[i] = cfg.StorageSize / uint64(len(sizes))
+		}
+	}
+	m := &multiDirBlock{
+		name:      name,
+		dirs:      cfg.DataDir,
+		stores:    make([]*mfileBlock, len(cfg.DataDir)),
+		blocksize: meta.BlockSize,
+	}
+	live := 0
+	for i, dir := range cfg.DataDir {
+		label := fmt.Sprintf("%s-%d", name, i)
+		mb, err := openMFileBlock(name, label, dir, sizes[i], cfg, meta)
+		if err != nil {
+			clog.Errorf("couldn't open storage in %s, leaving it out: %v", dir, err)
+			promFailedDirs.Inc()
+			continue
+		}
+		m.stores[i] = mb
+		live++
+	}
+	if live == 0 {
+		return nil, errors.New("storage: none of the data directories could be opened")
+	}
+	return m, nil
+}
+
+func (m *multiDirBlock) Kind() string { return "mfile" }
+
+func (m *multiDirBlock) BlockSize() uint64 { return m.blocksize }
+
+func (m *multiDirBlock) NumBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	var n uint64
+	for _, s := range m.stores {
+		if s != nil {
+			n += s.NumBlocks()
+		}
+	}
+	return n
+}
+
+func (m *multiDirBlock) UsedBlocks() uint64 {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	var n uint64
+	for _, s := range m.stores {
+		if s != nil {
+			n += s.UsedBlocks()
+		}
+	}
+	return n
+}
+
+// ReadOnly reports whether none of the stores can take new blocks.
+func (m *multiDirBlock) ReadOnly() bool {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	for _, s := range m.stores {
+		if s != nil && !s.ReadOnly() {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multiDirBlock) Stats() torus.BlockStoreStats {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	var out torus.BlockStoreStats
+	for _, s := range m.stores {
+		if s == nil {
+			continue
+		}
+		st := s.Stats()
+		out.Reads += st.Reads
+		out.ReadErrors += st.ReadErrors
+		out.Writes += st.Writes
+		out.WriteErrors += st.WriteErrors
+	}
+	return out
+}
+
+// refLock returns the lock serializing the writes and deletes of ref.
+func (m *multiDirBlock) refLock(ref torus.BlockRef) *sync.Mutex {
+	h := uint64(ref.Volume())*31 + uint64(ref.INode)*17 + uint64(ref.Index)
+	return &m.refLocks[h%uint64(len(m.refLocks))]
+}
+
+// lookup returns the store holding ref, or nil and the stores a new block
+// may go to if none does.
+func (m *multiDirBlock) lookup(ref torus.BlockRef) (*mfileBlock, []*mfileBlock, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if m.closed {
+		return nil, nil, torus.ErrClosed
+	}
+	if s := m.owner(ref); s != nil {
+		return s, nil, nil
+	}
+	return nil, m.placement(), nil
+}
+
+// dirFailed reports whether err, returned by the store of a data directory,
+// means that the directory has failed, rather than the request.
+func dirFailed(err error) bool {
+	switch err {
+	case nil, torus.ErrBlockNotExist, torus.ErrExists, torus.ErrOutOfSpace, torus.ErrClosed, torus.ErrNotSupported:
+		return false
+	}
+	return true
+}
+
+// tryNext reports whether a new block that a store failed to take with err
+// may go to the next one.
+func tryNext(err error) bool {
+	return err == torus.ErrOutOfSpace || err == torus.ErrClosed || dirFailed(err)
+}
+
+// fail leaves out s, which err was returned by, if err means that its
+// directory has failed. It returns err.
+func (m *multiDirBlock) fail(s *mfileBlock, err error) error {
+	if !dirFailed(err) {
+		return err
+	}
+	m.mut.Lock()
+	failed := false
+	for i, x := range m.stores {
+		if x == s {
+			clog.Errorf("storage in %s failed, leaving it out: %v", m.dirs[i], err)
+			m.stores[i] = nil
+			promFailedDirs.Inc()
+			failed = true
+		}
+	}
+	m.mut.Unlock()
+	if failed {
+		s.Close()
+	}
+	return err
+}
+
+// owner returns the store holding ref, or nil if none does.
+func (m *multiDirBlock) owner(ref torus.BlockRef) *mfileBlock {
+	for _, s := range m.stores {
+		if s == nil {
+			continue
+		}
+		if ok, _ := s.HasBlock(nil, ref); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+type storeUse struct {
+	store *mfileBlock
+	used  float64
+}
+
+type storesByUse []storeUse
+
+func (s storesByUse) Len() int           { return len(s) }
+func (s storesByUse) Less(i, j int) bool { return s[i].used < s[j].used }
+func (s storesByUse) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// placement returns the stores a new block may go to, least full first.
+// Stores that are read-only are left out.
+func (m *multiDirBlock) placement() []*mfileBlock {
+	var use storesByUse
+	for _, s := range m.stores {
+		if s == nil || s.ReadOnly() || s.NumBlocks() == 0 {
+			continue
+		}
+		use = append(use, storeUse{s, float64(s.UsedBlocks()) / float64(s.NumBlocks())})
+	}
+	sort.Stable(use)
+	out := make([]*mfileBlock, len(use))
+	for i, u := range use {
+		out[i] = u.store
+	}
+	return out
+}
+
+func (m *multiDirBlock) HasBlock(_ context.Context, ref torus.BlockRef) (bool, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.owner(ref) != nil, nil
+}
+
+// ReleaseBlock gives back a block returned by GetBlock. All the directories
+// share the same pool of buffers.
+func (m *multiDirBlock) ReleaseBlock(b []byte) {
+	torus.BlockBufs(m.blocksize).Put(b)
+}
+
+func (m *multiDirBlock) GetBlock(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	s, _, err := m.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, torus.ErrBlockNotExist
+	}
+	data, err := s.GetBlock(ctx, ref)
+	return data, m.fail(s, err)
+}
+
+func (m *multiDirBlock) WriteBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
+	l := m.refLock(ref)
+	l.Lock()
+	defer l.Unlock()
+	s, placement, err := m.lookup(ref)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		return m.fail(s, s.WriteBlock(ctx, ref, data))
+	}
+	for _, s := range placement {
+		err := m.fail(s, s.WriteBlock(ctx, ref, data))
+		if tryNext(err) {
+			continue
+		}
+		return err
+	}
+	return torus.ErrOutOfSpace
+}
+
+// WriteBuf returns torus.ErrNotSupported, as its stores do.
+func (m *multiDirBlock) WriteBuf(_ context.Context, _ torus.BlockRef) ([]byte, error) {
+	return nil, torus.ErrNotSupported
+}
+
+func (m *multiDirBlock) DeleteBlock(ctx context.Context, ref torus.BlockRef) error {
+	l := m.refLock(ref)
+	l.Lock()
+	defer l.Unlock()
+	s, _, err := m.lookup(ref)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		clog.Errorf("mfile: deleting non-existent thing? %s", ref)
+		return torus.ErrBlockNotExist
+	}
+	return m.fail(s, s.DeleteBlock(ctx, ref))
+}
+
+func (m *multiDirBlock) OverwriteBlock(ctx context.Context, ref torus.BlockRef) error {
+	l := m.refLock(ref)
+	l.Lock()
+	defer l.Unlock()
+	s, _, err := m.lookup(ref)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return torus.ErrBlockNotExist
+	}
+	return m.fail(s, s.OverwriteBlock(ctx, ref))
+}
+
+func (m *multiDirBlock) Flush() error {
+	return m.each(func(s *mfileBlock) error { return s.Flush() })
+}
+
+// Sync is like Flush, but waits for the files to be written to disk.
+func (m *multiDirBlock) Sync(ctx context.Context) error {
+	return m.each(func(s *mfileBlock) error { return s.Sync(ctx) })
+}
+
+// each calls f on every live store. A store f fails on with an error that
+// means its directory has failed is left out from then on, along with the
+// blocks it holds. The first error is returned.
+func (m *multiDirBlock) each(f func(*mfileBlock) error) error {
+	m.mut.RLock()
+	stores := append([]*mfileBlock(nil), m.stores...)
+	m.mut.RUnlock()
+	var first error
+	for _, s := range stores {
+		if s == nil {
+			continue
+		}
+		if err := m.fail(s, f(s)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Resize resizes the store in each data directory to its size in sizes.
+// Directories that have failed are skipped. Nothing is resized unless every
+// store can take its new size.
+func (m *multiDirBlock) Resize(sizes []uint64) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if len(sizes) != len(m.dirs) {
+		return fmt.Errorf("storage: %d sizes given for %d data directories", len(sizes), len(m.dirs))
+	}
+	for i, s := range m.stores {
+		if s == nil {
+			continue
+		}
+		n := sizes[i] / m.blocksize
+		if used := s.UsedBlocks(); n < used {
+			return &torus.ShrinkError{Dir: m.dirs[i], Used: used, Blocks: n}
+		}
+	}
+	for i, s := range m.stores {
+		if s == nil {
+			continue
+		}
+		if err := s.resize(sizes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multiDirBlock) Close() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var first error
+	for _, s := range m.stores {
+		if s == nil {
+			continue
+		}
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m *multiDirBlock) BlockIterator() torus.BlockIterator {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	var l []torus.BlockRef
+	for _, s := range m.stores {
+		if s == nil {
+			continue
+		}
+		s.mut.RLock()
+		for k := range s.refIndex {
+			l = append(l, k)
+		}
+		s.mut.RUnlock()
+	}
+	return &mfileIterator{
+		set: l,
+		i:   -1,
+	}
+}
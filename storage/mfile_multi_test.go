@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestMultiDirBlock(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "torus-multidir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := torus.MkdirsFor(dir); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+	// The third directory can't hold storage, and is left out.
+	bad := filepath.Join(dirs[2], "block")
+	if err := os.Remove(bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := torus.Config{
+		DataDir:      dirs,
+		DataDirSizes: []uint64{4 * BlockSize, 8 * BlockSize, 8 * BlockSize},
+		StorageSize:  20 * BlockSize,
+	}
+	gmd := torus.GlobalMetadata{BlockSize: BlockSize}
+	open := func() *multiDirBlock {
+		s, err := newMFileBlockStore("current", cfg, gmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(*multiDirBlock)
+	}
+
+	m := open()
+	if m.NumBlocks() != 12 {
+		t.Fatalf("expected 12 blocks in the usable directories, got %d", m.NumBlocks())
+	}
+	for i := 0; i < 12; i++ {
+		if err := m.WriteBlock(nil, testRef(i), bytes.Repeat([]byte{byte(i)}, 64)); err != nil {
+			t.Fatalf("writing block %d: %v", i, err)
+		}
+	}
+	if err := m.WriteBlock(nil, testRef(12), make([]byte, 64)); err != torus.ErrOutOfSpace {
+		t.Fatalf("expected ErrOutOfSpace once every directory is full, got %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = open()
+	if m.UsedBlocks() != 12 {
+		t.Fatalf("expected 12 blocks after reopening, got %d", m.UsedBlocks())
+	}
+	if err := m.DeleteBlock(nil, testRef(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the first directory loses only the blocks it held.
+	if err := os.RemoveAll(filepath.Join(dirs[0], "block")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirs[0], "block"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m = open()
+	defer m.Close()
+	if m.NumBlocks() != 8 || m.UsedBlocks() != 8 {
+		t.Fatalf("expected the second directory's 8 blocks, got %d of %d used", m.UsedBlocks(), m.NumBlocks())
+	}
+	n := 0
+	it := m.BlockIterator()
+	for it.Next() {
+		ref := it.BlockRef()
+		data, err := m.GetBlock(nil, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[:64], bytes.Repeat([]byte{byte(ref.Index)}, 64)) {
+			t.Fatalf("wrong data for %s", ref)
+		}
+		n++
+	}
+	it.Close()
+	if n != 8 {
+		t.Fatalf("expected to iterate over 8 blocks, got %d", n)
+	}
+}
+
+// failingFile is a blockFile whose reads and writes fail.
+type failingFile struct {
+	blockFile
+}
+
+func (failingFile) ReadBlock(n uint64) ([]byte, error)     { return nil, errors.New("input/output error") }
+func (failingFile) WriteBlock(n uint64, data []byte) error { return errors.New("input/output error") }
+
+func TestMultiDirBlockIOError(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "torus-multidir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := torus.MkdirsFor(dir); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+	cfg := torus.Config{
+		DataDir:     dirs,
+		StorageSize: 16 * BlockSize,
+	}
+	s, err := newMFileBlockStore("current", cfg, torus.GlobalMetadata{BlockSize: BlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := s.(*multiDirBlock)
+	defer m.Close()
+	if err := m.WriteBlock(nil, testRef(1), make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	var owner int
+	for i, s := range m.stores {
+		if ok, _ := s.HasBlock(nil, testRef(1)); ok {
+			owner = i
+		}
+	}
+	failed := m.stores[owner]
+	failed.mut.Lock()
+	failed.dataFile = failingFile{failed.dataFile}
+	failed.mut.Unlock()
+
+	// A read that fails on the disk leaves the directory out, and new
+	// blocks go to the other one.
+	if _, err := m.GetBlock(nil, testRef(1)); err == nil {
+		t.Fatal("expected the read to fail")
+	}
+	if m.stores[owner] != nil {
+		t.Fatal("expected the failed directory to be left out")
+	}
+	if ok, _ := m.HasBlock(nil, testRef(1)); ok {
+		t.Fatal("expected the block of the failed directory to be gone")
+	}
+	for i := 2; i < 6; i++ {
+		if err := m.WriteBlock(nil, testRef(i), make([]byte, 64)); err != nil {
+			t.Fatalf("writing block %d: %v", i, err)
+		}
+	}
+	if n := m.stores[1-owner].UsedBlocks(); n != 4 {
+		t.Fatalf("expected 4 blocks in the remaining directory, got %d", n)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"reflect"
 	"testing"
@@ -87,3 +88,71 @@ func TestWriteBlock(t *testing.T) {
 		t.Fatal("Failed to delete")
 	}
 }
+
+func TestMFileResize(t *testing.T) {
+	mfb := newTestMFileBlock(t, 16)
+	mfb.blocksize = BlockSize
+	defer mfb.Close()
+	for i := 0; i < 12; i++ {
+		if err := mfb.WriteBlock(nil, testRef(i), bytes.Repeat([]byte{byte(i)}, 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{0, 3, 4, 7, 9} {
+		if err := mfb.DeleteBlock(nil, testRef(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Blocks read before resizing stay readable after, as reads served
+	// from the store may still be using them.
+	held, err := mfb.GetBlock(nil, testRef(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slots aren't handed out to be filled in place, as resizing could
+	// move them from under the writer.
+	if _, err := mfb.WriteBuf(nil, testRef(12)); err != torus.ErrNotSupported {
+		t.Fatalf("expected WriteBuf to be unsupported, got %v", err)
+	}
+
+	err = mfb.Resize([]uint64{6 * BlockSize})
+	if se, ok := err.(*torus.ShrinkError); !ok || se.Used != 7 || se.Blocks != 6 {
+		t.Fatalf("expected shrinking below the blocks in use to fail, got %v", err)
+	}
+	if mfb.NumBlocks() != 16 {
+		t.Fatalf("expected a failed shrink to leave 16 blocks, got %d", mfb.NumBlocks())
+	}
+
+	if err := mfb.Resize([]uint64{8*BlockSize + 100}); err != nil {
+		t.Fatal(err)
+	}
+	if mfb.NumBlocks() != 8 || mfb.UsedBlocks() != 7 {
+		t.Fatalf("expected 7 of 8 blocks used, got %d of %d", mfb.UsedBlocks(), mfb.NumBlocks())
+	}
+	for _, i := range []int{1, 2, 5, 6, 8, 10, 11} {
+		data, err := mfb.GetBlock(nil, testRef(i))
+		if err != nil {
+			t.Fatalf("block %d lost by shrinking: %v", i, err)
+		}
+		if !bytes.Equal(data[:64], bytes.Repeat([]byte{byte(i)}, 64)) {
+			t.Fatalf("block %d corrupted by shrinking", i)
+		}
+	}
+
+	if err := mfb.Resize([]uint64{20 * BlockSize}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(held[:64], bytes.Repeat([]byte{11}, 64)) {
+		t.Fatal("block read before resizing changed")
+	}
+	for i := 20; i < 33; i++ {
+		if err := mfb.WriteBlock(nil, testRef(i), bytes.Repeat([]byte{byte(i)}, 64)); err != nil {
+			t.Fatalf("expected room for block %d after growing: %v", i, err)
+		}
+	}
+	if err := mfb.WriteBlock(nil, testRef(40), []byte{1}); err != torus.ErrOutOfSpace {
+		t.Fatalf("expected the grown store to be full, got %v", err)
+	}
+}
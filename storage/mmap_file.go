@@ -5,31 +5,42 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/alternative-storage/torus"
 	"github.com/barakmich/mmap-go"
 )
 
 type MFile struct {
+	path    string
 	mmap    mmap.MMap
 	blkSize uint64
 	size    uint64
 }
 
 func CreateOrOpenMFile(path string, size uint64, blkSize uint64) (*MFile, error) {
+	if err := sizeFile(path, size); err != nil {
+		return nil, err
+	}
+	return OpenMFile(path, blkSize)
+}
+
+// sizeFile creates the file at path with size bytes, or expands it to size if
+// it's smaller.
+func sizeFile(path string, size uint64) error {
 	finfo, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		err := CreateMFile(path, size)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 	if finfo != nil && finfo.Size() != int64(size) {
 		if finfo.Size() > int64(size) {
-			return nil, fmt.Errorf("Specified size %d is smaller than current size %d.", size, finfo.Size())
+			return fmt.Errorf("Specified size %d is smaller than current size %d.", size, finfo.Size())
 		}
 		clog.Debugf("mfile: expand %s %d to %d", path, finfo.Size(), size)
 		os.Truncate(path, int64(size))
 	}
-	return OpenMFile(path, blkSize)
+	return nil
 }
 
 func CreateMFile(path string, size uint64) error {
@@ -65,9 +76,44 @@ func OpenMFile(path string, blkSize uint64) (*MFile, error) {
 		return nil, err
 	}
 	mf.blkSize = blkSize
+	mf.path = path
 	return &mf, nil
 }
 
+// Resize changes the size of the file to size bytes, and maps it again.
+// Blocks past the new end are lost, and slices returned by GetBlock before
+// are invalid; ReadBlock copies blocks out of the mapping so that those it
+// returns stay valid.
+func (m *MFile) Resize(size uint64) error {
+	if size%m.blkSize != 0 {
+		return fmt.Errorf("File size is not a multiple of the block size: %d size, %d blksize", size, m.blkSize)
+	}
+	if err := m.mmap.Flush(); err != nil {
+		return err
+	}
+	if err := m.mmap.Unmap(); err != nil {
+		return err
+	}
+	// Map the file again even if truncating it failed, at whatever size it
+	// has, so that the store stays usable.
+	terr := os.Truncate(m.path, int64(size))
+	f, err := os.OpenFile(m.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	m.mmap, err = mmap.Map(f, mmap.RDWR, 0)
+	if err != nil {
+		return err
+	}
+	m.size = uint64(st.Size())
+	return terr
+}
+
 // GetBlock returns the n-th block as a byte slice, including any trailing zero padding.
 // The returned bytes are from the underlying mmap'd buffer and will be invalid after a call to Close().
 func (m *MFile) GetBlock(n uint64) []byte {
@@ -78,6 +124,18 @@ func (m *MFile) GetBlock(n uint64) []byte {
 	return m.mmap[offset : offset+m.blkSize]
 }
 
+// ReadBlock is GetBlock for blockFile, failing past the end of the file. It
+// returns a copy of the block, as the mapping may be replaced by Resize while
+// the caller still uses it. The copy comes from torus.BlockBufs, and may be
+// put back there once the caller is done with it.
+func (m *MFile) ReadBlock(n uint64) ([]byte, error) {
+	blk := m.GetBlock(n)
+	if blk == nil {
+		return nil, errors.New("Offset too large")
+	}
+	return torus.BlockBufs(m.blkSize).Copy(blk), nil
+}
+
 // NumBlocks returns the total capacity of the file in blocks.
 func (m *MFile) NumBlocks() uint64 {
 	return m.size / m.blkSize
@@ -109,6 +167,11 @@ func (m *MFile) Flush() error {
 	return m.mmap.FlushAsync()
 }
 
+// Sync writes the file to disk and waits for it to be written, unlike Flush.
+func (m *MFile) Sync() error {
+	return m.mmap.Flush()
+}
+
 func (m *MFile) Close() error {
 	if err := m.mmap.Flush(); err != nil {
 		return err
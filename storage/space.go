@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/alternative-storage/torus"
+)
+
+// spaceGuard turns a block store read-only once it fills up past its
+// high-water mark, or the disk under it runs out of space, and writable again
+// once it is back under its low-water mark.
+type spaceGuard struct {
+	mut sync.Mutex
+	// high and low are the marks in blocks. A zero high disables them, and
+	// only running out of space turns the store read-only.
+	high, low uint64
+	// highPct and lowPct are the marks as percentages of the store.
+	highPct, lowPct int
+	readOnly        bool
+	// clearAt is the number of used blocks under which the store turns
+	// writable again.
+	clearAt uint64
+}
+
+// setMarks sets the marks of g from the percentages of cfg, for a store of
+// nBlocks blocks.
+func (g *spaceGuard) setMarks(cfg torus.Config, nBlocks uint64) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.highPct, g.lowPct = cfg.HighWaterMark, cfg.LowWaterMark
+	g.resize(nBlocks)
+}
+
+// setBlocks sets the marks of g again for a store resized to nBlocks blocks.
+// A read-only store turns writable again once it's under the new low-water
+// mark.
+func (g *spaceGuard) setBlocks(nBlocks uint64) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.resize(nBlocks)
+	if g.readOnly && g.high != 0 {
+		g.clearAt = g.low
+	}
+}
+
+func (g *spaceGuard) resize(nBlocks uint64) {
+	g.high = nBlocks * uint64(g.highPct) / 100
+	g.low = nBlocks * uint64(g.lowPct) / 100
+	if g.low > g.high {
+		g.low = g.high
+	}
+}
+
+// outOfSpace turns the store read-only after a write failed for lack of
+// space, with used blocks in it. It turns writable again once it has freed
+// as many blocks as lie between the marks, and is under the low-water mark.
+func (g *spaceGuard) outOfSpace(used uint64) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	gap := g.high - g.low
+	if gap == 0 {
+		gap = 1
+	}
+	clearAt := uint64(0)
+	if used > gap {
+		clearAt = used - gap
+	}
+	if g.high != 0 && clearAt > g.low {
+		clearAt = g.low
+	}
+	if !g.readOnly {
+		clog.Errorf("storage: out of space with %d blocks used, taking no new blocks", used)
+	}
+	g.readOnly = true
+	g.clearAt = clearAt
+}
+
+// check updates the state of the store from the blocks it uses, and reports
+// whether it is read-only.
+func (g *spaceGuard) check(used uint64) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	switch {
+	case !g.readOnly && g.high != 0 && used >= g.high:
+		clog.Warningf("storage: %d blocks used, past the high-water mark of %d; taking no new blocks", used, g.high)
+		g.readOnly = true
+		g.clearAt = g.low
+	case g.readOnly && used < g.clearAt:
+		clog.Infof("storage: %d blocks used, under the low-water mark; taking new blocks again", used)
+		g.readOnly = false
+	}
+	return g.readOnly
+}
+
+// noSpace returns torus.ErrOutOfSpace in place of err if err is the disk
+// running out of space, turning the store read-only, and err otherwise.
+func (g *spaceGuard) noSpace(err error, used uint64) error {
+	if !isNoSpace(err) {
+		return err
+	}
+	g.outOfSpace(used)
+	return torus.ErrOutOfSpace
+}
+
+func isNoSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC
+}
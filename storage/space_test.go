@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/alternative-storage/torus"
+)
+
+func TestMFileWaterMarks(t *testing.T) {
+	mfb := newTestMFileBlock(t, 8)
+	defer mfb.Close()
+	mfb.space.setMarks(torus.Config{HighWaterMark: 50, LowWaterMark: 25}, 8)
+	data := bytes.Repeat([]byte{1}, 64)
+	for i := 0; i < 4; i++ {
+		if mfb.ReadOnly() {
+			t.Fatalf("read-only with %d of 8 blocks used", i)
+		}
+		if err := mfb.WriteBlock(nil, testRef(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !mfb.ReadOnly() {
+		t.Fatal("expected read-only at the high-water mark")
+	}
+	for i := 0; i < 2; i++ {
+		if err := mfb.DeleteBlock(nil, testRef(i)); err != nil {
+			t.Fatal(err)
+		}
+		if !mfb.ReadOnly() {
+			t.Fatal("expected to stay read-only down to the low-water mark")
+		}
+	}
+	if err := mfb.DeleteBlock(nil, testRef(2)); err != nil {
+		t.Fatal(err)
+	}
+	if mfb.ReadOnly() {
+		t.Fatal("expected writable under the low-water mark")
+	}
+}
+
+func TestSpaceGuardOutOfSpace(t *testing.T) {
+	var g spaceGuard
+	g.setMarks(torus.Config{HighWaterMark: 90, LowWaterMark: 80}, 100)
+	err := g.noSpace(&os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}, 50)
+	if err != torus.ErrOutOfSpace {
+		t.Fatalf("expected ErrOutOfSpace, got %v", err)
+	}
+	if !g.check(45) {
+		t.Fatal("expected to stay read-only until the gap between the marks is freed")
+	}
+	if g.check(39) {
+		t.Fatal("expected writable after freeing the gap between the marks")
+	}
+	other := syscall.EIO
+	if err := g.noSpace(other, 39); err != other {
+		t.Fatalf("expected other errors to pass through, got %v", err)
+	}
+	if g.check(39) {
+		t.Fatal("expected other errors to leave the store writable")
+	}
+}
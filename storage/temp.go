@@ -2,6 +2,7 @@ package storage
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/context"
 
@@ -20,6 +21,7 @@ type tempBlockStore struct {
 	nBlocks   uint64
 	name      string
 	blockSize uint64
+	opStats
 }
 
 func openTempBlockStore(name string, cfg torus.Config, gmd torus.GlobalMetadata) (torus.BlockStore, error) {
@@ -73,15 +75,18 @@ func (t *tempBlockStore) GetBlock(_ context.Context, s torus.BlockRef) ([]byte,
 
 	if t.store == nil {
 		promBlocksFailed.WithLabelValues(t.name).Inc()
+		atomic.AddUint64(&t.readErrors, 1)
 		return nil, torus.ErrClosed
 	}
 
 	x, ok := t.store[s]
 	if !ok {
 		promBlocksFailed.WithLabelValues(t.name).Inc()
+		atomic.AddUint64(&t.readErrors, 1)
 		return nil, torus.ErrBlockNotExist
 	}
 	promBlocksRetrieved.WithLabelValues(t.name).Inc()
+	atomic.AddUint64(&t.reads, 1)
 	return x, nil
 }
 
@@ -91,6 +96,7 @@ func (t *tempBlockStore) WriteBlock(_ context.Context, s torus.BlockRef, data []
 
 	if t.store == nil {
 		promBlockWritesFailed.WithLabelValues(t.name).Inc()
+		atomic.AddUint64(&t.writeErrors, 1)
 		return torus.ErrClosed
 	}
 	if int(t.nBlocks) <= len(t.store) {
@@ -101,6 +107,7 @@ func (t *tempBlockStore) WriteBlock(_ context.Context, s torus.BlockRef, data []
 	t.store[s] = buf
 	promBlocks.WithLabelValues(t.name).Set(float64(len(t.store)))
 	promBlocksWritten.WithLabelValues(t.name).Inc()
+	atomic.AddUint64(&t.writes, 1)
 	return nil
 }
 
@@ -110,6 +117,7 @@ func (t *tempBlockStore) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte,
 
 	if t.store == nil {
 		promBlockWritesFailed.WithLabelValues(t.name).Inc()
+		atomic.AddUint64(&t.writeErrors, 1)
 		return nil, torus.ErrClosed
 	}
 	if int(t.nBlocks) <= len(t.store) {
@@ -119,6 +127,7 @@ func (t *tempBlockStore) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte,
 	t.store[s] = buf
 	promBlocks.WithLabelValues(t.name).Set(float64(len(t.store)))
 	promBlocksWritten.WithLabelValues(t.name).Inc()
+	atomic.AddUint64(&t.writes, 1)
 	return buf, nil
 }
 
@@ -137,6 +146,25 @@ func (t *tempBlockStore) DeleteBlock(_ context.Context, s torus.BlockRef) error
 	return nil
 }
 
+// OverwriteBlock zeroes the buffer of block s.
+func (t *tempBlockStore) OverwriteBlock(_ context.Context, s torus.BlockRef) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.store == nil {
+		return torus.ErrClosed
+	}
+	x, ok := t.store[s]
+	if !ok {
+		return torus.ErrBlockNotExist
+	}
+	for i := range x {
+		x[i] = 0
+	}
+	promBlocksOverwritten.WithLabelValues(t.name).Inc()
+	return nil
+}
+
 func (t *tempBlockStore) BlockIterator() torus.BlockIterator {
 	t.mut.RLock()
 	defer t.mut.RUnlock()
@@ -0,0 +1,25 @@
+package torus
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+)
+
+// StartChildSpan starts a span for op as a child of the span in ctx, and
+// returns it with a context carrying it. If ctx carries no span, op isn't
+// part of any trace and the span returned does nothing, so that only the
+// operations that begin a trace decide whether it is sampled.
+func StartChildSpan(ctx context.Context, op string) (opentracing.Span, context.Context) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return opentracing.NoopTracer{}.StartSpan(op), ctx
+	}
+	span := parent.Tracer().StartSpan(op, opentracing.ChildOf(parent.Context()))
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// SetBlockRefTags tags span with the block it operates on, and its volume.
+func SetBlockRefTags(span opentracing.Span, ref BlockRef) {
+	span.SetTag("block", ref.String())
+	span.SetTag("volume", uint64(ref.Volume()))
+}
@@ -1,18 +1,28 @@
 package jaeger
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/uber/jaeger-client-go/config"
 )
 
-// Init creates a new instance of tracer and set it as GlobalTracer.
-func Init(serviceName string) error {
+// DefaultSampleRate is the fraction of traces sampled by default. Tracing
+// every block operation would cost too much on a busy node.
+const DefaultSampleRate = 0.001
+
+// Init creates a new instance of tracer and set it as GlobalTracer. The
+// tracer samples the given fraction of the traces begun on this node; the
+// traces a peer sends requests with are sampled as the peer decided.
+func Init(serviceName string, sampleRate float64) error {
+	if sampleRate < 0 || sampleRate > 1 {
+		return fmt.Errorf("trace sample rate must be between 0 and 1: %v", sampleRate)
+	}
 	cfg := config.Configuration{
 		Sampler: &config.SamplerConfig{
-			Type:  "const",
-			Param: 1,
+			Type:  "probabilistic",
+			Param: sampleRate,
 		},
 		Reporter: &config.ReporterConfig{
 			LogSpans: true,